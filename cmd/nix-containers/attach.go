@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var attachCmd = &cobra.Command{
+	Use:   "attach --subject REF --artifact-type TYPE --file PATH",
+	Short: "Attach a file to a pushed image as an OCI referrer artifact",
+	Long:  "Uploads PATH as the blob of an artifact manifest whose subject is the digest REF resolves to, so that it is listed by the OCI Referrers API of the image. Registries without the Referrers API get the artifact added to the referrers tag of the image instead.",
+	Example: "# Attach a test report to the image CI pushed\n" +
+		"./nix-containers attach --subject ghcr.io/you/app:sha-abc123 \\\n" +
+		"  --artifact-type application/vnd.example.test-report+json --file report.json \\\n" +
+		"  --annotation org.example.suite=e2e",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		raw := strings.TrimSpace(viper.GetString("attach_subject"))
+		if raw == "" {
+			return errors.New("--subject is required")
+		}
+		subject, err := name.ParseReference(raw)
+		if err != nil {
+			return fmt.Errorf("invalid subject reference %q: %w", raw, err)
+		}
+		attachment, err := getAttachment()
+		if err != nil {
+			return err
+		}
+		auth, err := getRegistryAuth([]string{subject.Context().RegistryStr()})
+		if err != nil {
+			return err
+		}
+		ctx, cancel := nixcontainers.PhaseTimeoutContext(cmd.Context(), "push", getPushTimeout())
+		defer cancel()
+		err = attachArtifact(
+			ctx,
+			cmd.OutOrStdout(),
+			subject,
+			attachment,
+			remote.WithAuthFromKeychain(auth.keychain),
+		)
+		return nixcontainers.WrapPhaseTimeout(ctx, err)
+	},
+}
+
+func init() {
+	attachCmd.Flags().String("subject", "", "image the artifact refers to, as a tag or digest")
+	if err := viper.BindPFlag("attach_subject", attachCmd.Flags().Lookup("subject")); err != nil {
+		slog.Error("bind flag failed", "flag", "subject", "err", err)
+		os.Exit(1)
+	}
+	attachCmd.Flags().String(
+		"artifact-type",
+		"",
+		"media type of the artifact, such as application/vnd.example.test-report+json",
+	)
+	if err := viper.BindPFlag(
+		"attach_artifact_type",
+		attachCmd.Flags().Lookup("artifact-type"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "artifact-type", "err", err)
+		os.Exit(1)
+	}
+	attachCmd.Flags().String("file", "", "file uploaded as the artifact")
+	if err := viper.BindPFlag("attach_file", attachCmd.Flags().Lookup("file")); err != nil {
+		slog.Error("bind flag failed", "flag", "file", "err", err)
+		os.Exit(1)
+	}
+	attachCmd.Flags().StringArray(
+		"annotation",
+		nil,
+		"annotate the artifact manifest, as KEY=VALUE (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"attach_annotations",
+		attachCmd.Flags().Lookup("annotation"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "annotation", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(attachCmd)
+}
+
+// getAttachment returns the file, artifact type and annotations of the
+// attach command.
+func getAttachment() (nixcontainers.Attachment, error) {
+	path := strings.TrimSpace(viper.GetString("attach_file"))
+	if path == "" {
+		return nixcontainers.Attachment{}, errors.New("--file is required")
+	}
+	artifactType, err := parseArtifactType(viper.GetString("attach_artifact_type"))
+	if err != nil {
+		return nixcontainers.Attachment{}, err
+	}
+	annotations, err := parseAnnotations(
+		"artifact annotation",
+		getListSetting("attach_annotations"),
+	)
+	if err != nil {
+		return nixcontainers.Attachment{}, err
+	}
+	return nixcontainers.Attachment{
+		Path:         path,
+		ArtifactType: artifactType,
+		Annotations:  annotations,
+	}, checkAttachmentFile(path)
+}
+
+// getBuildAttachments parses the FILE:TYPE entries from the repeatable
+// --attach flag or the comma-separated ATTACH env, attached to every pushed
+// image.
+func getBuildAttachments(push bool) ([]nixcontainers.Attachment, error) {
+	var entries []string
+	for _, v := range viper.GetStringSlice("attach") {
+		entries = append(entries, strings.Split(v, ",")...)
+	}
+	var attachments []nixcontainers.Attachment
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// Media types have no colon, so the last one ends the path.
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid attachment %q: expected FILE:TYPE", entry)
+		}
+		path := strings.TrimSpace(entry[:i])
+		artifactType, err := parseArtifactType(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid attachment %q: %w", entry, err)
+		}
+		if err := checkAttachmentFile(path); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, nixcontainers.Attachment{
+			Path:         path,
+			ArtifactType: artifactType,
+		})
+	}
+	if len(attachments) > 0 && !push {
+		return nil, errors.New("--attach requires --push")
+	}
+	return attachments, nil
+}
+
+// parseArtifactType validates the media type of an artifact.
+func parseArtifactType(raw string) (string, error) {
+	v := strings.TrimSpace(raw)
+	if v == "" {
+		return "", errors.New("an artifact type is required")
+	}
+	if !mediaTypePattern.MatchString(v) {
+		return "", fmt.Errorf("invalid artifact type %q: expected a media type", v)
+	}
+	return v, nil
+}
+
+// checkAttachmentFile fails before anything is built or pushed when path is
+// not a readable file.
+func checkAttachmentFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("attachment file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("attachment file %s is a directory", path)
+	}
+	return nil
+}
+
+// attachArtifact pushes attachment as a referrer of subject and prints the
+// digest reference of the artifact.
+func attachArtifact(
+	ctx context.Context,
+	out io.Writer,
+	subject name.Reference,
+	attachment nixcontainers.Attachment,
+	opts ...remote.Option,
+) error {
+	ref, err := nixcontainers.AttachArtifact(ctx, subject, attachment, opts...)
+	if err != nil {
+		return fmt.Errorf("attach %s to %s failed: %w", attachment.Path, subject, err)
+	}
+	_, _ = fmt.Fprintf(out, "%s\n", ref.Name())
+	return nil
+}
+
+// attachBuildArtifacts attaches every attachment to the image a build just
+// pushed as subject.
+func attachBuildArtifacts(
+	ctx context.Context,
+	container *nixcontainers.ContainerClient,
+	subject name.Digest,
+	attachments []nixcontainers.Attachment,
+) error {
+	for _, attachment := range attachments {
+		if _, err := container.AttachArtifact(ctx, subject, attachment); err != nil {
+			return fmt.Errorf("attach %s to %s failed: %w", attachment.Path, subject, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/viper"
+)
+
+func writeAttachmentFile(t *testing.T, name string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(`{"passed":42}`), 0o600); err != nil {
+		t.Fatalf("write attachment failed: %v", err)
+	}
+	return path
+}
+
+func TestGetBuildAttachments(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	report := writeAttachmentFile(t, "report.json")
+	scan := writeAttachmentFile(t, "scan.sarif")
+
+	viper.Set("attach", []string{
+		report + ":application/vnd.example.test-report+json",
+		" " + scan + " : application/sarif+json ",
+	})
+	got, err := getBuildAttachments(true)
+	if err != nil {
+		t.Fatalf("get attachments failed: %v", err)
+	}
+	if len(got) != 2 ||
+		got[0].Path != report ||
+		got[0].ArtifactType != "application/vnd.example.test-report+json" ||
+		got[1].Path != scan ||
+		got[1].ArtifactType != "application/sarif+json" {
+		t.Fatalf("unexpected attachments %+v", got)
+	}
+
+	if _, err := getBuildAttachments(false); err == nil {
+		t.Fatal("expected an error without --push")
+	}
+
+	for _, raw := range []string{
+		report,
+		report + ":report",
+		":application/json",
+		filepath.Join(t.TempDir(), "missing.json") + ":application/json",
+		t.TempDir() + ":application/json",
+	} {
+		viper.Set("attach", []string{raw})
+		if _, err := getBuildAttachments(true); err == nil {
+			t.Fatalf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestGetAttachment(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	report := writeAttachmentFile(t, "report.json")
+
+	viper.Set("attach_file", report)
+	viper.Set("attach_artifact_type", "application/vnd.example.test-report+json")
+	viper.Set("attach_annotations", []string{"org.example.suite=e2e"})
+	got, err := getAttachment()
+	if err != nil {
+		t.Fatalf("get attachment failed: %v", err)
+	}
+	if got.Path != report ||
+		got.ArtifactType != "application/vnd.example.test-report+json" ||
+		got.Annotations["org.example.suite"] != "e2e" {
+		t.Fatalf("unexpected attachment %+v", got)
+	}
+
+	viper.Set("attach_artifact_type", "")
+	if _, err := getAttachment(); err == nil {
+		t.Fatal("expected an error without an artifact type")
+	}
+}
+
+func TestAttachArtifact(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("get image digest failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = attachArtifact(context.Background(), &out, ref, nixcontainers.Attachment{
+		Path:         writeAttachmentFile(t, "report.json"),
+		ArtifactType: "application/vnd.example.test-report+json",
+	})
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	artifact := mustParseReference(t, strings.TrimSpace(out.String()))
+
+	idx, err := remote.Referrers(ref.Context().Digest(digest.String()))
+	if err != nil {
+		t.Fatalf("list referrers failed: %v", err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("read referrers failed: %v", err)
+	}
+	if len(m.Manifests) != 1 || m.Manifests[0].Digest.String() != artifact.Identifier() {
+		t.Fatalf("expected %s as the only referrer, got %+v", artifact, m.Manifests)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+// flakeURLPattern matches flake references with a scheme, such as
+// github:org/repo, path:/src or git+https://example.com/repo.git.
+var flakeURLPattern = regexp.MustCompile(`^[a-z][a-z0-9+.-]*:`)
+
+// resolveBuildContext canonicalizes a local build context to an absolute,
+// symlink-free directory containing flake.nix so the installable passed to
+// nix does not depend on the invoking working directory. Flake URLs are
+// returned unchanged, query parameters such as ?ref= or ?rev= included.
+func resolveBuildContext(raw string) (string, error) {
+	if raw == "" {
+		return "", errors.New("build context is empty: pass a path or set BUILD_CONTEXT")
+	}
+	if flakeURLPattern.MatchString(raw) {
+		if err := checkFlakeURL(raw); err != nil {
+			return "", err
+		}
+		return raw, nil
+	}
+
+	abs, err := filepath.Abs(raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve build context %s: %w", raw, err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("build context %s does not exist", abs)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve build context %s: %w", abs, err)
+	}
+	if i := strings.IndexAny(resolved, "#?"); i >= 0 {
+		return "", fmt.Errorf(
+			"build context %s contains %q, which would corrupt the flake reference: "+
+				"move the flake to a path without '#' or '?'",
+			resolved,
+			resolved[i:i+1],
+		)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat build context %s: %w", resolved, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("build context %s is not a directory", resolved)
+	}
+	flakePath := filepath.Join(resolved, "flake.nix")
+	if _, err := os.Stat(flakePath); errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("build context %s does not contain flake.nix", resolved)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", flakePath, err)
+	}
+	return resolved, nil
+}
+
+// skaffoldFilenameEnv is the env Skaffold reads its --filename from, naming
+// the skaffold.yaml the build contexts it passes are relative to.
+const skaffoldFilenameEnv = "SKAFFOLD_FILENAME"
+
+// resolveSkaffoldBuildContext makes the relative local build context Skaffold
+// passes absolute. Skaffold makes it relative to skaffold.yaml while the
+// builder may run from another directory, so it is tried against the working
+// directory, then against the directory of the skaffold.yaml SKAFFOLD_FILENAME
+// names, keeping the first holding the flake of flakeDir. Absolute paths and
+// flake URLs are returned unchanged.
+func resolveSkaffoldBuildContext(raw, flakeDir string) (string, error) {
+	if raw == "" || flakeURLPattern.MatchString(raw) || filepath.IsAbs(raw) {
+		return raw, nil
+	}
+	var bases []string
+	if wd, err := os.Getwd(); err == nil {
+		bases = append(bases, wd)
+	}
+	if file := os.Getenv(skaffoldFilenameEnv); file != "" {
+		if abs, err := filepath.Abs(file); err == nil && !slices.Contains(bases, filepath.Dir(abs)) {
+			bases = append(bases, filepath.Dir(abs))
+		}
+	}
+	tried := make([]string, 0, len(bases))
+	for _, base := range bases {
+		candidate := filepath.Join(base, raw)
+		flake := filepath.Join(candidate, filepath.FromSlash(flakeDir), "flake.nix")
+		if _, err := os.Stat(flake); err == nil {
+			return candidate, nil
+		}
+		tried = append(tried, candidate)
+	}
+	return "", fmt.Errorf(
+		"build context %s has no flake.nix at any of %s: make BUILD_CONTEXT absolute, "+
+			"or relative to the working directory or to the skaffold.yaml named by %s",
+		raw,
+		strings.Join(tried, ", "),
+		skaffoldFilenameEnv,
+	)
+}
+
+// checkFlakeURL rejects flake URLs selecting an output with a fragment, since
+// the package attribute is derived from the image and appended after the
+// query as the fragment of the installable.
+func checkFlakeURL(raw string) error {
+	if _, fragment, ok := strings.Cut(raw, "#"); ok {
+		return fmt.Errorf(
+			"build context %s selects the flake output %q: "+
+				"drop the fragment, the package is derived from IMAGE or --package-map",
+			raw,
+			fragment,
+		)
+	}
+	return nil
+}
+
+// applyFlakeDir points the build context at the flake in its subdirectory
+// dir. A local path is joined with it, git metadata still being read from the
+// enclosing repository, while a flake URL gets the dir query parameter.
+func applyFlakeDir(buildContext, dir string) (string, error) {
+	if dir == "" {
+		return buildContext, nil
+	}
+	if !flakeURLPattern.MatchString(buildContext) {
+		return filepath.Join(buildContext, filepath.FromSlash(dir)), nil
+	}
+	if _, rawQuery, ok := strings.Cut(buildContext, "?"); ok {
+		if query, err := url.ParseQuery(rawQuery); err == nil && query.Has("dir") {
+			return "", fmt.Errorf(
+				"build context %s already sets dir=%s, drop it or --flake-dir",
+				buildContext,
+				query.Get("dir"),
+			)
+		}
+	}
+	return nixcontainers.FormatFlakeDir(buildContext, dir), nil
+}
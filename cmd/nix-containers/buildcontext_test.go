@@ -0,0 +1,235 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeBuildContext(t *testing.T, dir string) string {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("create build context failed: %v", err)
+	}
+	flake := []byte("{ outputs = _: { }; }")
+	if err := os.WriteFile(filepath.Join(dir, "flake.nix"), flake, 0o644); err != nil {
+		t.Fatalf("write flake.nix failed: %v", err)
+	}
+	return dir
+}
+
+func TestResolveBuildContextRelativePath(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir failed: %v", err)
+	}
+	dir := writeBuildContext(t, filepath.Join(root, "app"))
+	t.Chdir(root)
+
+	got, err := resolveBuildContext("./app")
+	if err != nil {
+		t.Fatalf("resolve build context failed: %v", err)
+	}
+	if got != dir {
+		t.Fatalf("expected %s, got %s", dir, got)
+	}
+}
+
+func TestResolveBuildContextFollowsSymlinks(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir failed: %v", err)
+	}
+	dir := writeBuildContext(t, filepath.Join(root, "app"))
+	link := filepath.Join(root, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatalf("create symlink failed: %v", err)
+	}
+
+	got, err := resolveBuildContext(link)
+	if err != nil {
+		t.Fatalf("resolve build context failed: %v", err)
+	}
+	if got != dir {
+		t.Fatalf("expected %s, got %s", dir, got)
+	}
+}
+
+func TestResolveBuildContextKeepsFlakeURLs(t *testing.T) {
+	for _, ref := range []string{
+		"github:org/repo/main",
+		"github:org/repo?ref=v1",
+		"path:/src/app",
+		"git+https://x/y.git?ref=main&rev=0123abcd",
+		"git+ssh://git@x/y.git",
+	} {
+		got, err := resolveBuildContext(ref)
+		if err != nil {
+			t.Fatalf("resolve %s failed: %v", ref, err)
+		}
+		if got != ref {
+			t.Fatalf("expected %s unchanged, got %s", ref, got)
+		}
+	}
+}
+
+func TestResolveBuildContextRejectsFlakeURLFragments(t *testing.T) {
+	_, err := resolveBuildContext("github:org/repo?ref=main#app")
+	if err == nil || !strings.Contains(err.Error(), `"app"`) {
+		t.Fatalf("expected the fragment to be rejected, got %v", err)
+	}
+}
+
+func TestApplyFlakeDir(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir failed: %v", err)
+	}
+	dir := writeBuildContext(t, filepath.Join(root, "services", "api"))
+
+	tests := []struct {
+		buildContext string
+		want         string
+	}{
+		{buildContext: root, want: dir},
+		{buildContext: "github:org/repo", want: "github:org/repo?dir=services/api"},
+		{
+			buildContext: "git+ssh://git@x/y.git?ref=main",
+			want:         "git+ssh://git@x/y.git?ref=main&dir=services/api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.buildContext, func(t *testing.T) {
+			got, err := applyFlakeDir(tt.buildContext, "services/api")
+			if err != nil {
+				t.Fatalf("apply flake dir failed: %v", err)
+			}
+			got, err = resolveBuildContext(got)
+			if err != nil {
+				t.Fatalf("resolve build context failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := applyFlakeDir("github:org/repo?dir=web", "services/api"); err == nil {
+		t.Fatal("expected a build context already setting dir to be rejected")
+	}
+}
+
+func TestResolveBuildContextRejectsInvalidPaths(t *testing.T) {
+	root := t.TempDir()
+	writeBuildContext(t, filepath.Join(root, "app#v1"))
+	writeBuildContext(t, filepath.Join(root, "app?v1"))
+	if err := os.MkdirAll(filepath.Join(root, "noflake"), 0o755); err != nil {
+		t.Fatalf("create dir failed: %v", err)
+	}
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatalf("write file failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		message string
+	}{
+		{name: "empty", path: "", message: "is empty"},
+		{name: "missing", path: filepath.Join(root, "missing"), message: "does not exist"},
+		{name: "file", path: file, message: "is not a directory"},
+		{
+			name:    "no flake",
+			path:    filepath.Join(root, "noflake"),
+			message: "does not contain flake.nix",
+		},
+		{name: "hash", path: filepath.Join(root, "app#v1"), message: `"#"`},
+		{name: "query", path: filepath.Join(root, "app?v1"), message: `"?"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resolveBuildContext(tt.path)
+			if err == nil {
+				t.Fatalf("expected error for %q", tt.path)
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Fatalf("expected error containing %q, got %v", tt.message, err)
+			}
+		})
+	}
+}
+
+func TestResolveSkaffoldBuildContext(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir failed: %v", err)
+	}
+	project := filepath.Join(root, "project")
+	app := writeBuildContext(t, filepath.Join(project, "app"))
+	writeBuildContext(t, filepath.Join(project, "mono", "nix"))
+	elsewhere := filepath.Join(root, "elsewhere")
+	if err := os.MkdirAll(elsewhere, 0o755); err != nil {
+		t.Fatalf("create dir failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		wd       string
+		filename string
+		raw      string
+		flakeDir string
+		want     string
+		message  string
+	}{
+		{name: "working directory", wd: project, raw: "app", want: app},
+		{
+			name:     "skaffold.yaml directory",
+			wd:       elsewhere,
+			filename: filepath.Join(project, "skaffold.yaml"),
+			raw:      "./app",
+			want:     app,
+		},
+		{
+			name:     "flake dir",
+			wd:       project,
+			raw:      "mono",
+			flakeDir: "nix",
+			want:     filepath.Join(project, "mono"),
+		},
+		{name: "absolute", wd: elsewhere, raw: app, want: app},
+		{name: "flake URL", wd: elsewhere, raw: "github:you/app", want: "github:you/app"},
+		{
+			name:     "missing",
+			wd:       elsewhere,
+			filename: filepath.Join(project, "skaffold.yaml"),
+			raw:      "missing",
+			message: filepath.Join(elsewhere, "missing") + ", " +
+				filepath.Join(project, "missing"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(tt.wd)
+			t.Setenv(skaffoldFilenameEnv, tt.filename)
+
+			got, err := resolveSkaffoldBuildContext(tt.raw, tt.flakeDir)
+			if tt.message != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.message) {
+					t.Fatalf("expected error listing %q, got %v", tt.message, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve skaffold build context failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
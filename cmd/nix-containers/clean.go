@@ -0,0 +1,189 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// platformTagPattern matches the platform suffix FormatPlatformReference
+// appends to a tag, such as _linux_amd64 or _linux_arm_v7.
+var platformTagPattern = regexp.MustCompile(`_linux_[a-z0-9]+(_v[0-9]+)?$`)
+
+type imageCleanClient interface {
+	ListImages(context.Context) ([]nixcontainers.LocalImage, error)
+	RemoveImage(context.Context, name.Reference) error
+}
+
+type cleanOptions struct {
+	// image restricts the cleanup to the platform tags of one image. Every
+	// platform tag is matched when it is nil.
+	image        *name.Tag
+	includeImage bool
+	olderThan    time.Duration
+	now          time.Time
+}
+
+var cleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove intermediate images left by builds",
+	Long:  "Lists the platform tags loaded by multi-platform builds (such as app:latest_linux_amd64) in the container runtime and removes them with --force. Without --force, only shows what would be removed. Restricted to the platform tags of IMAGE when set. Configure via env vars: IMAGE.",
+	Example: "# Show the platform tags older than three days\n" +
+		"./nix-containers clean --older-than 72h\n\n" +
+		"# Remove the platform tags and the main tag of an image\n" +
+		"IMAGE=ghcr.io/you/app:latest ./nix-containers clean --include-image --force",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		ctx := cmd.Context()
+		opts := cleanOptions{
+			includeImage: viper.GetBool("clean_include_image"),
+			olderThan:    viper.GetDuration("clean_older_than"),
+			now:          time.Now(),
+		}
+		if image := viper.GetString("image"); image != "" {
+			ref, err := parseImageTag("IMAGE", image)
+			if err != nil {
+				return err
+			}
+			opts.image = &ref
+		} else if opts.includeImage {
+			return fmt.Errorf("--include-image requires IMAGE")
+		}
+		container, err := newConfiguredContainerClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create container client: %w", err)
+		}
+		force := viper.GetBool("clean_force") && !viper.GetBool("clean_dry_run")
+		return runClean(ctx, cmd.OutOrStdout(), container, opts, force)
+	},
+}
+
+func init() {
+	cleanCmd.Flags().Bool("force", false, "remove the matching images")
+	if err := viper.BindPFlag("clean_force", cleanCmd.Flags().Lookup("force")); err != nil {
+		slog.Error("bind flag failed", "flag", "force", "err", err)
+		os.Exit(1)
+	}
+	cleanCmd.Flags().Bool("dry-run", false, "only show the matching images (the default)")
+	if err := viper.BindPFlag("clean_dry_run", cleanCmd.Flags().Lookup("dry-run")); err != nil {
+		slog.Error("bind flag failed", "flag", "dry-run", "err", err)
+		os.Exit(1)
+	}
+	cleanCmd.MarkFlagsMutuallyExclusive("force", "dry-run")
+	cleanCmd.Flags().Duration(
+		"older-than",
+		0,
+		"only match images created longer ago than this, such as 72h",
+	)
+	if err := viper.BindPFlag(
+		"clean_older_than",
+		cleanCmd.Flags().Lookup("older-than"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "older-than", "err", err)
+		os.Exit(1)
+	}
+	cleanCmd.Flags().Bool("include-image", false, "also match the IMAGE tag itself")
+	if err := viper.BindPFlag(
+		"clean_include_image",
+		cleanCmd.Flags().Lookup("include-image"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "include-image", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(cleanCmd)
+}
+
+// runClean writes the images matching opts to out, removing them when force
+// is set. Every removal is attempted before the first failure is returned.
+func runClean(
+	ctx context.Context,
+	out io.Writer,
+	client imageCleanClient,
+	opts cleanOptions,
+	force bool,
+) error {
+	imgs, err := client.ListImages(ctx)
+	if err != nil {
+		return err
+	}
+	matched := selectCleanImages(imgs, opts)
+	var firstErr error
+	for _, img := range matched {
+		created := img.Created.UTC().Format(time.RFC3339)
+		if !force {
+			_, _ = fmt.Fprintf(out, "would remove %s (created %s)\n", img.Ref.Name(), created)
+			continue
+		}
+		if err := client.RemoveImage(ctx, img.Ref); err != nil {
+			slog.ErrorContext(ctx, "remove image failed", "image", img.Ref.Name(), "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "removed %s (created %s)\n", img.Ref.Name(), created)
+	}
+	if !force && len(matched) > 0 {
+		slog.InfoContext(ctx, "dry run, pass --force to remove the images", "images", len(matched))
+	}
+	return firstErr
+}
+
+// selectCleanImages returns the images of imgs matching opts, sorted by name.
+func selectCleanImages(
+	imgs []nixcontainers.LocalImage,
+	opts cleanOptions,
+) []nixcontainers.LocalImage {
+	var matched []nixcontainers.LocalImage
+	for _, img := range imgs {
+		tag, ok := img.Ref.(name.Tag)
+		if !ok || !matchCleanTag(tag, opts) {
+			continue
+		}
+		if opts.olderThan > 0 && opts.now.Sub(img.Created) < opts.olderThan {
+			continue
+		}
+		matched = append(matched, img)
+	}
+	slices.SortFunc(matched, func(a, b nixcontainers.LocalImage) int {
+		return cmp.Compare(a.Ref.Name(), b.Ref.Name())
+	})
+	return matched
+}
+
+func matchCleanTag(tag name.Tag, opts cleanOptions) bool {
+	loc := platformTagPattern.FindStringIndex(tag.TagStr())
+	if opts.image == nil {
+		return loc != nil && loc[0] > 0
+	}
+	if tag.Context().Name() != opts.image.Context().Name() {
+		return false
+	}
+	if opts.includeImage && tag.TagStr() == opts.image.TagStr() {
+		return true
+	}
+	if loc == nil {
+		return false
+	}
+	// Long image tags are truncated in their platform tags, so the platform
+	// tag of the image is formatted again rather than matched as a prefix.
+	parts := strings.Split(tag.TagStr()[loc[0]+1:], "_")
+	p := &v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) > 2 {
+		p.Variant = parts[2]
+	}
+	return nixcontainers.FormatPlatformReference(opts.image, p).TagStr() == tag.TagStr()
+}
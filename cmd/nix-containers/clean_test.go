@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+type fakeImageCleanClient struct {
+	images  []nixcontainers.LocalImage
+	removed []string
+	failing string
+}
+
+func (f *fakeImageCleanClient) ListImages(context.Context) ([]nixcontainers.LocalImage, error) {
+	return f.images, nil
+}
+
+func (f *fakeImageCleanClient) RemoveImage(_ context.Context, ref name.Reference) error {
+	if ref.Name() == f.failing {
+		return errors.New("image is in use")
+	}
+	f.removed = append(f.removed, ref.Name())
+	return nil
+}
+
+func cleanFixture(t *testing.T, now time.Time) []nixcontainers.LocalImage {
+	t.Helper()
+
+	images := map[string]time.Duration{
+		"ghcr.io/example/app:latest":               time.Hour,
+		"ghcr.io/example/app:latest_linux_amd64":   100 * time.Hour,
+		"ghcr.io/example/app:latest_linux_arm_v7":  time.Hour,
+		"ghcr.io/example/app:v1_linux_arm64":       100 * time.Hour,
+		"ghcr.io/example/other:latest_linux_amd64": 100 * time.Hour,
+		"ghcr.io/example/app:build_1":              100 * time.Hour,
+		"ghcr.io/example/app:_linux_amd64":         100 * time.Hour,
+	}
+	var out []nixcontainers.LocalImage
+	for raw, age := range images {
+		out = append(
+			out,
+			nixcontainers.LocalImage{Ref: mustParseReference(t, raw), Created: now.Add(-age)},
+		)
+	}
+	return out
+}
+
+func TestSelectCleanImages(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	image, err := name.NewTag("ghcr.io/example/app:latest")
+	if err != nil {
+		t.Fatalf("parse image failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		opts cleanOptions
+		want []string
+	}{
+		{
+			name: "every platform tag",
+			opts: cleanOptions{now: now},
+			want: []string{
+				"ghcr.io/example/app:latest_linux_amd64",
+				"ghcr.io/example/app:latest_linux_arm_v7",
+				"ghcr.io/example/app:v1_linux_arm64",
+				"ghcr.io/example/other:latest_linux_amd64",
+			},
+		},
+		{
+			name: "platform tags of image",
+			opts: cleanOptions{image: &image, now: now},
+			want: []string{
+				"ghcr.io/example/app:latest_linux_amd64",
+				"ghcr.io/example/app:latest_linux_arm_v7",
+			},
+		},
+		{
+			name: "include image",
+			opts: cleanOptions{image: &image, includeImage: true, now: now},
+			want: []string{
+				"ghcr.io/example/app:latest",
+				"ghcr.io/example/app:latest_linux_amd64",
+				"ghcr.io/example/app:latest_linux_arm_v7",
+			},
+		},
+		{
+			name: "older than",
+			opts: cleanOptions{image: &image, olderThan: 72 * time.Hour, now: now},
+			want: []string{"ghcr.io/example/app:latest_linux_amd64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, img := range selectCleanImages(cleanFixture(t, now), tt.opts) {
+				got = append(got, img.Ref.Name())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRunClean(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	image, err := name.NewTag("ghcr.io/example/app:latest")
+	if err != nil {
+		t.Fatalf("parse image failed: %v", err)
+	}
+	opts := cleanOptions{image: &image, now: now}
+
+	client := &fakeImageCleanClient{images: cleanFixture(t, now)}
+	var out bytes.Buffer
+	if err := runClean(context.Background(), &out, client, opts, false); err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if len(client.removed) != 0 {
+		t.Fatalf("expected dry run to keep every image, removed %q", client.removed)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("would remove ghcr.io/example/app:latest_linux_amd64")) {
+		t.Fatalf("expected dry run listing, got %q", out.String())
+	}
+
+	client.failing = "ghcr.io/example/app:latest_linux_amd64"
+	out.Reset()
+	err = runClean(context.Background(), &out, client, opts, true)
+	if err == nil {
+		t.Fatalf("expected removal failure to be returned")
+	}
+	if want := []string{"ghcr.io/example/app:latest_linux_arm_v7"}; !slices.Equal(
+		client.removed,
+		want,
+	) {
+		t.Fatalf("expected removals %q, got %q", want, client.removed)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("removed ghcr.io/example/app:latest_linux_arm_v7")) {
+		t.Fatalf("expected removal listing, got %q", out.String())
+	}
+}
+
+func TestMatchCleanTagTruncatedPlatformTag(t *testing.T) {
+	image, err := name.NewTag("ghcr.io/example/app:" + strings.Repeat("a", 125))
+	if err != nil {
+		t.Fatalf("parse image failed: %v", err)
+	}
+	platformTag := nixcontainers.FormatPlatformReference(
+		image,
+		&v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+	)
+	if !matchCleanTag(platformTag, cleanOptions{image: &image}) {
+		t.Fatalf("expected %s to be a platform tag of %s", platformTag, image)
+	}
+}
@@ -2,20 +2,45 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
-	"runtime"
+	"path"
+	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/compression"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
 	"github.com/spf13/viper"
 )
 
+const defaultEvalTimeout = 10 * time.Second
+
 func init() {
 	viper.AutomaticEnv()
+	if err := viper.BindEnv("config_file", "NIX_CONTAINERS_CONFIG"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"NIX_CONTAINERS_CONFIG",
+			"key",
+			"config_file",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
 	if err := viper.BindEnv("build_context", "BUILD_CONTEXT"); err != nil {
 		slog.Error("bind env failed", "env", "BUILD_CONTEXT", "key", "build_context", "err", err)
 		os.Exit(1)
@@ -24,6 +49,26 @@ func init() {
 		slog.Error("bind env failed", "env", "IMAGE", "key", "image", "err", err)
 		os.Exit(1)
 	}
+	if err := viper.BindEnv("images", "IMAGES"); err != nil {
+		slog.Error("bind env failed", "env", "IMAGES", "key", "images", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("source_image", "SOURCE_IMAGE"); err != nil {
+		slog.Error("bind env failed", "env", "SOURCE_IMAGE", "key", "source_image", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("destination", "DESTINATION_IMAGE"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"DESTINATION_IMAGE",
+			"key",
+			"destination",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
 	if err := viper.BindEnv("platforms", "PLATFORMS"); err != nil {
 		slog.Error("bind env failed", "env", "PLATFORMS", "key", "platforms", "err", err)
 		os.Exit(1)
@@ -36,6 +81,10 @@ func init() {
 		slog.Error("bind env failed", "env", "LOG_LEVEL", "key", "log_level", "err", err)
 		os.Exit(1)
 	}
+	if err := viper.BindEnv("log_format", "LOG_FORMAT"); err != nil {
+		slog.Error("bind env failed", "env", "LOG_FORMAT", "key", "log_format", "err", err)
+		os.Exit(1)
+	}
 	if err := viper.BindEnv("accept_flake_config", "ACCEPT_FLAKE_CONFIG"); err != nil {
 		slog.Error(
 			"bind env failed",
@@ -52,102 +101,1868 @@ func init() {
 		slog.Error("bind env failed", "env", "NO_PURE_EVAL", "key", "no_pure_eval", "err", err)
 		os.Exit(1)
 	}
+	if err := viper.BindEnv("docker_config", "DOCKER_CONFIG"); err != nil {
+		slog.Error("bind env failed", "env", "DOCKER_CONFIG", "key", "docker_config", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("cred_helper", "CRED_HELPER"); err != nil {
+		slog.Error("bind env failed", "env", "CRED_HELPER", "key", "cred_helper", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("no_ambient_auth", "NO_AMBIENT_AUTH"); err != nil {
+		slog.Error("bind env failed", "env", "NO_AMBIENT_AUTH", "key", "no_ambient_auth", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("flake_dir", "FLAKE_DIR"); err != nil {
+		slog.Error("bind env failed", "env", "FLAKE_DIR", "key", "flake_dir", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("refresh", "REFRESH"); err != nil {
+		slog.Error("bind env failed", "env", "REFRESH", "key", "refresh", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("print_build_logs", "PRINT_BUILD_LOGS"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"PRINT_BUILD_LOGS",
+			"key",
+			"print_build_logs",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv(
+		"no_auto_experimental_features",
+		"NO_AUTO_EXPERIMENTAL_FEATURES",
+	); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"NO_AUTO_EXPERIMENTAL_FEATURES",
+			"key",
+			"no_auto_experimental_features",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("impure", "IMPURE"); err != nil {
+		slog.Error("bind env failed", "env", "IMPURE", "key", "impure", "err", err)
+		os.Exit(1)
+	}
 	if err := viper.BindEnv("debug", "DEBUG"); err != nil {
 		slog.Error("bind env failed", "env", "DEBUG", "key", "debug", "err", err)
 		os.Exit(1)
 	}
-}
-
-func getHostPlatform() *v1.Platform {
-	return &v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
-}
-
-func parsePlatform(s string) *v1.Platform {
-	seg := strings.SplitN(s, "/", 2)
-	operatingSystem := ""
-	arch := ""
-	if len(seg) > 0 {
-		operatingSystem = seg[0]
+	if err := viper.BindEnv("index_annotations", "INDEX_ANNOTATIONS"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"INDEX_ANNOTATIONS",
+			"key",
+			"index_annotations",
+			"err",
+			err,
+		)
+		os.Exit(1)
 	}
-	if len(seg) > 1 {
-		arch = seg[1]
+	if err := viper.BindEnv("index_artifact_type", "INDEX_ARTIFACT_TYPE"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"INDEX_ARTIFACT_TYPE",
+			"key",
+			"index_artifact_type",
+			"err",
+			err,
+		)
+		os.Exit(1)
 	}
-	return &v1.Platform{OS: operatingSystem, Architecture: arch}
-}
-
-func getPlatforms() []*v1.Platform {
-	v := viper.GetString("platforms")
-	if v == "" {
-		hp := getHostPlatform()
-		slog.Info("no platforms specified", "detected_os", hp.OS, "detected_arch", hp.Architecture)
-		return []*v1.Platform{hp}
+	if err := viper.BindEnv("index_mediatype", "INDEX_MEDIATYPE"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"INDEX_MEDIATYPE",
+			"key",
+			"index_mediatype",
+			"err",
+			err,
+		)
+		os.Exit(1)
 	}
-	ps := strings.Split(v, ",")
-	plats := make([]*v1.Platform, 0, len(ps))
-	for _, s := range ps {
-		p := parsePlatform(s)
-		if slices.ContainsFunc(plats, func(existing *v1.Platform) bool {
-			return existing.OS == p.OS && existing.Architecture == p.Architecture
-		}) {
-			slog.Warn("duplicate platform skipped", "platform", p.OS+"/"+p.Architecture)
-			continue
-		}
-		plats = append(plats, p)
+	if err := viper.BindEnv("container_runtime", "CONTAINER_RUNTIME"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"CONTAINER_RUNTIME",
+			"key",
+			"container_runtime",
+			"err",
+			err,
+		)
+		os.Exit(1)
 	}
-	return plats
-}
-
-func getPushImage() bool {
-	switch strings.ToLower(viper.GetString("push_image")) {
-	case "1", "true", "yes", "on":
-		return true
-	default:
-		return false
+	if err := viper.BindEnv("containerd_address", "CONTAINERD_ADDRESS"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"CONTAINERD_ADDRESS",
+			"key",
+			"containerd_address",
+			"err",
+			err,
+		)
+		os.Exit(1)
 	}
-}
-
-func getBuildContext() string {
-	return viper.GetString("build_context")
-}
-
-func getImageTag() (name.Tag, error) {
-	s := viper.GetString("image")
-	ref, err := name.NewTag(s)
-	if err != nil {
-		return name.Tag{}, fmt.Errorf("invalid image reference: %w", err)
+	if err := viper.BindEnv("containerd_namespace", "CONTAINERD_NAMESPACE"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"CONTAINERD_NAMESPACE",
+			"key",
+			"containerd_namespace",
+			"err",
+			err,
+		)
+		os.Exit(1)
 	}
-	return ref, nil
-}
-
-func getLogLevel() (slog.Level, error) {
-	v := strings.ToLower(viper.GetString("log_level"))
-	switch v {
-	case "", "info":
-		return slog.LevelInfo, nil
-	case "debug":
-		return slog.LevelDebug, nil
-	case "warn", "warning":
-		return slog.LevelWarn, nil
-	case "error", "err":
-		return slog.LevelError, nil
-	default:
-		return slog.LevelInfo, fmt.Errorf("invalid log level: %s", v)
+	if err := viper.BindEnv("skip_preflight", "SKIP_PREFLIGHT"); err != nil {
+		slog.Error("bind env failed", "env", "SKIP_PREFLIGHT", "key", "skip_preflight", "err", err)
+		os.Exit(1)
 	}
-}
-
-func getAcceptFlakeConfig() bool {
-	switch strings.ToLower(viper.GetString("accept_flake_config")) {
-	case "1", "true", "yes", "on":
-		return true
-	default:
-		return false
+	if err := viper.BindEnv("skip_daemon_check", "SKIP_DAEMON_CHECK"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"SKIP_DAEMON_CHECK",
+			"key",
+			"skip_daemon_check",
+			"err",
+			err,
+		)
+		os.Exit(1)
 	}
-}
-
-func getNoPureEval() bool {
-	return viper.GetBool("no_pure_eval")
-}
-
-func getDebug() bool {
-	return viper.GetBool("debug") || viper.GetBool("actions_step_debug")
+	if err := viper.BindEnv("skip_gc_root", "SKIP_GC_ROOT"); err != nil {
+		slog.Error("bind env failed", "env", "SKIP_GC_ROOT", "key", "skip_gc_root", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("required_nix_version", "REQUIRED_NIX_VERSION"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"REQUIRED_NIX_VERSION",
+			"key",
+			"required_nix_version",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("nix_from_flake", "NIX_FROM_FLAKE"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_FROM_FLAKE", "key", "nix_from_flake", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("nix_build_args", "NIX_BUILD_ARGS"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_BUILD_ARGS", "key", "nix_build_args", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("nix_max_jobs", "NIX_MAX_JOBS"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_MAX_JOBS", "key", "nix_max_jobs", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("nix_cores", "NIX_CORES"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_CORES", "key", "nix_cores", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("nix_builders", "NIX_BUILDERS"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_BUILDERS", "key", "nix_builders", "err", err)
+		os.Exit(1)
+	}
+	// NIX_STORE is set to the store directory inside nix shells, so the
+	// store URIs use their own variables.
+	if err := viper.BindEnv("nix_store", "NIX_BUILD_STORE"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_BUILD_STORE", "key", "nix_store", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("nix_output", "NIX_OUTPUT"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_OUTPUT", "key", "nix_output", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("nix_eval_store", "NIX_EVAL_STORE"); err != nil {
+		slog.Error("bind env failed", "env", "NIX_EVAL_STORE", "key", "nix_eval_store", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("split_jobs", "SPLIT_JOBS"); err != nil {
+		slog.Error("bind env failed", "env", "SPLIT_JOBS", "key", "split_jobs", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("build_timeout", "BUILD_TIMEOUT"); err != nil {
+		slog.Error("bind env failed", "env", "BUILD_TIMEOUT", "key", "build_timeout", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("heartbeat_interval", "HEARTBEAT_INTERVAL"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"HEARTBEAT_INTERVAL",
+			"key",
+			"heartbeat_interval",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("load_timeout", "LOAD_TIMEOUT"); err != nil {
+		slog.Error("bind env failed", "env", "LOAD_TIMEOUT", "key", "load_timeout", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("load_retries", "LOAD_RETRIES"); err != nil {
+		slog.Error("bind env failed", "env", "LOAD_RETRIES", "key", "load_retries", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("push_timeout", "PUSH_TIMEOUT"); err != nil {
+		slog.Error("bind env failed", "env", "PUSH_TIMEOUT", "key", "push_timeout", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("push_jobs", "PUSH_JOBS"); err != nil {
+		slog.Error("bind env failed", "env", "PUSH_JOBS", "key", "push_jobs", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("serialize_push", "SERIALIZE_PUSH"); err != nil {
+		slog.Error("bind env failed", "env", "SERIALIZE_PUSH", "key", "serialize_push", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("registry_timeout", "REGISTRY_TIMEOUT"); err != nil {
+		slog.Error("bind env failed", "env", "REGISTRY_TIMEOUT", "key", "registry_timeout", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("registry_retry_count", "REGISTRY_RETRY_COUNT"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"REGISTRY_RETRY_COUNT",
+			"key",
+			"registry_retry_count",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("registry_retry_backoff", "REGISTRY_RETRY_BACKOFF"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"REGISTRY_RETRY_BACKOFF",
+			"key",
+			"registry_retry_backoff",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("kill_grace_period", "KILL_GRACE_PERIOD"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"KILL_GRACE_PERIOD",
+			"key",
+			"kill_grace_period",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("keep_platform_images", "KEEP_PLATFORM_IMAGES"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"KEEP_PLATFORM_IMAGES",
+			"key",
+			"keep_platform_images",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("keep_on_failure", "KEEP_ON_FAILURE"); err != nil {
+		slog.Error("bind env failed", "env", "KEEP_ON_FAILURE", "key", "keep_on_failure", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("skip_unchanged", "SKIP_UNCHANGED"); err != nil {
+		slog.Error("bind env failed", "env", "SKIP_UNCHANGED", "key", "skip_unchanged", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("skip_missing_platforms", "SKIP_MISSING_PLATFORMS"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"SKIP_MISSING_PLATFORMS",
+			"key",
+			"skip_missing_platforms",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("load_image", "LOAD_IMAGE"); err != nil {
+		slog.Error("bind env failed", "env", "LOAD_IMAGE", "key", "load_image", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("output_oci", "OUTPUT_OCI"); err != nil {
+		slog.Error("bind env failed", "env", "OUTPUT_OCI", "key", "output_oci", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("kind_cluster", "KIND_CLUSTER"); err != nil {
+		slog.Error("bind env failed", "env", "KIND_CLUSTER", "key", "kind_cluster", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("smoke_test", "SMOKE_TEST"); err != nil {
+		slog.Error("bind env failed", "env", "SMOKE_TEST", "key", "smoke_test", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("smoke_test_k8s", "SMOKE_TEST_K8S"); err != nil {
+		slog.Error("bind env failed", "env", "SMOKE_TEST_K8S", "key", "smoke_test_k8s", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("smoke_test_timeout", "SMOKE_TEST_TIMEOUT"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"SMOKE_TEST_TIMEOUT",
+			"key",
+			"smoke_test_timeout",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("override_inputs", "OVERRIDE_INPUTS"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"OVERRIDE_INPUTS",
+			"key",
+			"override_inputs",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("package_map", "PACKAGE_MAP"); err != nil {
+		slog.Error("bind env failed", "env", "PACKAGE_MAP", "key", "package_map", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("use_existing", "USE_EXISTING"); err != nil {
+		slog.Error("bind env failed", "env", "USE_EXISTING", "key", "use_existing", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("also_push", "ALSO_PUSH"); err != nil {
+		slog.Error("bind env failed", "env", "ALSO_PUSH", "key", "also_push", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("base_image", "BASE_IMAGE"); err != nil {
+		slog.Error("bind env failed", "env", "BASE_IMAGE", "key", "base_image", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("add_layers", "ADD_LAYERS"); err != nil {
+		slog.Error("bind env failed", "env", "ADD_LAYERS", "key", "add_layers", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("add_layer_chown", "ADD_LAYER_CHOWN"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"ADD_LAYER_CHOWN",
+			"key",
+			"add_layer_chown",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("image_entrypoint", "IMAGE_ENTRYPOINT"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"IMAGE_ENTRYPOINT",
+			"key",
+			"image_entrypoint",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("image_cmd", "IMAGE_CMD"); err != nil {
+		slog.Error("bind env failed", "env", "IMAGE_CMD", "key", "image_cmd", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("env_file", "IMAGE_ENV_FILE"); err != nil {
+		slog.Error("bind env failed", "env", "IMAGE_ENV_FILE", "key", "env_file", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("image_user", "IMAGE_USER"); err != nil {
+		slog.Error("bind env failed", "env", "IMAGE_USER", "key", "image_user", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("image_workdir", "IMAGE_WORKDIR"); err != nil {
+		slog.Error("bind env failed", "env", "IMAGE_WORKDIR", "key", "image_workdir", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("image_expose", "IMAGE_EXPOSE"); err != nil {
+		slog.Error("bind env failed", "env", "IMAGE_EXPOSE", "key", "image_expose", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("image_volumes", "IMAGE_VOLUMES"); err != nil {
+		slog.Error("bind env failed", "env", "IMAGE_VOLUMES", "key", "image_volumes", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("tag_strategy", "TAG_STRATEGY"); err != nil {
+		slog.Error("bind env failed", "env", "TAG_STRATEGY", "key", "tag_strategy", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("tag_template", "TAG_TEMPLATE"); err != nil {
+		slog.Error("bind env failed", "env", "TAG_TEMPLATE", "key", "tag_template", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("compression", "COMPRESSION"); err != nil {
+		slog.Error("bind env failed", "env", "COMPRESSION", "key", "compression", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("estargz", "ESTARGZ"); err != nil {
+		slog.Error("bind env failed", "env", "ESTARGZ", "key", "estargz", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("push_by_digest", "PUSH_BY_DIGEST"); err != nil {
+		slog.Error("bind env failed", "env", "PUSH_BY_DIGEST", "key", "push_by_digest", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("if_not_exists", "IF_NOT_EXISTS"); err != nil {
+		slog.Error("bind env failed", "env", "IF_NOT_EXISTS", "key", "if_not_exists", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("fail_if_exists", "FAIL_IF_EXISTS"); err != nil {
+		slog.Error("bind env failed", "env", "FAIL_IF_EXISTS", "key", "fail_if_exists", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("metrics_file", "METRICS_FILE"); err != nil {
+		slog.Error("bind env failed", "env", "METRICS_FILE", "key", "metrics_file", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("compression_level", "COMPRESSION_LEVEL"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"COMPRESSION_LEVEL",
+			"key",
+			"compression_level",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("latest_tag", "LATEST_TAG"); err != nil {
+		slog.Error("bind env failed", "env", "LATEST_TAG", "key", "latest_tag", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("no_git_metadata", "NO_GIT_METADATA"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"NO_GIT_METADATA",
+			"key",
+			"no_git_metadata",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("require_nonroot", "REQUIRE_NONROOT"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"REQUIRE_NONROOT",
+			"key",
+			"require_nonroot",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("ecr_create_repo", "ECR_CREATE_REPO"); err != nil {
+		slog.Error("bind env failed", "env", "ECR_CREATE_REPO", "key", "ecr_create_repo", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("ecr_repo_tags", "ECR_REPO_TAGS"); err != nil {
+		slog.Error("bind env failed", "env", "ECR_REPO_TAGS", "key", "ecr_repo_tags", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("ecr_immutable_tags", "ECR_IMMUTABLE_TAGS"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"ECR_IMMUTABLE_TAGS",
+			"key",
+			"ecr_immutable_tags",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("attach", "ATTACH"); err != nil {
+		slog.Error("bind env failed", "env", "ATTACH", "key", "attach", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("mount_from", "MOUNT_FROM"); err != nil {
+		slog.Error("bind env failed", "env", "MOUNT_FROM", "key", "mount_from", "err", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("mirror_best_effort", "MIRROR_BEST_EFFORT"); err != nil {
+		slog.Error(
+			"bind env failed",
+			"env",
+			"MIRROR_BEST_EFFORT",
+			"key",
+			"mirror_best_effort",
+			"err",
+			err,
+		)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("eval_timeout", "EVAL_TIMEOUT"); err != nil {
+		slog.Error("bind env failed", "env", "EVAL_TIMEOUT", "key", "eval_timeout", "err", err)
+		os.Exit(1)
+	}
+}
+
+// platformsAll is the PLATFORMS value building every linux platform the flake
+// exposes the image packages for.
+const platformsAll = "all"
+
+// getPlatformsSetting returns the comma-separated PLATFORMS, joining the
+// entries of a config file list.
+func getPlatformsSetting() string {
+	if list, ok := viper.Get("platforms").([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return viper.GetString("platforms")
+}
+
+// getAllPlatforms reports whether PLATFORMS is platformsAll, so the platforms
+// are resolved from the flake with resolveFlakePlatforms.
+func getAllPlatforms() bool {
+	return strings.EqualFold(strings.TrimSpace(getPlatformsSetting()), platformsAll)
+}
+
+func getPlatforms() ([]*v1.Platform, error) {
+	v := getPlatformsSetting()
+	if getAllPlatforms() {
+		return nil, fmt.Errorf("PLATFORMS=%s is resolved from the flake", platformsAll)
+	}
+	if v == "" {
+		hp := nixcontainers.HostPlatform()
+		slog.Info("no platforms specified", "detected_os", hp.OS, "detected_arch", hp.Architecture)
+		return []*v1.Platform{hp}, nil
+	}
+	return parsePlatforms(v)
+}
+
+// resolveFlakePlatforms returns the platforms of the nix systems the flake at
+// buildContext exposes the packages of every image for, in system order.
+// Systems without a linux OCI platform, such as darwin ones, are skipped.
+func resolveFlakePlatforms(
+	ctx context.Context,
+	client flakePackagesClient,
+	buildContext string,
+	images []buildImage,
+	opts ...nixcontainers.ImageOption,
+) ([]*v1.Platform, error) {
+	systems, err := client.FlakePackages(ctx, buildContext, opts...)
+	if err != nil {
+		return nil, nixcontainers.ClassifyError(
+			nixcontainers.EvalErrorClass,
+			fmt.Errorf("failed to list flake packages: %w", err),
+		)
+	}
+	pkgs := make([]string, 0, len(images))
+	for _, image := range images {
+		pkg := image.flakePackage()
+		if !slices.Contains(pkgs, pkg) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	var plats []*v1.Platform
+	for _, system := range slices.Sorted(maps.Keys(systems)) {
+		if !slices.ContainsFunc(pkgs, func(pkg string) bool {
+			return slices.Contains(systems[system], pkg)
+		}) {
+			continue
+		}
+		p, err := nixcontainers.ParseSystemName(system)
+		if err != nil || p.OS != "linux" {
+			slog.WarnContext(
+				ctx,
+				"skipping flake system without a linux image platform",
+				"system", system,
+				"packages", pkgs,
+			)
+			continue
+		}
+		// Every image of the index is built for the same platforms.
+		if missing := slices.IndexFunc(pkgs, func(pkg string) bool {
+			return !slices.Contains(systems[system], pkg)
+		}); missing >= 0 {
+			slog.WarnContext(
+				ctx,
+				"skipping flake system missing an image package",
+				"system", system,
+				"package", pkgs[missing],
+			)
+			continue
+		}
+		plats = append(plats, p)
+	}
+	if len(plats) == 0 {
+		return nil, nixcontainers.ClassifyError(
+			nixcontainers.EvalErrorClass,
+			fmt.Errorf(
+				"flake %s exposes %s for no linux system",
+				buildContext,
+				strings.Join(pkgs, ", "),
+			),
+		)
+	}
+	slog.InfoContext(ctx, "platforms resolved from flake", "platforms", plats)
+	return plats, nil
+}
+
+// parsePlatformFlag parses the single platform of a --platform flag, the host
+// platform when v is empty.
+func parsePlatformFlag(v string) (*v1.Platform, error) {
+	if v == "" {
+		return nixcontainers.HostPlatform(), nil
+	}
+	plats, err := parsePlatforms(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(plats) != 1 {
+		return nil, fmt.Errorf("--platform expects a single platform, got %q", v)
+	}
+	return plats[0], nil
+}
+
+func parsePlatforms(v string) ([]*v1.Platform, error) {
+	ps := strings.Split(v, ",")
+	plats := make([]*v1.Platform, 0, len(ps))
+	for _, s := range ps {
+		s = strings.TrimSpace(s)
+		p := nixcontainers.ParsePlatform(s)
+		if p.OS == "" || p.Architecture == "" {
+			return nil, fmt.Errorf(
+				"invalid platform %q in PLATFORMS %q: expected os/arch[/variant]",
+				s,
+				v,
+			)
+		}
+		if p.OS != "linux" {
+			return nil, fmt.Errorf(
+				"unsupported platform os %q in PLATFORMS %q: only linux images can be built",
+				s,
+				v,
+			)
+		}
+		if slices.ContainsFunc(plats, func(existing *v1.Platform) bool {
+			return nixcontainers.PlatformEquals(existing, p)
+		}) {
+			slog.Warn("duplicate platform skipped", "platform", p.String())
+			continue
+		}
+		plats = append(plats, p)
+	}
+	return plats, nil
+}
+
+func getPushImage() bool {
+	switch strings.ToLower(viper.GetString("push_image")) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+func getLoadImage() bool {
+	switch strings.ToLower(viper.GetString("load_image")) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+func getSkipUnchanged() bool {
+	return viper.GetBool("skip_unchanged")
+}
+
+func getSkipMissingPlatforms() bool {
+	return viper.GetBool("skip_missing_platforms")
+}
+
+func getOutputOCI() string {
+	return viper.GetString("output_oci")
+}
+
+func getKindCluster() string {
+	return viper.GetString("kind_cluster")
+}
+
+// getMinikube returns the minikube profile set by --minikube, empty to load
+// images into the configured container runtime.
+func getMinikube() string {
+	return strings.TrimSpace(viper.GetString("minikube"))
+}
+
+func getConfigFile() string {
+	return viper.GetString("config_file")
+}
+
+func getBuildContext() string {
+	return viper.GetString("build_context")
+}
+
+// getFlakeDir returns the subdirectory FLAKE_DIR sets for the flake of the
+// build context, as a clean slash-separated relative path.
+func getFlakeDir() (string, error) {
+	raw := strings.TrimSpace(viper.GetString("flake_dir"))
+	if raw == "" {
+		return "", nil
+	}
+	if !filepath.IsLocal(raw) {
+		return "", fmt.Errorf(
+			"invalid flake dir %q: expected a relative path inside the build context",
+			raw,
+		)
+	}
+	dir := filepath.ToSlash(filepath.Clean(raw))
+	if i := strings.IndexAny(dir, "#?&= "); i >= 0 {
+		return "", fmt.Errorf(
+			"invalid flake dir %q: %q would corrupt the flake reference",
+			raw,
+			dir[i:i+1],
+		)
+	}
+	if dir == "." {
+		return "", nil
+	}
+	return dir, nil
+}
+
+// exampleImageReference is the valid reference suggested by image errors.
+const exampleImageReference = "ghcr.io/you/app:latest"
+
+// getImageRefs returns the source image, used to derive the flake package
+// and tag the loaded image, and the destination image it is pushed to. Each
+// falls back to IMAGE when unset.
+func getImageRefs() (source, destination name.Tag, err error) {
+	image := viper.GetString("image")
+	sourceRaw := viper.GetString("source_image")
+	destinationRaw := viper.GetString("destination")
+	if sourceRaw == "" {
+		sourceRaw = image
+	}
+	if destinationRaw == "" {
+		destinationRaw = sourceRaw
+	}
+	switch {
+	case sourceRaw == "" && destinationRaw != "":
+		return name.Tag{}, name.Tag{}, errors.New(
+			"--destination requires --source-image or IMAGE to derive the flake package",
+		)
+	case sourceRaw == "":
+		return name.Tag{}, name.Tag{}, errors.New(
+			"no image set: set IMAGE, or --source-image and --destination",
+		)
+	}
+	sourceSetting := "source image"
+	if viper.GetString("source_image") == "" {
+		sourceSetting = "IMAGE"
+	}
+	source, err = parseImageTag(sourceSetting, sourceRaw)
+	if err != nil {
+		return name.Tag{}, name.Tag{}, err
+	}
+	destination = source
+	if destinationRaw != sourceRaw {
+		destination, err = parseImageTag("destination image", destinationRaw)
+		if err != nil {
+			return name.Tag{}, name.Tag{}, err
+		}
+	}
+	return source, destination, nil
+}
+
+// buildImage is an image of a build: the flake package is derived from source
+// and the result is tagged and pushed as destination.
+type buildImage struct {
+	source      name.Tag
+	destination name.Tag
+	// untagged is set when the destination was given without a tag, so
+	// --tag-strategy generates one.
+	untagged bool
+	// pkg is the flake package resolved for source, empty for the one named
+	// after it.
+	pkg string
+}
+
+// flakePackage returns the flake package the image is built from.
+func (i buildImage) flakePackage() string {
+	if i.pkg != "" {
+		return i.pkg
+	}
+	return nixcontainers.FormatNixFlakePackageName(i.source)
+}
+
+// getBuildImages returns the images to build: IMAGE and every space-separated
+// ref of IMAGES, each built from its own flake package, or the single image
+// of getImageRefs when IMAGES is unset.
+func getBuildImages() ([]buildImage, error) {
+	raws := strings.Fields(viper.GetString("images"))
+	if len(raws) == 0 {
+		source, destination, err := getImageRefs()
+		if err != nil {
+			return nil, err
+		}
+		untagged := !hasExplicitTag(cmp.Or(
+			viper.GetString("destination"),
+			viper.GetString("source_image"),
+			viper.GetString("image"),
+		))
+		images := []buildImage{{source: source, destination: destination, untagged: untagged}}
+		return images, resolveImagePackages(images)
+	}
+	if viper.GetString("source_image") != "" || viper.GetString("destination") != "" {
+		return nil, errors.New("IMAGES cannot be combined with --source-image or --destination")
+	}
+	if image := viper.GetString("image"); image != "" {
+		raws = append([]string{image}, raws...)
+	}
+	var images []buildImage
+	for _, raw := range raws {
+		tag, err := parseImageTag("IMAGES", raw)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(images, func(i buildImage) bool {
+			return i.destination.Name() == tag.Name()
+		}) {
+			continue
+		}
+		images = append(images, buildImage{
+			source:      tag,
+			destination: tag,
+			untagged:    !hasExplicitTag(raw),
+		})
+	}
+	return images, resolveImagePackages(images)
+}
+
+// resolveImagePackages sets the flake package of each image to the one
+// PACKAGE_MAP maps its source repository to, or else to the one named after
+// it, warning when the repository name had to be sanitized.
+func resolveImagePackages(images []buildImage) error {
+	packages, err := getPackageMap()
+	if err != nil {
+		return err
+	}
+	for i, image := range images {
+		pkg, mapped := flakePackageOf(image.source, packages)
+		if segment := path.Base(image.source.RepositoryStr()); !mapped && pkg != segment {
+			slog.Warn(
+				"repository name sanitized into a flake package, map it with --package-map",
+				"image", image.source.Name(),
+				"segment", segment,
+				"package", pkg,
+			)
+		}
+		slog.Info(
+			"flake package resolved",
+			"image", image.source.Name(),
+			"package", pkg,
+			"mapped", mapped,
+		)
+		images[i].pkg = pkg
+	}
+	return nil
+}
+
+// flakePackageOf returns the flake package of ref, the one packages maps its
+// repository to or else the one named after it, and whether it was mapped.
+func flakePackageOf(ref name.Reference, packages map[string]string) (string, bool) {
+	if pkg, ok := packages[ref.Context().Name()]; ok {
+		return pkg, true
+	}
+	return nixcontainers.FormatNixFlakePackageName(ref), false
+}
+
+// parseImageTag parses the image reference of setting. A reference without
+// a tag defaults to latest with a warning, and digest references are rejected
+// since the image is tagged in the runtime and pushed by tag.
+func parseImageTag(setting, raw string) (name.Tag, error) {
+	ref, err := name.ParseReference(raw)
+	if err != nil {
+		return name.Tag{}, fmt.Errorf(
+			"invalid %s reference %q: %w (expected a reference such as %s)",
+			setting,
+			raw,
+			err,
+			exampleImageReference,
+		)
+	}
+	tag, ok := ref.(name.Tag)
+	if !ok {
+		return name.Tag{}, fmt.Errorf(
+			"invalid %s reference %q: digest references cannot be tagged or pushed, "+
+				"use a tag such as %s",
+			setting,
+			raw,
+			exampleImageReference,
+		)
+	}
+	if !hasExplicitTag(raw) && viper.GetString("tag_strategy") == "" {
+		slog.Warn(
+			"image reference has no tag, defaulting to latest",
+			"setting", setting,
+			"image", tag.Name(),
+		)
+	}
+	return tag, nil
+}
+
+// hasExplicitTag reports whether the image reference raw sets a tag.
+func hasExplicitTag(raw string) bool {
+	ref, err := name.ParseReference(raw)
+	if err != nil {
+		return false
+	}
+	tag, ok := ref.(name.Tag)
+	return ok && strings.HasSuffix(raw, ":"+tag.TagStr())
+}
+
+// getLogLevel returns the LOG_LEVEL level, lowered to at least debug by -v
+// and raised to at least warn by -q.
+func getLogLevel() (slog.Level, error) {
+	level, err := parseLogLevel(viper.GetString("log_level"))
+	if err != nil {
+		return level, err
+	}
+	switch {
+	case getVerbosity() > 0:
+		return min(level, slog.LevelDebug), nil
+	case viper.GetBool("quiet"):
+		return max(level, slog.LevelWarn), nil
+	}
+	return level, nil
+}
+
+// getVerbosity returns how many times -v was given.
+func getVerbosity() int {
+	return viper.GetInt("verbose")
+}
+
+// getNixStderrLevel returns the level the stderr lines of nix and image
+// stream scripts are relayed at, raised to info by -vv.
+func getNixStderrLevel() slog.Level {
+	if getVerbosity() >= 2 {
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+func parseLogLevel(v string) (slog.Level, error) {
+	v = strings.ToLower(v)
+	switch v {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "trace":
+		return nixcontainers.LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error", "err":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("invalid log level: %s", v)
+	}
+}
+
+func getAcceptFlakeConfig() bool {
+	switch strings.ToLower(viper.GetString("accept_flake_config")) {
+	case "1", "true", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+// getDockerHost returns the docker daemon endpoint set by --docker-host,
+// empty to use DOCKER_HOST or the current docker context.
+func getDockerHost() string {
+	return strings.TrimSpace(viper.GetString("docker_host"))
+}
+
+func getNoPureEval() bool {
+	return viper.GetBool("no_pure_eval")
+}
+
+func getRefresh() bool {
+	return viper.GetBool("refresh")
+}
+
+// getPrintBuildLogs reports whether nix build prints the full derivation logs,
+// relayed at info.
+func getPrintBuildLogs() bool {
+	return viper.GetBool("print_build_logs")
+}
+
+// getAutoExperimentalFeatures reports whether nix commands enable the
+// experimental features missing from nix.conf.
+func getAutoExperimentalFeatures() bool {
+	return !viper.GetBool("no_auto_experimental_features")
+}
+
+// nixFeatureOptions returns the options of the nix clients that build and
+// evaluate flakes.
+func nixFeatureOptions() []nixcontainers.NixOption {
+	if !getAutoExperimentalFeatures() {
+		return nil
+	}
+	return []nixcontainers.NixOption{nixcontainers.WithNixAutoExperimentalFeatures()}
+}
+
+func getImpure() bool {
+	return viper.GetBool("impure")
+}
+
+// getTagTemplate returns the template generating the tag of images given
+// without one, nil when --tag-strategy is unset.
+func getTagTemplate() (*template.Template, error) {
+	strategy := strings.ToLower(strings.TrimSpace(viper.GetString("tag_strategy")))
+	if strategy == "" {
+		if viper.GetString("tag_template") != "" {
+			return nil, errors.New("--tag-template requires --tag-strategy custom")
+		}
+		return nil, nil
+	}
+	if strategy != TagStrategyCustom && viper.GetString("tag_template") != "" {
+		return nil, fmt.Errorf("--tag-template cannot be combined with --tag-strategy %s", strategy)
+	}
+	return parseTagTemplate(strategy, viper.GetString("tag_template"))
+}
+
+// getLatestTag returns the tag --latest writes pushed images under in their
+// repository, empty when unset.
+func getLatestTag() (string, error) {
+	tag := strings.TrimSpace(viper.GetString("latest_tag"))
+	if tag == "" {
+		return "", nil
+	}
+	if _, err := name.NewTag("example.com/image:" + tag); err != nil {
+		return "", fmt.Errorf("invalid --latest tag %q: %w", tag, err)
+	}
+	return tag, nil
+}
+
+// getCompression returns the compression and level pushed layers are
+// re-encoded with.
+func getCompression() (compression.Compression, int, error) {
+	raw := strings.ToLower(strings.TrimSpace(viper.GetString("compression")))
+	if raw == "" {
+		raw = string(compression.GZip)
+	}
+	level := nixcontainers.DefaultCompressionLevel
+	if v := strings.TrimSpace(viper.GetString("compression_level")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid compression level %q: expected an integer", v)
+		}
+		level = n
+	}
+	comp, err := nixcontainers.ParseCompression(raw, level)
+	if err != nil {
+		return "", 0, err
+	}
+	return comp, level, nil
+}
+
+func getEstargz() bool {
+	return viper.GetBool("estargz")
+}
+
+func getPushByDigest() bool {
+	return viper.GetBool("push_by_digest")
+}
+
+// checkPushByDigest rejects the settings that write or read tags, which
+// --push-by-digest never writes.
+func checkPushByDigest(images []buildImage, push bool, latestTag string) error {
+	if !push {
+		return errors.New("--push-by-digest requires --push")
+	}
+	if latestTag != "" {
+		return errors.New("--push-by-digest cannot be combined with --latest")
+	}
+	if viper.GetString("tag_strategy") != "" {
+		return errors.New("--push-by-digest cannot be combined with --tag-strategy")
+	}
+	if getSkipUnchanged() {
+		return errors.New("--push-by-digest cannot be combined with --skip-unchanged")
+	}
+	for _, image := range images {
+		if !image.untagged {
+			return fmt.Errorf(
+				"--push-by-digest writes no tag, use a repository without a tag instead of %s",
+				image.destination,
+			)
+		}
+	}
+	return nil
+}
+
+func getIfNotExists() bool {
+	return viper.GetBool("if_not_exists")
+}
+
+func getFailIfExists() bool {
+	return viper.GetBool("fail_if_exists")
+}
+
+// checkIfNotExists rejects the settings --if-not-exists and --fail-if-exists
+// cannot check the destination tag with.
+func checkIfNotExists(push, pushByDigest bool) error {
+	if getIfNotExists() && getFailIfExists() {
+		return errors.New("--if-not-exists cannot be combined with --fail-if-exists")
+	}
+	if !push {
+		return errors.New("--if-not-exists and --fail-if-exists require --push")
+	}
+	if pushByDigest {
+		return errors.New(
+			"--if-not-exists and --fail-if-exists cannot be combined with --push-by-digest",
+		)
+	}
+	return nil
+}
+
+func getMetricsFile() string {
+	return viper.GetString("metrics_file")
+}
+
+func getNoGitMetadata() bool {
+	return viper.GetBool("no_git_metadata")
+}
+
+func getDebug() bool {
+	return viper.GetBool("debug") || viper.GetBool("actions_step_debug")
+}
+
+func getEvalTimeout() time.Duration {
+	if d := viper.GetDuration("eval_timeout"); d > 0 {
+		return d
+	}
+	return defaultEvalTimeout
+}
+
+func getContainerRuntime() (string, error) {
+	v := strings.ToLower(viper.GetString("container_runtime"))
+	switch v {
+	case "", nixcontainers.ContainerRuntimeAuto:
+		return nixcontainers.ContainerRuntimeAuto, nil
+	case nixcontainers.ContainerRuntimeDocker, nixcontainers.ContainerRuntimeContainerd:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid container runtime: %s", v)
+	}
+}
+
+func getContainerdAddress() string {
+	return viper.GetString("containerd_address")
+}
+
+func getContainerdNamespace() string {
+	return viper.GetString("containerd_namespace")
+}
+
+func getSkipPreflight() bool {
+	return viper.GetBool("skip_preflight")
+}
+
+func getSkipDaemonCheck() bool {
+	return viper.GetBool("skip_daemon_check")
+}
+
+func getSkipGCRoot() bool {
+	return viper.GetBool("skip_gc_root")
+}
+
+func getLogFormat() (string, error) {
+	v := strings.ToLower(viper.GetString("log_format"))
+	switch v {
+	case "", LogFormatText:
+		return LogFormatText, nil
+	case LogFormatJSON:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid log format: %s", v)
+	}
+}
+
+func getIndexMediaType() (string, error) {
+	v := strings.ToLower(viper.GetString("index_mediatype"))
+	switch v {
+	case "", nixcontainers.IndexMediaTypeOCI:
+		return nixcontainers.IndexMediaTypeOCI, nil
+	case nixcontainers.IndexMediaTypeDocker, nixcontainers.IndexMediaTypeAuto:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid index media type: %s", v)
+	}
+}
+
+// getIndexAnnotations parses KEY=VALUE entries from the repeatable
+// --index-annotation flag or the comma-separated INDEX_ANNOTATIONS env.
+func getIndexAnnotations() (map[string]string, error) {
+	return parseAnnotations("index annotation", getListSetting("index_annotations"))
+}
+
+// getListSetting returns the entries of the repeatable setting key: each
+// value of its flag as given, so a value may hold commas, or the
+// comma-separated entries of its env var or config file string.
+func getListSetting(key string) []string {
+	raw, ok := viper.Get(key).(string)
+	if !ok {
+		return viper.GetStringSlice(key)
+	}
+	return strings.Split(raw, ",")
+}
+
+// parseAnnotations parses the KEY=VALUE entries, naming them what in errors.
+func parseAnnotations(what string, entries []string) (map[string]string, error) {
+	var annotations map[string]string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s %q: expected KEY=VALUE", what, entry)
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[key] = strings.TrimSpace(value)
+	}
+	return annotations, nil
+}
+
+// mediaTypePattern matches a media type, such as
+// application/vnd.example.release.v1+json.
+var mediaTypePattern = regexp.MustCompile(
+	`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*$`,
+)
+
+// getIndexArtifactType returns the --index-artifact-type media type, which
+// only OCI indexes hold.
+func getIndexArtifactType(indexMediaType string) (string, error) {
+	v := strings.TrimSpace(viper.GetString("index_artifact_type"))
+	if v == "" {
+		return "", nil
+	}
+	if !mediaTypePattern.MatchString(v) {
+		return "", fmt.Errorf("invalid index artifact type %q: expected a media type", v)
+	}
+	if indexMediaType == nixcontainers.IndexMediaTypeDocker {
+		return "", fmt.Errorf(
+			"--index-artifact-type requires an OCI index, not --index-mediatype %s",
+			indexMediaType,
+		)
+	}
+	return v, nil
+}
+
+func getRequiredNixVersion() string {
+	return strings.TrimSpace(viper.GetString("required_nix_version"))
+}
+
+func getNixFromFlake() string {
+	return strings.TrimSpace(viper.GetString("nix_from_flake"))
+}
+
+// getNixMaxJobs returns the nix --max-jobs value: a non-negative integer or
+// "auto", or empty to keep the nix default.
+func getNixMaxJobs() (string, error) {
+	v := strings.TrimSpace(viper.GetString("nix_max_jobs"))
+	if v == "" || v == "auto" {
+		return v, nil
+	}
+	if n, err := strconv.Atoi(v); err != nil || n < 0 {
+		return "", fmt.Errorf("invalid nix max jobs %q: expected a non-negative integer or auto", v)
+	}
+	return v, nil
+}
+
+// getNixCores returns the nix --cores value: a non-negative integer, where 0
+// means every core, "auto", or empty to keep the nix default.
+func getNixCores() (string, error) {
+	v := strings.TrimSpace(viper.GetString("nix_cores"))
+	if v == "" || v == "auto" {
+		return v, nil
+	}
+	if n, err := strconv.Atoi(v); err != nil || n < 0 {
+		return "", fmt.Errorf("invalid nix cores %q: expected a non-negative integer or auto", v)
+	}
+	return v, nil
+}
+
+func getBuildTimeout() time.Duration {
+	return viper.GetDuration("build_timeout")
+}
+
+// getHeartbeatInterval returns how often a running nix build or push is
+// logged, zero when stderr is a terminal drawing progress instead.
+func getHeartbeatInterval(ctx context.Context) (time.Duration, error) {
+	v := viper.GetDuration("heartbeat_interval")
+	if v < 0 {
+		return 0, fmt.Errorf("invalid --heartbeat-interval %s: must not be negative", v)
+	}
+	if showTerminalProgress(ctx) {
+		return 0, nil
+	}
+	return v, nil
+}
+
+func getLoadTimeout() time.Duration {
+	return viper.GetDuration("load_timeout")
+}
+
+func getLoadRetries() (int, error) {
+	v := strings.TrimSpace(viper.GetString("load_retries"))
+	if v == "" {
+		return nixcontainers.DefaultLoadRetries, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid load retries %q: expected a non-negative integer", v)
+	}
+	return n, nil
+}
+
+func getPushTimeout() time.Duration {
+	return viper.GetDuration("push_timeout")
+}
+
+func getPushJobs() (int, error) {
+	v := strings.TrimSpace(viper.GetString("push_jobs"))
+	if v == "" {
+		return nixcontainers.DefaultPushJobs, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid push jobs %q: expected a positive integer", v)
+	}
+	return n, nil
+}
+
+func getSerializePush() bool {
+	return viper.GetBool("serialize_push")
+}
+
+// getRegistryTransport returns the registry transport settings, the
+// go-containerregistry defaults unless overridden.
+func getRegistryTransport() (nixcontainers.RegistryTransport, error) {
+	rt := nixcontainers.DefaultRegistryTransport()
+	rt.Timeout = viper.GetDuration("registry_timeout")
+	if rt.Timeout < 0 {
+		return rt, fmt.Errorf("invalid registry timeout %s: expected a non-negative duration", rt.Timeout)
+	}
+	if v := strings.TrimSpace(viper.GetString("registry_retry_count")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return rt, fmt.Errorf(
+				"invalid registry retry count %q: expected a non-negative integer",
+				v,
+			)
+		}
+		rt.RetryCount = n
+	}
+	if viper.IsSet("registry_retry_backoff") {
+		rt.RetryBackoff = viper.GetDuration("registry_retry_backoff")
+	}
+	if rt.RetryBackoff < 0 {
+		return rt, fmt.Errorf(
+			"invalid registry retry backoff %s: expected a non-negative duration",
+			rt.RetryBackoff,
+		)
+	}
+	return rt, nil
+}
+
+func getKillGracePeriod() time.Duration {
+	return viper.GetDuration("kill_grace_period")
+}
+
+func getKeepPlatformImages() bool {
+	return viper.GetBool("keep_platform_images")
+}
+
+func getKeepOnFailure() bool {
+	return viper.GetBool("keep_on_failure")
+}
+
+func getSmokeTest() string {
+	return viper.GetString("smoke_test")
+}
+
+func getSmokeTestK8s() bool {
+	return viper.GetBool("smoke_test_k8s")
+}
+
+func getSmokeTestTimeout() time.Duration {
+	return viper.GetDuration("smoke_test_timeout")
+}
+
+// getNixBuilders returns the nix --builders value, such as
+// "ssh://builder aarch64-linux" or "@/etc/nix/machines", or empty to keep the
+// nix configured builders.
+func getNixBuilders() string {
+	return strings.TrimSpace(viper.GetString("nix_builders"))
+}
+
+// getNixStore returns the nix store URI to build into, or empty for the
+// system store. The store must be local since the built image is read from it.
+func getNixStore() (string, error) {
+	v := strings.TrimSpace(viper.GetString("nix_store"))
+	if _, err := nixcontainers.NixStoreRoot(v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+func getNixEvalStore() string {
+	return strings.TrimSpace(viper.GetString("nix_eval_store"))
+}
+
+func getSplitJobs() bool {
+	return viper.GetBool("split_jobs")
+}
+
+// getNixBuildArgs returns the extra nix build arguments from NIX_BUILD_ARGS,
+// shell-split, followed by every --nix-arg value so flags win over env.
+func getNixBuildArgs() ([]string, error) {
+	args, err := splitShellWords(viper.GetString("nix_build_args"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NIX_BUILD_ARGS: %w", err)
+	}
+	return append(args, viper.GetStringSlice("nix_args")...), nil
+}
+
+// nixIdentifierPattern matches the names nix accepts for --arg and --argstr.
+var nixIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*$`)
+
+// getNixAutoArgs parses the NAME=VALUE entries of the repeatable --nix-argstr
+// flag, then the NAME=EXPR ones of --nix-arg-expr. Values are kept verbatim,
+// commas included.
+func getNixAutoArgs() ([]nixcontainers.NixArg, error) {
+	var args []nixcontainers.NixArg
+	for _, flag := range []struct {
+		key, name string
+		expr      bool
+	}{
+		{key: "nix_argstrs", name: "--nix-argstr"},
+		{key: "nix_arg_exprs", name: "--nix-arg-expr", expr: true},
+	} {
+		for _, entry := range viper.GetStringSlice(flag.key) {
+			argName, value, ok := strings.Cut(entry, "=")
+			argName = strings.TrimSpace(argName)
+			if !ok {
+				return nil, fmt.Errorf("invalid %s %q: expected NAME=VALUE", flag.name, entry)
+			}
+			if !nixIdentifierPattern.MatchString(argName) {
+				return nil, fmt.Errorf(
+					"invalid %s %q: %q is not a nix identifier",
+					flag.name,
+					entry,
+					argName,
+				)
+			}
+			args = append(args, nixcontainers.NixArg{Name: argName, Value: value, Expr: flag.expr})
+		}
+	}
+	return args, nil
+}
+
+// getNixOutput parses the [DRV:]NAME of --nix-output, the output of the nix
+// build result images are read from, DRV being the path or name of the
+// derivation when the build produces several.
+func getNixOutput() (nixcontainers.NixOutput, error) {
+	raw := strings.TrimSpace(viper.GetString("nix_output"))
+	if raw == "" {
+		return nixcontainers.NixOutput{}, nil
+	}
+	var out nixcontainers.NixOutput
+	// Neither store paths nor output names hold a colon.
+	if drv, outName, ok := strings.Cut(raw, ":"); ok {
+		out.Derivation = strings.TrimSpace(drv)
+		if out.Derivation == "" || strings.ContainsAny(out.Derivation, " \t") {
+			return nixcontainers.NixOutput{}, fmt.Errorf(
+				"invalid --nix-output %q: expected [DRV:]NAME",
+				raw,
+			)
+		}
+		raw = outName
+	}
+	out.Name = strings.TrimSpace(raw)
+	if !nixIdentifierPattern.MatchString(out.Name) {
+		return nixcontainers.NixOutput{}, fmt.Errorf(
+			"invalid --nix-output %q: %q is not an output name",
+			viper.GetString("nix_output"),
+			out.Name,
+		)
+	}
+	return out, nil
+}
+
+// nixAutoArgNames lists the names of args for logs, leaving out the values,
+// which may be long expressions.
+func nixAutoArgNames(args []nixcontainers.NixArg) []string {
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		names = append(names, arg.Name)
+	}
+	return names
+}
+
+// getExistingPlatformImages parses PLATFORM=REF entries from --use-existing or
+// the comma-separated USE_EXISTING env.
+func getExistingPlatformImages() ([]nixcontainers.ExistingPlatformImage, error) {
+	var entries []string
+	for _, v := range viper.GetStringSlice("use_existing") {
+		entries = append(entries, strings.Split(v, ",")...)
+	}
+	existing := make([]nixcontainers.ExistingPlatformImage, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		platform, raw, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid existing image %q: expected PLATFORM=REF", entry)
+		}
+		plats, err := parsePlatforms(platform)
+		if err != nil {
+			return nil, fmt.Errorf("invalid existing image %q: %w", entry, err)
+		}
+		ref, err := name.ParseReference(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid existing image %q: %w", entry, err)
+		}
+		existing = append(
+			existing,
+			nixcontainers.ExistingPlatformImage{Platform: plats[0], Ref: ref},
+		)
+	}
+	return existing, nil
+}
+
+// getMirrors parses the references from the repeatable --also-push flag or
+// the comma-separated ALSO_PUSH env.
+func getMirrors() ([]name.Reference, error) {
+	var mirrors []name.Reference
+	for _, v := range viper.GetStringSlice("also_push") {
+		for _, raw := range strings.Split(v, ",") {
+			raw = strings.TrimSpace(raw)
+			if raw == "" {
+				continue
+			}
+			tag, err := parseImageTag("mirror image", raw)
+			if err != nil {
+				return nil, err
+			}
+			mirrors = append(mirrors, tag)
+		}
+	}
+	return mirrors, nil
+}
+
+func getMirrorBestEffort() bool {
+	return viper.GetBool("mirror_best_effort")
+}
+
+// getMountFrom parses the --mount-from repository, nil when unset.
+func getMountFrom() (*name.Repository, error) {
+	raw := strings.TrimSpace(viper.GetString("mount_from"))
+	if raw == "" {
+		return nil, nil
+	}
+	repo, err := name.NewRepository(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --mount-from repository %q: %w", raw, err)
+	}
+	return &repo, nil
+}
+
+// getBaseImage parses the --base-image reference, nil when unset.
+func getBaseImage() (name.Reference, error) {
+	raw := strings.TrimSpace(viper.GetString("base_image"))
+	if raw == "" {
+		return nil, nil
+	}
+	ref, err := name.ParseReference(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --base-image reference %q: %w", raw, err)
+	}
+	return ref, nil
+}
+
+// getExtraLayers parses the SRC[:DEST] entries from the repeatable
+// --add-layer flag or the comma-separated ADD_LAYERS env, owned by --chown.
+// DEST must be absolute, so a colon followed by anything else is kept in SRC.
+func getExtraLayers() ([]nixcontainers.ExtraLayer, error) {
+	entries := getListSetting("add_layers")
+	var layers []nixcontainers.ExtraLayer
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		layer := nixcontainers.ExtraLayer{Source: entry, Dest: "/"}
+		if i := strings.LastIndex(entry, ":"); i >= 0 && strings.HasPrefix(entry[i+1:], "/") {
+			layer.Source, layer.Dest = entry[:i], path.Clean(entry[i+1:])
+		}
+		if layer.Source == "" {
+			return nil, fmt.Errorf("invalid --add-layer %q: expected SRC[:DEST]", entry)
+		}
+		layers = append(layers, layer)
+	}
+	raw := strings.TrimSpace(viper.GetString("add_layer_chown"))
+	if raw == "" {
+		return layers, nil
+	}
+	if len(layers) == 0 {
+		return nil, errors.New("--chown requires --add-layer")
+	}
+	uid, gid, err := parseChown(raw)
+	if err != nil {
+		return nil, err
+	}
+	for i := range layers {
+		layers[i].UID, layers[i].GID = uid, gid
+	}
+	return layers, nil
+}
+
+// parseChown parses a numeric UID[:GID] owner, the group defaulting to the
+// user, since names cannot be resolved without the passwd of the image.
+func parseChown(raw string) (int, int, error) {
+	rawUID, rawGID, ok := strings.Cut(raw, ":")
+	if !ok {
+		rawGID = rawUID
+	}
+	uid, err := strconv.ParseUint(rawUID, 10, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --chown %q: expected a numeric UID[:GID]", raw)
+	}
+	gid, err := strconv.ParseUint(rawGID, 10, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --chown %q: expected a numeric UID[:GID]", raw)
+	}
+	return int(uid), int(gid), nil
+}
+
+// getImageConfig parses the image config overrides. An entrypoint or cmd
+// given as an empty string clears the field, while an unset one keeps it.
+// Env vars are read from --env-file, then --env.
+func getImageConfig() (nixcontainers.ImageConfig, error) {
+	var cfg nixcontainers.ImageConfig
+	for _, field := range []struct {
+		key, flag string
+		value     *[]string
+	}{
+		{key: "image_entrypoint", flag: "entrypoint", value: &cfg.Entrypoint},
+		{key: "image_cmd", flag: "cmd", value: &cfg.Cmd},
+	} {
+		if !viper.IsSet(field.key) {
+			continue
+		}
+		// A config file list is already split into arguments.
+		if command, ok := viper.Get(field.key).([]string); ok {
+			*field.value = command
+			continue
+		}
+		command, err := parseCommand(field.flag, viper.GetString(field.key))
+		if err != nil {
+			return nixcontainers.ImageConfig{}, err
+		}
+		*field.value = command
+	}
+
+	// The env file comes first, so that --env entries override it.
+	var env []string
+	if path := viper.GetString("env_file"); path != "" {
+		entries, err := readEnvFile(path)
+		if err != nil {
+			return nixcontainers.ImageConfig{}, err
+		}
+		env = entries
+	}
+	for _, kv := range viper.GetStringSlice("image_env") {
+		kv, err := parseEnvVar("--env", kv)
+		if err != nil {
+			return nixcontainers.ImageConfig{}, err
+		}
+		env = append(env, kv)
+	}
+	for _, key := range nixcontainers.OverriddenEnvKeys(nil, env) {
+		slog.Debug("image env var defined more than once, the last one wins", "key", key)
+	}
+	cfg.Env = env
+	cfg.User = strings.TrimSpace(viper.GetString("image_user"))
+	cfg.WorkingDir = strings.TrimSpace(viper.GetString("image_workdir"))
+	cfg.RequireNonRoot = viper.GetBool("require_nonroot")
+	for _, v := range viper.GetStringSlice("image_expose") {
+		for _, raw := range strings.Split(v, ",") {
+			raw = strings.TrimSpace(raw)
+			if raw == "" {
+				continue
+			}
+			port, err := parsePort(raw)
+			if err != nil {
+				return nixcontainers.ImageConfig{}, err
+			}
+			cfg.ExposedPorts = append(cfg.ExposedPorts, port)
+		}
+	}
+	for _, v := range viper.GetStringSlice("image_volumes") {
+		for _, volume := range strings.Split(v, ",") {
+			volume = strings.TrimSpace(volume)
+			if volume == "" {
+				continue
+			}
+			if !path.IsAbs(volume) {
+				return nixcontainers.ImageConfig{}, fmt.Errorf(
+					"invalid --volume %q, expected an absolute path",
+					volume,
+				)
+			}
+			cfg.Volumes = append(cfg.Volumes, volume)
+		}
+	}
+	return cfg, nil
+}
+
+// getPackageMap returns the flake packages PACKAGE_MAP sets for image
+// repositories, as REPO=ATTR entries, keyed by the full repository name.
+func getPackageMap() (map[string]string, error) {
+	entries := getListSetting("package_map")
+	packages := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		raw, pkg, ok := strings.Cut(entry, "=")
+		raw, pkg = strings.TrimSpace(raw), strings.TrimSpace(pkg)
+		if !ok || raw == "" || pkg == "" {
+			return nil, fmt.Errorf("invalid package mapping %q: expected REPO=ATTR", entry)
+		}
+		repo, err := name.NewRepository(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid package mapping %q: %w", entry, err)
+		}
+		if !nixcontainers.ValidNixAttrName(pkg) {
+			return nil, fmt.Errorf(
+				"invalid package mapping %q: %s is not a flake attribute name",
+				entry,
+				pkg,
+			)
+		}
+		packages[repo.Name()] = pkg
+	}
+	return packages, nil
+}
+
+// getECRRepository returns the options of the ECR repositories created
+// before pushing, nil without --ecr-create-repo. Every image must be pushed to
+// an ECR registry.
+func getECRRepository(
+	images []buildImage,
+	push bool,
+) (*nixcontainers.ECRRepositoryOptions, error) {
+	if !viper.GetBool("ecr_create_repo") {
+		return nil, nil
+	}
+	if !push {
+		return nil, errors.New("--ecr-create-repo requires --push")
+	}
+	for _, image := range images {
+		registry := image.destination.Context().RegistryStr()
+		if !nixcontainers.IsECRRegistry(registry) {
+			return nil, fmt.Errorf(
+				"--ecr-create-repo requires an ECR registry, not %s of %s",
+				registry,
+				image.destination,
+			)
+		}
+	}
+	opts := &nixcontainers.ECRRepositoryOptions{
+		ImmutableTags: viper.GetBool("ecr_immutable_tags"),
+	}
+	var entries []string
+	for _, v := range viper.GetStringSlice("ecr_repo_tags") {
+		entries = append(entries, strings.Split(v, ",")...)
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid ECR repository tag %q: expected KEY=VALUE", entry)
+		}
+		if opts.Tags == nil {
+			opts.Tags = map[string]string{}
+		}
+		opts.Tags[key] = value
+	}
+	return opts, nil
+}
+
+// getOverrideInputs parses NAME=REF entries from the repeatable
+// --override-input flag or the comma-separated OVERRIDE_INPUTS env.
+func getOverrideInputs() ([]nixcontainers.FlakeInputOverride, error) {
+	var entries []string
+	for _, v := range viper.GetStringSlice("override_inputs") {
+		entries = append(entries, strings.Split(v, ",")...)
+	}
+	overrides := make([]nixcontainers.FlakeInputOverride, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		inputName, ref, ok := strings.Cut(entry, "=")
+		inputName, ref = strings.TrimSpace(inputName), strings.TrimSpace(ref)
+		if !ok || inputName == "" || ref == "" {
+			return nil, fmt.Errorf("invalid input override %q: expected NAME=REF", entry)
+		}
+		overrides = append(overrides, nixcontainers.FlakeInputOverride{Name: inputName, Ref: ref})
+	}
+	return overrides, nil
 }
@@ -1,51 +1,62 @@
 package main
 
 import (
+	"context"
+	"log/slog"
+	"reflect"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 
-	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/viper"
 )
 
-func TestGetPlatformsDeduplicates(t *testing.T) {
+func TestParsePlatformsDeduplicates(t *testing.T) {
 	tests := []struct {
 		name     string
-		input    []string
+		input    string
 		expected int
 	}{
 		{
 			name:     "no duplicates",
-			input:    []string{"linux/amd64", "linux/arm64"},
+			input:    "linux/amd64,linux/arm64",
 			expected: 2,
 		},
 		{
 			name:     "with duplicates",
-			input:    []string{"linux/amd64", "linux/arm64", "linux/amd64", "linux/arm64"},
+			input:    "linux/amd64,linux/arm64,linux/amd64,linux/arm64",
 			expected: 2,
 		},
 		{
 			name:     "triple duplicate",
-			input:    []string{"linux/amd64", "linux/amd64", "linux/amd64"},
+			input:    "linux/amd64,linux/amd64,linux/amd64",
 			expected: 1,
 		},
 		{
 			name:     "single platform",
-			input:    []string{"linux/amd64"},
+			input:    "linux/amd64",
 			expected: 1,
 		},
+		{
+			name:     "surrounding whitespace",
+			input:    " linux/amd64 , linux/amd64,linux/arm64 ",
+			expected: 2,
+		},
+		{
+			name:     "variants are distinct",
+			input:    "linux/arm/v6,linux/arm/v7",
+			expected: 2,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			plats := make([]*v1.Platform, 0, len(tt.input))
-			for _, s := range tt.input {
-				p := parsePlatform(s)
-				if slices.ContainsFunc(plats, func(existing *v1.Platform) bool {
-					return existing.OS == p.OS && existing.Architecture == p.Architecture
-				}) {
-					continue
-				}
-				plats = append(plats, p)
+			plats, err := parsePlatforms(tt.input)
+			if err != nil {
+				t.Fatalf("parse platforms failed: %v", err)
 			}
 			if len(plats) != tt.expected {
 				t.Fatalf("expected %d platforms, got %d", tt.expected, len(plats))
@@ -53,3 +64,904 @@ func TestGetPlatformsDeduplicates(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePlatformsRejectsInvalidEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		segment string
+	}{
+		{name: "missing arch", input: "linux/", segment: `"linux/"`},
+		{name: "trailing comma", input: "linux/amd64,", segment: `""`},
+		{name: "missing os", input: "/amd64", segment: `"/amd64"`},
+		{name: "non linux os", input: "linux/amd64,darwin/arm64", segment: `"darwin/arm64"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePlatforms(tt.input)
+			if err == nil {
+				t.Fatalf("expected error for %q", tt.input)
+			}
+			if !strings.Contains(err.Error(), tt.segment) ||
+				!strings.Contains(err.Error(), `"`+tt.input+`"`) {
+				t.Fatalf("expected error to echo segment and value, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveFlakePlatforms(t *testing.T) {
+	client := fakeFlakePackagesClient{systems: map[string][]string{
+		"aarch64-darwin": {"app", "worker"},
+		"aarch64-linux":  {"app", "worker"},
+		"armv7l-linux":   {"app"},
+		"riscv64-linux":  {"tools"},
+		"x86_64-linux":   {"app", "tools", "worker"},
+	}}
+	images := []buildImage{
+		{source: mustParseTag(t, "ghcr.io/you/app:latest")},
+		{source: mustParseTag(t, "ghcr.io/you/worker:latest")},
+	}
+
+	plats, err := resolveFlakePlatforms(context.Background(), client, "/workspace", images)
+	if err != nil {
+		t.Fatalf("resolve flake platforms failed: %v", err)
+	}
+	got := make([]string, 0, len(plats))
+	for _, p := range plats {
+		got = append(got, p.String())
+	}
+	// darwin is skipped, and armv7l-linux lacks the worker package.
+	if want := []string{"linux/arm64", "linux/amd64"}; !slices.Equal(got, want) {
+		t.Fatalf("expected platforms %v, got %v", want, got)
+	}
+
+	_, err = resolveFlakePlatforms(
+		context.Background(),
+		client,
+		"/workspace",
+		[]buildImage{{source: mustParseTag(t, "ghcr.io/you/missing:latest")}},
+	)
+	if nixcontainers.ErrorClassOf(err) != nixcontainers.EvalErrorClass {
+		t.Fatalf("expected an eval error for a package of no system, got %v", err)
+	}
+}
+
+func TestGetPlatformsAll(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	viper.Set("platforms", " ALL ")
+	if !getAllPlatforms() {
+		t.Fatal("expected PLATFORMS=ALL to resolve the platforms from the flake")
+	}
+	if _, err := getPlatforms(); err == nil {
+		t.Fatal("expected getPlatforms to reject PLATFORMS=all")
+	}
+	viper.Set("platforms", "linux/amd64")
+	if getAllPlatforms() {
+		t.Fatal("expected explicit PLATFORMS not to resolve from the flake")
+	}
+}
+
+func TestGetOverrideInputs(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	viper.Set(
+		"override_inputs",
+		[]string{"nixpkgs=path:/src/nixpkgs, utils=github:numtide/flake-utils"},
+	)
+	overrides, err := getOverrideInputs()
+	if err != nil {
+		t.Fatalf("get override inputs failed: %v", err)
+	}
+	want := []nixcontainers.FlakeInputOverride{
+		{Name: "nixpkgs", Ref: "path:/src/nixpkgs"},
+		{Name: "utils", Ref: "github:numtide/flake-utils"},
+	}
+	if !slices.Equal(overrides, want) {
+		t.Fatalf("expected overrides %v, got %v", want, overrides)
+	}
+
+	for _, entry := range []string{"nixpkgs", "=path:/src", "nixpkgs="} {
+		viper.Set("override_inputs", []string{entry})
+		if _, err := getOverrideInputs(); err == nil {
+			t.Fatalf("expected error for %q", entry)
+		}
+	}
+}
+
+func TestGetNixAutoArgs(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	viper.Set("nix_argstrs", []string{"channel=stable", "tags=a,b", "empty="})
+	viper.Set("nix_arg_exprs", []string{"maxLayers=100", "features={ tls = true; }"})
+	got, err := getNixAutoArgs()
+	if err != nil {
+		t.Fatalf("get nix args failed: %v", err)
+	}
+	want := []nixcontainers.NixArg{
+		{Name: "channel", Value: "stable"},
+		{Name: "tags", Value: "a,b"},
+		{Name: "empty", Value: ""},
+		{Name: "maxLayers", Value: "100", Expr: true},
+		{Name: "features", Value: "{ tls = true; }", Expr: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if names := nixAutoArgNames(got); !reflect.DeepEqual(
+		names,
+		[]string{"channel", "tags", "empty", "maxLayers", "features"},
+	) {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	for key, raw := range map[string]string{
+		"nix_argstrs":   "channel",
+		"nix_arg_exprs": "=100",
+	} {
+		viper.Reset()
+		viper.Set(key, []string{raw})
+		if _, err := getNixAutoArgs(); err == nil {
+			t.Fatalf("expected error for %s %q", key, raw)
+		}
+	}
+	viper.Reset()
+	viper.Set("nix_argstrs", []string{"1st=value"})
+	if _, err := getNixAutoArgs(); err == nil {
+		t.Fatal("expected error for a name that is not a nix identifier")
+	}
+}
+
+func TestGetNixOutput(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	tests := []struct {
+		raw     string
+		want    nixcontainers.NixOutput
+		wantErr bool
+	}{
+		{raw: "", want: nixcontainers.NixOutput{}},
+		{raw: " image ", want: nixcontainers.NixOutput{Name: "image"}},
+		{
+			raw:  "stream-app:out",
+			want: nixcontainers.NixOutput{Derivation: "stream-app", Name: "out"},
+		},
+		{
+			raw: "/nix/store/abc-stream-app.drv:image",
+			want: nixcontainers.NixOutput{
+				Derivation: "/nix/store/abc-stream-app.drv",
+				Name:       "image",
+			},
+		},
+		{raw: ":out", wantErr: true},
+		{raw: "stream-app:", wantErr: true},
+		{raw: "out put", wantErr: true},
+	}
+	for _, tt := range tests {
+		viper.Set("nix_output", tt.raw)
+		got, err := getNixOutput()
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("expected error for %q", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("get nix output %q failed: %v", tt.raw, err)
+		}
+		if got != tt.want {
+			t.Fatalf("expected %+v for %q, got %+v", tt.want, tt.raw, got)
+		}
+	}
+}
+
+func TestGetFlakeDir(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	for raw, want := range map[string]string{
+		"":                "",
+		".":               "",
+		"services/api/":   "services/api",
+		"./services//api": "services/api",
+	} {
+		viper.Set("flake_dir", raw)
+		got, err := getFlakeDir()
+		if err != nil {
+			t.Fatalf("get flake dir %q failed: %v", raw, err)
+		}
+		if got != want {
+			t.Fatalf("expected flake dir %q for %q, got %q", want, raw, got)
+		}
+	}
+
+	for _, raw := range []string{"/src/api", "../api", "api?ref=main", "api#app"} {
+		viper.Set("flake_dir", raw)
+		if _, err := getFlakeDir(); err == nil {
+			t.Fatalf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestGetExtraLayers(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	viper.Set("add_layers", []string{"./ca", "config/app:/etc/app/", "a:b:/srv"})
+	got, err := getExtraLayers()
+	if err != nil {
+		t.Fatalf("get extra layers failed: %v", err)
+	}
+	want := []nixcontainers.ExtraLayer{
+		{Source: "./ca", Dest: "/"},
+		{Source: "config/app", Dest: "/etc/app"},
+		{Source: "a:b", Dest: "/srv"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	viper.Set("add_layers", []string{"./a,b"})
+	got, err = getExtraLayers()
+	if err != nil {
+		t.Fatalf("get extra layers with a comma failed: %v", err)
+	}
+	comma := []nixcontainers.ExtraLayer{{Source: "./a,b", Dest: "/"}}
+	if !reflect.DeepEqual(got, comma) {
+		t.Fatalf("expected %+v, got %+v", comma, got)
+	}
+
+	viper.Set("add_layers", "./ca, config/app:/etc/app/")
+	got, err = getExtraLayers()
+	if err != nil {
+		t.Fatalf("get extra layers from env failed: %v", err)
+	}
+	if want := want[:2]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	for raw, owner := range map[string][2]int{"1000": {1000, 1000}, "1000:100": {1000, 100}} {
+		viper.Set("add_layer_chown", raw)
+		got, err := getExtraLayers()
+		if err != nil {
+			t.Fatalf("get extra layers with --chown %s failed: %v", raw, err)
+		}
+		for _, l := range got {
+			if l.UID != owner[0] || l.GID != owner[1] {
+				t.Fatalf("expected %s to own %s, got %d:%d", raw, l, l.UID, l.GID)
+			}
+		}
+	}
+
+	for _, raw := range []string{"app", "-1", "1000:", "0:root"} {
+		viper.Set("add_layer_chown", raw)
+		if _, err := getExtraLayers(); err == nil {
+			t.Fatalf("expected error for --chown %q", raw)
+		}
+	}
+	viper.Set("add_layer_chown", "")
+	viper.Set("add_layers", []string{":/srv"})
+	if _, err := getExtraLayers(); err == nil {
+		t.Fatal("expected error without a source")
+	}
+	viper.Set("add_layers", nil)
+	viper.Set("add_layer_chown", "1000")
+	if _, err := getExtraLayers(); err == nil {
+		t.Fatal("expected error for --chown without --add-layer")
+	}
+}
+
+func TestGetIndexAnnotations(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	viper.Set("index_annotations", []string{
+		"org.example.channel=stable",
+		" org.example.team = platform ",
+		"org.opencontainers.image.description=a, b",
+	})
+	got, err := getIndexAnnotations()
+	if err != nil {
+		t.Fatalf("get index annotations failed: %v", err)
+	}
+	want := map[string]string{
+		"org.example.channel":                  "stable",
+		"org.example.team":                     "platform",
+		"org.opencontainers.image.description": "a, b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	viper.Set(
+		"index_annotations",
+		" org.example.team = platform ,org.example.url=https://ci.example/?a=b",
+	)
+	got, err = getIndexAnnotations()
+	if err != nil {
+		t.Fatalf("get index annotations from env failed: %v", err)
+	}
+	want = map[string]string{
+		"org.example.team": "platform",
+		"org.example.url":  "https://ci.example/?a=b",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	for _, raw := range []string{"channel", "=stable"} {
+		viper.Set("index_annotations", []string{raw})
+		if _, err := getIndexAnnotations(); err == nil {
+			t.Fatalf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestGetIndexArtifactType(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	tests := []struct {
+		raw            string
+		indexMediaType string
+		want           string
+		wantErr        bool
+	}{
+		{raw: ""},
+		{
+			raw:            " application/vnd.example.release.v1+json ",
+			indexMediaType: nixcontainers.IndexMediaTypeOCI,
+			want:           "application/vnd.example.release.v1+json",
+		},
+		{
+			raw:            "application/vnd.example.release",
+			indexMediaType: nixcontainers.IndexMediaTypeAuto,
+			want:           "application/vnd.example.release",
+		},
+		{
+			raw:            "application/vnd.example.release",
+			indexMediaType: nixcontainers.IndexMediaTypeDocker,
+			wantErr:        true,
+		},
+		{raw: "release", indexMediaType: nixcontainers.IndexMediaTypeOCI, wantErr: true},
+		{raw: "application/", indexMediaType: nixcontainers.IndexMediaTypeOCI, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		viper.Set("index_artifact_type", tt.raw)
+		got, err := getIndexArtifactType(tt.indexMediaType)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("expected error %v for %q, got %v", tt.wantErr, tt.raw, err)
+		}
+		if got != tt.want {
+			t.Fatalf("expected artifact type %q for %q, got %q", tt.want, tt.raw, got)
+		}
+	}
+}
+
+func TestGetECRRepository(t *testing.T) {
+	ecr := "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:latest"
+	tests := []struct {
+		name      string
+		image     string
+		push      bool
+		tags      []string
+		immutable bool
+		want      *nixcontainers.ECRRepositoryOptions
+		wantErr   string
+	}{
+		{
+			name:      "ecr",
+			image:     ecr,
+			push:      true,
+			tags:      []string{"team=platform, env=prod", "owner="},
+			immutable: true,
+			want: &nixcontainers.ECRRepositoryOptions{
+				Tags:          map[string]string{"team": "platform", "env": "prod", "owner": ""},
+				ImmutableTags: true,
+			},
+		},
+		{name: "without push", image: ecr, wantErr: "requires --push"},
+		{
+			name:    "outside ecr",
+			image:   "ghcr.io/you/app:latest",
+			push:    true,
+			wantErr: "requires an ECR registry",
+		},
+		{
+			name:    "invalid tag",
+			image:   ecr,
+			push:    true,
+			tags:    []string{"=prod"},
+			wantErr: "expected KEY=VALUE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("ecr_create_repo", true)
+			viper.Set("ecr_repo_tags", tt.tags)
+			viper.Set("ecr_immutable_tags", tt.immutable)
+			ref := mustParseTag(t, tt.image)
+
+			got, err := getECRRepository([]buildImage{{source: ref, destination: ref}}, tt.push)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get ECR repository failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetImageRefs(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       string
+		source      string
+		destination string
+		wantSource  string
+		wantDest    string
+		wantErr     string
+	}{
+		{
+			name:       "image only",
+			image:      "ghcr.io/example/app:latest",
+			wantSource: "ghcr.io/example/app:latest",
+			wantDest:   "ghcr.io/example/app:latest",
+		},
+		{
+			name:        "destination overrides image",
+			image:       "ghcr.io/example/app:latest",
+			destination: "ghcr.io/example/product:1.0",
+			wantSource:  "ghcr.io/example/app:latest",
+			wantDest:    "ghcr.io/example/product:1.0",
+		},
+		{
+			name:       "source without destination",
+			source:     "ghcr.io/example/app:latest",
+			wantSource: "ghcr.io/example/app:latest",
+			wantDest:   "ghcr.io/example/app:latest",
+		},
+		{
+			name:        "source overrides image",
+			image:       "ghcr.io/example/other:latest",
+			source:      "ghcr.io/example/app:latest",
+			destination: "ghcr.io/example/product:1.0",
+			wantSource:  "ghcr.io/example/app:latest",
+			wantDest:    "ghcr.io/example/product:1.0",
+		},
+		{
+			name:        "destination without source",
+			destination: "ghcr.io/example/product:1.0",
+			wantErr:     "--destination requires --source-image or IMAGE",
+		},
+		{name: "nothing set", wantErr: "no image set"},
+		{
+			name:        "invalid destination",
+			image:       "ghcr.io/example/app:latest",
+			destination: "not a reference",
+			wantErr:     "invalid destination image reference",
+		},
+		{
+			name:       "default tag",
+			image:      "ghcr.io/example/app",
+			wantSource: "ghcr.io/example/app:latest",
+			wantDest:   "ghcr.io/example/app:latest",
+		},
+		{
+			name:    "digest image",
+			image:   "ghcr.io/example/app@sha256:" + strings.Repeat("a", 64),
+			wantErr: "invalid IMAGE reference \"ghcr.io/example/app@sha256:",
+		},
+		{
+			name:    "digest error suggests a tag",
+			image:   "ghcr.io/example/app@sha256:" + strings.Repeat("a", 64),
+			wantErr: "use a tag such as ghcr.io/you/app:latest",
+		},
+		{
+			name:    "invalid image",
+			image:   "ghcr.io/example/App:latest",
+			wantErr: "invalid IMAGE reference \"ghcr.io/example/App:latest\"",
+		},
+		{
+			name:        "invalid source image",
+			source:      "ghcr.io/example/app:bad tag",
+			destination: "ghcr.io/example/product:1.0",
+			wantErr:     "invalid source image reference",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("image", tt.image)
+			viper.Set("source_image", tt.source)
+			viper.Set("destination", tt.destination)
+
+			source, destination, err := getImageRefs()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get image refs failed: %v", err)
+			}
+			if source.Name() != tt.wantSource || destination.Name() != tt.wantDest {
+				t.Fatalf(
+					"expected %s -> %s, got %s -> %s",
+					tt.wantSource,
+					tt.wantDest,
+					source.Name(),
+					destination.Name(),
+				)
+			}
+		})
+	}
+}
+
+func TestGetBuildImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		images  string
+		source  string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "single image",
+			image: "ghcr.io/example/app:latest",
+			want:  []string{"ghcr.io/example/app:latest"},
+		},
+		{
+			name:   "image and images",
+			image:  "ghcr.io/example/app:latest",
+			images: "ghcr.io/example/api:1.0  ghcr.io/example/web:1.0\nghcr.io/example/app:latest",
+			want: []string{
+				"ghcr.io/example/app:latest",
+				"ghcr.io/example/api:1.0",
+				"ghcr.io/example/web:1.0",
+			},
+		},
+		{
+			name:   "images only",
+			images: "ghcr.io/example/api",
+			want:   []string{"ghcr.io/example/api:latest"},
+		},
+		{
+			name:    "invalid image",
+			images:  "ghcr.io/example/api:1.0 ghcr.io/example/Web:1.0",
+			wantErr: "invalid IMAGES reference \"ghcr.io/example/Web:1.0\"",
+		},
+		{
+			name:    "images with source image",
+			images:  "ghcr.io/example/api:1.0",
+			source:  "ghcr.io/example/app:latest",
+			wantErr: "IMAGES cannot be combined with --source-image",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("image", tt.image)
+			viper.Set("images", tt.images)
+			viper.Set("source_image", tt.source)
+
+			images, err := getBuildImages()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get build images failed: %v", err)
+			}
+			var got []string
+			for _, image := range images {
+				if image.source.Name() != image.destination.Name() {
+					t.Fatalf("expected %s to be built from its own package", image.destination)
+				}
+				got = append(got, image.destination.Name())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected images %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetLogLevelVerbosity(t *testing.T) {
+	tests := []struct {
+		name     string
+		logLevel string
+		verbose  int
+		quiet    bool
+		want     slog.Level
+		wantNix  slog.Level
+	}{
+		{name: "default", want: slog.LevelInfo, wantNix: slog.LevelDebug},
+		{name: "verbose", verbose: 1, want: slog.LevelDebug, wantNix: slog.LevelDebug},
+		{name: "very verbose", verbose: 2, want: slog.LevelDebug, wantNix: slog.LevelInfo},
+		{
+			name:     "verbose keeps trace",
+			logLevel: "trace",
+			verbose:  1,
+			want:     nixcontainers.LevelTrace,
+			wantNix:  slog.LevelDebug,
+		},
+		{
+			name:     "quiet overrides env",
+			logLevel: "debug",
+			quiet:    true,
+			want:     slog.LevelWarn,
+			wantNix:  slog.LevelDebug,
+		},
+		{
+			name:     "quiet keeps error",
+			logLevel: "error",
+			quiet:    true,
+			want:     slog.LevelError,
+			wantNix:  slog.LevelDebug,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("log_level", tt.logLevel)
+			viper.Set("verbose", tt.verbose)
+			viper.Set("quiet", tt.quiet)
+
+			got, err := getLogLevel()
+			if err != nil {
+				t.Fatalf("get log level failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected level %v, got %v", tt.want, got)
+			}
+			if got := getNixStderrLevel(); got != tt.wantNix {
+				t.Fatalf("expected nix stderr level %v, got %v", tt.wantNix, got)
+			}
+		})
+	}
+}
+
+func TestGetHeartbeatInterval(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	viper.Set("heartbeat_interval", "90s")
+	if got, err := getHeartbeatInterval(context.Background()); got != 90*time.Second || err != nil {
+		t.Fatalf("expected 90s, got %s, %v", got, err)
+	}
+	viper.Set("heartbeat_interval", "0")
+	if got, err := getHeartbeatInterval(context.Background()); got != 0 || err != nil {
+		t.Fatalf("expected heartbeats disabled, got %s, %v", got, err)
+	}
+	viper.Set("heartbeat_interval", "-1m")
+	if _, err := getHeartbeatInterval(context.Background()); err == nil {
+		t.Fatal("expected error for a negative interval")
+	}
+}
+
+func TestGetLatestTag(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.AutomaticEnv()
+	t.Setenv("LATEST", "x")
+
+	if tag, err := getLatestTag(); tag != "" || err != nil {
+		t.Fatalf("expected no latest tag by default, got %q, %v", tag, err)
+	}
+	viper.Set("latest_tag", "stable")
+	if tag, err := getLatestTag(); tag != "stable" || err != nil {
+		t.Fatalf("expected latest tag stable, got %q, %v", tag, err)
+	}
+	viper.Set("latest_tag", "not/a/tag")
+	if _, err := getLatestTag(); err == nil || !strings.Contains(err.Error(), "invalid --latest") {
+		t.Fatalf("expected error for an invalid tag, got %v", err)
+	}
+}
+
+func TestGetBuildImagesPackageMap(t *testing.T) {
+	tests := []struct {
+		name       string
+		images     string
+		packageMap any
+		want       []string
+		wantErr    string
+	}{
+		{
+			name:   "repository names",
+			images: "ghcr.io/example/app ghcr.io/example/api.v2",
+			want:   []string{"app", "api-v2"},
+		},
+		{
+			name:       "mapped repositories",
+			images:     "ghcr.io/example/api.v2 ghcr.io/example/worker:1.0 ghcr.io/example/app",
+			packageMap: []string{"ghcr.io/example/api.v2=apiV2", "ghcr.io/example/worker=jobs"},
+			want:       []string{"apiV2", "jobs", "app"},
+		},
+		{
+			name:       "comma-separated env",
+			images:     "ghcr.io/example/api.v2 ghcr.io/example/worker:1.0 ghcr.io/example/app",
+			packageMap: "ghcr.io/example/api.v2=apiV2, ghcr.io/example/worker=jobs",
+			want:       []string{"apiV2", "jobs", "app"},
+		},
+		{
+			name:       "docker hub repository",
+			images:     "example/app",
+			packageMap: []string{"docker.io/example/app=server"},
+			want:       []string{"server"},
+		},
+		{
+			name:       "missing attribute",
+			images:     "ghcr.io/example/app",
+			packageMap: []string{"ghcr.io/example/app"},
+			wantErr:    "expected REPO=ATTR",
+		},
+		{
+			name:       "invalid attribute",
+			images:     "ghcr.io/example/app",
+			packageMap: []string{"ghcr.io/example/app=app.v2"},
+			wantErr:    "app.v2 is not a flake attribute name",
+		},
+		{
+			name:       "tagged repository",
+			images:     "ghcr.io/example/app",
+			packageMap: []string{"ghcr.io/example/app:1.0=app"},
+			wantErr:    "invalid package mapping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("images", tt.images)
+			viper.Set("package_map", tt.packageMap)
+
+			images, err := getBuildImages()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get build images failed: %v", err)
+			}
+			got := make([]string, 0, len(images))
+			for _, image := range images {
+				got = append(got, image.flakePackage())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected packages %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckPushByDigest(t *testing.T) {
+	tests := []struct {
+		name    string
+		images  string
+		push    bool
+		latest  string
+		wantErr string
+	}{
+		{name: "repository", images: "ghcr.io/example/app", push: true},
+		{name: "without push", images: "ghcr.io/example/app", wantErr: "requires --push"},
+		{
+			name:    "with latest",
+			images:  "ghcr.io/example/app",
+			push:    true,
+			latest:  "latest",
+			wantErr: "cannot be combined with --latest",
+		},
+		{
+			name:    "tagged image",
+			images:  "ghcr.io/example/api ghcr.io/example/web:1.0",
+			push:    true,
+			wantErr: "instead of ghcr.io/example/web:1.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("images", tt.images)
+
+			images, err := getBuildImages()
+			if err != nil {
+				t.Fatalf("get build images failed: %v", err)
+			}
+			err = checkPushByDigest(images, tt.push, tt.latest)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("expected push by digest allowed, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckIfNotExists(t *testing.T) {
+	tests := []struct {
+		name         string
+		ifNotExists  bool
+		failIfExists bool
+		push         bool
+		pushByDigest bool
+		wantErr      string
+	}{
+		{name: "skip existing", ifNotExists: true, push: true},
+		{name: "fail existing", failIfExists: true, push: true},
+		{name: "without push", ifNotExists: true, wantErr: "require --push"},
+		{
+			name:         "both",
+			ifNotExists:  true,
+			failIfExists: true,
+			push:         true,
+			wantErr:      "cannot be combined with --fail-if-exists",
+		},
+		{
+			name:         "by digest",
+			failIfExists: true,
+			push:         true,
+			pushByDigest: true,
+			wantErr:      "cannot be combined with --push-by-digest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("if_not_exists", tt.ifNotExists)
+			viper.Set("fail_if_exists", tt.failIfExists)
+
+			err := checkIfNotExists(tt.push, tt.pushByDigest)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("expected the existing tag check allowed, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestGetCompression(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	comp, level, err := getCompression()
+	if err != nil || comp != compression.GZip || level != nixcontainers.DefaultCompressionLevel {
+		t.Fatalf("expected default gzip compression, got %s, %d, %v", comp, level, err)
+	}
+	viper.Set("compression", "ZSTD")
+	viper.Set("compression_level", "19")
+	comp, level, err = getCompression()
+	if err != nil || comp != compression.ZStd || level != 19 {
+		t.Fatalf("expected zstd level 19, got %s, %d, %v", comp, level, err)
+	}
+	for _, tt := range []struct {
+		compression, level, wantErr string
+	}{
+		{compression: "brotli", wantErr: "invalid compression"},
+		{compression: "gzip", level: "10", wantErr: "expected 0 to 9"},
+		{compression: "zstd", level: "fast", wantErr: "expected an integer"},
+	} {
+		viper.Set("compression", tt.compression)
+		viper.Set("compression_level", tt.level)
+		if _, _, err := getCompression(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Fatalf("expected error containing %q for %+v, got %v", tt.wantErr, tt, err)
+		}
+	}
+}
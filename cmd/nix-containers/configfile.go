@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+
+	"github.com/spf13/viper"
+)
+
+// defaultConfigFile is the project config file read from the working
+// directory when --config is not set.
+const defaultConfigFile = ".nix-containers.yaml"
+
+// configFileAliases maps the shorter config file keys to their settings.
+var configFileAliases = map[string]string{
+	"push":       "push_image",
+	"entrypoint": "image_entrypoint",
+	"cmd":        "image_cmd",
+	"env":        "image_env",
+	"latest":     "latest_tag",
+	"user":       "image_user",
+	"workdir":    "image_workdir",
+	"expose":     "image_expose",
+	"volumes":    "image_volumes",
+}
+
+// configFileListKeys are comma-separated settings that the config file may
+// also spell as YAML lists, kept as lists so an entry may hold commas.
+var configFileListKeys = []string{
+	"platforms",
+	"image_entrypoint",
+	"image_cmd",
+	"package_map",
+	"ecr_repo_tags",
+	"index_annotations",
+	"attach",
+	"add_layers",
+}
+
+// loadConfigFile merges the YAML config file at path into the settings below
+// flags and env vars. A missing file is only an error when it was explicitly
+// requested. Unknown keys are ignored with a warning listing the valid ones.
+func loadConfigFile(path string, explicit bool) error {
+	cfg := viper.New()
+	cfg.SetConfigFile(path)
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadInConfig(); err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	valid := configFileKeys()
+	settings := make(map[string]any)
+	var unknown []string
+	for key, value := range cfg.AllSettings() {
+		if alias, ok := configFileAliases[key]; ok {
+			key = alias
+		}
+		if !slices.Contains(valid, key) {
+			unknown = append(unknown, key)
+			continue
+		}
+		if list, ok := value.([]any); ok && slices.Contains(configFileListKeys, key) {
+			items := make([]string, 0, len(list))
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+			value = items
+		}
+		settings[key] = value
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		slog.Warn(
+			"unknown config file keys ignored",
+			"path", path,
+			"keys", unknown,
+			"valid_keys", valid,
+		)
+	}
+	if err := viper.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("failed to merge config file %s: %w", path, err)
+	}
+	slog.Debug("config file loaded", "path", path, "keys", len(settings))
+	return nil
+}
+
+// configFileKeys returns the sorted settings a config file may set: every
+// key bound to a flag or env var, except the config file path itself.
+func configFileKeys() []string {
+	keys := slices.DeleteFunc(viper.AllKeys(), func(key string) bool {
+		return key == "config_file"
+	})
+	for alias := range configFileAliases {
+		keys = append(keys, alias)
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
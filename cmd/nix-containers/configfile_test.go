@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func setupConfigFileTest(t *testing.T, content string) string {
+	t.Helper()
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	for key, env := range map[string]string{
+		"image":               "IMAGE",
+		"platforms":           "PLATFORMS",
+		"push_image":          "PUSH_IMAGE",
+		"accept_flake_config": "ACCEPT_FLAKE_CONFIG",
+		"image_entrypoint":    "IMAGE_ENTRYPOINT",
+		"image_cmd":           "IMAGE_CMD",
+	} {
+		if err := viper.BindEnv(key, env); err != nil {
+			t.Fatalf("bind env failed: %v", err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), defaultConfigFile)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := setupConfigFileTest(t, `image: ghcr.io/example/app:latest
+platforms:
+  - linux/amd64
+  - linux/arm64
+push: true
+accept_flake_config: true
+unknown_key: ignored
+`)
+	t.Setenv("IMAGE", "ghcr.io/example/app:env")
+
+	if err := loadConfigFile(path, true); err != nil {
+		t.Fatalf("load config file failed: %v", err)
+	}
+	if got := viper.GetString("image"); got != "ghcr.io/example/app:env" {
+		t.Fatalf("expected env to win over the config file, got %q", got)
+	}
+	if got := getPlatformsSetting(); got != "linux/amd64,linux/arm64" {
+		t.Fatalf("expected platforms list to be joined, got %q", got)
+	}
+	if !getPushImage() {
+		t.Fatalf("expected push alias to set push_image")
+	}
+	if !viper.GetBool("accept_flake_config") {
+		t.Fatalf("expected accept_flake_config from the config file")
+	}
+	if viper.IsSet("unknown_key") {
+		t.Fatalf("expected unknown key to be ignored")
+	}
+}
+
+func TestLoadConfigFileCommandList(t *testing.T) {
+	path := setupConfigFileTest(t, `entrypoint: ["sh", "-c", "echo a,b"]
+cmd: []
+`)
+
+	if err := loadConfigFile(path, true); err != nil {
+		t.Fatalf("load config file failed: %v", err)
+	}
+	cfg, err := getImageConfig()
+	if err != nil {
+		t.Fatalf("get image config failed: %v", err)
+	}
+	if want := []string{"sh", "-c", "echo a,b"}; !slices.Equal(cfg.Entrypoint, want) {
+		t.Fatalf("expected entrypoint %q, got %q", want, cfg.Entrypoint)
+	}
+	if cfg.Cmd == nil || len(cfg.Cmd) != 0 {
+		t.Fatalf("expected an empty cmd list to clear cmd, got %#v", cfg.Cmd)
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	setupConfigFileTest(t, "")
+	missing := filepath.Join(t.TempDir(), defaultConfigFile)
+
+	if err := loadConfigFile(missing, false); err != nil {
+		t.Fatalf("expected missing default config file to be skipped, got %v", err)
+	}
+	if err := loadConfigFile(missing, true); err == nil {
+		t.Fatalf("expected error for missing explicit config file")
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	path := setupConfigFileTest(t, "image: [unterminated\n")
+	if err := loadConfigFile(path, false); err == nil {
+		t.Fatalf("expected error for invalid config file")
+	}
+}
+
+func TestGetConfigFileIgnoresShellEnv(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.AutomaticEnv()
+	if err := viper.BindEnv("config_file", "NIX_CONTAINERS_CONFIG"); err != nil {
+		t.Fatalf("bind env failed: %v", err)
+	}
+	t.Setenv("CONFIG", "/nonexistent")
+
+	if got := getConfigFile(); got != "" {
+		t.Fatalf("expected CONFIG to be ignored, got %q", got)
+	}
+	t.Setenv("NIX_CONTAINERS_CONFIG", "ci.yaml")
+	if got := getConfigFile(); got != "ci.yaml" {
+		t.Fatalf("expected NIX_CONTAINERS_CONFIG to set the config file, got %q", got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var copyCmd = &cobra.Command{
+	Use:   "copy SRC DST",
+	Short: "Copy an image or index between registries",
+	Long:  "Copies the manifest or index SRC resolves to, with every platform image and blob, to DST, with the credentials and registry transport settings of the build. Blobs the destination already has are skipped, and blobs within the same registry are mounted from the source repository instead of uploaded. With --copy-referrers, the artifacts referring to the image, such as signatures or test reports, are copied too. Prints the digest reference of the copy.",
+	Example: "# Promote a staging image to the production registry\n" +
+		"./nix-containers copy ghcr.io/you/app:v1.4.0 registry.example.com/prod/app:v1.4.0\n\n" +
+		"# Copy the signatures and attestations along\n" +
+		"./nix-containers copy --copy-referrers ghcr.io/you/app:v1.4.0 registry.example.com/prod/app:v1.4.0",
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, err := name.ParseReference(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid source reference %q: %w", args[0], err)
+		}
+		dst, err := name.ParseReference(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid destination reference %q: %w", args[1], err)
+		}
+		auth, err := getRegistryAuth([]string{
+			src.Context().RegistryStr(),
+			dst.Context().RegistryStr(),
+		})
+		if err != nil {
+			return err
+		}
+		registryTransport, err := getRegistryTransport()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := nixcontainers.PhaseTimeoutContext(cmd.Context(), "push", getPushTimeout())
+		defer cancel()
+		opts := []remote.Option{
+			remote.WithAuthFromKeychain(auth.keychain),
+			remote.WithContext(ctx),
+		}
+		// The default settings keep the go-containerregistry transport as is.
+		if registryTransport != nixcontainers.DefaultRegistryTransport() {
+			opts = append(opts, registryTransport.RemoteOptions()...)
+		}
+		copied, err := copyImage(ctx, src, dst, viper.GetBool("copy_referrers"), opts...)
+		if err != nil {
+			return nixcontainers.WrapPhaseTimeout(ctx, err)
+		}
+		_, err = fmt.Fprintln(cmd.OutOrStdout(), copied)
+		return err
+	},
+}
+
+func init() {
+	copyCmd.Flags().Bool(
+		"copy-referrers",
+		false,
+		"also copy the artifacts referring to the image, such as signatures",
+	)
+	if err := viper.BindPFlag("copy_referrers", copyCmd.Flags().Lookup("copy-referrers")); err != nil {
+		slog.Error("bind flag failed", "flag", "copy-referrers", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(copyCmd)
+}
+
+// copyImage copies the manifest or index src resolves to, with its children
+// and blobs, to dst and returns its digest reference in the repository of
+// dst. The pusher skips the blobs dst already has and mounts those of the
+// same registry from src. With referrers, the artifacts referring to src are
+// copied after it.
+func copyImage(
+	ctx context.Context,
+	src, dst name.Reference,
+	referrers bool,
+	opts ...remote.Option,
+) (name.Digest, error) {
+	desc, err := remote.Get(src, opts...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("resolve %s failed: %w", src, err)
+	}
+	pusher, err := remote.NewPusher(opts...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("failed to create registry pusher: %w", err)
+	}
+	// Within the repository of src, the blobs and children are there already.
+	if dst.Context() == src.Context() {
+		err = pusher.Put(ctx, dst, desc)
+	} else {
+		err = pusher.Push(ctx, dst, desc)
+	}
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("copy %s to %s failed: %w", src, dst, err)
+	}
+	copied := dst.Context().Digest(desc.Digest.String())
+	slog.InfoContext(
+		ctx,
+		"image copied",
+		"src", src.Name(),
+		"dst", dst.Name(),
+		"digest", desc.Digest,
+		"media_type", desc.MediaType,
+	)
+	if referrers {
+		subject := src.Context().Digest(desc.Digest.String())
+		if err := copyReferrers(ctx, subject, dst.Context(), opts...); err != nil {
+			return name.Digest{}, err
+		}
+	}
+	return copied, nil
+}
+
+// copyReferrers copies the artifacts referring to subject to repo. They are
+// written one by one, so that on registries without the OCI Referrers API
+// go-containerregistry adds them to the referrers tag of the subject.
+func copyReferrers(
+	ctx context.Context,
+	subject name.Digest,
+	repo name.Repository,
+	opts ...remote.Option,
+) error {
+	idx, err := remote.Referrers(subject, opts...)
+	if err != nil {
+		return fmt.Errorf("list referrers of %s failed: %w", subject, err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("read referrers of %s failed: %w", subject, err)
+	}
+	for _, d := range m.Manifests {
+		ref := subject.Context().Digest(d.Digest.String())
+		desc, err := remote.Get(ref, opts...)
+		if err != nil {
+			return fmt.Errorf("resolve referrer %s failed: %w", ref, err)
+		}
+		dst := repo.Digest(d.Digest.String())
+		if desc.MediaType.IsIndex() {
+			err = writeReferrerIndex(desc, dst, opts...)
+		} else {
+			err = writeReferrerImage(desc, dst, opts...)
+		}
+		if err != nil {
+			return fmt.Errorf("copy referrer %s to %s failed: %w", ref, dst, err)
+		}
+		slog.InfoContext(
+			ctx,
+			"referrer copied",
+			"subject", subject.Name(),
+			"referrer", dst.Name(),
+			"artifact_type", d.ArtifactType,
+		)
+	}
+	return nil
+}
+
+func writeReferrerIndex(desc *remote.Descriptor, dst name.Digest, opts ...remote.Option) error {
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return err
+	}
+	return remote.WriteIndex(dst, idx, opts...)
+}
+
+func writeReferrerImage(desc *remote.Descriptor, dst name.Digest, opts ...remote.Option) error {
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	return remote.Write(dst, img, opts...)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+// blobUploadCounter counts the blob uploads a registry completes and the
+// cross-repository mounts it is asked for, which fall back to uploads when
+// the blob cannot be mounted.
+type blobUploadCounter struct {
+	uploads atomic.Int32
+	mounts  atomic.Int32
+}
+
+func (c *blobUploadCounter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Get("mount") != "":
+			c.mounts.Add(1)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+			c.uploads.Add(1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestCopyImage(t *testing.T) {
+	src := newTestRegistryRef(
+		t,
+		registry.New(registry.WithReferrersSupport(false)),
+		"example/app:v1.4.0",
+	)
+	var counter blobUploadCounter
+	dst := newTestRegistryRef(
+		t,
+		counter.wrap(registry.New(registry.WithReferrersSupport(true))),
+		"prod/app:v1.4.0",
+	)
+	var idx v1.ImageIndex = empty.Index
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(64, 2)
+		if err != nil {
+			t.Fatalf("create random image failed: %v", err)
+		}
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: arch}},
+		})
+	}
+	if err := remote.WriteIndex(src, idx); err != nil {
+		t.Fatalf("push source index failed: %v", err)
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		t.Fatalf("index digest failed: %v", err)
+	}
+	if _, err := nixcontainers.AttachArtifact(context.Background(), src, nixcontainers.Attachment{
+		Path:         writeAttachmentFile(t, "report.json"),
+		ArtifactType: "application/vnd.example.test-report+json",
+	}); err != nil {
+		t.Fatalf("attach artifact failed: %v", err)
+	}
+
+	copied, err := copyImage(context.Background(), src, dst, true)
+	if err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if copied.DigestStr() != digest.String() || copied.Context() != dst.Context() {
+		t.Fatalf("expected %s@%s, got %s", dst.Context(), digest, copied)
+	}
+	assertSameDigest(t, src, dst)
+	referrers, err := remote.Referrers(copied)
+	if err != nil {
+		t.Fatalf("list referrers failed: %v", err)
+	}
+	m, err := referrers.IndexManifest()
+	if err != nil {
+		t.Fatalf("read referrers failed: %v", err)
+	}
+	if len(m.Manifests) != 1 ||
+		m.Manifests[0].ArtifactType != "application/vnd.example.test-report+json" {
+		t.Fatalf("expected the test report to be copied, got %+v", m.Manifests)
+	}
+	// 2 images of 2 layers and a config each, and the artifact blob and config.
+	if got := counter.uploads.Load(); got != 8 {
+		t.Fatalf("expected 8 blob uploads, got %d", got)
+	}
+
+	counter.uploads.Store(0)
+	if _, err := copyImage(context.Background(), src, dst, false); err != nil {
+		t.Fatalf("copy again failed: %v", err)
+	}
+	if got := counter.uploads.Load(); got != 0 {
+		t.Fatalf("expected the blobs of the destination to be skipped, got %d uploads", got)
+	}
+
+	staging := dst.Context().Registry.Repo("staging", "app").Tag("v1.4.0")
+	if _, err := copyImage(context.Background(), dst, staging, false); err != nil {
+		t.Fatalf("copy within the registry failed: %v", err)
+	}
+	assertSameDigest(t, dst, staging)
+	if uploads, mounts := counter.uploads.Load(), counter.mounts.Load(); uploads != 0 || mounts == 0 {
+		t.Fatalf("expected the blobs to be mounted, got %d uploads and %d mounts", uploads, mounts)
+	}
+}
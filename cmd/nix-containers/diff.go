@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Exit codes of the diff command, following diff(1).
+const (
+	exitCodeImagesDiffer = 1
+	exitCodeDiffFailed   = 2
+)
+
+const (
+	diffRemotePrefix = "docker://"
+	diffDaemonPrefix = "docker-daemon:"
+	diffLayoutPrefix = "oci:"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff REF_A REF_B",
+	Short: "Compare two images layer by layer",
+	Long:  "Compares the config (env, entrypoint, cmd, labels, created) and the layers of two images and reports the added, removed and changed layers with their sizes. The store paths of the layers that differ are compared too, so a package update reads as its old and new version. References are read from their registry, or with the docker-daemon:REF prefix from the Docker daemon, or with the oci:DIR[:TAG] prefix from an OCI image layout such as the one --output-oci writes. Exits 0 when the images are identical, 1 when they differ, and 2 on failure.",
+	Example: "# Compare the image CI pushed with the previous release\n" +
+		"./nix-containers diff ghcr.io/you/app:v1.3.0 ghcr.io/you/app:v1.4.0\n\n" +
+		"# Compare a local build with the pushed image\n" +
+		"./nix-containers diff docker-daemon:app:latest ghcr.io/you/app:latest",
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		differ, err := runDiff(cmd.Context(), cmd.OutOrStdout(), args[0], args[1])
+		if err != nil {
+			return &exitCodeError{code: exitCodeDiffFailed, err: err}
+		}
+		if differ {
+			// The report already says how the images differ.
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+			return &exitCodeError{code: exitCodeImagesDiffer}
+		}
+		return nil
+	},
+}
+
+func init() {
+	diffCmd.Flags().String("platform", "", "platform to read from indexes (default: host)")
+	if err := viper.BindPFlag("diff_platform", diffCmd.Flags().Lookup("platform")); err != nil {
+		slog.Error("bind flag failed", "flag", "platform", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(diffCmd)
+}
+
+func runDiff(ctx context.Context, out io.Writer, rawA, rawB string) (bool, error) {
+	p, err := parsePlatformFlag(viper.GetString("diff_platform"))
+	if err != nil {
+		return false, err
+	}
+	a, err := loadDiffImage(ctx, rawA, p)
+	if err != nil {
+		return false, err
+	}
+	b, err := loadDiffImage(ctx, rawB, p)
+	if err != nil {
+		return false, err
+	}
+	d, err := diffImages(a, b)
+	if err != nil {
+		return false, err
+	}
+	if err := d.write(out); err != nil {
+		return false, fmt.Errorf("write diff failed: %w", err)
+	}
+	return !d.identical(), nil
+}
+
+// loadDiffImage reads the image raw refers to, resolving indexes to the
+// image for p.
+func loadDiffImage(ctx context.Context, raw string, p *v1.Platform) (v1.Image, error) {
+	if rest, ok := strings.CutPrefix(raw, diffDaemonPrefix); ok {
+		ref, err := name.ParseReference(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image reference %q: %w", rest, err)
+		}
+		img, err := daemon.Image(ref, daemon.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("read %s from the Docker daemon failed: %w", ref, err)
+		}
+		return img, nil
+	}
+	if rest, ok := strings.CutPrefix(raw, diffLayoutPrefix); ok {
+		dir, tag, _ := strings.Cut(rest, ":")
+		return layoutImage(dir, tag, p)
+	}
+	rest := strings.TrimPrefix(raw, diffRemotePrefix)
+	ref, err := name.ParseReference(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %w", rest, err)
+	}
+	auth, err := getRegistryAuth([]string{ref.Context().RegistryStr()})
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(
+		ref,
+		remote.WithPlatform(*p),
+		remote.WithAuthFromKeychain(auth.keychain),
+		remote.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %w", ref, err)
+	}
+	return img, nil
+}
+
+// layoutImage reads the image for p from the OCI image layout in dir, out of
+// the entry named tag, or its only entry when tag is empty.
+func layoutImage(dir, tag string, p *v1.Platform) (v1.Image, error) {
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read OCI layout %s failed: %w", dir, err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("read OCI layout %s index failed: %w", dir, err)
+	}
+	var matches []v1.Descriptor
+	for _, d := range m.Manifests {
+		if tag == "" || d.Annotations[nixcontainers.OCIRefNameAnnotation] == tag {
+			matches = append(matches, d)
+		}
+	}
+	switch {
+	case len(matches) == 0 && tag != "":
+		return nil, fmt.Errorf("OCI layout %s has no image named %q", dir, tag)
+	case len(matches) != 1:
+		return nil, fmt.Errorf(
+			"OCI layout %s has %d images, select one with oci:%s:TAG",
+			dir,
+			len(matches),
+			dir,
+		)
+	}
+	return resolveDescriptorImage(idx, matches[0], p)
+}
+
+func resolveDescriptorImage(
+	idx v1.ImageIndex,
+	d v1.Descriptor,
+	p *v1.Platform,
+) (v1.Image, error) {
+	if !d.MediaType.IsIndex() {
+		return idx.Image(d.Digest)
+	}
+	child, err := idx.ImageIndex(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	m, err := child.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range m.Manifests {
+		if c.Platform != nil && c.Platform.Satisfies(*p) {
+			return resolveDescriptorImage(child, c, p)
+		}
+	}
+	return nil, fmt.Errorf("index %s has no image for %s", d.Digest, p)
+}
+
+// imageDiff is how two images differ. It only holds the digests when their
+// manifests match.
+type imageDiff struct {
+	DigestA  v1.Hash
+	DigestB  v1.Hash
+	Config   []configChange
+	Layers   []layerChange
+	Packages []packageChange
+}
+
+// configChange is a config field that differs, with "" for a value only one
+// image sets.
+type configChange struct {
+	Field string
+	A     string
+	B     string
+}
+
+// layerChange is a layer only one image has, or a pair of them taking each
+// other's place.
+type layerChange struct {
+	A *diffLayer
+	B *diffLayer
+}
+
+// diffLayer is a layer of a manifest with its uncompressed digest, which
+// matches across compressions, such as between the Docker daemon and a
+// registry.
+type diffLayer struct {
+	Digest v1.Hash
+	DiffID v1.Hash
+	Size   int64
+}
+
+// packageChange is a store path name whose versions differ between the
+// layers that changed.
+type packageChange struct {
+	Name     string
+	VersionA string
+	VersionB string
+	Added    bool
+	Removed  bool
+	Rebuilt  bool
+}
+
+func diffImages(a, b v1.Image) (imageDiff, error) {
+	var d imageDiff
+	var err error
+	if d.DigestA, err = a.Digest(); err != nil {
+		return imageDiff{}, fmt.Errorf("read image digest failed: %w", err)
+	}
+	if d.DigestB, err = b.Digest(); err != nil {
+		return imageDiff{}, fmt.Errorf("read image digest failed: %w", err)
+	}
+	if d.DigestA == d.DigestB {
+		return d, nil
+	}
+	cfgA, err := a.ConfigFile()
+	if err != nil {
+		return imageDiff{}, fmt.Errorf("read image config failed: %w", err)
+	}
+	cfgB, err := b.ConfigFile()
+	if err != nil {
+		return imageDiff{}, fmt.Errorf("read image config failed: %w", err)
+	}
+	d.Config = diffConfig(cfgA, cfgB)
+
+	layersA, err := diffLayers(a, cfgA)
+	if err != nil {
+		return imageDiff{}, err
+	}
+	layersB, err := diffLayers(b, cfgB)
+	if err != nil {
+		return imageDiff{}, err
+	}
+	onlyA, onlyB := uniqueLayers(layersA, layersB), uniqueLayers(layersB, layersA)
+	for i := range max(len(onlyA), len(onlyB)) {
+		var c layerChange
+		if i < len(onlyA) {
+			c.A = &onlyA[i]
+		}
+		if i < len(onlyB) {
+			c.B = &onlyB[i]
+		}
+		d.Layers = append(d.Layers, c)
+	}
+
+	pathsA, err := layerStorePaths(a, onlyA)
+	if err != nil {
+		return imageDiff{}, err
+	}
+	pathsB, err := layerStorePaths(b, onlyB)
+	if err != nil {
+		return imageDiff{}, err
+	}
+	d.Packages = diffStorePaths(pathsA, pathsB)
+	return d, nil
+}
+
+// identical reports whether the images have the same manifest, or the same
+// config fields and layer contents compared.
+func (d imageDiff) identical() bool {
+	return d.DigestA == d.DigestB || len(d.Config) == 0 && len(d.Layers) == 0
+}
+
+func diffConfig(a, b *v1.ConfigFile) []configChange {
+	var changes []configChange
+	envA, envB := envMap(a.Config.Env), envMap(b.Config.Env)
+	for _, key := range sortedUnion(envA, envB) {
+		if envA[key] != envB[key] {
+			changes = append(changes, configChange{Field: "env " + key, A: envA[key], B: envB[key]})
+		}
+	}
+	if !slices.Equal(a.Config.Entrypoint, b.Config.Entrypoint) {
+		changes = append(changes, configChange{
+			Field: "entrypoint",
+			A:     formatCommand(a.Config.Entrypoint),
+			B:     formatCommand(b.Config.Entrypoint),
+		})
+	}
+	if !slices.Equal(a.Config.Cmd, b.Config.Cmd) {
+		changes = append(changes, configChange{
+			Field: "cmd",
+			A:     formatCommand(a.Config.Cmd),
+			B:     formatCommand(b.Config.Cmd),
+		})
+	}
+	for _, key := range sortedUnion(a.Config.Labels, b.Config.Labels) {
+		if a.Config.Labels[key] != b.Config.Labels[key] {
+			changes = append(changes, configChange{
+				Field: "label " + key,
+				A:     a.Config.Labels[key],
+				B:     b.Config.Labels[key],
+			})
+		}
+	}
+	if !a.Created.Equal(b.Created.Time) {
+		changes = append(changes, configChange{
+			Field: "created",
+			A:     a.Created.UTC().Format("2006-01-02T15:04:05Z"),
+			B:     b.Created.UTC().Format("2006-01-02T15:04:05Z"),
+		})
+	}
+	return changes
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func sortedUnion[V any](a, b map[string]V) []string {
+	keys := slices.AppendSeq(slices.Collect(maps.Keys(a)), maps.Keys(b))
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+func formatCommand(args []string) string {
+	if args == nil {
+		return ""
+	}
+	return fmt.Sprintf("%q", args)
+}
+
+func diffLayers(img v1.Image, cfg *v1.ConfigFile) ([]diffLayer, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("read image manifest failed: %w", err)
+	}
+	if len(m.Layers) != len(cfg.RootFS.DiffIDs) {
+		return nil, fmt.Errorf(
+			"image manifest lists %d layers but its config %d",
+			len(m.Layers),
+			len(cfg.RootFS.DiffIDs),
+		)
+	}
+	layers := make([]diffLayer, 0, len(m.Layers))
+	for i, l := range m.Layers {
+		layers = append(layers, diffLayer{
+			Digest: l.Digest,
+			DiffID: cfg.RootFS.DiffIDs[i],
+			Size:   l.Size,
+		})
+	}
+	return layers, nil
+}
+
+// uniqueLayers returns the layers of a, in order, that b does not have.
+func uniqueLayers(a, b []diffLayer) []diffLayer {
+	var unique []diffLayer
+	for _, l := range a {
+		if !slices.ContainsFunc(b, func(o diffLayer) bool { return o.DiffID == l.DiffID }) {
+			unique = append(unique, l)
+		}
+	}
+	return unique
+}
+
+// layerStorePaths lists the store paths of the given layers of img. Only the
+// layers that differ are read, which for a remote image means downloaded.
+func layerStorePaths(img v1.Image, layers []diffLayer) ([]string, error) {
+	var paths []string
+	for _, desc := range layers {
+		l, err := img.LayerByDiffID(desc.DiffID)
+		if err != nil {
+			return nil, fmt.Errorf("get layer %s failed: %w", desc.Digest, err)
+		}
+		s, err := nixcontainers.SummarizeLayer(l)
+		if err != nil {
+			return nil, fmt.Errorf("read layer %s failed: %w", desc.Digest, err)
+		}
+		paths = append(paths, s.StorePaths...)
+	}
+	return paths, nil
+}
+
+// diffStorePaths pairs the store paths only one side has by package name.
+// Paths in both are left out, as they only moved between layers.
+func diffStorePaths(a, b []string) []packageChange {
+	namesA, namesB := storePathVersions(a, b), storePathVersions(b, a)
+	var changes []packageChange
+	for _, pname := range sortedUnion(namesA, namesB) {
+		versionsA, inA := namesA[pname]
+		versionsB, inB := namesB[pname]
+		changes = append(changes, packageChange{
+			Name:     pname,
+			VersionA: strings.Join(versionsA, ", "),
+			VersionB: strings.Join(versionsB, ", "),
+			Added:    !inA,
+			Removed:  !inB,
+			// The same versions under other hashes differ in a dependency.
+			Rebuilt: inA && inB && slices.Equal(versionsA, versionsB),
+		})
+	}
+	return changes
+}
+
+// storePathVersions returns the sorted versions of each package name among
+// the store paths of paths that others does not list.
+func storePathVersions(paths, others []string) map[string][]string {
+	versions := make(map[string][]string)
+	for _, p := range paths {
+		if slices.Contains(others, p) {
+			continue
+		}
+		pname, version := parseStorePathName(p)
+		if !slices.Contains(versions[pname], version) {
+			versions[pname] = append(versions[pname], version)
+		}
+	}
+	for _, v := range versions {
+		slices.Sort(v)
+	}
+	return versions
+}
+
+// parseStorePathName splits the name of a store path such as
+// /nix/store/<hash>-python3-3.11.8 into python3 and 3.11.8, the version
+// starting at the first dash not followed by a letter, as nix does.
+func parseStorePathName(p string) (string, string) {
+	base := path.Base(p)
+	if _, rest, ok := strings.Cut(base, "-"); ok {
+		base = rest
+	}
+	for i := 0; i+1 < len(base); i++ {
+		if base[i] == '-' && !isASCIILetter(base[i+1]) {
+			return base[:i], base[i+1:]
+		}
+	}
+	return base, ""
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// write prints the diff as the sections that differ, or a single line when
+// the images are identical.
+func (d imageDiff) write(w io.Writer) error {
+	if d.DigestA == d.DigestB {
+		_, err := fmt.Fprintf(w, "images are identical (%s)\n", d.DigestA)
+		return err
+	}
+	if d.identical() {
+		_, err := fmt.Fprintf(
+			w,
+			"images have the same config and layers (%s, %s)\n",
+			d.DigestA,
+			d.DigestB,
+		)
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "%s → %s\n", d.DigestA, d.DigestB)
+	if len(d.Config) > 0 {
+		_, _ = fmt.Fprintln(w, "config:")
+		for _, c := range d.Config {
+			_, _ = fmt.Fprintf(w, "  %s: %s → %s\n", c.Field, diffValue(c.A), diffValue(c.B))
+		}
+	}
+	if len(d.Layers) > 0 {
+		_, _ = fmt.Fprintln(w, "layers:")
+		for _, c := range d.Layers {
+			switch {
+			case c.A == nil:
+				_, _ = fmt.Fprintf(w, "  + %s\n", formatLayer(*c.B))
+			case c.B == nil:
+				_, _ = fmt.Fprintf(w, "  - %s\n", formatLayer(*c.A))
+			default:
+				_, _ = fmt.Fprintf(w, "  ~ %s → %s\n", formatLayer(*c.A), formatLayer(*c.B))
+			}
+		}
+	}
+	if len(d.Packages) > 0 {
+		_, _ = fmt.Fprintln(w, "store paths:")
+		for _, c := range d.Packages {
+			switch {
+			case c.Rebuilt:
+				_, _ = fmt.Fprintf(w, "  %s %s (rebuilt)\n", c.Name, diffValue(c.VersionA))
+			case c.Added:
+				_, _ = fmt.Fprintf(w, "  + %s %s\n", c.Name, diffValue(c.VersionB))
+			case c.Removed:
+				_, _ = fmt.Fprintf(w, "  - %s %s\n", c.Name, diffValue(c.VersionA))
+			default:
+				_, _ = fmt.Fprintf(w, "  %s %s → %s\n", c.Name, c.VersionA, c.VersionB)
+			}
+		}
+	}
+	return nil
+}
+
+func diffValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+func formatLayer(d diffLayer) string {
+	return nixcontainers.ShortDigest(d.Digest) + " " + units.BytesSize(float64(d.Size))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/viper"
+)
+
+// makeStoreLayer returns a layer holding a file of size bytes in each of the
+// store paths.
+func makeStoreLayer(t *testing.T, size int, paths ...string) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, p := range paths {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(p, "/") + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0o555,
+		}); err != nil {
+			t.Fatalf("write dir header failed: %v", err)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(p, "/") + "/bin/app",
+			Typeflag: tar.TypeReg,
+			Mode:     0o555,
+			Size:     int64(size),
+		}); err != nil {
+			t.Fatalf("write file header failed: %v", err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte{'x'}, size)); err != nil {
+			t.Fatalf("write file failed: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar failed: %v", err)
+	}
+	data := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatalf("create layer failed: %v", err)
+	}
+	return l
+}
+
+func makeDiffImage(t *testing.T, env []string, created time.Time, layers ...v1.Layer) v1.Image {
+	t.Helper()
+
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatalf("append layers failed: %v", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Env = env
+	cfg.Created = v1.Time{Time: created}
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatalf("set config failed: %v", err)
+	}
+	return img
+}
+
+func TestRunDiffReportsChangedStorePaths(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	glibc := makeStoreLayer(t, 64, "/nix/store/aaaa-glibc-2.39")
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := makeDiffImage(
+		t,
+		[]string{"PATH=/bin", "MODE=debug"},
+		created,
+		glibc,
+		makeStoreLayer(t, 64, "/nix/store/bbbb-python3-3.11.8"),
+		makeStoreLayer(t, 64, "/nix/store/cccc-app-1.0"),
+	)
+	b := makeDiffImage(
+		t,
+		[]string{"PATH=/bin"},
+		created,
+		glibc,
+		makeStoreLayer(t, 64, "/nix/store/dddd-python3-3.11.9"),
+		makeStoreLayer(t, 64, "/nix/store/eeee-app-1.0"),
+		makeStoreLayer(t, 64, "/nix/store/ffff-libfoo-0.2"),
+	)
+	ref := newTestRegistryRef(t, registry.New(), "example/app:a")
+	refB := ref.Context().Tag("b")
+	for ref, img := range map[string]v1.Image{ref.String(): a, refB.String(): b} {
+		if err := remote.Write(mustParseReference(t, ref), img); err != nil {
+			t.Fatalf("push %s failed: %v", ref, err)
+		}
+	}
+
+	var out bytes.Buffer
+	differ, err := runDiff(context.Background(), &out, ref.String(), "docker://"+refB.String())
+	if err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	if !differ {
+		t.Fatalf("expected the images to differ")
+	}
+	got := out.String()
+	for _, want := range []string{
+		"env MODE: debug → -",
+		"  ~ ",
+		"  + ",
+		"python3 3.11.8 → 3.11.9",
+		"app 1.0 (rebuilt)",
+		"+ libfoo 0.2",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in the diff, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "glibc") || strings.Contains(got, "PATH") {
+		t.Fatalf("expected unchanged layers and env to be left out, got:\n%s", got)
+	}
+}
+
+func TestRunDiffIdenticalImages(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	img := makeDiffImage(t, nil, time.Time{}, makeStoreLayer(t, 64, "/nix/store/aaaa-app-1.0"))
+	ref := newTestRegistryRef(t, registry.New(), "example/app:a")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if err := remote.Write(ref.Context().Tag("b"), img); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	differ, err := runDiff(
+		context.Background(),
+		&out,
+		ref.String(),
+		ref.Context().Tag("b").String(),
+	)
+	if err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	if differ {
+		t.Fatalf("expected identical images, got:\n%s", out.String())
+	}
+	if !strings.HasPrefix(out.String(), "images are identical") {
+		t.Fatalf("expected identical report, got %q", out.String())
+	}
+}
+
+func TestDiffImagesMatchesLayersAcrossCompressions(t *testing.T) {
+	layer := makeStoreLayer(t, 64, "/nix/store/aaaa-app-1.0")
+	a := makeDiffImage(t, nil, time.Time{}, layer)
+	// An OCI media type gives the image another manifest digest.
+	b := mutate.MediaType(a, "application/vnd.oci.image.manifest.v1+json")
+
+	d, err := diffImages(a, b)
+	if err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	if d.DigestA == d.DigestB {
+		t.Fatalf("expected the manifests to differ")
+	}
+	if !d.identical() {
+		t.Fatalf("expected the same config and layers to be identical, got %+v", d)
+	}
+}
+
+func TestLoadDiffImageFromLayout(t *testing.T) {
+	amd64 := makeDiffImage(t, []string{"ARCH=amd64"}, time.Time{})
+	arm64 := makeDiffImage(t, []string{"ARCH=arm64"}, time.Time{})
+	idx := mutate.AppendManifests(
+		empty.Index,
+		mutate.IndexAddendum{
+			Add:        amd64,
+			Descriptor: v1.Descriptor{Platform: nixcontainers.ParsePlatform("linux/amd64")},
+		},
+		mutate.IndexAddendum{
+			Add:        arm64,
+			Descriptor: v1.Descriptor{Platform: nixcontainers.ParsePlatform("linux/arm64")},
+		},
+	)
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("write layout failed: %v", err)
+	}
+	for _, tag := range []string{"app:v1", "app:v2"} {
+		err := lp.AppendIndex(idx, layout.WithAnnotations(map[string]string{
+			nixcontainers.OCIRefNameAnnotation: tag,
+		}))
+		if err != nil {
+			t.Fatalf("append index failed: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	img, err := loadDiffImage(ctx, "oci:"+dir+":app:v2", nixcontainers.ParsePlatform("linux/arm64"))
+	if err != nil {
+		t.Fatalf("load layout image failed: %v", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+	if got := cfg.Config.Env; len(got) != 1 || got[0] != "ARCH=arm64" {
+		t.Fatalf("expected the arm64 image, got env %q", got)
+	}
+
+	if _, err := loadDiffImage(ctx, "oci:"+dir, nixcontainers.HostPlatform()); err == nil {
+		t.Fatalf("expected error selecting from several layout images without a tag")
+	}
+	ref := "oci:" + dir + ":app:v3"
+	if _, err := loadDiffImage(ctx, ref, nixcontainers.HostPlatform()); err == nil {
+		t.Fatalf("expected error for a missing layout image")
+	}
+}
+
+func TestParseStorePathName(t *testing.T) {
+	tests := map[string][2]string{
+		"/nix/store/aaaa-python3-3.11.8":     {"python3", "3.11.8"},
+		"/nix/store/aaaa-gcc-13.2.0-lib":     {"gcc", "13.2.0-lib"},
+		"/nix/store/aaaa-ca-certificates":    {"ca-certificates", ""},
+		"/nix/store/aaaa-hello-world-2.12.1": {"hello-world", "2.12.1"},
+	}
+	for path, want := range tests {
+		pname, version := parseStorePathName(path)
+		if pname != want[0] || version != want[1] {
+			t.Fatalf(
+				"parseStorePathName(%s) = %s, %s, want %s, %s",
+				path,
+				pname,
+				version,
+				want[0],
+				want[1],
+			)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// exitCodeDigestNotFound is the exit code of digest when the reference does
+// not exist, so scripts can tell it from a failure to reach the registry.
+const exitCodeDigestNotFound = 8
+
+var digestCmd = &cobra.Command{
+	Use:   "digest REF",
+	Short: "Print the digest a tag resolves to",
+	Long:  "Resolves REF in its registry, with the credentials of the build, and prints the digest of the manifest or index it points to, or REF@DIGEST with --full. With --platform, an index is resolved to the digest of the image for that platform. Exits 8 when REF does not exist and 1 on any other failure.",
+	Example: "# Pin a deployment to the image a tag points to\n" +
+		"./nix-containers digest --full ghcr.io/you/app:v1.4.0\n\n" +
+		"# Resolve the arm64 image out of a multi-platform index\n" +
+		"./nix-containers digest --platform linux/arm64 ghcr.io/you/app:latest",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ref, err := name.ParseReference(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid image reference %q: %w", args[0], err)
+		}
+		var p *v1.Platform
+		if v := viper.GetString("digest_platform"); v != "" {
+			p, err = parsePlatformFlag(v)
+			if err != nil {
+				return err
+			}
+		}
+		auth, err := getRegistryAuth([]string{ref.Context().RegistryStr()})
+		if err != nil {
+			return err
+		}
+		ctx := cmd.Context()
+		digest, err := resolveDigest(
+			ctx,
+			ref,
+			p,
+			remote.WithAuthFromKeychain(auth.keychain),
+			remote.WithContext(ctx),
+		)
+		if isManifestNotFound(err) {
+			return &exitCodeError{code: exitCodeDigestNotFound, err: err}
+		}
+		if err != nil {
+			return err
+		}
+		out := digest.String()
+		if viper.GetBool("digest_full") {
+			out = ref.Context().Digest(digest.String()).String()
+		}
+		_, err = fmt.Fprintln(cmd.OutOrStdout(), out)
+		return err
+	},
+}
+
+func init() {
+	digestCmd.Flags().Bool("full", false, "print REF@DIGEST instead of the digest alone")
+	if err := viper.BindPFlag("digest_full", digestCmd.Flags().Lookup("full")); err != nil {
+		slog.Error("bind flag failed", "flag", "full", "err", err)
+		os.Exit(1)
+	}
+	digestCmd.Flags().String("platform", "", "platform to resolve out of an index")
+	if err := viper.BindPFlag("digest_platform", digestCmd.Flags().Lookup("platform")); err != nil {
+		slog.Error("bind flag failed", "flag", "platform", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(digestCmd)
+}
+
+// resolveDigest returns the digest ref points to, or with p set, the digest
+// of the image for p out of the index ref points to. Without p, the digest is
+// read with a HEAD request, so the manifest is not downloaded.
+func resolveDigest(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	opts ...remote.Option,
+) (v1.Hash, error) {
+	if p == nil {
+		desc, err := remote.Head(ref, opts...)
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("resolve %s failed: %w", ref, err)
+		}
+		slog.DebugContext(ctx, "digest resolved", "ref", ref.Name(), "digest", desc.Digest)
+		return desc.Digest, nil
+	}
+	desc, err := remote.Get(ref, opts...)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("resolve %s failed: %w", ref, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("read image %s failed: %w", ref, err)
+		}
+		cf, err := img.ConfigFile()
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("read config of %s failed: %w", ref, err)
+		}
+		if !cf.Platform().Satisfies(*p) {
+			return v1.Hash{}, fmt.Errorf("image %s is %s, not %s", ref, cf.Platform(), p)
+		}
+		return desc.Digest, nil
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("read index %s failed: %w", ref, err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("read index %s failed: %w", ref, err)
+	}
+	for _, child := range m.Manifests {
+		if child.Platform != nil && child.Platform.Satisfies(*p) {
+			slog.DebugContext(
+				ctx,
+				"digest resolved",
+				"ref", ref.Name(),
+				"index", desc.Digest,
+				"digest", child.Digest,
+			)
+			return child.Digest, nil
+		}
+	}
+	return v1.Hash{}, fmt.Errorf("index %s has no image for %s", ref, p)
+}
+
+// isManifestNotFound reports whether err is a registry answering that the
+// manifest or repository does not exist.
+func isManifestNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	return slices.ContainsFunc(terr.Errors, func(d transport.Diagnostic) bool {
+		return d.Code == transport.ManifestUnknownErrorCode || d.Code == transport.NameUnknownErrorCode
+	})
+}
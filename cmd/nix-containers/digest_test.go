@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestResolveDigest(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	var idx v1.ImageIndex = empty.Index
+	digests := map[string]v1.Hash{}
+	for _, p := range []*v1.Platform{amd64, arm64} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatalf("create random image failed: %v", err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatalf("image digest failed: %v", err)
+		}
+		digests[p.Architecture] = digest
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		t.Fatalf("push index failed: %v", err)
+	}
+	indexDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatalf("index digest failed: %v", err)
+	}
+	single := ref.Context().Tag("amd64")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	img, err = mutate.ConfigFile(img, &v1.ConfigFile{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatalf("mutate config failed: %v", err)
+	}
+	if err := remote.Write(single, img); err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	singleDigest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		ref          string
+		platform     *v1.Platform
+		want         v1.Hash
+		wantNotFound bool
+		wantErr      bool
+	}{
+		{name: "index", ref: ref.String(), want: indexDigest},
+		{name: "index platform", ref: ref.String(), platform: arm64, want: digests["arm64"]},
+		{name: "image", ref: single.String(), want: singleDigest},
+		{name: "image platform", ref: single.String(), platform: amd64, want: singleDigest},
+		{name: "image other platform", ref: single.String(), platform: arm64, wantErr: true},
+		{
+			name:     "index missing platform",
+			ref:      ref.String(),
+			platform: &v1.Platform{OS: "linux", Architecture: "riscv64"},
+			wantErr:  true,
+		},
+		{name: "missing tag", ref: ref.Context().Tag("missing").String(), wantNotFound: true},
+		{
+			name:         "missing tag with platform",
+			ref:          ref.Context().Tag("missing").String(),
+			platform:     amd64,
+			wantNotFound: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveDigest(
+				context.Background(),
+				mustParseReference(t, tt.ref),
+				tt.platform,
+			)
+			if tt.wantNotFound {
+				if !isManifestNotFound(err) {
+					t.Fatalf("expected a not found error, got %v", err)
+				}
+				return
+			}
+			if tt.wantErr {
+				if err == nil || isManifestNotFound(err) {
+					t.Fatalf("expected a resolution error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve digest failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected digest %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
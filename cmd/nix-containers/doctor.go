@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Status of a doctor check. A failed check that the configured build does not
+// need is reported as a warning.
+const (
+	doctorStatusPass = "PASS"
+	doctorStatusWarn = "WARN"
+	doctorStatusFail = "FAIL"
+	doctorStatusSkip = "SKIP"
+)
+
+// doctorMinNixVersion is the oldest nix builds are supported on.
+var doctorMinNixVersion = nixcontainers.NixVersion{2, 18, 0}
+
+type doctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+type doctorNixClient interface {
+	flakePackagesClient
+	Version(context.Context) (string, error)
+	ExperimentalFeatures(context.Context) ([]string, error)
+}
+
+type doctorContainerClient interface {
+	Ping(context.Context) error
+	APIVersion() string
+	CheckRepository(context.Context, name.Reference) error
+}
+
+// doctorEnv is what the doctor checks against: the images to push, whether
+// the build needs the container runtime, and the flake to evaluate, if any.
+type doctorEnv struct {
+	images          []name.Reference
+	requiresRuntime bool
+	buildContext    string
+	host            *v1.Platform
+	opts            []nixcontainers.ImageOption
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [BUILD_CONTEXT]",
+	Short: "Check the environment can build and push images",
+	Long:  "Checks that nix 2.18 or later is installed with the nix-command and flakes experimental features, that the container runtime is reachable, that the registry of every IMAGE answers with the keychain credentials, and, when BUILD_CONTEXT is given, that the flake exposes a package for the host system. Each check prints PASS or FAIL with a remediation hint. A runtime the configured build does not need is only a warning. Exits 1 when a required check fails.",
+	Example: "# Check the environment and the flake of the current directory\n" +
+		"IMAGE=ghcr.io/you/app:latest ./nix-containers doctor .",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		env := doctorEnv{host: nixcontainers.HostPlatform()}
+		if len(args) > 0 {
+			flakeDir, err := getFlakeDir()
+			if err != nil {
+				return err
+			}
+			buildContext, err := applyFlakeDir(args[0], flakeDir)
+			if err != nil {
+				return err
+			}
+			buildContext, err = resolveBuildContext(buildContext)
+			if err != nil {
+				return err
+			}
+			env.buildContext = buildContext
+		}
+		if viper.GetString("image") != "" || viper.GetString("images") != "" {
+			images, err := getBuildImages()
+			if err != nil {
+				return fmt.Errorf("failed to get image: %w", err)
+			}
+			for _, image := range images {
+				env.images = append(env.images, image.destination)
+			}
+		}
+		// PLATFORMS=all is resolved by the build; it is taken for several
+		// platforms, which is what a flake usually exposes.
+		platformCount := 0
+		if !getAllPlatforms() {
+			plats, err := getPlatforms()
+			if err != nil {
+				return fmt.Errorf("failed to get platforms: %w", err)
+			}
+			platformCount = len(plats)
+		}
+		smokeTestLocal := getSmokeTest() != "" && !getSmokeTestK8s()
+		env.requiresRuntime = requiresRuntime(
+			platformCount,
+			getLoadImage(),
+			getKeepPlatformImages(),
+			smokeTestLocal,
+		)
+		if getAcceptFlakeConfig() {
+			env.opts = append(env.opts, nixcontainers.WithAcceptFlakeConfig())
+		}
+		if getNoPureEval() {
+			env.opts = append(env.opts, nixcontainers.WithNoPureEval())
+		}
+		registries := make([]string, 0, len(env.images))
+		for _, image := range env.images {
+			registries = append(registries, image.Context().RegistryStr())
+		}
+		auth, err := getRegistryAuth(registries)
+		if err != nil {
+			return err
+		}
+		container, err := newConfiguredContainerClient(
+			ctx,
+			nixcontainers.WithContainerKeychain(auth.keychain),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create container client: %w", err)
+		}
+		if !runDoctor(ctx, cmd.OutOrStdout(), nixcontainers.NewNixClient(), container, env) {
+			// Every failed check is already printed with its hint.
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+			return &exitCodeError{code: 1}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// runDoctor runs every check, printing each as it completes, and reports
+// whether all the required ones passed.
+func runDoctor(
+	ctx context.Context,
+	out io.Writer,
+	nix doctorNixClient,
+	container doctorContainerClient,
+	env doctorEnv,
+) bool {
+	ok := true
+	report := func(c doctorCheck) {
+		_, _ = fmt.Fprintf(out, "%s %s: %s\n", c.Status, c.Name, c.Detail)
+		if c.Hint != "" && c.Status != doctorStatusPass {
+			_, _ = fmt.Fprintf(out, "     hint: %s\n", c.Hint)
+		}
+		if c.Status == doctorStatusFail {
+			ok = false
+		}
+	}
+
+	nixCheck, installed := checkDoctorNix(ctx, nix)
+	report(nixCheck)
+	if !installed {
+		report(doctorCheck{
+			Name:   "nix experimental features",
+			Status: doctorStatusSkip,
+			Detail: "nix is not installed",
+		})
+	} else {
+		report(checkDoctorFeatures(ctx, nix))
+	}
+	runtimeCheck := checkDoctorRuntime(ctx, container)
+	if runtimeCheck.Status == doctorStatusFail && !env.requiresRuntime {
+		runtimeCheck.Status = doctorStatusWarn
+		runtimeCheck.Detail += " (not needed to push several platforms without --load)"
+	}
+	report(runtimeCheck)
+	if len(env.images) == 0 {
+		report(doctorCheck{
+			Name:   "registry",
+			Status: doctorStatusSkip,
+			Detail: "IMAGE is not set",
+		})
+	}
+	for _, ref := range env.images {
+		report(checkDoctorRegistry(ctx, container, ref))
+	}
+	if env.buildContext == "" {
+		report(doctorCheck{
+			Name:   "flake",
+			Status: doctorStatusSkip,
+			Detail: "no BUILD_CONTEXT given",
+		})
+	} else {
+		report(checkDoctorFlake(ctx, nix, env))
+	}
+	return ok
+}
+
+// checkDoctorNix checks the nix version and reports whether nix is installed
+// at all, so the checks running it can be skipped.
+func checkDoctorNix(ctx context.Context, nix doctorNixClient) (doctorCheck, bool) {
+	c := doctorCheck{Name: "nix", Status: doctorStatusFail}
+	raw, err := nix.Version(ctx)
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		c.Detail = fmt.Sprintf("nix not found: %v", err)
+		c.Hint = "install nix from https://nixos.org/download and make sure it is on PATH"
+		return c, false
+	}
+	if err != nil {
+		c.Detail = err.Error()
+		c.Hint = "check nix --version runs in this environment"
+		return c, true
+	}
+	v, err := nixcontainers.ParseNixVersion(raw)
+	if err != nil {
+		c.Detail = fmt.Sprintf("failed to parse nix version: %v", err)
+		c.Hint = "check nix --version runs in this environment"
+		return c, true
+	}
+	if v.Compare(doctorMinNixVersion) < 0 {
+		c.Detail = fmt.Sprintf("nix %s is older than %s", v, doctorMinNixVersion)
+		c.Hint = "upgrade nix, or pin a newer one with --nix-from-flake"
+		return c, true
+	}
+	c.Status = doctorStatusPass
+	c.Detail = "nix " + v.String()
+	return c, true
+}
+
+func checkDoctorFeatures(ctx context.Context, nix doctorNixClient) doctorCheck {
+	c := doctorCheck{
+		Name: "nix experimental features",
+		Hint: "add \"experimental-features = nix-command flakes\" to /etc/nix/nix.conf " +
+			"or ~/.config/nix/nix.conf",
+	}
+	features, err := nix.ExperimentalFeatures(ctx)
+	if err != nil {
+		c.Status = doctorStatusFail
+		c.Detail = err.Error()
+		return c
+	}
+	var missing []string
+	for _, feature := range nixcontainers.RequiredExperimentalFeatures {
+		if !slices.Contains(features, feature) {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		c.Status = doctorStatusFail
+		c.Detail = "missing " + strings.Join(missing, ", ")
+		return c
+	}
+	c.Status = doctorStatusPass
+	c.Detail = strings.Join(nixcontainers.RequiredExperimentalFeatures, ", ") + " enabled"
+	return c
+}
+
+func checkDoctorRuntime(ctx context.Context, container doctorContainerClient) doctorCheck {
+	c := doctorCheck{Name: "container runtime"}
+	ctx, cancel := context.WithTimeout(ctx, runtimeCheckTimeout)
+	defer cancel()
+	if err := container.Ping(ctx); err != nil {
+		c.Status = doctorStatusFail
+		c.Detail = err.Error()
+		c.Hint = "mount the docker socket or set DOCKER_HOST to a reachable daemon"
+		return c
+	}
+	c.Status = doctorStatusPass
+	c.Detail = "reachable"
+	if version := container.APIVersion(); version != "" {
+		c.Detail = "reachable, docker API " + version
+	}
+	return c
+}
+
+func checkDoctorRegistry(
+	ctx context.Context,
+	container doctorContainerClient,
+	ref name.Reference,
+) doctorCheck {
+	c := doctorCheck{Name: "registry " + ref.Context().Name()}
+	if err := container.CheckRepository(ctx, ref); err != nil {
+		c.Status = doctorStatusFail
+		c.Detail = err.Error()
+		c.Hint = fmt.Sprintf(
+			"log in with docker login %s, or check the network can reach it",
+			ref.Context().RegistryStr(),
+		)
+		return c
+	}
+	c.Status = doctorStatusPass
+	c.Detail = "reachable and authenticated"
+	return c
+}
+
+func checkDoctorFlake(ctx context.Context, nix doctorNixClient, env doctorEnv) doctorCheck {
+	c := doctorCheck{Name: "flake " + env.buildContext}
+	system := nixcontainers.FormatSystemName(env.host)
+	systems, err := nix.FlakePackages(ctx, env.buildContext, env.opts...)
+	if err != nil {
+		c.Status = doctorStatusFail
+		c.Detail = err.Error()
+		c.Hint = "run nix flake show " + env.buildContext + " to see the evaluation error"
+		return c
+	}
+	packages := systems[system]
+	if len(packages) == 0 {
+		c.Status = doctorStatusFail
+		c.Detail = "no package for " + system
+		c.Hint = "expose the images as packages." + system + ".<name> in the flake outputs"
+		return c
+	}
+	c.Status = doctorStatusPass
+	c.Detail = fmt.Sprintf(
+		"%d packages for %s: %s",
+		len(packages),
+		system,
+		strings.Join(packages, ", "),
+	)
+	return c
+}
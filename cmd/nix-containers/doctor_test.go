@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+type fakeDoctorNixClient struct {
+	version    string
+	versionErr error
+	features   []string
+	systems    map[string][]string
+}
+
+func (f fakeDoctorNixClient) Version(context.Context) (string, error) {
+	return f.version, f.versionErr
+}
+
+func (f fakeDoctorNixClient) ExperimentalFeatures(context.Context) ([]string, error) {
+	return f.features, nil
+}
+
+func (f fakeDoctorNixClient) FlakePackages(
+	context.Context,
+	string,
+	...nixcontainers.ImageOption,
+) (map[string][]string, error) {
+	return f.systems, nil
+}
+
+type fakeDoctorContainerClient struct {
+	pingErr     error
+	registryErr error
+}
+
+func (f fakeDoctorContainerClient) Ping(context.Context) error {
+	return f.pingErr
+}
+
+func (f fakeDoctorContainerClient) APIVersion() string {
+	return "1.45"
+}
+
+func (f fakeDoctorContainerClient) CheckRepository(context.Context, name.Reference) error {
+	return f.registryErr
+}
+
+func TestRunDoctor(t *testing.T) {
+	host := nixcontainers.HostPlatform()
+	healthy := fakeDoctorNixClient{
+		version:  "nix (Nix) 2.24.10",
+		features: []string{"ca-derivations", "flakes", "nix-command"},
+		systems:  map[string][]string{nixcontainers.FormatSystemName(host): {"app"}},
+	}
+	env := doctorEnv{
+		images:          []name.Reference{mustParseReference(t, "ghcr.io/example/app:latest")},
+		requiresRuntime: true,
+		buildContext:    "/workspace",
+		host:            host,
+	}
+
+	tests := []struct {
+		name      string
+		nix       fakeDoctorNixClient
+		container fakeDoctorContainerClient
+		env       doctorEnv
+		wantOK    bool
+		want      []string
+	}{
+		{
+			name:   "healthy",
+			nix:    healthy,
+			env:    env,
+			wantOK: true,
+			want: []string{
+				"PASS nix: nix 2.24.10",
+				"PASS nix experimental features",
+				"PASS container runtime: reachable, docker API 1.45",
+				"PASS registry ghcr.io/example/app",
+				"PASS flake /workspace: 1 packages",
+			},
+		},
+		{
+			name: "old nix without flakes",
+			nix: fakeDoctorNixClient{
+				version:  "nix (Nix) 2.13.3",
+				features: []string{"nix-command"},
+				systems:  healthy.systems,
+			},
+			env: env,
+			want: []string{
+				"FAIL nix: nix 2.13.3 is older than 2.18.0",
+				"FAIL nix experimental features: missing flakes",
+				"hint: add \"experimental-features = nix-command flakes\"",
+			},
+		},
+		{
+			name: "nix not installed",
+			nix:  fakeDoctorNixClient{versionErr: exec.ErrNotFound},
+			env:  doctorEnv{host: host, requiresRuntime: true},
+			want: []string{
+				"FAIL nix: nix not found",
+				"SKIP nix experimental features",
+				"SKIP registry: IMAGE is not set",
+				"SKIP flake: no BUILD_CONTEXT given",
+			},
+		},
+		{
+			name:      "unneeded runtime",
+			nix:       healthy,
+			container: fakeDoctorContainerClient{pingErr: errors.New("no socket")},
+			env:       doctorEnv{host: host},
+			wantOK:    true,
+			want:      []string{"WARN container runtime: no socket"},
+		},
+		{
+			name: "unreachable runtime and registry",
+			nix:  healthy,
+			container: fakeDoctorContainerClient{
+				pingErr:     errors.New("no socket"),
+				registryErr: errors.New("UNAUTHORIZED"),
+			},
+			env: env,
+			want: []string{
+				"FAIL container runtime: no socket",
+				"FAIL registry ghcr.io/example/app: UNAUTHORIZED",
+				"hint: log in with docker login ghcr.io",
+			},
+		},
+		{
+			name: "flake without host package",
+			nix: fakeDoctorNixClient{
+				version:  healthy.version,
+				features: healthy.features,
+				systems:  map[string][]string{"riscv64-linux": {"app"}},
+			},
+			env: env,
+			want: []string{
+				"FAIL flake /workspace: no package for " + nixcontainers.FormatSystemName(host),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			ok := runDoctor(context.Background(), &out, tt.nix, tt.container, tt.env)
+			if ok != tt.wantOK {
+				t.Fatalf("expected ok %t, got %t:\n%s", tt.wantOK, ok, out.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Fatalf("expected output to contain %q, got:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
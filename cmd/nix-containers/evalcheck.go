@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	diagnosticSeverityError   = "error"
+	diagnosticSeverityWarning = "warning"
+)
+
+type nixEvalClient interface {
+	EvalPackageType(context.Context, string, ...nixcontainers.ImageOption) (string, error)
+}
+
+type evalDiagnostic struct {
+	Severity     string `json:"severity"`
+	Message      string `json:"message"`
+	SuggestedFix string `json:"suggested_fix,omitempty"`
+}
+
+type evalCheckResult struct {
+	Image        string           `json:"image,omitempty"`
+	BuildContext string           `json:"build_context"`
+	Installables []string         `json:"installables,omitempty"`
+	Partial      bool             `json:"partial"`
+	Diagnostics  []evalDiagnostic `json:"diagnostics"`
+}
+
+type flakeLock struct {
+	Version int                        `json:"version"`
+	Root    string                     `json:"root"`
+	Nodes   map[string]json.RawMessage `json:"nodes"`
+}
+
+var evalCheckCmd = &cobra.Command{
+	Use:   "eval-check [BUILD_CONTEXT]",
+	Short: "Check the IMAGE to flake wiring without building",
+	Long:  "Performs offline-safe checks only: parses IMAGE, derives the flake package attribute, validates flake.nix and flake.lock, and evaluates the attribute type with nix eval --offline. Never builds, pushes, or contacts the Docker daemon. Diagnostics are printed as JSON on stdout for editor tooling. Configure via env vars: IMAGE, PLATFORMS, EVAL_TIMEOUT.",
+	Example: "# Check the current directory\n" +
+		"IMAGE=ghcr.io/you/app:latest ./nix-containers eval-check .",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		buildContext := ""
+		if len(args) > 0 {
+			buildContext = args[0]
+		} else {
+			var err error
+			buildContext, err = os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get current working directory: %w", err)
+			}
+		}
+		var result *evalCheckResult
+		plats := []*v1.Platform{nixcontainers.HostPlatform()}
+		fix := "set FLAKE_DIR to a relative subdirectory of BUILD_CONTEXT"
+		flakeDir, err := getFlakeDir()
+		if err == nil {
+			buildContext, err = applyFlakeDir(buildContext, flakeDir)
+		}
+		if err == nil {
+			fix = "set PLATFORMS to comma-separated linux/arch[/variant] entries"
+			if getAllPlatforms() {
+				slog.InfoContext(
+					ctx,
+					"checking the host platform for PLATFORMS=all",
+					"platform", plats[0],
+				)
+			} else {
+				plats, err = getPlatforms()
+			}
+		}
+		var packages map[string]string
+		if err == nil {
+			fix = "set PACKAGE_MAP to comma-separated REPO=ATTR entries"
+			packages, err = getPackageMap()
+		}
+		if err != nil {
+			result = &evalCheckResult{
+				Image:        viper.GetString("image"),
+				BuildContext: buildContext,
+				Diagnostics: []evalDiagnostic{{
+					Severity:     diagnosticSeverityError,
+					Message:      err.Error(),
+					SuggestedFix: fix,
+				}},
+			}
+		} else {
+			result = runEvalCheck(
+				ctx,
+				nixcontainers.NewNixClient(nixFeatureOptions()...),
+				buildContext,
+				viper.GetString("image"),
+				packages,
+				plats,
+				getEvalTimeout(),
+			)
+		}
+		if err := json.NewEncoder(cmd.OutOrStdout()).Encode(result); err != nil {
+			return fmt.Errorf("failed to write diagnostics: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	evalCheckCmd.Flags().Duration(
+		"timeout",
+		defaultEvalTimeout,
+		"maximum duration of the offline nix evaluation",
+	)
+	if err := viper.BindPFlag("eval_timeout", evalCheckCmd.Flags().Lookup("timeout")); err != nil {
+		slog.Error("bind flag failed", "flag", "timeout", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(evalCheckCmd)
+}
+
+func runEvalCheck(
+	ctx context.Context,
+	nix nixEvalClient,
+	buildContext string,
+	image string,
+	packages map[string]string,
+	plats []*v1.Platform,
+	timeout time.Duration,
+) *evalCheckResult {
+	result := &evalCheckResult{
+		Image:        image,
+		BuildContext: buildContext,
+		Diagnostics:  []evalDiagnostic{},
+	}
+
+	ref, err := name.NewTag(image)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, evalDiagnostic{
+			Severity:     diagnosticSeverityError,
+			Message:      fmt.Sprintf("invalid IMAGE %q: %v", image, err),
+			SuggestedFix: "set IMAGE to a tagged reference such as ghcr.io/you/app:latest",
+		})
+		return result
+	}
+
+	result.Diagnostics = append(result.Diagnostics, checkFlakeFiles(buildContext)...)
+	if hasErrorDiagnostic(result.Diagnostics) {
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	pkg, _ := flakePackageOf(ref, packages)
+	for _, p := range plats {
+		installable := nixcontainers.FormatNixFlakeAttribute(buildContext, pkg, p)
+		result.Installables = append(result.Installables, installable)
+		typ, err := nix.EvalPackageType(ctx, installable)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result.Partial = true
+			result.Diagnostics = append(result.Diagnostics, evalDiagnostic{
+				Severity: diagnosticSeverityWarning,
+				Message: fmt.Sprintf(
+					"evaluation of %s timed out after %s",
+					installable,
+					timeout,
+				),
+				SuggestedFix: "increase --timeout or EVAL_TIMEOUT",
+			})
+			return result
+		}
+		if err != nil {
+			result.Diagnostics = append(result.Diagnostics, evalDiagnostic{
+				Severity: diagnosticSeverityError,
+				Message:  fmt.Sprintf("failed to evaluate %s: %v", installable, err),
+				SuggestedFix: fmt.Sprintf(
+					"expose packages.%s.%s in the flake, change the IMAGE repository name "+
+						"or map it with PACKAGE_MAP",
+					nixcontainers.FormatSystemName(p),
+					pkg,
+				),
+			})
+			continue
+		}
+		if typ != "derivation" {
+			result.Diagnostics = append(result.Diagnostics, evalDiagnostic{
+				Severity:     diagnosticSeverityError,
+				Message:      fmt.Sprintf("%s has type %q, expected a derivation", installable, typ),
+				SuggestedFix: "point the package attribute at an image derivation",
+			})
+		}
+	}
+	return result
+}
+
+func checkFlakeFiles(buildContext string) []evalDiagnostic {
+	var diags []evalDiagnostic
+
+	// Remote flakes have no local files to check, and are only evaluated
+	// offline from the nix cache.
+	if flakeURLPattern.MatchString(buildContext) {
+		if err := checkFlakeURL(buildContext); err != nil {
+			return append(diags, evalDiagnostic{
+				Severity:     diagnosticSeverityError,
+				Message:      err.Error(),
+				SuggestedFix: "remove the #fragment from BUILD_CONTEXT",
+			})
+		}
+		return append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityWarning,
+			Message:      fmt.Sprintf("flake %s is remote and evaluated from the nix cache", buildContext),
+			SuggestedFix: fmt.Sprintf("fetch it first with nix flake metadata --refresh %s", buildContext),
+		})
+	}
+
+	info, err := os.Stat(buildContext)
+	if err != nil {
+		return append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityError,
+			Message:      fmt.Sprintf("build context %s is not accessible: %v", buildContext, err),
+			SuggestedFix: "pass an existing flake directory as BUILD_CONTEXT",
+		})
+	}
+	if !info.IsDir() {
+		return append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityError,
+			Message:      fmt.Sprintf("build context %s is not a directory", buildContext),
+			SuggestedFix: "pass the directory containing flake.nix as BUILD_CONTEXT",
+		})
+	}
+
+	flakePath := filepath.Join(buildContext, "flake.nix")
+	flakeInfo, err := os.Stat(flakePath)
+	if err != nil {
+		return append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityError,
+			Message:      fmt.Sprintf("flake.nix not found in %s", buildContext),
+			SuggestedFix: "create a flake.nix or point BUILD_CONTEXT at the flake directory",
+		})
+	}
+	if flakeInfo.Size() == 0 {
+		diags = append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityError,
+			Message:      fmt.Sprintf("%s is empty", flakePath),
+			SuggestedFix: "define the flake outputs in flake.nix",
+		})
+	}
+
+	lockPath := filepath.Join(buildContext, "flake.lock")
+	raw, err := os.ReadFile(lockPath)
+	if err != nil {
+		return append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityWarning,
+			Message:      fmt.Sprintf("flake.lock not found in %s", buildContext),
+			SuggestedFix: "run nix flake lock so offline evaluation can resolve inputs",
+		})
+	}
+	var lock flakeLock
+	if err := json.Unmarshal(raw, &lock); err != nil {
+		return append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityError,
+			Message:      fmt.Sprintf("failed to parse %s: %v", lockPath, err),
+			SuggestedFix: "regenerate the lock file with nix flake lock",
+		})
+	}
+	if _, ok := lock.Nodes[lock.Root]; lock.Root == "" || !ok {
+		diags = append(diags, evalDiagnostic{
+			Severity:     diagnosticSeverityError,
+			Message:      fmt.Sprintf("%s has no root node", lockPath),
+			SuggestedFix: "regenerate the lock file with nix flake lock",
+		})
+	}
+	return diags
+}
+
+func hasErrorDiagnostic(diags []evalDiagnostic) bool {
+	return slices.ContainsFunc(diags, func(d evalDiagnostic) bool {
+		return d.Severity == diagnosticSeverityError
+	})
+}
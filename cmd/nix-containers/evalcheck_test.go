@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+type fakeNixEvalClient struct {
+	evalFunc func(context.Context, string) (string, error)
+}
+
+func (f fakeNixEvalClient) EvalPackageType(
+	ctx context.Context,
+	installable string,
+	_ ...nixcontainers.ImageOption,
+) (string, error) {
+	return f.evalFunc(ctx, installable)
+}
+
+func writeFlakeFixture(t *testing.T, lock string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	flake := []byte("{ outputs = _: { }; }")
+	if err := os.WriteFile(filepath.Join(dir, "flake.nix"), flake, 0o644); err != nil {
+		t.Fatalf("write flake.nix failed: %v", err)
+	}
+	if lock != "" {
+		if err := os.WriteFile(filepath.Join(dir, "flake.lock"), []byte(lock), 0o644); err != nil {
+			t.Fatalf("write flake.lock failed: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestCheckFlakeFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		lock     string
+		severity string
+	}{
+		{
+			name: "valid lock",
+			lock: `{"nodes":{"root":{}},"root":"root","version":7}`,
+		},
+		{
+			name:     "missing lock",
+			severity: diagnosticSeverityWarning,
+		},
+		{
+			name:     "invalid lock",
+			lock:     `{"nodes":`,
+			severity: diagnosticSeverityError,
+		},
+		{
+			name:     "lock without root",
+			lock:     `{"nodes":{},"root":"root","version":7}`,
+			severity: diagnosticSeverityError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diags := checkFlakeFiles(writeFlakeFixture(t, tt.lock))
+			if tt.severity == "" {
+				if len(diags) != 0 {
+					t.Fatalf("expected no diagnostics, got %v", diags)
+				}
+				return
+			}
+			if len(diags) != 1 || diags[0].Severity != tt.severity {
+				t.Fatalf("expected one %s diagnostic, got %v", tt.severity, diags)
+			}
+		})
+	}
+}
+
+func TestCheckFlakeFilesReportsMissingFlake(t *testing.T) {
+	diags := checkFlakeFiles(t.TempDir())
+	if len(diags) != 1 || !strings.Contains(diags[0].Message, "flake.nix not found") {
+		t.Fatalf("expected missing flake.nix diagnostic, got %v", diags)
+	}
+}
+
+func TestCheckFlakeFilesRemoteFlake(t *testing.T) {
+	tests := []struct {
+		name         string
+		buildContext string
+		severity     string
+	}{
+		{
+			name:         "flake url",
+			buildContext: "github:org/repo?ref=main",
+			severity:     diagnosticSeverityWarning,
+		},
+		{
+			name:         "fragment",
+			buildContext: "git+https://example.com/repo.git#app",
+			severity:     diagnosticSeverityError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diags := checkFlakeFiles(tt.buildContext)
+			if len(diags) != 1 || diags[0].Severity != tt.severity {
+				t.Fatalf("expected one %s diagnostic, got %v", tt.severity, diags)
+			}
+		})
+	}
+}
+
+func TestRunEvalCheckReportsInvalidImage(t *testing.T) {
+	result := runEvalCheck(
+		context.Background(),
+		fakeNixEvalClient{},
+		t.TempDir(),
+		"not a reference",
+		nil,
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+		time.Second,
+	)
+	if !hasErrorDiagnostic(result.Diagnostics) || result.Diagnostics[0].SuggestedFix == "" {
+		t.Fatalf("expected invalid image diagnostic with fix, got %v", result.Diagnostics)
+	}
+}
+
+func TestRunEvalCheckEvaluatesEveryPlatform(t *testing.T) {
+	dir := writeFlakeFixture(t, `{"nodes":{"root":{}},"root":"root","version":7}`)
+	var installables []string
+	nix := fakeNixEvalClient{evalFunc: func(_ context.Context, installable string) (string, error) {
+		installables = append(installables, installable)
+		return "derivation", nil
+	}}
+
+	result := runEvalCheck(
+		context.Background(),
+		nix,
+		dir,
+		"ghcr.io/example/app:latest",
+		nil,
+		[]*v1.Platform{
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "arm64"},
+		},
+		time.Second,
+	)
+	if len(result.Diagnostics) != 0 || result.Partial {
+		t.Fatalf("expected clean result, got %+v", result)
+	}
+	want := []string{
+		dir + "#packages.x86_64-linux.app",
+		dir + "#packages.aarch64-linux.app",
+	}
+	if strings.Join(installables, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected installables %q, got %q", want, installables)
+	}
+}
+
+func TestRunEvalCheckMappedPackage(t *testing.T) {
+	dir := writeFlakeFixture(t, `{"nodes":{"root":{}},"root":"root","version":7}`)
+	var installables []string
+	nix := fakeNixEvalClient{evalFunc: func(_ context.Context, installable string) (string, error) {
+		installables = append(installables, installable)
+		return "derivation", nil
+	}}
+
+	result := runEvalCheck(
+		context.Background(),
+		nix,
+		dir,
+		"ghcr.io/example/api.v2:latest",
+		map[string]string{"ghcr.io/example/api.v2": "apiV2"},
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+		time.Second,
+	)
+	if len(result.Diagnostics) != 0 {
+		t.Fatalf("expected clean result, got %+v", result)
+	}
+	if want := dir + "#packages.x86_64-linux.apiV2"; len(installables) != 1 ||
+		installables[0] != want {
+		t.Fatalf("expected installables [%s], got %q", want, installables)
+	}
+}
+
+func TestRunEvalCheckReturnsPartialResultOnTimeout(t *testing.T) {
+	dir := writeFlakeFixture(t, `{"nodes":{"root":{}},"root":"root","version":7}`)
+	nix := fakeNixEvalClient{evalFunc: func(ctx context.Context, _ string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}}
+
+	result := runEvalCheck(
+		context.Background(),
+		nix,
+		dir,
+		"ghcr.io/example/app:latest",
+		nil,
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+		10*time.Millisecond,
+	)
+	if !result.Partial {
+		t.Fatalf("expected partial result on timeout")
+	}
+	if len(result.Diagnostics) != 1 ||
+		!strings.Contains(result.Diagnostics[0].Message, "timed out") {
+		t.Fatalf("expected timeout diagnostic, got %v", result.Diagnostics)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+type flakeMetadataClient interface {
+	FlakeMetadata(
+		context.Context,
+		string,
+		...nixcontainers.ImageOption,
+	) (*nixcontainers.FlakeMetadata, error)
+}
+
+// flakeMetadataProvider memoizes flake metadata per flake reference for the
+// lifetime of one invocation, so every consumer shares a single nix call.
+type flakeMetadataProvider struct {
+	nix  flakeMetadataClient
+	opts []nixcontainers.ImageOption
+
+	mu      sync.Mutex
+	entries map[string]*flakeMetadataEntry
+	hits    int
+}
+
+type flakeMetadataEntry struct {
+	once     sync.Once
+	metadata *nixcontainers.FlakeMetadata
+	err      error
+}
+
+func newFlakeMetadataProvider(
+	nix flakeMetadataClient,
+	opts ...nixcontainers.ImageOption,
+) *flakeMetadataProvider {
+	return &flakeMetadataProvider{
+		nix:     nix,
+		opts:    opts,
+		entries: map[string]*flakeMetadataEntry{},
+	}
+}
+
+// Get returns the metadata of flakeRef, fetching it on first use. Concurrent
+// callers for the same reference wait for the same fetch.
+func (p *flakeMetadataProvider) Get(
+	ctx context.Context,
+	flakeRef string,
+) (*nixcontainers.FlakeMetadata, error) {
+	p.mu.Lock()
+	entry, ok := p.entries[flakeRef]
+	if ok {
+		p.hits++
+	} else {
+		entry = &flakeMetadataEntry{}
+		p.entries[flakeRef] = entry
+	}
+	p.mu.Unlock()
+
+	entry.once.Do(func() {
+		start := time.Now()
+		entry.metadata, entry.err = p.nix.FlakeMetadata(ctx, flakeRef, p.opts...)
+		slog.DebugContext(
+			ctx,
+			"flake metadata fetched",
+			"flake",
+			flakeRef,
+			"duration",
+			time.Since(start),
+			"err",
+			entry.err,
+		)
+	})
+	return entry.metadata, entry.err
+}
+
+// Hits returns how many lookups were served from the memoized results.
+func (p *flakeMetadataProvider) Hits() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hits
+}
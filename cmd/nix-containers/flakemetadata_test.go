@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+type fakeFlakeMetadataClient struct {
+	calls    atomic.Int32
+	metadata *nixcontainers.FlakeMetadata
+}
+
+func (f *fakeFlakeMetadataClient) FlakeMetadata(
+	context.Context,
+	string,
+	...nixcontainers.ImageOption,
+) (*nixcontainers.FlakeMetadata, error) {
+	f.calls.Add(1)
+	return f.metadata, nil
+}
+
+func TestFlakeMetadataProviderMemoizesPerFlake(t *testing.T) {
+	nix := &fakeFlakeMetadataClient{metadata: &nixcontainers.FlakeMetadata{Revision: "abc123"}}
+	provider := newFlakeMetadataProvider(nix)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			got, err := provider.Get(context.Background(), "/workspace")
+			if err != nil || got.Revision != "abc123" {
+				t.Errorf("unexpected metadata %+v: %v", got, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	if n := nix.calls.Load(); n != 1 {
+		t.Fatalf("expected one nix flake metadata call, got %d", n)
+	}
+	if hits := provider.Hits(); hits != 7 {
+		t.Fatalf("expected 7 cache hits, got %d", hits)
+	}
+	if _, err := provider.Get(context.Background(), "/other"); err != nil {
+		t.Fatalf("flake metadata failed: %v", err)
+	}
+	if n := nix.calls.Load(); n != 2 {
+		t.Fatalf("expected a separate call for another flake, got %d", n)
+	}
+}
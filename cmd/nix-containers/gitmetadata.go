@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// OCI annotations describing where an image was built from.
+const (
+	ociRevisionAnnotation = "org.opencontainers.image.revision"
+	ociSourceAnnotation   = "org.opencontainers.image.source"
+	ociCreatedAnnotation  = "org.opencontainers.image.created"
+)
+
+var gitCommandContext = exec.CommandContext
+
+// gitMetadata is the git revision, source repository and commit time of the
+// build context. Empty fields are unknown.
+type gitMetadata struct {
+	Revision string
+	Source   string
+	Created  string
+}
+
+// annotations returns the known fields as OCI annotations, nil when none is.
+func (m gitMetadata) annotations() map[string]string {
+	var annotations map[string]string
+	for key, value := range map[string]string{
+		ociRevisionAnnotation: m.Revision,
+		ociSourceAnnotation:   m.Source,
+		ociCreatedAnnotation:  m.Created,
+	} {
+		if value == "" {
+			continue
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[key] = value
+	}
+	return annotations
+}
+
+// readGitMetadata describes the git repository of the build context: the
+// work tree a local context is in, or the repository and rev of a remote
+// flake ref. Git being missing or the context not being a repository is
+// only logged, since the metadata is informational.
+func readGitMetadata(ctx context.Context, buildContext string) gitMetadata {
+	if flakeURLPattern.MatchString(buildContext) {
+		return parseFlakeRefGitMetadata(buildContext)
+	}
+
+	revision, err := runGit(ctx, buildContext, "rev-parse", "HEAD")
+	if err != nil {
+		slog.DebugContext(
+			ctx,
+			"git metadata unavailable",
+			"build_context",
+			buildContext,
+			"err",
+			err,
+		)
+		return gitMetadata{}
+	}
+	m := gitMetadata{Revision: revision}
+	// Untracked files are ignored, as nix leaves them out of a git flake.
+	status, err := runGit(ctx, buildContext, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		slog.DebugContext(ctx, "git status unavailable", "err", err)
+	} else if status != "" {
+		m.Revision += "-dirty"
+	}
+	if origin, err := runGit(ctx, buildContext, "remote", "get-url", "origin"); err == nil {
+		m.Source = normalizeGitURL(origin)
+	} else {
+		slog.DebugContext(ctx, "git remote origin unavailable", "err", err)
+	}
+	committed, err := runGit(ctx, buildContext, "show", "-s", "--format=%cI", "HEAD")
+	if err == nil {
+		if t, err := time.Parse(time.RFC3339, committed); err == nil {
+			m.Created = t.UTC().Format(time.RFC3339)
+		}
+	}
+	return m
+}
+
+// runGit runs git in dir and returns its trimmed output.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := gitCommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr := strings.TrimSpace(string(exitErr.Stderr))
+			return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, stderr)
+		}
+		return "", fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// normalizeGitURL turns a git remote into a browsable https URL: scp-like
+// and ssh remotes are rewritten, credentials are dropped so they never end
+// up in an image, and the .git suffix is trimmed.
+func normalizeGitURL(remote string) string {
+	if !strings.Contains(remote, "://") {
+		// An scp-like remote, such as git@github.com:org/repo.git.
+		if host, path, ok := strings.Cut(remote, ":"); ok && !strings.Contains(host, "/") {
+			if _, h, ok := strings.Cut(host, "@"); ok {
+				host = h
+			}
+			remote = "https://" + host + "/" + strings.TrimPrefix(path, "/")
+		}
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if u.Scheme == "ssh" || u.Scheme == "git" {
+		u.Scheme = "https"
+		u.Host = u.Hostname()
+	}
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, ".git")
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// flakeForgeHosts maps the forge flake ref schemes to their default host.
+var flakeForgeHosts = map[string]string{
+	"github":    "github.com",
+	"gitlab":    "gitlab.com",
+	"sourcehut": "git.sr.ht",
+}
+
+// parseFlakeRefGitMetadata reads the source and rev of a remote flake ref,
+// from its rev query parameter or a rev in place of the branch of a forge
+// ref. A branch gives no revision, since it may have moved.
+func parseFlakeRefGitMetadata(ref string) gitMetadata {
+	ref, _, _ = strings.Cut(ref, "#")
+	ref, rawQuery, _ := strings.Cut(ref, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	m := gitMetadata{Revision: query.Get("rev")}
+
+	scheme, rest, _ := strings.Cut(ref, ":")
+	if host, ok := flakeForgeHosts[scheme]; ok {
+		if h := query.Get("host"); h != "" {
+			host = h
+		}
+		segs := strings.Split(rest, "/")
+		if len(segs) >= 2 {
+			m.Source = "https://" + host + "/" + segs[0] + "/" + segs[1]
+		}
+		if m.Revision == "" && len(segs) >= 3 && gitRevPattern.MatchString(segs[2]) {
+			m.Revision = segs[2]
+		}
+		return m
+	}
+	if remote, ok := strings.CutPrefix(ref, "git+"); ok {
+		m.Source = normalizeGitURL(remote)
+	}
+	return m
+}
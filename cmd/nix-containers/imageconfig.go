@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parseEnvVar validates a KEY=VALUE entry. The value is kept verbatim, so
+// it may contain spaces and further = signs.
+func parseEnvVar(source, kv string) (string, error) {
+	key, _, ok := strings.Cut(kv, "=")
+	if !ok || strings.TrimSpace(key) == "" || strings.ContainsAny(key, " \t") {
+		return "", fmt.Errorf("invalid %s entry %q, expected KEY=VALUE", source, kv)
+	}
+	return kv, nil
+}
+
+// readEnvFile reads the KEY=VALUE entries of a dotenv file, in order. Blank
+// lines and # comments are skipped, an export prefix is allowed, and values
+// wrapped in single or double quotes are unquoted with their spaces kept.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open env file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		source := fmt.Sprintf("env file %s line %d", path, n)
+		kv, err := parseEnvVar(source, line)
+		if err != nil {
+			return nil, err
+		}
+		key, value, _ := strings.Cut(kv, "=")
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, strings.TrimSpace(key)+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %w", path, err)
+	}
+	return env, nil
+}
+
+// parsePort validates a port exposed by the image, as a number with an
+// optional /tcp or /udp protocol, and returns it as PORT/PROTO, the form of
+// the image config.
+func parsePort(raw string) (string, error) {
+	port, proto, ok := strings.Cut(raw, "/")
+	if !ok {
+		proto = "tcp"
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 || (proto != "tcp" && proto != "udp") {
+		return "", fmt.Errorf("invalid --expose port %q, expected PORT[/tcp|/udp]", raw)
+	}
+	return fmt.Sprintf("%d/%s", n, proto), nil
+}
+
+// parseCommand parses a command given either as a JSON array, as in a
+// Dockerfile exec form, or as comma-separated arguments. An empty value
+// yields an empty, non-nil command.
+func parseCommand(flag, raw string) ([]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return []string{}, nil
+	}
+	if strings.HasPrefix(raw, "[") {
+		var command []string
+		if err := json.Unmarshal([]byte(raw), &command); err != nil {
+			return nil, fmt.Errorf("invalid --%s JSON array %q: %w", flag, raw, err)
+		}
+		return command, nil
+	}
+	command := strings.Split(raw, ",")
+	for i, arg := range command {
+		command[i] = strings.TrimSpace(arg)
+	}
+	return command, nil
+}
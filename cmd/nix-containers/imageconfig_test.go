@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := map[string][]string{
+		`["/bin/app", "--port", "8080"]`: {"/bin/app", "--port", "8080"},
+		`["/bin/sh", "-c", "a, b"]`:      {"/bin/sh", "-c", "a, b"},
+		"/bin/app, --port,8080":          {"/bin/app", "--port", "8080"},
+		"[]":                             {},
+		"":                               {},
+	}
+	for raw, want := range tests {
+		got, err := parseCommand("cmd", raw)
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", raw, err)
+		}
+		if got == nil || !slices.Equal(got, want) {
+			t.Fatalf("parseCommand(%q) = %#v, want %#v", raw, got, want)
+		}
+	}
+	if _, err := parseCommand("cmd", `["/bin/app"`); err == nil {
+		t.Fatalf("expected error for an invalid JSON array")
+	}
+}
+
+func TestGetImageConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	cfg, err := getImageConfig()
+	if err != nil {
+		t.Fatalf("get image config failed: %v", err)
+	}
+	if !cfg.Empty() {
+		t.Fatalf("expected no overrides by default, got %+v", cfg)
+	}
+
+	viper.Set("image_entrypoint", "")
+	viper.Set("image_cmd", `["serve"]`)
+	cfg, err = getImageConfig()
+	if err != nil {
+		t.Fatalf("get image config failed: %v", err)
+	}
+	if cfg.Entrypoint == nil || len(cfg.Entrypoint) != 0 {
+		t.Fatalf("expected an empty entrypoint to clear it, got %#v", cfg.Entrypoint)
+	}
+	if !slices.Equal(cfg.Cmd, []string{"serve"}) {
+		t.Fatalf("expected cmd serve, got %q", cfg.Cmd)
+	}
+
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("REGION=eu\nMODE=file\n"), 0o644); err != nil {
+		t.Fatalf("write env file failed: %v", err)
+	}
+	viper.Set("env_file", path)
+	viper.Set("image_env", []string{"MODE=flag", "OTEL_RESOURCE_ATTRIBUTES=a=1, b=2"})
+	cfg, err = getImageConfig()
+	if err != nil {
+		t.Fatalf("get image config failed: %v", err)
+	}
+	want := []string{"REGION=eu", "MODE=file", "MODE=flag", "OTEL_RESOURCE_ATTRIBUTES=a=1, b=2"}
+	if !slices.Equal(cfg.Env, want) {
+		t.Fatalf("expected env %q, got %q", want, cfg.Env)
+	}
+
+	viper.Set("image_env", []string{"MODE"})
+	if _, err := getImageConfig(); err == nil {
+		t.Fatalf("expected error for an env entry without a value")
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	content := "# endpoints\n" +
+		"\n" +
+		"export OTEL_EXPORTER_OTLP_ENDPOINT=http://collector:4317\n" +
+		"GREETING=\"hello  world\"\n" +
+		"QUERY='a=b'\n" +
+		"EMPTY=\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write env file failed: %v", err)
+	}
+
+	env, err := readEnvFile(path)
+	if err != nil {
+		t.Fatalf("read env file failed: %v", err)
+	}
+	want := []string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT=http://collector:4317",
+		"GREETING=hello  world",
+		"QUERY=a=b",
+		"EMPTY=",
+	}
+	if !slices.Equal(env, want) {
+		t.Fatalf("expected env %q, got %q", want, env)
+	}
+
+	if err := os.WriteFile(path, []byte("VALID=1\nnot an entry\n"), 0o644); err != nil {
+		t.Fatalf("write env file failed: %v", err)
+	}
+	if _, err := readEnvFile(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected error naming line 2, got %v", err)
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	for raw, want := range map[string]string{
+		"8080":     "8080/tcp",
+		"8080/tcp": "8080/tcp",
+		"53/udp":   "53/udp",
+	} {
+		got, err := parsePort(raw)
+		if err != nil || got != want {
+			t.Fatalf("parsePort(%q) = %q, %v, want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "http", "0", "70000/tcp", "8080/sctp", "8080/"} {
+		if _, err := parsePort(raw); err == nil {
+			t.Fatalf("expected error for port %q", raw)
+		}
+	}
+}
+
+func TestGetImageConfigIgnoresShellEnv(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.AutomaticEnv()
+	t.Setenv("USER", "alice")
+	t.Setenv("WORKDIR", "/home/alice")
+	t.Setenv("ENTRYPOINT", "/bin/sh")
+	t.Setenv("CMD", "foo")
+	t.Setenv("ENV", "/etc/shrc")
+	t.Setenv("EXPOSE", "8080")
+	t.Setenv("VOLUMES", "/data")
+
+	cfg, err := getImageConfig()
+	if err != nil {
+		t.Fatalf("get image config failed: %v", err)
+	}
+	if !cfg.Empty() {
+		t.Fatalf("expected the shell env to leave the image config as built, got %+v", cfg)
+	}
+}
+
+func TestGetImageConfigPortsAndVolumes(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	viper.Set("image_expose", []string{"8080,9090/udp"})
+	viper.Set("image_volumes", []string{"/data", "/cache"})
+	cfg, err := getImageConfig()
+	if err != nil {
+		t.Fatalf("get image config failed: %v", err)
+	}
+	if !slices.Equal(cfg.ExposedPorts, []string{"8080/tcp", "9090/udp"}) ||
+		!slices.Equal(cfg.Volumes, []string{"/data", "/cache"}) {
+		t.Fatalf("expected ports and volumes, got %q %q", cfg.ExposedPorts, cfg.Volumes)
+	}
+
+	viper.Set("image_expose", []string{"8080/http"})
+	if _, err := getImageConfig(); err == nil {
+		t.Fatalf("expected error for an invalid port protocol")
+	}
+	viper.Set("image_expose", nil)
+	viper.Set("image_volumes", []string{"data"})
+	if _, err := getImageConfig(); err == nil {
+		t.Fatalf("expected error for a relative volume")
+	}
+}
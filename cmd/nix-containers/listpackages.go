@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// listPackagesOutputText prints packages as an aligned table.
+	listPackagesOutputText = "text"
+	// listPackagesOutputJSON prints packages as a JSON array.
+	listPackagesOutputJSON = "json"
+)
+
+// flakePackage is a package of the flake and the platforms it is built for.
+type flakePackage struct {
+	Name      string   `json:"package"`
+	Platforms []string `json:"platforms"`
+	Systems   []string `json:"systems"`
+}
+
+type flakePackagesClient interface {
+	FlakePackages(
+		context.Context,
+		string,
+		...nixcontainers.ImageOption,
+	) (map[string][]string, error)
+}
+
+var listPackagesCmd = &cobra.Command{
+	Use:   "list-packages [BUILD_CONTEXT]",
+	Short: "List the flake packages usable as image names",
+	Long:  "Lists the packages of the flake at BUILD_CONTEXT with the platforms they are available for, using nix flake show. The last path segment of IMAGE selects the package, so every listed name can be built as an image for its platforms.",
+	Example: "# List the packages of the current directory\n" +
+		"./nix-containers list-packages\n\n" +
+		"# Print them as JSON\n" +
+		"./nix-containers list-packages . --output json",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		buildContext := getBuildContext()
+		if len(args) > 0 {
+			buildContext = args[0]
+		} else if buildContext == "" {
+			var err error
+			buildContext, err = os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get current working directory: %w", err)
+			}
+		}
+		flakeDir, err := getFlakeDir()
+		if err != nil {
+			return err
+		}
+		buildContext, err = applyFlakeDir(buildContext, flakeDir)
+		if err != nil {
+			return err
+		}
+		output := viper.GetString("list_packages_output")
+		if output != listPackagesOutputText && output != listPackagesOutputJSON {
+			return fmt.Errorf("invalid output format: %s", output)
+		}
+		var opts []nixcontainers.ImageOption
+		if getAcceptFlakeConfig() {
+			opts = append(opts, nixcontainers.WithAcceptFlakeConfig())
+		}
+		if getNoPureEval() {
+			opts = append(opts, nixcontainers.WithNoPureEval())
+		}
+		if getRefresh() {
+			opts = append(opts, nixcontainers.WithRefresh())
+		}
+		return runListPackages(
+			cmd.Context(),
+			cmd.OutOrStdout(),
+			nixcontainers.NewNixClient(nixFeatureOptions()...),
+			buildContext,
+			output,
+			opts...,
+		)
+	},
+}
+
+func init() {
+	listPackagesCmd.Flags().String(
+		"output",
+		listPackagesOutputText,
+		"output format: text or json",
+	)
+	if err := viper.BindPFlag(
+		"list_packages_output",
+		listPackagesCmd.Flags().Lookup("output"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "output", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(listPackagesCmd)
+}
+
+func runListPackages(
+	ctx context.Context,
+	out io.Writer,
+	nix flakePackagesClient,
+	buildContext string,
+	output string,
+	opts ...nixcontainers.ImageOption,
+) error {
+	systems, err := nix.FlakePackages(ctx, buildContext, opts...)
+	if err != nil {
+		return err
+	}
+	packages := groupFlakePackages(ctx, systems)
+	if output == listPackagesOutputJSON {
+		if err := json.NewEncoder(out).Encode(packages); err != nil {
+			return fmt.Errorf("failed to write packages: %w", err)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "PACKAGE\tPLATFORMS")
+	for _, pkg := range packages {
+		_, _ = fmt.Fprintf(w, "%s\t%s\n", pkg.Name, strings.Join(pkg.Platforms, ","))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write packages: %w", err)
+	}
+	return nil
+}
+
+// groupFlakePackages turns the package names of each nix system into the
+// sorted packages with the platforms they are available for. Systems that
+// do not map to a platform are skipped.
+func groupFlakePackages(ctx context.Context, systems map[string][]string) []flakePackage {
+	byName := map[string]*flakePackage{}
+	for _, system := range slices.Sorted(maps.Keys(systems)) {
+		p, err := nixcontainers.ParseSystemName(system)
+		if err != nil {
+			slog.DebugContext(ctx, "skipping flake packages", "system", system, "err", err)
+			continue
+		}
+		for _, pkgName := range systems[system] {
+			pkg, ok := byName[pkgName]
+			if !ok {
+				pkg = &flakePackage{Name: pkgName, Platforms: []string{}, Systems: []string{}}
+				byName[pkgName] = pkg
+			}
+			pkg.Platforms = append(pkg.Platforms, p.String())
+			pkg.Systems = append(pkg.Systems, system)
+		}
+	}
+	packages := make([]flakePackage, 0, len(byName))
+	for _, pkgName := range slices.Sorted(maps.Keys(byName)) {
+		packages = append(packages, *byName[pkgName])
+	}
+	return packages
+}
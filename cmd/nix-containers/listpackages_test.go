@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+type fakeFlakePackagesClient struct {
+	systems map[string][]string
+}
+
+func (f fakeFlakePackagesClient) FlakePackages(
+	context.Context,
+	string,
+	...nixcontainers.ImageOption,
+) (map[string][]string, error) {
+	return f.systems, nil
+}
+
+func TestRunListPackages(t *testing.T) {
+	client := fakeFlakePackagesClient{systems: map[string][]string{
+		"aarch64-darwin": {"app"},
+		"aarch64-linux":  {"app", "worker"},
+		"armv7l-linux":   {"app"},
+		"x86_64-linux":   {"app", "tools"},
+		"bogus":          {"app"},
+	}}
+
+	var out bytes.Buffer
+	if err := runListPackages(
+		context.Background(),
+		&out,
+		client,
+		"/workspace",
+		listPackagesOutputJSON,
+	); err != nil {
+		t.Fatalf("list packages failed: %v", err)
+	}
+	var packages []flakePackage
+	if err := json.Unmarshal(out.Bytes(), &packages); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", out.String(), err)
+	}
+	names := make([]string, 0, len(packages))
+	for _, pkg := range packages {
+		names = append(names, pkg.Name)
+	}
+	if !slices.Equal(names, []string{"app", "tools", "worker"}) {
+		t.Fatalf("expected sorted packages, got %q", names)
+	}
+	wantPlatforms := []string{"darwin/arm64", "linux/arm64", "linux/arm/v7", "linux/amd64"}
+	if !slices.Equal(packages[0].Platforms, wantPlatforms) {
+		t.Fatalf("expected app platforms %q, got %q", wantPlatforms, packages[0].Platforms)
+	}
+	wantSystems := []string{"aarch64-darwin", "aarch64-linux", "armv7l-linux", "x86_64-linux"}
+	if !slices.Equal(packages[0].Systems, wantSystems) {
+		t.Fatalf("expected app systems %q, got %q", wantSystems, packages[0].Systems)
+	}
+
+	out.Reset()
+	if err := runListPackages(
+		context.Background(),
+		&out,
+		client,
+		"/workspace",
+		listPackagesOutputText,
+	); err != nil {
+		t.Fatalf("list packages failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		"PACKAGE  PLATFORMS",
+		"app      darwin/arm64,linux/arm64,linux/arm/v7,linux/amd64",
+		"tools    linux/amd64",
+		"worker   linux/arm64",
+	}
+	if !slices.Equal(lines, want) {
+		t.Fatalf("expected table %q, got %q", want, lines)
+	}
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -13,37 +24,53 @@ var (
 	rootCmd = &cobra.Command{
 		Use:   "nix-containers",
 		Short: "Build OCI images from Nix flakes",
-		Long:  "CLI to build and optionally push OCI images produced from Nix flakes. Primarily intended for Skaffold custom builders. Configure via env vars: IMAGE, PLATFORMS, BUILD_CONTEXT, PUSH_IMAGE, LOG_LEVEL, ACCEPT_FLAKE_CONFIG.",
+		Long:  "CLI to build and optionally push OCI images produced from Nix flakes. Primarily intended for Skaffold custom builders. Configure via env vars: IMAGE, PLATFORMS, BUILD_CONTEXT, PUSH_IMAGE, LOG_LEVEL, ACCEPT_FLAKE_CONFIG. Failed builds exit 2 on a configuration error, 3 when the flake fails to evaluate, 4 when nix fails to build, 5 when the container runtime fails to load the image, 6 when the registry rejects the credentials, 7 when a push fails, and 130 when interrupted.",
 		Example: "# Show help\n" +
 			"nix-containers --help\n\n" +
 			"# Build via Skaffold custom builder\n" +
 			"IMAGE=ghcr.io/you/app:latest PLATFORMS=linux/amd64 BUILD_CONTEXT=. PUSH_IMAGE=true nix-containers skaffold build",
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			// Reject -v with -q before the logger is set up from them.
+			if err := cmd.ValidateFlagGroups(); err != nil {
+				return err
+			}
+			path := getConfigFile()
+			explicit := path != ""
+			if !explicit {
+				path = defaultConfigFile
+			}
+			if err := loadConfigFile(path, explicit); err != nil {
+				return err
+			}
+			// The config file and -v/-q may set the log level.
+			if err := setupLogger(); err != nil {
+				return err
+			}
+			level, _ := getLogLevel()
+			slog.Debug(
+				"log level resolved",
+				"log_level", level,
+				"verbose", getVerbosity(),
+				"nix_stderr_level", nixcontainers.NixStderrLevel,
+			)
+			return nil
+		},
 	}
 
 	buildCmd = &cobra.Command{
 		Use:   "build [BUILD_CONTEXT]",
 		Short: "Build and optionally push images (root variant)",
-		Long:  "Builds OCI images from a Nix flake at BUILD_CONTEXT and optionally pushes them. Configure via env vars: IMAGE, PLATFORMS, PUSH_IMAGE, LOG_LEVEL, ACCEPT_FLAKE_CONFIG.",
+		Long:  "Builds OCI images from a Nix flake at BUILD_CONTEXT and optionally pushes them. Configure via env vars: IMAGE, PLATFORMS, PUSH_IMAGE, LOG_LEVEL, ACCEPT_FLAKE_CONFIG. Failed builds exit 2 on a configuration error, 3 when the flake fails to evaluate, 4 when nix fails to build, 5 when the container runtime fails to load the image, 6 when the registry rejects the credentials, 7 when a push fails, and 130 when interrupted.",
 		Example: "# Build from current directory and push\n" +
 			"IMAGE=ghcr.io/you/app:latest PLATFORMS=linux/amd64 PUSH_IMAGE=true ./nix-containers build .",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := cmd.Context()
-			debug := getDebug()
-			if debug {
+			if getDebug() {
 				slog.SetLogLoggerLevel(slog.LevelDebug)
 			}
-			image, err := getImageTag()
-			if err != nil {
-				return fmt.Errorf("failed to get image: %w", err)
-			}
-			plats := getPlatforms()
-			pushImage := getPushImage()
-			acceptFlake := getAcceptFlakeConfig()
-			noPureEval := getNoPureEval()
-			buildContext := ""
+			buildContext := getBuildContext()
 			if len(args) > 0 {
 				buildContext = args[0]
-			} else {
+			} else if buildContext == "" {
 				var err error
 				buildContext, err = os.Getwd()
 				if err != nil {
@@ -55,36 +82,35 @@ var (
 					"build context must be provided via arg or --build-context/BUILD_CONTEXT",
 				)
 			}
-			slog.InfoContext(
-				ctx,
-				"build config",
-				"image", image.String(),
-				"platforms", plats,
-				"build_context", buildContext,
-				"push", pushImage,
-				"accept_flake_config", acceptFlake,
-				"no_pure_eval", noPureEval,
-			)
-			opts := []BuildOption{
-				WithPush(pushImage),
-			}
-			if acceptFlake {
-				opts = append(opts, WithStreamImageOption(WithAcceptFlakeConfig()))
-			}
-			if noPureEval {
-				opts = append(opts, WithStreamImageOption(WithNoPureEval()))
-			}
-			container, err := NewContainerClient(ctx)
+			built, err := runBuild(cmd.Context(), buildContext, buildRun{})
 			if err != nil {
-				return fmt.Errorf("failed to create container client: %w", err)
+				return err
+			}
+			// The built references go to stdout, so that scripts can read the
+			// tags --tag-strategy generated or the digests pushed by digest.
+			for _, ref := range built {
+				if _, err := fmt.Fprintln(cmd.OutOrStdout(), ref); err != nil {
+					return err
+				}
 			}
-			builder := NewBuilder(NewNixClient(), container, opts...)
-			return builder.BuildAndPush(ctx, buildContext, image, plats)
+			return nil
 		},
 	}
 )
 
 func init() {
+	rootCmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return nixcontainers.ClassifyError(nixcontainers.ConfigErrorClass, err)
+	})
+	rootCmd.PersistentFlags().
+		String("config", "", "project config file (defaults to "+defaultConfigFile+" if present)")
+	if err := viper.BindPFlag(
+		"config_file",
+		rootCmd.PersistentFlags().Lookup("config"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "config", "err", err)
+		os.Exit(1)
+	}
 	rootCmd.PersistentFlags().
 		Bool("accept-flake-config", false, "accept nix flake config during build")
 	if err := viper.BindPFlag(
@@ -103,66 +129,2115 @@ func init() {
 		slog.Error("bind flag failed", "flag", "no-pure-eval", "err", err)
 		os.Exit(1)
 	}
+	rootCmd.PersistentFlags().String(
+		"docker-config",
+		"",
+		"directory of the docker config.json to read registry credentials from",
+	)
+	if err := viper.BindPFlag(
+		"docker_config",
+		rootCmd.PersistentFlags().Lookup("docker-config"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "docker-config", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().String(
+		"docker-host",
+		"",
+		"docker daemon to load images into, such as ssh://builder@host, "+
+			"overriding DOCKER_HOST and the docker context",
+	)
+	if err := viper.BindPFlag(
+		"docker_host",
+		rootCmd.PersistentFlags().Lookup("docker-host"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "docker-host", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().String(
+		"cred-helper",
+		"",
+		"docker-credential-NAME helper to get the destination registry credentials from",
+	)
+	if err := viper.BindPFlag(
+		"cred_helper",
+		rootCmd.PersistentFlags().Lookup("cred-helper"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "cred-helper", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().Bool(
+		"no-ambient-auth",
+		false,
+		"never authenticate with credentials of the environment, such as GITHUB_TOKEN",
+	)
+	if err := viper.BindPFlag(
+		"no_ambient_auth",
+		rootCmd.PersistentFlags().Lookup("no-ambient-auth"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "no-ambient-auth", "err", err)
+		os.Exit(1)
+	}
 	rootCmd.PersistentFlags().
-		Bool("debug", false, "enable debug logging")
-	if err := viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug")); err != nil {
-		slog.Error("bind flag failed", "flag", "debug", "err", err)
+		String("flake-dir", "", "subdirectory of the build context containing flake.nix")
+	if err := viper.BindPFlag("flake_dir", rootCmd.PersistentFlags().Lookup("flake-dir")); err != nil {
+		slog.Error("bind flag failed", "flag", "flake-dir", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().
+		Bool("refresh", false, "refetch remote flake build contexts instead of using the nix cache")
+	if err := viper.BindPFlag("refresh", rootCmd.PersistentFlags().Lookup("refresh")); err != nil {
+		slog.Error("bind flag failed", "flag", "refresh", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().BoolP(
+		"print-build-logs",
+		"L",
+		false,
+		"pass -L to nix build and relay its output at info",
+	)
+	if err := viper.BindPFlag(
+		"print_build_logs",
+		buildCmd.Flags().Lookup("print-build-logs"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "print-build-logs", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().Bool(
+		"no-auto-experimental-features",
+		false,
+		"do not enable the nix-command and flakes features missing from nix.conf",
+	)
+	if err := viper.BindPFlag(
+		"no_auto_experimental_features",
+		rootCmd.PersistentFlags().Lookup("no-auto-experimental-features"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "no-auto-experimental-features", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Bool("impure", false, "allow impure nix builds that read the environment")
+	if err := viper.BindPFlag("impure", buildCmd.Flags().Lookup("impure")); err != nil {
+		slog.Error("bind flag failed", "flag", "impure", "err", err)
 		os.Exit(1)
 	}
-	rootCmd.AddCommand(buildCmd)
 	buildCmd.Flags().String(
-		"image",
+		"index-mediatype",
+		nixcontainers.IndexMediaTypeOCI,
+		"multi-platform index media type: oci, docker, or auto (docker fallback)",
+	)
+	if err := viper.BindPFlag(
+		"index_mediatype",
+		buildCmd.Flags().Lookup("index-mediatype"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "index-mediatype", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"index-annotation",
+		nil,
+		"annotate the multi-platform index, as KEY=VALUE (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"index_annotations",
+		buildCmd.Flags().Lookup("index-annotation"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "index-annotation", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"index-artifact-type",
 		"",
-		"destination image reference (e.g., ghcr.io/you/app:tag)",
+		"artifactType of the multi-platform OCI index, such as application/vnd.example.release",
 	)
-	if err := viper.BindPFlag("image", buildCmd.Flags().Lookup("image")); err != nil {
-		slog.Error("bind flag failed", "flag", "image", "err", err)
+	if err := viper.BindPFlag(
+		"index_artifact_type",
+		buildCmd.Flags().Lookup("index-artifact-type"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "index-artifact-type", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().String(
+		"runtime",
+		nixcontainers.ContainerRuntimeAuto,
+		"runtime images are loaded into: auto (docker, else containerd), docker, or containerd",
+	)
+	if err := viper.BindPFlag(
+		"container_runtime",
+		rootCmd.PersistentFlags().Lookup("runtime"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "runtime", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().
+		String("containerd-address", "", "containerd socket (defaults to the containerd default)")
+	if err := viper.BindPFlag(
+		"containerd_address",
+		rootCmd.PersistentFlags().Lookup("containerd-address"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "containerd-address", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().String(
+		"containerd-namespace",
+		nixcontainers.DefaultContainerdNamespace,
+		"containerd namespace images are loaded into (k8s.io for Kubernetes nodes)",
+	)
+	if err := viper.BindPFlag(
+		"containerd_namespace",
+		rootCmd.PersistentFlags().Lookup("containerd-namespace"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "containerd-namespace", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"skip-preflight",
+		false,
+		"skip checking the container runtime and registry credentials before building",
+	)
+	if err := viper.BindPFlag(
+		"skip_preflight",
+		buildCmd.Flags().Lookup("skip-preflight"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "skip-preflight", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"skip-daemon-check",
+		false,
+		"skip checking the container runtime is reachable before building",
+	)
+	if err := viper.BindPFlag(
+		"skip_daemon_check",
+		buildCmd.Flags().Lookup("skip-daemon-check"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "skip-daemon-check", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"skip-gc-root",
+		false,
+		"leave nix build results unrooted while their images are loaded and pushed",
+	)
+	if err := viper.BindPFlag(
+		"skip_gc_root",
+		buildCmd.Flags().Lookup("skip-gc-root"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "skip-gc-root", "err", err)
 		os.Exit(1)
 	}
 	buildCmd.Flags().String(
-		"build-context",
+		"required-nix-version",
 		"",
-		"path to the flake build context (defaults to positional arg or BUILD_CONTEXT)",
+		"semver range the nix version must satisfy (e.g., \">=2.18 <2.25\")",
 	)
 	if err := viper.BindPFlag(
-		"build_context",
-		buildCmd.Flags().Lookup("build-context"),
+		"required_nix_version",
+		buildCmd.Flags().Lookup("required-nix-version"),
 	); err != nil {
-		slog.Error("bind flag failed", "flag", "build-context", "err", err)
+		slog.Error("bind flag failed", "flag", "required-nix-version", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"nix-from-flake",
+		"",
+		"flake reference providing a pinned nix (built as <flakeref>#nix)",
+	)
+	if err := viper.BindPFlag(
+		"nix_from_flake",
+		buildCmd.Flags().Lookup("nix-from-flake"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-from-flake", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"nix-arg",
+		nil,
+		"extra argument appended verbatim to nix build (repeatable)",
+	)
+	if err := viper.BindPFlag("nix_args", buildCmd.Flags().Lookup("nix-arg")); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-arg", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"nix-argstr",
+		nil,
+		"pass a string to the functions nix auto-calls, as NAME=VALUE for --argstr (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"nix_argstrs",
+		buildCmd.Flags().Lookup("nix-argstr"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-argstr", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"nix-arg-expr",
+		nil,
+		"pass a nix expression to the functions nix auto-calls, as NAME=EXPR for --arg (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"nix_arg_exprs",
+		buildCmd.Flags().Lookup("nix-arg-expr"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-arg-expr", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"nix-output",
+		"",
+		"output of the nix build result the image is read from, as [DRV:]NAME (default out)",
+	)
+	if err := viper.BindPFlag(
+		"nix_output",
+		buildCmd.Flags().Lookup("nix-output"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-output", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"use-existing",
+		nil,
+		"reuse a pushed image for a platform instead of building it, as PLATFORM=REF (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"use_existing",
+		buildCmd.Flags().Lookup("use-existing"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "use-existing", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"also-push",
+		nil,
+		"also push the image to this reference after the destination (repeatable)",
+	)
+	if err := viper.BindPFlag("also_push", buildCmd.Flags().Lookup("also-push")); err != nil {
+		slog.Error("bind flag failed", "flag", "also-push", "err", err)
 		os.Exit(1)
 	}
 	buildCmd.Flags().Bool(
-		"push",
+		"mirror-best-effort",
 		false,
-		"push built images to the registry",
+		"report failed --also-push pushes without failing the build",
 	)
-	if err := viper.BindPFlag("push_image", buildCmd.Flags().Lookup("push")); err != nil {
-		slog.Error("bind flag failed", "flag", "push", "err", err)
+	if err := viper.BindPFlag(
+		"mirror_best_effort",
+		buildCmd.Flags().Lookup("mirror-best-effort"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "mirror-best-effort", "err", err)
 		os.Exit(1)
 	}
 	buildCmd.Flags().String(
-		"platforms",
+		"base-image",
 		"",
-		"comma-separated target platforms os/arch (e.g., linux/amd64,linux/arm64)",
+		"image to append the nix layers onto, resolved for each platform",
 	)
-	if err := viper.BindPFlag("platforms", buildCmd.Flags().Lookup("platforms")); err != nil {
-		slog.Error("bind flag failed", "flag", "platforms", "err", err)
+	if err := viper.BindPFlag("base_image", buildCmd.Flags().Lookup("base-image")); err != nil {
+		slog.Error("bind flag failed", "flag", "base-image", "err", err)
 		os.Exit(1)
 	}
-}
-
-func main() {
-	logLevel, err := getLogLevel()
-	if err != nil {
-		slog.Error("get log level failed", "err", err)
+	buildCmd.Flags().StringArray(
+		"add-layer",
+		nil,
+		"add the local file or directory SRC as a layer, as SRC[:DEST] with DEST defaulting to / (repeatable)",
+	)
+	if err := viper.BindPFlag("add_layers", buildCmd.Flags().Lookup("add-layer")); err != nil {
+		slog.Error("bind flag failed", "flag", "add-layer", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"chown",
+		"",
+		"owner of the files --add-layer adds, as UID[:GID] (default 0:0)",
+	)
+	if err := viper.BindPFlag("add_layer_chown", buildCmd.Flags().Lookup("chown")); err != nil {
+		slog.Error("bind flag failed", "flag", "chown", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"entrypoint",
+		"",
+		"entrypoint of the image, as a JSON array or comma-separated; empty clears it",
+	)
+	if err := viper.BindPFlag(
+		"image_entrypoint",
+		buildCmd.Flags().Lookup("entrypoint"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "entrypoint", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"cmd",
+		"",
+		"cmd of the image, as a JSON array or comma-separated; empty clears it",
+	)
+	if err := viper.BindPFlag("image_cmd", buildCmd.Flags().Lookup("cmd")); err != nil {
+		slog.Error("bind flag failed", "flag", "cmd", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"env",
+		nil,
+		"env var set in the image config, as KEY=VALUE (repeatable)",
+	)
+	if err := viper.BindPFlag("image_env", buildCmd.Flags().Lookup("env")); err != nil {
+		slog.Error("bind flag failed", "flag", "env", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"env-file",
+		"",
+		"dotenv file of env vars set in the image config, overridden by --env",
+	)
+	if err := viper.BindPFlag("env_file", buildCmd.Flags().Lookup("env-file")); err != nil {
+		slog.Error("bind flag failed", "flag", "env-file", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"user",
+		"",
+		"user the image runs as, as a uid, uid:gid or name",
+	)
+	if err := viper.BindPFlag("image_user", buildCmd.Flags().Lookup("user")); err != nil {
+		slog.Error("bind flag failed", "flag", "user", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String("workdir", "", "working directory of the image")
+	if err := viper.BindPFlag(
+		"image_workdir",
+		buildCmd.Flags().Lookup("workdir"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "workdir", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"expose",
+		nil,
+		"port the image exposes, as PORT[/tcp|/udp] (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"image_expose",
+		buildCmd.Flags().Lookup("expose"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "expose", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray("volume", nil, "volume of the image (repeatable)")
+	if err := viper.BindPFlag(
+		"image_volumes",
+		buildCmd.Flags().Lookup("volume"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "volume", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"require-nonroot",
+		false,
+		"fail the build when an image runs as root after the overrides",
+	)
+	if err := viper.BindPFlag(
+		"require_nonroot",
+		buildCmd.Flags().Lookup("require-nonroot"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "require-nonroot", "err", err)
 		os.Exit(1)
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(
-		os.Stderr,
-		&slog.HandlerOptions{Level: logLevel},
-	)))
-	if err := rootCmd.Execute(); err != nil {
-		slog.Error("command failed", "err", err)
+	buildCmd.Flags().Bool(
+		"no-git-metadata",
+		false,
+		"do not annotate and label images with the git revision and source of the build context",
+	)
+	if err := viper.BindPFlag(
+		"no_git_metadata",
+		buildCmd.Flags().Lookup("no-git-metadata"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "no-git-metadata", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"tag-strategy",
+		"",
+		"tag images given without one by gitsha, date, flake-rev or a custom --tag-template",
+	)
+	if err := viper.BindPFlag(
+		"tag_strategy",
+		buildCmd.Flags().Lookup("tag-strategy"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "tag-strategy", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"tag-template",
+		"",
+		"Go template of the custom tag strategy, e.g. {{.Package}}-{{.GitSHA}}",
+	)
+	if err := viper.BindPFlag(
+		"tag_template",
+		buildCmd.Flags().Lookup("tag-template"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "tag-template", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"compression",
+		string(compression.GZip),
+		"layer compression of pushed images, gzip or zstd; zstd layers need containerd 1.5+, "+
+			"Docker 23+ or podman to pull",
+	)
+	if err := viper.BindPFlag("compression", buildCmd.Flags().Lookup("compression")); err != nil {
+		slog.Error("bind flag failed", "flag", "compression", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Int(
+		"compression-level",
+		nixcontainers.DefaultCompressionLevel,
+		"level pushed layers are re-encoded at, -1 keeps the default of --compression",
+	)
+	if err := viper.BindPFlag(
+		"compression_level",
+		buildCmd.Flags().Lookup("compression-level"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "compression-level", "err", err)
 		os.Exit(1)
 	}
+	buildCmd.Flags().Bool(
+		"estargz",
+		false,
+		"convert pushed layers to eStargz for runtimes with the stargz snapshotter to pull lazily",
+	)
+	if err := viper.BindPFlag("estargz", buildCmd.Flags().Lookup("estargz")); err != nil {
+		slog.Error("bind flag failed", "flag", "estargz", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"metrics-file",
+		"",
+		"write a JSON report of the phase durations, sizes and digests of the run to this file",
+	)
+	if err := viper.BindPFlag(
+		"metrics_file",
+		buildCmd.Flags().Lookup("metrics-file"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "metrics-file", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"latest",
+		"",
+		"after pushing, also tag the image or index as latest, or the given tag, in its repository",
+	)
+	buildCmd.Flags().Lookup("latest").NoOptDefVal = "latest"
+	if err := viper.BindPFlag("latest_tag", buildCmd.Flags().Lookup("latest")); err != nil {
+		slog.Error("bind flag failed", "flag", "latest", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"push-by-digest",
+		false,
+		"push images and indexes to their digest in the IMAGE repository without writing any tag",
+	)
+	if err := viper.BindPFlag(
+		"push_by_digest",
+		buildCmd.Flags().Lookup("push-by-digest"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "push-by-digest", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"if-not-exists",
+		false,
+		"skip the build when the IMAGE tag already exists in its registry, printing its digest",
+	)
+	if err := viper.BindPFlag(
+		"if_not_exists",
+		buildCmd.Flags().Lookup("if-not-exists"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "if-not-exists", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"fail-if-exists",
+		false,
+		"fail before building when the IMAGE tag already exists in its registry",
+	)
+	if err := viper.BindPFlag(
+		"fail_if_exists",
+		buildCmd.Flags().Lookup("fail-if-exists"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "fail-if-exists", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"mount-from",
+		"",
+		"repository of the destination registry to mount layers from before uploading them",
+	)
+	if err := viper.BindPFlag("mount_from", buildCmd.Flags().Lookup("mount-from")); err != nil {
+		slog.Error("bind flag failed", "flag", "mount-from", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"ecr-create-repo",
+		false,
+		"create the ECR repository of the image when the push does not find it",
+	)
+	if err := viper.BindPFlag(
+		"ecr_create_repo",
+		buildCmd.Flags().Lookup("ecr-create-repo"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "ecr-create-repo", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"ecr-repo-tag",
+		nil,
+		"tag the ECR repositories --ecr-create-repo creates, as KEY=VALUE (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"ecr_repo_tags",
+		buildCmd.Flags().Lookup("ecr-repo-tag"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "ecr-repo-tag", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"ecr-immutable-tags",
+		false,
+		"make the image tags of the ECR repositories --ecr-create-repo creates immutable",
+	)
+	if err := viper.BindPFlag(
+		"ecr_immutable_tags",
+		buildCmd.Flags().Lookup("ecr-immutable-tags"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "ecr-immutable-tags", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"attach",
+		nil,
+		"attach FILE to every pushed image as an OCI referrer artifact, as FILE:TYPE (repeatable)",
+	)
+	if err := viper.BindPFlag("attach", buildCmd.Flags().Lookup("attach")); err != nil {
+		slog.Error("bind flag failed", "flag", "attach", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().StringArray(
+		"override-input",
+		nil,
+		"override a flake input for every platform build, as NAME=REF (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"override_inputs",
+		buildCmd.Flags().Lookup("override-input"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "override-input", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().StringArray(
+		"package-map",
+		nil,
+		"build the image repository REPO from the flake package ATTR, as REPO=ATTR (repeatable)",
+	)
+	if err := viper.BindPFlag(
+		"package_map",
+		rootCmd.PersistentFlags().Lookup("package-map"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "package-map", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		String("nix-max-jobs", "", "nix --max-jobs for each build (integer or auto)")
+	if err := viper.BindPFlag(
+		"nix_max_jobs",
+		buildCmd.Flags().Lookup("nix-max-jobs"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-max-jobs", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		String("nix-cores", "", "nix --cores for each build job (integer, 0 for all cores)")
+	if err := viper.BindPFlag(
+		"nix_cores",
+		buildCmd.Flags().Lookup("nix-cores"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-cores", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		String("nix-builders", "", "nix --builders value for remote builds, passed verbatim")
+	if err := viper.BindPFlag(
+		"nix_builders",
+		buildCmd.Flags().Lookup("nix-builders"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-builders", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		String("nix-store", "", "nix store URI to build into, such as a chroot store path")
+	if err := viper.BindPFlag(
+		"nix_store",
+		buildCmd.Flags().Lookup("nix-store"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-store", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		String("nix-eval-store", "", "nix store URI to evaluate derivations in")
+	if err := viper.BindPFlag(
+		"nix_eval_store",
+		buildCmd.Flags().Lookup("nix-eval-store"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "nix-eval-store", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Bool("split-jobs", false, "divide --nix-max-jobs between concurrent platform builds")
+	if err := viper.BindPFlag(
+		"split_jobs",
+		buildCmd.Flags().Lookup("split-jobs"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "split-jobs", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Duration("build-timeout", 0, "maximum duration of each nix build (0 for no timeout)")
+	if err := viper.BindPFlag(
+		"build_timeout",
+		buildCmd.Flags().Lookup("build-timeout"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "build-timeout", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Duration(
+		"heartbeat-interval",
+		nixcontainers.DefaultHeartbeatInterval,
+		"log that a nix build or push is still running this often (0 to disable)",
+	)
+	if err := viper.BindPFlag(
+		"heartbeat_interval",
+		buildCmd.Flags().Lookup("heartbeat-interval"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "heartbeat-interval", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Duration("load-timeout", 0, "maximum duration of each docker load (0 for no timeout)")
+	if err := viper.BindPFlag(
+		"load_timeout",
+		buildCmd.Flags().Lookup("load-timeout"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "load-timeout", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Int(
+		"load-retries",
+		nixcontainers.DefaultLoadRetries,
+		"retries of a docker load failing with a transient daemon error, re-running the image stream",
+	)
+	if err := viper.BindPFlag(
+		"load_retries",
+		buildCmd.Flags().Lookup("load-retries"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "load-retries", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Duration("push-timeout", 0, "maximum duration of each image or index push (0 for no timeout)")
+	if err := viper.BindPFlag(
+		"push_timeout",
+		buildCmd.Flags().Lookup("push-timeout"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "push-timeout", "err", err)
+		os.Exit(1)
+	}
+	// The commands writing to registries share the flag, bound once.
+	for _, cmd := range []*cobra.Command{skaffoldBuildCmd, promoteCmd, attachCmd, copyCmd} {
+		cmd.Flags().AddFlag(buildCmd.Flags().Lookup("push-timeout"))
+	}
+	buildCmd.Flags().Int(
+		"push-jobs",
+		nixcontainers.DefaultPushJobs,
+		"layers uploaded concurrently, in total across the platform images pushed at once",
+	)
+	if err := viper.BindPFlag(
+		"push_jobs",
+		buildCmd.Flags().Lookup("push-jobs"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "push-jobs", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Bool("serialize-push", false, "push one platform image at a time with every upload job")
+	if err := viper.BindPFlag(
+		"serialize_push",
+		buildCmd.Flags().Lookup("serialize-push"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "serialize-push", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().Duration(
+		"registry-timeout",
+		0,
+		"maximum duration to connect to a registry and wait for each response (0 for the defaults)",
+	)
+	if err := viper.BindPFlag(
+		"registry_timeout",
+		rootCmd.PersistentFlags().Lookup("registry-timeout"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "registry-timeout", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().Int(
+		"registry-retry-count",
+		nixcontainers.DefaultRegistryRetryCount,
+		"retries of a registry request failing with a transient error or a 429 or 5xx response",
+	)
+	if err := viper.BindPFlag(
+		"registry_retry_count",
+		rootCmd.PersistentFlags().Lookup("registry-retry-count"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "registry-retry-count", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().Duration(
+		"registry-retry-backoff",
+		nixcontainers.DefaultRegistryRetryBackoff,
+		"delay before the first registry request retry, tripled after each",
+	)
+	if err := viper.BindPFlag(
+		"registry_retry_backoff",
+		rootCmd.PersistentFlags().Lookup("registry-retry-backoff"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "registry-retry-backoff", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"source-image",
+		"",
+		"image the flake package is derived from and tagged as locally (defaults to IMAGE)",
+	)
+	if err := viper.BindPFlag(
+		"source_image",
+		buildCmd.Flags().Lookup("source-image"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "source-image", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"destination",
+		"",
+		"image reference to push to (defaults to --source-image or IMAGE)",
+	)
+	if err := viper.BindPFlag(
+		"destination",
+		buildCmd.Flags().Lookup("destination"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "destination", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Duration(
+		"kill-grace-period",
+		nixcontainers.DefaultKillGracePeriod,
+		"time interrupted nix and stream commands get to exit after SIGINT before SIGKILL",
+	)
+	if err := viper.BindPFlag(
+		"kill_grace_period",
+		buildCmd.Flags().Lookup("kill-grace-period"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "kill-grace-period", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Bool("keep-platform-images", false, "keep intermediate platform tags after a multi-arch push")
+	if err := viper.BindPFlag(
+		"keep_platform_images",
+		buildCmd.Flags().Lookup("keep-platform-images"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "keep-platform-images", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Bool("keep-on-failure", false, "keep intermediate platform tags when a multi-arch build fails")
+	if err := viper.BindPFlag(
+		"keep_on_failure",
+		buildCmd.Flags().Lookup("keep-on-failure"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "keep-on-failure", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"skip-unchanged",
+		false,
+		"skip platforms whose pushed image was built from the same nix out path",
+	)
+	if err := viper.BindPFlag(
+		"skip_unchanged",
+		buildCmd.Flags().Lookup("skip-unchanged"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "skip-unchanged", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"skip-missing-platforms",
+		false,
+		"build only the platforms the flake defines the package for instead of failing",
+	)
+	if err := viper.BindPFlag(
+		"skip_missing_platforms",
+		buildCmd.Flags().Lookup("skip-missing-platforms"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "skip-missing-platforms", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"smoke-test",
+		"",
+		"command to run in each built image after push; the build fails on non-zero exit",
+	)
+	if err := viper.BindPFlag(
+		"smoke_test",
+		buildCmd.Flags().Lookup("smoke-test"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "smoke-test", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().
+		Bool("smoke-test-k8s", false, "run the smoke test as a pod with kubectl instead of docker")
+	if err := viper.BindPFlag(
+		"smoke_test_k8s",
+		buildCmd.Flags().Lookup("smoke-test-k8s"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "smoke-test-k8s", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Duration(
+		"smoke-test-timeout",
+		nixcontainers.DefaultSmokeTestTimeout,
+		"maximum duration of each smoke test (0 for no timeout)",
+	)
+	if err := viper.BindPFlag(
+		"smoke_test_timeout",
+		buildCmd.Flags().Lookup("smoke-test-timeout"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "smoke-test-timeout", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().
+		CountP("verbose", "v", "debug logging, -vv also relays nix output at info (overrides LOG_LEVEL)")
+	if err := viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose")); err != nil {
+		slog.Error("bind flag failed", "flag", "verbose", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().
+		BoolP("quiet", "q", false, "log warnings and errors only (overrides LOG_LEVEL)")
+	if err := viper.BindPFlag("quiet", rootCmd.PersistentFlags().Lookup("quiet")); err != nil {
+		slog.Error("bind flag failed", "flag", "quiet", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.MarkFlagsMutuallyExclusive("verbose", "quiet")
+	rootCmd.PersistentFlags().String("log-format", LogFormatText, "log output format: text or json")
+	if err := viper.BindPFlag(
+		"log_format",
+		rootCmd.PersistentFlags().Lookup("log-format"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "log-format", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.PersistentFlags().
+		Bool("debug", false, "enable debug logging")
+	if err := viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug")); err != nil {
+		slog.Error("bind flag failed", "flag", "debug", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(buildCmd)
+	buildCmd.Flags().String(
+		"image",
+		"",
+		"destination image reference (e.g., ghcr.io/you/app:tag)",
+	)
+	if err := viper.BindPFlag("image", buildCmd.Flags().Lookup("image")); err != nil {
+		slog.Error("bind flag failed", "flag", "image", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"build-context",
+		"",
+		"path to the flake build context (defaults to positional arg or BUILD_CONTEXT)",
+	)
+	if err := viper.BindPFlag(
+		"build_context",
+		buildCmd.Flags().Lookup("build-context"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "build-context", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"push",
+		false,
+		"push built images to the registry",
+	)
+	if err := viper.BindPFlag("push_image", buildCmd.Flags().Lookup("push")); err != nil {
+		slog.Error("bind flag failed", "flag", "push", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().Bool(
+		"load",
+		false,
+		"load the platform images of a multi-platform build without --push into the daemon",
+	)
+	if err := viper.BindPFlag("load_image", buildCmd.Flags().Lookup("load")); err != nil {
+		slog.Error("bind flag failed", "flag", "load", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"output-oci",
+		"",
+		"OCI layout directory for multi-platform builds without --push (defaults to a temp dir)",
+	)
+	if err := viper.BindPFlag("output_oci", buildCmd.Flags().Lookup("output-oci")); err != nil {
+		slog.Error("bind flag failed", "flag", "output-oci", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"kind-cluster",
+		"",
+		"kind cluster to load the built image into, on every node",
+	)
+	if err := viper.BindPFlag("kind_cluster", buildCmd.Flags().Lookup("kind-cluster")); err != nil {
+		slog.Error("bind flag failed", "flag", "kind-cluster", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"minikube",
+		"",
+		"load the built image into the container runtime of this minikube profile "+
+			"(minikube when no profile is given)",
+	)
+	buildCmd.Flags().Lookup("minikube").NoOptDefVal = nixcontainers.DefaultMinikubeProfile
+	if err := viper.BindPFlag("minikube", buildCmd.Flags().Lookup("minikube")); err != nil {
+		slog.Error("bind flag failed", "flag", "minikube", "err", err)
+		os.Exit(1)
+	}
+	buildCmd.Flags().String(
+		"platforms",
+		"",
+		"comma-separated target platforms os/arch (e.g., linux/amd64,linux/arm64), "+
+			"or all for every linux system the flake exposes the package for",
+	)
+	if err := viper.BindPFlag("platforms", buildCmd.Flags().Lookup("platforms")); err != nil {
+		slog.Error("bind flag failed", "flag", "platforms", "err", err)
+		os.Exit(1)
+	}
+	// runBuild reads the build flags for skaffold build too, and for render
+	// those shaping the image, as it stops before loading or pushing it.
+	for _, flag := range []string{
+		"source-image", "destination", "tag-strategy", "tag-template",
+		"print-build-logs", "impure", "skip-preflight", "skip-gc-root",
+		"required-nix-version", "nix-from-flake", "nix-arg", "nix-argstr",
+		"nix-arg-expr", "nix-output", "override-input", "nix-max-jobs",
+		"nix-cores", "nix-builders", "nix-store", "nix-eval-store",
+		"build-timeout", "heartbeat-interval", "kill-grace-period",
+		"base-image", "add-layer", "chown", "entrypoint", "cmd", "env",
+		"env-file", "user", "workdir", "expose", "volume", "require-nonroot",
+		"no-git-metadata", "compression", "compression-level", "metrics-file",
+	} {
+		skaffoldBuildCmd.Flags().AddFlag(buildCmd.Flags().Lookup(flag))
+		renderCmd.Flags().AddFlag(buildCmd.Flags().Lookup(flag))
+	}
+	for _, flag := range []string{
+		"index-mediatype", "index-annotation", "index-artifact-type",
+		"skip-daemon-check", "split-jobs", "use-existing", "skip-unchanged",
+		"skip-missing-platforms", "load-timeout", "load-retries",
+		"keep-platform-images", "keep-on-failure", "push-jobs", "serialize-push",
+		"also-push", "mirror-best-effort", "mount-from", "estargz", "latest",
+		"push-by-digest", "if-not-exists", "fail-if-exists", "ecr-create-repo",
+		"ecr-repo-tag", "ecr-immutable-tags", "attach", "smoke-test",
+		"smoke-test-k8s", "smoke-test-timeout",
+	} {
+		skaffoldBuildCmd.Flags().AddFlag(buildCmd.Flags().Lookup(flag))
+	}
+}
+
+// resolveBuildNixClient returns the nix client a build runs with.
+func resolveBuildNixClient(
+	ctx context.Context,
+	heartbeat time.Duration,
+) (*nixcontainers.NixClient, error) {
+	nix, err := nixcontainers.ResolveNixClient(
+		ctx,
+		getNixFromFlake(),
+		getRequiredNixVersion(),
+		append(
+			nixFeatureOptions(),
+			nixcontainers.WithNixBuildTimeout(getBuildTimeout()),
+			nixcontainers.WithNixKillGracePeriod(getKillGracePeriod()),
+			nixcontainers.WithNixHeartbeatInterval(heartbeat),
+		)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve nix: %w", err)
+	}
+	return nix, nil
+}
+
+// buildRun selects how runBuild runs the builds it configures.
+type buildRun struct {
+	// skaffold takes the PLATFORMS Skaffold passes as the platforms of the
+	// target cluster.
+	skaffold bool
+	// platform is built instead of PLATFORMS.
+	platform *v1.Platform
+	// render receives the config and manifest of the single image as JSON
+	// instead of the image being loaded or pushed.
+	render io.Writer
+	// renderExisting renders this image instead of building one.
+	renderExisting name.Reference
+}
+
+// runBuild reads the shared build configuration, so that the root, Skaffold
+// and render commands construct the same options, and builds every image one
+// after the other, sharing the nix evaluation cache. It returns the built
+// images.
+func runBuild(
+	ctx context.Context,
+	buildContext string,
+	run buildRun,
+) (_ []name.Reference, err error) {
+	start := time.Now()
+	var results []nixcontainers.BuildResult
+	// Registered first to run last, once err is classified.
+	defer func() {
+		report := newMetricsReport(results, time.Since(start), err)
+		report.logSummary(ctx)
+		path := getMetricsFile()
+		if path == "" {
+			return
+		}
+		if werr := writeMetricsReport(ctx, path, report); werr != nil {
+			if err == nil {
+				err = werr
+			} else {
+				slog.WarnContext(ctx, "write metrics report failed", "err", werr)
+			}
+		}
+	}()
+	// Failures before the first build are in the configuration, unless a
+	// step classified them already.
+	building := false
+	defer func() {
+		if !building {
+			err = nixcontainers.ClassifyError(nixcontainers.ConfigErrorClass, err)
+		}
+	}()
+	flakeDir, err := getFlakeDir()
+	if err != nil {
+		return nil, err
+	}
+	buildContext, err = applyFlakeDir(buildContext, flakeDir)
+	if err != nil {
+		return nil, err
+	}
+	buildContext, err = resolveBuildContext(buildContext)
+	if err != nil {
+		return nil, err
+	}
+	images, err := getBuildImages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image: %w", err)
+	}
+	pushImage := getPushImage()
+	heartbeat, err := getHeartbeatInterval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nix, plats, err := buildPlatforms(ctx, run, buildContext, images, pushImage, heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getExistingPlatformImages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing platform images: %w", err)
+	}
+	if len(images) > 1 && len(existing) > 0 {
+		return nil, fmt.Errorf("--use-existing requires a single image, not IMAGES")
+	}
+	if len(images) > 1 && getOutputOCI() != "" {
+		return nil, fmt.Errorf("--output-oci holds a single image, not IMAGES")
+	}
+	tagTemplate, err := getTagTemplate()
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(
+		ctx,
+		"build config",
+		"build_context", buildContext,
+		"skip_unchanged", getSkipUnchanged(),
+		"skip_missing_platforms", getSkipMissingPlatforms(),
+		"skip_preflight", getSkipPreflight(),
+		"use_existing", existing,
+		"metrics_file", getMetricsFile(),
+		"debug", getDebug(),
+	)
+	opts := []nixcontainers.BuildOption{
+		nixcontainers.WithSkipPreflight(getSkipPreflight()),
+		nixcontainers.WithSkipUnchanged(getSkipUnchanged()),
+		nixcontainers.WithSkipMissingPlatforms(getSkipMissingPlatforms()),
+	}
+	for _, ex := range existing {
+		opts = append(opts, nixcontainers.WithExistingPlatformImage(ex.Platform, ex.Ref))
+	}
+	var containerOpts []nixcontainers.ContainerOption
+	push, pushOpts, pushContainerOpts, err := pushOptions(
+		ctx,
+		images,
+		pushImage,
+		run.renderExisting,
+	)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, pushOpts...)
+	containerOpts = append(containerOpts, pushContainerOpts...)
+	defer func() {
+		if nixcontainers.ErrorClassOf(err) == nixcontainers.AuthErrorClass {
+			slog.ErrorContext(
+				ctx,
+				"registry rejected the credentials",
+				"auth_source",
+				push.auth.source,
+			)
+		}
+	}()
+	imageOpts, imageContainerOpts, err := imageOptions(ctx, buildContext, plats)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, imageOpts...)
+	containerOpts = append(containerOpts, imageContainerOpts...)
+	nixOpts, nixContainerOpts, err := nixOptions(ctx, buildContext, images, plats, existing)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, nixOpts...)
+	containerOpts = append(containerOpts, nixContainerOpts...)
+	// Rendering an existing image needs nix only for the tags of the flake.
+	if nix == nil && (run.renderExisting == nil || tagTemplate != nil) {
+		nix, err = resolveBuildNixClient(ctx, heartbeat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	images, err = buildTags(ctx, nix, buildContext, images, tagTemplate, push.latestTag)
+	if err != nil {
+		return nil, err
+	}
+	runtimeOpts, runtimeContainerOpts, err := runtimeOptions(ctx, heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, runtimeOpts...)
+	containerOpts = append(containerOpts, runtimeContainerOpts...)
+	container, err := newConfiguredContainerClient(ctx, containerOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+	if err := container.CheckBaseImage(ctx, plats); err != nil {
+		return nil, err
+	}
+	if run.render != nil {
+		building = true
+		opts = append(
+			opts,
+			nixcontainers.WithNixClient(nix),
+			nixcontainers.WithContainerClient(container),
+		)
+		return nil, renderBuild(ctx, run, container, buildContext, images, plats, opts...)
+	}
+	smokeTestLocal := getSmokeTest() != "" && !getSmokeTestK8s()
+	if !getSkipDaemonCheck() && !getSkipPreflight() &&
+		requiresRuntime(len(plats), getLoadImage(), getKeepPlatformImages(), smokeTestLocal) {
+		if err := checkRuntime(ctx, container); err != nil {
+			return nil, nixcontainers.ClassifyError(nixcontainers.LoadErrorClass, err)
+		}
+	}
+	smokeTestOpts, err := smokeTestOptions(ctx, container, plats, pushImage)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, smokeTestOpts...)
+	if showImageSummaryTable(ctx) {
+		opts = append(opts, nixcontainers.WithImageSummaryOutput(os.Stderr))
+	}
+	opts = append(
+		opts,
+		nixcontainers.WithNixClient(nix),
+		nixcontainers.WithContainerClient(container),
+	)
+	built := make([]name.Reference, 0, len(images))
+	building = true
+	for _, image := range images {
+		var result nixcontainers.BuildResult
+		result, err = nixcontainers.Build(ctx, nixcontainers.BuildRequest{
+			Context:   buildContext,
+			Reference: image.destination,
+			Source:    image.source,
+			Package:   image.pkg,
+			Platforms: plats,
+		}, opts...)
+		results = append(results, result)
+		if err != nil && len(images) > 1 {
+			err = fmt.Errorf("build image %s failed: %w", image.destination, err)
+		}
+		if err != nil {
+			break
+		}
+		if len(push.attachments) > 0 && !result.Existing {
+			subject := image.destination.Context().Digest(result.Digest.String())
+			if err = attachBuildArtifacts(ctx, container, subject, push.attachments); err != nil {
+				break
+			}
+		}
+		// An existing tag is reported with the digest it was found at.
+		if !push.byDigest && !result.Existing {
+			built = append(built, image.destination)
+			continue
+		}
+		var pushed name.Digest
+		pushed, err = name.NewDigest(image.destination.String() + "@" + result.Digest.String())
+		if err != nil {
+			err = fmt.Errorf("format digest reference of %s failed: %w", image.destination, err)
+			break
+		}
+		built = append(built, pushed)
+	}
+	container.LogPushSummary(ctx)
+	return built, err
+}
+
+// buildPlatforms returns the platforms images are built for: the platform of
+// run, every linux system the flake exposes the images for with
+// PLATFORMS=all, or PLATFORMS, which Skaffold narrows to those of the target
+// cluster. It also returns the nix client it evaluated the flake with, if any.
+func buildPlatforms(
+	ctx context.Context,
+	run buildRun,
+	buildContext string,
+	images []buildImage,
+	pushImage bool,
+	heartbeat time.Duration,
+) (*nixcontainers.NixClient, []*v1.Platform, error) {
+	var showOpts []nixcontainers.ImageOption
+	if getAcceptFlakeConfig() {
+		showOpts = append(showOpts, nixcontainers.WithAcceptFlakeConfig())
+	}
+	if getNoPureEval() {
+		showOpts = append(showOpts, nixcontainers.WithNoPureEval())
+	}
+	if getRefresh() {
+		showOpts = append(showOpts, nixcontainers.WithRefresh())
+	}
+	var nix *nixcontainers.NixClient
+	var plats []*v1.Platform
+	var err error
+	if run.platform != nil {
+		plats = []*v1.Platform{run.platform}
+	} else if getAllPlatforms() {
+		nix, err = resolveBuildNixClient(ctx, heartbeat)
+		if err != nil {
+			return nil, nil, err
+		}
+		plats, err = resolveFlakePlatforms(ctx, nix, buildContext, images, showOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve platforms: %w", err)
+		}
+	} else {
+		if run.skaffold {
+			warnEmptySkaffoldPlatforms(ctx)
+		}
+		plats, err = getPlatforms()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get platforms: %w", err)
+		}
+		if run.skaffold && len(plats) > 1 {
+			nix, err = resolveBuildNixClient(ctx, heartbeat)
+			if err != nil {
+				return nil, nil, err
+			}
+			plats, err = skaffoldPlatforms(ctx, nix, buildContext, images, plats, showOpts...)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to resolve platforms: %w", err)
+			}
+		}
+	}
+	if run.skaffold && len(plats) > 1 && !pushImage && !getLoadImage() && getOutputOCI() == "" {
+		plats = skaffoldLocalPlatforms(ctx, plats)
+	}
+	slog.InfoContext(
+		ctx,
+		"platform config",
+		"platforms", plats,
+		"all_platforms", getAllPlatforms(),
+		"skaffold", run.skaffold,
+	)
+	return nix, plats, nil
+}
+
+// buildTags tags the images given without a tag by tagTemplate, nil to keep
+// them as given, from the flake metadata nix reads, and checks that none of
+// them is tagged as latestTag already.
+func buildTags(
+	ctx context.Context,
+	nix *nixcontainers.NixClient,
+	buildContext string,
+	images []buildImage,
+	tagTemplate *template.Template,
+	latestTag string,
+) ([]buildImage, error) {
+	if tagTemplate != nil {
+		var metadataOpts []nixcontainers.ImageOption
+		if getNoPureEval() {
+			metadataOpts = append(metadataOpts, nixcontainers.WithNoPureEval())
+		}
+		if getRefresh() {
+			metadataOpts = append(metadataOpts, nixcontainers.WithRefresh())
+		}
+		metadata := newFlakeMetadataProvider(nix, metadataOpts...)
+		var err error
+		images, err = resolveImageTags(
+			ctx,
+			images,
+			tagTemplate,
+			newTagSource(buildContext, metadata.Get, time.Now()),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, image := range images {
+		if latestTag != "" && image.destination.TagStr() == latestTag {
+			return nil, fmt.Errorf(
+				"--latest cannot retag %s, it is already tagged as %s",
+				image.destination,
+				latestTag,
+			)
+		}
+	}
+	slog.InfoContext(
+		ctx,
+		"tag config",
+		"images", formatBuildImages(images),
+		"tag_strategy", viper.GetString("tag_strategy"),
+	)
+	return images, nil
+}
+
+// buildPush holds the push settings runBuild needs past its options.
+type buildPush struct {
+	// auth is logged again when a registry rejects its credentials.
+	auth registryAuth
+	// latestTag must not be the tag of an image.
+	latestTag string
+	// byDigest reports the images by the digest they were pushed at.
+	byDigest bool
+	// attachments are attached to every image built.
+	attachments []nixcontainers.Attachment
+}
+
+// pushOptions reads the registry and push configuration of images. The
+// registry of renderExisting, when set, is authenticated too.
+func pushOptions(
+	ctx context.Context,
+	images []buildImage,
+	pushImage bool,
+	renderExisting name.Reference,
+) (buildPush, []nixcontainers.BuildOption, []nixcontainers.ContainerOption, error) {
+	pushJobs, err := getPushJobs()
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	registryTransport, err := getRegistryTransport()
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	mirrors, err := getMirrors()
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	if len(mirrors) > 0 && !pushImage {
+		return buildPush{}, nil, nil, fmt.Errorf("--also-push requires --push")
+	}
+	if len(mirrors) > 0 && len(images) > 1 {
+		return buildPush{}, nil, nil, fmt.Errorf("--also-push requires a single image, not IMAGES")
+	}
+	ecrRepository, err := getECRRepository(images, pushImage)
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	attachments, err := getBuildAttachments(pushImage)
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	registries := destinationRegistries(images, mirrors)
+	if renderExisting != nil {
+		registries = append(registries, renderExisting.Context().RegistryStr())
+	}
+	auth, err := getRegistryAuth(registries)
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	mountFrom, err := getMountFrom()
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	if mountFrom != nil && !pushImage {
+		return buildPush{}, nil, nil, fmt.Errorf("--mount-from requires --push")
+	}
+	latestTag, err := getLatestTag()
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	comp, compLevel, err := getCompression()
+	if err != nil {
+		return buildPush{}, nil, nil, err
+	}
+	if latestTag != "" && !pushImage {
+		return buildPush{}, nil, nil, fmt.Errorf("--latest requires --push")
+	}
+	estargz := getEstargz()
+	if estargz && !pushImage {
+		return buildPush{}, nil, nil, fmt.Errorf("--estargz requires --push")
+	}
+	pushByDigest := getPushByDigest()
+	if pushByDigest {
+		if err := checkPushByDigest(images, pushImage, latestTag); err != nil {
+			return buildPush{}, nil, nil, err
+		}
+	}
+	ifNotExists, failIfExists := getIfNotExists(), getFailIfExists()
+	if ifNotExists || failIfExists {
+		if err := checkIfNotExists(pushImage, pushByDigest); err != nil {
+			return buildPush{}, nil, nil, err
+		}
+	}
+	if estargz && comp != compression.GZip {
+		return buildPush{}, nil, nil, fmt.Errorf(
+			"--estargz requires gzip compression, not %s",
+			comp,
+		)
+	}
+	slog.InfoContext(
+		ctx,
+		"push config",
+		"push", pushImage,
+		"push_timeout", getPushTimeout(),
+		"push_jobs", pushJobs,
+		"serialize_push", getSerializePush(),
+		"registry_timeout", registryTransport.Timeout,
+		"registry_retry_count", registryTransport.RetryCount,
+		"registry_retry_backoff", registryTransport.RetryBackoff,
+		"also_push", mirrors,
+		"mirror_best_effort", getMirrorBestEffort(),
+		"auth_source", auth.source,
+		"ecr_create_repo", ecrRepository != nil,
+		"attach", len(attachments),
+		"mount_from", viper.GetString("mount_from"),
+		"latest", latestTag,
+		"compression", comp,
+		"compression_level", compLevel,
+		"estargz", estargz,
+		"push_by_digest", pushByDigest,
+		"if_not_exists", ifNotExists,
+		"fail_if_exists", failIfExists,
+	)
+	opts := []nixcontainers.BuildOption{
+		nixcontainers.WithPush(pushImage),
+		nixcontainers.WithPushByDigest(pushByDigest),
+		nixcontainers.WithIfNotExists(ifNotExists),
+		nixcontainers.WithFailIfExists(failIfExists),
+	}
+	containerOpts := []nixcontainers.ContainerOption{
+		nixcontainers.WithContainerKeychain(auth.keychain),
+		nixcontainers.WithContainerPushTimeout(getPushTimeout()),
+		nixcontainers.WithContainerPushJobs(pushJobs),
+		nixcontainers.WithContainerSerializePush(getSerializePush()),
+		nixcontainers.WithContainerMirrors(mirrors...),
+		nixcontainers.WithContainerMirrorBestEffort(getMirrorBestEffort()),
+		nixcontainers.WithContainerLatestTag(latestTag),
+		nixcontainers.WithContainerCompression(comp, compLevel),
+		nixcontainers.WithContainerEstargz(estargz),
+		nixcontainers.WithContainerPushByDigest(pushByDigest),
+	}
+	if mountFrom != nil {
+		containerOpts = append(containerOpts, nixcontainers.WithContainerMountFrom(*mountFrom))
+	}
+	if ecrRepository != nil {
+		containerOpts = append(
+			containerOpts,
+			nixcontainers.WithContainerECRCreateRepository(*ecrRepository),
+		)
+	}
+	// The default settings keep the go-containerregistry transport as is.
+	if registryTransport != nixcontainers.DefaultRegistryTransport() {
+		containerOpts = append(
+			containerOpts,
+			nixcontainers.WithContainerRegistryTransport(registryTransport),
+		)
+	}
+	return buildPush{
+		auth:        auth,
+		latestTag:   latestTag,
+		byDigest:    pushByDigest,
+		attachments: attachments,
+	}, opts, containerOpts, nil
+}
+
+// imageOptions reads what is added to the images nix builds: the index of
+// the platforms, the base image, extra layers, config and git metadata.
+func imageOptions(
+	ctx context.Context,
+	buildContext string,
+	plats []*v1.Platform,
+) ([]nixcontainers.BuildOption, []nixcontainers.ContainerOption, error) {
+	indexMediaType, err := getIndexMediaType()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get index media type: %w", err)
+	}
+	indexAnnotations, err := getIndexAnnotations()
+	if err != nil {
+		return nil, nil, err
+	}
+	indexArtifactType, err := getIndexArtifactType(indexMediaType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (len(indexAnnotations) > 0 || indexArtifactType != "") && len(plats) == 1 {
+		slog.WarnContext(
+			ctx,
+			"index annotations and artifact type only apply to multi-platform builds",
+			"platforms",
+			plats,
+		)
+	}
+	baseImage, err := getBaseImage()
+	if err != nil {
+		return nil, nil, err
+	}
+	extraLayers, err := getExtraLayers()
+	if err != nil {
+		return nil, nil, err
+	}
+	imageConfig, err := getImageConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	var gitAnnotations map[string]string
+	if !getNoGitMetadata() {
+		gitAnnotations = readGitMetadata(ctx, buildContext).annotations()
+		imageConfig.Labels = gitAnnotations
+	}
+	slog.InfoContext(
+		ctx,
+		"image config",
+		"index_mediatype", indexMediaType,
+		"index_annotations", indexAnnotations,
+		"index_artifact_type", indexArtifactType,
+		"base_image", viper.GetString("base_image"),
+		"add_layers", extraLayers,
+		"entrypoint", imageConfig.Entrypoint,
+		"cmd", imageConfig.Cmd,
+		"env_file", viper.GetString("env_file"),
+		"env_vars", len(imageConfig.Env),
+		"user", imageConfig.User,
+		"workdir", imageConfig.WorkingDir,
+		"expose", imageConfig.ExposedPorts,
+		"volumes", imageConfig.Volumes,
+		"require_nonroot", imageConfig.RequireNonRoot,
+		"git_metadata", gitAnnotations,
+	)
+	var opts []nixcontainers.BuildOption
+	containerOpts := []nixcontainers.ContainerOption{
+		nixcontainers.WithContainerIndexMediaType(indexMediaType),
+		nixcontainers.WithContainerIndexAnnotations(indexAnnotations),
+		nixcontainers.WithContainerIndexArtifactType(indexArtifactType),
+	}
+	if baseImage != nil {
+		containerOpts = append(containerOpts, nixcontainers.WithContainerBaseImage(baseImage))
+		opts = append(opts, nixcontainers.WithBaseImage(baseImage))
+	}
+	if len(extraLayers) > 0 {
+		containerOpts = append(containerOpts, nixcontainers.WithContainerExtraLayers(extraLayers))
+		opts = append(opts, nixcontainers.WithExtraLayers(extraLayers))
+	}
+	if len(gitAnnotations) > 0 {
+		containerOpts = append(
+			containerOpts,
+			nixcontainers.WithContainerAnnotations(gitAnnotations),
+		)
+	}
+	if !imageConfig.AsBuilt() {
+		containerOpts = append(containerOpts, nixcontainers.WithContainerImageConfig(imageConfig))
+		opts = append(opts, nixcontainers.WithImageConfig(imageConfig))
+	}
+	return opts, containerOpts, nil
+}
+
+// nixOptions reads the arguments of the nix commands building images for
+// plats, of which the existing platform images are not built.
+func nixOptions(
+	ctx context.Context,
+	buildContext string,
+	images []buildImage,
+	plats []*v1.Platform,
+	existing []nixcontainers.ExistingPlatformImage,
+) ([]nixcontainers.BuildOption, []nixcontainers.ContainerOption, error) {
+	nixArgs, err := getNixBuildArgs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get nix build args: %w", err)
+	}
+	overrides, err := getOverrideInputs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get input overrides: %w", err)
+	}
+	autoArgs, err := getNixAutoArgs()
+	if err != nil {
+		return nil, nil, err
+	}
+	nixOutput, err := getNixOutput()
+	if err != nil {
+		return nil, nil, err
+	}
+	maxJobs, err := getNixMaxJobs()
+	if err != nil {
+		return nil, nil, err
+	}
+	cores, err := getNixCores()
+	if err != nil {
+		return nil, nil, err
+	}
+	if getSplitJobs() {
+		// Every platform that is not reused is built concurrently.
+		maxJobs = splitMaxJobs(maxJobs, len(plats)-len(existing))
+	}
+	builders := getNixBuilders()
+	store, err := getNixStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	evalStore := getNixEvalStore()
+	slog.InfoContext(
+		ctx,
+		"nix config",
+		"accept_flake_config", getAcceptFlakeConfig(),
+		"no_pure_eval", getNoPureEval(),
+		"impure", getImpure(),
+		"refresh", getRefresh(),
+		"print_build_logs", getPrintBuildLogs(),
+		"auto_experimental_features", getAutoExperimentalFeatures(),
+		"skip_gc_root", getSkipGCRoot(),
+		"build_timeout", getBuildTimeout(),
+		"nix_args", nixArgs,
+		"override_inputs", overrides,
+		"nix_auto_args", nixAutoArgNames(autoArgs),
+		"nix_output", nixOutput.String(),
+		"nix_max_jobs", maxJobs,
+		"nix_cores", cores,
+		"nix_builders", builders,
+		"nix_store", store,
+		"nix_eval_store", evalStore,
+	)
+	var imageOpts []nixcontainers.ImageOption
+	if getAcceptFlakeConfig() {
+		imageOpts = append(imageOpts, nixcontainers.WithAcceptFlakeConfig())
+	}
+	if getNoPureEval() {
+		imageOpts = append(imageOpts, nixcontainers.WithNoPureEval())
+	}
+	if getImpure() {
+		slog.WarnContext(
+			ctx,
+			"impure nix build enabled, reproducibility guarantees are weakened",
+			"images",
+			formatBuildImages(images),
+		)
+		imageOpts = append(imageOpts, nixcontainers.WithImpure())
+	}
+	if getRefresh() {
+		imageOpts = append(imageOpts, nixcontainers.WithRefresh())
+	} else if isMutableFlakeRef(buildContext) {
+		slog.InfoContext(
+			ctx,
+			"build context is a mutable remote flake ref and may be served from cache, "+
+				"pass --refresh or pin it to a rev",
+			"build_context",
+			buildContext,
+		)
+	}
+	if getPrintBuildLogs() {
+		imageOpts = append(imageOpts, nixcontainers.WithPrintBuildLogs())
+	}
+	if maxJobs != "" {
+		imageOpts = append(imageOpts, nixcontainers.WithMaxJobs(maxJobs))
+	}
+	if cores != "" {
+		imageOpts = append(imageOpts, nixcontainers.WithCores(cores))
+	}
+	if builders != "" {
+		imageOpts = append(imageOpts, nixcontainers.WithBuilders(builders))
+	}
+	if store != "" {
+		imageOpts = append(imageOpts, nixcontainers.WithStore(store))
+	}
+	if evalStore != "" {
+		imageOpts = append(imageOpts, nixcontainers.WithEvalStore(evalStore))
+	}
+	nixcontainers.WarnEmulatedBuilds(ctx, plats, builders)
+	if len(overrides) > 0 {
+		imageOpts = append(imageOpts, nixcontainers.WithOverrideInputs(overrides...))
+	}
+	if len(autoArgs) > 0 {
+		imageOpts = append(imageOpts, nixcontainers.WithNixArgs(autoArgs...))
+	}
+	if nixOutput != (nixcontainers.NixOutput{}) {
+		imageOpts = append(imageOpts, nixcontainers.WithNixOutput(nixOutput))
+	}
+	if len(nixArgs) > 0 {
+		imageOpts = append(imageOpts, nixcontainers.WithExtraArgs(nixArgs...))
+	}
+	opts := []nixcontainers.BuildOption{nixcontainers.WithSkipGCRoot(getSkipGCRoot())}
+	for _, o := range imageOpts {
+		opts = append(opts, nixcontainers.WithStreamImageOption(o))
+	}
+	return opts, []nixcontainers.ContainerOption{nixcontainers.WithContainerNixStore(store)}, nil
+}
+
+// runtimeOptions reads where images are loaded or written and how the
+// commands doing so are run.
+func runtimeOptions(
+	ctx context.Context,
+	heartbeat time.Duration,
+) ([]nixcontainers.BuildOption, []nixcontainers.ContainerOption, error) {
+	runtime, err := getContainerRuntime()
+	if err != nil {
+		return nil, nil, err
+	}
+	loadRetries, err := getLoadRetries()
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.InfoContext(
+		ctx,
+		"runtime config",
+		"runtime", runtime,
+		"docker_host", getDockerHost(),
+		"containerd_address", getContainerdAddress(),
+		"containerd_namespace", getContainerdNamespace(),
+		"skip_daemon_check", getSkipDaemonCheck(),
+		"load", getLoadImage(),
+		"output_oci", getOutputOCI(),
+		"kind_cluster", getKindCluster(),
+		"minikube", getMinikube(),
+		"load_timeout", getLoadTimeout(),
+		"load_retries", loadRetries,
+		"keep_platform_images", getKeepPlatformImages(),
+		"keep_on_failure", getKeepOnFailure(),
+		"kill_grace_period", getKillGracePeriod(),
+		"heartbeat_interval", heartbeat,
+	)
+	opts := []nixcontainers.BuildOption{
+		nixcontainers.WithLoad(getLoadImage()),
+		nixcontainers.WithOutputOCI(getOutputOCI()),
+		nixcontainers.WithKindCluster(getKindCluster()),
+		nixcontainers.WithKeepPlatformImages(getKeepPlatformImages()),
+		nixcontainers.WithKeepOnFailure(getKeepOnFailure()),
+	}
+	containerOpts := []nixcontainers.ContainerOption{
+		nixcontainers.WithContainerLoadTimeout(getLoadTimeout()),
+		nixcontainers.WithContainerLoadRetries(loadRetries),
+		nixcontainers.WithContainerKillGracePeriod(getKillGracePeriod()),
+		nixcontainers.WithContainerHeartbeatInterval(heartbeat),
+	}
+	if showTerminalProgress(ctx) {
+		containerOpts = append(containerOpts, nixcontainers.WithContainerProgressOutput(os.Stderr))
+	}
+	if profile := getMinikube(); profile != "" {
+		minikubeOpts, err := minikubeContainerOptions(ctx, profile)
+		if err != nil {
+			return nil, nil, err
+		}
+		containerOpts = append(containerOpts, minikubeOpts...)
+	}
+	return opts, containerOpts, nil
+}
+
+// smokeTestOptions reads the smoke test run on the images of plats, locally
+// with container or, with --smoke-test-k8s, in the cluster they are pushed
+// for.
+func smokeTestOptions(
+	ctx context.Context,
+	container *nixcontainers.ContainerClient,
+	plats []*v1.Platform,
+	pushImage bool,
+) ([]nixcontainers.BuildOption, error) {
+	command := getSmokeTest()
+	if command == "" {
+		return nil, nil
+	}
+	args, err := parseSmokeTestCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	var tester nixcontainers.SmokeTester = container
+	if !getSmokeTestK8s() && len(plats) > 1 && pushImage &&
+		!getLoadImage() && !getKeepPlatformImages() {
+		return nil, fmt.Errorf(
+			"--smoke-test of a multi-platform push requires --load or --smoke-test-k8s",
+		)
+	}
+	if getSmokeTestK8s() {
+		if !pushImage {
+			return nil, fmt.Errorf("--smoke-test-k8s requires --push")
+		}
+		tester = nixcontainers.NewKubeSmokeTester(getKillGracePeriod())
+	}
+	slog.InfoContext(
+		ctx,
+		"smoke test config",
+		"smoke_test", command,
+		"smoke_test_k8s", getSmokeTestK8s(),
+		"smoke_test_timeout", getSmokeTestTimeout(),
+	)
+	return []nixcontainers.BuildOption{
+		nixcontainers.WithSmokeTest(tester, args, getSmokeTestTimeout()),
+	}, nil
+}
+
+// formatBuildImages lists each image as its destination, preceded by the
+// source image it is built from when they differ.
+func formatBuildImages(images []buildImage) []string {
+	out := make([]string, 0, len(images))
+	for _, image := range images {
+		if image.source.Name() == image.destination.Name() {
+			out = append(out, image.destination.String())
+			continue
+		}
+		out = append(out, image.source.String()+" -> "+image.destination.String())
+	}
+	return out
+}
+
+// newConfiguredContainerClient creates the container client for the
+// configured runtime, with opts applied on top.
+func newConfiguredContainerClient(
+	ctx context.Context,
+	opts ...nixcontainers.ContainerOption,
+) (*nixcontainers.ContainerClient, error) {
+	runtime, err := getContainerRuntime()
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]nixcontainers.ContainerOption{
+		nixcontainers.WithContainerRuntime(runtime),
+		nixcontainers.WithContainerDockerHost(getDockerHost()),
+		nixcontainers.WithContainerdAddress(getContainerdAddress()),
+		nixcontainers.WithContainerdNamespace(getContainerdNamespace()),
+	}, opts...)
+	return nixcontainers.NewContainerClient(ctx, opts...)
+}
+
+// minikubeContainerOptions loads images into the container runtime of the
+// minikube profile: its Docker daemon through its docker-env, or the
+// minikube image commands for containerd and cri-o, which load the image on
+// every node.
+func minikubeContainerOptions(
+	ctx context.Context,
+	profile string,
+) ([]nixcontainers.ContainerOption, error) {
+	if getDockerHost() != "" {
+		return nil, nixcontainers.ClassifyError(
+			nixcontainers.ConfigErrorClass,
+			fmt.Errorf("--minikube cannot be combined with --docker-host"),
+		)
+	}
+	minikube := nixcontainers.NewMinikube(profile, getKillGracePeriod())
+	runtime, err := minikube.ContainerRuntime(ctx)
+	if err != nil {
+		return nil, nixcontainers.ClassifyError(nixcontainers.ConfigErrorClass, err)
+	}
+	slog.InfoContext(ctx, "minikube profile", "profile", profile, "container_runtime", runtime)
+	if runtime != nixcontainers.ContainerRuntimeDocker {
+		return []nixcontainers.ContainerOption{
+			nixcontainers.WithContainerRuntimeBackend(minikube.ImageRuntime()),
+		}, nil
+	}
+	env, err := minikube.DockerEnv(ctx)
+	if err != nil {
+		return nil, nixcontainers.ClassifyError(nixcontainers.ConfigErrorClass, err)
+	}
+	return []nixcontainers.ContainerOption{
+		nixcontainers.WithContainerRuntime(nixcontainers.ContainerRuntimeDocker),
+		nixcontainers.WithContainerDockerHost(env.Host),
+		nixcontainers.WithContainerDockerCertPath(env.CertPath),
+	}, nil
+}
+
+// runtimeCheckTimeout bounds the container runtime preflight.
+const runtimeCheckTimeout = 5 * time.Second
+
+// requiresRuntime reports whether a build of n platforms loads images into
+// the container runtime. Multi-platform images are pushed or written from
+// their archives and only need it to be loaded or smoke tested locally.
+func requiresRuntime(n int, load, keepPlatformImages, smokeTestLocal bool) bool {
+	return n == 1 || load || keepPlatformImages || smokeTestLocal
+}
+
+// checkRuntime fails fast, before any nix build starts, when the container
+// runtime images are loaded into cannot be reached.
+func checkRuntime(ctx context.Context, container *nixcontainers.ContainerClient) error {
+	ctx, cancel := context.WithTimeout(ctx, runtimeCheckTimeout)
+	defer cancel()
+	if err := container.Ping(ctx); err != nil {
+		return fmt.Errorf(
+			"container runtime is not reachable: %w; mount the docker socket, "+
+				"set DOCKER_HOST or --docker-host to a reachable daemon, or build "+
+				"several platforms with --push and without --load, which needs no daemon "+
+				"(pass --skip-daemon-check or --skip-preflight to skip this check)",
+			err,
+		)
+	}
+	return nil
+}
+
+// exitCodeInterrupted is the shell convention for a process ended by SIGINT.
+const exitCodeInterrupted = 130
+
+// exitCodeError makes the process exit with code instead of 1. Without err,
+// the command already reported the outcome and nothing is logged.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit code %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// classExitCodes are the exit codes of the classified errors, so CI can retry
+// the jobs failing on infrastructure and not those failing on the user.
+var classExitCodes = map[nixcontainers.ErrorClass]int{
+	nixcontainers.ConfigErrorClass: 2,
+	nixcontainers.EvalErrorClass:   3,
+	nixcontainers.BuildErrorClass:  4,
+	nixcontainers.LoadErrorClass:   5,
+	nixcontainers.AuthErrorClass:   6,
+	nixcontainers.PushErrorClass:   7,
+}
+
+// exitCode returns the code the process exits with for err: the one of an
+// exitCodeError, else the one of its class, else 1.
+func exitCode(err error) int {
+	var exitErr *exitCodeError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	if code, ok := classExitCodes[nixcontainers.ErrorClassOf(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// replaceLevelName names LevelTrace, which slog would print as DEBUG-4.
+func replaceLevelName(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && a.Value.Any() == nixcontainers.LevelTrace {
+		a.Value = slog.StringValue("TRACE")
+	}
+	return a
+}
+
+const (
+	// LogFormatText writes logs as logfmt-style key=value lines.
+	LogFormatText = "text"
+	// LogFormatJSON writes logs as one JSON object per line.
+	LogFormatJSON = "json"
+)
+
+func setupLogger() error {
+	logLevel, err := getLogLevel()
+	if err != nil {
+		return fmt.Errorf("get log level failed: %w", err)
+	}
+	logFormat, err := getLogFormat()
+	if err != nil {
+		return fmt.Errorf("get log format failed: %w", err)
+	}
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, logFormat, logLevel)))
+	nixcontainers.NixStderrLevel = getNixStderrLevel()
+	return nil
+}
+
+// showImageSummaryTable reports whether image size summaries are printed as
+// tables, for people reading text logs, rather than logged as records.
+func showImageSummaryTable(ctx context.Context) bool {
+	format, err := getLogFormat()
+	return err == nil && format == LogFormatText && slog.Default().Enabled(ctx, slog.LevelInfo)
+}
+
+// showTerminalProgress reports whether progress is drawn as an updating line
+// on stderr: it must be a terminal showing text logs at info level.
+func showTerminalProgress(ctx context.Context) bool {
+	format, err := getLogFormat()
+	if err != nil || format != LogFormatText || !slog.Default().Enabled(ctx, slog.LevelInfo) {
+		return false
+	}
+	return isTerminal(os.Stderr)
+}
+
+// newLogHandler returns the handler writing logs of at least level to w in
+// the given format, LogFormatText or LogFormatJSON.
+func newLogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevelName}
+	if format == LogFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func main() {
+	if err := setupLogger(); err != nil {
+		slog.Error("setup logger failed", "err", err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// Restore the default handlers so a second signal exits immediately.
+		stop()
+		slog.Warn("interrupted, cleaning up; signal again to exit immediately")
+	}()
+	// The signal goroutine reads ctx, so the traced context is a new one.
+	tracedCtx, shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		slog.Error("setup tracing failed", "err", err)
+		os.Exit(1)
+	}
+	err = rootCmd.ExecuteContext(tracedCtx)
+	shutdownTracing()
+	if err != nil {
+		var exitErr *exitCodeError
+		if !errors.As(err, &exitErr) || exitErr.err != nil {
+			slog.Error("command failed", "class", nixcontainers.ErrorClassOf(err), "err", err)
+		}
+		if ctx.Err() != nil {
+			os.Exit(exitCodeInterrupted)
+		}
+		os.Exit(exitCode(err))
+	}
 }
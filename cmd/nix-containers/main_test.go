@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func newFakeDockerClient(t testing.TB, handler http.HandlerFunc) *client.Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	docker, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+server.Listener.Addr().String()),
+		client.WithVersion("1.47"),
+	)
+	if err != nil {
+		t.Fatalf("create docker client failed: %v", err)
+	}
+	return docker
+}
+
+func TestNewLogHandlerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, LogFormatJSON, nixcontainers.LevelTrace))
+	logger.Info("build config", "image", "ghcr.io/example/app:latest", "push", true)
+	logger.Log(t.Context(), nixcontainers.LevelTrace, "loading layer", "id", "sha256:abc")
+	logger.Debug("nix build output", "nix_stderr", "building '/nix/store/app.drv'\n\"quoted\"")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 log lines, got %d: %q", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+	}
+	var trace map[string]any
+	_ = json.Unmarshal([]byte(lines[1]), &trace)
+	if trace["level"] != "TRACE" {
+		t.Fatalf("expected TRACE level name, got %v", trace["level"])
+	}
+}
+
+func TestNewLogHandlerText(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, LogFormatText, slog.LevelInfo))
+	logger.Debug("hidden")
+	logger.Info("shown", "image", "app")
+	got := buf.String()
+	if strings.Contains(got, "hidden") || !strings.Contains(got, "msg=shown image=app") {
+		t.Fatalf("unexpected text log output %q", got)
+	}
+}
+
+func TestRequiresRuntime(t *testing.T) {
+	tests := []struct {
+		name           string
+		platforms      int
+		load           bool
+		keep           bool
+		smokeTestLocal bool
+		want           bool
+	}{
+		{name: "single platform", platforms: 1, want: true},
+		{name: "multi-platform push", platforms: 2, want: false},
+		{name: "multi-platform load", platforms: 2, load: true, want: true},
+		{name: "multi-platform keep", platforms: 2, keep: true, want: true},
+		{name: "multi-platform smoke test", platforms: 2, smokeTestLocal: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := requiresRuntime(tt.platforms, tt.load, tt.keep, tt.smokeTestLocal)
+			if got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckRuntime(t *testing.T) {
+	up := newFakeDockerClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	container, err := nixcontainers.NewContainerClient(
+		context.Background(),
+		nixcontainers.WithContainerDockerClient(up),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	if err := checkRuntime(context.Background(), container); err != nil {
+		t.Fatalf("expected reachable daemon, got %v", err)
+	}
+
+	down := newFakeDockerClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, `{"message":"daemon unavailable"}`, http.StatusServiceUnavailable)
+	})
+	container, err = nixcontainers.NewContainerClient(
+		context.Background(),
+		nixcontainers.WithContainerDockerClient(down),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	err = checkRuntime(context.Background(), container)
+	if err == nil || !strings.Contains(err.Error(), "DOCKER_HOST") ||
+		!strings.Contains(err.Error(), "--skip-daemon-check") {
+		t.Fatalf("expected guidance in runtime check error, got %v", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	classified := func(class nixcontainers.ErrorClass) error {
+		return nixcontainers.ClassifyError(class, errors.New("boom"))
+	}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "unclassified", err: errors.New("boom"), want: 1},
+		{name: "config", err: classified(nixcontainers.ConfigErrorClass), want: 2},
+		{name: "nix eval", err: classified(nixcontainers.EvalErrorClass), want: 3},
+		{name: "nix build", err: classified(nixcontainers.BuildErrorClass), want: 4},
+		{name: "daemon load", err: classified(nixcontainers.LoadErrorClass), want: 5},
+		{name: "registry auth", err: classified(nixcontainers.AuthErrorClass), want: 6},
+		{name: "registry push", err: classified(nixcontainers.PushErrorClass), want: 7},
+		{
+			name: "wrapped class",
+			err:  fmt.Errorf("build image failed: %w", classified(nixcontainers.PushErrorClass)),
+			want: 7,
+		},
+		{
+			name: "explicit exit code",
+			err: &exitCodeError{
+				code: exitCodeImagesDiffer,
+				err:  classified(nixcontainers.PushErrorClass),
+			},
+			want: exitCodeImagesDiffer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Fatalf("expected exit code %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRootFlagErrorIsConfigError(t *testing.T) {
+	err := rootCmd.FlagErrorFunc()(rootCmd, errors.New("unknown flag: --nope"))
+	if got := nixcontainers.ErrorClassOf(err); got != nixcontainers.ConfigErrorClass {
+		t.Fatalf("expected class %s, got %s", nixcontainers.ConfigErrorClass, got)
+	}
+}
+
+func TestPushTimeoutFlagIsShared(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	flag := buildCmd.Flags().Lookup("push-timeout")
+	t.Cleanup(func() {
+		_ = flag.Value.Set(flag.DefValue)
+		flag.Changed = false
+	})
+	// Other tests reset viper, dropping the binding of init.
+	if err := viper.BindPFlag("push_timeout", flag); err != nil {
+		t.Fatalf("bind --push-timeout failed: %v", err)
+	}
+	if rootCmd.PersistentFlags().Lookup("push-timeout") != nil {
+		t.Fatal("expected --push-timeout not to be a flag of every command")
+	}
+
+	for i, cmd := range []*cobra.Command{skaffoldBuildCmd, promoteCmd} {
+		want := time.Duration(i+1) * time.Second
+		if err := cmd.Flags().Set("push-timeout", want.String()); err != nil {
+			t.Fatalf("set %s --push-timeout failed: %v", cmd.CommandPath(), err)
+		}
+		if got := getPushTimeout(); got != want {
+			t.Fatalf("expected the %s --push-timeout %s, got %s", cmd.CommandPath(), want, got)
+		}
+	}
+}
+
+func TestBuildFlagsAreShared(t *testing.T) {
+	for _, cmd := range []*cobra.Command{
+		evalCheckCmd, diffCmd, digestCmd, cleanCmd, doctorCmd, listPackagesCmd,
+	} {
+		if cmd.Flag("smoke-test") != nil || cmd.Flag("entrypoint") != nil {
+			t.Fatalf("expected %s not to accept the build flags", cmd.CommandPath())
+		}
+	}
+	for _, cmd := range []*cobra.Command{buildCmd, skaffoldBuildCmd} {
+		if cmd.Flag("smoke-test") == nil || cmd.Flag("entrypoint") == nil {
+			t.Fatalf("expected %s to accept the build flags", cmd.CommandPath())
+		}
+	}
+	if renderCmd.Flag("entrypoint") == nil || renderCmd.Flag("smoke-test") != nil {
+		t.Fatal("expected render to accept the flags shaping the image only")
+	}
+}
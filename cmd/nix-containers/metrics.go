@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+const (
+	metricsStatusSucceeded = "succeeded"
+	metricsStatusFailed    = "failed"
+)
+
+// metricsReport is the JSON report --metrics-file writes after a run, so CI
+// can track where build time goes. A failed run reports the phases it went
+// through, with the class of its error as the failed phase.
+type metricsReport struct {
+	Status          string         `json:"status"`
+	FailedPhase     string         `json:"failed_phase,omitempty"`
+	Error           string         `json:"error,omitempty"`
+	StderrTail      []string       `json:"stderr_tail,omitempty"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Images          []imageMetrics `json:"images"`
+}
+
+type imageMetrics struct {
+	Reference       string            `json:"reference"`
+	Digest          string            `json:"digest,omitempty"`
+	Existing        bool              `json:"existing,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Platforms       []platformMetrics `json:"platforms"`
+}
+
+type platformMetrics struct {
+	Platform              string  `json:"platform"`
+	OutPath               string  `json:"out_path,omitempty"`
+	Digest                string  `json:"digest,omitempty"`
+	Reused                bool    `json:"reused"`
+	BuildSeconds          float64 `json:"build_seconds"`
+	LoadSeconds           float64 `json:"load_seconds"`
+	PushSeconds           float64 `json:"push_seconds"`
+	UploadedBytes         int64   `json:"uploaded_bytes"`
+	SizeBytes             int64   `json:"size_bytes"`
+	UncompressedSizeBytes int64   `json:"uncompressed_size_bytes"`
+}
+
+// newMetricsReport reports the results of a run that took duration and ended
+// with err.
+func newMetricsReport(
+	results []nixcontainers.BuildResult,
+	duration time.Duration,
+	err error,
+) metricsReport {
+	report := metricsReport{
+		Status:          metricsStatusSucceeded,
+		DurationSeconds: duration.Seconds(),
+		Images:          make([]imageMetrics, 0, len(results)),
+	}
+	if err != nil {
+		report.Status = metricsStatusFailed
+		report.FailedPhase = string(nixcontainers.ErrorClassOf(err))
+		report.Error = err.Error()
+		var cmdErr *nixcontainers.CommandError
+		if errors.As(err, &cmdErr) {
+			report.StderrTail = cmdErr.Stderr
+		}
+	}
+	for _, result := range results {
+		image := imageMetrics{
+			Existing:        result.Existing,
+			DurationSeconds: result.Duration.Seconds(),
+			Platforms:       make([]platformMetrics, 0, len(result.Platforms)),
+		}
+		if result.Reference != nil {
+			image.Reference = result.Reference.Name()
+		}
+		if result.Digest != (v1.Hash{}) {
+			image.Digest = result.Digest.String()
+		}
+		for _, p := range result.Platforms {
+			platform := platformMetrics{
+				OutPath:               p.OutPath,
+				Reused:                p.Reused,
+				BuildSeconds:          p.BuildDuration.Seconds(),
+				LoadSeconds:           p.LoadDuration.Seconds(),
+				PushSeconds:           p.PushDuration.Seconds(),
+				UploadedBytes:         p.UploadedBytes,
+				SizeBytes:             p.Size,
+				UncompressedSizeBytes: p.UncompressedSize,
+			}
+			if p.Platform != nil {
+				platform.Platform = p.Platform.String()
+			}
+			if p.Digest != (v1.Hash{}) {
+				platform.Digest = p.Digest.String()
+			}
+			image.Platforms = append(image.Platforms, platform)
+		}
+		report.Images = append(report.Images, image)
+	}
+	return report
+}
+
+// logSummary logs the report as a single line for people reading the logs.
+func (r metricsReport) logSummary(ctx context.Context) {
+	var build, load, push float64
+	var uploaded int64
+	for _, image := range r.Images {
+		for _, p := range image.Platforms {
+			build += p.BuildSeconds
+			load += p.LoadSeconds
+			push += p.PushSeconds
+			uploaded += p.UploadedBytes
+		}
+	}
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second)).Round(time.Millisecond)
+	}
+	attrs := []any{
+		"status", r.Status,
+		"images", len(r.Images),
+		"duration", seconds(r.DurationSeconds),
+		"build", seconds(build),
+		"load", seconds(load),
+		"push", seconds(push),
+		"uploaded", units.BytesSize(float64(uploaded)),
+	}
+	if r.FailedPhase != "" {
+		attrs = append(attrs, "failed_phase", r.FailedPhase)
+	}
+	slog.InfoContext(ctx, "build summary", attrs...)
+}
+
+// writeMetricsReport writes report to path as JSON.
+func writeMetricsReport(ctx context.Context, path string, report metricsReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode metrics report failed: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write metrics report %s failed: %w", path, err)
+	}
+	slog.InfoContext(ctx, "metrics report written", "path", path, "status", report.Status)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+func TestMetricsReportRecordsFailedPhase(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	results := []nixcontainers.BuildResult{{
+		Reference: ref,
+		Duration:  3 * time.Second,
+		Platforms: []nixcontainers.PlatformResult{{
+			Platform:      amd64,
+			OutPath:       "/nix/store/abc-image.tar.gz",
+			BuildDuration: 2 * time.Second,
+			LoadDuration:  500 * time.Millisecond,
+			PushDuration:  time.Second,
+			UploadedBytes: 1024,
+			Size:          2048,
+		}},
+	}}
+	err := nixcontainers.ClassifyError(nixcontainers.PushErrorClass, errors.New("push failed"))
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	report := newMetricsReport(results, 4*time.Second, err)
+	if err := writeMetricsReport(context.Background(), path, report); err != nil {
+		t.Fatalf("write metrics report failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read metrics report failed: %v", err)
+	}
+	var got metricsReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode metrics report failed: %v", err)
+	}
+	if got.Status != metricsStatusFailed || got.FailedPhase != "registry_push" ||
+		got.Error != "push failed" || got.DurationSeconds != 4 {
+		t.Fatalf("unexpected run metrics %+v", got)
+	}
+	want := platformMetrics{
+		Platform:      "linux/amd64",
+		OutPath:       "/nix/store/abc-image.tar.gz",
+		BuildSeconds:  2,
+		LoadSeconds:   0.5,
+		PushSeconds:   1,
+		UploadedBytes: 1024,
+		SizeBytes:     2048,
+	}
+	if len(got.Images) != 1 || got.Images[0].Reference != ref.Name() ||
+		got.Images[0].Digest != "" || len(got.Images[0].Platforms) != 1 ||
+		got.Images[0].Platforms[0] != want {
+		t.Fatalf("unexpected image metrics %+v", got.Images)
+	}
+}
+
+func TestMetricsReportSucceeded(t *testing.T) {
+	digest := v1.Hash{Algorithm: "sha256", Hex: "0123456789abcdef"}
+	report := newMetricsReport([]nixcontainers.BuildResult{{
+		Reference: mustParseReference(t, "ghcr.io/example/app:latest"),
+		Digest:    digest,
+	}}, time.Second, nil)
+	if report.Status != metricsStatusSucceeded || report.FailedPhase != "" ||
+		report.Images[0].Digest != digest.String() {
+		t.Fatalf("unexpected metrics report %+v", report)
+	}
+}
+
+func TestMetricsReportRecordsStderrTail(t *testing.T) {
+	err := fmt.Errorf("build image failed: %w", nixcontainers.ClassifyError(
+		nixcontainers.BuildErrorClass,
+		&nixcontainers.CommandError{
+			Command: "nix build",
+			Stderr:  []string{"app> make: *** [all] Error 2"},
+			Err:     errors.New("failed to wait for command: exit status 1"),
+		},
+	))
+	report := newMetricsReport(nil, time.Second, err)
+	if want := []string{"app> make: *** [all] Error 2"}; !slices.Equal(report.StderrTail, want) {
+		t.Fatalf("expected stderr tail %q, got %q", want, report.StderrTail)
+	}
+	if report := newMetricsReport(nil, time.Second, errors.New("boom")); report.StderrTail != nil {
+		t.Fatalf("expected no stderr tail without a command error, got %q", report.StderrTail)
+	}
+}
+
+func TestMetricsReportExistingTag(t *testing.T) {
+	digest := v1.Hash{Algorithm: "sha256", Hex: "0123456789abcdef"}
+	report := newMetricsReport([]nixcontainers.BuildResult{{
+		Reference: mustParseReference(t, "ghcr.io/example/app:1.0"),
+		Digest:    digest,
+		Existing:  true,
+	}}, time.Second, nil)
+	if !report.Images[0].Existing || report.Images[0].Digest != digest.String() ||
+		len(report.Images[0].Platforms) != 0 {
+		t.Fatalf("unexpected metrics of an existing tag %+v", report.Images)
+	}
+}
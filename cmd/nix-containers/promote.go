@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote SRC_REF DST_REF...",
+	Short: "Tag an already pushed image with other references",
+	Long:  "Resolves SRC_REF, a tag or digest, in its registry and pushes the same manifest or index to every DST_REF tag without rebuilding or contacting nix or the Docker daemon. Destinations in another repository or registry receive the blobs by cross-repository mount when possible, or by copy.",
+	Example: "# Promote the image CI pushed for a commit to a release\n" +
+		"./nix-containers promote ghcr.io/you/app:sha-abc123 ghcr.io/you/app:v1.4.0 ghcr.io/you/app:stable\n\n" +
+		"# Show the digest and destinations without pushing\n" +
+		"./nix-containers promote --dry-run ghcr.io/you/app:sha-abc123 ghcr.io/you/app:stable",
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, err := name.ParseReference(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid source reference %q: %w", args[0], err)
+		}
+		dsts := make([]name.Tag, 0, len(args)-1)
+		for _, raw := range args[1:] {
+			dst, err := parseImageTag("destination image", raw)
+			if err != nil {
+				return err
+			}
+			dsts = append(dsts, dst)
+		}
+		registries := make([]string, 0, len(dsts))
+		for _, dst := range dsts {
+			registries = append(registries, dst.Context().RegistryStr())
+		}
+		auth, err := getRegistryAuth(registries)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := nixcontainers.PhaseTimeoutContext(cmd.Context(), "push", getPushTimeout())
+		defer cancel()
+		err = promoteImage(
+			ctx,
+			cmd.OutOrStdout(),
+			src,
+			dsts,
+			viper.GetBool("promote_dry_run"),
+			remote.WithAuthFromKeychain(auth.keychain),
+			remote.WithContext(ctx),
+		)
+		return nixcontainers.WrapPhaseTimeout(ctx, err)
+	},
+}
+
+func init() {
+	promoteCmd.Flags().Bool("dry-run", false, "only print the resolved digest and destinations")
+	if err := viper.BindPFlag("promote_dry_run", promoteCmd.Flags().Lookup("dry-run")); err != nil {
+		slog.Error("bind flag failed", "flag", "dry-run", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(promoteCmd)
+}
+
+// promoteImage pushes the manifest or index src resolves to as every tag of
+// dsts. Tags in the repository of src only get the manifest, while other
+// repositories are written the whole image or index so that its blobs are
+// mounted or copied first. A single pusher serves every destination, so each
+// repository is authenticated once.
+func promoteImage(
+	ctx context.Context,
+	out io.Writer,
+	src name.Reference,
+	dsts []name.Tag,
+	dryRun bool,
+	opts ...remote.Option,
+) error {
+	desc, err := remote.Get(src, opts...)
+	if err != nil {
+		return fmt.Errorf("resolve %s failed: %w", src, err)
+	}
+	resolved := src.Context().Digest(desc.Digest.String())
+	slog.InfoContext(
+		ctx,
+		"source image resolved",
+		"ref", src.Name(),
+		"digest", desc.Digest,
+		"media_type", desc.MediaType,
+	)
+	_, _ = fmt.Fprintf(out, "%s\n", resolved.Name())
+	pusher, err := remote.NewPusher(opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create registry pusher: %w", err)
+	}
+	for _, dst := range dsts {
+		if dryRun {
+			_, _ = fmt.Fprintf(out, "would promote to %s\n", dst.Name())
+			continue
+		}
+		if dst.Context() == src.Context() {
+			err = pusher.Put(ctx, dst, desc)
+		} else {
+			err = pusher.Push(ctx, dst, desc)
+		}
+		if err != nil {
+			return fmt.Errorf("promote %s to %s failed: %w", resolved, dst, err)
+		}
+		slog.InfoContext(ctx, "image promoted", "ref", dst.Name(), "digest", desc.Digest)
+		_, _ = fmt.Fprintf(out, "promoted to %s\n", dst.Name())
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func mustParseReference(t *testing.T, raw string) name.Reference {
+	t.Helper()
+
+	ref, err := name.ParseReference(raw)
+	if err != nil {
+		t.Fatalf("parse reference failed: %v", err)
+	}
+	return ref
+}
+
+func newTestRegistryRef(t *testing.T, handler http.Handler, repo string) name.Reference {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return mustParseReference(t, strings.TrimPrefix(srv.URL, "http://")+"/"+repo)
+}
+
+func assertSameDigest(t *testing.T, refs ...name.Reference) {
+	t.Helper()
+
+	var want v1.Hash
+	for i, ref := range refs {
+		desc, err := remote.Head(ref)
+		if err != nil {
+			t.Fatalf("head %s failed: %v", ref, err)
+		}
+		if i == 0 {
+			want = desc.Digest
+		} else if desc.Digest != want {
+			t.Fatalf("expected %s to have digest %s, got %s", ref, want, desc.Digest)
+		}
+	}
+}
+
+func mustParseTag(t *testing.T, raw string) name.Tag {
+	t.Helper()
+
+	tag, err := name.NewTag(raw)
+	if err != nil {
+		t.Fatalf("parse tag %s failed: %v", raw, err)
+	}
+	return tag
+}
+
+func TestPromoteImage(t *testing.T) {
+	src := newTestRegistryRef(t, registry.New(), "example/app:sha-abc123")
+	other := newTestRegistryRef(t, registry.New(), "mirror/app:stable")
+	img, err := random.Image(64, 2)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	if err := remote.Write(src, img); err != nil {
+		t.Fatalf("push source image failed: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest failed: %v", err)
+	}
+
+	release := mustParseTag(t, src.Context().Tag("v1.4.0").Name())
+	crossRepo := mustParseTag(t, src.Context().Registry.Repo("example", "other").Tag("stable").Name())
+	crossRegistry := mustParseTag(t, other.Name())
+	var out bytes.Buffer
+	err = promoteImage(
+		context.Background(),
+		&out,
+		src.Context().Digest(digest.String()),
+		[]name.Tag{release, crossRepo, crossRegistry},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	assertSameDigest(t, src, release, crossRepo, crossRegistry)
+	if got := out.String(); !strings.Contains(got, "promoted to "+crossRegistry.Name()) {
+		t.Fatalf("expected promoted destinations in output, got %q", got)
+	}
+}
+
+func TestPromoteImageIndex(t *testing.T) {
+	src := newTestRegistryRef(t, registry.New(), "example/app:sha-abc123")
+	dst := mustParseTag(t, newTestRegistryRef(t, registry.New(), "example/app:stable").Name())
+	idx, err := random.Index(64, 1, 2)
+	if err != nil {
+		t.Fatalf("create random index failed: %v", err)
+	}
+	if err := remote.WriteIndex(src, idx); err != nil {
+		t.Fatalf("push source index failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := promoteImage(context.Background(), &out, src, []name.Tag{dst}, false); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+	assertSameDigest(t, src, dst)
+}
+
+func TestPromoteImageDryRun(t *testing.T) {
+	src := newTestRegistryRef(t, registry.New(), "example/app:sha-abc123")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	if err := remote.Write(src, img); err != nil {
+		t.Fatalf("push source image failed: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("image digest failed: %v", err)
+	}
+	dst := mustParseTag(t, src.Context().Tag("stable").Name())
+
+	var out bytes.Buffer
+	if err := promoteImage(context.Background(), &out, src, []name.Tag{dst}, true); err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	want := src.Context().Digest(digest.String()).Name() + "\n" +
+		"would promote to " + dst.Name() + "\n"
+	if got := out.String(); got != want {
+		t.Fatalf("expected output %q, got %q", want, got)
+	}
+	if _, err := remote.Head(dst); err == nil {
+		t.Fatalf("expected dry run not to push %s", dst)
+	}
+}
+
+func TestPromoteImageMissingSource(t *testing.T) {
+	src := newTestRegistryRef(t, registry.New(), "example/app:missing")
+	dst := mustParseTag(t, src.Context().Tag("stable").Name())
+
+	err := promoteImage(context.Background(), &bytes.Buffer{}, src, []name.Tag{dst}, false)
+	if err == nil || !strings.Contains(err.Error(), "resolve "+src.String()) {
+		t.Fatalf("expected resolve error, got %v", err)
+	}
+}
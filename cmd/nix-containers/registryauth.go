@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/viper"
+)
+
+// credHelperPattern matches the name of a docker-credential-<name> helper.
+var credHelperPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// registryAuth is the keychain registries are authenticated with, with a
+// description of where it reads the credentials from, free of secrets.
+type registryAuth struct {
+	keychain authn.Keychain
+	source   string
+}
+
+// getRegistryAuth returns the keychain configured by --docker-config and
+// --cred-helper, the helper answering for registries only, or the default
+// keychain without either. An explicit --docker-config or DOCKER_CONFIG takes
+// precedence over ~/.docker/config.json, unlike the default keychain. Unless
+// --no-ambient-auth is set, registries it has no credentials for fall back to
+// those of the environment, such as GITHUB_TOKEN for ghcr.io.
+func getRegistryAuth(registries []string) (registryAuth, error) {
+	auth := registryAuth{keychain: authn.DefaultKeychain, source: "default keychain"}
+	if dir := viper.GetString("docker_config"); dir != "" {
+		info, err := os.Stat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return registryAuth{}, fmt.Errorf("docker config directory %s does not exist", dir)
+		}
+		if err != nil {
+			return registryAuth{}, fmt.Errorf("failed to stat docker config %s: %w", dir, err)
+		}
+		if !info.IsDir() {
+			return registryAuth{}, fmt.Errorf(
+				"docker config %s is not a directory: pass the directory of config.json",
+				dir,
+			)
+		}
+		auth = registryAuth{
+			keychain: nixcontainers.NewDockerConfigKeychain(dir),
+			source:   "docker config " + filepath.Join(dir, "config.json"),
+		}
+	}
+	auth, err := getCredHelperAuth(auth, registries)
+	if err != nil {
+		return registryAuth{}, err
+	}
+	if viper.GetBool("no_ambient_auth") {
+		return auth, nil
+	}
+	// Ambient credentials only answer for registries none is configured for.
+	var providers []nixcontainers.AmbientProvider
+	var names []string
+	if p, ok := nixcontainers.NewGitHubAmbientProvider(os.Getenv); ok {
+		providers = append(providers, p)
+		names = append(names, p.Name())
+	}
+	if len(providers) == 0 {
+		return auth, nil
+	}
+	return registryAuth{
+		keychain: nixcontainers.NewAmbientKeychain(auth.keychain, providers...),
+		source:   auth.source + ", ambient " + strings.Join(names, ", ") + " otherwise",
+	}, nil
+}
+
+// getCredHelperAuth returns auth with the --cred-helper keychain answering
+// for registries.
+func getCredHelperAuth(auth registryAuth, registries []string) (registryAuth, error) {
+	helper := viper.GetString("cred_helper")
+	if helper != "" && !credHelperPattern.MatchString(helper) {
+		return registryAuth{}, fmt.Errorf(
+			"invalid credential helper %q: expected the NAME of docker-credential-NAME",
+			helper,
+		)
+	}
+	if helper == "" || len(registries) == 0 {
+		return auth, nil
+	}
+	registries = slices.Compact(slices.Sorted(slices.Values(registries)))
+	return registryAuth{
+		keychain: nixcontainers.NewRegistryKeychain(
+			registries,
+			nixcontainers.NewCredentialHelperKeychain(helper),
+			auth.keychain,
+		),
+		source: fmt.Sprintf(
+			"credential helper docker-credential-%s for %s, %s otherwise",
+			helper,
+			strings.Join(registries, ", "),
+			auth.source,
+		),
+	}, nil
+}
+
+// destinationRegistries returns the registries the images and mirrors are
+// pushed to.
+func destinationRegistries(images []buildImage, mirrors []name.Reference) []string {
+	var registries []string
+	for _, image := range images {
+		registries = append(registries, image.destination.Context().RegistryStr())
+	}
+	for _, mirror := range mirrors {
+		registries = append(registries, mirror.Context().RegistryStr())
+	}
+	return registries
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetRegistryAuth(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(file, []byte(`{}`), 0o600); err != nil {
+		t.Fatalf("write config failed: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		dockerConfig  string
+		credHelper    string
+		githubToken   string
+		noAmbientAuth bool
+		registries    []string
+		source        string
+		err           string
+	}{
+		{name: "default", source: "default keychain"},
+		{name: "docker config", dockerConfig: dir, source: "docker config " + file},
+		{
+			name:       "credential helper",
+			credHelper: "ecr-login",
+			registries: []string{"ghcr.io", "1234.dkr.ecr.eu-west-1.amazonaws.com", "ghcr.io"},
+			source: "credential helper docker-credential-ecr-login for " +
+				"1234.dkr.ecr.eu-west-1.amazonaws.com, ghcr.io, default keychain otherwise",
+		},
+		{
+			name:        "ambient github token",
+			githubToken: "token",
+			source:      "default keychain, ambient GITHUB_TOKEN for ghcr.io otherwise",
+		},
+		{
+			name:          "no ambient auth",
+			githubToken:   "token",
+			noAmbientAuth: true,
+			source:        "default keychain",
+		},
+		{name: "helper without registries", credHelper: "pass", source: "default keychain"},
+		{
+			name:         "missing docker config",
+			dockerConfig: filepath.Join(dir, "missing"),
+			err:          "does not exist",
+		},
+		{name: "docker config file", dockerConfig: file, err: "is not a directory"},
+		{
+			name:       "invalid helper",
+			credHelper: "../pass",
+			registries: []string{"ghcr.io"},
+			err:        "invalid credential helper",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("docker_config", tt.dockerConfig)
+			viper.Set("cred_helper", tt.credHelper)
+			viper.Set("no_ambient_auth", tt.noAmbientAuth)
+			t.Setenv("GITHUB_TOKEN", tt.githubToken)
+			t.Setenv("GH_TOKEN", "")
+
+			auth, err := getRegistryAuth(tt.registries)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get registry auth failed: %v", err)
+			}
+			if auth.source != tt.source {
+				t.Fatalf("expected auth source %q, got %q", tt.source, auth.source)
+			}
+		})
+	}
+}
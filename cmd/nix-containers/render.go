@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var renderCmd = &cobra.Command{
+	Use:   "render [BUILD_CONTEXT]",
+	Short: "Print the config and manifest an image would be pushed with",
+	Long:  "Builds the image of IMAGE for a single platform and applies the same mutations as the build command (base image, extra layers, config overrides, labels and compression), then prints its config and manifest as JSON instead of loading or pushing it. With --skip-build the mutations are applied to an existing image instead of a fresh build, to review a change of flags without waiting for nix.",
+	Example: "# Review the config the pushed image will have\n" +
+		"IMAGE=ghcr.io/you/app:latest ./nix-containers render . --entrypoint /bin/app --label team=web\n\n" +
+		"# Apply the mutations to the last pushed image without building\n" +
+		"IMAGE=ghcr.io/you/app:latest ./nix-containers render . --skip-build ghcr.io/you/app:latest --user 1000",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if getDebug() {
+			slog.SetLogLoggerLevel(slog.LevelDebug)
+		}
+		run, err := getRenderRun()
+		if err != nil {
+			return nixcontainers.ClassifyError(nixcontainers.ConfigErrorClass, err)
+		}
+		run.render = cmd.OutOrStdout()
+		buildContext := getBuildContext()
+		if len(args) > 0 {
+			buildContext = args[0]
+		} else if buildContext == "" {
+			buildContext, err = os.Getwd()
+			if err != nil {
+				return fmt.Errorf("failed to get current working directory: %w", err)
+			}
+		}
+		_, err = runBuild(cmd.Context(), buildContext, run)
+		return err
+	},
+}
+
+func init() {
+	renderCmd.Flags().String("platform", "", "platform to render (default: host)")
+	if err := viper.BindPFlag("render_platform", renderCmd.Flags().Lookup("platform")); err != nil {
+		slog.Error("bind flag failed", "flag", "platform", "err", err)
+		os.Exit(1)
+	}
+	renderCmd.Flags().String(
+		"skip-build",
+		"",
+		"existing image to apply the mutations to instead of building the flake",
+	)
+	if err := viper.BindPFlag(
+		"render_skip_build",
+		renderCmd.Flags().Lookup("skip-build"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "skip-build", "err", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(renderCmd)
+}
+
+// getRenderRun returns the platform and existing image of the render flags.
+func getRenderRun() (buildRun, error) {
+	p, err := parsePlatformFlag(viper.GetString("render_platform"))
+	if err != nil {
+		return buildRun{}, err
+	}
+	run := buildRun{platform: p}
+	if v := viper.GetString("render_skip_build"); v != "" {
+		ref, err := name.ParseReference(v)
+		if err != nil {
+			return buildRun{}, fmt.Errorf("invalid --skip-build image %q: %w", v, err)
+		}
+		run.renderExisting = ref
+	}
+	return run, nil
+}
+
+// renderBuild writes the config and manifest of the single image as JSON to
+// run.render, built from buildContext or read from run.renderExisting.
+func renderBuild(
+	ctx context.Context,
+	run buildRun,
+	container *nixcontainers.ContainerClient,
+	buildContext string,
+	images []buildImage,
+	plats []*v1.Platform,
+	opts ...nixcontainers.BuildOption,
+) error {
+	if len(images) > 1 {
+		return nixcontainers.ClassifyError(
+			nixcontainers.ConfigErrorClass,
+			fmt.Errorf("render requires a single image, not IMAGES"),
+		)
+	}
+	image := images[0]
+	var rendered *nixcontainers.RenderedImage
+	var err error
+	if run.renderExisting != nil {
+		rendered, err = container.RenderExistingImage(
+			ctx,
+			run.renderExisting,
+			image.destination,
+			plats[0],
+		)
+	} else {
+		rendered, err = nixcontainers.Render(ctx, nixcontainers.BuildRequest{
+			Context:   buildContext,
+			Reference: image.destination,
+			Source:    image.source,
+			Package:   image.pkg,
+			Platforms: plats,
+		}, opts...)
+	}
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(run.render)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rendered); err != nil {
+		return fmt.Errorf("write rendered image failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/viper"
+)
+
+func TestGetRenderRun(t *testing.T) {
+	tests := []struct {
+		name         string
+		platform     string
+		skipBuild    string
+		wantPlatform string
+		wantExisting string
+		wantErr      bool
+	}{
+		{name: "defaults to the host", wantPlatform: nixcontainers.HostPlatform().String()},
+		{name: "platform", platform: "linux/arm64", wantPlatform: "linux/arm64"},
+		{
+			name:         "skip build",
+			skipBuild:    "ghcr.io/you/app:v1",
+			wantPlatform: nixcontainers.HostPlatform().String(),
+			wantExisting: "ghcr.io/you/app:v1",
+		},
+		{name: "several platforms", platform: "linux/amd64,linux/arm64", wantErr: true},
+		{name: "invalid skip build", skipBuild: "ghcr.io/you/App", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(viper.Reset)
+			viper.Set("render_platform", tt.platform)
+			viper.Set("render_skip_build", tt.skipBuild)
+
+			run, err := getRenderRun()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get render run failed: %v", err)
+			}
+			if got := run.platform.String(); got != tt.wantPlatform {
+				t.Fatalf("expected platform %s, got %s", tt.wantPlatform, got)
+			}
+			var existing string
+			if run.renderExisting != nil {
+				existing = run.renderExisting.String()
+			}
+			if existing != tt.wantExisting {
+				t.Fatalf("expected existing image %q, got %q", tt.wantExisting, existing)
+			}
+		})
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"os"
+	"slices"
+	"strings"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -17,56 +27,207 @@ var (
 	}
 
 	skaffoldBuildCmd = &cobra.Command{
-		Use:     "build",
-		Short:   "Build and optionally push images",
-		Long:    "Builds OCI images from a Nix flake and optionally pushes them to a registry. Configure via env vars: IMAGE, PLATFORMS, BUILD_CONTEXT, PUSH_IMAGE, LOG_LEVEL, ACCEPT_FLAKE_CONFIG.",
-		Example: "IMAGE=ghcr.io/you/app:latest PLATFORMS=linux/amd64 PUSH_IMAGE=true BUILD_CONTEXT=. ACCEPT_FLAKE_CONFIG=true ./nix-containers skaffold build",
+		Use:   "build",
+		Short: "Build and optionally push images",
+		Long:  "Builds OCI images from a Nix flake and optionally pushes them to a registry. IMAGES lists further space-separated images to build in the same process, each from the flake package of its name. Configure via env vars: IMAGE, IMAGES, PLATFORMS, BUILD_CONTEXT, PUSH_IMAGE, LOG_LEVEL, ACCEPT_FLAKE_CONFIG. Failed builds exit 2 on a configuration error, 3 when the flake fails to evaluate, 4 when nix fails to build, 5 when the container runtime fails to load the image, 6 when the registry rejects the credentials, 7 when a push fails, and 130 when interrupted.",
+		Example: "IMAGE=ghcr.io/you/app:latest PLATFORMS=linux/amd64 PUSH_IMAGE=true BUILD_CONTEXT=. ACCEPT_FLAKE_CONFIG=true ./nix-containers skaffold build\n\n" +
+			"# Build several images of a monorepo flake at once\n" +
+			"IMAGES='ghcr.io/you/api:latest ghcr.io/you/web:latest' PUSH_IMAGE=true BUILD_CONTEXT=. ./nix-containers skaffold build --file-output builds.json",
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			ctx := cmd.Context()
-			debug := getDebug()
-			if debug {
+			if getDebug() {
 				slog.SetLogLoggerLevel(slog.LevelDebug)
 			}
-			buildContext := getBuildContext()
-			ref, err := getImageTag()
+			ctx := cmd.Context()
+			flakeDir, err := getFlakeDir()
 			if err != nil {
-				return fmt.Errorf("failed to get image: %w", err)
+				return nixcontainers.ClassifyError(nixcontainers.ConfigErrorClass, err)
 			}
-			plats := getPlatforms()
-			pushImage := getPushImage()
-			acceptFlake := getAcceptFlakeConfig()
-			noPureEvalFlake := getNoPureEval()
-			slog.InfoContext(
-				ctx,
-				"build config",
-				"image", ref.String(),
-				"platforms", plats,
-				"build_context", buildContext,
-				"push", pushImage,
-				"accept_flake_config", acceptFlake,
-				"no_pure_eval_flake", noPureEvalFlake,
-				"debug", debug,
-			)
-			opts := []BuildOption{
-				WithPush(pushImage),
+			buildContext, err := resolveSkaffoldBuildContext(getBuildContext(), flakeDir)
+			if err != nil {
+				return nixcontainers.ClassifyError(nixcontainers.ConfigErrorClass, err)
 			}
-			if acceptFlake {
-				opts = append(opts, WithStreamImageOption(WithAcceptFlakeConfig()))
+			built, err := runBuild(ctx, buildContext, buildRun{skaffold: true})
+			if err != nil {
+				return err
+			}
+			path := viper.GetString("skaffold_file_output")
+			if path == "" {
+				return nil
 			}
-			if noPureEvalFlake {
-				opts = append(opts, WithStreamImageOption(WithNoPureEval()))
+			registries := make([]string, 0, len(built))
+			for _, ref := range built {
+				registries = append(registries, ref.Context().RegistryStr())
 			}
-			container, err := NewContainerClient(ctx)
+			auth, err := getRegistryAuth(registries)
 			if err != nil {
-				return fmt.Errorf("failed to create container client: %w", err)
+				return err
 			}
-			builder := NewBuilder(NewNixClient(), container, opts...)
-			return builder.BuildAndPush(ctx, buildContext, ref, plats)
+			return writeSkaffoldBuildOutput(
+				ctx,
+				path,
+				built,
+				getPushImage(),
+				remote.WithAuthFromKeychain(auth.keychain),
+				remote.WithContext(ctx),
+			)
 		},
 	}
 )
 
 func init() {
+	skaffoldBuildCmd.Flags().String(
+		"file-output",
+		"",
+		"write the built images with their pushed digests as JSON to this file",
+	)
+	if err := viper.BindPFlag(
+		"skaffold_file_output",
+		skaffoldBuildCmd.Flags().Lookup("file-output"),
+	); err != nil {
+		slog.Error("bind flag failed", "flag", "file-output", "err", err)
+		os.Exit(1)
+	}
 	skaffoldCmd.AddCommand(skaffoldBuildCmd)
 	rootCmd.AddCommand(skaffoldCmd)
 }
+
+// skaffoldBuildOutput is the build artifacts file of skaffold build
+// --file-output, which skaffold deploy --build-artifacts reads back.
+type skaffoldBuildOutput struct {
+	Builds []skaffoldBuildArtifact `json:"builds"`
+}
+
+type skaffoldBuildArtifact struct {
+	ImageName string `json:"imageName"`
+	Tag       string `json:"tag"`
+}
+
+// writeSkaffoldBuildOutput writes every built image to path, tagged with the
+// digest its registry resolves it to when it was pushed. Images pushed by
+// digest are written as is.
+func writeSkaffoldBuildOutput(
+	ctx context.Context,
+	path string,
+	built []name.Reference,
+	pushed bool,
+	opts ...remote.Option,
+) error {
+	out := skaffoldBuildOutput{Builds: make([]skaffoldBuildArtifact, 0, len(built))}
+	for _, ref := range built {
+		// Skaffold matches the artifact by the image as configured.
+		tag := ref.String()
+		if ref, ok := ref.(name.Digest); ok {
+			// An existing tag kept by --if-not-exists is reported with its
+			// digest, after the tag.
+			image := strings.TrimSuffix(tag, "@"+ref.DigestStr())
+			if hasExplicitTag(image) {
+				image = image[:strings.LastIndex(image, ":")]
+			}
+			out.Builds = append(out.Builds, skaffoldBuildArtifact{
+				ImageName: image,
+				Tag:       tag,
+			})
+			continue
+		}
+		if pushed {
+			desc, err := remote.Head(ref, opts...)
+			if err != nil {
+				return fmt.Errorf("resolve digest of %s failed: %w", ref, err)
+			}
+			tag += "@" + desc.Digest.String()
+		}
+		out.Builds = append(out.Builds, skaffoldBuildArtifact{
+			ImageName: strings.TrimSuffix(ref.String(), ":"+ref.Identifier()),
+			Tag:       tag,
+		})
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode build output failed: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write build output %s failed: %w", path, err)
+	}
+	slog.InfoContext(ctx, "build output written", "path", path, "images", len(built))
+	return nil
+}
+
+// warnEmptySkaffoldPlatforms warns when Skaffold set PLATFORMS to an empty
+// value, which it does when the target cluster reports no node platforms, so
+// building the host platform instead is visible.
+func warnEmptySkaffoldPlatforms(ctx context.Context) {
+	v, ok := os.LookupEnv("PLATFORMS")
+	if !ok || strings.TrimSpace(v) != "" || getPlatformsSetting() != "" {
+		return
+	}
+	slog.WarnContext(
+		ctx,
+		"skaffold passed an empty PLATFORMS, building the host platform",
+		"platform",
+		nixcontainers.HostPlatform().String(),
+	)
+}
+
+// skaffoldPlatforms returns the platforms Skaffold requested, the platforms
+// of the nodes of the target cluster, that the flake exposes every image for.
+// The others are dropped with a warning, and no platform is added.
+func skaffoldPlatforms(
+	ctx context.Context,
+	client flakePackagesClient,
+	buildContext string,
+	images []buildImage,
+	plats []*v1.Platform,
+	opts ...nixcontainers.ImageOption,
+) ([]*v1.Platform, error) {
+	supported, err := resolveFlakePlatforms(ctx, client, buildContext, images, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Platforms are matched by nix system, so linux/arm64/v8 is built as
+	// aarch64-linux like linux/arm64.
+	kept := make([]*v1.Platform, 0, len(plats))
+	for _, p := range plats {
+		system := nixcontainers.FormatSystemName(p)
+		if slices.ContainsFunc(supported, func(s *v1.Platform) bool {
+			return nixcontainers.FormatSystemName(s) == system
+		}) {
+			kept = append(kept, p)
+			continue
+		}
+		slog.WarnContext(
+			ctx,
+			"dropping skaffold platform the flake does not build",
+			"platform", p.String(),
+			"system", system,
+		)
+	}
+	if len(kept) == 0 {
+		return nil, nixcontainers.ClassifyError(
+			nixcontainers.EvalErrorClass,
+			fmt.Errorf("flake %s builds none of the platforms %v skaffold requested", buildContext, plats),
+		)
+	}
+	return kept, nil
+}
+
+// skaffoldLocalPlatforms returns the single platform a multi-platform
+// Skaffold build without push is narrowed to: the one of the host, else the
+// first. Images that are not pushed go to a local cluster, which cannot use
+// an index.
+func skaffoldLocalPlatforms(ctx context.Context, plats []*v1.Platform) []*v1.Platform {
+	host := nixcontainers.FormatSystemName(nixcontainers.HostPlatform())
+	i := slices.IndexFunc(plats, func(p *v1.Platform) bool {
+		return nixcontainers.FormatSystemName(p) == host
+	})
+	if i < 0 {
+		i = 0
+	}
+	slog.WarnContext(
+		ctx,
+		"skaffold requested several platforms without PUSH_IMAGE, building only one "+
+			"for the local cluster; set PUSH_IMAGE=true to build them all",
+		"platform", plats[i].String(),
+		"requested", plats,
+	)
+	return plats[i : i+1]
+}
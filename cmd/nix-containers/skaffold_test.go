@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+func TestWriteSkaffoldBuildOutput(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/api:1.0")
+	api := mustParseTag(t, ref.String())
+	web := mustParseTag(t, api.RegistryStr()+"/example/web:1.0")
+	digests := make(map[string]string)
+	for _, tag := range []string{api.String(), web.String()} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatalf("create random image failed: %v", err)
+		}
+		if err := remote.Write(mustParseTag(t, tag), img); err != nil {
+			t.Fatalf("push %s failed: %v", tag, err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatalf("image digest failed: %v", err)
+		}
+		digests[tag] = digest.String()
+	}
+
+	for _, pushed := range []bool{true, false} {
+		path := filepath.Join(t.TempDir(), "builds.json")
+		err := writeSkaffoldBuildOutput(
+			context.Background(),
+			path,
+			[]name.Reference{api, web},
+			pushed,
+		)
+		if err != nil {
+			t.Fatalf("write build output failed: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read build output failed: %v", err)
+		}
+		var out skaffoldBuildOutput
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("decode build output failed: %v", err)
+		}
+		if len(out.Builds) != 2 {
+			t.Fatalf("expected every image in the build output, got %+v", out.Builds)
+		}
+		for i, ref := range []name.Tag{api, web} {
+			want := skaffoldBuildArtifact{ImageName: ref.Context().String(), Tag: ref.String()}
+			if pushed {
+				want.Tag += "@" + digests[ref.String()]
+			}
+			if out.Builds[i] != want {
+				t.Fatalf("expected %+v, got %+v", want, out.Builds[i])
+			}
+		}
+	}
+}
+
+func TestWriteSkaffoldBuildOutputPushedByDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	ref, err := name.NewDigest("ghcr.io/example/api@" + digest)
+	if err != nil {
+		t.Fatalf("parse digest reference failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "builds.json")
+	// The digest is not resolved from the registry, which has no tag for it.
+	if err := writeSkaffoldBuildOutput(
+		context.Background(),
+		path,
+		[]name.Reference{ref},
+		true,
+	); err != nil {
+		t.Fatalf("write build output failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read build output failed: %v", err)
+	}
+	var out skaffoldBuildOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("decode build output failed: %v", err)
+	}
+	want := skaffoldBuildArtifact{ImageName: "ghcr.io/example/api", Tag: ref.String()}
+	if len(out.Builds) != 1 || out.Builds[0] != want {
+		t.Fatalf("expected %+v, got %+v", want, out.Builds)
+	}
+}
+
+func TestWriteSkaffoldBuildOutputExistingTag(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	ref, err := name.NewDigest("ghcr.io/example/api:1.0@" + digest)
+	if err != nil {
+		t.Fatalf("parse digest reference failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "builds.json")
+	if err := writeSkaffoldBuildOutput(
+		context.Background(),
+		path,
+		[]name.Reference{ref},
+		true,
+	); err != nil {
+		t.Fatalf("write build output failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read build output failed: %v", err)
+	}
+	var out skaffoldBuildOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("decode build output failed: %v", err)
+	}
+	want := skaffoldBuildArtifact{ImageName: "ghcr.io/example/api", Tag: ref.String()}
+	if len(out.Builds) != 1 || out.Builds[0] != want {
+		t.Fatalf("expected %+v, got %+v", want, out.Builds)
+	}
+}
+
+func TestSkaffoldPlatforms(t *testing.T) {
+	client := fakeFlakePackagesClient{systems: map[string][]string{
+		"aarch64-linux": {"app"},
+		"x86_64-linux":  {"app"},
+	}}
+	images := []buildImage{{source: mustParseTag(t, "ghcr.io/you/app:latest")}}
+
+	plats, err := skaffoldPlatforms(
+		context.Background(),
+		client,
+		"/workspace",
+		images,
+		[]*v1.Platform{
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			{OS: "linux", Architecture: "riscv64"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("resolve skaffold platforms failed: %v", err)
+	}
+	got := make([]string, 0, len(plats))
+	for _, p := range plats {
+		got = append(got, p.String())
+	}
+	// The variant Skaffold passed is kept, and riscv64 is dropped.
+	if want := []string{"linux/amd64", "linux/arm64/v8"}; !slices.Equal(got, want) {
+		t.Fatalf("expected platforms %v, got %v", want, got)
+	}
+
+	_, err = skaffoldPlatforms(
+		context.Background(),
+		client,
+		"/workspace",
+		images,
+		[]*v1.Platform{{OS: "linux", Architecture: "riscv64"}},
+	)
+	if nixcontainers.ErrorClassOf(err) != nixcontainers.EvalErrorClass {
+		t.Fatalf("expected an eval error when no platform is built, got %v", err)
+	}
+}
+
+func TestSkaffoldLocalPlatforms(t *testing.T) {
+	host := nixcontainers.HostPlatform()
+	other := &v1.Platform{OS: "linux", Architecture: "riscv64"}
+
+	got := skaffoldLocalPlatforms(context.Background(), []*v1.Platform{other, host})
+	if len(got) != 1 || !nixcontainers.PlatformEquals(got[0], host) {
+		t.Fatalf("expected only the host platform %s, got %v", host, got)
+	}
+	got = skaffoldLocalPlatforms(
+		context.Background(),
+		[]*v1.Platform{other, {OS: "linux", Architecture: "s390x"}},
+	)
+	if len(got) != 1 || got[0] != other {
+		t.Fatalf("expected the first platform without a host match, got %v", got)
+	}
+}
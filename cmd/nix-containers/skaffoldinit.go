@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+)
+
+const skaffoldAPIVersion = "skaffold/v4beta11"
+
+// skaffoldBuilderKeys are the artifact builder types Skaffold accepts; an
+// artifact may only set one of them.
+var skaffoldBuilderKeys = []string{"docker", "bazel", "jib", "kaniko", "buildpacks", "ko"}
+
+// skaffoldWatchPaths and skaffoldWatchIgnore are the custom builder
+// dependencies: flakes may read any tracked file, but result links written
+// by local nix builds must not retrigger a rebuild.
+var (
+	skaffoldWatchPaths  = []string{"**"}
+	skaffoldWatchIgnore = []string{".git", "result", "result-*"}
+)
+
+type skaffoldArtifact struct {
+	Context string
+	Image   string
+}
+
+var skaffoldInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Add this builder to skaffold.yaml",
+	Long:  "Reads skaffold.yaml (or creates it) and adds or updates build.artifacts entries that use nix-containers as the custom builder, including the buildCommand env wiring and dependencies.paths for file watching. Comments and unrelated keys are preserved and re-runs do not duplicate entries.",
+	Example: "# Preview the change for one artifact\n" +
+		"./nix-containers skaffold init --artifact ghcr.io/you/app --dry-run\n" +
+		"# Configure an artifact built from the ./app flake\n" +
+		"./nix-containers skaffold init --artifact app=ghcr.io/you/app",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		ctx := cmd.Context()
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		specs, err := cmd.Flags().GetStringArray("artifact")
+		if err != nil {
+			return err
+		}
+		platforms, err := cmd.Flags().GetString("platforms")
+		if err != nil {
+			return err
+		}
+		if platforms != "" {
+			if _, err := parsePlatforms(platforms); err != nil {
+				return err
+			}
+		}
+		if len(specs) == 0 {
+			return errors.New("at least one --artifact is required")
+		}
+		artifacts := make([]skaffoldArtifact, 0, len(specs))
+		for _, spec := range specs {
+			artifact, err := parseSkaffoldArtifact(spec)
+			if err != nil {
+				return err
+			}
+			artifacts = append(artifacts, artifact)
+		}
+
+		src, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		configName := "nix-containers"
+		if abs, err := filepath.Abs(file); err == nil {
+			configName = filepath.Base(filepath.Dir(abs))
+		}
+		out, err := patchSkaffoldConfig(
+			src,
+			configName,
+			artifacts,
+			formatSkaffoldBuildCommand(getAcceptFlakeConfig(), platforms),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to patch %s: %w", file, err)
+		}
+
+		if dryRun {
+			_, err := fmt.Fprint(cmd.OutOrStdout(), formatUnifiedDiff(file, src, out))
+			return err
+		}
+		if bytes.Equal(src, out) {
+			slog.InfoContext(ctx, "skaffold config up to date", "file", file)
+			return nil
+		}
+		if err := os.WriteFile(file, out, 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		slog.InfoContext(
+			ctx,
+			"skaffold config updated",
+			"file", file,
+			"artifacts", len(artifacts),
+		)
+		return nil
+	},
+}
+
+func init() {
+	skaffoldInitCmd.Flags().String("file", "skaffold.yaml", "path to the Skaffold config")
+	skaffoldInitCmd.Flags().Bool("dry-run", false, "print the diff instead of writing the file")
+	skaffoldInitCmd.Flags().StringArray(
+		"artifact",
+		nil,
+		"artifact to configure, as IMAGE or CONTEXT=IMAGE (repeatable)",
+	)
+	skaffoldInitCmd.Flags().String(
+		"platforms",
+		"",
+		"default PLATFORMS for the build command when Skaffold does not set them",
+	)
+	skaffoldCmd.AddCommand(skaffoldInitCmd)
+}
+
+// parseSkaffoldArtifact parses IMAGE or CONTEXT=IMAGE.
+func parseSkaffoldArtifact(spec string) (skaffoldArtifact, error) {
+	context, image, ok := strings.Cut(spec, "=")
+	if !ok {
+		context, image = ".", spec
+	}
+	context, image = strings.TrimSpace(context), strings.TrimSpace(image)
+	if context == "" || image == "" {
+		return skaffoldArtifact{}, fmt.Errorf(
+			"invalid artifact %q: expected IMAGE or CONTEXT=IMAGE",
+			spec,
+		)
+	}
+	return skaffoldArtifact{Context: filepath.ToSlash(filepath.Clean(context)), Image: image}, nil
+}
+
+// formatSkaffoldBuildCommand returns the custom buildCommand. Skaffold runs
+// it through sh and already exports IMAGE, BUILD_CONTEXT, PUSH_IMAGE and, when
+// requested, PLATFORMS, so only the defaults missing from that env are set.
+func formatSkaffoldBuildCommand(acceptFlakeConfig bool, platforms string) string {
+	var parts []string
+	if acceptFlakeConfig {
+		parts = append(parts, "ACCEPT_FLAKE_CONFIG=true")
+	}
+	if platforms != "" {
+		parts = append(parts, fmt.Sprintf("PLATFORMS=${PLATFORMS:-%s}", platforms))
+	}
+	parts = append(parts, "nix-containers", "skaffold", "build")
+	return strings.Join(parts, " ")
+}
+
+// patchSkaffoldConfig adds or updates the artifacts in the Skaffold config
+// src, creating a minimal config when src is empty. Artifacts are matched on
+// their image so re-running with the same input yields the same output.
+func patchSkaffoldConfig(
+	src []byte,
+	configName string,
+	artifacts []skaffoldArtifact,
+	buildCommand string,
+) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{newYAMLMapping()}}
+		root := doc.Content[0]
+		setYAMLValue(root, "apiVersion", newYAMLString(skaffoldAPIVersion))
+		setYAMLValue(root, "kind", newYAMLString("Config"))
+		metadata := newYAMLMapping()
+		setYAMLValue(metadata, "name", newYAMLString(configName))
+		setYAMLValue(root, "metadata", metadata)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("config is not a mapping")
+	}
+
+	build, err := ensureYAMLNode(root, "build", yaml.MappingNode)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := ensureYAMLNode(build, "artifacts", yaml.SequenceNode)
+	if err != nil {
+		return nil, err
+	}
+	for _, artifact := range artifacts {
+		var entry *yaml.Node
+		for _, item := range seq.Content {
+			if image := getYAMLValue(item, "image"); image != nil && image.Value == artifact.Image {
+				entry = item
+				break
+			}
+		}
+		if entry == nil {
+			entry = newYAMLMapping()
+			setYAMLValue(entry, "image", newYAMLString(artifact.Image))
+			seq.Content = append(seq.Content, entry)
+		}
+		if artifact.Context != "." || getYAMLValue(entry, "context") != nil {
+			setYAMLValue(entry, "context", newYAMLString(artifact.Context))
+		}
+
+		for _, key := range skaffoldBuilderKeys {
+			deleteYAMLValue(entry, key)
+		}
+		custom, err := ensureYAMLNode(entry, "custom", yaml.MappingNode)
+		if err != nil {
+			return nil, fmt.Errorf("artifact %s: %w", artifact.Image, err)
+		}
+		setYAMLValue(custom, "buildCommand", newYAMLString(buildCommand))
+		deps, err := ensureYAMLNode(custom, "dependencies", yaml.MappingNode)
+		if err != nil {
+			return nil, fmt.Errorf("artifact %s: %w", artifact.Image, err)
+		}
+		setYAMLValue(deps, "paths", newYAMLStrings(skaffoldWatchPaths))
+		setYAMLValue(deps, "ignore", newYAMLStrings(skaffoldWatchIgnore))
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func newYAMLMapping() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+func newYAMLString(v string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+}
+
+func newYAMLStrings(vs []string) *yaml.Node {
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, v := range vs {
+		seq.Content = append(seq.Content, newYAMLString(v))
+	}
+	return seq
+}
+
+func getYAMLValue(m *yaml.Node, key string) *yaml.Node {
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setYAMLValue replaces the value of key in m, keeping the comments attached
+// to the previous value, or appends the key when it is missing.
+func setYAMLValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			old := m.Content[i+1]
+			value.HeadComment = old.HeadComment
+			value.LineComment = old.LineComment
+			value.FootComment = old.FootComment
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, newYAMLString(key), value)
+}
+
+func deleteYAMLValue(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// ensureYAMLNode returns the value of key in m, creating an empty node of the
+// given kind when it is missing or null.
+func ensureYAMLNode(m *yaml.Node, key string, kind yaml.Kind) (*yaml.Node, error) {
+	value := getYAMLValue(m, key)
+	if value != nil && value.Kind == kind {
+		return value, nil
+	}
+	if value != nil && value.Tag != "!!null" {
+		return nil, fmt.Errorf("%s has an unexpected type", key)
+	}
+	value = newYAMLMapping()
+	if kind == yaml.SequenceNode {
+		value = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	setYAMLValue(m, key, value)
+	return value, nil
+}
+
+// formatUnifiedDiff returns a unified diff of a and b with three lines of
+// context, or an empty string when they are equal.
+func formatUnifiedDiff(file string, a, b []byte) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	x := splitLines(a)
+	y := splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:], y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type diffLine struct {
+		op   byte
+		text string
+		i, j int
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, diffLine{' ', x[i], i, j})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', x[i], i, j})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", file, file)
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		from := max(start-context, 0)
+		end := start
+		for k := start; k < len(lines) && k <= end+2*context; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+		to := min(end+context+1, len(lines))
+		var oldCount, newCount int
+		for _, l := range lines[from:to] {
+			if l.op != '+' {
+				oldCount++
+			}
+			if l.op != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(
+			&out,
+			"@@ -%d,%d +%d,%d @@\n",
+			lines[from].i+1,
+			oldCount,
+			lines[from].j+1,
+			newCount,
+		)
+		for _, l := range lines[from:to] {
+			fmt.Fprintf(&out, "%c%s\n", l.op, l.text)
+		}
+		start = to
+	}
+	return out.String()
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSkaffoldArtifact(t *testing.T) {
+	got, err := parseSkaffoldArtifact("ghcr.io/example/app")
+	if err != nil || got != (skaffoldArtifact{Context: ".", Image: "ghcr.io/example/app"}) {
+		t.Fatalf("unexpected artifact %+v: %v", got, err)
+	}
+	got, err = parseSkaffoldArtifact("./services/api/=ghcr.io/example/api")
+	if err != nil || got != (skaffoldArtifact{Context: "services/api", Image: "ghcr.io/example/api"}) {
+		t.Fatalf("unexpected artifact %+v: %v", got, err)
+	}
+	for _, spec := range []string{"", "app=", "=ghcr.io/example/app"} {
+		if _, err := parseSkaffoldArtifact(spec); err == nil {
+			t.Fatalf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestPatchSkaffoldConfigCreatesConfig(t *testing.T) {
+	out, err := patchSkaffoldConfig(
+		nil,
+		"example",
+		[]skaffoldArtifact{{Context: ".", Image: "ghcr.io/example/app"}},
+		formatSkaffoldBuildCommand(true, "linux/amd64"),
+	)
+	if err != nil {
+		t.Fatalf("patch skaffold config failed: %v", err)
+	}
+
+	want := `apiVersion: skaffold/v4beta11
+kind: Config
+metadata:
+  name: example
+build:
+  artifacts:
+    - image: ghcr.io/example/app
+      custom:
+        buildCommand: ACCEPT_FLAKE_CONFIG=true PLATFORMS=${PLATFORMS:-linux/amd64} nix-containers skaffold build
+        dependencies:
+          paths:
+            - '**'
+          ignore:
+            - .git
+            - result
+            - result-*
+`
+	if string(out) != want {
+		t.Fatalf("unexpected config:\n%s", out)
+	}
+}
+
+func TestPatchSkaffoldConfigPreservesCommentsAndIsIdempotent(t *testing.T) {
+	src := `# project config
+apiVersion: skaffold/v4beta11
+kind: Config
+build:
+  artifacts:
+    # existing docker artifact
+    - image: ghcr.io/example/web
+      docker:
+        dockerfile: Dockerfile
+    - image: ghcr.io/example/app
+      docker:
+        dockerfile: Dockerfile.app
+      custom:
+        buildCommand: ./old-build.sh # replaced
+deploy:
+  kubectl: {}
+`
+	artifacts := []skaffoldArtifact{
+		{Context: ".", Image: "ghcr.io/example/app"},
+		{Context: "api", Image: "ghcr.io/example/api"},
+	}
+	command := formatSkaffoldBuildCommand(false, "")
+
+	out, err := patchSkaffoldConfig([]byte(src), "example", artifacts, command)
+	if err != nil {
+		t.Fatalf("patch skaffold config failed: %v", err)
+	}
+	for _, want := range []string{
+		"# project config",
+		"# existing docker artifact",
+		"dockerfile: Dockerfile",
+		"buildCommand: nix-containers skaffold build # replaced",
+		"context: api",
+		"kubectl: {}",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Fatalf("expected config to contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "Dockerfile.app") {
+		t.Fatalf("expected docker builder to be replaced:\n%s", out)
+	}
+	if n := strings.Count(string(out), "image: ghcr.io/example/app"); n != 1 {
+		t.Fatalf("expected one app artifact, got %d:\n%s", n, out)
+	}
+
+	again, err := patchSkaffoldConfig(out, "example", artifacts, command)
+	if err != nil {
+		t.Fatalf("patch skaffold config again failed: %v", err)
+	}
+	if string(again) != string(out) {
+		t.Fatalf("expected idempotent output, got:\n%s", formatUnifiedDiff("skaffold.yaml", out, again))
+	}
+}
+
+func TestFormatUnifiedDiff(t *testing.T) {
+	if got := formatUnifiedDiff("a.yaml", []byte("a\n"), []byte("a\n")); got != "" {
+		t.Fatalf("expected empty diff, got %q", got)
+	}
+
+	got := formatUnifiedDiff("a.yaml", []byte("a\nb\nc\n"), []byte("a\nB\nc\nd\n"))
+	want := "--- a.yaml\n+++ a.yaml\n@@ -1,3 +1,4 @@\n a\n-b\n+B\n c\n+d\n"
+	if got != want {
+		t.Fatalf("expected diff %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+)
+
+// Strategies generating the tag of an image reference given without one.
+const (
+	TagStrategyGitSHA   = "gitsha"
+	TagStrategyDate     = "date"
+	TagStrategyFlakeRev = "flake-rev"
+	TagStrategyCustom   = "custom"
+)
+
+// tagDateFormat is the UTC timestamp of the date strategy, yyyymmdd-HHMMSS.
+const tagDateFormat = "20060102-150405"
+
+// shortRevLength is how many hex digits of a revision a generated tag keeps.
+const shortRevLength = 7
+
+// tagSource resolves the values a tag is generated from, once for every
+// image of the build, and only when the strategy uses them.
+type tagSource struct {
+	buildContext  string
+	flakeMetadata func(context.Context, string) (*nixcontainers.FlakeMetadata, error)
+	now           time.Time
+
+	gitOnce   sync.Once
+	gitSHA    string
+	flakeOnce sync.Once
+	flakeRev  string
+	flakeErr  error
+}
+
+func newTagSource(
+	buildContext string,
+	flakeMetadata func(context.Context, string) (*nixcontainers.FlakeMetadata, error),
+	now time.Time,
+) *tagSource {
+	return &tagSource{buildContext: buildContext, flakeMetadata: flakeMetadata, now: now}
+}
+
+// tagTemplateData holds the fields of a --tag-template. GitSHA and FlakeRev
+// are methods, so a template not using them needs neither git nor nix.
+type tagTemplateData struct {
+	ctx    context.Context
+	source *tagSource
+
+	// Date is the UTC build time, as yyyymmdd-HHMMSS.
+	Date string
+	// Package is the flake package the image is built from.
+	Package string
+}
+
+// GitSHA returns the short git revision of the build context, suffixed with
+// -dirty when the work tree has changes.
+func (d tagTemplateData) GitSHA() (string, error) {
+	s := d.source
+	s.gitOnce.Do(func() {
+		revision := readGitMetadata(d.ctx, s.buildContext).Revision
+		rev, dirty := strings.CutSuffix(revision, "-dirty")
+		if len(rev) > shortRevLength {
+			rev = rev[:shortRevLength]
+		}
+		if rev != "" && dirty {
+			rev += "-dirty"
+		}
+		s.gitSHA = rev
+	})
+	if s.gitSHA == "" {
+		return "", fmt.Errorf("build context %s has no git revision", s.buildContext)
+	}
+	return s.gitSHA, nil
+}
+
+// FlakeRev returns the short locked revision of the flake, as reported by
+// nix flake metadata.
+func (d tagTemplateData) FlakeRev() (string, error) {
+	s := d.source
+	s.flakeOnce.Do(func() {
+		metadata, err := s.flakeMetadata(d.ctx, s.buildContext)
+		if err != nil {
+			s.flakeErr = err
+			return
+		}
+		rev := metadata.Revision
+		if rev == "" {
+			rev = metadata.DirtyRevision
+		}
+		rev, dirty := strings.CutSuffix(rev, "-dirty")
+		if rev == "" {
+			s.flakeErr = fmt.Errorf("flake %s has no locked revision", s.buildContext)
+			return
+		}
+		if len(rev) > shortRevLength {
+			rev = rev[:shortRevLength]
+		}
+		if dirty {
+			rev += "-dirty"
+		}
+		s.flakeRev = rev
+	})
+	return s.flakeRev, s.flakeErr
+}
+
+// parseTagTemplate returns the template of strategy; custom takes raw as
+// its Go template.
+func parseTagTemplate(strategy, raw string) (*template.Template, error) {
+	switch strategy {
+	case TagStrategyGitSHA:
+		raw = "{{.GitSHA}}"
+	case TagStrategyDate:
+		raw = "{{.Date}}"
+	case TagStrategyFlakeRev:
+		raw = "{{.FlakeRev}}"
+	case TagStrategyCustom:
+		if strings.TrimSpace(raw) == "" {
+			return nil, errors.New("--tag-strategy custom requires --tag-template")
+		}
+	default:
+		return nil, fmt.Errorf(
+			"invalid tag strategy %q, expected %s, %s, %s or %s",
+			strategy,
+			TagStrategyGitSHA,
+			TagStrategyDate,
+			TagStrategyFlakeRev,
+			TagStrategyCustom,
+		)
+	}
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --tag-template %q: %w", raw, err)
+	}
+	return tmpl, nil
+}
+
+// resolveImageTags tags every image given without a tag with the one tmpl
+// generates, instead of latest. The builds share the same values.
+func resolveImageTags(
+	ctx context.Context,
+	images []buildImage,
+	tmpl *template.Template,
+	source *tagSource,
+) ([]buildImage, error) {
+	resolved := make([]buildImage, 0, len(images))
+	for _, image := range images {
+		if !image.untagged {
+			resolved = append(resolved, image)
+			continue
+		}
+		var tag strings.Builder
+		err := tmpl.Execute(&tag, tagTemplateData{
+			ctx:     ctx,
+			source:  source,
+			Date:    source.now.UTC().Format(tagDateFormat),
+			Package: image.flakePackage(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("generate tag of %s failed: %w", image.destination, err)
+		}
+		// An untagged reference keeps the form it was given in, without a tag.
+		destination, err := name.NewTag(image.destination.String() + ":" + tag.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid generated tag %q: %w", tag.String(), err)
+		}
+		slog.InfoContext(
+			ctx,
+			"image tag resolved",
+			"image",
+			destination.String(),
+			"tag",
+			destination.TagStr(),
+		)
+		if image.source.Name() == image.destination.Name() {
+			image.source = destination
+		}
+		image.destination = destination
+		image.untagged = false
+		resolved = append(resolved, image)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+	"github.com/spf13/viper"
+)
+
+func TestResolveImageTags(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	viper.Set("images", "ghcr.io/example/api ghcr.io/example/web:1.0")
+	images, err := getBuildImages()
+	if err != nil {
+		t.Fatalf("get build images failed: %v", err)
+	}
+	var metadataCalls int
+	source := newTagSource(
+		"/workspace",
+		func(context.Context, string) (*nixcontainers.FlakeMetadata, error) {
+			metadataCalls++
+			return &nixcontainers.FlakeMetadata{Revision: strings.Repeat("b", 40)}, nil
+		},
+		time.Date(2024, 5, 1, 12, 30, 45, 0, time.FixedZone("CEST", 2*60*60)),
+	)
+
+	tests := map[string]string{
+		TagStrategyDate:     "ghcr.io/example/api:20240501-103045",
+		TagStrategyFlakeRev: "ghcr.io/example/api:bbbbbbb",
+	}
+	for strategy, want := range tests {
+		tmpl, err := parseTagTemplate(strategy, "")
+		if err != nil {
+			t.Fatalf("parse %s template failed: %v", strategy, err)
+		}
+		resolved, err := resolveImageTags(context.Background(), images, tmpl, source)
+		if err != nil {
+			t.Fatalf("resolve %s tags failed: %v", strategy, err)
+		}
+		if got := resolved[0].destination.String(); got != want {
+			t.Fatalf("expected %s tag %s, got %s", strategy, want, got)
+		}
+		if resolved[0].source.String() != want {
+			t.Fatalf("expected the source to be tagged as %s, got %s", want, resolved[0].source)
+		}
+		if got := resolved[1].destination.String(); got != "ghcr.io/example/web:1.0" {
+			t.Fatalf("expected the explicit tag to be kept, got %s", got)
+		}
+	}
+
+	tmpl, err := parseTagTemplate(TagStrategyCustom, "{{.Package}}-{{.FlakeRev}}")
+	if err != nil {
+		t.Fatalf("parse custom template failed: %v", err)
+	}
+	resolved, err := resolveImageTags(context.Background(), images, tmpl, source)
+	if err != nil {
+		t.Fatalf("resolve custom tags failed: %v", err)
+	}
+	if got := resolved[0].destination.TagStr(); got != "api-bbbbbbb" {
+		t.Fatalf("expected custom tag api-bbbbbbb, got %s", got)
+	}
+	if metadataCalls != 1 {
+		t.Fatalf("expected the flake metadata to be read once, got %d", metadataCalls)
+	}
+
+	tmpl, err = parseTagTemplate(TagStrategyCustom, "{{.Package}}/{{.Date}}")
+	if err != nil {
+		t.Fatalf("parse custom template failed: %v", err)
+	}
+	if _, err := resolveImageTags(context.Background(), images, tmpl, source); err == nil {
+		t.Fatalf("expected error for an invalid generated tag")
+	}
+}
+
+func TestResolveImageTagsGitSHA(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	dir := t.TempDir()
+	runTestGit(t, dir, "init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "flake.nix"), []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("write flake failed: %v", err)
+	}
+	runTestGit(t, dir, "add", "flake.nix")
+	runTestGit(t, dir, "commit", "-q", "-m", "init")
+	rev := runTestGit(t, dir, "rev-parse", "HEAD")
+
+	viper.Set("image", "ghcr.io/example/app")
+	images, err := getBuildImages()
+	if err != nil {
+		t.Fatalf("get build images failed: %v", err)
+	}
+	tmpl, err := parseTagTemplate(TagStrategyGitSHA, "")
+	if err != nil {
+		t.Fatalf("parse gitsha template failed: %v", err)
+	}
+	noMetadata := func(context.Context, string) (*nixcontainers.FlakeMetadata, error) {
+		return nil, errors.New("unexpected flake metadata lookup")
+	}
+	resolved, err := resolveImageTags(
+		context.Background(),
+		images,
+		tmpl,
+		newTagSource(dir, noMetadata, time.Now()),
+	)
+	if err != nil {
+		t.Fatalf("resolve tags failed: %v", err)
+	}
+	if got := resolved[0].destination.TagStr(); got != rev[:shortRevLength] {
+		t.Fatalf("expected tag %s, got %s", rev[:shortRevLength], got)
+	}
+
+	_, err = resolveImageTags(
+		context.Background(),
+		images,
+		tmpl,
+		newTagSource(t.TempDir(), noMetadata, time.Now()),
+	)
+	if err == nil || !strings.Contains(err.Error(), "has no git revision") {
+		t.Fatalf("expected error outside a git repository, got %v", err)
+	}
+}
+
+func TestGetTagTemplate(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	if tmpl, err := getTagTemplate(); tmpl != nil || err != nil {
+		t.Fatalf("expected no template by default, got %v, %v", tmpl, err)
+	}
+	for _, tt := range []struct {
+		strategy, template, wantErr string
+	}{
+		{strategy: "semver", wantErr: "invalid tag strategy"},
+		{strategy: TagStrategyCustom, wantErr: "requires --tag-template"},
+		{strategy: TagStrategyCustom, template: "{{.Missing", wantErr: "invalid --tag-template"},
+		{strategy: TagStrategyDate, template: "{{.Date}}", wantErr: "cannot be combined"},
+		{template: "{{.Date}}", wantErr: "requires --tag-strategy custom"},
+	} {
+		viper.Set("tag_strategy", tt.strategy)
+		viper.Set("tag_template", tt.template)
+		_, err := getTagTemplate()
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Fatalf("expected error containing %q for %+v, got %v", tt.wantErr, tt, err)
+		}
+	}
+}
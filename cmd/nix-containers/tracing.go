@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// tracingShutdownTimeout bounds the export of the spans left when the
+// process exits.
+const tracingShutdownTimeout = 5 * time.Second
+
+// tracingEnabled reports whether an OTLP endpoint is configured with the
+// standard OpenTelemetry environment variables.
+func tracingEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// traceParentContext returns ctx under the trace context of the TRACEPARENT
+// and TRACESTATE environment variables, so the spans of a CI job that passes
+// its own nest under the job span.
+func traceParentContext(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{}
+	if v := os.Getenv("TRACEPARENT"); v != "" {
+		carrier.Set("traceparent", v)
+	}
+	if v := os.Getenv("TRACESTATE"); v != "" {
+		carrier.Set("tracestate", v)
+	}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+// setupTracing exports the spans of the run over OTLP/HTTP when an endpoint
+// is configured, and returns the context to run under with the function
+// flushing the spans before exit. Without an endpoint, nothing is registered
+// and the spans of the build pipeline are no-ops.
+func setupTracing(ctx context.Context) (context.Context, func(), error) {
+	if !tracingEnabled() {
+		return ctx, func() {}, nil
+	}
+	// The exporter reads the endpoint, headers and timeout from the
+	// OTEL_EXPORTER_OTLP_* environment variables itself.
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("create otlp trace exporter failed: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(semconv.ServiceName("nix-containers")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("create trace resource failed: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(
+		propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	)
+	slog.Debug("otlp tracing enabled")
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Warn("flush traces failed", "err", err)
+		}
+	}
+	return traceParentContext(ctx), shutdown, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceParentContext(t *testing.T) {
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sc := trace.SpanContextFromContext(traceParentContext(context.Background()))
+	if !sc.IsRemote() || sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		sc.SpanID().String() != "00f067aa0ba902b7" || !sc.IsSampled() {
+		t.Fatalf("expected the TRACEPARENT span context, got %+v", sc)
+	}
+
+	t.Setenv("TRACEPARENT", "")
+	if sc := trace.SpanContextFromContext(traceParentContext(context.Background())); sc.IsValid() {
+		t.Fatalf("expected no span context without TRACEPARENT, got %+v", sc)
+	}
+}
+
+func TestSetupTracingWithoutEndpointIsNoop(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	prev := otel.GetTracerProvider()
+	ctx := context.Background()
+	got, shutdown, err := setupTracing(ctx)
+	if err != nil {
+		t.Fatalf("setup tracing failed: %v", err)
+	}
+	shutdown()
+	if got != ctx || otel.GetTracerProvider() != prev {
+		t.Fatal("expected tracing to stay disabled without an endpoint")
+	}
+}
@@ -1,49 +1,114 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/google/go-containerregistry/pkg/name"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
-func formatArch(s string) string {
-	switch s {
-	case "amd64":
-		return "x86_64"
-	case "arm64":
-		return "aarch64"
-	case "arm32":
-		return "armv7l"
-	default:
-		return s
-	}
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-func formatPlatformReference(ref name.Reference, p *v1.Platform) (*name.Tag, error) {
-	tag, err := name.NewTag(fmt.Sprintf("%s_%s_%s", ref.Name(), p.OS, p.Architecture))
-	if err != nil {
-		return nil, fmt.Errorf("failed to format platform reference: %w", err)
+// splitShellWords splits s into words using POSIX shell quoting rules for
+// single quotes, double quotes, and backslash escapes.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
 	}
-	return &tag, nil
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
 }
 
-func formatSystemName(p *v1.Platform) string {
-	return fmt.Sprintf("%s-%s", formatArch(p.Architecture), p.OS)
+var gitRevPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// isMutableFlakeRef reports whether a flake reference points at a remote
+// branch that nix may serve from its tarball cache rather than a pinned rev.
+func isMutableFlakeRef(ref string) bool {
+	ref, rawQuery, _ := strings.Cut(ref, "?")
+	if query, err := url.ParseQuery(rawQuery); err == nil && query.Get("rev") != "" {
+		return false
+	}
+	for _, scheme := range []string{"github:", "gitlab:", "sourcehut:"} {
+		if rest, ok := strings.CutPrefix(ref, scheme); ok {
+			segs := strings.Split(rest, "/")
+			return len(segs) < 3 || !gitRevPattern.MatchString(segs[2])
+		}
+	}
+	return strings.HasPrefix(ref, "git+")
 }
 
-func formatNixFlakePackageName(ref name.Reference) string {
-	repo := ref.Context().RepositoryStr()
-	segs := strings.Split(repo, "/")
-	return segs[len(segs)-1]
+// parseSmokeTestCommand splits the smoke test command using shell quoting
+// rules. The command is executed directly as the container entrypoint since
+// images built with nix often ship no shell.
+func parseSmokeTestCommand(command string) ([]string, error) {
+	args, err := splitShellWords(command)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smoke test command %q: %w", command, err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("smoke test command is empty")
+	}
+	return args, nil
 }
 
-func formatNixFlakePackage(buildContext string, ref name.Reference, p *v1.Platform) string {
-	return fmt.Sprintf(
-		"%s#packages.%s.%s",
-		buildContext,
-		formatSystemName(p),
-		formatNixFlakePackageName(ref),
-	)
+// splitMaxJobs divides a numeric --max-jobs value between builds running
+// concurrently, keeping at least one job each. "auto" and "0" are returned
+// unchanged since nix resolves them per build.
+func splitMaxJobs(maxJobs string, builds int) string {
+	n, err := strconv.Atoi(maxJobs)
+	if err != nil || n <= 0 || builds <= 1 {
+		return maxJobs
+	}
+	return strconv.Itoa(max(n/builds, 1))
 }
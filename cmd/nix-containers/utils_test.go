@@ -1,32 +1,107 @@
 package main
 
 import (
+	"slices"
 	"testing"
-
-	"github.com/google/go-containerregistry/pkg/name"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
-func TestFormatSystemName(t *testing.T) {
-	got := formatSystemName(&v1.Platform{OS: "linux", Architecture: "arm64"})
-	if got != "aarch64-linux" {
-		t.Fatalf("expected aarch64-linux, got %s", got)
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{input: "", want: nil},
+		{input: "--option sandbox false", want: []string{"--option", "sandbox", "false"}},
+		{
+			input: `--option extra-substituters "https://a.example https://b.example"`,
+			want:  []string{"--option", "extra-substituters", "https://a.example https://b.example"},
+		},
+		{input: `--argstr name 'hello world'`, want: []string{"--argstr", "name", "hello world"}},
+		{input: `--argstr name hello\ world`, want: []string{"--argstr", "name", "hello world"}},
+		{input: `--argstr quote "say \"hi\""`, want: []string{"--argstr", "quote", `say "hi"`}},
+		{input: `--argstr empty ''`, want: []string{"--argstr", "empty", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := splitShellWords(tt.input)
+			if err != nil {
+				t.Fatalf("split shell words failed: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSplitShellWordsRejectsUnterminatedQuote(t *testing.T) {
+	if _, err := splitShellWords(`--argstr name "unterminated`); err == nil {
+		t.Fatalf("expected unterminated quote error")
+	}
+}
+
+func TestIsMutableFlakeRef(t *testing.T) {
+	rev := "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{ref: ".", want: false},
+		{ref: "/workspace/app", want: false},
+		{ref: "path:/workspace/app", want: false},
+		{ref: "github:org/repo", want: true},
+		{ref: "github:org/repo/main", want: true},
+		{ref: "github:org/repo/" + rev, want: false},
+		{ref: "github:org/repo?ref=main", want: true},
+		{ref: "gitlab:org/repo/main", want: true},
+		{ref: "git+https://example.com/repo.git?ref=main", want: true},
+		{ref: "git+https://example.com/repo.git?rev=" + rev, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			if got := isMutableFlakeRef(tt.ref); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSmokeTestCommand(t *testing.T) {
+	got, err := parseSmokeTestCommand("  /bin/app --version ")
+	if err != nil || !slices.Equal(got, []string{"/bin/app", "--version"}) {
+		t.Fatalf("unexpected args %q: %v", got, err)
+	}
+	got, err = parseSmokeTestCommand(`/bin/sh -c 'test -x "/bin/app"'`)
+	if err != nil || !slices.Equal(got, []string{"/bin/sh", "-c", `test -x "/bin/app"`}) {
+		t.Fatalf("unexpected args %q: %v", got, err)
+	}
+	for _, command := range []string{" ", "/bin/sh -c 'unterminated"} {
+		if _, err := parseSmokeTestCommand(command); err == nil {
+			t.Fatalf("expected error for %q", command)
+		}
 	}
 }
 
-func TestFormatNixFlakePackage(t *testing.T) {
-	ref, err := name.ParseReference("ghcr.io/shikanime/shikanime/catbox:latest")
-	if err != nil {
-		t.Fatalf("parse reference failed: %v", err)
+func TestSplitMaxJobs(t *testing.T) {
+	tests := []struct {
+		maxJobs string
+		builds  int
+		want    string
+	}{
+		{maxJobs: "8", builds: 2, want: "4"},
+		{maxJobs: "3", builds: 2, want: "1"},
+		{maxJobs: "1", builds: 4, want: "1"},
+		{maxJobs: "8", builds: 1, want: "8"},
+		{maxJobs: "auto", builds: 2, want: "auto"},
+		{maxJobs: "0", builds: 2, want: "0"},
+		{maxJobs: "", builds: 2, want: ""},
 	}
 
-	got := formatNixFlakePackage(
-		"/workspace",
-		ref,
-		&v1.Platform{OS: "linux", Architecture: "amd64"},
-	)
-	want := "/workspace#packages.x86_64-linux.catbox"
-	if got != want {
-		t.Fatalf("expected %s, got %s", want, got)
+	for _, tt := range tests {
+		if got := splitMaxJobs(tt.maxJobs, tt.builds); got != tt.want {
+			t.Fatalf("splitMaxJobs(%q, %d) = %q, want %q", tt.maxJobs, tt.builds, got, tt.want)
+		}
 	}
 }
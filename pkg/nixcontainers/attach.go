@@ -0,0 +1,181 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// artifactTitleAnnotation names the file an artifact blob was read from.
+const artifactTitleAnnotation = "org.opencontainers.image.title"
+
+// artifactConfig is the empty JSON config of artifact manifests.
+var artifactConfig = []byte("{}")
+
+// Attachment is a file attached to a pushed image as an OCI referrer
+// artifact, such as a test report or scan result.
+type Attachment struct {
+	// Path is the file uploaded as the single blob of the artifact.
+	Path string
+	// ArtifactType is the media type of the artifact and of its blob.
+	ArtifactType string
+	// Annotations are set on the artifact manifest.
+	Annotations map[string]string
+}
+
+// AttachArtifact pushes a as an artifact whose subject is the manifest
+// subject resolves to, with opts, and returns the digest reference of the
+// artifact. On registries without the OCI Referrers API, go-containerregistry
+// also adds it to the referrers tag of the subject. Registry errors are
+// classified as push or auth errors.
+func AttachArtifact(
+	ctx context.Context,
+	subject name.Reference,
+	a Attachment,
+	opts ...remote.Option,
+) (name.Digest, error) {
+	opts = append(slices.Clone(opts), remote.WithContext(ctx))
+	desc, err := remote.Head(subject, opts...)
+	if err != nil {
+		return name.Digest{}, classifyRegistryError(
+			fmt.Errorf("resolve subject %s failed: %w", subject, err),
+		)
+	}
+	artifact, err := newArtifactImage(a, v1.Descriptor{
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Digest:    desc.Digest,
+	})
+	if err != nil {
+		return name.Digest{}, ClassifyError(ConfigErrorClass, err)
+	}
+	digest, err := artifact.Digest()
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("get artifact digest failed: %w", err)
+	}
+	ref := subject.Context().Digest(digest.String())
+	if err := remote.Write(ref, artifact, opts...); err != nil {
+		return name.Digest{}, classifyRegistryError(
+			fmt.Errorf("push artifact %s failed: %w", a.Path, err),
+		)
+	}
+	slog.InfoContext(
+		ctx,
+		"artifact attached",
+		"subject", subject.Context().Digest(desc.Digest.String()).Name(),
+		"artifact", ref.Name(),
+		"artifact_type", a.ArtifactType,
+	)
+	return ref, nil
+}
+
+// AttachArtifact pushes a as an artifact referring to the manifest subject
+// resolves to, with the registry options of the client.
+func (c *ContainerClient) AttachArtifact(
+	ctx context.Context,
+	subject name.Reference,
+	a Attachment,
+) (name.Digest, error) {
+	return AttachArtifact(ctx, subject, a, c.remoteOptions(ctx)...)
+}
+
+// newArtifactImage returns the artifact manifest of a, with subject, as an
+// image so it can be written with remote.Write. Its config is the empty JSON
+// object typed with the artifact type, which registries without artifactType
+// support report the artifact as.
+func newArtifactImage(a Attachment, subject v1.Descriptor) (v1.Image, error) {
+	blob, err := newFileBlob(a.Path, types.MediaType(a.ArtifactType))
+	if err != nil {
+		return nil, err
+	}
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(artifactConfig))
+	if err != nil {
+		return nil, fmt.Errorf("get artifact config digest failed: %w", err)
+	}
+	m := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: types.MediaType(a.ArtifactType),
+			Size:      configSize,
+			Digest:    configDigest,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: blob.mediaType,
+			Size:      blob.size,
+			Digest:    blob.digest,
+			Annotations: map[string]string{
+				artifactTitleAnnotation: filepath.Base(a.Path),
+			},
+		}},
+		Annotations: a.Annotations,
+		Subject:     &subject,
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("encode artifact manifest failed: %w", err)
+	}
+	return partial.CompressedToImage(&artifactImage{manifest: raw, blob: blob})
+}
+
+// artifactImage is the core of an artifact manifest with a single file blob.
+type artifactImage struct {
+	manifest []byte
+	blob     *fileBlob
+}
+
+func (a *artifactImage) RawConfigFile() ([]byte, error) { return artifactConfig, nil }
+
+func (a *artifactImage) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (a *artifactImage) RawManifest() ([]byte, error) { return a.manifest, nil }
+
+func (a *artifactImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if h != a.blob.digest {
+		return nil, fmt.Errorf("artifact has no blob %s", h)
+	}
+	return a.blob, nil
+}
+
+// fileBlob is a file uploaded as is, read again for every upload attempt.
+type fileBlob struct {
+	path      string
+	mediaType types.MediaType
+	digest    v1.Hash
+	size      int64
+}
+
+func newFileBlob(path string, mediaType types.MediaType) (*fileBlob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open artifact file failed: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	digest, size, err := v1.SHA256(f)
+	if err != nil {
+		return nil, fmt.Errorf("read artifact file %s failed: %w", path, err)
+	}
+	return &fileBlob{path: path, mediaType: mediaType, digest: digest, size: size}, nil
+}
+
+func (b *fileBlob) Digest() (v1.Hash, error) { return b.digest, nil }
+
+func (b *fileBlob) Compressed() (io.ReadCloser, error) { return os.Open(b.path) }
+
+func (b *fileBlob) Size() (int64, error) { return b.size, nil }
+
+func (b *fileBlob) MediaType() (types.MediaType, error) { return b.mediaType, nil }
@@ -0,0 +1,128 @@
+package nixcontainers
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestAttachArtifact(t *testing.T) {
+	tests := []struct {
+		name      string
+		referrers bool
+	}{
+		{name: "referrers api", referrers: true},
+		{name: "referrers tag", referrers: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := newTestRegistryRef(
+				t,
+				registry.New(registry.WithReferrersSupport(tt.referrers)),
+				"example/app:latest",
+			)
+			img, err := random.Image(64, 1)
+			if err != nil {
+				t.Fatalf("create random image failed: %v", err)
+			}
+			if err := remote.Write(ref, img); err != nil {
+				t.Fatalf("push image failed: %v", err)
+			}
+			subject, err := img.Digest()
+			if err != nil {
+				t.Fatalf("get image digest failed: %v", err)
+			}
+			path := filepath.Join(t.TempDir(), "report.json")
+			if err := os.WriteFile(path, []byte(`{"passed":42}`), 0o600); err != nil {
+				t.Fatalf("write report failed: %v", err)
+			}
+
+			artifact, err := AttachArtifact(context.Background(), ref, Attachment{
+				Path:         path,
+				ArtifactType: "application/vnd.example.test-report+json",
+				Annotations:  map[string]string{"org.example.suite": "e2e"},
+			})
+			if err != nil {
+				t.Fatalf("attach artifact failed: %v", err)
+			}
+
+			idx, err := remote.Referrers(ref.Context().Digest(subject.String()))
+			if err != nil {
+				t.Fatalf("list referrers failed: %v", err)
+			}
+			m, err := idx.IndexManifest()
+			if err != nil {
+				t.Fatalf("read referrers failed: %v", err)
+			}
+			if len(m.Manifests) != 1 {
+				t.Fatalf("expected a single referrer, got %d", len(m.Manifests))
+			}
+			desc := m.Manifests[0]
+			if desc.Digest.String() != artifact.DigestStr() {
+				t.Fatalf("expected referrer %s, got %s", artifact.DigestStr(), desc.Digest)
+			}
+			if desc.ArtifactType != "application/vnd.example.test-report+json" {
+				t.Fatalf("expected the artifact type, got %q", desc.ArtifactType)
+			}
+
+			got, err := remote.Image(artifact)
+			if err != nil {
+				t.Fatalf("read artifact failed: %v", err)
+			}
+			manifest, err := got.Manifest()
+			if err != nil {
+				t.Fatalf("read artifact manifest failed: %v", err)
+			}
+			if manifest.Subject == nil || manifest.Subject.Digest != subject {
+				t.Fatalf("expected subject %s, got %v", subject, manifest.Subject)
+			}
+			if manifest.Annotations["org.example.suite"] != "e2e" {
+				t.Fatalf("expected the annotations, got %v", manifest.Annotations)
+			}
+			layers, err := got.Layers()
+			if err != nil || len(layers) != 1 {
+				t.Fatalf("expected a single blob, got %d: %v", len(layers), err)
+			}
+			if title := manifest.Layers[0].Annotations[artifactTitleAnnotation]; title != "report.json" {
+				t.Fatalf("expected the blob titled report.json, got %q", title)
+			}
+			rc, err := layers[0].Compressed()
+			if err != nil {
+				t.Fatalf("read blob failed: %v", err)
+			}
+			defer func() { _ = rc.Close() }()
+			blob, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("read blob failed: %v", err)
+			}
+			if string(blob) != `{"passed":42}` {
+				t.Fatalf("expected the report as the blob, got %q", blob)
+			}
+		})
+	}
+}
+
+func TestAttachArtifactMissingFile(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	_, err = AttachArtifact(context.Background(), ref, Attachment{
+		Path:         filepath.Join(t.TempDir(), "missing.json"),
+		ArtifactType: "application/json",
+	})
+	if err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,193 @@
+package nixcontainers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Annotations recording the image a rebased image was appended onto.
+const (
+	ociBaseNameAnnotation   = "org.opencontainers.image.base.name"
+	ociBaseDigestAnnotation = "org.opencontainers.image.base.digest"
+)
+
+// WithContainerBaseImage appends the layers of every image onto ref, resolved
+// for the platform of the image, instead of shipping the nix layers alone.
+func WithContainerBaseImage(ref name.Reference) ContainerOption {
+	return func(o *containerOptions) { o.baseImage = ref }
+}
+
+// CheckBaseImage resolves the base image for every platform, so that a base
+// without one of them fails before anything is built.
+func (c *ContainerClient) CheckBaseImage(ctx context.Context, plats []*v1.Platform) error {
+	if c.baseImage == nil {
+		return nil
+	}
+	for _, p := range plats {
+		base, err := c.platformBaseImage(ctx, p)
+		if err != nil {
+			return err
+		}
+		digest, err := base.Digest()
+		if err != nil {
+			return fmt.Errorf("get base image digest failed: %w", err)
+		}
+		slog.InfoContext(
+			ctx,
+			"base image resolved",
+			"base_image", c.baseImage.Name(),
+			"platform", FormatSystemName(p),
+			"digest", digest.String(),
+		)
+	}
+	return nil
+}
+
+// platformBaseImage fetches the base image for p once and validates its
+// platform, since a single-platform base is returned whatever p is.
+func (c *ContainerClient) platformBaseImage(ctx context.Context, p *v1.Platform) (v1.Image, error) {
+	if img, ok := c.baseImages.Load(p.String()); ok {
+		return img.(v1.Image), nil
+	}
+	opts := append(c.remoteOptions(ctx), remote.WithPlatform(*p))
+	img, err := remote.Image(c.baseImage, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("fetch base image %s for %s failed: %w", c.baseImage, p, err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("read config of base image %s failed: %w", c.baseImage, err)
+	}
+	if !configPlatformMatches(cf, p) {
+		return nil, fmt.Errorf(
+			"base image %s is %s, expected %s",
+			c.baseImage,
+			configPlatform(cf),
+			p,
+		)
+	}
+	actual, _ := c.baseImages.LoadOrStore(p.String(), img)
+	return actual.(v1.Image), nil
+}
+
+// rebase appends the layers of img onto the base image for p. The config of
+// img takes precedence over the one of the base, and the base is recorded in
+// the manifest annotations.
+func (c *ContainerClient) rebase(
+	ctx context.Context,
+	img v1.Image,
+	p *v1.Platform,
+) (v1.Image, error) {
+	base, err := c.platformBaseImage(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := base.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("get base image digest failed: %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("read image layers failed: %w", err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("read image config failed: %w", err)
+	}
+	adds := make([]mutate.Addendum, 0, len(layers))
+	for _, l := range layers {
+		adds = append(adds, mutate.Addendum{Layer: l})
+	}
+	rebased, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("append layers to base image failed: %w", err)
+	}
+	rebasedConfig, err := rebased.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("read rebased image config failed: %w", err)
+	}
+	rebasedConfig = rebasedConfig.DeepCopy()
+	rebasedConfig.Config = mergeImageConfig(rebasedConfig.Config, cf.Config)
+	rebasedConfig.Created = cf.Created
+	rebased, err = mutate.ConfigFile(rebased, rebasedConfig)
+	if err != nil {
+		return nil, fmt.Errorf("set rebased image config failed: %w", err)
+	}
+	return annotateImage(rebased, map[string]string{
+		ociBaseNameAnnotation:   c.baseImage.Name(),
+		ociBaseDigestAnnotation: digest.String(),
+	}), nil
+}
+
+// mergeImageConfig returns the base config overridden by the one of the nix
+// image: env vars and labels are merged by key, and an entrypoint or cmd of
+// the image replaces both of the base, as docker does for a new entrypoint.
+func mergeImageConfig(base, image v1.Config) v1.Config {
+	merged := base
+	merged.Env = mergeEnv(base.Env, image.Env)
+	if len(image.Entrypoint) > 0 || len(image.Cmd) > 0 {
+		merged.Entrypoint = image.Entrypoint
+		merged.Cmd = image.Cmd
+	}
+	if image.User != "" {
+		merged.User = image.User
+	}
+	if image.WorkingDir != "" {
+		merged.WorkingDir = image.WorkingDir
+	}
+	if len(image.Labels) > 0 {
+		merged.Labels = make(map[string]string, len(base.Labels)+len(image.Labels))
+		for k, v := range base.Labels {
+			merged.Labels[k] = v
+		}
+		for k, v := range image.Labels {
+			merged.Labels[k] = v
+		}
+	}
+	if len(image.ExposedPorts) > 0 {
+		merged.ExposedPorts = make(map[string]struct{}, len(base.ExposedPorts))
+		for port := range base.ExposedPorts {
+			merged.ExposedPorts[port] = struct{}{}
+		}
+		for port := range image.ExposedPorts {
+			merged.ExposedPorts[port] = struct{}{}
+		}
+	}
+	if len(image.Volumes) > 0 {
+		merged.Volumes = make(map[string]struct{}, len(base.Volumes))
+		for volume := range base.Volumes {
+			merged.Volumes[volume] = struct{}{}
+		}
+		for volume := range image.Volumes {
+			merged.Volumes[volume] = struct{}{}
+		}
+	}
+	return merged
+}
+
+// mergeEnv returns the KEY=VALUE entries of base, in order, with those the
+// image sets replaced, followed by the image entries the base lacks.
+func mergeEnv(base, image []string) []string {
+	merged := slices.Clone(base)
+	for _, kv := range image {
+		key, _, _ := strings.Cut(kv, "=")
+		i := slices.IndexFunc(merged, func(b string) bool {
+			k, _, _ := strings.Cut(b, "=")
+			return k == key
+		})
+		if i >= 0 {
+			merged[i] = kv
+			continue
+		}
+		merged = append(merged, kv)
+	}
+	return merged
+}
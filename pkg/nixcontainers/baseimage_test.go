@@ -0,0 +1,249 @@
+package nixcontainers
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// pushTestBaseImage pushes an index with a random image for each of plats,
+// configured with env, to ref and returns the images by platform.
+func pushTestBaseImage(
+	t *testing.T,
+	ref name.Reference,
+	env []string,
+	plats ...*v1.Platform,
+) map[string]v1.Image {
+	t.Helper()
+
+	images := make(map[string]v1.Image)
+	var adds []mutate.IndexAddendum
+	for _, p := range plats {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatalf("create random image failed: %v", err)
+		}
+		cf, err := img.ConfigFile()
+		if err != nil {
+			t.Fatalf("read config failed: %v", err)
+		}
+		cf = cf.DeepCopy()
+		cf.OS, cf.Architecture = p.OS, p.Architecture
+		cf.Config.Env = env
+		cf.Config.Cmd = []string{"/bin/sh"}
+		img, err = mutate.ConfigFile(img, cf)
+		if err != nil {
+			t.Fatalf("set config failed: %v", err)
+		}
+		images[p.String()] = img
+		adds = append(adds, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: p}})
+	}
+	if err := remote.WriteIndex(ref, mutate.AppendManifests(empty.Index, adds...)); err != nil {
+		t.Fatalf("push base index failed: %v", err)
+	}
+	return images
+}
+
+func writeTestNixImageArchive(t *testing.T, cfg v1.Config) (string, v1.Image) {
+	t.Helper()
+
+	img, err := random.Image(64, 2)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	img, err = mutate.Config(img, cfg)
+	if err != nil {
+		t.Fatalf("set config failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := tarball.WriteToFile(path, mustParseReference(t, "app:latest"), img); err != nil {
+		t.Fatalf("write image archive failed: %v", err)
+	}
+	return path, img
+}
+
+func TestContainerClientPushPlatformImageOntoBaseImage(t *testing.T) {
+	base := newTestRegistryRef(t, registry.New(), "example/base:latest")
+	arm64 := ParsePlatform("linux/arm64")
+	bases := pushTestBaseImage(
+		t,
+		base,
+		[]string{"PATH=/usr/bin", "LANG=C"},
+		HostPlatform(),
+		arm64,
+	)
+	path, nixImage := writeTestNixImageArchive(t, v1.Config{
+		Env:        []string{"PATH=/nix/bin", "APP=1"},
+		Entrypoint: []string{"/bin/app"},
+	})
+
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerBaseImage(base),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	ref := base.Context().Registry.Repo("example", "app").Tag("arm64")
+	_, err = containerClient.PushPlatformImage(context.Background(), ref, arm64, path, nil)
+	if err != nil {
+		t.Fatalf("push platform image failed: %v", err)
+	}
+
+	img, err := remote.Image(ref)
+	if err != nil {
+		t.Fatalf("fetch pushed image failed: %v", err)
+	}
+	var want []v1.Hash
+	for _, img := range []v1.Image{bases[arm64.String()], nixImage} {
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatalf("read layers failed: %v", err)
+		}
+		for _, l := range layers {
+			diffID, err := l.DiffID()
+			if err != nil {
+				t.Fatalf("read diff id failed: %v", err)
+			}
+			want = append(want, diffID)
+		}
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read pushed config failed: %v", err)
+	}
+	if !slices.Equal(cf.RootFS.DiffIDs, want) {
+		t.Fatalf("expected base then nix layers %v, got %v", want, cf.RootFS.DiffIDs)
+	}
+	if cf.Architecture != "arm64" {
+		t.Fatalf("expected the arm64 base, got %s", cf.Architecture)
+	}
+	wantEnv := []string{"PATH=/nix/bin", "LANG=C", "APP=1"}
+	if !slices.Equal(cf.Config.Env, wantEnv) {
+		t.Fatalf("expected env %q, got %q", wantEnv, cf.Config.Env)
+	}
+	if !slices.Equal(cf.Config.Entrypoint, []string{"/bin/app"}) || cf.Config.Cmd != nil {
+		t.Fatalf(
+			"expected the nix entrypoint to replace the base cmd, got %q %q",
+			cf.Config.Entrypoint,
+			cf.Config.Cmd,
+		)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("read pushed manifest failed: %v", err)
+	}
+	baseDigest, err := bases[arm64.String()].Digest()
+	if err != nil {
+		t.Fatalf("base digest failed: %v", err)
+	}
+	if got := m.Annotations[ociBaseNameAnnotation]; got != base.Name() {
+		t.Fatalf("expected base name annotation %s, got %q", base.Name(), got)
+	}
+	if got := m.Annotations[ociBaseDigestAnnotation]; got != baseDigest.String() {
+		t.Fatalf("expected base digest annotation %s, got %q", baseDigest, got)
+	}
+}
+
+func TestContainerClientCheckBaseImageRejectsMissingPlatform(t *testing.T) {
+	reg := registry.New()
+	index := newTestRegistryRef(t, reg, "example/base:index")
+	pushTestBaseImage(t, index, nil, HostPlatform())
+	single := index.Context().Tag("single")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+	cf = cf.DeepCopy()
+	cf.OS, cf.Architecture = "linux", "s390x"
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatalf("set config failed: %v", err)
+	}
+	if err := remote.Write(single, img); err != nil {
+		t.Fatalf("push base image failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		base name.Reference
+		want string
+	}{
+		{base: index, want: "fetch base image"},
+		{base: single, want: "is linux/s390x, expected linux/riscv64"},
+	} {
+		containerClient, err := NewContainerClient(
+			context.Background(),
+			WithContainerDockerClient(&client.Client{}),
+			WithContainerKeychain(fakeKeychain{}),
+			WithContainerBaseImage(tt.base),
+		)
+		if err != nil {
+			t.Fatalf("create container client failed: %v", err)
+		}
+		err = containerClient.CheckBaseImage(
+			context.Background(),
+			[]*v1.Platform{ParsePlatform("linux/riscv64")},
+		)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("expected error containing %q for %s, got %v", tt.want, tt.base, err)
+		}
+	}
+}
+
+func TestMergeImageConfig(t *testing.T) {
+	base := v1.Config{
+		Env:          []string{"PATH=/usr/bin", "SSL_CERT_FILE=/etc/ssl/cert.pem"},
+		Cmd:          []string{"/bin/sh"},
+		User:         "root",
+		WorkingDir:   "/",
+		Labels:       map[string]string{"vendor": "distro", "version": "12"},
+		ExposedPorts: map[string]struct{}{"22/tcp": {}},
+	}
+	got := mergeImageConfig(base, v1.Config{
+		Env:          []string{"PATH=/nix/bin"},
+		Cmd:          []string{"/bin/app"},
+		User:         "1000",
+		Labels:       map[string]string{"version": "1.0"},
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+	})
+
+	wantEnv := []string{"PATH=/nix/bin", "SSL_CERT_FILE=/etc/ssl/cert.pem"}
+	if !slices.Equal(got.Env, wantEnv) {
+		t.Fatalf("expected env %q, got %q", wantEnv, got.Env)
+	}
+	if !slices.Equal(got.Cmd, []string{"/bin/app"}) || got.User != "1000" || got.WorkingDir != "/" {
+		t.Fatalf("expected the image cmd and user over the base workdir, got %+v", got)
+	}
+	if got.Labels["vendor"] != "distro" || got.Labels["version"] != "1.0" {
+		t.Fatalf("expected merged labels, got %v", got.Labels)
+	}
+	if _, ok := got.ExposedPorts["22/tcp"]; !ok || len(got.ExposedPorts) != 2 {
+		t.Fatalf("expected merged exposed ports, got %v", got.ExposedPorts)
+	}
+	if base.Labels["version"] != "12" {
+		t.Fatalf("expected the base config to be left unchanged, got %v", base.Labels)
+	}
+
+	if got := mergeImageConfig(base, v1.Config{}); !slices.Equal(got.Cmd, base.Cmd) {
+		t.Fatalf("expected the base cmd without an image entrypoint, got %q", got.Cmd)
+	}
+}
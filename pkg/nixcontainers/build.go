@@ -0,0 +1,171 @@
+package nixcontainers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// BuildRequest describes an image to build from a flake.
+type BuildRequest struct {
+	// Context is the flake reference or directory the image is built from.
+	Context string
+	// Reference is the image to push, load or write.
+	Reference name.Reference
+	// Source selects the flake package by the last path segment of its
+	// repository. It defaults to Reference.
+	Source name.Reference
+	// Package is the flake package the image is built from, overriding the
+	// one named after Source.
+	Package string
+	// Platforms are built concurrently into a multi-platform image when
+	// there are more than one.
+	Platforms []*v1.Platform
+}
+
+// BuildResult reports what a build produced.
+type BuildResult struct {
+	Reference name.Reference
+	// Digest is the digest of the pushed image, or of its index for a
+	// multi-platform image. It is zero when the image was not pushed.
+	Digest    v1.Hash
+	Platforms []PlatformResult
+	Duration  time.Duration
+	// Existing reports the tag was already in the registry, so nothing was
+	// built; Digest is the one it points to.
+	Existing bool
+}
+
+// PlatformResult reports the image of one platform of a build.
+type PlatformResult struct {
+	Platform *v1.Platform
+	// OutPath is the nix store path the image was built at, or the one
+	// annotated on a reused image.
+	OutPath string
+	// Digest is the digest of the pushed platform image, zero when it was
+	// not pushed.
+	Digest v1.Hash
+	// Reused reports the pushed image was kept instead of being built,
+	// either as an existing image or as unchanged.
+	Reused        bool
+	BuildDuration time.Duration
+	LoadDuration  time.Duration
+	PushDuration  time.Duration
+	// UploadedBytes counts the layer bytes the push uploaded, without those
+	// the registry already had or mounted.
+	UploadedBytes int64
+	// Size and UncompressedSize sum the layers of the image, zero when it
+	// could not be read.
+	Size             int64
+	UncompressedSize int64
+}
+
+// setSize records the sizes of the image summarized as s.
+func (r *PlatformResult) setSize(s imageSummary) {
+	r.Size = s.Size
+	r.UncompressedSize = s.UncompressedSize
+}
+
+// reusedPlatformResult describes the pushed image add kept for p.
+func reusedPlatformResult(p *v1.Platform, add mutate.IndexAddendum) PlatformResult {
+	result := PlatformResult{Platform: p, Digest: addendumDigest(add), Reused: true}
+	if img, ok := add.Add.(v1.Image); ok {
+		if m, err := img.Manifest(); err == nil {
+			result.OutPath = m.Annotations[nixOutPathAnnotation]
+		}
+	}
+	return result
+}
+
+// addendumDigest returns the digest of the image of add, zero when it is not
+// known.
+func addendumDigest(add mutate.IndexAddendum) v1.Hash {
+	if add.Add == nil {
+		return v1.Hash{}
+	}
+	digest, err := add.Add.Digest()
+	if err != nil {
+		return v1.Hash{}
+	}
+	return digest
+}
+
+// WithNixClient builds images with nix instead of a default NixClient.
+func WithNixClient(nix nixBuilderClient) BuildOption {
+	return func(o *buildOption) {
+		o.nix = nix
+	}
+}
+
+// WithContainerClient loads and pushes images with container instead of a
+// default ContainerClient.
+func WithContainerClient(container containerBuilderClient) BuildOption {
+	return func(o *buildOption) {
+		o.container = container
+	}
+}
+
+// Build builds the image of req with the given options, the way the build
+// command does. Clients that are not given are created with their defaults.
+func Build(ctx context.Context, req BuildRequest, opts ...BuildOption) (BuildResult, error) {
+	builder, done, err := newRequestBuilder(ctx, req, opts...)
+	if err != nil {
+		return BuildResult{}, err
+	}
+	defer done()
+	return builder.BuildAndPush(ctx, req.Context, req.Reference, req.Platforms)
+}
+
+// Render builds the image of req for its single platform and returns the
+// config and manifest it would be pushed with, after the same mutations as
+// Build, without loading or pushing it.
+func Render(ctx context.Context, req BuildRequest, opts ...BuildOption) (*RenderedImage, error) {
+	if len(req.Platforms) != 1 {
+		return nil, ClassifyError(
+			ConfigErrorClass,
+			fmt.Errorf("render requires a single platform, got %d", len(req.Platforms)),
+		)
+	}
+	builder, _, err := newRequestBuilder(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return builder.Render(ctx, req.Context, req.Reference, req.Platforms[0])
+}
+
+// newRequestBuilder returns the builder of req with the given options,
+// creating the clients that are not given with their defaults. done logs the
+// push summary of a created container client.
+func newRequestBuilder(
+	ctx context.Context,
+	req BuildRequest,
+	opts ...BuildOption,
+) (*Builder, func(), error) {
+	o := makeBuildOption(opts...)
+	nix := o.nix
+	if nix == nil {
+		nix = NewNixClient()
+	}
+	container := o.container
+	done := func() {}
+	if container == nil {
+		client, err := NewContainerClient(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create container client: %w", err)
+		}
+		done = func() { client.LogPushSummary(ctx) }
+		container = client
+	}
+	if req.Source != nil {
+		opts = append(slices.Clip(opts), WithSourceImage(req.Source))
+	}
+	if req.Package != "" {
+		opts = append(slices.Clip(opts), WithStreamImageOption(WithPackageName(req.Package)))
+	}
+	return NewBuilder(nix, container, opts...), done, nil
+}
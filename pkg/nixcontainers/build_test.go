@@ -0,0 +1,212 @@
+package nixcontainers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestBuildReportsPushedImage(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	source := mustParseReference(t, "ghcr.io/example/worker:latest")
+	digest := v1.Hash{Algorithm: "sha256", Hex: "0123456789abcdef"}
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/nix/store/abc-image.tar.gz", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return LoadedImage{Ref: source}, nil
+		},
+		PushImageFunc: func(
+			context.Context,
+			name.Reference,
+			*v1.Platform,
+			string,
+			map[string]string,
+		) (v1.Hash, error) {
+			return digest, nil
+		},
+		UploadedBytesFunc: func(name.Reference) int64 {
+			return 1234
+		},
+	}
+
+	result, err := Build(context.Background(), BuildRequest{
+		Context:   "/workspace",
+		Reference: ref,
+		Source:    source,
+		Platforms: []*v1.Platform{HostPlatform()},
+	}, WithNixClient(nixClient), WithContainerClient(containerClient), WithPush(true))
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	if result.Reference != ref || result.Digest != digest {
+		t.Fatalf("expected %s@%s, got %s@%s", ref, digest, result.Reference, result.Digest)
+	}
+	if len(result.Platforms) != 1 {
+		t.Fatalf("expected one platform result, got %+v", result.Platforms)
+	}
+	platform := result.Platforms[0]
+	if platform.OutPath != "/nix/store/abc-image.tar.gz" || platform.Digest != digest ||
+		platform.UploadedBytes != 1234 || platform.Reused {
+		t.Fatalf("unexpected platform result %+v", platform)
+	}
+	if result.Duration < platform.BuildDuration+platform.PushDuration {
+		t.Fatalf("expected the build duration to cover every phase, got %+v", result)
+	}
+	buildCalls := nixClient.BuildPlatformImageCalls()
+	if len(buildCalls) != 1 || buildCalls[0].Reference != source {
+		t.Fatalf("expected the package of %s to be built, got %+v", source, buildCalls)
+	}
+}
+
+func TestBuildReportsMultiplatformImage(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	existingRef := mustParseReference(t, "ghcr.io/example/app:arm64")
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	built, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create image failed: %v", err)
+	}
+	existing, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create image failed: %v", err)
+	}
+	existing = mutate.Annotations(existing, map[string]string{
+		nixOutPathAnnotation: "/nix/store/def-image.tar.gz",
+	}).(v1.Image)
+	index := v1.Hash{Algorithm: "sha256", Hex: "fedcba9876543210"}
+	nixClient := &mockNixBuilderClient{
+		EvalPackageSystemsFunc: evalEverySystem,
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/nix/store/abc-image.tar.gz", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		GetPlatformImageFunc: func(context.Context, name.Reference, *v1.Platform) (mutate.IndexAddendum, error) {
+			return mutate.IndexAddendum{Add: existing}, nil
+		},
+		PushPlatformImageFunc: func(context.Context, name.Reference, *v1.Platform, string, map[string]string) (mutate.IndexAddendum, error) {
+			return mutate.IndexAddendum{Add: built}, nil
+		},
+		PushManifestFunc: func(
+			context.Context,
+			name.Reference,
+			[]mutate.IndexAddendum,
+		) (v1.Hash, types.MediaType, error) {
+			return index, types.OCIImageIndex, nil
+		},
+	}
+
+	result, err := Build(context.Background(), BuildRequest{
+		Context:   "/workspace",
+		Reference: ref,
+		Platforms: []*v1.Platform{amd64, arm64},
+	},
+		WithNixClient(nixClient),
+		WithContainerClient(containerClient),
+		WithPush(true),
+		WithExistingPlatformImage(arm64, existingRef),
+	)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	if result.Digest != index {
+		t.Fatalf("expected index digest %s, got %s", index, result.Digest)
+	}
+	builtDigest, err := built.Digest()
+	if err != nil {
+		t.Fatalf("get image digest failed: %v", err)
+	}
+	existingDigest, err := existing.Digest()
+	if err != nil {
+		t.Fatalf("get image digest failed: %v", err)
+	}
+	want := []PlatformResult{
+		{Platform: amd64, OutPath: "/nix/store/abc-image.tar.gz", Digest: builtDigest},
+		{
+			Platform: arm64,
+			OutPath:  "/nix/store/def-image.tar.gz",
+			Digest:   existingDigest,
+			Reused:   true,
+		},
+	}
+	if len(result.Platforms) != len(want) {
+		t.Fatalf("expected %d platform results, got %+v", len(want), result.Platforms)
+	}
+	for i, got := range result.Platforms {
+		got.BuildDuration, got.PushDuration = 0, 0
+		if got != want[i] {
+			t.Fatalf("expected platform result %+v, got %+v", want[i], got)
+		}
+	}
+}
+
+func TestBuildReportsFailures(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/nix/store/abc-image.tar.gz", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return LoadedImage{Ref: ref}, nil
+		},
+		PushImageFunc: func(
+			context.Context,
+			name.Reference,
+			*v1.Platform,
+			string,
+			map[string]string,
+		) (v1.Hash, error) {
+			return v1.Hash{}, &transport.Error{StatusCode: http.StatusUnauthorized}
+		},
+	}
+	opts := []BuildOption{
+		WithNixClient(nixClient),
+		WithContainerClient(containerClient),
+		WithPush(true),
+		WithSkipPreflight(true),
+	}
+
+	result, err := Build(context.Background(), BuildRequest{
+		Context:   "/workspace",
+		Reference: ref,
+		Platforms: []*v1.Platform{HostPlatform()},
+	}, opts...)
+	if got := ErrorClassOf(err); got != AuthErrorClass {
+		t.Fatalf("expected class %s, got %s: %v", AuthErrorClass, got, err)
+	}
+	// The phases before the failed push are still reported.
+	if len(result.Platforms) != 1 ||
+		result.Platforms[0].OutPath != "/nix/store/abc-image.tar.gz" {
+		t.Fatalf("expected the built platform to be reported, got %+v", result.Platforms)
+	}
+
+	_, err = Build(context.Background(), BuildRequest{Context: "/workspace", Reference: ref}, opts...)
+	if got := ErrorClassOf(err); got != ConfigErrorClass {
+		t.Fatalf("expected class %s, got %s: %v", ConfigErrorClass, got, err)
+	}
+}
@@ -0,0 +1,1503 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+)
+
+// platformTagCleanupTimeout bounds the removal of intermediate platform tags,
+// which also runs after the build context is cancelled.
+const platformTagCleanupTimeout = 30 * time.Second
+
+// nixOutPathAnnotation records the nix out path an image was built from on
+// its manifest, so unchanged images can be detected without building them.
+const nixOutPathAnnotation = "studio.shikanime.nix/out-path"
+
+type BuildOption func(*buildOption)
+
+type buildOption struct {
+	nix       nixBuilderClient
+	container containerBuilderClient
+
+	imageOpts     []ImageOption
+	push          bool
+	skipPreflight bool
+	existing      []ExistingPlatformImage
+	source        name.Reference
+
+	keepPlatformImages bool
+	keepOnFailure      bool
+
+	smokeTester      SmokeTester
+	smokeTestArgs    []string
+	smokeTestTimeout time.Duration
+
+	load                 bool
+	outputOCI            string
+	skipUnchanged        bool
+	skipMissingPlatforms bool
+	pushByDigest         bool
+	ifNotExists          bool
+	failIfExists         bool
+	skipGCRoot           bool
+	kindCluster          string
+
+	summaryOutput io.Writer
+	baseImage     name.Reference
+	imageConfig   ImageConfig
+	extraLayers   []ExtraLayer
+}
+
+// ExistingPlatformImage is an already pushed image reused for a platform of a
+// multi-platform index instead of building it.
+type ExistingPlatformImage struct {
+	Platform *v1.Platform
+	Ref      name.Reference
+}
+
+func (e ExistingPlatformImage) String() string {
+	return fmt.Sprintf("%s=%s", e.Platform, e.Ref)
+}
+
+type nixBuilderClient interface {
+	GetImageBuilderType(context.Context, string) (BuilderType, error)
+	BuildPlatformImage(
+		context.Context,
+		string,
+		name.Reference,
+		*v1.Platform,
+		...ImageOption,
+	) (string, error)
+	EvalPlatformOutPath(
+		context.Context,
+		string,
+		name.Reference,
+		*v1.Platform,
+		...ImageOption,
+	) (string, error)
+	EvalPackageSystems(context.Context, string, name.Reference, ...ImageOption) ([]string, error)
+}
+
+type containerBuilderClient interface {
+	CheckPushPermission(context.Context, name.Reference) error
+	HeadImage(context.Context, name.Reference) (v1.Hash, bool, error)
+	TagImage(context.Context, LoadedImage, name.Reference) error
+	RemoveImage(context.Context, name.Reference) error
+	RenderImage(
+		context.Context,
+		name.Reference,
+		*v1.Platform,
+		string,
+		map[string]string,
+	) (*RenderedImage, error)
+	LoadImage(context.Context, name.Reference, string) (LoadedImage, error)
+	LoadStreamImage(context.Context, name.Reference, string) (LoadedImage, error)
+	LoadStreamImageArchive(context.Context, name.Reference, string, string) (LoadedImage, error)
+	LoadPlatformImage(context.Context, name.Reference, *v1.Platform, string) (LoadedImage, error)
+	LoadKindImage(context.Context, string, name.Reference, *v1.Platform, string) error
+	PushImage(
+		context.Context,
+		name.Reference,
+		*v1.Platform,
+		string,
+		map[string]string,
+	) (v1.Hash, error)
+	PushPlatformImage(
+		context.Context,
+		name.Reference,
+		*v1.Platform,
+		string,
+		map[string]string,
+	) (mutate.IndexAddendum, error)
+	PushManifest(
+		context.Context,
+		name.Reference,
+		[]mutate.IndexAddendum,
+	) (v1.Hash, types.MediaType, error)
+	GetPlatformImage(context.Context, name.Reference, *v1.Platform) (mutate.IndexAddendum, error)
+	GetLocalPlatformImage(
+		context.Context,
+		name.Reference,
+		*v1.Platform,
+		string,
+	) (mutate.IndexAddendum, error)
+	SaveStreamImage(context.Context, string, string) error
+	WriteLayout(string, name.Reference, []mutate.IndexAddendum) error
+	SummarizeLocalImage(string) (imageSummary, error)
+	UploadedBytes(name.Reference) int64
+}
+
+type Builder struct {
+	nix           nixBuilderClient
+	container     containerBuilderClient
+	imageOpts     []ImageOption
+	push          bool
+	skipPreflight bool
+	existing      []ExistingPlatformImage
+	source        name.Reference
+
+	keepPlatformImages bool
+	keepOnFailure      bool
+
+	smokeTester      SmokeTester
+	smokeTestArgs    []string
+	smokeTestTimeout time.Duration
+
+	load                 bool
+	outputOCI            string
+	skipUnchanged        bool
+	skipMissingPlatforms bool
+	pushByDigest         bool
+	ifNotExists          bool
+	failIfExists         bool
+	skipGCRoot           bool
+	kindCluster          string
+
+	summaryOutput io.Writer
+	baseImage     name.Reference
+	imageConfig   ImageConfig
+	extraLayers   []ExtraLayer
+}
+
+func NewBuilder(
+	nix nixBuilderClient,
+	container containerBuilderClient,
+	opts ...BuildOption,
+) *Builder {
+	o := makeBuildOption(opts...)
+	return &Builder{
+		nix:           nix,
+		container:     container,
+		imageOpts:     o.imageOpts,
+		push:          o.push,
+		skipPreflight: o.skipPreflight,
+		existing:      o.existing,
+		source:        o.source,
+
+		keepPlatformImages: o.keepPlatformImages,
+		keepOnFailure:      o.keepOnFailure,
+
+		smokeTester:      o.smokeTester,
+		smokeTestArgs:    o.smokeTestArgs,
+		smokeTestTimeout: o.smokeTestTimeout,
+
+		load:                 o.load,
+		outputOCI:            o.outputOCI,
+		skipUnchanged:        o.skipUnchanged,
+		skipMissingPlatforms: o.skipMissingPlatforms,
+		pushByDigest:         o.pushByDigest,
+		ifNotExists:          o.ifNotExists,
+		failIfExists:         o.failIfExists,
+		skipGCRoot:           o.skipGCRoot,
+		kindCluster:          o.kindCluster,
+
+		summaryOutput: o.summaryOutput,
+		baseImage:     o.baseImage,
+		imageConfig:   o.imageConfig,
+		extraLayers:   o.extraLayers,
+	}
+}
+
+func WithStreamImageOption(opt ImageOption) BuildOption {
+	return func(o *buildOption) { o.imageOpts = append(o.imageOpts, opt) }
+}
+
+func WithPush(push bool) BuildOption {
+	return func(o *buildOption) { o.push = push }
+}
+
+// WithSkipPreflight pushes without first checking the destination accepts
+// the credentials, for registries that reject the check itself.
+func WithSkipPreflight(skip bool) BuildOption {
+	return func(o *buildOption) { o.skipPreflight = skip }
+}
+
+// WithExistingPlatformImage reuses ref for platform p instead of building it.
+func WithExistingPlatformImage(p *v1.Platform, ref name.Reference) BuildOption {
+	return func(o *buildOption) {
+		o.existing = append(o.existing, ExistingPlatformImage{Platform: p, Ref: ref})
+	}
+}
+
+// WithSourceImage derives the flake package from ref, and tags the loaded
+// image with it, instead of using the destination image.
+func WithSourceImage(ref name.Reference) BuildOption {
+	return func(o *buildOption) { o.source = ref }
+}
+
+// WithKeepPlatformImages loads the platform images of a multi-platform push
+// into the daemon and keeps their tags, like WithLoad.
+func WithKeepPlatformImages(keep bool) BuildOption {
+	return func(o *buildOption) { o.keepPlatformImages = keep }
+}
+
+// WithKeepOnFailure keeps the loaded platform tags in the daemon when a
+// multi-platform build fails, for debugging.
+func WithKeepOnFailure(keep bool) BuildOption {
+	return func(o *buildOption) { o.keepOnFailure = keep }
+}
+
+// WithSmokeTest runs args in every built image with tester once it is loaded
+// and pushed, and fails the build when the command exits non-zero or runs
+// longer than timeout. Zero disables the timeout.
+func WithSmokeTest(tester SmokeTester, args []string, timeout time.Duration) BuildOption {
+	return func(o *buildOption) {
+		o.smokeTester = tester
+		o.smokeTestArgs = args
+		o.smokeTestTimeout = timeout
+	}
+}
+
+// WithLoad also loads the platform images of a multi-platform build into the
+// daemon, tagged per platform. Otherwise they are only pushed or written to
+// the OCI layout.
+func WithLoad(load bool) BuildOption {
+	return func(o *buildOption) { o.load = load }
+}
+
+// WithOutputOCI sets the OCI image layout directory a multi-platform build
+// that is not pushed is written to. A temporary directory is used when unset.
+func WithOutputOCI(dir string) BuildOption {
+	return func(o *buildOption) { o.outputOCI = dir }
+}
+
+// WithSkipUnchanged skips building and pushing a platform whose pushed image
+// was built from the same nix out path.
+func WithSkipUnchanged(skip bool) BuildOption {
+	return func(o *buildOption) { o.skipUnchanged = skip }
+}
+
+// WithSkipMissingPlatforms drops the platforms of a multi-platform build the
+// flake does not define the package for, instead of failing the build.
+func WithSkipMissingPlatforms(skip bool) BuildOption {
+	return func(o *buildOption) { o.skipMissingPlatforms = skip }
+}
+
+// WithPushByDigest smoke tests pushed images by digest, for a container
+// client pushing them without tags.
+func WithPushByDigest(byDigest bool) BuildOption {
+	return func(o *buildOption) { o.pushByDigest = byDigest }
+}
+
+// WithIfNotExists skips the build when the pushed tag already exists,
+// reporting the digest it points to instead.
+func WithIfNotExists(skip bool) BuildOption {
+	return func(o *buildOption) { o.ifNotExists = skip }
+}
+
+// WithFailIfExists fails the build before building when the pushed tag
+// already exists, for registries with immutable tags.
+func WithFailIfExists(fail bool) BuildOption {
+	return func(o *buildOption) { o.failIfExists = fail }
+}
+
+// WithKindCluster also loads the built image into every node of the kind
+// cluster, for local clusters pulling from no registry.
+func WithKindCluster(cluster string) BuildOption {
+	return func(o *buildOption) { o.kindCluster = cluster }
+}
+
+// WithSkipGCRoot builds without rooting the nix build result, leaving it to
+// the garbage collector while the image is loaded and pushed.
+func WithSkipGCRoot(skip bool) BuildOption {
+	return func(o *buildOption) { o.skipGCRoot = skip }
+}
+
+// WithImageSummaryOutput writes the size summary of every built image as a
+// table on w instead of logging it as a record.
+func WithImageSummaryOutput(w io.Writer) BuildOption {
+	return func(o *buildOption) { o.summaryOutput = w }
+}
+
+// WithBaseImage loads images into the daemon from their archive, appended
+// onto ref by the container client, rather than as nix built them.
+func WithBaseImage(ref name.Reference) BuildOption {
+	return func(o *buildOption) { o.baseImage = ref }
+}
+
+// WithImageConfig loads images into the daemon from their archive, with cfg
+// applied by the container client, so they match the pushed images.
+func WithImageConfig(cfg ImageConfig) BuildOption {
+	return func(o *buildOption) { o.imageConfig = cfg }
+}
+
+// WithExtraLayers loads images into the daemon from their archive, with
+// layers appended by the container client, so they match the pushed images.
+func WithExtraLayers(layers []ExtraLayer) BuildOption {
+	return func(o *buildOption) { o.extraLayers = layers }
+}
+
+func makeBuildOption(opts ...BuildOption) *buildOption {
+	o := &buildOption{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// BuildAndPush builds ref for plats from the flake at buildContext, then
+// pushes, loads or writes it as configured, and reports what was built.
+func (b *Builder) BuildAndPush(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	plats []*v1.Platform,
+) (BuildResult, error) {
+	ctx, span := startSpan(
+		ctx,
+		"build",
+		refAttribute(ref),
+		attribute.Int("nix_containers.platform_count", len(plats)),
+	)
+	start := time.Now()
+	result, err := b.buildAndPush(ctx, buildContext, ref, plats)
+	result.Reference = ref
+	result.Duration = time.Since(start)
+	endSpan(span, err)
+	return result, err
+}
+
+func (b *Builder) buildAndPush(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	plats []*v1.Platform,
+) (BuildResult, error) {
+	if len(plats) == 0 {
+		return BuildResult{}, ClassifyError(
+			ConfigErrorClass,
+			fmt.Errorf("at least one platform is required"),
+		)
+	}
+	for _, ex := range b.existing {
+		if !slices.ContainsFunc(plats, func(p *v1.Platform) bool {
+			return PlatformEquals(p, ex.Platform)
+		}) {
+			return BuildResult{}, ClassifyError(ConfigErrorClass, fmt.Errorf(
+				"existing image %s is for platform %s which is not requested",
+				ex.Ref,
+				ex.Platform,
+			))
+		}
+	}
+	if len(b.existing) > 0 && len(plats) == 1 {
+		return BuildResult{}, ClassifyError(
+			ConfigErrorClass,
+			fmt.Errorf("reusing existing images requires a multi-platform build"),
+		)
+	}
+	if b.kindCluster != "" && len(plats) > 1 {
+		return BuildResult{}, ClassifyError(
+			ConfigErrorClass,
+			fmt.Errorf("loading into kind cluster %s requires a single-platform build", b.kindCluster),
+		)
+	}
+	if b.push && !b.skipPreflight {
+		slog.InfoContext(ctx, "checking push permission", "ref", ref.Name())
+		// CheckPushPermission is used to fail fast if the user doesn't have credentials
+		// to push to the registry. This prevents running the expensive build process
+		// only to fail at the end.
+		// See: https://github.com/google/go-containerregistry/issues/412
+		if err := b.container.CheckPushPermission(ctx, ref); err != nil {
+			return BuildResult{}, classifyRegistryError(fmt.Errorf(
+				"registry rejected the push check for %s before building: %w "+
+					"(pass --skip-preflight to skip this check)",
+				ref.Name(),
+				err,
+			))
+		}
+	}
+	if b.push && (b.ifNotExists || b.failIfExists) {
+		digest, exists, err := b.container.HeadImage(ctx, ref)
+		if err != nil {
+			return BuildResult{}, classifyRegistryError(fmt.Errorf(
+				"check whether %s exists failed: %w",
+				ref.Name(),
+				err,
+			))
+		}
+		if exists && b.failIfExists {
+			return BuildResult{Digest: digest}, ClassifyError(PushErrorClass, fmt.Errorf(
+				"tag %s already exists at %s",
+				ref.Name(),
+				digest,
+			))
+		}
+		if exists {
+			slog.InfoContext(
+				ctx,
+				"tag already exists, skipping",
+				"ref",
+				ref.Name(),
+				"digest",
+				digest.String(),
+			)
+			return BuildResult{Digest: digest, Existing: true}, nil
+		}
+	}
+	if len(plats) == 1 {
+		slog.DebugContext(ctx, "build image", "ref", ref.Name(), "plat", plats[0])
+		return b.buildAndPushImage(ctx, buildContext, ref, plats[0])
+	}
+	plats, err := b.checkFlakePlatforms(ctx, buildContext, ref, plats)
+	if err != nil {
+		return BuildResult{}, err
+	}
+	slog.DebugContext(ctx, "build image", "ref", ref.Name(), "plats", plats)
+	return b.buildAndPushMultiplatformImage(ctx, buildContext, ref, plats)
+}
+
+// checkFlakePlatforms fails a multi-platform build before any platform is
+// built when the flake does not define the package of ref for some of plats,
+// or drops them with WithSkipMissingPlatforms. Reused platforms are not
+// built, so the flake need not define them.
+func (b *Builder) checkFlakePlatforms(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	plats []*v1.Platform,
+) ([]*v1.Platform, error) {
+	systems, err := b.nix.EvalPackageSystems(ctx, buildContext, b.sourceRef(ref), b.imageOpts...)
+	if err != nil {
+		return nil, ClassifyError(
+			EvalErrorClass,
+			fmt.Errorf("failed to evaluate the systems of %s: %w", ref.Name(), err),
+		)
+	}
+	var supported, missing []*v1.Platform
+	for _, p := range plats {
+		if b.findExistingImage(p) != nil || slices.Contains(systems, FormatSystemName(p)) {
+			supported = append(supported, p)
+		} else {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return plats, nil
+	}
+	pkg := makeImageOptions(b.imageOpts...).flakePackageName(b.sourceRef(ref))
+	if len(supported) == 0 {
+		return nil, ClassifyError(EvalErrorClass, fmt.Errorf(
+			"flake %s does not define package %s for any of platforms %v (systems: %v)",
+			buildContext,
+			pkg,
+			plats,
+			systems,
+		))
+	}
+	if !b.skipMissingPlatforms {
+		return nil, ClassifyError(EvalErrorClass, fmt.Errorf(
+			"flake %s does not define package %s for platforms %v (systems: %v); "+
+				"pass --skip-missing-platforms to build the others",
+			buildContext,
+			pkg,
+			missing,
+			systems,
+		))
+	}
+	slog.WarnContext(
+		ctx,
+		"skipping platforms the flake does not define the package for",
+		"ref", ref.Name(),
+		"package", pkg,
+		"missing", missing,
+		"platforms", supported,
+	)
+	return supported, nil
+}
+
+// buildPlatformPath builds the image package for p and resolves how its
+// output is turned into an image.
+func (b *Builder) buildPlatformPath(
+	ctx context.Context,
+	buildContext string,
+	p *v1.Platform,
+	ref name.Reference,
+) (string, BuilderType, func(), error) {
+	slog.InfoContext(ctx, "build image", "ref", ref.Name(), "os", p.OS, "arch", p.Architecture)
+
+	// The build result is linked in a directory removed once the image is
+	// loaded and pushed, so that a garbage collection running meanwhile
+	// keeps its store paths.
+	opts := b.imageOpts
+	unroot := func() {}
+	if !b.skipGCRoot {
+		rootDir, err := os.MkdirTemp("", "nix-containers-gcroot-*")
+		if err != nil {
+			return "", UnknownBuilderType, nil, fmt.Errorf(
+				"failed to create gc root directory: %w",
+				err,
+			)
+		}
+		unroot = func() { _ = os.RemoveAll(rootDir) }
+		opts = append(slices.Clip(opts), WithOutLink(filepath.Join(rootDir, "result")))
+	}
+	source := b.sourceRef(ref)
+	path, err := b.nix.BuildPlatformImage(
+		ctx,
+		buildContext,
+		source,
+		p,
+		opts...,
+	)
+	if err != nil {
+		unroot()
+		return "", UnknownBuilderType, nil, fmt.Errorf(
+			"build image failed: %w",
+			ClassifyError(BuildErrorClass, err),
+		)
+	}
+
+	builderType, err := b.nix.GetImageBuilderType(ctx, path)
+	if err != nil {
+		unroot()
+		return "", UnknownBuilderType, nil, fmt.Errorf(
+			"check image builder type failed: %w",
+			ClassifyError(ConfigErrorClass, err),
+		)
+	}
+	slog.InfoContext(
+		ctx,
+		"image builder type resolved",
+		"ref",
+		ref.Name(),
+		"platform",
+		FormatSystemName(p),
+		"builder_type",
+		builderType,
+		"path",
+		path,
+	)
+	return path, builderType, unroot, nil
+}
+
+// errStorePathCollected marks a failure caused by the built image vanishing
+// from the nix store.
+var errStorePathCollected = errors.New("garbage collected")
+
+// checkStorePath explains err, from reading the image built at path, when
+// path is no longer in the nix store, rather than leaving a bare missing
+// file error.
+func (b *Builder) checkStorePath(path string, err error) error {
+	if err == nil || errors.Is(err, errStorePathCollected) {
+		return err
+	}
+	if _, serr := os.Stat(path); !errors.Is(serr, fs.ErrNotExist) {
+		return err
+	}
+	hint := ""
+	if b.skipGCRoot {
+		hint = " (drop --skip-gc-root to root builds until they are pushed)"
+	}
+	return fmt.Errorf(
+		"nix store path %s was %w before the image was read%s: %w",
+		path,
+		errStorePathCollected,
+		hint,
+		err,
+	)
+}
+
+func (b *Builder) loadPlatformImage(
+	ctx context.Context,
+	p *v1.Platform,
+	ref name.Reference,
+	path string,
+	builderType BuilderType,
+) (LoadedImage, error) {
+	if b.rewritesImages() {
+		return b.loadRewrittenImage(ctx, p, ref, path, builderType)
+	}
+	if builderType == StreamBuilderType {
+		slog.InfoContext(
+			ctx,
+			"load stream image",
+			"ref",
+			ref.Name(),
+			"platform",
+			FormatSystemName(p),
+			"path",
+			path,
+		)
+		loaded, err := b.container.LoadStreamImage(ctx, ref, path)
+		return loaded, b.checkStorePath(path, err)
+	}
+	if builderType == TarGzBuilderType {
+		slog.InfoContext(
+			ctx,
+			"load archive image",
+			"ref",
+			ref.Name(),
+			"platform",
+			FormatSystemName(p),
+			"path",
+			path,
+		)
+		loaded, err := b.container.LoadImage(ctx, ref, path)
+		return loaded, b.checkStorePath(path, err)
+	}
+	// The runtime only loads archives, so a layout is read in-process.
+	if builderType == OCILayoutBuilderType {
+		slog.InfoContext(
+			ctx,
+			"load layout image",
+			"ref",
+			ref.Name(),
+			"platform",
+			FormatSystemName(p),
+			"path",
+			path,
+		)
+		loaded, err := b.container.LoadPlatformImage(ctx, ref, p, path)
+		return loaded, b.checkStorePath(path, err)
+	}
+
+	return LoadedImage{}, fmt.Errorf("unknown builder type: %d", builderType)
+}
+
+// rewritesImages reports whether images are changed in-process by the
+// container client, so they are loaded from their archive as they are pushed.
+func (b *Builder) rewritesImages() bool {
+	return b.baseImage != nil || !b.imageConfig.AsBuilt() || len(b.extraLayers) > 0
+}
+
+// loadRewrittenImage loads the image built at path onto the base image or
+// with its config overridden, both applied in-process, so stream images are
+// saved as an archive first.
+func (b *Builder) loadRewrittenImage(
+	ctx context.Context,
+	p *v1.Platform,
+	ref name.Reference,
+	path string,
+	builderType BuilderType,
+) (LoadedImage, error) {
+	archiveDir, err := os.MkdirTemp("", "nix-containers-archive-*")
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to create image archive directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(archiveDir) }()
+	return b.loadRewrittenArchive(
+		ctx,
+		p,
+		ref,
+		path,
+		builderType,
+		filepath.Join(archiveDir, "image.tar"),
+	)
+}
+
+// loadRewrittenArchive is loadRewrittenImage saving a stream image to the
+// archive path, which the caller removes.
+func (b *Builder) loadRewrittenArchive(
+	ctx context.Context,
+	p *v1.Platform,
+	ref name.Reference,
+	path string,
+	builderType BuilderType,
+	archive string,
+) (LoadedImage, error) {
+	archive, err := b.platformArchive(ctx, p, path, builderType, archive)
+	if err != nil {
+		return LoadedImage{}, err
+	}
+	slog.InfoContext(
+		ctx,
+		"load rewritten image",
+		"ref",
+		ref.Name(),
+		"platform",
+		FormatSystemName(p),
+		"path",
+		archive,
+	)
+	loaded, err := b.container.LoadPlatformImage(ctx, ref, p, archive)
+	return loaded, b.checkStorePath(path, err)
+}
+
+// loadCapturedStreamImage loads the stream image at path and writes its
+// archive to archive on the way, so the image is pushed from the archive
+// without running the script again or exporting it from the runtime.
+func (b *Builder) loadCapturedStreamImage(
+	ctx context.Context,
+	p *v1.Platform,
+	ref name.Reference,
+	path string,
+	archive string,
+) (LoadedImage, error) {
+	if b.rewritesImages() {
+		return b.loadRewrittenArchive(ctx, p, ref, path, StreamBuilderType, archive)
+	}
+	slog.InfoContext(
+		ctx,
+		"load stream image",
+		"ref",
+		ref.Name(),
+		"platform",
+		FormatSystemName(p),
+		"path",
+		path,
+		"archive",
+		archive,
+	)
+	loaded, err := b.container.LoadStreamImageArchive(ctx, ref, path, archive)
+	return loaded, b.checkStorePath(path, err)
+}
+
+func (b *Builder) buildAndPushMultiplatformImage(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	ps []*v1.Platform,
+) (_ BuildResult, err error) {
+	if !b.push {
+		return b.buildMultiplatformLayout(ctx, buildContext, ref, ps)
+	}
+	// Each platform pipeline writes its addendum at the platform index, so the
+	// index lists platforms in the requested order regardless of which
+	// pipeline finishes first.
+	adds := make([]mutate.IndexAddendum, len(ps))
+	pushed := make([]name.Reference, len(ps))
+	platforms := make([]PlatformResult, len(ps))
+	var platformTagsMu sync.Mutex
+	slog.InfoContext(ctx, "build multiplatform image", "ref", ref.Name(), "platform_count", len(ps))
+	var reused []string
+	// Platform images are pushed straight from their archives. They are only
+	// loaded into the daemon, and tagged per platform, when local copies are
+	// requested; the tags are then kept unless the build fails.
+	platformTags := map[string]name.Reference{}
+	cleanupCtx := context.WithoutCancel(ctx)
+	defer func() {
+		if err != nil && !b.keepOnFailure {
+			b.removePlatformTags(cleanupCtx, ref, platformTags)
+		}
+	}()
+	// Stream images are saved as archives here until they are pushed.
+	archiveDir, err := os.MkdirTemp("", "nix-containers-archive-*")
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("failed to create image archive directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(archiveDir) }()
+	wg, groupCtx := errgroup.WithContext(ctx)
+	for i, p := range ps {
+		platforms[i] = PlatformResult{Platform: p}
+		if ex := b.findExistingImage(p); ex != nil {
+			reused = append(reused, p.String())
+			wg.Go(func() error {
+				slog.InfoContext(
+					groupCtx,
+					"reuse platform image",
+					"ref",
+					ref.Name(),
+					"platform",
+					FormatSystemName(p),
+					"existing_ref",
+					ex.Ref.Name(),
+				)
+				add, err := b.container.GetPlatformImage(groupCtx, ex.Ref, p)
+				if err != nil {
+					return fmt.Errorf(
+						"reuse platform %s failed: %w",
+						p,
+						classifyRegistryError(err),
+					)
+				}
+				adds[i] = add
+				platforms[i] = reusedPlatformResult(p, add)
+				return nil
+			})
+			continue
+		}
+		wg.Go(func() error {
+			if add, ok := b.findUnchangedImage(groupCtx, buildContext, ref, p); ok {
+				adds[i] = add
+				platforms[i] = reusedPlatformResult(p, add)
+				return nil
+			}
+			slog.InfoContext(
+				groupCtx,
+				"platform pipeline started",
+				"ref",
+				ref.Name(),
+				"platform",
+				FormatSystemName(p),
+			)
+			platformTag := FormatPlatformReference(ref, p)
+			start := time.Now()
+			path, builderType, unroot, err := b.buildPlatformPath(groupCtx, buildContext, p, ref)
+			if err != nil {
+				return err
+			}
+			defer unroot()
+			platforms[i].OutPath = path
+			platforms[i].BuildDuration = time.Since(start)
+			if b.load || b.keepPlatformImages {
+				start := time.Now()
+				if err := b.loadPlatformTag(groupCtx, p, ref, platformTag, path, builderType); err != nil {
+					return err
+				}
+				platforms[i].LoadDuration = time.Since(start)
+				platformTagsMu.Lock()
+				platformTags[p.String()] = platformTag
+				platformTagsMu.Unlock()
+			}
+			archive := filepath.Join(archiveDir, fmt.Sprintf("%d.tar", i))
+			archivePath, err := b.platformArchive(groupCtx, p, path, builderType, archive)
+			if err != nil {
+				return err
+			}
+			platforms[i].setSize(b.logImageSummary(groupCtx, ref, p, archivePath))
+			slog.InfoContext(
+				groupCtx,
+				"push platform image",
+				"ref",
+				ref.Name(),
+				"platform",
+				FormatSystemName(p),
+				"platform_ref",
+				platformTag.Name(),
+			)
+			start = time.Now()
+			add, err := b.container.PushPlatformImage(
+				groupCtx,
+				platformTag,
+				p,
+				archivePath,
+				map[string]string{nixOutPathAnnotation: path},
+			)
+			if err != nil {
+				return b.checkStorePath(path, classifyRegistryError(err))
+			}
+			slog.InfoContext(
+				groupCtx,
+				"platform image pushed",
+				"ref",
+				ref.Name(),
+				"platform",
+				FormatSystemName(p),
+				"platform_ref",
+				platformTag.Name(),
+				"duration",
+				time.Since(start),
+			)
+			adds[i] = add
+			platforms[i].Digest = addendumDigest(add)
+			pushed[i] = b.pushedReference(platformTag, platforms[i].Digest)
+			platforms[i].PushDuration = time.Since(start)
+			platforms[i].UploadedBytes = b.container.UploadedBytes(platformTag)
+			slog.InfoContext(
+				groupCtx,
+				"platform pipeline completed",
+				"ref",
+				ref.Name(),
+				"platform",
+				FormatSystemName(p),
+			)
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		return BuildResult{Platforms: platforms}, fmt.Errorf("push images failed: %w", err)
+	}
+	var built, unchanged []string
+	for i, p := range ps {
+		if pushed[i] != nil {
+			built = append(built, p.String())
+		} else if b.findExistingImage(p) == nil {
+			unchanged = append(unchanged, p.String())
+		}
+	}
+	slog.InfoContext(ctx, "push manifest", "ref", ref.Name(), "platform_count", len(adds))
+	digest, mediaType, err := b.container.PushManifest(ctx, ref, adds)
+	if err != nil {
+		return BuildResult{Platforms: platforms}, classifyRegistryError(err)
+	}
+	slog.InfoContext(
+		ctx,
+		"manifest pushed",
+		"ref",
+		ref.Name(),
+		"platform_count",
+		len(adds),
+		"media_type",
+		mediaType,
+		"built_platforms",
+		built,
+		"reused_platforms",
+		reused,
+		"unchanged_platforms",
+		unchanged,
+	)
+	result := BuildResult{Digest: digest, Platforms: platforms}
+	for i, p := range ps {
+		if pushed[i] == nil {
+			continue
+		}
+		image := smokeTestImage{Loaded: platformTags[p.String()], Pushed: pushed[i], Platform: p}
+		if err := b.smokeTest(ctx, image); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// buildMultiplatformLayout builds every platform and writes the images and
+// their index to an OCI image layout instead of pushing them, since the
+// daemon cannot store manifest lists.
+func (b *Builder) buildMultiplatformLayout(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	ps []*v1.Platform,
+) (BuildResult, error) {
+	dir := b.outputOCI
+	if dir == "" {
+		var err error
+		dir, err = os.MkdirTemp("", "nix-containers-oci-*")
+		if err != nil {
+			return BuildResult{}, fmt.Errorf("failed to create oci layout directory: %w", err)
+		}
+	}
+	// Stream images are saved as archives here until the layout is written.
+	archiveDir, err := os.MkdirTemp("", "nix-containers-archive-*")
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("failed to create image archive directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(archiveDir) }()
+
+	slog.InfoContext(ctx, "build multiplatform layout", "ref", ref.Name(), "path", dir)
+	adds := make([]mutate.IndexAddendum, len(ps))
+	loaded := make([]name.Reference, len(ps))
+	platforms := make([]PlatformResult, len(ps))
+	wg, groupCtx := errgroup.WithContext(ctx)
+	for i, p := range ps {
+		platforms[i] = PlatformResult{Platform: p}
+		if ex := b.findExistingImage(p); ex != nil {
+			wg.Go(func() error {
+				add, err := b.container.GetPlatformImage(groupCtx, ex.Ref, p)
+				if err != nil {
+					return fmt.Errorf(
+						"reuse platform %s failed: %w",
+						p,
+						classifyRegistryError(err),
+					)
+				}
+				adds[i] = add
+				platforms[i] = reusedPlatformResult(p, add)
+				return nil
+			})
+			continue
+		}
+		wg.Go(func() error {
+			start := time.Now()
+			path, builderType, unroot, err := b.buildPlatformPath(groupCtx, buildContext, p, ref)
+			if err != nil {
+				return err
+			}
+			defer unroot()
+			platforms[i].OutPath = path
+			platforms[i].BuildDuration = time.Since(start)
+			if b.load {
+				platformTag := FormatPlatformReference(ref, p)
+				start := time.Now()
+				if err := b.loadPlatformTag(groupCtx, p, ref, platformTag, path, builderType); err != nil {
+					return err
+				}
+				platforms[i].LoadDuration = time.Since(start)
+				loaded[i] = platformTag
+			}
+			archive := filepath.Join(archiveDir, fmt.Sprintf("%d.tar", i))
+			path, err = b.platformArchive(groupCtx, p, path, builderType, archive)
+			if err != nil {
+				return err
+			}
+			platforms[i].setSize(b.logImageSummary(groupCtx, ref, p, path))
+			add, err := b.container.GetLocalPlatformImage(groupCtx, ref, p, path)
+			if err != nil {
+				return err
+			}
+			adds[i] = add
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		return BuildResult{Platforms: platforms}, fmt.Errorf("build images failed: %w", err)
+	}
+	if err := b.container.WriteLayout(dir, ref, adds); err != nil {
+		return BuildResult{Platforms: platforms}, err
+	}
+	slog.InfoContext(
+		ctx,
+		"oci layout written",
+		"ref",
+		ref.Name(),
+		"path",
+		dir,
+		"platform_count",
+		len(adds),
+	)
+	result := BuildResult{Platforms: platforms}
+	for i, p := range ps {
+		if loaded[i] == nil {
+			continue
+		}
+		image := smokeTestImage{Loaded: loaded[i], Platform: p}
+		if err := b.smokeTest(ctx, image); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// findUnchangedImage returns the image pushed to ref for p when it was built
+// from the same nix out path as the current flake evaluates to. Failing
+// checks are logged and the platform is rebuilt.
+func (b *Builder) findUnchangedImage(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	p *v1.Platform,
+) (mutate.IndexAddendum, bool) {
+	if !b.skipUnchanged {
+		return mutate.IndexAddendum{}, false
+	}
+	outPath, err := b.nix.EvalPlatformOutPath(
+		ctx,
+		buildContext,
+		b.sourceRef(ref),
+		p,
+		b.imageOpts...,
+	)
+	if err != nil {
+		slog.WarnContext(
+			ctx,
+			"evaluate out path failed, rebuilding",
+			"ref",
+			ref.Name(),
+			"platform",
+			FormatSystemName(p),
+			"err",
+			err,
+		)
+		return mutate.IndexAddendum{}, false
+	}
+	add, err := b.container.GetPlatformImage(ctx, ref, p)
+	if err != nil {
+		slog.InfoContext(
+			ctx,
+			"no pushed image to compare, rebuilding",
+			"ref",
+			ref.Name(),
+			"platform",
+			FormatSystemName(p),
+			"err",
+			err,
+		)
+		return mutate.IndexAddendum{}, false
+	}
+	pushedOutPath := ""
+	if img, ok := add.Add.(v1.Image); ok {
+		if m, err := img.Manifest(); err == nil {
+			pushedOutPath = m.Annotations[nixOutPathAnnotation]
+		}
+	}
+	if pushedOutPath != outPath {
+		slog.InfoContext(
+			ctx,
+			"image changed",
+			"ref",
+			ref.Name(),
+			"platform",
+			FormatSystemName(p),
+			"out_path",
+			outPath,
+			"pushed_out_path",
+			pushedOutPath,
+		)
+		return mutate.IndexAddendum{}, false
+	}
+	slog.InfoContext(
+		ctx,
+		"up to date",
+		"ref",
+		ref.Name(),
+		"platform",
+		FormatSystemName(p),
+		"out_path",
+		outPath,
+	)
+	return add, true
+}
+
+// loadPlatformTag loads the image built at path into the daemon and tags it
+// as platformTag.
+func (b *Builder) loadPlatformTag(
+	ctx context.Context,
+	p *v1.Platform,
+	ref name.Reference,
+	platformTag name.Reference,
+	path string,
+	builderType BuilderType,
+) error {
+	loaded, err := b.loadPlatformImage(ctx, p, ref, path, builderType)
+	if err != nil {
+		return ClassifyError(LoadErrorClass, err)
+	}
+	slog.InfoContext(
+		ctx,
+		"tag platform image",
+		"ref",
+		ref.Name(),
+		"platform",
+		FormatSystemName(p),
+		"loaded",
+		loaded.String(),
+		"platform_ref",
+		platformTag.Name(),
+	)
+	if err := b.container.TagImage(ctx, loaded, platformTag); err != nil {
+		return fmt.Errorf("tag image failed: %w", ClassifyError(LoadErrorClass, err))
+	}
+	return nil
+}
+
+// platformArchive returns the image archive built at path, saving the output
+// of stream images to archive so it can be read in-process.
+func (b *Builder) platformArchive(
+	ctx context.Context,
+	p *v1.Platform,
+	path string,
+	builderType BuilderType,
+	archive string,
+) (string, error) {
+	if builderType != StreamBuilderType {
+		return path, nil
+	}
+	slog.InfoContext(
+		ctx,
+		"save stream image",
+		"platform",
+		FormatSystemName(p),
+		"path",
+		path,
+		"archive",
+		archive,
+	)
+	if err := b.container.SaveStreamImage(ctx, path, archive); err != nil {
+		return "", b.checkStorePath(path, err)
+	}
+	return archive, nil
+}
+
+func (b *Builder) buildAndPushImage(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	p *v1.Platform,
+) (BuildResult, error) {
+	if b.push {
+		if add, ok := b.findUnchangedImage(ctx, buildContext, ref, p); ok {
+			platform := reusedPlatformResult(p, add)
+			return BuildResult{Digest: platform.Digest, Platforms: []PlatformResult{platform}}, nil
+		}
+	}
+	platform := PlatformResult{Platform: p}
+	// A failed build still reports the phases it went through.
+	failed := func(err error) (BuildResult, error) {
+		return BuildResult{Platforms: []PlatformResult{platform}}, err
+	}
+	start := time.Now()
+	path, builderType, unroot, err := b.buildPlatformPath(ctx, buildContext, p, ref)
+	if err != nil {
+		return failed(fmt.Errorf("build flake image failed: %w", err))
+	}
+	defer unroot()
+	platform.OutPath = path
+	platform.BuildDuration = time.Since(start)
+	start = time.Now()
+	// A stream image only exists while its script runs, so a pushed one, or
+	// one loaded into kind, is captured as an archive as it is loaded, removed
+	// once shipped.
+	archive := path
+	var loaded LoadedImage
+	if (b.push || b.kindCluster != "") && builderType == StreamBuilderType {
+		archiveDir, err := os.MkdirTemp("", "nix-containers-archive-*")
+		if err != nil {
+			return failed(fmt.Errorf("failed to create image archive directory: %w", err))
+		}
+		defer func() { _ = os.RemoveAll(archiveDir) }()
+		archive = filepath.Join(archiveDir, "image.tar")
+		loaded, err = b.loadCapturedStreamImage(ctx, p, ref, path, archive)
+	} else {
+		loaded, err = b.loadPlatformImage(ctx, p, ref, path, builderType)
+	}
+	if err != nil {
+		return failed(fmt.Errorf(
+			"build flake image failed: %w",
+			ClassifyError(LoadErrorClass, err),
+		))
+	}
+	platform.LoadDuration = time.Since(start)
+	// An uncaptured stream image is written straight to the runtime.
+	if archive != path || builderType != StreamBuilderType {
+		platform.setSize(b.logImageSummary(ctx, ref, p, archive))
+	}
+	// An untagged image is only known by ID, so it is always tagged.
+	if source := b.sourceRef(ref); loaded.Ref != source {
+		slog.DebugContext(ctx, "tag image", "ref", source.Name(), "loaded", loaded.String())
+		if err = b.container.TagImage(ctx, loaded, source); err != nil {
+			return failed(fmt.Errorf(
+				"tag image failed: %w",
+				ClassifyError(LoadErrorClass, err),
+			))
+		}
+	}
+	if b.kindCluster != "" {
+		start := time.Now()
+		err := b.container.LoadKindImage(ctx, b.kindCluster, b.sourceRef(ref), p, archive)
+		platform.LoadDuration += time.Since(start)
+		if err != nil {
+			return failed(fmt.Errorf(
+				"load kind image failed: %w",
+				ClassifyError(LoadErrorClass, err),
+			))
+		}
+	}
+	image := smokeTestImage{Loaded: b.sourceRef(ref), Platform: p}
+	if b.push {
+		slog.DebugContext(ctx, "push image", "ref", ref.Name())
+		annotations := map[string]string{nixOutPathAnnotation: path}
+		start := time.Now()
+		digest, err := b.container.PushImage(ctx, ref, p, archive, annotations)
+		platform.PushDuration = time.Since(start)
+		platform.UploadedBytes = b.container.UploadedBytes(ref)
+		if err != nil {
+			return failed(b.checkStorePath(path, classifyRegistryError(err)))
+		}
+		platform.Digest = digest
+		image.Pushed = b.pushedReference(ref, digest)
+	}
+	result := BuildResult{Digest: platform.Digest, Platforms: []PlatformResult{platform}}
+	return result, b.smokeTest(ctx, image)
+}
+
+// Render builds the image of ref for p and returns the config and manifest it
+// would be pushed with, stopping before it is loaded or pushed.
+func (b *Builder) Render(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	p *v1.Platform,
+) (*RenderedImage, error) {
+	path, builderType, unroot, err := b.buildPlatformPath(ctx, buildContext, p, ref)
+	if err != nil {
+		return nil, fmt.Errorf("build flake image failed: %w", err)
+	}
+	defer unroot()
+	archiveDir, err := os.MkdirTemp("", "nix-containers-archive-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image archive directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(archiveDir) }()
+	archive, err := b.platformArchive(
+		ctx,
+		p,
+		path,
+		builderType,
+		filepath.Join(archiveDir, "image.tar"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("build flake image failed: %w", ClassifyError(LoadErrorClass, err))
+	}
+	annotations := map[string]string{nixOutPathAnnotation: path}
+	rendered, err := b.container.RenderImage(ctx, ref, p, archive, annotations)
+	if err != nil {
+		return nil, fmt.Errorf("render image failed: %w", err)
+	}
+	return rendered, nil
+}
+
+// pushedReference returns the reference the image with the digest digest was
+// pushed to for ref: its digest in push-by-digest mode, or else ref.
+func (b *Builder) pushedReference(ref name.Reference, digest v1.Hash) name.Reference {
+	if !b.pushByDigest {
+		return ref
+	}
+	return ref.Context().Digest(digest.String())
+}
+
+// logImageSummary reports the layers and sizes of the image archive at path
+// before it is shipped, and returns them. A failure is only logged, since the
+// image is fine, and returns an empty summary.
+func (b *Builder) logImageSummary(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+) imageSummary {
+	s, err := b.container.SummarizeLocalImage(path)
+	if err != nil {
+		slog.WarnContext(
+			ctx,
+			"image size summary failed",
+			"ref",
+			ref.Name(),
+			"platform",
+			FormatSystemName(p),
+			"err",
+			err,
+		)
+		return imageSummary{}
+	}
+	if b.summaryOutput != nil {
+		var table bytes.Buffer
+		_ = s.writeTable(&table, fmt.Sprintf("image %s for %s", ref.Name(), p))
+		_, _ = b.summaryOutput.Write(table.Bytes())
+		return s
+	}
+	slog.InfoContext(
+		ctx,
+		"image size summary",
+		"ref",
+		ref.Name(),
+		"platform",
+		FormatSystemName(p),
+		"layers",
+		len(s.Layers),
+		"size_bytes",
+		s.Size,
+		"uncompressed_size_bytes",
+		s.UncompressedSize,
+		"largest_layers",
+		s.largest(imageSummaryLargestLayers),
+	)
+	return s
+}
+
+// smokeTest runs the smoke test command in image, if one is configured. An
+// image the tester cannot run is skipped with a warning.
+func (b *Builder) smokeTest(ctx context.Context, image smokeTestImage) error {
+	if b.smokeTester == nil {
+		return nil
+	}
+	slog.InfoContext(
+		ctx,
+		"run smoke test",
+		"ref",
+		image.ref().Name(),
+		"platform",
+		FormatSystemName(image.Platform),
+		"command",
+		b.smokeTestArgs,
+	)
+	ctx, cancel := PhaseTimeoutContext(ctx, "smoke test", b.smokeTestTimeout)
+	defer cancel()
+	result, err := b.smokeTester.SmokeTest(ctx, image, b.smokeTestArgs)
+	if errors.Is(err, errSmokeTestPlatformMismatch) {
+		slog.WarnContext(
+			ctx,
+			"smoke test skipped",
+			"ref",
+			image.ref().Name(),
+			"platform",
+			FormatSystemName(image.Platform),
+			"reason",
+			err,
+		)
+		return nil
+	}
+	if err != nil {
+		return ClassifyError(
+			SmokeTestErrorClass,
+			WrapPhaseTimeout(ctx, fmt.Errorf("smoke test failed: %w", err)),
+		)
+	}
+	slog.InfoContext(
+		ctx,
+		"smoke test completed",
+		"ref",
+		image.ref().Name(),
+		"platform",
+		FormatSystemName(image.Platform),
+		"exit_code",
+		result.ExitCode,
+		"output",
+		result.Output,
+	)
+	if result.ExitCode != 0 {
+		return ClassifyError(SmokeTestErrorClass, fmt.Errorf(
+			"smoke test failed: %s exited with code %d on %s",
+			b.smokeTestArgs[0],
+			result.ExitCode,
+			FormatSystemName(image.Platform),
+		))
+	}
+	return nil
+}
+
+// removePlatformTags removes intermediate platform tags from the daemon.
+// Failures are only logged since the pushed images do not depend on them.
+func (b *Builder) removePlatformTags(
+	ctx context.Context,
+	ref name.Reference,
+	tags map[string]name.Reference,
+) {
+	ctx, cancel := context.WithTimeout(ctx, platformTagCleanupTimeout)
+	defer cancel()
+	for platform, tag := range tags {
+		slog.InfoContext(
+			ctx,
+			"remove platform image",
+			"ref",
+			ref.Name(),
+			"platform",
+			platform,
+			"platform_ref",
+			tag.Name(),
+		)
+		if err := b.container.RemoveImage(ctx, tag); err != nil {
+			slog.WarnContext(
+				ctx,
+				"remove platform image failed",
+				"platform_ref",
+				tag.Name(),
+				"err",
+				err,
+			)
+		}
+	}
+}
+
+// sourceRef returns the image the flake package is derived from, which is
+// the destination ref unless a source image is set.
+func (b *Builder) sourceRef(ref name.Reference) name.Reference {
+	if b.source != nil {
+		return b.source
+	}
+	return ref
+}
+
+func (b *Builder) findExistingImage(p *v1.Platform) *ExistingPlatformImage {
+	for i := range b.existing {
+		if PlatformEquals(b.existing[i].Platform, p) {
+			return &b.existing[i]
+		}
+	}
+	return nil
+}
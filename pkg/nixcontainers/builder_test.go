@@ -0,0 +1,1472 @@
+//go:generate go run github.com/matryer/moq@v0.7.1 -rm -stub -out builder_moq_test.go . nixBuilderClient:mockNixBuilderClient containerBuilderClient:mockContainerBuilderClient
+
+package nixcontainers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func mustParseReference(t *testing.T, raw string) name.Reference {
+	t.Helper()
+
+	ref, err := name.ParseReference(raw)
+	if err != nil {
+		t.Fatalf("parse reference failed: %v", err)
+	}
+	return ref
+}
+
+// evalEverySystem is the EvalPackageSystemsFunc of a flake defining the
+// package for every system the tests build.
+func evalEverySystem(context.Context, string, name.Reference, ...ImageOption) ([]string, error) {
+	return []string{"aarch64-linux", "armv7l-linux", "riscv64-linux", "x86_64-linux"}, nil
+}
+
+func TestBuilderBuildAndPushReturnsPermissionErrorBeforeBuild(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plat := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	nixClient := &mockNixBuilderClient{}
+	containerClient := &mockContainerBuilderClient{
+		CheckPushPermissionFunc: func(context.Context, name.Reference) error {
+			return errors.New("no credentials")
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true))
+	_, err := builder.BuildAndPush(context.Background(), "/workspace", ref, []*v1.Platform{plat})
+	if err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Fatalf("expected permission error, got %v", err)
+	}
+	if len(nixClient.BuildPlatformImageCalls()) != 0 {
+		t.Fatalf(
+			"expected nix build to be skipped, got %d calls",
+			len(nixClient.BuildPlatformImageCalls()),
+		)
+	}
+	if len(containerClient.CheckPushPermissionCalls()) != 1 {
+		t.Fatalf(
+			"expected one permission check, got %d",
+			len(containerClient.CheckPushPermissionCalls()),
+		)
+	}
+}
+
+func TestBuilderBuildAndPushSinglePlatformStreamFlow(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	loadedRef := mustParseReference(t, "ghcr.io/example/app:loaded")
+	plat := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return StreamBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadStreamImageArchiveFunc: func(_ context.Context, _ name.Reference, _, dest string) (LoadedImage, error) {
+			return LoadedImage{Ref: loadedRef}, os.WriteFile(dest, []byte("image archive"), 0o644)
+		},
+		PushImageFunc: func(
+			_ context.Context,
+			_ name.Reference,
+			_ *v1.Platform,
+			path string,
+			_ map[string]string,
+		) (v1.Hash, error) {
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("expected the captured archive to exist while pushing: %v", err)
+			}
+			return v1.Hash{}, nil
+		},
+	}
+
+	builder := NewBuilder(
+		nixClient,
+		containerClient,
+		WithPush(true),
+		WithStreamImageOption(WithAcceptFlakeConfig()),
+	)
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		ref,
+		[]*v1.Platform{plat},
+	); err != nil {
+		t.Fatalf("build and push failed: %v", err)
+	}
+
+	buildCalls := nixClient.BuildPlatformImageCalls()
+	typeCalls := nixClient.GetImageBuilderTypeCalls()
+	if len(buildCalls) != 1 || len(typeCalls) != 1 {
+		t.Fatalf(
+			"expected one nix build/type check, got build=%d type=%d",
+			len(buildCalls),
+			len(typeCalls),
+		)
+	}
+	if len(buildCalls[0].ImageOptions) != 2 {
+		t.Fatalf("expected image options to flow through builder")
+	}
+	if typeCalls[0].S != "/tmp/result" {
+		t.Fatalf("expected the builder type detected from the out path, got %s", typeCalls[0].S)
+	}
+	outLink := makeImageOptions(buildCalls[0].ImageOptions...).outLink
+	if outLink == "" {
+		t.Fatalf("expected the build result to be rooted with an out link")
+	}
+	if _, err := os.Stat(filepath.Dir(outLink)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the gc root to be removed after the push, got %v", err)
+	}
+	loadStreamCalls := containerClient.LoadStreamImageArchiveCalls()
+	if len(loadStreamCalls) != 1 || loadStreamCalls[0].S1 != "/tmp/result" {
+		t.Fatalf("expected one stream load from /tmp/result, got %+v", loadStreamCalls)
+	}
+	if len(containerClient.LoadImageCalls()) != 0 {
+		t.Fatalf(
+			"expected archive loader to be unused, got %d calls",
+			len(containerClient.LoadImageCalls()),
+		)
+	}
+	tagCalls := containerClient.TagImageCalls()
+	if len(tagCalls) != 1 || tagCalls[0].LoadedImage.Ref.Name() != loadedRef.Name() ||
+		tagCalls[0].Reference.Name() != ref.Name() {
+		t.Fatalf("expected image tag from %s to %s", loadedRef.Name(), ref.Name())
+	}
+	pushImageCalls := containerClient.PushImageCalls()
+	if len(pushImageCalls) != 1 || pushImageCalls[0].Reference.Name() != ref.Name() {
+		t.Fatalf(
+			"expected pushed ref %s, got calls=%d ref=%v",
+			ref.Name(),
+			len(pushImageCalls),
+			pushImageCalls[0].Reference,
+		)
+	}
+	// The image is pushed from the archive captured as it was loaded, with the
+	// out path of the script annotated.
+	archive := loadStreamCalls[0].S2
+	if pushImageCalls[0].S != archive ||
+		pushImageCalls[0].StringToString[nixOutPathAnnotation] != "/tmp/result" {
+		t.Fatalf("expected the push from %s of /tmp/result, got %+v", archive, pushImageCalls[0])
+	}
+	if _, err := os.Stat(archive); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the captured archive to be removed, got %v", err)
+	}
+}
+
+func TestBuilderBuildAndPushTagsUntaggedImageByID(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	loaded := LoadedImage{ID: "sha256:" + strings.Repeat("a", 64)}
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return StreamBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadStreamImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return loaded, nil
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient)
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		ref,
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+	); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	tagCalls := containerClient.TagImageCalls()
+	if len(tagCalls) != 1 || tagCalls[0].LoadedImage != loaded ||
+		tagCalls[0].Reference.Name() != ref.Name() {
+		t.Fatalf("expected image %s to be tagged as %s, got %+v", loaded, ref.Name(), tagCalls)
+	}
+}
+
+func TestBuilderBuildLoadsOCILayoutInProcess(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return OCILayoutBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadPlatformImageFunc: func(context.Context, name.Reference, *v1.Platform, string) (LoadedImage, error) {
+			return LoadedImage{Ref: ref}, nil
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient)
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		ref,
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+	); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	loadCalls := containerClient.LoadPlatformImageCalls()
+	if len(loadCalls) != 1 || loadCalls[0].S != "/tmp/result" {
+		t.Fatalf("expected the layout at /tmp/result loaded in-process, got %+v", loadCalls)
+	}
+	if n := len(containerClient.LoadImageCalls()) + len(containerClient.LoadStreamImageCalls()); n != 0 {
+		t.Fatalf("expected no archive or stream load, got %d", n)
+	}
+	if n := len(containerClient.SummarizeLocalImageCalls()); n != 1 {
+		t.Fatalf("expected the layout image summarized, got %d", n)
+	}
+}
+
+func TestBuilderBuildRejectsUnsupportedOutput(t *testing.T) {
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return UnknownBuilderType, errors.New("nix output /tmp/result is an empty file")
+		},
+	}
+	containerClient := &mockContainerBuilderClient{}
+
+	builder := NewBuilder(nixClient, containerClient)
+	_, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+	)
+	if ErrorClassOf(err) != ConfigErrorClass {
+		t.Fatalf("expected a config error, got %v", err)
+	}
+}
+
+func TestBuilderBuildMultiplatformWritesLayout(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	if err := tarball.WriteToFile(archive, ref, img); err != nil {
+		t.Fatalf("write image archive failed: %v", err)
+	}
+	// The stream script of the fake stream image is the archive it outputs.
+	stream := filepath.Join(t.TempDir(), "stream-image")
+	raw, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("read image archive failed: %v", err)
+	}
+	if err := os.WriteFile(stream, raw, 0o600); err != nil {
+		t.Fatalf("write stream image failed: %v", err)
+	}
+	registryClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	for _, load := range []bool{false, true} {
+		t.Run(fmt.Sprintf("load=%t", load), func(t *testing.T) {
+			nixClient, containerClient := newPlatformTagTestClients(t, "")
+			nixClient.BuildPlatformImageFunc = func(_ context.Context, _ string, _ name.Reference, p *v1.Platform, _ ...ImageOption) (string, error) {
+				if p.Architecture == "arm64" {
+					return stream, nil
+				}
+				return archive, nil
+			}
+			nixClient.GetImageBuilderTypeFunc = func(_ context.Context, path string) (BuilderType, error) {
+				if path == stream {
+					return StreamBuilderType, nil
+				}
+				return TarGzBuilderType, nil
+			}
+			containerClient.LoadStreamImageFunc = func(context.Context, name.Reference, string) (LoadedImage, error) {
+				return LoadedImage{Ref: mustParseReference(t, "ghcr.io/example/app:loaded")}, nil
+			}
+			containerClient.SaveStreamImageFunc = func(_ context.Context, path, dest string) error {
+				raw, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(dest, raw, 0o600)
+			}
+			containerClient.GetLocalPlatformImageFunc = registryClient.GetLocalPlatformImage
+			containerClient.WriteLayoutFunc = registryClient.WriteLayout
+
+			dir := filepath.Join(t.TempDir(), "oci")
+			builder := NewBuilder(
+				nixClient,
+				containerClient,
+				WithLoad(load),
+				WithOutputOCI(dir),
+			)
+			if _, err := builder.BuildAndPush(
+				context.Background(),
+				"/workspace",
+				ref,
+				plats,
+			); err != nil {
+				t.Fatalf("build failed: %v", err)
+			}
+
+			if n := len(containerClient.PushPlatformImageCalls()); n != 0 {
+				t.Fatalf("expected no push, got %d", n)
+			}
+			if n := len(containerClient.SaveStreamImageCalls()); n != 1 {
+				t.Fatalf("expected the stream image saved once, got %d", n)
+			}
+			loads := len(containerClient.LoadImageCalls()) + len(containerClient.LoadStreamImageCalls())
+			tags := containerClient.TagImageCalls()
+			if !load && (loads != 0 || len(tags) != 0) {
+				t.Fatalf("expected no daemon load, got %d loads and %d tags", loads, len(tags))
+			}
+			if load && (loads != 2 || len(tags) != 2) {
+				t.Fatalf("expected platform images loaded, got %d loads and %d tags", loads, len(tags))
+			}
+			if n := len(containerClient.RemoveImageCalls()); n != 0 {
+				t.Fatalf("expected loaded platform images kept, got %d removals", n)
+			}
+
+			lp, err := layout.FromPath(dir)
+			if err != nil {
+				t.Fatalf("open oci layout failed: %v", err)
+			}
+			root, err := lp.ImageIndex()
+			if err != nil {
+				t.Fatalf("read oci layout failed: %v", err)
+			}
+			rootManifest, err := root.IndexManifest()
+			if err != nil {
+				t.Fatalf("read oci layout index failed: %v", err)
+			}
+			if len(rootManifest.Manifests) != 1 ||
+				rootManifest.Manifests[0].Annotations[OCIRefNameAnnotation] != "latest" {
+				t.Fatalf("expected one index named latest, got %+v", rootManifest.Manifests)
+			}
+			idx, err := root.ImageIndex(rootManifest.Manifests[0].Digest)
+			if err != nil {
+				t.Fatalf("read platform index failed: %v", err)
+			}
+			manifest, err := idx.IndexManifest()
+			if err != nil {
+				t.Fatalf("read platform index manifest failed: %v", err)
+			}
+			if len(manifest.Manifests) != len(plats) {
+				t.Fatalf("expected %d manifests, got %d", len(plats), len(manifest.Manifests))
+			}
+			for i, desc := range manifest.Manifests {
+				if !PlatformEquals(desc.Platform, plats[i]) {
+					t.Fatalf("expected manifest %d for %s, got %s", i, plats[i], desc.Platform)
+				}
+			}
+		})
+	}
+}
+
+func TestBuilderRender(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plat := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/nix/store/abc-app.tar", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return StreamBuilderType, nil
+		},
+	}
+	want := &RenderedImage{Config: &v1.ConfigFile{Architecture: "amd64", OS: "linux"}}
+	containerClient := &mockContainerBuilderClient{
+		SaveStreamImageFunc: func(_ context.Context, _, dest string) error {
+			return os.WriteFile(dest, []byte("image archive"), 0o600)
+		},
+		RenderImageFunc: func(_ context.Context, _ name.Reference, _ *v1.Platform, path string, _ map[string]string) (*RenderedImage, error) {
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("expected the saved archive to exist while rendering: %v", err)
+			}
+			return want, nil
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true), WithLoad(true))
+	got, err := builder.Render(context.Background(), "/workspace", ref, plat)
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if got != want {
+		t.Fatalf("expected the rendered image of the container client, got %+v", got)
+	}
+	calls := containerClient.RenderImageCalls()
+	if len(calls) != 1 || calls[0].StringToString[nixOutPathAnnotation] != "/nix/store/abc-app.tar" {
+		t.Fatalf("expected one render annotated with the nix out path, got %+v", calls)
+	}
+	if len(containerClient.LoadStreamImageCalls()) != 0 || len(containerClient.PushImageCalls()) != 0 {
+		t.Fatal("expected render to neither load nor push the image")
+	}
+}
+
+func TestBuilderBuildAndPushLoadsKindCluster(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plat := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return StreamBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadStreamImageArchiveFunc: func(_ context.Context, ref name.Reference, _, dest string) (LoadedImage, error) {
+			return LoadedImage{Ref: ref}, os.WriteFile(dest, []byte("image archive"), 0o644)
+		},
+		LoadKindImageFunc: func(_ context.Context, _ string, _ name.Reference, _ *v1.Platform, path string) error {
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("expected the captured archive to exist while loading into kind: %v", err)
+			}
+			return nil
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithKindCluster("dev"))
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		ref,
+		[]*v1.Platform{plat},
+	); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	loadStreamCalls := containerClient.LoadStreamImageArchiveCalls()
+	kindCalls := containerClient.LoadKindImageCalls()
+	if len(loadStreamCalls) != 1 || len(kindCalls) != 1 {
+		t.Fatalf(
+			"expected one captured stream load and kind load, got stream=%d kind=%d",
+			len(loadStreamCalls),
+			len(kindCalls),
+		)
+	}
+	if kindCalls[0].S1 != "dev" || kindCalls[0].Reference.Name() != ref.Name() ||
+		kindCalls[0].S2 != loadStreamCalls[0].S2 {
+		t.Fatalf("expected %s loaded into dev from the captured archive, got %+v", ref.Name(), kindCalls[0])
+	}
+	if len(containerClient.PushImageCalls()) != 0 {
+		t.Fatalf("expected no push without WithPush, got %d", len(containerClient.PushImageCalls()))
+	}
+
+	builder = NewBuilder(nixClient, containerClient, WithKindCluster("dev"))
+	_, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		ref,
+		[]*v1.Platform{plat, {OS: "linux", Architecture: "arm64"}},
+	)
+	if ErrorClassOf(err) != ConfigErrorClass {
+		t.Fatalf("expected a multi-platform kind load to be rejected, got %v", err)
+	}
+}
+
+func TestBuilderBuildAndPushRejectsEmptyPlatforms(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	containerClient := &mockContainerBuilderClient{}
+
+	builder := NewBuilder(&mockNixBuilderClient{}, containerClient, WithPush(true))
+	_, err := builder.BuildAndPush(context.Background(), "/workspace", ref, nil)
+	if err == nil || !strings.Contains(err.Error(), "at least one platform is required") {
+		t.Fatalf("expected empty platform error, got %v", err)
+	}
+	if len(containerClient.CheckPushPermissionCalls()) != 0 {
+		t.Fatalf(
+			"expected push permission check to be skipped, got %d",
+			len(containerClient.CheckPushPermissionCalls()),
+		)
+	}
+}
+
+func TestBuilderBuildAndPushPreflight(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{{OS: "linux", Architecture: "amd64"}}
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "", errors.New("nix build failed")
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		CheckPushPermissionFunc: func(context.Context, name.Reference) error {
+			return errors.New("UNAUTHORIZED")
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true))
+	_, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+	if err == nil || !strings.Contains(err.Error(), "UNAUTHORIZED") ||
+		!strings.Contains(err.Error(), "--skip-preflight") {
+		t.Fatalf("expected push check failure with guidance, got %v", err)
+	}
+	if len(nixClient.BuildPlatformImageCalls()) != 0 {
+		t.Fatalf("expected nothing to be built after the failed push check")
+	}
+
+	builder = NewBuilder(nixClient, containerClient, WithPush(true), WithSkipPreflight(true))
+	_, err = builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+	if err == nil || !strings.Contains(err.Error(), "nix build failed") {
+		t.Fatalf("expected the build to run without the push check, got %v", err)
+	}
+	if n := len(containerClient.CheckPushPermissionCalls()); n != 1 {
+		t.Fatalf("expected the push check to be skipped, got %d calls", n)
+	}
+}
+
+func TestBuilderBuildAndPushCollectedStorePath(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{{OS: "linux", Architecture: "amd64"}}
+	tests := []struct {
+		name       string
+		skipGCRoot bool
+		wantErr    string
+	}{
+		{name: "rooted", wantErr: "garbage collected before the image was read"},
+		{name: "unrooted", skipGCRoot: true, wantErr: "drop --skip-gc-root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The image is collected from the store between build and load.
+			path := filepath.Join(t.TempDir(), "image.tar.gz")
+			if err := os.WriteFile(path, []byte("image"), 0o644); err != nil {
+				t.Fatalf("write image failed: %v", err)
+			}
+			nixClient := &mockNixBuilderClient{
+				BuildPlatformImageFunc: func(_ context.Context, _ string, _ name.Reference, _ *v1.Platform, opts ...ImageOption) (string, error) {
+					if got := makeImageOptions(opts...).outLink != ""; got == tt.skipGCRoot {
+						t.Fatalf("expected out link %v, got %v", !tt.skipGCRoot, got)
+					}
+					return path, os.Remove(path)
+				},
+				GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+					return TarGzBuilderType, nil
+				},
+			}
+			containerClient := &mockContainerBuilderClient{
+				LoadImageFunc: func(_ context.Context, _ name.Reference, path string) (LoadedImage, error) {
+					_, err := os.Open(path)
+					return LoadedImage{}, err
+				},
+			}
+
+			builder := NewBuilder(nixClient, containerClient, WithSkipGCRoot(tt.skipGCRoot))
+			_, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) ||
+				!strings.Contains(err.Error(), path) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("expected the missing file error to be kept, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBuilderBuildAndPushExistingTag(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:1.0")
+	plats := []*v1.Platform{{OS: "linux", Architecture: "amd64"}}
+	existing := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	tests := []struct {
+		name         string
+		opts         []BuildOption
+		exists       bool
+		wantErr      string
+		wantExisting bool
+		wantBuilt    int
+	}{
+		{
+			name:         "skips an existing tag",
+			opts:         []BuildOption{WithIfNotExists(true)},
+			exists:       true,
+			wantExisting: true,
+		},
+		{
+			name:      "builds a missing tag",
+			opts:      []BuildOption{WithIfNotExists(true)},
+			wantErr:   "nix build failed",
+			wantBuilt: 1,
+		},
+		{
+			name:    "fails on an existing tag",
+			opts:    []BuildOption{WithFailIfExists(true)},
+			exists:  true,
+			wantErr: "tag ghcr.io/example/app:1.0 already exists",
+		},
+		{
+			name:      "builds without checking",
+			exists:    true,
+			wantErr:   "nix build failed",
+			wantBuilt: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nixClient := &mockNixBuilderClient{
+				BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+					return "", errors.New("nix build failed")
+				},
+			}
+			containerClient := &mockContainerBuilderClient{
+				HeadImageFunc: func(context.Context, name.Reference) (v1.Hash, bool, error) {
+					if !tt.exists {
+						return v1.Hash{}, false, nil
+					}
+					return existing, true, nil
+				},
+			}
+
+			opts := append([]BuildOption{WithPush(true)}, tt.opts...)
+			builder := NewBuilder(nixClient, containerClient, opts...)
+			result, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("build and push failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if result.Existing != tt.wantExisting {
+				t.Fatalf("expected existing=%v, got %v", tt.wantExisting, result.Existing)
+			}
+			if tt.wantExisting && result.Digest != existing {
+				t.Fatalf("expected the existing digest %s, got %s", existing, result.Digest)
+			}
+			if n := len(nixClient.BuildPlatformImageCalls()); n != tt.wantBuilt {
+				t.Fatalf("expected %d builds, got %d", tt.wantBuilt, n)
+			}
+		})
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformTracksImage(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	loadedRef := mustParseReference(t, "ghcr.io/example/app:loaded")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	nixClient := &mockNixBuilderClient{
+		EvalPackageSystemsFunc: evalEverySystem,
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return LoadedImage{Ref: loadedRef}, nil
+		},
+		PushPlatformImageFunc: func(context.Context, name.Reference, *v1.Platform, string, map[string]string) (mutate.IndexAddendum, error) {
+			return mutate.IndexAddendum{}, nil
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true))
+	if _, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats); err != nil {
+		t.Fatalf("multiplatform build and push failed: %v", err)
+	}
+
+	if len(nixClient.BuildPlatformImageCalls()) != 2 ||
+		len(nixClient.GetImageBuilderTypeCalls()) != 2 {
+		t.Fatalf(
+			"expected one nix build/type per platform, got build=%d type=%d",
+			len(nixClient.BuildPlatformImageCalls()),
+			len(nixClient.GetImageBuilderTypeCalls()),
+		)
+	}
+	if n := len(containerClient.LoadImageCalls()) + len(containerClient.TagImageCalls()); n != 0 {
+		t.Fatalf("expected images pushed without the daemon, got %d loads and tags", n)
+	}
+	if len(containerClient.PushPlatformImageCalls()) != 2 {
+		t.Fatalf(
+			"expected two platform pushes, got %d",
+			len(containerClient.PushPlatformImageCalls()),
+		)
+	}
+	if len(containerClient.PushManifestCalls()) != 1 {
+		t.Fatalf("expected one manifest push, got %d", len(containerClient.PushManifestCalls()))
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformMissingFlakePlatform(t *testing.T) {
+	tests := []struct {
+		name        string
+		skipMissing bool
+		systems     []string
+		wantErr     string
+		wantBuilt   int
+		wantIndexed int
+	}{
+		{
+			name:    "fails before building",
+			systems: []string{"x86_64-linux"},
+			wantErr: "does not define package app for platforms [linux/arm64]",
+		},
+		{
+			name:        "skips missing platforms",
+			skipMissing: true,
+			systems:     []string{"x86_64-linux"},
+			wantBuilt:   1,
+			wantIndexed: 1,
+		},
+		{
+			name:        "fails without any platform",
+			skipMissing: true,
+			systems:     []string{"x86_64-darwin"},
+			wantErr:     "for any of platforms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := mustParseReference(t, "ghcr.io/example/app:latest")
+			plats := []*v1.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64"},
+			}
+			nixClient, containerClient := newPlatformTagTestClients(t, "")
+			nixClient.EvalPackageSystemsFunc = func(context.Context, string, name.Reference, ...ImageOption) ([]string, error) {
+				return tt.systems, nil
+			}
+
+			builder := NewBuilder(
+				nixClient,
+				containerClient,
+				WithPush(true),
+				WithSkipMissingPlatforms(tt.skipMissing),
+			)
+			_, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				if ErrorClassOf(err) != EvalErrorClass {
+					t.Fatalf("expected eval error class, got %v", ErrorClassOf(err))
+				}
+			} else if err != nil {
+				t.Fatalf("multiplatform build and push failed: %v", err)
+			}
+			if n := len(nixClient.BuildPlatformImageCalls()); n != tt.wantBuilt {
+				t.Fatalf("expected %d platform builds, got %d", tt.wantBuilt, n)
+			}
+			if tt.wantIndexed == 0 {
+				return
+			}
+			manifestCalls := containerClient.PushManifestCalls()
+			if len(manifestCalls) != 1 || len(manifestCalls[0].IndexAddendums) != tt.wantIndexed {
+				t.Fatalf("expected an index of %d platforms", tt.wantIndexed)
+			}
+		})
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformSummarizesBeforePush(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	nixClient := &mockNixBuilderClient{
+		EvalPackageSystemsFunc: evalEverySystem,
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	var mu sync.Mutex
+	summarized := 0
+	containerClient := &mockContainerBuilderClient{
+		SummarizeLocalImageFunc: func(path string) (imageSummary, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			summarized++
+			return imageSummary{
+				Layers: []LayerSummary{{Size: 2048, StorePaths: []string{"/nix/store/abc-app"}}},
+				Size:   2048,
+			}, nil
+		},
+		PushPlatformImageFunc: func(context.Context, name.Reference, *v1.Platform, string, map[string]string) (mutate.IndexAddendum, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if summarized == 0 {
+				t.Errorf("expected the image to be summarized before its push")
+			}
+			return mutate.IndexAddendum{}, nil
+		},
+	}
+
+	var out bytes.Buffer
+	builder := NewBuilder(nixClient, containerClient, WithPush(true), WithImageSummaryOutput(&out))
+	if _, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats); err != nil {
+		t.Fatalf("multiplatform build and push failed: %v", err)
+	}
+	if summarized != 2 {
+		t.Fatalf("expected one summary per platform, got %d", summarized)
+	}
+	for _, want := range []string{"for linux/amd64", "for linux/arm64", "/nix/store/abc-app"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected summary output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformReusesExistingImage(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	existingRef := mustParseReference(t, "ghcr.io/example/app:arm64-native")
+	loadedRef := mustParseReference(t, "ghcr.io/example/app:loaded")
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	nixClient := &mockNixBuilderClient{
+		EvalPackageSystemsFunc: evalEverySystem,
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return LoadedImage{Ref: loadedRef}, nil
+		},
+		PushPlatformImageFunc: func(_ context.Context, _ name.Reference, p *v1.Platform, _ string, _ map[string]string) (mutate.IndexAddendum, error) {
+			return mutate.IndexAddendum{Descriptor: v1.Descriptor{Platform: p}}, nil
+		},
+		GetPlatformImageFunc: func(_ context.Context, _ name.Reference, p *v1.Platform) (mutate.IndexAddendum, error) {
+			return mutate.IndexAddendum{Descriptor: v1.Descriptor{Platform: p}}, nil
+		},
+	}
+
+	builder := NewBuilder(
+		nixClient,
+		containerClient,
+		WithPush(true),
+		WithExistingPlatformImage(arm64, existingRef),
+	)
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		ref,
+		[]*v1.Platform{amd64, arm64},
+	); err != nil {
+		t.Fatalf("multiplatform build and push failed: %v", err)
+	}
+
+	buildCalls := nixClient.BuildPlatformImageCalls()
+	if len(buildCalls) != 1 || buildCalls[0].Platform != amd64 {
+		t.Fatalf("expected only amd64 to be built, got %d builds", len(buildCalls))
+	}
+	getCalls := containerClient.GetPlatformImageCalls()
+	if len(getCalls) != 1 || getCalls[0].Reference.Name() != existingRef.Name() ||
+		getCalls[0].Platform != arm64 {
+		t.Fatalf("expected arm64 to be fetched from %s", existingRef.Name())
+	}
+	manifestCalls := containerClient.PushManifestCalls()
+	if len(manifestCalls) != 1 || len(manifestCalls[0].IndexAddendums) != 2 {
+		t.Fatalf("expected index with built and reused platforms")
+	}
+}
+
+func TestBuilderBuildAndPushRejectsExistingImageForUnrequestedPlatform(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	existingRef := mustParseReference(t, "ghcr.io/example/app:riscv")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+
+	builder := NewBuilder(
+		&mockNixBuilderClient{},
+		&mockContainerBuilderClient{},
+		WithPush(true),
+		WithExistingPlatformImage(&v1.Platform{OS: "linux", Architecture: "riscv64"}, existingRef),
+	)
+	_, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+	if err == nil || !strings.Contains(err.Error(), existingRef.Name()) {
+		t.Fatalf("expected error naming %s, got %v", existingRef.Name(), err)
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformSourceImage(t *testing.T) {
+	source := mustParseReference(t, "ghcr.io/example/app:latest")
+	destination := mustParseReference(t, "ghcr.io/example/product:1.0")
+	loadedRef := mustParseReference(t, "ghcr.io/example/app:loaded")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	nixClient := &mockNixBuilderClient{
+		EvalPackageSystemsFunc: evalEverySystem,
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return LoadedImage{Ref: loadedRef}, nil
+		},
+		PushPlatformImageFunc: func(context.Context, name.Reference, *v1.Platform, string, map[string]string) (mutate.IndexAddendum, error) {
+			return mutate.IndexAddendum{}, nil
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true), WithSourceImage(source))
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		destination,
+		plats,
+	); err != nil {
+		t.Fatalf("multiplatform build and push failed: %v", err)
+	}
+
+	for _, call := range nixClient.BuildPlatformImageCalls() {
+		if call.Reference.Name() != source.Name() {
+			t.Fatalf("expected flake package from %s, got %s", source.Name(), call.Reference.Name())
+		}
+	}
+	for _, call := range containerClient.PushPlatformImageCalls() {
+		if !strings.HasPrefix(call.Reference.Name(), destination.Name()+"_") {
+			t.Fatalf("expected platform tag of %s, got %s", destination.Name(), call.Reference.Name())
+		}
+	}
+	manifestCalls := containerClient.PushManifestCalls()
+	if len(manifestCalls) != 1 || manifestCalls[0].Reference.Name() != destination.Name() {
+		t.Fatalf("expected index pushed to %s", destination.Name())
+	}
+	if n := len(containerClient.CheckPushPermissionCalls()); n != 1 ||
+		containerClient.CheckPushPermissionCalls()[0].Reference.Name() != destination.Name() {
+		t.Fatalf("expected push permission checked on %s", destination.Name())
+	}
+}
+
+func TestBuilderBuildAndPushSinglePlatformSourceImage(t *testing.T) {
+	source := mustParseReference(t, "ghcr.io/example/app:latest")
+	destination := mustParseReference(t, "ghcr.io/example/product:1.0")
+	loadedRef := mustParseReference(t, "ghcr.io/example/app:loaded")
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return StreamBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadStreamImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return LoadedImage{Ref: loadedRef}, nil
+		},
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true), WithSourceImage(source))
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		destination,
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+	); err != nil {
+		t.Fatalf("build and push failed: %v", err)
+	}
+
+	tagCalls := containerClient.TagImageCalls()
+	if len(tagCalls) != 1 || tagCalls[0].Reference.Name() != source.Name() {
+		t.Fatalf("expected loaded image tagged as %s", source.Name())
+	}
+	pushCalls := containerClient.PushImageCalls()
+	if len(pushCalls) != 1 || pushCalls[0].Reference.Name() != destination.Name() {
+		t.Fatalf("expected image pushed to %s", destination.Name())
+	}
+}
+
+func newPlatformTagTestClients(
+	t *testing.T,
+	failArch string,
+) (*mockNixBuilderClient, *mockContainerBuilderClient) {
+	t.Helper()
+
+	loadedRef := mustParseReference(t, "ghcr.io/example/app:loaded")
+	nixClient := &mockNixBuilderClient{
+		EvalPackageSystemsFunc: evalEverySystem,
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return TarGzBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadImageFunc: func(context.Context, name.Reference, string) (LoadedImage, error) {
+			return LoadedImage{Ref: loadedRef}, nil
+		},
+		PushPlatformImageFunc: func(_ context.Context, _ name.Reference, p *v1.Platform, _ string, _ map[string]string) (mutate.IndexAddendum, error) {
+			if p.Architecture == failArch {
+				return mutate.IndexAddendum{}, errors.New("registry unavailable")
+			}
+			return mutate.IndexAddendum{}, nil
+		},
+	}
+	return nixClient, containerClient
+}
+
+func TestBuilderBuildAndPushMultiplatformRemovesPlatformTags(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	tests := []struct {
+		name     string
+		failArch string
+		opts     []BuildOption
+		removed  int
+	}{
+		{name: "loaded images are kept", opts: []BuildOption{WithLoad(true)}},
+		{name: "keep platform images", opts: []BuildOption{WithKeepPlatformImages(true)}},
+		{name: "nothing loaded", failArch: "arm64"},
+		{
+			name:     "failure",
+			failArch: "arm64",
+			opts:     []BuildOption{WithLoad(true)},
+			removed:  2,
+		},
+		{
+			name:     "keep on failure",
+			failArch: "arm64",
+			opts:     []BuildOption{WithLoad(true), WithKeepOnFailure(true)},
+		},
+		{
+			name:     "keep platform images does not apply to failures",
+			failArch: "arm64",
+			opts:     []BuildOption{WithKeepPlatformImages(true)},
+			removed:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nixClient, containerClient := newPlatformTagTestClients(t, tt.failArch)
+			containerClient.RemoveImageFunc = func(context.Context, name.Reference) error {
+				return errors.New("image is in use")
+			}
+
+			builder := NewBuilder(
+				nixClient,
+				containerClient,
+				append([]BuildOption{WithPush(true)}, tt.opts...)...,
+			)
+			_, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+			if tt.failArch == "" && err != nil {
+				t.Fatalf("expected removal failures to be ignored, got %v", err)
+			}
+			if tt.failArch != "" && (err == nil || !strings.Contains(err.Error(), "registry")) {
+				t.Fatalf("expected push error, got %v", err)
+			}
+
+			removeCalls := containerClient.RemoveImageCalls()
+			if len(removeCalls) != tt.removed {
+				t.Fatalf("expected %d removed tags, got %d", tt.removed, len(removeCalls))
+			}
+			for _, call := range removeCalls {
+				if !strings.HasPrefix(call.Reference.Name(), ref.Name()+"_linux_") {
+					t.Fatalf("expected platform tag removal, got %s", call.Reference.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformLoadsIntoRuntime(t *testing.T) {
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+	}
+	archive := writeTestImageArchive(t)
+	tests := []struct {
+		name      string
+		buildErr  error
+		wantNames func(ref name.Reference) []string
+	}{
+		{
+			name: "loaded platform images are kept",
+			wantNames: func(ref name.Reference) []string {
+				return []string{ref.Name() + "_linux_amd64", ref.Name() + "_linux_arm_v7"}
+			},
+		},
+		{
+			name:      "failure removes the loaded platform images",
+			buildErr:  errors.New("nix build failed"),
+			wantNames: func(name.Reference) []string { return nil },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+			rt := newFakeContainerRuntime()
+			containerClient, err := NewContainerClient(
+				context.Background(),
+				WithContainerDockerClient(&client.Client{}),
+				WithContainerKeychain(fakeKeychain{}),
+				WithContainerRuntimeBackend(rt),
+			)
+			if err != nil {
+				t.Fatalf("create container client failed: %v", err)
+			}
+			nixClient, _ := newPlatformTagTestClients(t, "")
+			nixClient.BuildPlatformImageFunc = func(
+				_ context.Context,
+				_ string,
+				_ name.Reference,
+				p *v1.Platform,
+				_ ...ImageOption,
+			) (string, error) {
+				if p.Architecture == "arm" && tt.buildErr != nil {
+					return "", tt.buildErr
+				}
+				return archive, nil
+			}
+			builder := NewBuilder(
+				nixClient,
+				containerClient,
+				WithPush(true),
+				WithLoad(true),
+			)
+			_, err = builder.BuildAndPush(context.Background(), "/workspace", ref, plats)
+			if !errors.Is(err, tt.buildErr) {
+				t.Fatalf("expected build error %v, got %v", tt.buildErr, err)
+			}
+			if got := rt.names(); !slices.Equal(got, tt.wantNames(ref)) {
+				t.Fatalf("expected runtime images %v, got %v", tt.wantNames(ref), got)
+			}
+			if tt.buildErr != nil {
+				return
+			}
+			idx, err := remote.Index(ref)
+			if err != nil {
+				t.Fatalf("read pushed index failed: %v", err)
+			}
+			manifest, err := idx.IndexManifest()
+			if err != nil || len(manifest.Manifests) != len(plats) {
+				t.Fatalf("expected %d manifests, got %v, %v", len(plats), manifest, err)
+			}
+		})
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformStreamsWithoutDaemon(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	nixClient, containerClient := newPlatformTagTestClients(t, "")
+	nixClient.GetImageBuilderTypeFunc = func(context.Context, string) (BuilderType, error) {
+		return StreamBuilderType, nil
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true))
+	if _, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats); err != nil {
+		t.Fatalf("multiplatform build and push failed: %v", err)
+	}
+
+	if n := len(containerClient.LoadStreamImageCalls()) + len(containerClient.TagImageCalls()); n != 0 {
+		t.Fatalf("expected images pushed without the daemon, got %d loads and tags", n)
+	}
+	saves := containerClient.SaveStreamImageCalls()
+	if len(saves) != 2 {
+		t.Fatalf("expected two saved streams, got %d", len(saves))
+	}
+	archives := []string{saves[0].S2, saves[1].S2}
+	for _, call := range containerClient.PushPlatformImageCalls() {
+		if call.S == "/tmp/result" || !slices.Contains(archives, call.S) {
+			t.Fatalf("expected push from a saved archive, got %s", call.S)
+		}
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformIndexOrder(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	ref := mustParseReference(t, strings.TrimPrefix(srv.URL, "http://")+"/example/app:latest")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "riscv64"},
+	}
+	images := map[string]v1.Image{}
+	for _, p := range plats {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatalf("create random image failed: %v", err)
+		}
+		images[p.String()] = img
+	}
+	registryClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	var digests []v1.Hash
+	for range 3 {
+		nixClient, containerClient := newPlatformTagTestClients(t, "")
+		containerClient.PushPlatformImageFunc = func(
+			_ context.Context,
+			platformRef name.Reference,
+			p *v1.Platform,
+			_ string,
+			_ map[string]string,
+		) (mutate.IndexAddendum, error) {
+			// Finish the pipelines in reverse order of the requested platforms.
+			i := slices.IndexFunc(plats, func(q *v1.Platform) bool { return PlatformEquals(p, q) })
+			time.Sleep(time.Duration(len(plats)-i) * 10 * time.Millisecond)
+			img := images[p.String()]
+			if err := remote.Write(platformRef, img); err != nil {
+				return mutate.IndexAddendum{}, err
+			}
+			return mutate.IndexAddendum{
+				Add:        img,
+				Descriptor: v1.Descriptor{Platform: p},
+			}, nil
+		}
+		containerClient.PushManifestFunc = registryClient.PushManifest
+
+		builder := NewBuilder(nixClient, containerClient, WithPush(true))
+		if _, err := builder.BuildAndPush(
+			context.Background(),
+			"/workspace",
+			ref,
+			plats,
+		); err != nil {
+			t.Fatalf("build and push failed: %v", err)
+		}
+
+		idx, err := remote.Index(ref)
+		if err != nil {
+			t.Fatalf("read index failed: %v", err)
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			t.Fatalf("read index manifest failed: %v", err)
+		}
+		if len(manifest.Manifests) != len(plats) {
+			t.Fatalf("expected %d manifests, got %d", len(plats), len(manifest.Manifests))
+		}
+		for i, desc := range manifest.Manifests {
+			if !PlatformEquals(desc.Platform, plats[i]) {
+				t.Fatalf("expected manifest %d for %s, got %s", i, plats[i], desc.Platform)
+			}
+		}
+		digest, err := idx.Digest()
+		if err != nil {
+			t.Fatalf("read index digest failed: %v", err)
+		}
+		digests = append(digests, digest)
+	}
+	for _, digest := range digests[1:] {
+		if digest != digests[0] {
+			t.Fatalf("expected stable index digest, got %s", digests)
+		}
+	}
+}
+
+func TestBuilderBuildAndPushSkipUnchanged(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plat := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	pushed, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	pushed = mutate.Annotations(pushed, map[string]string{
+		nixOutPathAnnotation: "/nix/store/abc-app",
+	}).(v1.Image)
+
+	tests := []struct {
+		name    string
+		outPath string
+		evalErr error
+		pullErr error
+		skipped bool
+	}{
+		{name: "unchanged", outPath: "/nix/store/abc-app", skipped: true},
+		{name: "changed", outPath: "/nix/store/def-app"},
+		{name: "eval failure", evalErr: errors.New("nix eval failed")},
+		{name: "registry failure", outPath: "/nix/store/abc-app", pullErr: errors.New("not found")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nixClient, containerClient := newSmokeTestBuilderClients(t)
+			nixClient.BuildPlatformImageFunc = func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+				return tt.outPath, nil
+			}
+			nixClient.EvalPlatformOutPathFunc = func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+				return tt.outPath, tt.evalErr
+			}
+			containerClient.GetPlatformImageFunc = func(context.Context, name.Reference, *v1.Platform) (mutate.IndexAddendum, error) {
+				return mutate.IndexAddendum{Add: pushed}, tt.pullErr
+			}
+
+			builder := NewBuilder(
+				nixClient,
+				containerClient,
+				WithPush(true),
+				WithSkipUnchanged(true),
+			)
+			if _, err := builder.BuildAndPush(
+				context.Background(),
+				"/workspace",
+				ref,
+				[]*v1.Platform{plat},
+			); err != nil {
+				t.Fatalf("build and push failed: %v", err)
+			}
+
+			builds := len(nixClient.BuildPlatformImageCalls())
+			pushCalls := containerClient.PushImageCalls()
+			if tt.skipped && (builds != 0 || len(pushCalls) != 0) {
+				t.Fatalf("expected unchanged image skipped, got %d builds", builds)
+			}
+			if !tt.skipped {
+				if builds != 1 || len(pushCalls) != 1 {
+					t.Fatalf("expected rebuild and push, got %d builds", builds)
+				}
+				if got := pushCalls[0].StringToString[nixOutPathAnnotation]; got != tt.outPath {
+					t.Fatalf("expected out path annotation %q, got %q", tt.outPath, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBuilderBuildAndPushMultiplatformSkipUnchanged(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	pushed, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	pushed = mutate.Annotations(pushed, map[string]string{
+		nixOutPathAnnotation: "/nix/store/abc-app-aarch64",
+	}).(v1.Image)
+
+	nixClient, containerClient := newPlatformTagTestClients(t, "")
+	nixClient.EvalPlatformOutPathFunc = func(_ context.Context, _ string, _ name.Reference, p *v1.Platform, _ ...ImageOption) (string, error) {
+		return "/nix/store/abc-app-" + formatSystemArch(p), nil
+	}
+	containerClient.GetPlatformImageFunc = func(_ context.Context, _ name.Reference, p *v1.Platform) (mutate.IndexAddendum, error) {
+		return mutate.IndexAddendum{Add: pushed, Descriptor: v1.Descriptor{Platform: p}}, nil
+	}
+
+	builder := NewBuilder(nixClient, containerClient, WithPush(true), WithSkipUnchanged(true))
+	if _, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats); err != nil {
+		t.Fatalf("build and push failed: %v", err)
+	}
+
+	builds := nixClient.BuildPlatformImageCalls()
+	if len(builds) != 1 || builds[0].Platform.Architecture != "amd64" {
+		t.Fatalf("expected only amd64 rebuilt, got %d builds", len(builds))
+	}
+	manifestCalls := containerClient.PushManifestCalls()
+	if len(manifestCalls) != 1 || len(manifestCalls[0].IndexAddendums) != 2 {
+		t.Fatal("expected an index of both platforms")
+	}
+	if manifestCalls[0].IndexAddendums[1].Add != pushed {
+		t.Fatal("expected the unchanged arm64 image reused in the index")
+	}
+}
+
+func TestBuilderBuildAndPushLoadsImageWithConfigOverride(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	nixClient := &mockNixBuilderClient{
+		BuildPlatformImageFunc: func(context.Context, string, name.Reference, *v1.Platform, ...ImageOption) (string, error) {
+			return "/tmp/result", nil
+		},
+		GetImageBuilderTypeFunc: func(context.Context, string) (BuilderType, error) {
+			return StreamBuilderType, nil
+		},
+	}
+	containerClient := &mockContainerBuilderClient{
+		LoadPlatformImageFunc: func(context.Context, name.Reference, *v1.Platform, string) (LoadedImage, error) {
+			return LoadedImage{Ref: ref}, nil
+		},
+	}
+
+	builder := NewBuilder(
+		nixClient,
+		containerClient,
+		WithImageConfig(ImageConfig{Cmd: []string{"/bin/worker"}}),
+	)
+	if _, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		ref,
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+	); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	if len(containerClient.LoadStreamImageCalls()) != 0 {
+		t.Fatalf("expected the stream script not to be loaded as built")
+	}
+	saveCalls := containerClient.SaveStreamImageCalls()
+	loadCalls := containerClient.LoadPlatformImageCalls()
+	if len(saveCalls) != 1 || saveCalls[0].S1 != "/tmp/result" {
+		t.Fatalf("expected the stream image to be saved, got %+v", saveCalls)
+	}
+	if len(loadCalls) != 1 || loadCalls[0].S != saveCalls[0].S2 {
+		t.Fatalf("expected the saved archive %s to be loaded, got %+v", saveCalls[0].S2, loadCalls)
+	}
+}
@@ -0,0 +1,135 @@
+package nixcontainers
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// DefaultCompressionLevel keeps the default level of the compression.
+const DefaultCompressionLevel = -1
+
+// WithContainerCompression re-encodes the layers of pushed images with comp
+// at level, or the default level of comp when level is negative. Gzip at the
+// default level pushes the layers as nix compressed them.
+func WithContainerCompression(comp compression.Compression, level int) ContainerOption {
+	return func(o *containerOptions) {
+		o.compression = comp
+		o.compressionLevel = level
+	}
+}
+
+// WithContainerEstargz converts the layers of pushed images to eStargz, so
+// runtimes with the stargz snapshotter can pull them lazily.
+func WithContainerEstargz(estargz bool) ContainerOption {
+	return func(o *containerOptions) {
+		o.estargz = estargz
+	}
+}
+
+// ParseCompression validates a --compression and --compression-level pair.
+func ParseCompression(raw string, level int) (compression.Compression, error) {
+	var maxLevel int
+	switch comp := compression.Compression(raw); comp {
+	case compression.GZip:
+		maxLevel = 9
+	case compression.ZStd:
+		maxLevel = 22
+	default:
+		return "", fmt.Errorf(
+			"invalid compression %q, expected %s or %s",
+			raw,
+			compression.GZip,
+			compression.ZStd,
+		)
+	}
+	if level != DefaultCompressionLevel && (level < 0 || level > maxLevel) {
+		return "", fmt.Errorf(
+			"invalid %s compression level %d, expected 0 to %d",
+			raw,
+			level,
+			maxLevel,
+		)
+	}
+	return compression.Compression(raw), nil
+}
+
+// compressImage re-encodes the layers of img with the configured compression,
+// keeping its config and annotations. Zstd layers are only valid in an OCI
+// manifest, so the media types of the image are switched to OCI for them.
+// eStargz layers carry the digest of their table of contents in the
+// containerd.io/snapshot/stargz/toc.digest annotation of the manifest.
+func (c *ContainerClient) compressImage(img v1.Image) (v1.Image, error) {
+	if !c.estargz && (c.compression == "" ||
+		c.compression == compression.GZip && c.compressionLevel == DefaultCompressionLevel) {
+		return img, nil
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("read image manifest failed: %w", err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("read image config failed: %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("read image layers failed: %w", err)
+	}
+
+	manifestType, configType := manifest.MediaType, manifest.Config.MediaType
+	if c.compression == compression.ZStd {
+		manifestType, configType = types.OCIManifestSchema1, types.OCIConfigJSON
+	}
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, manifestType), configType)
+	adds := make([]mutate.Addendum, 0, len(layers))
+	diffIDs := make([]v1.Hash, 0, len(layers))
+	for _, l := range layers {
+		layerType, err := l.MediaType()
+		if err != nil {
+			return nil, fmt.Errorf("read layer media type failed: %w", err)
+		}
+		if c.compression == compression.ZStd {
+			layerType = types.OCILayerZStd
+		}
+		opts := []tarball.LayerOption{
+			tarball.WithCompression(c.compression),
+			tarball.WithMediaType(layerType),
+		}
+		if c.compressionLevel != DefaultCompressionLevel {
+			opts = append(opts, tarball.WithCompressionLevel(c.compressionLevel))
+		}
+		if c.estargz {
+			opts = append(opts, tarball.WithEstargz)
+		}
+		compressed, err := tarball.LayerFromOpener(l.Uncompressed, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("compress layer failed: %w", err)
+		}
+		diffID, err := compressed.DiffID()
+		if err != nil {
+			return nil, fmt.Errorf("compute compressed layer diff ID failed: %w", err)
+		}
+		adds = append(adds, mutate.Addendum{Layer: compressed})
+		diffIDs = append(diffIDs, diffID)
+	}
+	compressed, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("append compressed layers failed: %w", err)
+	}
+	// The config is kept as built. Only eStargz changes the uncompressed
+	// layers, appending its table of contents to each, so the diff IDs are
+	// those of the converted layers.
+	cf = cf.DeepCopy()
+	cf.RootFS.DiffIDs = diffIDs
+	compressed, err = mutate.ConfigFile(compressed, cf)
+	if err != nil {
+		return nil, fmt.Errorf("set compressed image config failed: %w", err)
+	}
+	return annotateImage(compressed, manifest.Annotations), nil
+}
@@ -0,0 +1,196 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// estargzTOCDigestAnnotation is the layer annotation the stargz snapshotter
+// reads the TOC digest from.
+const estargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+func TestContainerClientPushImageCompression(t *testing.T) {
+	path := writeTestImageArchive(t)
+	built, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		t.Fatalf("read image archive failed: %v", err)
+	}
+	builtConfig, err := built.ConfigFile()
+	if err != nil {
+		t.Fatalf("read image config failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		compression  compression.Compression
+		level        int
+		wantManifest types.MediaType
+		wantLayer    types.MediaType
+	}{
+		{
+			name:         "zstd",
+			compression:  compression.ZStd,
+			level:        DefaultCompressionLevel,
+			wantManifest: types.OCIManifestSchema1,
+			wantLayer:    types.OCILayerZStd,
+		},
+		{
+			name:         "gzip level",
+			compression:  compression.GZip,
+			level:        9,
+			wantManifest: types.DockerManifestSchema2,
+			wantLayer:    types.DockerLayer,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+			containerClient, err := NewContainerClient(
+				context.Background(),
+				WithContainerDockerClient(&client.Client{}),
+				WithContainerKeychain(fakeKeychain{}),
+				WithContainerCompression(tt.compression, tt.level),
+			)
+			if err != nil {
+				t.Fatalf("create container client failed: %v", err)
+			}
+			annotations := map[string]string{nixOutPathAnnotation: "/nix/store/app"}
+			_, err = containerClient.PushImage(
+				context.Background(),
+				ref,
+				HostPlatform(),
+				path,
+				annotations,
+			)
+			if err != nil {
+				t.Fatalf("push image failed: %v", err)
+			}
+
+			pushed, err := remote.Image(ref)
+			if err != nil {
+				t.Fatalf("read pushed image failed: %v", err)
+			}
+			manifest, err := pushed.Manifest()
+			if err != nil {
+				t.Fatalf("read pushed manifest failed: %v", err)
+			}
+			if manifest.MediaType != tt.wantManifest {
+				t.Fatalf("expected manifest %s, got %s", tt.wantManifest, manifest.MediaType)
+			}
+			if manifest.Annotations[nixOutPathAnnotation] != "/nix/store/app" {
+				t.Fatalf("expected the annotations to be kept, got %v", manifest.Annotations)
+			}
+			for _, layer := range manifest.Layers {
+				if layer.MediaType != tt.wantLayer {
+					t.Fatalf("expected layer %s, got %s", tt.wantLayer, layer.MediaType)
+				}
+			}
+			cf, err := pushed.ConfigFile()
+			if err != nil {
+				t.Fatalf("read pushed config failed: %v", err)
+			}
+			if !slices.Equal(cf.RootFS.DiffIDs, builtConfig.RootFS.DiffIDs) {
+				t.Fatalf("expected the diff IDs of the built image, got %v", cf.RootFS.DiffIDs)
+			}
+			// The tag resolves to the manifest that was actually pushed.
+			desc, err := remote.Head(ref)
+			if err != nil {
+				t.Fatalf("head %s failed: %v", ref, err)
+			}
+			digest, err := pushed.Digest()
+			if err != nil {
+				t.Fatalf("get pushed digest failed: %v", err)
+			}
+			if desc.Digest != digest {
+				t.Fatalf("expected tag digest %s, got %s", digest, desc.Digest)
+			}
+		})
+	}
+}
+
+// skipUnlessEstargzFooter skips when compress/gzip no longer writes the 51
+// byte footer the estargz writer expects, which it panics on.
+func skipUnlessEstargzFooter(t *testing.T) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	gz.Extra = make([]byte, 4+len("0000000000000000STARGZ"))
+	_ = gz.Close()
+	if buf.Len() != 51 {
+		t.Skipf("compress/gzip of %s writes a %d byte eStargz footer", runtime.Version(), buf.Len())
+	}
+}
+
+func TestContainerClientPushImageEstargz(t *testing.T) {
+	skipUnlessEstargzFooter(t)
+	path := writeTestImageArchive(t)
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerCompression(compression.GZip, DefaultCompressionLevel),
+		WithContainerEstargz(true),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	_, err = containerClient.PushImage(context.Background(), ref, HostPlatform(), path, nil)
+	if err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+
+	pushed, err := remote.Image(ref)
+	if err != nil {
+		t.Fatalf("read pushed image failed: %v", err)
+	}
+	manifest, err := pushed.Manifest()
+	if err != nil {
+		t.Fatalf("read pushed manifest failed: %v", err)
+	}
+	cf, err := pushed.ConfigFile()
+	if err != nil {
+		t.Fatalf("read pushed config failed: %v", err)
+	}
+	if len(cf.RootFS.DiffIDs) != len(manifest.Layers) {
+		t.Fatalf("expected %d diff IDs, got %v", len(manifest.Layers), cf.RootFS.DiffIDs)
+	}
+	for i, desc := range manifest.Layers {
+		toc, err := v1.NewHash(desc.Annotations[estargzTOCDigestAnnotation])
+		if err != nil {
+			t.Fatalf("expected layer %d to carry the TOC digest, got %v", i, desc.Annotations)
+		}
+		if toc.Algorithm != "sha256" {
+			t.Fatalf("expected a sha256 TOC digest, got %s", toc)
+		}
+		// The config describes the converted layers, TOC included.
+		layer, err := remote.Layer(ref.Context().Digest(desc.Digest.String()))
+		if err != nil {
+			t.Fatalf("read pushed layer failed: %v", err)
+		}
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			t.Fatalf("read pushed layer failed: %v", err)
+		}
+		diffID, _, err := v1.SHA256(rc)
+		_ = rc.Close()
+		if err != nil {
+			t.Fatalf("hash pushed layer failed: %v", err)
+		}
+		if diffID != cf.RootFS.DiffIDs[i] {
+			t.Fatalf("expected diff ID %s for layer %d, got %s", diffID, i, cf.RootFS.DiffIDs[i])
+		}
+	}
+}
@@ -0,0 +1,1526 @@
+package nixcontainers
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+)
+
+var streamCommandContext = exec.CommandContext
+
+const (
+	// IndexMediaTypeOCI pushes multi-platform images as OCI image indexes.
+	IndexMediaTypeOCI = "oci"
+	// IndexMediaTypeDocker pushes multi-platform images as Docker manifest lists.
+	IndexMediaTypeDocker = "docker"
+	// IndexMediaTypeAuto pushes OCI image indexes and retries once with a
+	// Docker manifest list when the registry rejects the OCI media type.
+	IndexMediaTypeAuto = "auto"
+)
+
+// DefaultLoadRetries is how many times a load failing with a transient
+// daemon error is retried by default.
+const DefaultLoadRetries = 2
+
+// loadRetryDelay is the delay before the first load retry, growing linearly
+// with each attempt.
+var loadRetryDelay = time.Second
+
+// OCIRefNameAnnotation names an image in an OCI image layout.
+const OCIRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// ContainerRuntime is where images are loaded, tagged and removed: the
+// Docker daemon or a containerd image store.
+type ContainerRuntime interface {
+	// Load loads the uncompressed docker archive read from r. layers is the
+	// number of layers of the archive for the load progress, 0 when unknown.
+	Load(ctx context.Context, r io.Reader, layers int) (LoadedImage, error)
+	// Tag names the loaded image dst, dropping the ref it was loaded under.
+	Tag(ctx context.Context, src LoadedImage, dst name.Reference) error
+	Remove(ctx context.Context, ref name.Reference) error
+	List(ctx context.Context) ([]LocalImage, error)
+	Ping(ctx context.Context) error
+}
+
+type ContainerOption func(*containerOptions)
+
+type containerOptions struct {
+	docker          *client.Client
+	dockerHost      string
+	dockerCertPath  string
+	keychain        authn.Keychain
+	transport       http.RoundTripper
+	remote          []remote.Option
+	indexMediaType  string
+	loadTimeout     time.Duration
+	loadRetries     int
+	pushTimeout     time.Duration
+	pushJobs        int
+	serializePush   bool
+	pushByDigest    bool
+	killGracePeriod time.Duration
+	nixStore        string
+	runtime         string
+	backend         ContainerRuntime
+	containerdAddr  string
+	containerdNS    string
+	progressOutput  io.Writer
+	heartbeat       time.Duration
+	mountFrom       *name.Repository
+	baseImage       name.Reference
+	imageConfig     ImageConfig
+	annotations     map[string]string
+	extraLayers     []ExtraLayer
+
+	indexAnnotations  map[string]string
+	indexArtifactType string
+
+	mirrors          []name.Reference
+	mirrorBestEffort bool
+	latestTag        string
+	ecrRepository    *ECRRepositoryOptions
+
+	compression      compression.Compression
+	compressionLevel int
+	estargz          bool
+}
+
+type ContainerClient struct {
+	docker          *client.Client
+	keychain        authn.Keychain
+	transport       http.RoundTripper
+	remote          []remote.Option
+	pusher          *remote.Pusher
+	indexMediaType  string
+	loadTimeout     time.Duration
+	loadRetries     int
+	pushTimeout     time.Duration
+	serializePush   bool
+	pushMu          sync.Mutex
+	pushByDigest    bool
+	killGracePeriod time.Duration
+	nixStore        string
+	runtime         string
+	backend         ContainerRuntime
+	progress        *pushProgress
+	heartbeat       time.Duration
+	mountFrom       *name.Repository
+	blobs           *blobStats
+	localImages     sync.Map
+	uploadedBytes   sync.Map
+	baseImage       name.Reference
+	baseImages      sync.Map
+	imageConfig     ImageConfig
+	annotations     map[string]string
+	extraLayers     []extraLayer
+
+	indexAnnotations  map[string]string
+	indexArtifactType string
+
+	mirrors          []name.Reference
+	mirrorBestEffort bool
+	latestTag        string
+	ecr              *ecrRepositoryCreator
+
+	compression      compression.Compression
+	compressionLevel int
+	estargz          bool
+}
+
+type imageLoadProgress struct {
+	Status         string         `json:"status"`
+	Progress       string         `json:"progress"`
+	ID             string         `json:"id"`
+	ProgressDetail map[string]any `json:"progressDetail"`
+}
+
+// LoadedImage is the image a load produced in the runtime: the ref it was
+// tagged with, or only its ID when the archive carried no tag.
+type LoadedImage struct {
+	Ref name.Reference
+	ID  string
+}
+
+func (l LoadedImage) String() string {
+	if l.Ref != nil {
+		return l.Ref.Name()
+	}
+	return l.ID
+}
+
+type imageLoadResult struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// err returns the failure the daemon reported in the load stream, if any.
+func (r imageLoadResult) err() error {
+	msg := r.ErrorDetail.Message
+	if msg == "" {
+		msg = r.Error
+	}
+	if msg == "" {
+		return nil
+	}
+	return fmt.Errorf("docker daemon rejected the image: %s", msg)
+}
+
+func WithContainerKeychain(kc authn.Keychain) ContainerOption {
+	return func(o *containerOptions) {
+		o.keychain = kc
+		o.remote = append(o.remote, remote.WithAuthFromKeychain(kc))
+	}
+}
+
+func WithContainerDockerClient(docker *client.Client) ContainerOption {
+	return func(o *containerOptions) {
+		o.docker = docker
+	}
+}
+
+// WithContainerDockerHost connects to the docker daemon at host, such as
+// ssh://builder@host, instead of the one of DOCKER_HOST or the current docker
+// context.
+func WithContainerDockerHost(host string) ContainerOption {
+	return func(o *containerOptions) {
+		o.dockerHost = host
+	}
+}
+
+// WithContainerDockerCertPath authenticates to the docker daemon with the
+// ca.pem, cert.pem and key.pem TLS files of dir, like DOCKER_CERT_PATH.
+func WithContainerDockerCertPath(dir string) ContainerOption {
+	return func(o *containerOptions) {
+		o.dockerCertPath = dir
+	}
+}
+
+func WithContainerTransport(t http.RoundTripper) ContainerOption {
+	return func(o *containerOptions) {
+		o.transport = t
+		o.remote = append(o.remote, remote.WithTransport(t))
+	}
+}
+
+func WithContainerRemoteOption(opt remote.Option) ContainerOption {
+	return func(o *containerOptions) {
+		o.remote = append(o.remote, opt)
+	}
+}
+
+func WithContainerIndexMediaType(mediaType string) ContainerOption {
+	return func(o *containerOptions) {
+		o.indexMediaType = mediaType
+	}
+}
+
+// WithContainerLoadTimeout aborts each docker load, and the image stream
+// feeding it, that runs longer than timeout. Zero disables the timeout.
+func WithContainerLoadTimeout(timeout time.Duration) ContainerOption {
+	return func(o *containerOptions) {
+		o.loadTimeout = timeout
+	}
+}
+
+// WithContainerLoadRetries sets how many times a docker load failing with a
+// transient daemon error is retried, re-running the image stream script.
+func WithContainerLoadRetries(retries int) ContainerOption {
+	return func(o *containerOptions) {
+		o.loadRetries = retries
+	}
+}
+
+// WithContainerPushTimeout aborts each image or index push that runs longer
+// than timeout. Zero disables the timeout.
+func WithContainerPushTimeout(timeout time.Duration) ContainerOption {
+	return func(o *containerOptions) {
+		o.pushTimeout = timeout
+	}
+}
+
+// WithContainerPushJobs sets how many layers are uploaded concurrently, in
+// total across the pushes in flight. Zero keeps DefaultPushJobs.
+func WithContainerPushJobs(jobs int) ContainerOption {
+	return func(o *containerOptions) {
+		o.pushJobs = jobs
+	}
+}
+
+// WithContainerSerializePush pushes one image or index at a time, each with
+// every upload job, instead of sharing the jobs across concurrent pushes.
+func WithContainerSerializePush(serialize bool) ContainerOption {
+	return func(o *containerOptions) {
+		o.serializePush = serialize
+	}
+}
+
+// WithContainerPushByDigest pushes every image and index to the digest of its
+// manifest in the repository of its reference, without writing any tag.
+func WithContainerPushByDigest(byDigest bool) ContainerOption {
+	return func(o *containerOptions) {
+		o.pushByDigest = byDigest
+	}
+}
+
+// WithContainerNixStore sets the nix store the images were built into, which
+// image stream commands receive as NIX_STORE to read their layers from.
+func WithContainerNixStore(store string) ContainerOption {
+	return func(o *containerOptions) {
+		o.nixStore = store
+	}
+}
+
+// WithContainerKillGracePeriod sets how long an image stream command may take
+// to exit after SIGINT when its context is cancelled before it is killed.
+func WithContainerKillGracePeriod(grace time.Duration) ContainerOption {
+	return func(o *containerOptions) {
+		o.killGracePeriod = grace
+	}
+}
+
+// WithContainerRuntime sets the runtime images are loaded into and tagged in:
+// ContainerRuntimeDocker (the default), ContainerRuntimeContainerd or
+// ContainerRuntimeAuto.
+func WithContainerRuntime(runtime string) ContainerOption {
+	return func(o *containerOptions) {
+		o.runtime = runtime
+	}
+}
+
+// WithContainerRuntimeBackend loads, tags and removes images with rt instead
+// of the runtime selected by WithContainerRuntime.
+func WithContainerRuntimeBackend(rt ContainerRuntime) ContainerOption {
+	return func(o *containerOptions) {
+		o.backend = rt
+	}
+}
+
+// WithContainerdAddress sets the containerd socket, defaulting to the
+// containerd default address.
+func WithContainerdAddress(address string) ContainerOption {
+	return func(o *containerOptions) {
+		o.containerdAddr = address
+	}
+}
+
+// WithContainerdNamespace sets the containerd namespace images are loaded
+// into, defaulting to the nerdctl one.
+func WithContainerdNamespace(namespace string) ContainerOption {
+	return func(o *containerOptions) {
+		o.containerdNS = namespace
+	}
+}
+
+// WithContainerProgressOutput renders the progress of concurrent pushes as a
+// single updating line on w, typically a terminal, instead of log lines.
+func WithContainerProgressOutput(w io.Writer) ContainerOption {
+	return func(o *containerOptions) {
+		o.progressOutput = w
+	}
+}
+
+// WithContainerHeartbeatInterval logs at info every interval that a push is
+// still running, with the bytes uploaded so far. Zero disables it.
+func WithContainerHeartbeatInterval(interval time.Duration) ContainerOption {
+	return func(o *containerOptions) {
+		o.heartbeat = interval
+	}
+}
+
+func makeContainerOptions(opts ...ContainerOption) *containerOptions {
+	o := &containerOptions{
+		keychain:        authn.DefaultKeychain,
+		transport:       http.DefaultTransport,
+		indexMediaType:  IndexMediaTypeOCI,
+		killGracePeriod: DefaultKillGracePeriod,
+		loadRetries:     DefaultLoadRetries,
+		pushJobs:        DefaultPushJobs,
+		runtime:         ContainerRuntimeDocker,
+	}
+	o.remote = append(o.remote, remote.WithAuthFromKeychain(o.keychain))
+	o.remote = append(o.remote, remote.WithTransport(o.transport))
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func NewContainerClient(ctx context.Context, opts ...ContainerOption) (*ContainerClient, error) {
+	o := makeContainerOptions(opts...)
+	docker := o.docker
+	var dockerHost string
+	if docker == nil {
+		var err error
+		docker, dockerHost, err = newDockerClient(ctx, o.dockerHost, o.dockerCertPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dockerHost = docker.DaemonHost()
+	}
+
+	runtime, backend := o.runtime, o.backend
+	if backend == nil {
+		var err error
+		runtime, backend, err = newContainerRuntime(ctx, docker, dockerHost, o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Every push shares the pusher, which authenticates once per repository
+	// and remembers the blobs the registry already has, and counts how the
+	// blobs were pushed. Concurrent pushes share the upload jobs.
+	jobs := cmp.Or(o.pushJobs, DefaultPushJobs)
+	blobs := &blobStats{}
+	pusher, err := remote.NewPusher(
+		append(
+			slices.Clone(o.remote),
+			remote.WithJobs(jobs),
+			remote.WithTransport(blobs.transport(newUploadLimit(jobs).transport(o.transport))),
+		)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create registry pusher: %w", err)
+	}
+	slog.DebugContext(ctx, "registry push concurrency", "jobs", jobs, "serialize", o.serializePush)
+	var ecr *ecrRepositoryCreator
+	if o.ecrRepository != nil {
+		ecr = newECRRepositoryCreator(*o.ecrRepository)
+	}
+	extraLayers, err := newExtraLayers(o.extraLayers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContainerClient{
+		docker:          docker,
+		keychain:        o.keychain,
+		transport:       o.transport,
+		remote:          o.remote,
+		pusher:          pusher,
+		indexMediaType:  o.indexMediaType,
+		loadTimeout:     o.loadTimeout,
+		loadRetries:     o.loadRetries,
+		pushTimeout:     o.pushTimeout,
+		serializePush:   o.serializePush,
+		pushByDigest:    o.pushByDigest,
+		killGracePeriod: o.killGracePeriod,
+		nixStore:        o.nixStore,
+		runtime:         runtime,
+		backend:         backend,
+		progress:        newPushProgress(o.progressOutput),
+		heartbeat:       o.heartbeat,
+		mountFrom:       o.mountFrom,
+		blobs:           blobs,
+		baseImage:       o.baseImage,
+		imageConfig:     o.imageConfig,
+		annotations:     o.annotations,
+		extraLayers:     extraLayers,
+
+		indexAnnotations:  o.indexAnnotations,
+		indexArtifactType: o.indexArtifactType,
+
+		mirrors:          o.mirrors,
+		mirrorBestEffort: o.mirrorBestEffort,
+		latestTag:        o.latestTag,
+		ecr:              ecr,
+
+		compression:      o.compression,
+		compressionLevel: o.compressionLevel,
+		estargz:          o.estargz,
+	}, nil
+}
+
+// newContainerRuntime resolves the runtime of the options, connecting to
+// containerd unless Docker was asked for.
+func newContainerRuntime(
+	ctx context.Context,
+	docker *client.Client,
+	dockerHost string,
+	o *containerOptions,
+) (string, ContainerRuntime, error) {
+	var store *containerdImageStore
+	if o.runtime != ContainerRuntimeDocker {
+		var err error
+		store, err = newContainerdImageStore(o.containerdAddr, o.containerdNS)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	dockerRT := &dockerRuntime{client: docker, host: dockerHost}
+	runtime, err := resolveContainerRuntime(
+		ctx,
+		o.runtime,
+		dockerRT.Ping,
+		func(ctx context.Context) error { return store.Ping(ctx) },
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	if runtime == ContainerRuntimeContainerd {
+		return runtime, store, nil
+	}
+	return runtime, dockerRT, nil
+}
+
+// CheckPushPermission checks ref, and every mirror, can be pushed to.
+func (c *ContainerClient) CheckPushPermission(ctx context.Context, ref name.Reference) error {
+	err := remote.CheckPushPermission(ref, c.keychain, c.contextTransport(ctx))
+	if retry, cerr := c.createMissingRepository(ctx, ref.Context(), err); retry {
+		err = remote.CheckPushPermission(ref, c.keychain, c.contextTransport(ctx))
+	} else {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("check push permission failed: %w", err)
+	}
+	return c.checkMirrorPushPermission(ctx)
+}
+
+// TagImage tags the loaded image as ref. An image loaded under another ref is
+// renamed, dropping the loaded ref, while an untagged image is tagged by ID.
+func (c *ContainerClient) TagImage(
+	ctx context.Context,
+	loaded LoadedImage,
+	ref name.Reference,
+) (err error) {
+	ctx, span := startSpan(ctx, "tag image", refAttribute(ref))
+	defer func() { endSpan(span, err) }()
+	return c.backend.Tag(ctx, loaded, ref)
+}
+
+// LocalImage is an image tag in the container runtime.
+type LocalImage struct {
+	Ref     name.Reference
+	ID      string
+	Created time.Time
+}
+
+// ListImages returns every tagged image of the runtime, one entry per tag.
+func (c *ContainerClient) ListImages(ctx context.Context) ([]LocalImage, error) {
+	return c.backend.List(ctx)
+}
+
+// Ping checks the runtime images are loaded into answers.
+func (c *ContainerClient) Ping(ctx context.Context) error {
+	return c.backend.Ping(ctx)
+}
+
+// RemoveImage removes ref from the runtime, only untagging the image when it
+// has other tags.
+func (c *ContainerClient) RemoveImage(ctx context.Context, ref name.Reference) error {
+	return c.backend.Remove(ctx, ref)
+}
+
+func (c *ContainerClient) LoadImage(
+	ctx context.Context,
+	ref name.Reference,
+	path string,
+) (LoadedImage, error) {
+	return c.retryLoad(ctx, ref, func(ctx context.Context) (LoadedImage, error) {
+		return c.loadImage(ctx, ref, path)
+	})
+}
+
+func (c *ContainerClient) loadImage(
+	ctx context.Context,
+	ref name.Reference,
+	path string,
+) (LoadedImage, error) {
+	slog.InfoContext(ctx, "load image", "image", ref, "path", path)
+
+	// containerd only imports uncompressed archives.
+	input, err := gzipPathOpener(path)()
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer func() { _ = input.Close() }()
+	return c.backend.Load(ctx, input, countArchiveLayers(path))
+}
+
+// LoadStreamImage loads the image produced by the stream script at path. The
+// script output cannot be replayed, so a retried load runs it again.
+func (c *ContainerClient) LoadStreamImage(
+	ctx context.Context,
+	ref name.Reference,
+	path string,
+) (LoadedImage, error) {
+	return c.retryLoad(ctx, ref, func(ctx context.Context) (LoadedImage, error) {
+		return c.loadStreamImage(ctx, ref, path, nil)
+	})
+}
+
+// LoadStreamImageArchive loads the image produced by the stream script at
+// path like LoadStreamImage, writing the image archive to dest as it is
+// loaded, so the image can be pushed without running the script again or
+// exporting it from the runtime.
+func (c *ContainerClient) LoadStreamImageArchive(
+	ctx context.Context,
+	ref name.Reference,
+	path string,
+	dest string,
+) (LoadedImage, error) {
+	return c.retryLoad(ctx, ref, func(ctx context.Context) (LoadedImage, error) {
+		// A retried load starts the archive over.
+		f, err := os.Create(dest)
+		if err != nil {
+			return LoadedImage{}, fmt.Errorf("failed to create image archive: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		loaded, err := c.loadStreamImage(ctx, ref, path, f)
+		if err != nil {
+			return LoadedImage{}, err
+		}
+		if err := f.Close(); err != nil {
+			return LoadedImage{}, fmt.Errorf("failed to write image archive: %w", err)
+		}
+		return loaded, nil
+	})
+}
+
+// LoadPlatformImage loads the image archive at path as the image for p,
+// rewritten in-process as it would be pushed.
+func (c *ContainerClient) LoadPlatformImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+) (LoadedImage, error) {
+	img, err := c.platformImage(ctx, ref, p, path)
+	if err != nil {
+		return LoadedImage{}, err
+	}
+	return c.retryLoad(ctx, ref, func(ctx context.Context) (LoadedImage, error) {
+		slog.InfoContext(ctx, "load image", "image", ref, "path", path)
+		pr, pw := io.Pipe()
+		go func() { _ = pw.CloseWithError(tarball.Write(ref, img, pw)) }()
+		// Closing the reader stops the writer when the load returns early.
+		defer func() { _ = pr.Close() }()
+		return c.loadStream(ctx, pr)
+	})
+}
+
+// retryLoad runs load, each attempt bounded by the load timeout, retrying up
+// to loadRetries times while it fails with a transient daemon error.
+func (c *ContainerClient) retryLoad(
+	ctx context.Context,
+	ref name.Reference,
+	load func(context.Context) (LoadedImage, error),
+) (_ LoadedImage, err error) {
+	ctx, span := startSpan(ctx, "load image", refAttribute(ref))
+	defer func() { endSpan(span, err) }()
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("nix_containers.load.attempts", attempt))
+		loadCtx, cancel := PhaseTimeoutContext(ctx, "docker load", c.loadTimeout)
+		loaded, err := load(loadCtx)
+		err = WrapPhaseTimeout(loadCtx, err)
+		cancel()
+		if err == nil {
+			return loaded, nil
+		}
+		if attempt > c.loadRetries || ctx.Err() != nil || !isTransientDaemonError(err) {
+			if attempt > 1 {
+				return LoadedImage{}, fmt.Errorf("load failed after %d attempts: %w", attempt, err)
+			}
+			return LoadedImage{}, err
+		}
+		slog.WarnContext(
+			ctx,
+			"load failed with a transient daemon error, retrying",
+			"image", ref,
+			"attempt", attempt,
+			"max_attempts", c.loadRetries+1,
+			"err", err,
+		)
+		select {
+		case <-ctx.Done():
+			return LoadedImage{}, ctx.Err()
+		case <-time.After(time.Duration(attempt) * loadRetryDelay):
+		}
+	}
+}
+
+// isTransientDaemonError reports whether err is a daemon failure worth
+// retrying: a server error, an unavailable daemon, or a connection that was
+// refused, reset or closed mid-load.
+func isTransientDaemonError(err error) bool {
+	if cerrdefs.IsInternal(err) || cerrdefs.IsUnavailable(err) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return strings.Contains(err.Error(), "dial unix")
+}
+
+// loadStreamImage runs the stream script at path into the runtime, copying
+// the archive it streams to archive when set.
+func (c *ContainerClient) loadStreamImage(
+	ctx context.Context,
+	ref name.Reference,
+	path string,
+	archive io.Writer,
+) (LoadedImage, error) {
+	slog.InfoContext(ctx, "start stream image command", "image", ref, "path", path)
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := c.streamCommand(cmdCtx, path)
+
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	var stream io.Reader = bufio.NewReader(stdoutPipe)
+	if archive != nil {
+		stream = io.TeeReader(stream, archive)
+	}
+
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	sc := bufio.NewScanner(stderrPipe)
+	stderrOutput := newStderrTail()
+
+	if err = cmd.Start(); err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to start stream command: %w", err)
+	}
+
+	wg := errgroup.Group{}
+	wg.Go(func() error {
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line != "" {
+				slog.Log(
+					ctx,
+					NixStderrLevel,
+					"stream image output",
+					"cmd",
+					cmd.Path,
+					"nix_stderr",
+					line,
+				)
+				stderrOutput.add(line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return fmt.Errorf("stderr scan failed: %w", err)
+		}
+		return nil
+	})
+	// stop interrupts the script of a failed load and waits for it and the
+	// stderr scanner, so that a retry starts with neither left running and
+	// the stderr tail is complete.
+	stop := func() {
+		cancel()
+		// A script blocked writing the stream fails on the closed pipe.
+		_ = stdoutPipe.Close()
+		_ = wg.Wait()
+		_ = cmd.Wait()
+	}
+
+	slog.InfoContext(ctx, "streaming image", "image", ref, "runtime", c.runtime)
+	loaded, err := c.loadStream(ctx, stream)
+	if err != nil {
+		stop()
+		// A script failing mid-stream fails the load, and says why on stderr.
+		return LoadedImage{}, stderrOutput.commandError("stream image", err)
+	}
+	if archive != nil {
+		// The runtime may stop reading at the end-of-archive marker, before
+		// the padding the script still writes.
+		if _, err := io.Copy(io.Discard, stream); err != nil {
+			stop()
+			return LoadedImage{}, fmt.Errorf("failed to write image archive: %w", err)
+		}
+	}
+
+	if err = wg.Wait(); err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to wait for stream command: %w", err)
+	}
+	if err = cmd.Wait(); err != nil {
+		return LoadedImage{}, stderrOutput.commandError(
+			"stream image",
+			fmt.Errorf("failed to wait for command: %w", err),
+		)
+	}
+
+	slog.InfoContext(ctx, "stream image command completed", "image", ref, "path", path)
+	return loaded, nil
+}
+
+// loadStream loads the docker archive streamed from r into the runtime. The
+// stream is not seekable, so the layer count is only known as the layers are
+// loaded.
+func (c *ContainerClient) loadStream(ctx context.Context, r io.Reader) (LoadedImage, error) {
+	return c.backend.Load(ctx, r, 0)
+}
+
+// PushImage pushes the image archive at path, as the image for p, to ref,
+// adding annotations to its manifest, and returns the digest of the pushed
+// image.
+func (c *ContainerClient) PushImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+	annotations map[string]string,
+) (v1.Hash, error) {
+	img, err := c.platformImage(ctx, ref, p, path)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	img, err = c.compressImage(annotateImage(img, annotations))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := c.push(ctx, ref, img, nil, c.mountFrom); err != nil {
+		return v1.Hash{}, fmt.Errorf("push image failed: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("get image digest failed: %w", err)
+	}
+	return digest, c.mirror(ctx, ref, digest, img)
+}
+
+// PushPlatformImage pushes the image archive at path to ref, adding
+// annotations to its manifest, and returns it as the index entry for p.
+func (c *ContainerClient) PushPlatformImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+	annotations map[string]string,
+) (mutate.IndexAddendum, error) {
+	add, err := c.GetLocalPlatformImage(ctx, ref, p, path)
+	if err != nil {
+		return mutate.IndexAddendum{}, err
+	}
+	img, err := c.compressImage(annotateImage(add.Add.(v1.Image), annotations))
+	if err != nil {
+		return mutate.IndexAddendum{}, err
+	}
+	if err := c.push(ctx, ref, img, p, c.mountFrom); err != nil {
+		return mutate.IndexAddendum{}, fmt.Errorf("push image failed: %w", err)
+	}
+	return mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: p},
+	}, nil
+}
+
+// RenderedImage is the config and manifest an image is pushed with.
+type RenderedImage struct {
+	Config   *v1.ConfigFile `json:"config"`
+	Manifest *v1.Manifest   `json:"manifest"`
+}
+
+// RenderImage returns the config and manifest PushImage would push the image
+// archive at path with, going through the same mutations, without loading or
+// pushing it.
+func (c *ContainerClient) RenderImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+	annotations map[string]string,
+) (*RenderedImage, error) {
+	img, err := c.platformImage(ctx, ref, p, path)
+	if err != nil {
+		return nil, err
+	}
+	return c.renderImage(img, annotations)
+}
+
+// RenderExistingImage is RenderImage for the image of p pushed at existing
+// instead of an image archive, such as a previous build of ref.
+func (c *ContainerClient) RenderExistingImage(
+	ctx context.Context,
+	existing name.Reference,
+	ref name.Reference,
+	p *v1.Platform,
+) (*RenderedImage, error) {
+	add, err := c.GetPlatformImage(ctx, existing, p)
+	if err != nil {
+		return nil, err
+	}
+	img, err := c.mutateImage(ctx, ref, p, add.Add.(v1.Image))
+	if err != nil {
+		return nil, err
+	}
+	return c.renderImage(img, nil)
+}
+
+func (c *ContainerClient) renderImage(
+	img v1.Image,
+	annotations map[string]string,
+) (*RenderedImage, error) {
+	img, err := c.compressImage(annotateImage(img, annotations))
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("read image config failed: %w", err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("read image manifest failed: %w", err)
+	}
+	return &RenderedImage{Config: cf, Manifest: m}, nil
+}
+
+// GetLocalPlatformImage reads the image archive at path as the image of ref
+// for p without going through the daemon.
+func (c *ContainerClient) GetLocalPlatformImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+) (mutate.IndexAddendum, error) {
+	img, err := c.platformImage(ctx, ref, p, path)
+	if err != nil {
+		return mutate.IndexAddendum{}, err
+	}
+	return mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: p},
+	}, nil
+}
+
+// SummarizeLocalImage sizes the layers of the image archive at path.
+func (c *ContainerClient) SummarizeLocalImage(path string) (imageSummary, error) {
+	img, err := c.localImage(path)
+	if err != nil {
+		return imageSummary{}, err
+	}
+	return summarizeImage(img)
+}
+
+// localImage reads the image archive, or OCI layout directory, at path. The
+// image is kept, so the layer digests and sizes computed by a summary are
+// reused by its push.
+func (c *ContainerClient) localImage(path string) (v1.Image, error) {
+	if img, ok := c.localImages.Load(path); ok {
+		return img.(v1.Image), nil
+	}
+	var img v1.Image
+	var err error
+	if isLayoutDir(path) {
+		img, err = layoutImage(path)
+	} else if img, err = tarball.Image(gzipPathOpener(path), nil); err != nil {
+		err = fmt.Errorf("load image from tarball failed: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := c.localImages.LoadOrStore(path, img)
+	return actual.(v1.Image), nil
+}
+
+// platformImage reads the image archive at path as the image of ref for p,
+// with the mutations of mutateImage applied.
+func (c *ContainerClient) platformImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+) (v1.Image, error) {
+	img, err := c.localImage(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.mutateImage(ctx, ref, p, img)
+}
+
+// mutateImage appends img, the image of ref for p, onto the base image when
+// one is set, with the extra layers, the config overrides and the annotations
+// applied.
+func (c *ContainerClient) mutateImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	img v1.Image,
+) (v1.Image, error) {
+	var err error
+	if c.baseImage != nil {
+		img, err = c.rebase(ctx, img, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	img, err = c.appendExtraLayers(img)
+	if err != nil {
+		return nil, err
+	}
+	img, err = c.configureImage(ctx, ref, p, img)
+	if err != nil {
+		return nil, err
+	}
+	return annotateImage(img, c.annotations), nil
+}
+
+// streamCommand returns the command running the image stream script at path.
+func (c *ContainerClient) streamCommand(ctx context.Context, path string) *exec.Cmd {
+	cmd := interruptOnCancel(streamCommandContext(ctx, path), c.killGracePeriod)
+	if c.nixStore != "" {
+		cmd.Env = append(cmd.Environ(), "NIX_STORE="+c.nixStore)
+	}
+	return cmd
+}
+
+// SaveStreamImage runs the image stream script at path and writes the image
+// archive it produces to dest, since a tarball image is read more than once.
+func (c *ContainerClient) SaveStreamImage(ctx context.Context, path, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create image archive: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	cmd := c.streamCommand(ctx, path)
+	cmd.Stdout = f
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf(
+			"stream image command failed: %w: %s",
+			err,
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write image archive: %w", err)
+	}
+	return nil
+}
+
+// WriteLayout writes a multi-platform index of adds to the OCI image layout at
+// dir, naming it after the tag of ref. The Docker daemon cannot store
+// manifest lists, so the layout is the local multi-platform artifact.
+func (c *ContainerClient) WriteLayout(
+	dir string,
+	ref name.Reference,
+	adds []mutate.IndexAddendum,
+) error {
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return fmt.Errorf("failed to create oci layout: %w", err)
+	}
+	idx := c.annotateIndex(mutate.AppendManifests(empty.Index, adds...), true)
+	if err := lp.AppendIndex(idx, layout.WithAnnotations(map[string]string{
+		OCIRefNameAnnotation: ref.Identifier(),
+	})); err != nil {
+		return fmt.Errorf("failed to write oci layout: %w", err)
+	}
+	return nil
+}
+
+// GetPlatformImage fetches an already pushed image for the given platform,
+// resolving indexes to their matching child, and validates its platform.
+func (c *ContainerClient) GetPlatformImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+) (mutate.IndexAddendum, error) {
+	opts := append(c.remoteOptions(ctx), remote.WithPlatform(*p))
+	img, err := remote.Image(ref, opts...)
+	if err != nil {
+		return mutate.IndexAddendum{}, fmt.Errorf("fetch existing image %s failed: %w", ref, err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return mutate.IndexAddendum{}, fmt.Errorf(
+			"read config of existing image %s failed: %w",
+			ref,
+			err,
+		)
+	}
+	if !configPlatformMatches(cf, p) {
+		return mutate.IndexAddendum{}, fmt.Errorf(
+			"existing image %s is %s, expected %s",
+			ref,
+			configPlatform(cf),
+			p.String(),
+		)
+	}
+	return mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: p},
+	}, nil
+}
+
+// configPlatformMatches reports whether the image of cf is for p, of any
+// variant when p has none.
+func configPlatformMatches(cf *v1.ConfigFile, p *v1.Platform) bool {
+	return cf.OS == p.OS && cf.Architecture == p.Architecture &&
+		(p.Variant == "" || cf.Variant == p.Variant)
+}
+
+// configPlatform returns the platform the image of cf is for.
+func configPlatform(cf *v1.ConfigFile) v1.Platform {
+	return v1.Platform{OS: cf.OS, Architecture: cf.Architecture, Variant: cf.Variant}
+}
+
+func annotateImage(img v1.Image, annotations map[string]string) v1.Image {
+	if len(annotations) == 0 {
+		return img
+	}
+	return mutate.Annotations(img, annotations).(v1.Image)
+}
+
+// gzipPathOpener opens the archive at path, decompressing it when it starts
+// with the gzip magic whatever its name.
+func gzipPathOpener(path string) tarball.Opener {
+	return func() (io.ReadCloser, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		magic := make([]byte, len(gzipMagic))
+		if n, _ := f.ReadAt(magic, 0); bytes.Equal(magic[:n], gzipMagic) {
+			gr, err := gzip.NewReader(f)
+			if err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+			return &gzipReadCloser{Reader: gr, file: f}, nil
+		}
+		return f, nil
+	}
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	if err := g.Reader.Close(); err != nil {
+		return err
+	}
+	return g.file.Close()
+}
+
+// PushManifest writes the index of the given platform images and returns its
+// digest and the media type the registry accepted.
+func (c *ContainerClient) PushManifest(
+	ctx context.Context,
+	ref name.Reference,
+	adds []mutate.IndexAddendum,
+) (v1.Hash, types.MediaType, error) {
+	idx, mediaType, err := c.pushIndex(ctx, ref, adds)
+	if err != nil {
+		return v1.Hash{}, "", err
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		return v1.Hash{}, "", fmt.Errorf("get index digest failed: %w", err)
+	}
+	return digest, mediaType, c.mirror(ctx, ref, digest, idx)
+}
+
+// pushIndex writes the index of adds in the configured media type and returns
+// the index the registry accepted.
+func (c *ContainerClient) pushIndex(
+	ctx context.Context,
+	ref name.Reference,
+	adds []mutate.IndexAddendum,
+) (v1.ImageIndex, types.MediaType, error) {
+	idx := c.annotateIndex(mutate.AppendManifests(empty.Index, adds...), true)
+	switch c.indexMediaType {
+	case IndexMediaTypeDocker:
+		idx = c.annotateIndex(makeDockerIndex(adds), false)
+	case IndexMediaTypeAuto:
+		mediaType, err := c.writeIndex(ctx, ref, idx)
+		if err == nil || !isIndexMediaTypeRejected(err) {
+			return idx, mediaType, err
+		}
+		slog.Warn(
+			"registry rejected oci index, retrying with docker manifest list",
+			"ref",
+			ref.Name(),
+			"err",
+			err,
+		)
+		if c.indexArtifactType != "" {
+			slog.Warn(
+				"docker manifest lists have no artifact type, dropping it",
+				"ref",
+				ref.Name(),
+				"artifact_type",
+				c.indexArtifactType,
+			)
+		}
+		dockerIdx := c.annotateIndex(makeDockerIndex(adds), false)
+		logIndexDigestChange(ref, idx, dockerIdx)
+		idx = dockerIdx
+	}
+	mediaType, err := c.writeIndex(ctx, ref, idx)
+	return idx, mediaType, err
+}
+
+func (c *ContainerClient) writeIndex(
+	ctx context.Context,
+	ref name.Reference,
+	idx v1.ImageIndex,
+) (types.MediaType, error) {
+	mediaType, err := idx.MediaType()
+	if err != nil {
+		return "", fmt.Errorf("get index media type failed: %w", err)
+	}
+	if err := c.push(ctx, ref, idx, nil, c.mountFrom); err != nil {
+		return "", fmt.Errorf("push manifest failed: %w", err)
+	}
+	return mediaType, nil
+}
+
+func (c *ContainerClient) remoteOptions(ctx context.Context) []remote.Option {
+	return append(slices.Clone(c.remote), remote.WithContext(ctx))
+}
+
+// contextTransport returns the registry transport bound to ctx, for the
+// remote calls that take no context option.
+func (c *ContainerClient) contextTransport(ctx context.Context) http.RoundTripper {
+	return &contextRoundTripper{ctx: ctx, base: c.transport}
+}
+
+// contextRoundTripper sends every request with its context replaced by ctx.
+type contextRoundTripper struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// push writes t to ref with the shared pusher within the push timeout,
+// reporting the progress of image layers by platform and offering the
+// registry to mount them from the repository from first. In push-by-digest
+// mode, t is written to its digest in the repository of ref instead.
+func (c *ContainerClient) push(
+	ctx context.Context,
+	ref name.Reference,
+	t remote.Taggable,
+	p *v1.Platform,
+	from *name.Repository,
+) (err error) {
+	spanName := "push image"
+	if _, ok := t.(v1.ImageIndex); ok {
+		spanName = "push index"
+	}
+	// Uploaded bytes are reported under the reference the caller knows.
+	tagged := ref
+	if c.pushByDigest {
+		raw, err := t.RawManifest()
+		if err != nil {
+			return fmt.Errorf("get manifest failed: %w", err)
+		}
+		digest, _, err := v1.SHA256(bytes.NewReader(raw))
+		if err != nil {
+			return fmt.Errorf("get manifest digest failed: %w", err)
+		}
+		ref = c.pushedReference(ref, digest)
+	}
+	ctx, span := startSpan(ctx, spanName, refAttribute(ref), platformAttribute(p))
+	defer func() { endSpan(span, err) }()
+	// A serialized push only starts its timeout once it is its turn.
+	if c.serializePush {
+		c.pushMu.Lock()
+		defer c.pushMu.Unlock()
+	}
+	ctx, cancel := PhaseTimeoutContext(ctx, "push", c.pushTimeout)
+	defer cancel()
+	platform := ""
+	if p != nil {
+		platform = p.String()
+	}
+	updates, wait := c.progress.track(ctx, ref.Name(), platform)
+	counter := newProgressCounter(updates)
+	wrap := counter.wrap
+	if canMount(from, ref.Context()) {
+		mount := mountLayers(*from)
+		wrap = func(l v1.Layer) v1.Layer { return mount(counter.wrap(l)) }
+	}
+	t = wrapPushLayers(t, wrap)
+	start := time.Now()
+	stopHeartbeat := startHeartbeat(ctx, c.heartbeat, "push running", func() []any {
+		return []any{"ref", ref.Name(), "platform", platform, "uploaded_bytes", counter.complete()}
+	})
+	err = c.pusher.Push(ctx, ref, t)
+	if retry, cerr := c.createMissingRepository(ctx, ref.Context(), err); retry {
+		err = c.pusher.Push(ctx, ref, t)
+	} else {
+		err = cerr
+	}
+	stopHeartbeat()
+	close(updates)
+	wait()
+	c.uploadedBytes.Store(tagged.Name(), counter.complete())
+	span.SetAttributes(bytesPushedKey.Int64(counter.complete()))
+	slog.DebugContext(
+		ctx,
+		"registry push finished",
+		"ref",
+		ref.Name(),
+		"platform",
+		platform,
+		"duration",
+		time.Since(start),
+	)
+	return WrapPhaseTimeout(ctx, err)
+}
+
+// pushedReference returns the reference an object with the digest digest
+// is pushed to for ref: its digest in the repository of ref in push-by-digest
+// mode, or else ref.
+func (c *ContainerClient) pushedReference(ref name.Reference, digest v1.Hash) name.Reference {
+	if !c.pushByDigest {
+		return ref
+	}
+	return ref.Context().Digest(digest.String())
+}
+
+// UploadedBytes returns the layer bytes the last push of ref uploaded, zero
+// when it was not pushed.
+func (c *ContainerClient) UploadedBytes(ref name.Reference) int64 {
+	n, ok := c.uploadedBytes.Load(ref.Name())
+	if !ok {
+		return 0
+	}
+	return n.(int64)
+}
+
+// makeDockerIndex builds a Docker manifest list, converting OCI platform
+// manifests to schema2 and logging when the conversion changes their digest.
+func makeDockerIndex(adds []mutate.IndexAddendum) v1.ImageIndex {
+	converted := make([]mutate.IndexAddendum, 0, len(adds))
+	for _, add := range adds {
+		img, ok := add.Add.(v1.Image)
+		if !ok {
+			converted = append(converted, add)
+			continue
+		}
+		mediaType, err := img.MediaType()
+		if err != nil || mediaType != types.OCIManifestSchema1 {
+			converted = append(converted, add)
+			continue
+		}
+		dockerImg := mutate.ConfigMediaType(
+			mutate.MediaType(img, types.DockerManifestSchema2),
+			types.DockerConfigJSON,
+		)
+		before, beforeErr := img.Digest()
+		after, afterErr := dockerImg.Digest()
+		if beforeErr == nil && afterErr == nil && before != after {
+			slog.Warn(
+				"platform manifest digest changed due to media type rewrite",
+				"platform",
+				add.Descriptor.Platform,
+				"old_digest",
+				before.String(),
+				"new_digest",
+				after.String(),
+			)
+		}
+		add.Add = dockerImg
+		converted = append(converted, add)
+	}
+	return mutate.IndexMediaType(
+		mutate.AppendManifests(empty.Index, converted...),
+		types.DockerManifestList,
+	)
+}
+
+func logIndexDigestChange(ref name.Reference, before, after v1.ImageIndex) {
+	beforeDigest, err := before.Digest()
+	if err != nil {
+		return
+	}
+	afterDigest, err := after.Digest()
+	if err != nil {
+		return
+	}
+	slog.Warn(
+		"index digest changed due to media type rewrite",
+		"ref",
+		ref.Name(),
+		"old_digest",
+		beforeDigest.String(),
+		"new_digest",
+		afterDigest.String(),
+	)
+}
+
+// isIndexMediaTypeRejected reports whether a registry error indicates that the
+// index media type itself is not accepted.
+func isIndexMediaTypeRejected(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusUnsupportedMediaType {
+		return true
+	}
+	for _, d := range terr.Errors {
+		if d.Code == transport.ManifestInvalidErrorCode ||
+			d.Code == transport.UnsupportedErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+func readImageLoadedRef(
+	ctx context.Context,
+	r *bufio.Reader,
+	progress *loadProgress,
+) (LoadedImage, error) {
+	lastReport := time.Now()
+	for {
+		// Some daemons do not terminate the last record with a newline, so the
+		// partial line returned alongside io.EOF is still decoded.
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return LoadedImage{}, fmt.Errorf("failed to read line: %w", readErr)
+		}
+		if strings.TrimSpace(line) != "" {
+			var event imageLoadProgress
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				return LoadedImage{}, fmt.Errorf(
+					"failed to decode image load progress %q: %w",
+					strings.TrimSpace(line),
+					err,
+				)
+			}
+			var result imageLoadResult
+			if err := json.Unmarshal([]byte(line), &result); err != nil {
+				return LoadedImage{}, fmt.Errorf("failed to decode image load result: %w", err)
+			}
+			if err := result.err(); err != nil {
+				return LoadedImage{}, err
+			}
+			switch {
+			case progress.observe(event):
+				slog.Log(ctx, LevelTrace, "loading layer", "id", event.ID, "progress", event.Progress)
+				if time.Since(lastReport) >= loadProgressInterval {
+					slog.InfoContext(ctx, "loading image", "progress", progress.String())
+					lastReport = time.Now()
+				}
+			case strings.HasPrefix(result.Stream, "Loaded image: "):
+				slog.DebugContext(ctx, "loaded image", "stream", result.Stream)
+				slog.InfoContext(ctx, "image loaded", "progress", progress.String())
+				loadedRef, err := name.ParseReference(
+					strings.TrimSpace(strings.TrimPrefix(result.Stream, "Loaded image: ")),
+				)
+				if err != nil {
+					return LoadedImage{}, err
+				}
+				return LoadedImage{Ref: loadedRef}, nil
+			case strings.HasPrefix(result.Stream, "Loaded image ID: "):
+				slog.DebugContext(ctx, "loaded image", "stream", result.Stream)
+				slog.InfoContext(ctx, "image loaded", "progress", progress.String())
+				id := strings.TrimSpace(strings.TrimPrefix(result.Stream, "Loaded image ID: "))
+				if _, err := v1.NewHash(id); err != nil {
+					return LoadedImage{}, fmt.Errorf("invalid loaded image ID %q: %w", id, err)
+				}
+				return LoadedImage{ID: id}, nil
+			default:
+				slog.DebugContext(ctx, "image load output", "line", strings.TrimSpace(line))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	return LoadedImage{}, errors.New("load stream ended without a loaded image")
+}
+
+// APIVersion returns the negotiated Docker API version, empty for
+// containerd.
+func (c *ContainerClient) APIVersion() string {
+	if _, ok := c.backend.(*dockerRuntime); !ok {
+		return ""
+	}
+	return c.docker.ClientVersion()
+}
+
+// CheckRepository sends a HEAD request for ref with the keychain credentials.
+// A missing repository or tag passes, since the first push creates it.
+func (c *ContainerClient) CheckRepository(ctx context.Context, ref name.Reference) error {
+	_, err := remote.Head(ref, c.remoteOptions(ctx)...)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// HeadImage returns the digest ref points to in its registry, and whether it
+// exists. Some registries answer 401 rather than 404 for a missing
+// repository, so a denied request is only taken as absence when the
+// keychain credentials may push to the repository.
+func (c *ContainerClient) HeadImage(ctx context.Context, ref name.Reference) (v1.Hash, bool, error) {
+	desc, err := remote.Head(ref, c.remoteOptions(ctx)...)
+	if err == nil {
+		return desc.Digest, true, nil
+	}
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return v1.Hash{}, false, err
+	}
+	switch terr.StatusCode {
+	case http.StatusNotFound:
+		return v1.Hash{}, false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if remote.CheckPushPermission(ref, c.keychain, c.contextTransport(ctx)) == nil {
+			return v1.Hash{}, false, nil
+		}
+	}
+	return v1.Hash{}, false, err
+}
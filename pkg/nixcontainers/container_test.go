@@ -0,0 +1,1253 @@
+package nixcontainers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+type testContextKey string
+
+type fakeKeychain struct{}
+
+func (fakeKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return authn.Anonymous, nil
+}
+
+type fakeRoundTripper struct{}
+
+func (fakeRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func TestNewContainerClientUsesInjectedDockerClientAndOptions(t *testing.T) {
+	wantClient := &client.Client{}
+	ctx := context.WithValue(context.Background(), testContextKey("test"), "value")
+	keychain := fakeKeychain{}
+	transport := fakeRoundTripper{}
+
+	containerClient, err := NewContainerClient(
+		ctx,
+		WithContainerDockerClient(wantClient),
+		WithContainerKeychain(keychain),
+		WithContainerTransport(transport),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	if containerClient.docker != wantClient {
+		t.Fatalf("expected injected docker client to be preserved")
+	}
+	if containerClient.keychain != keychain {
+		t.Fatalf("expected keychain override to be stored")
+	}
+	if _, ok := containerClient.transport.(fakeRoundTripper); !ok {
+		t.Fatalf("expected transport override to be stored")
+	}
+	if len(containerClient.remote) != 4 {
+		t.Fatalf(
+			"expected default and override remote options, got %d",
+			len(containerClient.remote),
+		)
+	}
+}
+
+func TestReadImageLoadedRefParsesResultAfterProgress(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader(
+		"{\"status\":\"Loading layer\",\"progress\":\"1/1\",\"id\":\"sha256:abc\"}\n" +
+			"{\"stream\":\"Loaded image: ghcr.io/example/app:latest\\n\"}\n",
+	))
+
+	progress := newLoadProgress(2)
+	ref, err := readImageLoadedRef(context.Background(), reader, progress)
+	if err != nil {
+		t.Fatalf("read loaded ref failed: %v", err)
+	}
+	if got := ref.String(); got != "ghcr.io/example/app:latest" {
+		t.Fatalf("expected loaded ref ghcr.io/example/app:latest, got %s", got)
+	}
+	if got := progress.String(); got != "1/2 layers (50%)" {
+		t.Fatalf("expected progress 1/2 layers (50%%), got %s", got)
+	}
+}
+
+func TestReadImageLoadedRefStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		want    string
+		wantID  string
+		wantErr string
+	}{
+		{
+			name:   "success",
+			stream: "{\"stream\":\"Loaded image: ghcr.io/example/app:latest\\n\"}\n",
+			want:   "ghcr.io/example/app:latest",
+		},
+		{
+			name: "layer progress",
+			stream: "{\"status\":\"Loading layer\",\"progress\":\"1/2\",\"id\":\"sha256:a\"}\n" +
+				"{\"status\":\"Loading layer\",\"progress\":\"2/2\",\"id\":\"sha256:b\"}\n" +
+				"{\"stream\":\"Loaded image: ghcr.io/example/app:v1\\n\"}\n",
+			want: "ghcr.io/example/app:v1",
+		},
+		{
+			name: "error mid-stream",
+			stream: "{\"status\":\"Loading layer\",\"progress\":\"1/2\",\"id\":\"sha256:a\"}\n" +
+				"{\"errorDetail\":{\"message\":\"write /var/lib/docker/tmp: no space left on device\"}," +
+				"\"error\":\"write /var/lib/docker/tmp: no space left on device\"}\n",
+			wantErr: "docker daemon rejected the image: " +
+				"write /var/lib/docker/tmp: no space left on device",
+		},
+		{
+			name:    "error without detail",
+			stream:  "{\"error\":\"invalid tar header\"}\n",
+			wantErr: "docker daemon rejected the image: invalid tar header",
+		},
+		{
+			name:   "untagged image",
+			stream: "{\"stream\":\"Loaded image ID: sha256:" + strings.Repeat("a", 64) + "\\n\"}\n",
+			wantID: "sha256:" + strings.Repeat("a", 64),
+		},
+		{
+			name:    "invalid image ID",
+			stream:  "{\"stream\":\"Loaded image ID: abc\\n\"}\n",
+			wantErr: "invalid loaded image ID \"abc\"",
+		},
+		{
+			name:   "unterminated final line",
+			stream: "{\"stream\":\"Loaded image: ghcr.io/example/app:latest\\n\"}",
+			want:   "ghcr.io/example/app:latest",
+		},
+		{
+			name: "unterminated after progress",
+			stream: "{\"status\":\"Loading layer\",\"progress\":\"1/1\",\"id\":\"sha256:a\"}\n" +
+				"{\"stream\":\"Loaded image: ghcr.io/example/app:v1\\n\"}",
+			want: "ghcr.io/example/app:v1",
+		},
+		{
+			name:    "unterminated error",
+			stream:  "{\"error\":\"invalid tar header\"}",
+			wantErr: "docker daemon rejected the image: invalid tar header",
+		},
+		{
+			name:    "eof without loaded image",
+			stream:  "{\"status\":\"Loading layer\",\"progress\":\"1/1\",\"id\":\"sha256:a\"}\n\n",
+			wantErr: "load stream ended without a loaded image",
+		},
+		{
+			name:    "garbage line",
+			stream:  "not json\n",
+			wantErr: "failed to decode image load progress \"not json\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.stream))
+			ref, err := readImageLoadedRef(context.Background(), reader, newLoadProgress(2))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				if isTransientDaemonError(err) {
+					t.Fatalf("expected daemon rejection not to be retried, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read loaded ref failed: %v", err)
+			}
+			if tt.wantID != "" {
+				if ref.Ref != nil || ref.ID != tt.wantID {
+					t.Fatalf("expected loaded image ID %s, got %+v", tt.wantID, ref)
+				}
+				return
+			}
+			if ref.Ref == nil || ref.Ref.Name() != tt.want {
+				t.Fatalf("expected loaded ref %s, got %+v", tt.want, ref)
+			}
+		})
+	}
+}
+
+func newIndexRejectingRegistry(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	handler := registry.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") &&
+			r.Header.Get("Content-Type") == string(types.OCIImageIndex) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(
+				[]byte(`{"errors":[{"code":"MANIFEST_INVALID","message":"oci index unsupported"}]}`),
+			)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func makeRandomIndexAddenda(t *testing.T, plats ...*v1.Platform) []mutate.IndexAddendum {
+	t.Helper()
+
+	adds := make([]mutate.IndexAddendum, 0, len(plats))
+	for _, p := range plats {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatalf("create random image failed: %v", err)
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+	}
+	return adds
+}
+
+func TestContainerClientPushManifestFallsBackToDockerManifestList(t *testing.T) {
+	srv := newIndexRejectingRegistry(t)
+	ref := mustParseReference(t, strings.TrimPrefix(srv.URL, "http://")+"/example/app:latest")
+	adds := makeRandomIndexAddenda(
+		t,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+		&v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+	)
+
+	tests := []struct {
+		name      string
+		mediaType string
+		want      types.MediaType
+		wantErr   bool
+	}{
+		{name: "oci", mediaType: IndexMediaTypeOCI, wantErr: true},
+		{name: "docker", mediaType: IndexMediaTypeDocker, want: types.DockerManifestList},
+		{name: "auto", mediaType: IndexMediaTypeAuto, want: types.DockerManifestList},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			containerClient, err := NewContainerClient(
+				context.Background(),
+				WithContainerDockerClient(&client.Client{}),
+				WithContainerKeychain(fakeKeychain{}),
+				WithContainerIndexMediaType(tt.mediaType),
+			)
+			if err != nil {
+				t.Fatalf("create container client failed: %v", err)
+			}
+
+			_, got, err := containerClient.PushManifest(context.Background(), ref, adds)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected oci index to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("push manifest failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected media type %s, got %s", tt.want, got)
+			}
+
+			idx, err := remote.Index(ref)
+			if err != nil {
+				t.Fatalf("read pushed index failed: %v", err)
+			}
+			manifest, err := idx.IndexManifest()
+			if err != nil {
+				t.Fatalf("read index manifest failed: %v", err)
+			}
+			if manifest.MediaType != types.DockerManifestList || len(manifest.Manifests) != 2 {
+				t.Fatalf(
+					"expected docker manifest list with two platforms, got %s with %d",
+					manifest.MediaType,
+					len(manifest.Manifests),
+				)
+			}
+			if manifest.Manifests[1].Platform.Variant != "v7" {
+				t.Fatalf("expected variant to be kept in descriptor")
+			}
+		})
+	}
+}
+
+func TestContainerClientPushByDigest(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerPushByDigest(true),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	digest, err := containerClient.PushImage(
+		context.Background(),
+		ref,
+		HostPlatform(),
+		writeTestImageArchive(t),
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	if _, err := remote.Head(ref.Context().Digest(digest.String())); err != nil {
+		t.Fatalf("expected the image pushed by digest: %v", err)
+	}
+	if containerClient.UploadedBytes(ref) == 0 {
+		t.Fatal("expected uploaded bytes reported under the tag")
+	}
+
+	adds := makeRandomIndexAddenda(t, &v1.Platform{OS: "linux", Architecture: "amd64"})
+	digest, _, err = containerClient.PushManifest(context.Background(), ref, adds)
+	if err != nil {
+		t.Fatalf("push manifest failed: %v", err)
+	}
+	if _, err := remote.Head(ref.Context().Digest(digest.String())); err != nil {
+		t.Fatalf("expected the index pushed by digest: %v", err)
+	}
+
+	if _, err := remote.Head(ref); err == nil {
+		t.Fatalf("expected no tag written for %s", ref)
+	}
+}
+
+func TestIsIndexMediaTypeRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "manifest invalid",
+			err: &transport.Error{
+				StatusCode: http.StatusBadRequest,
+				Errors:     []transport.Diagnostic{{Code: transport.ManifestInvalidErrorCode}},
+			},
+			want: true,
+		},
+		{
+			name: "unsupported media type status",
+			err:  &transport.Error{StatusCode: http.StatusUnsupportedMediaType},
+			want: true,
+		},
+		{
+			name: "unauthorized",
+			err: &transport.Error{
+				StatusCode: http.StatusUnauthorized,
+				Errors:     []transport.Diagnostic{{Code: transport.UnauthorizedErrorCode}},
+			},
+		},
+		{
+			name: "plain error",
+			err:  errors.New("connection reset"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIndexMediaTypeRejected(fmt.Errorf("push: %w", tt.err)); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestContainerClientGetPlatformImageValidatesPlatform(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	ref := mustParseReference(t, strings.TrimPrefix(srv.URL, "http://")+"/example/app:arm64")
+
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+	cf.OS = "linux"
+	cf.Architecture = "arm64"
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatalf("mutate config failed: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("write image failed: %v", err)
+	}
+
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	ctx := context.Background()
+	arm64 := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	add, err := containerClient.GetPlatformImage(ctx, ref, arm64)
+	if err != nil {
+		t.Fatalf("get platform image failed: %v", err)
+	}
+	if add.Descriptor.Platform.Architecture != "arm64" {
+		t.Fatalf("expected arm64 descriptor, got %v", add.Descriptor.Platform)
+	}
+
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	_, err = containerClient.GetPlatformImage(ctx, ref, amd64)
+	if err == nil || !strings.Contains(err.Error(), ref.Name()) {
+		t.Fatalf("expected platform mismatch naming %s, got %v", ref.Name(), err)
+	}
+}
+
+func newFakeDockerClient(t testing.TB, handler http.HandlerFunc) *client.Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	docker, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+server.Listener.Addr().String()),
+		client.WithVersion("1.47"),
+	)
+	if err != nil {
+		t.Fatalf("create docker client failed: %v", err)
+	}
+	return docker
+}
+
+// newHangingRegistryRef never answers a request until its client gives up,
+// like a registry behind a stalled connection.
+func newHangingRegistryRef(t *testing.T, repo string) name.Reference {
+	t.Helper()
+
+	release := make(chan struct{})
+	ref := newTestRegistryRef(t, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}), repo)
+	t.Cleanup(func() { close(release) })
+	return ref
+}
+
+func TestContainerClientRemoteOperationsHonorCancellation(t *testing.T) {
+	ref := newHangingRegistryRef(t, "example/app:latest")
+	path := writeTestImageArchive(t)
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	tests := map[string]func(context.Context) error{
+		"check push permission": func(ctx context.Context) error {
+			return containerClient.CheckPushPermission(ctx, ref)
+		},
+		"push image": func(ctx context.Context) error {
+			_, err := containerClient.PushImage(ctx, ref, HostPlatform(), path, nil)
+			return err
+		},
+		"push platform image": func(ctx context.Context) error {
+			_, err := containerClient.PushPlatformImage(ctx, ref, amd64, path, nil)
+			return err
+		},
+		"push manifest": func(ctx context.Context) error {
+			adds := []mutate.IndexAddendum{{Add: img, Descriptor: v1.Descriptor{Platform: amd64}}}
+			_, _, err := containerClient.PushManifest(ctx, ref, adds)
+			return err
+		},
+		"get platform image": func(ctx context.Context) error {
+			_, err := containerClient.GetPlatformImage(ctx, ref, amd64)
+			return err
+		},
+	}
+	for op, run := range tests {
+		t.Run(op, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			start := time.Now()
+			err := run(ctx)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected context canceled error, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("expected cancellation to return promptly, took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestContainerClientPushesAuthenticateOncePerRepository(t *testing.T) {
+	var pings atomic.Int32
+	handler := registry.New()
+	ref := newTestRegistryRef(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			pings.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}), "example/app:latest")
+	path := writeTestImageArchive(t)
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	ctx := context.Background()
+	var adds []mutate.IndexAddendum
+	for _, p := range []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	} {
+		platformRef := FormatPlatformReference(ref, p)
+		add, err := containerClient.PushPlatformImage(ctx, platformRef, p, path, nil)
+		if err != nil {
+			t.Fatalf("push platform image failed: %v", err)
+		}
+		adds = append(adds, add)
+	}
+	if _, _, err := containerClient.PushManifest(ctx, ref, adds); err != nil {
+		t.Fatalf("push manifest failed: %v", err)
+	}
+	if got := pings.Load(); got != 1 {
+		t.Fatalf("expected the registry to be pinged once, got %d", got)
+	}
+}
+
+func TestContainerClientPushManifestKeepsPlatformVariant(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	path := writeTestImageArchive(t)
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	ctx := context.Background()
+	plats := []*v1.Platform{
+		ParsePlatform("linux/arm/v6"),
+		ParsePlatform("linux/arm/v7"),
+		ParsePlatform("linux/386"),
+	}
+	var adds []mutate.IndexAddendum
+	for _, p := range plats {
+		platformRef := FormatPlatformReference(ref, p)
+		add, err := containerClient.PushPlatformImage(ctx, platformRef, p, path, nil)
+		if err != nil {
+			t.Fatalf("push platform image failed: %v", err)
+		}
+		adds = append(adds, add)
+	}
+	if _, _, err := containerClient.PushManifest(ctx, ref, adds); err != nil {
+		t.Fatalf("push manifest failed: %v", err)
+	}
+
+	idx, err := remote.Index(ref)
+	if err != nil {
+		t.Fatalf("read pushed index failed: %v", err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("read pushed index manifest failed: %v", err)
+	}
+	if len(manifest.Manifests) != len(plats) {
+		t.Fatalf("expected %d manifests, got %d", len(plats), len(manifest.Manifests))
+	}
+	// The index keeps the OCI arch and variant, not the nix system.
+	for i, desc := range manifest.Manifests {
+		got, want := desc.Platform, plats[i]
+		if got == nil || got.Architecture != want.Architecture || got.Variant != want.Variant {
+			t.Fatalf("expected platform %+v for manifest %d, got %+v", *want, i, got)
+		}
+	}
+}
+
+func TestContainerClientTagImage(t *testing.T) {
+	id := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name       string
+		loaded     LoadedImage
+		wantSource string
+		wantRemove bool
+	}{
+		{
+			name:       "renames loaded ref",
+			loaded:     LoadedImage{Ref: mustParseReference(t, "ghcr.io/example/app:loaded")},
+			wantSource: "ghcr.io/example/app:loaded",
+			wantRemove: true,
+		},
+		{name: "tags untagged image by ID", loaded: LoadedImage{ID: id}, wantSource: id},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tagged, removed []string
+			docker := newFakeDockerClient(t, func(w http.ResponseWriter, r *http.Request) {
+				source, _ := strings.CutPrefix(r.URL.Path, "/v1.47/images/")
+				switch {
+				case r.Method == http.MethodPost && strings.HasSuffix(source, "/tag"):
+					tagged = append(tagged, strings.TrimSuffix(source, "/tag"))
+					w.WriteHeader(http.StatusCreated)
+				case r.Method == http.MethodDelete:
+					removed = append(removed, source)
+					_, _ = fmt.Fprintln(w, "[]")
+				default:
+					http.NotFound(w, r)
+				}
+			})
+			containerClient, err := NewContainerClient(
+				context.Background(),
+				WithContainerDockerClient(docker),
+			)
+			if err != nil {
+				t.Fatalf("create container client failed: %v", err)
+			}
+
+			ref := mustParseReference(t, "ghcr.io/example/app:latest")
+			if err := containerClient.TagImage(context.Background(), tt.loaded, ref); err != nil {
+				t.Fatalf("tag image failed: %v", err)
+			}
+			if len(tagged) != 1 || tagged[0] != tt.wantSource {
+				t.Fatalf("expected tag of %s, got %q", tt.wantSource, tagged)
+			}
+			if tt.wantRemove != (len(removed) == 1) {
+				t.Fatalf("expected remove %t, got %q", tt.wantRemove, removed)
+			}
+		})
+	}
+}
+
+func TestContainerClientLoadStreamImageRetriesTransientErrors(t *testing.T) {
+	original := loadRetryDelay
+	loadRetryDelay = 0
+	t.Cleanup(func() { loadRetryDelay = original })
+
+	commandStubMu.Lock()
+	originalStream := streamCommandContext
+	t.Cleanup(func() {
+		streamCommandContext = originalStream
+		commandStubMu.Unlock()
+	})
+	var streams atomic.Int32
+	stream := stubCommand(t, "image archive", "", 0, "")
+	streamCommandContext = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		streams.Add(1)
+		return stream(ctx, command, args...)
+	}
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		wantErr      string
+		wantAttempts int
+	}{
+		{name: "recovers", statuses: []int{500, 200}, retries: 2, wantAttempts: 2},
+		{
+			name:         "exhausted",
+			statuses:     []int{500, 500, 500},
+			retries:      2,
+			wantErr:      "load failed after 3 attempts",
+			wantAttempts: 3,
+		},
+		{name: "not transient", statuses: []int{400}, retries: 2, wantErr: "400", wantAttempts: 1},
+		{name: "disabled", statuses: []int{500}, retries: 0, wantErr: "500", wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streams.Store(0)
+			var loads atomic.Int32
+			docker := newFakeDockerClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/images/load") {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = io.Copy(io.Discard, r.Body)
+				status := tt.statuses[loads.Add(1)-1]
+				if status != http.StatusOK {
+					http.Error(w, fmt.Sprintf(`{"message":"status %d"}`, status), status)
+					return
+				}
+				_, _ = fmt.Fprintln(w, `{"stream":"Loaded image: ghcr.io/example/app:latest\n"}`)
+			})
+			containerClient, err := NewContainerClient(
+				context.Background(),
+				WithContainerDockerClient(docker),
+				WithContainerLoadRetries(tt.retries),
+			)
+			if err != nil {
+				t.Fatalf("create container client failed: %v", err)
+			}
+
+			ref, err := containerClient.LoadStreamImage(
+				context.Background(),
+				mustParseReference(t, "ghcr.io/example/app:latest"),
+				"/nix/store/stream-app",
+			)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("load stream image failed: %v", err)
+				}
+				if ref.String() != "ghcr.io/example/app:latest" {
+					t.Fatalf("unexpected loaded ref %s", ref)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if got := int(loads.Load()); got != tt.wantAttempts {
+				t.Fatalf("expected %d loads, got %d", tt.wantAttempts, got)
+			}
+			if got := int(streams.Load()); got != tt.wantAttempts {
+				t.Fatalf("expected the stream script to run %d times, got %d", tt.wantAttempts, got)
+			}
+		})
+	}
+}
+
+func TestContainerClientLoadStreamImageKeepsStderrTail(t *testing.T) {
+	commandStubMu.Lock()
+	originalStream := streamCommandContext
+	t.Cleanup(func() {
+		streamCommandContext = originalStream
+		commandStubMu.Unlock()
+	})
+	streamCommandContext = stubCommand(t, "image archive", "layer 1\nerror: missing layer 2", 1, "")
+
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(newLoadingDockerClient(t)),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	_, err = containerClient.LoadStreamImage(
+		context.Background(),
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		"/nix/store/stream-app",
+	)
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a command error, got %v", err)
+	}
+	if want := []string{"layer 1", "error: missing layer 2"}; !slices.Equal(cmdErr.Stderr, want) {
+		t.Fatalf("expected stderr tail %q, got %q", want, cmdErr.Stderr)
+	}
+	if !strings.Contains(err.Error(), "stream image stderr:\n    layer 1\n    error: missing layer 2") {
+		t.Fatalf("expected the stderr tail in the error, got %v", err)
+	}
+}
+
+// stubStreamScript makes the stream script at path write the file at path,
+// so an image archive stands in for the script of a stream image.
+func stubStreamScript(t testing.TB) {
+	t.Helper()
+
+	commandStubMu.Lock()
+	original := streamCommandContext
+	t.Cleanup(func() {
+		streamCommandContext = original
+		commandStubMu.Unlock()
+	})
+	streamCommandContext = func(ctx context.Context, path string, _ ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat", path)
+	}
+}
+
+// newLoadingDockerClient answers every image load after reading the whole
+// archive, like a daemon storing it.
+func newLoadingDockerClient(t testing.TB) *client.Client {
+	t.Helper()
+
+	return newFakeDockerClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/load") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = fmt.Fprintln(w, `{"stream":"Loaded image: ghcr.io/example/app:latest\n"}`)
+	})
+}
+
+func TestContainerClientLoadStreamImageArchivePushesCapturedArchive(t *testing.T) {
+	stubStreamScript(t)
+	script := writeTestImageArchive(t)
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(newLoadingDockerClient(t)),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	loaded, err := containerClient.LoadStreamImageArchive(
+		context.Background(),
+		ref,
+		script,
+		archive,
+	)
+	if err != nil {
+		t.Fatalf("load stream image failed: %v", err)
+	}
+	if loaded.String() != "ghcr.io/example/app:latest" {
+		t.Fatalf("unexpected loaded ref %s", loaded)
+	}
+	_, err = containerClient.PushImage(context.Background(), ref, HostPlatform(), archive, nil)
+	if err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	img, err := tarball.ImageFromPath(script, nil)
+	if err != nil {
+		t.Fatalf("read image archive failed: %v", err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatalf("get image digest failed: %v", err)
+	}
+	desc, err := remote.Head(ref)
+	if err != nil {
+		t.Fatalf("head %s failed: %v", ref, err)
+	}
+	if desc.Digest != want {
+		t.Fatalf("expected the streamed image %s to be pushed, got %s", want, desc.Digest)
+	}
+}
+
+// BenchmarkPushStreamImage compares pushing a ~500 MiB stream image from the
+// archive captured while it is loaded with exporting it back from the daemon,
+// which copies every byte through the daemon a second time.
+func BenchmarkPushStreamImage(b *testing.B) {
+	stubStreamScript(b)
+	const layers = 4
+	img, err := random.Image(500<<20/layers, layers)
+	if err != nil {
+		b.Fatalf("create random image failed: %v", err)
+	}
+	script := filepath.Join(b.TempDir(), "stream.tar")
+	tag, err := name.NewTag("app:latest")
+	if err != nil {
+		b.Fatalf("parse tag failed: %v", err)
+	}
+	if err := tarball.WriteToFile(script, tag, img); err != nil {
+		b.Fatalf("write image archive failed: %v", err)
+	}
+	// The daemon stores the loaded archive and exports it back, as docker
+	// save does.
+	stored := filepath.Join(b.TempDir(), "stored.tar")
+	docker := newFakeDockerClient(b, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/load"):
+			f, err := os.Create(stored)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			_, err = io.Copy(f, r.Body)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			_, _ = fmt.Fprintln(w, `{"stream":"Loaded image: app:latest\n"}`)
+		case strings.HasSuffix(r.URL.Path, "/images/get"):
+			http.ServeFile(w, r, stored)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(docker),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		b.Fatalf("create container client failed: %v", err)
+	}
+
+	push := func(
+		b *testing.B,
+		load func(ctx context.Context, ref name.Reference, archive string) error,
+	) {
+		for b.Loop() {
+			// Every push uploads all the blobs to an empty registry, and a
+			// fresh archive path is read again instead of from the cache.
+			b.StopTimer()
+			srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+			ref, err := name.ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/example/app")
+			if err != nil {
+				b.Fatalf("parse reference failed: %v", err)
+			}
+			archive := filepath.Join(b.TempDir(), "image.tar")
+			b.StartTimer()
+			if err := load(context.Background(), ref, archive); err != nil {
+				b.Fatalf("load stream image failed: %v", err)
+			}
+			_, err = containerClient.PushImage(
+				context.Background(),
+				ref,
+				HostPlatform(),
+				archive,
+				nil,
+			)
+			if err != nil {
+				b.Fatalf("push image failed: %v", err)
+			}
+			srv.Close()
+		}
+	}
+	b.Run("captured", func(b *testing.B) {
+		push(b, func(ctx context.Context, ref name.Reference, archive string) error {
+			_, err := containerClient.LoadStreamImageArchive(ctx, ref, script, archive)
+			return err
+		})
+	})
+	b.Run("reexported", func(b *testing.B) {
+		push(b, func(ctx context.Context, ref name.Reference, archive string) error {
+			if _, err := containerClient.LoadStreamImage(ctx, ref, script); err != nil {
+				return err
+			}
+			rc, err := docker.ImageSave(ctx, []string{"app:latest"})
+			if err != nil {
+				return err
+			}
+			defer func() { _ = rc.Close() }()
+			f, err := os.Create(archive)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			if _, err := io.Copy(f, rc); err != nil {
+				return err
+			}
+			return f.Close()
+		})
+	})
+}
+
+// fakeContainerRuntime keeps the names of the images loaded into it in memory.
+type fakeContainerRuntime struct {
+	mu       sync.Mutex
+	images   map[string]string
+	layers   []int
+	loadErrs []error
+	pingErr  error
+}
+
+func newFakeContainerRuntime() *fakeContainerRuntime {
+	return &fakeContainerRuntime{images: map[string]string{}}
+}
+
+func (f *fakeContainerRuntime) Load(
+	_ context.Context,
+	r io.Reader,
+	layers int,
+) (LoadedImage, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return LoadedImage{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.layers = append(f.layers, layers)
+	if len(f.loadErrs) > 0 {
+		err := f.loadErrs[0]
+		f.loadErrs = f.loadErrs[1:]
+		return LoadedImage{}, err
+	}
+	manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(raw)), nil
+	})
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("invalid image archive: %w", err)
+	}
+	id := manifest[0].Config
+	if len(manifest[0].RepoTags) == 0 {
+		f.images[id] = id
+		return LoadedImage{ID: id}, nil
+	}
+	ref, err := name.ParseReference(manifest[0].RepoTags[0])
+	if err != nil {
+		return LoadedImage{}, err
+	}
+	f.images[ref.Name()] = id
+	return LoadedImage{Ref: ref}, nil
+}
+
+func (f *fakeContainerRuntime) Tag(_ context.Context, src LoadedImage, dst name.Reference) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, ok := f.images[src.String()]
+	if !ok {
+		return fmt.Errorf("no such image: %s", src)
+	}
+	f.images[dst.Name()] = id
+	if src.Ref != nil && src.Ref.Name() != dst.Name() {
+		delete(f.images, src.Ref.Name())
+	}
+	return nil
+}
+
+func (f *fakeContainerRuntime) Remove(_ context.Context, ref name.Reference) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.images[ref.Name()]; !ok {
+		return fmt.Errorf("no such image: %s", ref)
+	}
+	delete(f.images, ref.Name())
+	return nil
+}
+
+func (f *fakeContainerRuntime) List(context.Context) ([]LocalImage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []LocalImage
+	for tag, id := range f.images {
+		ref, err := name.ParseReference(tag)
+		if err != nil {
+			continue
+		}
+		out = append(out, LocalImage{Ref: ref, ID: id})
+	}
+	return out, nil
+}
+
+func (f *fakeContainerRuntime) Ping(context.Context) error {
+	return f.pingErr
+}
+
+// names returns the sorted names of the images in the runtime.
+func (f *fakeContainerRuntime) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Sorted(maps.Keys(f.images))
+}
+
+func TestContainerClientRuntimeBackend(t *testing.T) {
+	original := loadRetryDelay
+	loadRetryDelay = 0
+	t.Cleanup(func() { loadRetryDelay = original })
+
+	rt := newFakeContainerRuntime()
+	rt.loadErrs = []error{syscall.ECONNRESET}
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerRuntimeBackend(rt),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	ctx := context.Background()
+	ref := mustParseReference(t, "ghcr.io/example/app:v1")
+	loaded, err := containerClient.LoadImage(ctx, ref, writeTestImageArchive(t))
+	if err != nil {
+		t.Fatalf("load image failed: %v", err)
+	}
+	if loaded.Ref == nil || loaded.Ref.Name() != "index.docker.io/library/app:latest" {
+		t.Fatalf("expected the archive tag to be loaded, got %s", loaded)
+	}
+	// The transient failure was retried, with the layer count of the archive.
+	if !slices.Equal(rt.layers, []int{2, 2}) {
+		t.Fatalf("expected two loads of 2 layers, got %v", rt.layers)
+	}
+
+	if err := containerClient.TagImage(ctx, loaded, ref); err != nil {
+		t.Fatalf("tag image failed: %v", err)
+	}
+	if got := rt.names(); !slices.Equal(got, []string{ref.Name()}) {
+		t.Fatalf("expected the loaded image renamed to %s, got %v", ref, got)
+	}
+	images, err := containerClient.ListImages(ctx)
+	if err != nil || len(images) != 1 || images[0].Ref.Name() != ref.Name() {
+		t.Fatalf("expected %s listed, got %v, %v", ref, images, err)
+	}
+	if err := containerClient.RemoveImage(ctx, ref); err != nil {
+		t.Fatalf("remove image failed: %v", err)
+	}
+	if got := rt.names(); len(got) != 0 {
+		t.Fatalf("expected no images left, got %v", got)
+	}
+
+	rt.pingErr = errors.New("runtime is not reachable")
+	if err := containerClient.Ping(ctx); !errors.Is(err, rt.pingErr) {
+		t.Fatalf("expected the runtime ping error, got %v", err)
+	}
+	if version := containerClient.APIVersion(); version != "" {
+		t.Fatalf("expected no docker API version, got %s", version)
+	}
+}
+
+func TestIsTransientDaemonError(t *testing.T) {
+	transient := []error{
+		fmt.Errorf("docker image load failed: %w", syscall.ECONNRESET),
+		fmt.Errorf("failed to read loaded ref: failed to read line: %w", io.EOF),
+		errors.New("Cannot connect to the Docker daemon: dial unix /var/run/docker.sock: connect"),
+	}
+	for _, err := range transient {
+		if !isTransientDaemonError(err) {
+			t.Fatalf("expected %v to be transient", err)
+		}
+	}
+	for _, err := range []error{
+		errors.New("failed to wait for command: exit status 1"),
+		context.DeadlineExceeded,
+	} {
+		if isTransientDaemonError(err) {
+			t.Fatalf("expected %v not to be transient", err)
+		}
+	}
+}
+
+func TestContainerClientCheckRepository(t *testing.T) {
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	// A repository never pushed to is created by the first push.
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	if err := containerClient.CheckRepository(context.Background(), ref); err != nil {
+		t.Fatalf("expected a missing repository to pass, got %v", err)
+	}
+
+	denied := newTestRegistryRef(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, `{"errors":[{"code":"DENIED","message":"denied"}]}`, http.StatusForbidden)
+	}), "example/app:latest")
+	if err := containerClient.CheckRepository(context.Background(), denied); err == nil {
+		t.Fatalf("expected a denied repository to fail")
+	}
+}
+
+func TestContainerClientHeadImage(t *testing.T) {
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	if _, exists, err := containerClient.HeadImage(context.Background(), ref); err != nil || exists {
+		t.Fatalf("expected a missing tag to be absent, got exists=%v err=%v", exists, err)
+	}
+	if _, err := containerClient.PushImage(
+		context.Background(),
+		ref,
+		HostPlatform(),
+		writeTestImageArchive(t),
+		nil,
+	); err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	desc, err := remote.Head(ref)
+	if err != nil {
+		t.Fatalf("head pushed image failed: %v", err)
+	}
+	digest, exists, err := containerClient.HeadImage(context.Background(), ref)
+	if err != nil || !exists || digest != desc.Digest {
+		t.Fatalf(
+			"expected %s to exist at %s, got %s exists=%v err=%v",
+			ref,
+			desc.Digest,
+			digest,
+			exists,
+			err,
+		)
+	}
+
+	// Registries hiding missing repositories behind a 401 still let pushing
+	// credentials start an upload.
+	handler := registry.New()
+	hidden := newTestRegistryRef(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			http.Error(
+				w,
+				`{"errors":[{"code":"UNAUTHORIZED","message":"unauthorized"}]}`,
+				http.StatusUnauthorized,
+			)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), "example/app:latest")
+	if _, exists, err := containerClient.HeadImage(context.Background(), hidden); err != nil || exists {
+		t.Fatalf(
+			"expected a hidden missing repository to be absent, got exists=%v err=%v",
+			exists,
+			err,
+		)
+	}
+
+	denied := newTestRegistryRef(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(
+			w,
+			`{"errors":[{"code":"UNAUTHORIZED","message":"unauthorized"}]}`,
+			http.StatusUnauthorized,
+		)
+	}), "example/app:latest")
+	if _, _, err := containerClient.HeadImage(context.Background(), denied); err == nil {
+		t.Fatalf("expected denied credentials to fail")
+	}
+}
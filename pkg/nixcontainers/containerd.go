@@ -0,0 +1,214 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/defaults"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	// ContainerRuntimeDocker loads images into the Docker daemon.
+	ContainerRuntimeDocker = "docker"
+	// ContainerRuntimeContainerd loads images into a containerd image store,
+	// as used by nerdctl and Kubernetes nodes.
+	ContainerRuntimeContainerd = "containerd"
+	// ContainerRuntimeAuto uses the Docker daemon when it answers and
+	// containerd otherwise.
+	ContainerRuntimeAuto = "auto"
+)
+
+// DefaultContainerdNamespace is the containerd namespace used by nerdctl.
+// Kubernetes nodes keep their images in the k8s.io namespace.
+const DefaultContainerdNamespace = "default"
+
+// runtimeProbeTimeout bounds each daemon ping when detecting the runtime.
+const runtimeProbeTimeout = 2 * time.Second
+
+// containerdImageStore imports, tags and removes images in one namespace of
+// a containerd image store through its gRPC API.
+type containerdImageStore struct {
+	client *containerd.Client
+}
+
+func newContainerdImageStore(address, namespace string) (*containerdImageStore, error) {
+	if address == "" {
+		address = defaults.DefaultAddress
+	}
+	if namespace == "" {
+		namespace = DefaultContainerdNamespace
+	}
+	client, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("create containerd client failed: %w", err)
+	}
+	return &containerdImageStore{client: client}, nil
+}
+
+// Ping checks that the containerd daemon answers.
+func (s *containerdImageStore) Ping(ctx context.Context) error {
+	if _, err := s.client.Version(ctx); err != nil {
+		return fmt.Errorf("containerd is not reachable: %w", err)
+	}
+	return nil
+}
+
+// Load imports the docker archive read from r and returns the image it names,
+// which containerd always does. The image is unpacked for the default
+// snapshotter when it matches the host platform, so it can run without
+// another unpack. The load progress is not reported.
+func (s *containerdImageStore) Load(ctx context.Context, r io.Reader, _ int) (LoadedImage, error) {
+	imgs, err := s.client.Import(ctx, r, containerd.WithAllPlatforms(true))
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("containerd image import failed: %w", err)
+	}
+	if len(imgs) == 0 {
+		return LoadedImage{}, errors.New("containerd image import returned no image")
+	}
+	img := imgs[0]
+	if err := containerd.NewImage(s.client, img).Unpack(ctx, ""); err != nil {
+		slog.DebugContext(ctx, "unpack imported image skipped", "image", img.Name, "err", err)
+	}
+	ref, err := name.ParseReference(img.Name)
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf(
+			"failed to parse imported image name %q: %w",
+			img.Name,
+			err,
+		)
+	}
+	slog.InfoContext(ctx, "containerd image imported", "image", img.Name)
+	return LoadedImage{Ref: ref}, nil
+}
+
+// Tag names the image of src as dst, replacing any image dst named before,
+// and removes the src name like the Docker runtime does.
+func (s *containerdImageStore) Tag(ctx context.Context, src LoadedImage, dst name.Reference) error {
+	if src.Ref == nil {
+		return fmt.Errorf("tag image failed: containerd image %s has no name", src)
+	}
+	srcName, err := containerdImageName(src.Ref)
+	if err != nil {
+		return err
+	}
+	dstName, err := containerdImageName(dst)
+	if err != nil {
+		return err
+	}
+	if srcName == dstName {
+		return nil
+	}
+	is := s.client.ImageService()
+	img, err := is.Get(ctx, srcName)
+	if err != nil {
+		return fmt.Errorf("tag image failed: %w", err)
+	}
+	img.Name = dstName
+	if _, err := is.Create(ctx, img); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return fmt.Errorf("tag image failed: %w", err)
+		}
+		if _, err := is.Update(ctx, img); err != nil {
+			return fmt.Errorf("tag image failed: %w", err)
+		}
+	}
+	if err := is.Delete(ctx, srcName); err != nil {
+		return fmt.Errorf("remove image failed: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the ref name from the image store; the content is garbage
+// collected by containerd once no image references it.
+func (s *containerdImageStore) Remove(ctx context.Context, ref name.Reference) error {
+	imageName, err := containerdImageName(ref)
+	if err != nil {
+		return err
+	}
+	if err := s.client.ImageService().Delete(ctx, imageName); err != nil {
+		return fmt.Errorf("remove image failed: %w", err)
+	}
+	return nil
+}
+
+// List returns the images of the namespace that are named by a reference.
+func (s *containerdImageStore) List(ctx context.Context) ([]LocalImage, error) {
+	imgs, err := s.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list images failed: %w", err)
+	}
+	out := make([]LocalImage, 0, len(imgs))
+	for _, img := range imgs {
+		ref, err := name.ParseReference(img.Name)
+		if err != nil {
+			continue
+		}
+		out = append(out, LocalImage{
+			Ref:     ref,
+			ID:      img.Target.Digest.String(),
+			Created: img.CreatedAt,
+		})
+	}
+	return out, nil
+}
+
+// containerdImageName returns the fully qualified name containerd stores ref
+// under, such as docker.io/library/app:latest.
+func containerdImageName(ref name.Reference) (string, error) {
+	named, err := reference.ParseDockerRef(ref.Name())
+	if err != nil {
+		return "", fmt.Errorf("invalid containerd image name %q: %w", ref.Name(), err)
+	}
+	return named.String(), nil
+}
+
+// resolveContainerRuntime returns the runtime images are loaded into. Auto
+// prefers the Docker daemon and falls back to containerd when only it answers;
+// when neither answers, Docker is kept so errors point at the usual setup.
+func resolveContainerRuntime(
+	ctx context.Context,
+	runtime string,
+	pingDocker, pingContainerd func(context.Context) error,
+) (string, error) {
+	switch runtime {
+	case ContainerRuntimeDocker, ContainerRuntimeContainerd:
+		return runtime, nil
+	case "", ContainerRuntimeAuto:
+	default:
+		return "", fmt.Errorf(
+			"invalid container runtime %q: expected %s, %s or %s",
+			runtime,
+			ContainerRuntimeAuto,
+			ContainerRuntimeDocker,
+			ContainerRuntimeContainerd,
+		)
+	}
+
+	probe := func(ping func(context.Context) error) error {
+		ctx, cancel := context.WithTimeout(ctx, runtimeProbeTimeout)
+		defer cancel()
+		return ping(ctx)
+	}
+	dockerErr := probe(pingDocker)
+	if dockerErr == nil {
+		return ContainerRuntimeDocker, nil
+	}
+	if err := probe(pingContainerd); err == nil {
+		slog.InfoContext(
+			ctx,
+			"docker daemon not reachable, using containerd",
+			"err",
+			dockerErr,
+		)
+		return ContainerRuntimeContainerd, nil
+	}
+	return ContainerRuntimeDocker, nil
+}
@@ -0,0 +1,70 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestResolveContainerRuntime(t *testing.T) {
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+
+	tests := []struct {
+		name       string
+		runtime    string
+		docker     func(context.Context) error
+		containerd func(context.Context) error
+		want       string
+	}{
+		{name: "auto prefers docker", runtime: "auto", docker: up, containerd: up, want: "docker"},
+		{name: "auto falls back", runtime: "", docker: down, containerd: up, want: "containerd"},
+		{name: "auto keeps docker", runtime: "auto", docker: down, containerd: down, want: "docker"},
+		{name: "explicit docker", runtime: "docker", docker: down, containerd: up, want: "docker"},
+		{
+			name:       "explicit containerd",
+			runtime:    "containerd",
+			docker:     up,
+			containerd: down,
+			want:       "containerd",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveContainerRuntime(
+				context.Background(),
+				tt.runtime,
+				tt.docker,
+				tt.containerd,
+			)
+			if err != nil {
+				t.Fatalf("resolve runtime failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := resolveContainerRuntime(context.Background(), "podman", up, up); err == nil {
+		t.Fatalf("expected invalid runtime error")
+	}
+}
+
+func TestContainerdImageName(t *testing.T) {
+	tests := map[string]string{
+		"app:latest":                 "docker.io/library/app:latest",
+		"example/app":                "docker.io/example/app:latest",
+		"ghcr.io/example/app:v1":     "ghcr.io/example/app:v1",
+		"localhost:5000/app:v1_test": "localhost:5000/app:v1_test",
+	}
+	for raw, want := range tests {
+		got, err := containerdImageName(mustParseReference(t, raw))
+		if err != nil {
+			t.Fatalf("containerd image name of %s failed: %v", raw, err)
+		}
+		if got != want {
+			t.Fatalf("containerdImageName(%s) = %s, want %s", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package nixcontainers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// dockerRuntime loads, tags and removes images in the Docker daemon.
+type dockerRuntime struct {
+	client *client.Client
+	// host is the endpoint of the daemon named in errors.
+	host string
+}
+
+// Load loads the docker archive read from r, following the load progress the
+// daemon streams back.
+func (d *dockerRuntime) Load(ctx context.Context, r io.Reader, layers int) (LoadedImage, error) {
+	resp, err := d.client.ImageLoad(ctx, r)
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("docker image load on %s failed: %w", d.host, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	loaded, err := readImageLoadedRef(ctx, bufio.NewReader(resp.Body), newLoadProgress(layers))
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to read loaded ref: %w", err)
+	}
+	return loaded, nil
+}
+
+// Tag tags src as dst. An image loaded under another ref is renamed, dropping
+// the loaded ref, while an untagged image is tagged by ID.
+func (d *dockerRuntime) Tag(ctx context.Context, src LoadedImage, dst name.Reference) error {
+	if err := d.client.ImageTag(ctx, src.String(), dst.Name()); err != nil {
+		return fmt.Errorf("tag image failed: %w", err)
+	}
+	if src.Ref == nil {
+		return nil
+	}
+	if _, err := d.client.ImageRemove(ctx, src.Ref.Name(), image.RemoveOptions{}); err != nil {
+		return fmt.Errorf("remove image failed: %w", err)
+	}
+	return nil
+}
+
+// Remove removes ref from the daemon, only untagging the image when it has
+// other tags.
+func (d *dockerRuntime) Remove(ctx context.Context, ref name.Reference) error {
+	if _, err := d.client.ImageRemove(ctx, ref.Name(), image.RemoveOptions{}); err != nil {
+		return fmt.Errorf("remove image failed: %w", err)
+	}
+	return nil
+}
+
+// List returns every tagged image of the daemon, one entry per tag.
+func (d *dockerRuntime) List(ctx context.Context) ([]LocalImage, error) {
+	summaries, err := d.client.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list images failed: %w", err)
+	}
+	var out []LocalImage
+	for _, summary := range summaries {
+		for _, tag := range summary.RepoTags {
+			ref, err := name.ParseReference(tag)
+			if err != nil {
+				// Dangling images are listed as <none>:<none>.
+				continue
+			}
+			out = append(out, LocalImage{
+				Ref:     ref,
+				ID:      summary.ID,
+				Created: time.Unix(summary.Created, 0),
+			})
+		}
+	}
+	return out, nil
+}
+
+// Ping checks the daemon answers.
+func (d *dockerRuntime) Ping(ctx context.Context) error {
+	if _, err := d.client.Ping(ctx); err != nil {
+		return fmt.Errorf("docker daemon at %s is not reachable: %w", d.host, err)
+	}
+	return nil
+}
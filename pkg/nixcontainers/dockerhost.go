@@ -0,0 +1,134 @@
+package nixcontainers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/connhelper"
+	"github.com/docker/docker/client"
+)
+
+// defaultDockerContext is the docker context of the DOCKER_HOST or default
+// socket, which has no metadata.
+const defaultDockerContext = "default"
+
+// dockerContextMeta is the subset of the metadata of a docker context holding
+// its docker endpoint.
+type dockerContextMeta struct {
+	Endpoints struct {
+		Docker struct {
+			Host string `json:"Host"`
+		} `json:"docker"`
+	} `json:"Endpoints"`
+}
+
+// ResolveDockerHost returns the docker endpoint to connect to: host when set,
+// else DOCKER_HOST, else the endpoint of the docker context selected by
+// DOCKER_CONTEXT or the currentContext of the docker config. It is empty for
+// the default socket.
+func ResolveDockerHost(host string) (string, error) {
+	return resolveDockerHost(host, config.Dir())
+}
+
+// resolveDockerHost resolves host like ResolveDockerHost, with the docker
+// config and contexts in dir.
+func resolveDockerHost(host, dir string) (string, error) {
+	if host != "" {
+		return host, nil
+	}
+	if host := os.Getenv(client.EnvOverrideHost); host != "" {
+		return host, nil
+	}
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name == "" {
+		cfg, err := config.Load(dir)
+		if err != nil {
+			return "", fmt.Errorf("failed to read docker config in %s: %w", dir, err)
+		}
+		name = cfg.CurrentContext
+	}
+	if name == "" || name == defaultDockerContext {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(name))
+	path := filepath.Join(dir, "contexts", "meta", hex.EncodeToString(sum[:]), "meta.json")
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read docker context %s: %w", name, err)
+	}
+	var meta dockerContextMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return "", fmt.Errorf("failed to parse docker context %s: %w", name, err)
+	}
+	if meta.Endpoints.Docker.Host == "" {
+		return "", fmt.Errorf("docker context %s has no docker endpoint", name)
+	}
+	return meta.Endpoints.Docker.Host, nil
+}
+
+// newDockerClient connects to the docker endpoint resolved from host, over
+// ssh for ssh:// endpoints and with the TLS files of certPath when set, and
+// returns it with the endpoint for errors.
+func newDockerClient(
+	ctx context.Context,
+	host, certPath string,
+) (*client.Client, string, error) {
+	host, err := ResolveDockerHost(host)
+	if err != nil {
+		return nil, "", err
+	}
+	opts := []client.Opt{client.FromEnv}
+	if host != "" {
+		helper, err := connhelper.GetConnectionHelper(host)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid docker host %s: %w", host, err)
+		}
+		if helper == nil {
+			opts = append(opts, client.WithHost(host))
+		} else {
+			// The helper dials through ssh, so requests go to a placeholder
+			// host over its connections.
+			opts = append(
+				opts,
+				client.WithHTTPClient(&http.Client{
+					Transport: &http.Transport{DialContext: helper.Dialer},
+				}),
+				client.WithHost(helper.Host),
+				client.WithDialContext(helper.Dialer),
+			)
+		}
+	}
+	if certPath != "" {
+		opts = append(opts, client.WithTLSClientConfig(
+			filepath.Join(certPath, "ca.pem"),
+			filepath.Join(certPath, "cert.pem"),
+			filepath.Join(certPath, "key.pem"),
+		))
+	}
+	docker, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, "", fmt.Errorf("create docker client for %s failed: %w", dockerEndpoint(host), err)
+	}
+	if host == "" {
+		host = docker.DaemonHost()
+	}
+	slog.DebugContext(ctx, "docker endpoint resolved", "docker_host", host)
+	docker.NegotiateAPIVersion(ctx)
+	return docker, host, nil
+}
+
+// dockerEndpoint names host in errors, the default socket when empty.
+func dockerEndpoint(host string) string {
+	if host == "" {
+		return client.DefaultDockerHost
+	}
+	return host
+}
@@ -0,0 +1,102 @@
+package nixcontainers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDockerContext writes a docker config in dir selecting the context
+// name, whose docker endpoint is host.
+func writeDockerContext(t *testing.T, dir, name, host string) {
+	t.Helper()
+
+	config := `{"currentContext":"` + name + `"}`
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600); err != nil {
+		t.Fatalf("write docker config failed: %v", err)
+	}
+	sum := sha256.Sum256([]byte(name))
+	meta := filepath.Join(dir, "contexts", "meta", hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(meta, 0o700); err != nil {
+		t.Fatalf("create docker context failed: %v", err)
+	}
+	raw := `{"Name":"` + name + `","Endpoints":{"docker":{"Host":"` + host + `"}}}`
+	if err := os.WriteFile(filepath.Join(meta, "meta.json"), []byte(raw), 0o600); err != nil {
+		t.Fatalf("write docker context failed: %v", err)
+	}
+}
+
+func TestResolveDockerHost(t *testing.T) {
+	dir := t.TempDir()
+	writeDockerContext(t, dir, "builder", "ssh://builder@build.example.com")
+
+	tests := []struct {
+		name       string
+		host       string
+		dockerHost string
+		context    string
+		want       string
+		err        string
+	}{
+		{name: "current context", want: "ssh://builder@build.example.com"},
+		{
+			name:       "docker host env",
+			dockerHost: "tcp://10.0.0.2:2375",
+			want:       "tcp://10.0.0.2:2375",
+		},
+		{
+			name:       "explicit host",
+			host:       "ssh://me@other",
+			dockerHost: "tcp://10.0.0.2:2375",
+			want:       "ssh://me@other",
+		},
+		{name: "default context", context: "default", want: ""},
+		{name: "missing context", context: "gone", err: "failed to read docker context gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_HOST", tt.dockerHost)
+			t.Setenv("DOCKER_CONTEXT", tt.context)
+
+			got, err := resolveDockerHost(tt.host, dir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve docker host failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected docker host %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDockerRuntimePingNamesEndpoint(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "")
+
+	docker, host, err := newDockerClient(context.Background(), "tcp://127.0.0.1:1", "")
+	if err != nil {
+		t.Fatalf("create docker client failed: %v", err)
+	}
+	if host != "tcp://127.0.0.1:1" {
+		t.Fatalf("expected the docker host kept, got %q", host)
+	}
+	err = (&dockerRuntime{client: docker, host: host}).Ping(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "docker daemon at tcp://127.0.0.1:1") {
+		t.Fatalf("expected the endpoint named in the error, got %v", err)
+	}
+
+	if _, _, err := newDockerClient(context.Background(), "ssh://", ""); err == nil ||
+		!strings.Contains(err.Error(), "invalid docker host ssh://") {
+		t.Fatalf("expected an invalid ssh host named in the error, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package nixcontainers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+var awsCommandContext = exec.CommandContext
+
+// ecrRegistryPattern matches the private ECR registries,
+// <account>.dkr.ecr.<region>.amazonaws.com, FIPS and China ones included.
+var ecrRegistryPattern = regexp.MustCompile(
+	`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`,
+)
+
+// IsECRRegistry reports whether registry is a private AWS ECR registry.
+func IsECRRegistry(registry string) bool {
+	return ecrRegistryPattern.MatchString(registry)
+}
+
+// ECRRepositoryOptions configures the ECR repositories created before
+// pushing to them.
+type ECRRepositoryOptions struct {
+	// Tags are the resource tags of created repositories.
+	Tags map[string]string
+	// ImmutableTags prevents the image tags of created repositories from
+	// being overwritten.
+	ImmutableTags bool
+}
+
+// WithContainerECRCreateRepository creates the ECR repository a push fails
+// to find, with opts, using the aws CLI and its credentials, then retries
+// the push.
+func WithContainerECRCreateRepository(opts ECRRepositoryOptions) ContainerOption {
+	return func(o *containerOptions) {
+		o.ecrRepository = &opts
+	}
+}
+
+// ecrRepositoryCreator creates ECR repositories once per process, concurrent
+// pushes to a repository waiting for the same creation.
+type ecrRepositoryCreator struct {
+	opts ECRRepositoryOptions
+
+	mu        sync.Mutex
+	creations map[string]*ecrCreation
+}
+
+type ecrCreation struct {
+	once sync.Once
+	err  error
+}
+
+func newECRRepositoryCreator(opts ECRRepositoryOptions) *ecrRepositoryCreator {
+	return &ecrRepositoryCreator{opts: opts, creations: map[string]*ecrCreation{}}
+}
+
+// create creates repo, a repository another process created in the meantime
+// counting as created.
+func (e *ecrRepositoryCreator) create(ctx context.Context, repo name.Repository) error {
+	e.mu.Lock()
+	c, ok := e.creations[repo.Name()]
+	if !ok {
+		c = &ecrCreation{}
+		e.creations[repo.Name()] = c
+	}
+	e.mu.Unlock()
+	c.once.Do(func() { c.err = e.run(ctx, repo) })
+	return c.err
+}
+
+func (e *ecrRepositoryCreator) run(ctx context.Context, repo name.Repository) error {
+	m := ecrRegistryPattern.FindStringSubmatch(repo.RegistryStr())
+	if m == nil {
+		return fmt.Errorf("%s is not an ECR registry", repo.RegistryStr())
+	}
+	mutability := "MUTABLE"
+	if e.opts.ImmutableTags {
+		mutability = "IMMUTABLE"
+	}
+	args := []string{
+		"ecr", "create-repository",
+		"--registry-id", m[1],
+		"--region", m[2],
+		"--repository-name", repo.RepositoryStr(),
+		"--image-tag-mutability", mutability,
+		"--output", "json",
+	}
+	if len(e.opts.Tags) > 0 {
+		type ecrTag struct {
+			Key   string
+			Value string
+		}
+		tags := make([]ecrTag, 0, len(e.opts.Tags))
+		for _, key := range slices.Sorted(maps.Keys(e.opts.Tags)) {
+			tags = append(tags, ecrTag{Key: key, Value: e.opts.Tags[key]})
+		}
+		raw, err := json.Marshal(tags)
+		if err != nil {
+			return fmt.Errorf("encode repository tags failed: %w", err)
+		}
+		args = append(args, "--tags", string(raw))
+	}
+	slog.InfoContext(ctx, "creating ECR repository", "repository", repo.Name())
+	out, err := awsCommandContext(ctx, "aws", args...).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "RepositoryAlreadyExistsException") {
+			slog.DebugContext(ctx, "ECR repository already exists", "repository", repo.Name())
+			return nil
+		}
+		return fmt.Errorf(
+			"aws ecr create-repository failed for %s: %w: %s",
+			repo.Name(),
+			err,
+			strings.TrimSpace(string(out)),
+		)
+	}
+	return nil
+}
+
+// createMissingRepository creates the ECR repository repo when err reports
+// it missing and repository creation is enabled, and reports whether the
+// failed request should be retried. Otherwise, err is returned unchanged.
+func (c *ContainerClient) createMissingRepository(
+	ctx context.Context,
+	repo name.Repository,
+	err error,
+) (bool, error) {
+	if c.ecr == nil || !IsECRRegistry(repo.RegistryStr()) || !isRepositoryNotFound(err) {
+		return false, err
+	}
+	if cerr := c.ecr.create(ctx, repo); cerr != nil {
+		return false, fmt.Errorf("%w (creating the repository failed: %w)", err, cerr)
+	}
+	return true, nil
+}
+
+// isRepositoryNotFound reports whether a registry request failed because
+// the repository does not exist.
+func isRepositoryNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	for _, d := range terr.Errors {
+		if d.Code == transport.NameUnknownErrorCode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func setupAWSCommandTest(t *testing.T, stderr string, exitCode int) (string, *atomic.Int32) {
+	t.Helper()
+
+	commandStubMu.Lock()
+	original := awsCommandContext
+	t.Cleanup(func() {
+		awsCommandContext = original
+		commandStubMu.Unlock()
+	})
+	argsFile := filepath.Join(t.TempDir(), "args.json")
+	stub := stubCommand(t, "", stderr, exitCode, argsFile)
+	var calls atomic.Int32
+	awsCommandContext = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		calls.Add(1)
+		return stub(ctx, command, args...)
+	}
+	return argsFile, &calls
+}
+
+func TestIsECRRegistry(t *testing.T) {
+	tests := []struct {
+		registry string
+		want     bool
+	}{
+		{registry: "123456789012.dkr.ecr.eu-west-1.amazonaws.com", want: true},
+		{registry: "123456789012.dkr.ecr-fips.us-east-1.amazonaws.com", want: true},
+		{registry: "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", want: true},
+		{registry: "public.ecr.aws"},
+		{registry: "ghcr.io"},
+		{registry: "123456789012.dkr.ecr.eu-west-1.amazonaws.com.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			if got := IsECRRegistry(tt.registry); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestECRRepositoryCreatorCreatesOnce(t *testing.T) {
+	argsFile, calls := setupAWSCommandTest(t, "", 0)
+	repo, err := name.NewRepository("123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/app")
+	if err != nil {
+		t.Fatalf("parse repository failed: %v", err)
+	}
+	creator := newECRRepositoryCreator(ECRRepositoryOptions{
+		Tags:          map[string]string{"team": "platform", "env": "prod"},
+		ImmutableTags: true,
+	})
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			if err := creator.create(context.Background(), repo); err != nil {
+				t.Errorf("create repository failed: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected a single create-repository call, got %d", got)
+	}
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"aws",
+		"ecr", "create-repository",
+		"--registry-id", "123456789012",
+		"--region", "eu-west-1",
+		"--repository-name", "team/app",
+		"--image-tag-mutability", "IMMUTABLE",
+		"--output", "json",
+		"--tags", `[{"Key":"env","Value":"prod"},{"Key":"team","Value":"platform"}]`,
+	)
+}
+
+func TestECRRepositoryCreatorExistingRepository(t *testing.T) {
+	tests := []struct {
+		name    string
+		stderr  string
+		wantErr bool
+	}{
+		{
+			name:   "already exists",
+			stderr: "An error occurred (RepositoryAlreadyExistsException) when calling the CreateRepository operation",
+		},
+		{
+			name:    "access denied",
+			stderr:  "An error occurred (AccessDeniedException) when calling the CreateRepository operation",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupAWSCommandTest(t, tt.stderr, 254)
+			repo, err := name.NewRepository("123456789012.dkr.ecr.eu-west-1.amazonaws.com/app")
+			if err != nil {
+				t.Fatalf("parse repository failed: %v", err)
+			}
+			err = newECRRepositoryCreator(ECRRepositoryOptions{}).create(context.Background(), repo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestContainerClientCreateMissingRepository(t *testing.T) {
+	setupAWSCommandTest(t, "", 0)
+	notFound := &transport.Error{
+		StatusCode: http.StatusNotFound,
+		Errors:     []transport.Diagnostic{{Code: transport.NameUnknownErrorCode}},
+	}
+	ecr := newECRRepositoryCreator(ECRRepositoryOptions{})
+
+	tests := []struct {
+		name      string
+		client    *ContainerClient
+		registry  string
+		err       error
+		wantRetry bool
+	}{
+		{
+			name:      "missing ecr repository",
+			client:    &ContainerClient{ecr: ecr},
+			registry:  "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+			err:       notFound,
+			wantRetry: true,
+		},
+		{
+			name:     "creation disabled",
+			client:   &ContainerClient{},
+			registry: "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+			err:      notFound,
+		},
+		{
+			name:     "not ecr",
+			client:   &ContainerClient{ecr: ecr},
+			registry: "ghcr.io",
+			err:      notFound,
+		},
+		{
+			name:     "other error",
+			client:   &ContainerClient{ecr: ecr},
+			registry: "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+			err:      errors.New("connection reset"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := name.NewRepository(tt.registry + "/app")
+			if err != nil {
+				t.Fatalf("parse repository failed: %v", err)
+			}
+			retry, err := tt.client.createMissingRepository(context.Background(), repo, tt.err)
+			if retry != tt.wantRetry {
+				t.Fatalf("expected retry %v, got %v", tt.wantRetry, retry)
+			}
+			if !retry && !errors.Is(err, tt.err) {
+				t.Fatalf("expected the original error, got %v", err)
+			}
+		})
+	}
+}
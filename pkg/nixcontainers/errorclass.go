@@ -0,0 +1,99 @@
+package nixcontainers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ErrorClass names why a build failed, so a caller can tell a user error
+// from an infrastructure one worth retrying.
+type ErrorClass string
+
+const (
+	// UnknownErrorClass is the class of an error that was not classified.
+	UnknownErrorClass ErrorClass = "unknown"
+	// ConfigErrorClass is an invalid configuration or build request.
+	ConfigErrorClass ErrorClass = "config"
+	// EvalErrorClass is a flake that fails to evaluate or lacks the package.
+	EvalErrorClass ErrorClass = "nix_eval"
+	// BuildErrorClass is a derivation that fails to build.
+	BuildErrorClass ErrorClass = "nix_build"
+	// LoadErrorClass is the container runtime failing to load or tag an
+	// image.
+	LoadErrorClass ErrorClass = "daemon_load"
+	// AuthErrorClass is a registry rejecting the credentials.
+	AuthErrorClass ErrorClass = "registry_auth"
+	// PushErrorClass is a registry failing a push or a read.
+	PushErrorClass ErrorClass = "registry_push"
+	// SmokeTestErrorClass is a smoke test failing in the built image.
+	SmokeTestErrorClass ErrorClass = "smoke_test"
+)
+
+// ClassifiedError is an error of a known class.
+type ClassifiedError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *ClassifiedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError returns err as an error of class. An error that is already
+// classified keeps its class, since the failing step knows it best.
+func ClassifyError(class ErrorClass, err error) error {
+	if err == nil || ErrorClassOf(err) != UnknownErrorClass {
+		return err
+	}
+	return &ClassifiedError{Class: class, Err: err}
+}
+
+// ErrorClassOf returns the class of err, or UnknownErrorClass when it was not
+// classified.
+func ErrorClassOf(err error) ErrorClass {
+	var cerr *ClassifiedError
+	if errors.As(err, &cerr) {
+		return cerr.Class
+	}
+	return UnknownErrorClass
+}
+
+// nixBuildFailurePattern matches the nix errors of a derivation that was
+// evaluated but failed to build, as opposed to an evaluation error.
+var nixBuildFailurePattern = regexp.MustCompile(
+	`(?m)^error: (builder for|build of|Cannot build|\d+ dependenc(y|ies) of derivation) '`,
+)
+
+// classifyNixBuildError classifies a failed nix build by its stderr.
+func classifyNixBuildError(err error, stderr string) error {
+	if nixBuildFailurePattern.MatchString(stderr) {
+		return ClassifyError(BuildErrorClass, err)
+	}
+	return ClassifyError(EvalErrorClass, err)
+}
+
+// classifyRegistryError classifies a failed registry request as an auth
+// error when the registry rejected the credentials, and as a push error
+// otherwise.
+func classifyRegistryError(err error) error {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		if terr.StatusCode == http.StatusUnauthorized ||
+			terr.StatusCode == http.StatusForbidden {
+			return ClassifyError(AuthErrorClass, err)
+		}
+		for _, d := range terr.Errors {
+			if d.Code == transport.UnauthorizedErrorCode || d.Code == transport.DeniedErrorCode {
+				return ClassifyError(AuthErrorClass, err)
+			}
+		}
+	}
+	return ClassifyError(PushErrorClass, err)
+}
@@ -0,0 +1,96 @@
+package nixcontainers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestClassifyErrorKeepsInnerClass(t *testing.T) {
+	err := fmt.Errorf("push failed: %w", ClassifyError(AuthErrorClass, errors.New("denied")))
+	if got := ErrorClassOf(ClassifyError(PushErrorClass, err)); got != AuthErrorClass {
+		t.Fatalf("expected class %s, got %s", AuthErrorClass, got)
+	}
+	if ClassifyError(ConfigErrorClass, nil) != nil {
+		t.Fatal("expected a nil error to stay nil")
+	}
+	if got := ErrorClassOf(errors.New("boom")); got != UnknownErrorClass {
+		t.Fatalf("expected class %s, got %s", UnknownErrorClass, got)
+	}
+}
+
+func TestClassifyNixBuildError(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   ErrorClass
+	}{
+		{
+			name:   "missing attribute",
+			stderr: "error: flake 'path:/src' does not provide attribute 'packages.x86_64-linux.app'",
+			want:   EvalErrorClass,
+		},
+		{
+			name:   "failed builder",
+			stderr: "error: builder for '/nix/store/abc-app.drv' failed with exit code 1",
+			want:   BuildErrorClass,
+		},
+		{
+			name:   "failed dependency",
+			stderr: "error: 1 dependencies of derivation '/nix/store/abc-image.drv' failed to build",
+			want:   BuildErrorClass,
+		},
+		{
+			name:   "cannot build",
+			stderr: "warning: x\nerror: Cannot build '/nix/store/abc-app.drv'.",
+			want:   BuildErrorClass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyNixBuildError(errors.New("nix build failed"), tt.stderr)
+			if got := ErrorClassOf(err); got != tt.want {
+				t.Fatalf("expected class %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClassifyRegistryError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{
+			name: "unauthorized",
+			err:  &transport.Error{StatusCode: http.StatusUnauthorized},
+			want: AuthErrorClass,
+		},
+		{
+			name: "denied",
+			err: &transport.Error{
+				StatusCode: http.StatusBadRequest,
+				Errors:     []transport.Diagnostic{{Code: transport.DeniedErrorCode}},
+			},
+			want: AuthErrorClass,
+		},
+		{
+			name: "server error",
+			err:  &transport.Error{StatusCode: http.StatusBadGateway},
+			want: PushErrorClass,
+		},
+		{name: "network", err: errors.New("connection reset by peer"), want: PushErrorClass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyRegistryError(fmt.Errorf("push image failed: %w", tt.err))
+			if got := ErrorClassOf(err); got != tt.want {
+				t.Fatalf("expected class %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
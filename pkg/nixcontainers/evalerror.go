@@ -0,0 +1,122 @@
+package nixcontainers
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// nixEvalSuggestions bounds the attribute names suggested by a NixEvalError.
+const nixEvalSuggestions = 5
+
+var (
+	// nixMissingAttributePatterns match the nix errors of an installable
+	// naming an attribute the flake does not have.
+	nixMissingAttributePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^(?:error: )?flake '[^']+' does not provide attribute '([^']+)'`),
+		regexp.MustCompile(`(?m)^(?:error: )?attribute '([^']+)' missing`),
+	}
+	// nixDidYouMeanPattern matches the attribute names nix suggests after a
+	// missing attribute.
+	nixDidYouMeanPattern = regexp.MustCompile(`(?m)^Did you mean (?:one of )?(.+)\?$`)
+)
+
+// NixEvalError is a nix build failing to evaluate its installable because
+// the flake lacks an attribute, without the nix trace leading to it.
+type NixEvalError struct {
+	// Installable is the flake attribute nix was asked to build.
+	Installable string
+	// Attribute is the attribute nix reported missing.
+	Attribute string
+	// Suggestions are existing attribute names close to the missing one.
+	Suggestions []string
+	// Err is the failed nix build, with the tail of its stderr.
+	Err error
+}
+
+func (e *NixEvalError) Error() string {
+	msg := fmt.Sprintf("evaluate %s failed: attribute '%s' missing", e.Installable, e.Attribute)
+	if len(e.Suggestions) > 0 {
+		msg += fmt.Sprintf("; did you mean %s?", strings.Join(e.Suggestions, ", "))
+	}
+	return msg
+}
+
+func (e *NixEvalError) Unwrap() error {
+	return e.Err
+}
+
+// parseNixEvalError returns the missing attribute error of installable in
+// the stderr of a failed nix build, or nil when it failed otherwise.
+func parseNixEvalError(installable string, err error, stderr string) *NixEvalError {
+	for _, pattern := range nixMissingAttributePatterns {
+		m := pattern.FindStringSubmatch(stderr)
+		if m == nil {
+			continue
+		}
+		evalErr := &NixEvalError{Installable: installable, Attribute: m[1], Err: err}
+		if m := nixDidYouMeanPattern.FindStringSubmatch(stderr); m != nil {
+			names := strings.FieldsFunc(
+				strings.ReplaceAll(m[1], " or ", ","),
+				func(r rune) bool { return r == ',' || r == ' ' },
+			)
+			evalErr.Suggestions = names[:min(len(names), nixEvalSuggestions)]
+		}
+		return evalErr
+	}
+	return nil
+}
+
+// suggestAttributes returns the names other than attr close to it, the
+// closest first: the ones within a few edits of it and the ones it is a
+// prefix of.
+func suggestAttributes(attr string, names []string) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	want := strings.ToLower(attr)
+	maxDistance := max(2, len(want)/3)
+	var candidates []candidate
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if name == attr {
+			continue
+		}
+		d := editDistance(want, lower)
+		if d > maxDistance && !strings.HasPrefix(lower, want) {
+			continue
+		}
+		candidates = append(candidates, candidate{name: name, distance: d})
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return a.distance - b.distance
+	})
+	suggestions := make([]string, 0, min(len(candidates), nixEvalSuggestions))
+	for _, c := range candidates[:min(len(candidates), nixEvalSuggestions)] {
+		suggestions = append(suggestions, c.name)
+	}
+	return suggestions
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,112 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestParseNixEvalError(t *testing.T) {
+	tests := []struct {
+		name        string
+		stderr      string
+		attribute   string
+		suggestions []string
+	}{
+		{
+			name:      "flake attribute",
+			stderr:    "error: flake 'path:/src' does not provide attribute 'packages.x86_64-linux.ap', 'legacyPackages.x86_64-linux.ap' or 'ap'",
+			attribute: "packages.x86_64-linux.ap",
+		},
+		{
+			name: "nested attribute",
+			stderr: "error:\n… while evaluating the attribute 'config'\nat /nix/store/abc-source/flake.nix:12:5:\n" +
+				"error: attribute 'entrypont' missing\nat /nix/store/abc-source/image.nix:3:9:\n" +
+				"Did you mean one of entrypoint, entrypoints or endpoint?",
+			attribute:   "entrypont",
+			suggestions: []string{"entrypoint", "entrypoints", "endpoint"},
+		},
+		{
+			name:        "single suggestion",
+			stderr:      "error: attribute 'ap' missing\nDid you mean app?",
+			attribute:   "ap",
+			suggestions: []string{"app"},
+		},
+		{
+			name:   "build failure",
+			stderr: "error: builder for '/nix/store/abc-app.drv' failed with exit code 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseNixEvalError("/src#packages.x86_64-linux.ap", errors.New("exit status 1"), tt.stderr)
+			if tt.attribute == "" {
+				if err != nil {
+					t.Fatalf("expected no eval error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an eval error")
+			}
+			if err.Attribute != tt.attribute {
+				t.Fatalf("expected attribute %q, got %q", tt.attribute, err.Attribute)
+			}
+			if !slices.Equal(err.Suggestions, tt.suggestions) {
+				t.Fatalf("expected suggestions %v, got %v", tt.suggestions, err.Suggestions)
+			}
+		})
+	}
+}
+
+func TestSuggestAttributes(t *testing.T) {
+	names := []string{"api", "app", "app-debug", "App", "worker", "tools"}
+	got := suggestAttributes("app", names)
+	if want := []string{"App", "api", "app-debug"}; !slices.Equal(got, want) {
+		t.Fatalf("expected suggestions %v, got %v", want, got)
+	}
+	if got := suggestAttributes("database", names); len(got) != 0 {
+		t.Fatalf("expected no suggestions for a distant name, got %v", got)
+	}
+}
+
+func TestNixClientBuildPlatformImageReportsEvalError(t *testing.T) {
+	setupNixCommandTest(
+		t,
+		"",
+		"error:\n… while evaluating the flake output attributes\n"+
+			"error: flake 'path:/workspace' does not provide attribute 'packages.x86_64-linux.ap'",
+		1,
+	)
+
+	ref, err := name.NewTag("ghcr.io/you/ap:latest")
+	if err != nil {
+		t.Fatalf("parse tag failed: %v", err)
+	}
+	_, err = NewNixClient().BuildPlatformImage(
+		context.Background(),
+		"/workspace",
+		ref,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+	)
+	var evalErr *NixEvalError
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("expected a nix eval error, got %v", err)
+	}
+	if ErrorClassOf(err) != EvalErrorClass {
+		t.Fatalf("expected an eval error, got %v", ErrorClassOf(err))
+	}
+	want := "evaluate /workspace#packages.x86_64-linux.ap failed: " +
+		"attribute 'packages.x86_64-linux.ap' missing"
+	if err.Error() != want {
+		t.Fatalf("expected %q without the nix trace, got %q", want, err.Error())
+	}
+	if !strings.Contains(errors.Unwrap(evalErr).Error(), "while evaluating") {
+		t.Fatalf("expected the nix stderr kept in the wrapped error, got %v", evalErr.Err)
+	}
+}
@@ -0,0 +1,185 @@
+package nixcontainers
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// ExtraLayer is a local file or directory added to every image as a layer
+// of its own, on top of the nix layers.
+type ExtraLayer struct {
+	// Source is the local file or directory. The content of a directory is
+	// added, while a file is added under its base name.
+	Source string
+	// Dest is the absolute directory Source is added in, / when empty.
+	Dest string
+	// UID and GID own every added file.
+	UID int
+	GID int
+}
+
+// String formats the layer as the SRC:DEST it was given as.
+func (l ExtraLayer) String() string {
+	return l.Source + ":" + l.dest()
+}
+
+func (l ExtraLayer) dest() string {
+	if l.Dest == "" {
+		return "/"
+	}
+	return path.Clean(l.Dest)
+}
+
+// WithContainerExtraLayers appends layers, in order, to every image before it
+// is loaded, pushed or written to a layout.
+func WithContainerExtraLayers(layers []ExtraLayer) ContainerOption {
+	return func(o *containerOptions) { o.extraLayers = layers }
+}
+
+// extraLayer is an ExtraLayer archived once, so every platform image gets
+// the same layer blob.
+type extraLayer struct {
+	layer   v1.Layer
+	history string
+}
+
+// newExtraLayers archives layers, failing on a source that cannot be read
+// before anything is built.
+func newExtraLayers(layers []ExtraLayer) ([]extraLayer, error) {
+	out := make([]extraLayer, 0, len(layers))
+	for _, l := range layers {
+		raw, err := tarExtraLayer(l)
+		if err != nil {
+			return nil, fmt.Errorf("archive extra layer %s failed: %w", l, err)
+		}
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(raw)), nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create extra layer %s failed: %w", l, err)
+		}
+		out = append(out, extraLayer{
+			layer:   layer,
+			history: fmt.Sprintf("nix-containers --add-layer %s (%d:%d)", l, l.UID, l.GID),
+		})
+	}
+	return out, nil
+}
+
+// tarExtraLayer archives the source of l under its destination, owned by its
+// UID and GID with zeroed timestamps, so the layer only changes with the
+// files. Symlinks are kept as links and never followed.
+func tarExtraLayer(l ExtraLayer) ([]byte, error) {
+	if !path.IsAbs(l.dest()) {
+		return nil, fmt.Errorf("destination %q is not absolute", l.Dest)
+	}
+	info, err := os.Lstat(l.Source)
+	if err != nil {
+		return nil, err
+	}
+	root := strings.TrimPrefix(l.dest(), "/")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(file, name string, info fs.FileInfo) error {
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return fmt.Errorf("%s is neither a regular file, a directory nor a symlink", file)
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = l.UID, l.GID
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		_, err = io.Copy(tw, f)
+		return err
+	}
+	if !info.IsDir() {
+		if err := add(l.Source, path.Join(root, filepath.Base(l.Source)), info); err != nil {
+			return nil, err
+		}
+	} else {
+		// The destination itself is left out, so an existing directory of the
+		// image keeps its mode and owner.
+		err = filepath.WalkDir(l.Source, func(file string, d fs.DirEntry, err error) error {
+			if err != nil || file == l.Source {
+				return err
+			}
+			rel, err := filepath.Rel(l.Source, file)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return add(file, path.Join(root, filepath.ToSlash(rel)), info)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// appendExtraLayers appends the extra layers to img, each with a history
+// entry describing it, dated like the image.
+func (c *ContainerClient) appendExtraLayers(img v1.Image) (v1.Image, error) {
+	if len(c.extraLayers) == 0 {
+		return img, nil
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("read image config failed: %w", err)
+	}
+	adds := make([]mutate.Addendum, 0, len(c.extraLayers))
+	for _, l := range c.extraLayers {
+		adds = append(adds, mutate.Addendum{
+			Layer:   l.layer,
+			History: v1.History{Created: cf.Created, CreatedBy: l.history},
+		})
+	}
+	img, err = mutate.Append(img, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("append extra layers failed: %w", err)
+	}
+	return img, nil
+}
@@ -0,0 +1,170 @@
+package nixcontainers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func writeExtraLayerSource(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0o755); err != nil {
+		t.Fatalf("create source dir failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "certs", "ca.pem"), []byte("ca"), 0o644); err != nil {
+		t.Fatalf("write source file failed: %v", err)
+	}
+	if err := os.Symlink("certs/ca.pem", filepath.Join(dir, "ca.pem")); err != nil {
+		t.Fatalf("create source symlink failed: %v", err)
+	}
+	return dir
+}
+
+func readTarHeaders(t *testing.T, raw []byte) map[string]*tar.Header {
+	t.Helper()
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(bytes.NewReader(raw))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return headers
+		}
+		if err != nil {
+			t.Fatalf("read layer failed: %v", err)
+		}
+		headers[hdr.Name] = hdr
+	}
+}
+
+func TestTarExtraLayer(t *testing.T) {
+	src := writeExtraLayerSource(t)
+	l := ExtraLayer{Source: src, Dest: "/etc/ssl/", UID: 1000, GID: 100}
+
+	raw, err := tarExtraLayer(l)
+	if err != nil {
+		t.Fatalf("archive layer failed: %v", err)
+	}
+	headers := readTarHeaders(t, raw)
+	if len(headers) != 3 {
+		t.Fatalf("expected 3 entries, got %v", headers)
+	}
+	for _, name := range []string{"etc/ssl/certs/", "etc/ssl/certs/ca.pem", "etc/ssl/ca.pem"} {
+		hdr, ok := headers[name]
+		if !ok {
+			t.Fatalf("expected %s in the layer, got %v", name, headers)
+		}
+		if hdr.Uid != 1000 || hdr.Gid != 100 || hdr.Uname != "" || hdr.Gname != "" {
+			t.Fatalf("expected %s owned by 1000:100, got %d:%d", name, hdr.Uid, hdr.Gid)
+		}
+		if !hdr.ModTime.Equal(time.Unix(0, 0)) {
+			t.Fatalf("expected %s with a zero timestamp, got %s", name, hdr.ModTime)
+		}
+	}
+	if hdr := headers["etc/ssl/ca.pem"]; hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "certs/ca.pem" {
+		t.Fatalf("expected the symlink to be kept, got %+v", hdr)
+	}
+
+	// Another checkout of the same files archives to the same bytes.
+	if err := os.Chtimes(filepath.Join(src, "certs", "ca.pem"), time.Now(), time.Now()); err != nil {
+		t.Fatalf("touch source file failed: %v", err)
+	}
+	again, err := tarExtraLayer(l)
+	if err != nil {
+		t.Fatalf("archive layer again failed: %v", err)
+	}
+	if !bytes.Equal(raw, again) {
+		t.Fatal("expected the layer to be reproducible")
+	}
+}
+
+func TestTarExtraLayerFile(t *testing.T) {
+	src := filepath.Join(writeExtraLayerSource(t), "certs", "ca.pem")
+
+	raw, err := tarExtraLayer(ExtraLayer{Source: src})
+	if err != nil {
+		t.Fatalf("archive layer failed: %v", err)
+	}
+	headers := readTarHeaders(t, raw)
+	hdr, ok := headers["ca.pem"]
+	if len(headers) != 1 || !ok {
+		t.Fatalf("expected ca.pem at the root, got %v", headers)
+	}
+	if hdr.Uid != 0 || hdr.Gid != 0 {
+		t.Fatalf("expected root ownership by default, got %d:%d", hdr.Uid, hdr.Gid)
+	}
+
+	for _, l := range []ExtraLayer{
+		{Source: src, Dest: "etc"},
+		{Source: filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := tarExtraLayer(l); err == nil {
+			t.Fatalf("expected error for %s", l)
+		}
+	}
+}
+
+func TestContainerClientPushPlatformImageExtraLayers(t *testing.T) {
+	path := writeTestImageArchive(t)
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerExtraLayers([]ExtraLayer{{Source: writeExtraLayerSource(t), Dest: "/etc/ssl"}}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	var digests []v1.Hash
+	for _, p := range []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	} {
+		ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+		_, err = containerClient.PushPlatformImage(context.Background(), ref, p, path, nil)
+		if err != nil {
+			t.Fatalf("push platform image failed: %v", err)
+		}
+		img, err := remote.Image(ref)
+		if err != nil {
+			t.Fatalf("fetch pushed image failed: %v", err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatalf("read pushed layers failed: %v", err)
+		}
+		if len(layers) != 3 {
+			t.Fatalf("expected the extra layer on top of 2 nix layers, got %d", len(layers))
+		}
+		digest, err := layers[2].Digest()
+		if err != nil {
+			t.Fatalf("get layer digest failed: %v", err)
+		}
+		digests = append(digests, digest)
+		cf, err := img.ConfigFile()
+		if err != nil {
+			t.Fatalf("read pushed config failed: %v", err)
+		}
+		last := cf.History[len(cf.History)-1]
+		if last.CreatedBy == "" || last.EmptyLayer {
+			t.Fatalf("expected a history entry for the extra layer, got %+v", last)
+		}
+	}
+	if digests[0] != digests[1] {
+		t.Fatalf("expected every platform to get the same layer, got %v", digests)
+	}
+}
@@ -0,0 +1,56 @@
+package nixcontainers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// FlakeMetadata is the subset of nix flake metadata --json used by the
+// builder.
+type FlakeMetadata struct {
+	Description   string `json:"description"`
+	LastModified  int64  `json:"lastModified"`
+	OriginalURL   string `json:"originalUrl"`
+	ResolvedURL   string `json:"resolvedUrl"`
+	URL           string `json:"url"`
+	Revision      string `json:"revision"`
+	DirtyRevision string `json:"dirtyRevision"`
+	Path          string `json:"path"`
+}
+
+// FlakeMetadata runs nix flake metadata --json for flakeRef.
+func (n *NixClient) FlakeMetadata(
+	ctx context.Context,
+	flakeRef string,
+	opts ...ImageOption,
+) (*FlakeMetadata, error) {
+	o := makeImageOptions(opts...)
+
+	args := []string{"flake", "metadata", "--json", flakeRef}
+	if o.noPureEval {
+		args = append(args, "--no-pure-eval")
+	}
+	if o.refresh {
+		args = append(args, "--refresh")
+	}
+	cmd := n.command(ctx, args...)
+	slog.DebugContext(ctx, "reading flake metadata", "cmd", cmd.Path, "args", args)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, formatNixBuildError(
+			fmt.Errorf("failed to run nix flake metadata: %w", err),
+			stderr.String(),
+		)
+	}
+	var metadata FlakeMetadata
+	if err := json.Unmarshal(output, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse nix flake metadata output: %w", err)
+	}
+	return &metadata, nil
+}
@@ -0,0 +1,34 @@
+package nixcontainers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNixClientFlakeMetadataParsesOutput(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`{"description":"app","lastModified":1700000000,"revision":"abc123",`+
+			`"url":"git+file:///workspace"}`,
+		"",
+		0,
+	)
+
+	got, err := NewNixClient().FlakeMetadata(context.Background(), "/workspace")
+	if err != nil {
+		t.Fatalf("flake metadata failed: %v", err)
+	}
+	if got.Description != "app" || got.Revision != "abc123" || got.LastModified != 1700000000 {
+		t.Fatalf("unexpected metadata %+v", got)
+	}
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"flake",
+		"metadata",
+		"--json",
+		"/workspace",
+		"--no-pure-eval",
+	)
+}
@@ -0,0 +1,50 @@
+package nixcontainers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// DefaultHeartbeatInterval is how often the command line logs that a nix
+// build or a push is still running.
+const DefaultHeartbeatInterval = time.Minute
+
+// startHeartbeat logs msg at info every interval, with the time elapsed and
+// the attributes attrs returns then, until the returned function is called,
+// so that CI jobs killed after minutes without output keep hearing from long
+// phases. The returned function only returns once logging stopped. A zero
+// interval disables it.
+func startHeartbeat(
+	ctx context.Context,
+	interval time.Duration,
+	msg string,
+	attrs func() []any,
+) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				args := append([]any{"elapsed", time.Since(start).Round(time.Second)}, attrs()...)
+				slog.InfoContext(ctx, msg, args...)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
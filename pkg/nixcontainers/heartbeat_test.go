@@ -0,0 +1,51 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartHeartbeat(t *testing.T) {
+	var buf bytes.Buffer
+	original := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(original) })
+
+	stop := startHeartbeat(context.Background(), 10*time.Millisecond, "nix build running", func() []any {
+		return []any{"building", "stream-app"}
+	})
+	time.Sleep(55 * time.Millisecond)
+	stop()
+	beats := strings.Count(buf.String(), "\n")
+	if beats < 2 {
+		t.Fatalf("expected heartbeats while running, got %q", buf.String())
+	}
+	var record struct {
+		Level    string `json:"level"`
+		Msg      string `json:"msg"`
+		Elapsed  int64  `json:"elapsed"`
+		Building string `json:"building"`
+	}
+	if err := json.Unmarshal([]byte(strings.SplitN(buf.String(), "\n", 2)[0]), &record); err != nil {
+		t.Fatalf("invalid JSON log line: %v", err)
+	}
+	if record.Level != "INFO" || record.Msg != "nix build running" || record.Building != "stream-app" {
+		t.Fatalf("unexpected heartbeat %+v", record)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if n := strings.Count(buf.String(), "\n"); n != beats {
+		t.Fatalf("expected heartbeats to stop with the phase, got %d more", n-beats)
+	}
+
+	buf.Reset()
+	startHeartbeat(context.Background(), 0, "push running", func() []any { return nil })()
+	if buf.Len() != 0 {
+		t.Fatalf("expected no heartbeat when disabled, got %q", buf.String())
+	}
+}
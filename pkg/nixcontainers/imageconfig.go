@@ -0,0 +1,177 @@
+package nixcontainers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// ImageConfig overrides the config of every built image. A nil field keeps
+// the value nix built, while an empty one clears it.
+type ImageConfig struct {
+	Entrypoint []string
+	Cmd        []string
+	// Env holds KEY=VALUE entries merged into the env of the image, a later
+	// entry replacing an earlier one with the same key.
+	Env []string
+	// User and WorkingDir replace the ones of the image when not empty. User
+	// is passed as-is, as a uid, uid:gid or name.
+	User       string
+	WorkingDir string
+	// ExposedPorts, as PORT/PROTO, and Volumes are added to the ones of the
+	// image.
+	ExposedPorts []string
+	Volumes      []string
+	// Labels are merged into the labels of the image.
+	Labels map[string]string
+	// RequireNonRoot fails images whose effective user is root.
+	RequireNonRoot bool
+}
+
+// Empty reports whether the config of the image is left unchanged.
+func (c ImageConfig) Empty() bool {
+	return c.Entrypoint == nil && c.Cmd == nil && len(c.Env) == 0 &&
+		c.User == "" && c.WorkingDir == "" && len(c.ExposedPorts) == 0 && len(c.Volumes) == 0 &&
+		len(c.Labels) == 0
+}
+
+// AsBuilt reports whether images can be used as nix built them, without
+// being changed or checked.
+func (c ImageConfig) AsBuilt() bool {
+	return c.Empty() && !c.RequireNonRoot
+}
+
+// apply returns cfg with the overridden fields replaced.
+func (c ImageConfig) apply(cfg v1.Config) v1.Config {
+	if c.Entrypoint != nil {
+		cfg.Entrypoint = overrideCommand(c.Entrypoint)
+	}
+	if c.Cmd != nil {
+		cfg.Cmd = overrideCommand(c.Cmd)
+	}
+	if len(c.Env) > 0 {
+		cfg.Env = mergeEnv(cfg.Env, c.Env)
+	}
+	if c.User != "" {
+		cfg.User = c.User
+	}
+	if c.WorkingDir != "" {
+		cfg.WorkingDir = c.WorkingDir
+	}
+	if len(c.ExposedPorts) > 0 {
+		cfg.ExposedPorts = addKeys(cfg.ExposedPorts, c.ExposedPorts)
+	}
+	if len(c.Volumes) > 0 {
+		cfg.Volumes = addKeys(cfg.Volumes, c.Volumes)
+	}
+	if len(c.Labels) > 0 {
+		labels := make(map[string]string, len(cfg.Labels)+len(c.Labels))
+		maps.Copy(labels, cfg.Labels)
+		maps.Copy(labels, c.Labels)
+		cfg.Labels = labels
+	}
+	return cfg
+}
+
+// addKeys returns a copy of set with keys added, leaving set unchanged since
+// it is shared with the config of the image.
+func addKeys(set map[string]struct{}, keys []string) map[string]struct{} {
+	added := make(map[string]struct{}, len(set)+len(keys))
+	for key := range set {
+		added[key] = struct{}{}
+	}
+	for _, key := range keys {
+		added[key] = struct{}{}
+	}
+	return added
+}
+
+// isRootUser reports whether a config user runs as root: no user at all, or
+// a uid 0 or root user whatever the group.
+func isRootUser(user string) bool {
+	uid, _, _ := strings.Cut(user, ":")
+	return uid == "" || uid == "0" || uid == "root"
+}
+
+// overrideCommand returns nil for a cleared command, so it is left out of the
+// config rather than written as an empty array.
+func overrideCommand(command []string) []string {
+	if len(command) == 0 {
+		return nil
+	}
+	return command
+}
+
+// WithContainerImageConfig overrides the config of every image before it is
+// loaded, pushed or written to a layout.
+func WithContainerImageConfig(cfg ImageConfig) ContainerOption {
+	return func(o *containerOptions) { o.imageConfig = cfg }
+}
+
+// WithContainerAnnotations adds annotations to the manifest of every image.
+func WithContainerAnnotations(annotations map[string]string) ContainerOption {
+	return func(o *containerOptions) { o.annotations = annotations }
+}
+
+// configureImage applies the image config overrides to img, the image of
+// ref for p, and checks its effective user when a non-root one is required.
+func (c *ContainerClient) configureImage(
+	ctx context.Context,
+	ref name.Reference,
+	p *v1.Platform,
+	img v1.Image,
+) (v1.Image, error) {
+	if c.imageConfig.AsBuilt() {
+		return img, nil
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("read image config failed: %w", err)
+	}
+	for _, key := range OverriddenEnvKeys(cf.Config.Env, c.imageConfig.Env) {
+		slog.DebugContext(ctx, "image env var overridden", "key", key)
+	}
+	cfg := c.imageConfig.apply(cf.Config)
+	if c.imageConfig.RequireNonRoot && isRootUser(cfg.User) {
+		return nil, fmt.Errorf(
+			"image %s for %s runs as root (user %q) but a non-root user is required, "+
+				"set one with --user",
+			ref,
+			FormatSystemName(p),
+			cfg.User,
+		)
+	}
+	if c.imageConfig.Empty() {
+		return img, nil
+	}
+	img, err = mutate.Config(img, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("override image config failed: %w", err)
+	}
+	return img, nil
+}
+
+// OverriddenEnvKeys returns the keys of the KEY=VALUE entries of env that
+// replace an entry of base.
+func OverriddenEnvKeys(base, env []string) []string {
+	keys := make(map[string]bool, len(base))
+	for _, kv := range base {
+		key, _, _ := strings.Cut(kv, "=")
+		keys[key] = true
+	}
+	var overridden []string
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if keys[key] {
+			overridden = append(overridden, key)
+		}
+		keys[key] = true
+	}
+	return overridden
+}
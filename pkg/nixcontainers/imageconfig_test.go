@@ -0,0 +1,233 @@
+package nixcontainers
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestContainerClientPushPlatformImageOverridesConfig(t *testing.T) {
+	path, _ := writeTestNixImageArchive(t, v1.Config{
+		Entrypoint:   []string{"/bin/app"},
+		Cmd:          []string{"serve"},
+		Env:          []string{"APP=1", "MODE=debug"},
+		ExposedPorts: map[string]struct{}{"9090/tcp": {}},
+	})
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerImageConfig(ImageConfig{
+			Entrypoint:   []string{},
+			Cmd:          []string{"/bin/worker", "--queue", "jobs"},
+			Env:          []string{"MODE=release", "REGION=eu"},
+			User:         "65532:65532",
+			WorkingDir:   "/srv",
+			ExposedPorts: []string{"8080/tcp"},
+			Volumes:      []string{"/data"},
+			Labels:       map[string]string{"org.opencontainers.image.revision": "abc"},
+		}),
+		WithContainerAnnotations(map[string]string{"org.opencontainers.image.revision": "abc"}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	ref := newTestRegistryRef(t, registry.New(), "example/worker:latest")
+	_, err = containerClient.PushPlatformImage(
+		context.Background(),
+		ref,
+		HostPlatform(),
+		path,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("push platform image failed: %v", err)
+	}
+
+	img, err := remote.Image(ref)
+	if err != nil {
+		t.Fatalf("fetch pushed image failed: %v", err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read pushed config failed: %v", err)
+	}
+	if cf.Config.Entrypoint != nil {
+		t.Fatalf("expected the entrypoint to be cleared, got %q", cf.Config.Entrypoint)
+	}
+	if !slices.Equal(cf.Config.Cmd, []string{"/bin/worker", "--queue", "jobs"}) {
+		t.Fatalf("expected the overridden cmd, got %q", cf.Config.Cmd)
+	}
+	if !slices.Equal(cf.Config.Env, []string{"APP=1", "MODE=release", "REGION=eu"}) {
+		t.Fatalf("expected the env to be merged, got %q", cf.Config.Env)
+	}
+	if cf.Config.User != "65532:65532" || cf.Config.WorkingDir != "/srv" {
+		t.Fatalf("expected the overridden user and workdir, got %+v", cf.Config)
+	}
+	if _, ok := cf.Config.ExposedPorts["9090/tcp"]; !ok || len(cf.Config.ExposedPorts) != 2 {
+		t.Fatalf("expected the exposed ports to be added, got %v", cf.Config.ExposedPorts)
+	}
+	if _, ok := cf.Config.Volumes["/data"]; !ok {
+		t.Fatalf("expected the /data volume, got %v", cf.Config.Volumes)
+	}
+	if cf.Config.Labels["org.opencontainers.image.revision"] != "abc" {
+		t.Fatalf("expected the revision label, got %v", cf.Config.Labels)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("read pushed manifest failed: %v", err)
+	}
+	if m.Annotations["org.opencontainers.image.revision"] != "abc" {
+		t.Fatalf("expected the revision annotation, got %v", m.Annotations)
+	}
+}
+
+func TestContainerClientRequireNonRoot(t *testing.T) {
+	path, _ := writeTestNixImageArchive(t, v1.Config{User: "0:1000"})
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	for _, tt := range []struct {
+		cfg     ImageConfig
+		wantErr bool
+	}{
+		{cfg: ImageConfig{RequireNonRoot: true}, wantErr: true},
+		{cfg: ImageConfig{RequireNonRoot: true, User: "root"}, wantErr: true},
+		{cfg: ImageConfig{RequireNonRoot: true, User: "1000"}},
+		{cfg: ImageConfig{RequireNonRoot: true, User: "app:app"}},
+	} {
+		containerClient, err := NewContainerClient(
+			context.Background(),
+			WithContainerDockerClient(&client.Client{}),
+			WithContainerKeychain(fakeKeychain{}),
+			WithContainerImageConfig(tt.cfg),
+		)
+		if err != nil {
+			t.Fatalf("create container client failed: %v", err)
+		}
+		_, err = containerClient.GetLocalPlatformImage(
+			context.Background(),
+			ref,
+			HostPlatform(),
+			path,
+		)
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), ref.String()) {
+				t.Fatalf("expected a root user error naming %s for %+v, got %v", ref, tt.cfg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected user %q to be accepted, got %v", tt.cfg.User, err)
+		}
+	}
+}
+
+func TestIsRootUser(t *testing.T) {
+	for user, want := range map[string]bool{
+		"":           true,
+		"0":          true,
+		"root":       true,
+		"0:0":        true,
+		"root:wheel": true,
+		"1000":       false,
+		"1000:0":     false,
+		"nobody":     false,
+	} {
+		if got := isRootUser(user); got != want {
+			t.Fatalf("isRootUser(%q) = %t, want %t", user, got, want)
+		}
+	}
+}
+
+func TestContainerClientRenderImage(t *testing.T) {
+	path, _ := writeTestNixImageArchive(t, v1.Config{
+		Entrypoint: []string{"/bin/app"},
+		Env:        []string{"MODE=debug"},
+	})
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerImageConfig(ImageConfig{
+			Env:    []string{"MODE=release"},
+			User:   "65532:65532",
+			Labels: map[string]string{"org.opencontainers.image.revision": "abc"},
+		}),
+		WithContainerAnnotations(map[string]string{"org.opencontainers.image.revision": "abc"}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	rendered, err := containerClient.RenderImage(
+		context.Background(),
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		HostPlatform(),
+		path,
+		map[string]string{nixOutPathAnnotation: "/nix/store/abc-app.tar"},
+	)
+	if err != nil {
+		t.Fatalf("render image failed: %v", err)
+	}
+	cf := rendered.Config
+	if !slices.Equal(cf.Config.Entrypoint, []string{"/bin/app"}) ||
+		!slices.Equal(cf.Config.Env, []string{"MODE=release"}) ||
+		cf.Config.User != "65532:65532" ||
+		cf.Config.Labels["org.opencontainers.image.revision"] != "abc" {
+		t.Fatalf("expected the overridden config, got %+v", cf.Config)
+	}
+	annotations := rendered.Manifest.Annotations
+	if annotations["org.opencontainers.image.revision"] != "abc" ||
+		annotations[nixOutPathAnnotation] != "/nix/store/abc-app.tar" {
+		t.Fatalf("expected the manifest annotations, got %v", annotations)
+	}
+	if len(rendered.Manifest.Layers) != 2 {
+		t.Fatalf("expected the 2 layers of the image, got %d", len(rendered.Manifest.Layers))
+	}
+}
+
+func TestContainerClientRenderExistingImage(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	_, img := writeTestNixImageArchive(t, v1.Config{Cmd: []string{"serve"}})
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+	p := HostPlatform()
+	cf.OS, cf.Architecture = p.OS, p.Architecture
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatalf("mutate config failed: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("push existing image failed: %v", err)
+	}
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerImageConfig(ImageConfig{WorkingDir: "/srv"}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	rendered, err := containerClient.RenderExistingImage(
+		context.Background(),
+		ref,
+		ref,
+		p,
+	)
+	if err != nil {
+		t.Fatalf("render existing image failed: %v", err)
+	}
+	if !slices.Equal(rendered.Config.Config.Cmd, []string{"serve"}) ||
+		rendered.Config.Config.WorkingDir != "/srv" {
+		t.Fatalf("expected the existing config with the overrides, got %+v", rendered.Config.Config)
+	}
+}
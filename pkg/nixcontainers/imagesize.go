@@ -0,0 +1,183 @@
+package nixcontainers
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// imageSummaryLargestLayers is how many of the largest layers a summary
+// lists with their store paths.
+const imageSummaryLargestLayers = 3
+
+// imageSummary is what a built image ships: its layers and their sizes.
+type imageSummary struct {
+	Layers           []LayerSummary
+	Size             int64
+	UncompressedSize int64
+}
+
+// LayerSummary sizes one layer of an image.
+type LayerSummary struct {
+	Digest           v1.Hash `json:"digest"`
+	Size             int64   `json:"size_bytes"`
+	UncompressedSize int64   `json:"uncompressed_size_bytes"`
+	// StorePaths are the top-level nix store paths the layer contains, which
+	// nix streamed layered images put one or a few of in each layer.
+	StorePaths []string `json:"store_paths"`
+}
+
+// summarizeImage reads the layers of img to size them and list their store
+// paths. Compressed sizes come from the manifest, which the push reuses.
+func summarizeImage(img v1.Image) (imageSummary, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return imageSummary{}, fmt.Errorf("read image manifest failed: %w", err)
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		return imageSummary{}, fmt.Errorf("read image layers failed: %w", err)
+	}
+	if len(ls) != len(m.Layers) {
+		return imageSummary{}, fmt.Errorf(
+			"image has %d layers but its manifest lists %d",
+			len(ls),
+			len(m.Layers),
+		)
+	}
+	var s imageSummary
+	for i, l := range ls {
+		layer, err := SummarizeLayer(l)
+		if err != nil {
+			return imageSummary{}, fmt.Errorf("read layer %s failed: %w", m.Layers[i].Digest, err)
+		}
+		layer.Digest = m.Layers[i].Digest
+		layer.Size = m.Layers[i].Size
+		s.Layers = append(s.Layers, layer)
+		s.Size += layer.Size
+		s.UncompressedSize += layer.UncompressedSize
+	}
+	return s, nil
+}
+
+// SummarizeLayer sizes the uncompressed content of l and lists its top-level
+// store paths.
+func SummarizeLayer(l v1.Layer) (LayerSummary, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return LayerSummary{}, err
+	}
+	defer func() { _ = rc.Close() }()
+	counter := &countingReader{r: rc}
+	tr := tar.NewReader(counter)
+	var paths []string
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return LayerSummary{}, err
+		}
+		if p := topLevelStorePath(hdr.Name); p != "" && !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	// The padding after the last entry is part of the layer too.
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return LayerSummary{}, err
+	}
+	slices.Sort(paths)
+	return LayerSummary{UncompressedSize: counter.n, StorePaths: paths}, nil
+}
+
+// topLevelStorePath returns the /nix/store/<hash>-<name> path the layer entry
+// name lies in, or "" outside of the store.
+func topLevelStorePath(entry string) string {
+	rest, ok := strings.CutPrefix(path.Clean("/"+entry), "/nix/store/")
+	if !ok || rest == "" {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return "/nix/store/" + name
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// largest returns the n largest layers by compressed size, largest first.
+func (s imageSummary) largest(n int) []LayerSummary {
+	layers := slices.Clone(s.Layers)
+	slices.SortStableFunc(layers, func(a, b LayerSummary) int {
+		switch {
+		case a.Size > b.Size:
+			return -1
+		case a.Size < b.Size:
+			return 1
+		}
+		return 0
+	})
+	return layers[:min(n, len(layers))]
+}
+
+// writeTable writes the layers of the summary as an aligned table, followed
+// by the totals and the largest layers with their store paths.
+func (s imageSummary) writeTable(w io.Writer, title string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "%s\n", title)
+	_, _ = fmt.Fprintln(tw, "LAYER\tSIZE\tUNCOMPRESSED")
+	for _, l := range s.Layers {
+		_, _ = fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\n",
+			ShortDigest(l.Digest),
+			units.BytesSize(float64(l.Size)),
+			units.BytesSize(float64(l.UncompressedSize)),
+		)
+	}
+	_, _ = fmt.Fprintf(
+		tw,
+		"total (%d layers)\t%s\t%s\n",
+		len(s.Layers),
+		units.BytesSize(float64(s.Size)),
+		units.BytesSize(float64(s.UncompressedSize)),
+	)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, l := range s.largest(imageSummaryLargestLayers) {
+		paths := strings.Join(l.StorePaths, ", ")
+		if paths == "" {
+			paths = "no store paths"
+		}
+		_, _ = fmt.Fprintf(
+			w,
+			"largest %s %s: %s\n",
+			ShortDigest(l.Digest),
+			units.BytesSize(float64(l.Size)),
+			paths,
+		)
+	}
+	return nil
+}
+
+// ShortDigest abbreviates h to its first 12 hex digits.
+func ShortDigest(h v1.Hash) string {
+	return h.Algorithm + ":" + h.Hex[:min(12, len(h.Hex))]
+}
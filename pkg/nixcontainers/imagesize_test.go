@@ -0,0 +1,131 @@
+package nixcontainers
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// makeStoreLayer returns a layer holding a file of size bytes in each of the
+// store paths.
+func makeStoreLayer(t *testing.T, size int, paths ...string) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, p := range paths {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(p, "/") + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0o555,
+		}); err != nil {
+			t.Fatalf("write dir header failed: %v", err)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(p, "/") + "/bin/app",
+			Typeflag: tar.TypeReg,
+			Mode:     0o555,
+			Size:     int64(size),
+		}); err != nil {
+			t.Fatalf("write file header failed: %v", err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte{'x'}, size)); err != nil {
+			t.Fatalf("write file failed: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar failed: %v", err)
+	}
+	data := buf.Bytes()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatalf("create layer failed: %v", err)
+	}
+	return l
+}
+
+func TestSummarizeImage(t *testing.T) {
+	small := makeStoreLayer(t, 16, "/nix/store/aaa-glibc")
+	large := makeStoreLayer(t, 1<<16, "/nix/store/ccc-app", "/nix/store/bbb-openssl")
+	img, err := mutate.AppendLayers(empty.Image, small, large)
+	if err != nil {
+		t.Fatalf("append layers failed: %v", err)
+	}
+
+	s, err := summarizeImage(img)
+	if err != nil {
+		t.Fatalf("summarize image failed: %v", err)
+	}
+	if len(s.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(s.Layers))
+	}
+	var size, uncompressed int64
+	for i, l := range []v1.Layer{small, large} {
+		n, err := l.Size()
+		if err != nil {
+			t.Fatalf("layer size failed: %v", err)
+		}
+		if s.Layers[i].Size != n {
+			t.Fatalf("expected layer %d size %d, got %d", i, n, s.Layers[i].Size)
+		}
+		size += n
+		uncompressed += s.Layers[i].UncompressedSize
+	}
+	if s.Size != size || s.UncompressedSize != uncompressed {
+		t.Fatalf("expected totals %d/%d, got %d/%d", size, uncompressed, s.Size, s.UncompressedSize)
+	}
+	if s.UncompressedSize <= 1<<16 {
+		t.Fatalf("expected uncompressed size to cover the layer files, got %d", s.UncompressedSize)
+	}
+
+	largest := s.largest(imageSummaryLargestLayers)
+	if len(largest) != 2 {
+		t.Fatalf("expected both layers as the largest, got %d", len(largest))
+	}
+	want := "/nix/store/bbb-openssl,/nix/store/ccc-app"
+	if got := strings.Join(largest[0].StorePaths, ","); got != want {
+		t.Fatalf("expected largest layer store paths %q, got %q", want, got)
+	}
+
+	var out bytes.Buffer
+	if err := s.writeTable(&out, "image app for linux/amd64"); err != nil {
+		t.Fatalf("write table failed: %v", err)
+	}
+	table := out.String()
+	for _, want := range []string{
+		"LAYER",
+		"total (2 layers)",
+		"/nix/store/bbb-openssl, /nix/store/ccc-app",
+		"/nix/store/aaa-glibc",
+	} {
+		if !strings.Contains(table, want) {
+			t.Fatalf("expected table to contain %q, got:\n%s", want, table)
+		}
+	}
+}
+
+func TestTopLevelStorePath(t *testing.T) {
+	tests := map[string]string{
+		"nix/store/abc-hello/bin/hello":   "/nix/store/abc-hello",
+		"./nix/store/abc-hello/":          "/nix/store/abc-hello",
+		"/nix/store/abc-hello":            "/nix/store/abc-hello",
+		"nix/store/":                      "",
+		"etc/passwd":                      "",
+		"nix/store/../../etc/passwd":      "",
+		"nix/storefront/abc-hello/readme": "",
+	}
+	for entry, want := range tests {
+		if got := topLevelStorePath(entry); got != want {
+			t.Fatalf("topLevelStorePath(%q) = %q, want %q", entry, got, want)
+		}
+	}
+}
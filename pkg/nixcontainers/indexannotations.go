@@ -0,0 +1,90 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// WithContainerIndexAnnotations adds annotations to the multi-platform
+// index, leaving the manifests of its images to WithContainerAnnotations.
+func WithContainerIndexAnnotations(annotations map[string]string) ContainerOption {
+	return func(o *containerOptions) { o.indexAnnotations = annotations }
+}
+
+// WithContainerIndexArtifactType sets the artifactType of the multi-platform
+// index, for policy engines to select it by. Docker manifest lists have no
+// artifact type, so it only applies to OCI indexes.
+func WithContainerIndexArtifactType(artifactType string) ContainerOption {
+	return func(o *containerOptions) { o.indexArtifactType = artifactType }
+}
+
+// annotateIndex applies the index annotations to idx and, when oci is set,
+// its artifact type.
+func (c *ContainerClient) annotateIndex(idx v1.ImageIndex, oci bool) v1.ImageIndex {
+	if len(c.indexAnnotations) > 0 {
+		idx = mutate.Annotations(idx, c.indexAnnotations).(v1.ImageIndex)
+	}
+	if oci && c.indexArtifactType != "" {
+		idx = &artifactTypeIndex{index: idx, artifactType: c.indexArtifactType}
+	}
+	return idx
+}
+
+// artifactTypeIndex is an index with the artifactType field, which the
+// go-containerregistry index manifest lacks, set in its raw manifest. It
+// forwards to index otherwise.
+type artifactTypeIndex struct {
+	index        v1.ImageIndex
+	artifactType string
+}
+
+func (i *artifactTypeIndex) MediaType() (types.MediaType, error) { return i.index.MediaType() }
+
+func (i *artifactTypeIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.index.IndexManifest()
+}
+
+func (i *artifactTypeIndex) Image(h v1.Hash) (v1.Image, error) { return i.index.Image(h) }
+
+func (i *artifactTypeIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	return i.index.ImageIndex(h)
+}
+
+func (i *artifactTypeIndex) RawManifest() ([]byte, error) {
+	raw, err := i.index.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("decode index manifest failed: %w", err)
+	}
+	artifactType, err := json.Marshal(i.artifactType)
+	if err != nil {
+		return nil, fmt.Errorf("encode index artifact type failed: %w", err)
+	}
+	fields["artifactType"] = artifactType
+	return json.Marshal(fields)
+}
+
+func (i *artifactTypeIndex) Digest() (v1.Hash, error) {
+	raw, err := i.RawManifest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(raw))
+	return digest, err
+}
+
+func (i *artifactTypeIndex) Size() (int64, error) {
+	raw, err := i.RawManifest()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(raw)), nil
+}
@@ -0,0 +1,85 @@
+package nixcontainers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestContainerClientPushManifestIndexAnnotations(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	adds := makeRandomIndexAddenda(
+		t,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+		&v1.Platform{OS: "linux", Architecture: "arm64"},
+	)
+	push := func(opts ...ContainerOption) v1.Hash {
+		t.Helper()
+		containerClient, err := NewContainerClient(
+			context.Background(),
+			append(
+				[]ContainerOption{
+					WithContainerDockerClient(&client.Client{}),
+					WithContainerKeychain(fakeKeychain{}),
+				},
+				opts...,
+			)...,
+		)
+		if err != nil {
+			t.Fatalf("create container client failed: %v", err)
+		}
+		digest, _, err := containerClient.PushManifest(context.Background(), ref, adds)
+		if err != nil {
+			t.Fatalf("push manifest failed: %v", err)
+		}
+		return digest
+	}
+
+	plain := push()
+	annotated := push(
+		WithContainerIndexAnnotations(map[string]string{
+			"org.example.channel":  "stable",
+			"org.example.pipeline": "https://ci.example/runs/1",
+		}),
+		WithContainerIndexArtifactType("application/vnd.example.release.v1"),
+	)
+	if annotated == plain {
+		t.Fatalf("expected the annotations to change the index digest %s", plain)
+	}
+
+	desc, err := remote.Get(ref)
+	if err != nil {
+		t.Fatalf("read pushed index failed: %v", err)
+	}
+	if desc.Digest != annotated {
+		t.Fatalf("expected the pushed index %s, got %s", annotated, desc.Digest)
+	}
+	var manifest struct {
+		ArtifactType string            `json:"artifactType"`
+		Annotations  map[string]string `json:"annotations"`
+		Manifests    []v1.Descriptor   `json:"manifests"`
+	}
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		t.Fatalf("decode pushed index failed: %v", err)
+	}
+	if manifest.ArtifactType != "application/vnd.example.release.v1" {
+		t.Fatalf("expected the artifact type in the index, got %q", manifest.ArtifactType)
+	}
+	if manifest.Annotations["org.example.channel"] != "stable" ||
+		manifest.Annotations["org.example.pipeline"] != "https://ci.example/runs/1" {
+		t.Fatalf("expected the annotations in the index, got %v", manifest.Annotations)
+	}
+	if len(manifest.Manifests) != len(adds) {
+		t.Fatalf("expected %d manifests, got %d", len(adds), len(manifest.Manifests))
+	}
+	for _, m := range manifest.Manifests {
+		if len(m.Annotations) != 0 {
+			t.Fatalf("expected the image descriptors unannotated, got %v", m.Annotations)
+		}
+	}
+}
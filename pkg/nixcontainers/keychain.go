@@ -0,0 +1,228 @@
+package nixcontainers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// NewDockerConfigKeychain returns a keychain reading credentials from the
+// config.json of the Docker config directory dir, with the credential
+// helpers it configures, instead of the default Docker config location.
+func NewDockerConfigKeychain(dir string) authn.Keychain {
+	return &dockerConfigKeychain{dir: dir}
+}
+
+type dockerConfigKeychain struct {
+	dir string
+}
+
+func (k *dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return k.ResolveContext(context.Background(), target)
+}
+
+// ResolveContext looks the target up as the default keychain does, by
+// repository then by registry, falling back to anonymous access.
+func (k *dockerConfigKeychain) ResolveContext(
+	_ context.Context,
+	target authn.Resource,
+) (authn.Authenticator, error) {
+	cf, err := config.Load(k.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the docker config in %s: %w", k.dir, err)
+	}
+	var empty types.AuthConfig
+	for _, key := range []string{target.String(), target.RegistryStr()} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the credentials of %s: %w", key, err)
+		}
+		// GetAuthConfig fills the server address in, even without
+		// credentials.
+		cfg.ServerAddress = ""
+		if cfg != empty {
+			return authn.FromConfig(authn.AuthConfig{
+				Username:      cfg.Username,
+				Password:      cfg.Password,
+				Auth:          cfg.Auth,
+				IdentityToken: cfg.IdentityToken,
+				RegistryToken: cfg.RegistryToken,
+			}), nil
+		}
+	}
+	return authn.Anonymous, nil
+}
+
+// NewCredentialHelperKeychain returns a keychain getting credentials from
+// the docker-credential-<helper> program.
+func NewCredentialHelperKeychain(helper string) authn.Keychain {
+	return authn.NewKeychainFromHelper(credentialHelper{
+		name:    "docker-credential-" + helper,
+		program: client.NewShellProgramFunc("docker-credential-" + helper),
+	})
+}
+
+type credentialHelper struct {
+	name    string
+	program client.ProgramFunc
+}
+
+// Get returns the credentials of serverURL. The keychain falls back to
+// anonymous access on any error, so failures other than missing credentials
+// are logged.
+func (h credentialHelper) Get(serverURL string) (string, string, error) {
+	creds, err := client.Get(h.program, serverURL)
+	if err != nil {
+		if !credentials.IsErrCredentialsNotFound(err) {
+			slog.Warn(
+				"credential helper failed",
+				"helper", h.name,
+				"registry", serverURL,
+				"err", err,
+			)
+		}
+		return "", "", err
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+// NewRegistryKeychain returns a keychain resolving the registries named in
+// registries with kc and every other one with fallback.
+func NewRegistryKeychain(registries []string, kc, fallback authn.Keychain) authn.Keychain {
+	return &registryKeychain{registries: registries, keychain: kc, fallback: fallback}
+}
+
+type registryKeychain struct {
+	registries []string
+	keychain   authn.Keychain
+	fallback   authn.Keychain
+}
+
+func (k *registryKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return k.ResolveContext(context.Background(), target)
+}
+
+func (k *registryKeychain) ResolveContext(
+	ctx context.Context,
+	target authn.Resource,
+) (authn.Authenticator, error) {
+	if slices.Contains(k.registries, target.RegistryStr()) {
+		return authn.Resolve(ctx, k.keychain, target)
+	}
+	return authn.Resolve(ctx, k.fallback, target)
+}
+
+// AmbientProvider supplies credentials found in the environment a build runs
+// in, such as a CI token, for the registries it knows.
+type AmbientProvider interface {
+	// Name describes the provider and where its credentials come from,
+	// without secrets.
+	Name() string
+	// Authenticator returns the credentials for registry, or false when the
+	// provider has none for it.
+	Authenticator(registry string) (authn.Authenticator, bool)
+}
+
+// GitHubRegistry is the GitHub Container Registry.
+const GitHubRegistry = "ghcr.io"
+
+// NewGitHubAmbientProvider returns the provider of ghcr.io credentials from
+// the GITHUB_TOKEN, or GH_TOKEN, of GitHub Actions, looked up with getenv,
+// as GITHUB_ACTOR or x-access-token. It returns false when neither token is
+// set.
+func NewGitHubAmbientProvider(getenv func(string) string) (AmbientProvider, bool) {
+	for _, env := range []string{"GITHUB_TOKEN", "GH_TOKEN"} {
+		token := getenv(env)
+		if token == "" {
+			continue
+		}
+		user := getenv("GITHUB_ACTOR")
+		if user == "" {
+			user = "x-access-token"
+		}
+		return &githubAmbientProvider{env: env, user: user, token: token}, true
+	}
+	return nil, false
+}
+
+type githubAmbientProvider struct {
+	env   string
+	user  string
+	token string
+}
+
+func (p *githubAmbientProvider) Name() string {
+	return p.env + " for " + GitHubRegistry
+}
+
+func (p *githubAmbientProvider) Authenticator(registry string) (authn.Authenticator, bool) {
+	if registry != GitHubRegistry {
+		return nil, false
+	}
+	return &authn.Basic{Username: p.user, Password: p.token}, true
+}
+
+// NewAmbientKeychain returns kc falling back to the first of providers with
+// credentials for a registry kc has none for.
+func NewAmbientKeychain(kc authn.Keychain, providers ...AmbientProvider) authn.Keychain {
+	return &ambientKeychain{keychain: kc, providers: providers, logged: map[string]bool{}}
+}
+
+type ambientKeychain struct {
+	keychain  authn.Keychain
+	providers []AmbientProvider
+
+	mu     sync.Mutex
+	logged map[string]bool
+}
+
+func (k *ambientKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return k.ResolveContext(context.Background(), target)
+}
+
+func (k *ambientKeychain) ResolveContext(
+	ctx context.Context,
+	target authn.Resource,
+) (authn.Authenticator, error) {
+	auth, err := authn.Resolve(ctx, k.keychain, target)
+	if err != nil || auth != authn.Anonymous {
+		return auth, err
+	}
+	registry := target.RegistryStr()
+	for _, p := range k.providers {
+		if ambient, ok := p.Authenticator(registry); ok {
+			k.logOnce(ctx, p, registry)
+			return ambient, nil
+		}
+	}
+	return auth, nil
+}
+
+// logOnce logs the first use of ambient credentials for registry, since
+// every registry request resolves the keychain again.
+func (k *ambientKeychain) logOnce(ctx context.Context, p AmbientProvider, registry string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.logged[registry] {
+		return
+	}
+	k.logged[registry] = true
+	slog.InfoContext(
+		ctx,
+		"using ambient registry credentials",
+		"registry", registry,
+		"provider", p.Name(),
+	)
+}
@@ -0,0 +1,176 @@
+package nixcontainers
+
+import (
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// fakeCredentialProgram answers a credential helper get with output.
+type fakeCredentialProgram struct {
+	output string
+	err    error
+}
+
+func (p *fakeCredentialProgram) Output() ([]byte, error) { return []byte(p.output), p.err }
+
+func (p *fakeCredentialProgram) Input(io.Reader) {}
+
+func resolveUsername(t *testing.T, kc authn.Keychain, registry string) string {
+	t.Helper()
+
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		t.Fatalf("parse registry failed: %v", err)
+	}
+	auth, err := kc.Resolve(reg)
+	if err != nil {
+		t.Fatalf("resolve %s failed: %v", registry, err)
+	}
+	if auth == authn.Anonymous {
+		return ""
+	}
+	cfg, err := auth.Authorization()
+	if err != nil {
+		t.Fatalf("authorization failed: %v", err)
+	}
+	return cfg.Username
+}
+
+func TestDockerConfigKeychain(t *testing.T) {
+	dir := t.TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte("ci:secret"))
+	config := `{"auths":{"registry.example":{"auth":"` + auth + `"}}}`
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600); err != nil {
+		t.Fatalf("write config failed: %v", err)
+	}
+	kc := NewDockerConfigKeychain(dir)
+
+	if got := resolveUsername(t, kc, "registry.example"); got != "ci" {
+		t.Fatalf("expected username ci, got %q", got)
+	}
+	if got := resolveUsername(t, kc, "other.example"); got != "" {
+		t.Fatalf("expected anonymous access to other.example, got %q", got)
+	}
+}
+
+func TestCredentialHelperKeychain(t *testing.T) {
+	tests := []struct {
+		name string
+		prog *fakeCredentialProgram
+		want string
+	}{
+		{
+			name: "credentials",
+			prog: &fakeCredentialProgram{output: `{"Username":"ci","Secret":"secret"}`},
+			want: "ci",
+		},
+		{
+			name: "not found",
+			prog: &fakeCredentialProgram{
+				output: "credentials not found in native keychain",
+				err:    io.EOF,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kc := authn.NewKeychainFromHelper(credentialHelper{
+				name:    "docker-credential-test",
+				program: func(...string) client.Program { return tt.prog },
+			})
+			if got := resolveUsername(t, kc, "registry.example"); got != tt.want {
+				t.Fatalf("expected username %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRegistryKeychain(t *testing.T) {
+	helper := authn.NewKeychainFromHelper(credentialHelper{
+		name: "docker-credential-test",
+		program: func(...string) client.Program {
+			return &fakeCredentialProgram{output: `{"Username":"helper","Secret":"secret"}`}
+		},
+	})
+	kc := NewRegistryKeychain(
+		[]string{"registry.example"},
+		helper,
+		NewDockerConfigKeychain(t.TempDir()),
+	)
+
+	if got := resolveUsername(t, kc, "registry.example"); got != "helper" {
+		t.Fatalf("expected the helper credentials, got %q", got)
+	}
+	if got := resolveUsername(t, kc, "other.example"); got != "" {
+		t.Fatalf("expected the fallback keychain for other.example, got %q", got)
+	}
+}
+
+func TestAmbientKeychain(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		registry string
+		config   bool
+		want     string
+	}{
+		{
+			name:     "github token",
+			env:      map[string]string{"GITHUB_TOKEN": "token", "GITHUB_ACTOR": "octocat"},
+			registry: GitHubRegistry,
+			want:     "octocat",
+		},
+		{
+			name:     "gh token without actor",
+			env:      map[string]string{"GH_TOKEN": "token"},
+			registry: GitHubRegistry,
+			want:     "x-access-token",
+		},
+		{
+			name:     "configured credentials first",
+			env:      map[string]string{"GITHUB_TOKEN": "token"},
+			registry: GitHubRegistry,
+			config:   true,
+			want:     "ci",
+		},
+		{
+			name:     "other registry",
+			env:      map[string]string{"GITHUB_TOKEN": "token"},
+			registry: "registry.example",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.config {
+				auth := base64.StdEncoding.EncodeToString([]byte("ci:secret"))
+				config := `{"auths":{"` + tt.registry + `":{"auth":"` + auth + `"}}}`
+				err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600)
+				if err != nil {
+					t.Fatalf("write config failed: %v", err)
+				}
+			}
+			p, ok := NewGitHubAmbientProvider(func(key string) string { return tt.env[key] })
+			if !ok {
+				t.Fatal("expected a github provider")
+			}
+			kc := NewAmbientKeychain(NewDockerConfigKeychain(dir), p)
+			if got := resolveUsername(t, kc, tt.registry); got != tt.want {
+				t.Fatalf("expected username %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	if _, ok := NewGitHubAmbientProvider(func(string) string { return "" }); ok {
+		t.Fatal("expected no github provider without a token")
+	}
+}
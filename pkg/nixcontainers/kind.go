@@ -0,0 +1,59 @@
+package nixcontainers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// kindCommandContext runs kind, replaced in tests.
+var kindCommandContext = exec.CommandContext
+
+// LoadKindImage loads the image built at path for p, tagged as ref, into
+// every node of the kind cluster, for clusters that pull from no registry.
+// The image is written as an archive handed to kind load image-archive, which
+// imports it into the containerd of each node.
+func (c *ContainerClient) LoadKindImage(
+	ctx context.Context,
+	cluster string,
+	ref name.Reference,
+	p *v1.Platform,
+	path string,
+) error {
+	img, err := c.platformImage(ctx, ref, p, path)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "nix-containers-kind-*")
+	if err != nil {
+		return fmt.Errorf("failed to create kind archive directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	archive := filepath.Join(dir, "image.tar")
+	if err := tarball.WriteToFile(archive, ref, img); err != nil {
+		return fmt.Errorf("failed to write kind image archive: %w", err)
+	}
+
+	args := []string{"load", "image-archive", archive, "--name", cluster}
+	cmd := interruptOnCancel(kindCommandContext(ctx, "kind", args...), c.killGracePeriod)
+	slog.InfoContext(ctx, "load image into kind cluster", "ref", ref.Name(), "cluster", cluster)
+	slog.DebugContext(ctx, "kind load argv", "argv", append([]string{"kind"}, args...))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return outputCommandError("kind load", output, fmt.Errorf(
+			"failed to load %s into kind cluster %s: %w",
+			ref.Name(),
+			cluster,
+			err,
+		))
+	}
+	slog.InfoContext(ctx, "loaded image into kind cluster", "ref", ref.Name(), "cluster", cluster)
+	return nil
+}
@@ -0,0 +1,85 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func setupKindCommandTest(t *testing.T, stderr string, exitCode int) string {
+	t.Helper()
+
+	commandStubMu.Lock()
+	original := kindCommandContext
+	t.Cleanup(func() {
+		kindCommandContext = original
+		commandStubMu.Unlock()
+	})
+	argsFile := filepath.Join(t.TempDir(), "args.json")
+	kindCommandContext = stubCommand(t, "", stderr, exitCode, argsFile)
+	return argsFile
+}
+
+func TestContainerClientLoadKindImage(t *testing.T) {
+	argsFile := setupKindCommandTest(t, "", 0)
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(newLoadingDockerClient(t)),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	if err := containerClient.LoadKindImage(
+		context.Background(),
+		"dev",
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+		writeTestImageArchive(t),
+	); err != nil {
+		t.Fatalf("load kind image failed: %v", err)
+	}
+	args := readCapturedCommandArgs(t, argsFile)
+	if len(args) != 6 ||
+		!slices.Equal(args[:3], []string{"kind", "load", "image-archive"}) ||
+		!slices.Equal(args[4:], []string{"--name", "dev"}) {
+		t.Fatalf("expected kind load image-archive into dev, got %q", args)
+	}
+	if !strings.HasSuffix(args[3], ".tar") {
+		t.Fatalf("expected an image archive, got %q", args[3])
+	}
+}
+
+func TestContainerClientLoadKindImageReportsOutput(t *testing.T) {
+	setupKindCommandTest(t, "ERROR: no nodes found for cluster \"dev\"\n", 1)
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(newLoadingDockerClient(t)),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+
+	err = containerClient.LoadKindImage(
+		context.Background(),
+		"dev",
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+		writeTestImageArchive(t),
+	)
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a command error, got %v", err)
+	}
+	if want := []string{`ERROR: no nodes found for cluster "dev"`}; !slices.Equal(cmdErr.Stderr, want) {
+		t.Fatalf("expected kind output %q, got %q", want, cmdErr.Stderr)
+	}
+	if !strings.Contains(err.Error(), "into kind cluster dev") {
+		t.Fatalf("expected the cluster named in the error, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package nixcontainers
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// LevelTrace is below debug and enables the raw docker load progress lines.
+const LevelTrace = slog.LevelDebug - 4
+
+// loadProgressInterval is how often the aggregated load progress is logged.
+const loadProgressInterval = 5 * time.Second
+
+// loadProgress aggregates docker load progress events into the number of
+// distinct layers seen, out of total when the image manifest is known.
+type loadProgress struct {
+	total  int
+	layers map[string]struct{}
+}
+
+func newLoadProgress(total int) *loadProgress {
+	return &loadProgress{total: total, layers: map[string]struct{}{}}
+}
+
+// observe records a progress event and reports whether it was a layer event.
+func (p *loadProgress) observe(e imageLoadProgress) bool {
+	if e.Status != "Loading layer" {
+		return false
+	}
+	if e.ID != "" {
+		p.layers[e.ID] = struct{}{}
+	}
+	return true
+}
+
+func (p *loadProgress) loaded() int {
+	return len(p.layers)
+}
+
+func (p *loadProgress) String() string {
+	if p.total <= 0 {
+		return fmt.Sprintf("%d layers loaded", p.loaded())
+	}
+	loaded := min(p.loaded(), p.total)
+	return fmt.Sprintf("%d/%d layers (%d%%)", loaded, p.total, loaded*100/p.total)
+}
+
+// countArchiveLayers returns the number of layers listed in the manifest of a
+// docker archive, or 0 when it cannot be read.
+func countArchiveLayers(path string) int {
+	manifest, err := tarball.LoadManifest(gzipPathOpener(path))
+	if err != nil || len(manifest) == 0 {
+		return 0
+	}
+	return len(manifest[0].Layers)
+}
@@ -0,0 +1,90 @@
+package nixcontainers
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestLoadProgressCountsDistinctLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		total  int
+		events []imageLoadProgress
+		want   string
+	}{
+		{
+			name:  "known total",
+			total: 4,
+			events: []imageLoadProgress{
+				{Status: "Loading layer", ID: "a", Progress: "[=>  ]"},
+				{Status: "Loading layer", ID: "a", Progress: "[===>]"},
+				{Status: "Loading layer", ID: "b", Progress: "[=>  ]"},
+				{Status: "Loaded image", ID: "c"},
+			},
+			want: "2/4 layers (50%)",
+		},
+		{
+			name:  "unknown total",
+			total: 0,
+			events: []imageLoadProgress{
+				{Status: "Loading layer", ID: "a"},
+				{Status: "Loading layer", ID: "b"},
+				{Status: "Loading layer", ID: "c"},
+			},
+			want: "3 layers loaded",
+		},
+		{
+			name:  "more layers than manifest",
+			total: 1,
+			events: []imageLoadProgress{
+				{Status: "Loading layer", ID: "a"},
+				{Status: "Loading layer", ID: "b"},
+			},
+			want: "1/1 layers (100%)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newLoadProgress(tt.total)
+			for _, e := range tt.events {
+				p.observe(e)
+			}
+			if got := p.String(); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadProgressObserveReportsLayerEvents(t *testing.T) {
+	p := newLoadProgress(0)
+	if !p.observe(imageLoadProgress{Status: "Loading layer", ID: "a"}) {
+		t.Fatalf("expected layer event")
+	}
+	if p.observe(imageLoadProgress{Status: ""}) {
+		t.Fatalf("expected non-layer event")
+	}
+}
+
+func TestCountArchiveLayers(t *testing.T) {
+	img, err := random.Image(64, 3)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	if err := tarball.WriteToFile(path, ref, img); err != nil {
+		t.Fatalf("write tarball failed: %v", err)
+	}
+
+	if got := countArchiveLayers(path); got != 3 {
+		t.Fatalf("expected 3 layers, got %d", got)
+	}
+	if got := countArchiveLayers(filepath.Join(t.TempDir(), "missing.tar")); got != 0 {
+		t.Fatalf("expected 0 layers for missing archive, got %d", got)
+	}
+}
@@ -0,0 +1,269 @@
+package nixcontainers
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// DefaultMinikubeProfile is the profile minikube creates without --profile.
+const DefaultMinikubeProfile = "minikube"
+
+// minikubeCommandContext runs minikube, replaced in tests.
+var minikubeCommandContext = exec.CommandContext
+
+// Minikube reaches the container runtime of a minikube profile through the
+// minikube command.
+type Minikube struct {
+	profile         string
+	killGracePeriod time.Duration
+}
+
+// MinikubeDockerEnv is the Docker daemon of a minikube profile, as printed
+// by minikube docker-env.
+type MinikubeDockerEnv struct {
+	Host string
+	// CertPath is the directory of the TLS client certificates of the
+	// daemon, empty when it does not use TLS.
+	CertPath string
+}
+
+// minikubeProfileList is the subset of minikube profile list --output json
+// naming the container runtime of each profile.
+type minikubeProfileList struct {
+	Valid []struct {
+		Name   string `json:"Name"`
+		Config struct {
+			KubernetesConfig struct {
+				ContainerRuntime string `json:"ContainerRuntime"`
+			} `json:"KubernetesConfig"`
+		} `json:"Config"`
+	} `json:"valid"`
+}
+
+func NewMinikube(profile string, killGracePeriod time.Duration) *Minikube {
+	if profile == "" {
+		profile = DefaultMinikubeProfile
+	}
+	return &Minikube{profile: profile, killGracePeriod: killGracePeriod}
+}
+
+// Profile returns the minikube profile.
+func (m *Minikube) Profile() string {
+	return m.profile
+}
+
+// ContainerRuntime returns the container runtime of the profile, such as
+// docker, containerd or crio.
+func (m *Minikube) ContainerRuntime(ctx context.Context) (string, error) {
+	out, err := m.output(ctx, "profile", "list", "--output", "json")
+	if err != nil {
+		return "", fmt.Errorf("failed to list minikube profiles: %w", err)
+	}
+	var list minikubeProfileList
+	if err := json.Unmarshal(out, &list); err != nil {
+		return "", fmt.Errorf("failed to parse minikube profiles: %w", err)
+	}
+	for _, p := range list.Valid {
+		if p.Name != m.profile {
+			continue
+		}
+		// Profiles created before the runtime was recorded use docker.
+		runtime := strings.ToLower(p.Config.KubernetesConfig.ContainerRuntime)
+		if runtime == "" {
+			runtime = ContainerRuntimeDocker
+		}
+		return runtime, nil
+	}
+	return "", fmt.Errorf("minikube profile %s does not exist or is not valid", m.profile)
+}
+
+// DockerEnv returns the Docker daemon of the profile, for profiles using the
+// docker runtime.
+func (m *Minikube) DockerEnv(ctx context.Context) (MinikubeDockerEnv, error) {
+	out, err := m.output(ctx, "docker-env", "--shell", "none")
+	if err != nil {
+		return MinikubeDockerEnv{}, fmt.Errorf(
+			"failed to read the docker-env of minikube profile %s: %w",
+			m.profile,
+			err,
+		)
+	}
+	var env MinikubeDockerEnv
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		switch key {
+		case "DOCKER_HOST":
+			env.Host = value
+		case "DOCKER_CERT_PATH":
+			env.CertPath = value
+		}
+	}
+	if env.Host == "" {
+		return MinikubeDockerEnv{}, fmt.Errorf(
+			"minikube profile %s docker-env has no DOCKER_HOST",
+			m.profile,
+		)
+	}
+	return env, nil
+}
+
+// ImageRuntime loads, tags and removes images in the container runtime of
+// the profile with the minikube image commands, for profiles whose runtime
+// is not a Docker daemon.
+func (m *Minikube) ImageRuntime() ContainerRuntime {
+	return &minikubeRuntime{minikube: m}
+}
+
+func (m *Minikube) command(ctx context.Context, args ...string) *exec.Cmd {
+	args = append([]string{"--profile", m.profile}, args...)
+	return interruptOnCancel(minikubeCommandContext(ctx, "minikube", args...), m.killGracePeriod)
+}
+
+// output runs minikube with args and returns its stdout, with its stderr in
+// the error when it fails.
+func (m *Minikube) output(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := m.command(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, outputCommandError("minikube "+args[0], stderr.Bytes(), err)
+	}
+	return out, nil
+}
+
+// minikubeRuntime is the ContainerRuntime of a minikube profile.
+type minikubeRuntime struct {
+	minikube *Minikube
+}
+
+// Load loads the docker archive read from r with minikube image load, which
+// imports it on every node of the profile, and returns the image named by
+// the archive. The load progress is not reported.
+func (r *minikubeRuntime) Load(ctx context.Context, archive io.Reader, _ int) (LoadedImage, error) {
+	// The archive is read once, so its manifest is read as minikube reads it.
+	pr, pw := io.Pipe()
+	tags := make(chan []string, 1)
+	go func() {
+		repoTags, _ := archiveRepoTags(pr)
+		_, _ = io.Copy(io.Discard, pr)
+		tags <- repoTags
+	}()
+	cmd := r.minikube.command(ctx, "image", "load", "-")
+	cmd.Stdin = io.TeeReader(archive, pw)
+	out, err := cmd.CombinedOutput()
+	_ = pw.Close()
+	repoTags := <-tags
+	if err != nil {
+		return LoadedImage{}, outputCommandError("minikube image load", out, fmt.Errorf(
+			"minikube image load into profile %s failed: %w",
+			r.minikube.profile,
+			err,
+		))
+	}
+	if len(repoTags) == 0 {
+		return LoadedImage{}, errors.New("minikube image load failed: the image archive names no image")
+	}
+	ref, err := name.ParseReference(repoTags[0])
+	if err != nil {
+		return LoadedImage{}, fmt.Errorf("failed to parse loaded image name %q: %w", repoTags[0], err)
+	}
+	slog.InfoContext(ctx, "minikube image loaded", "image", ref.Name(), "profile", r.minikube.profile)
+	return LoadedImage{Ref: ref}, nil
+}
+
+// Tag names the image of src as dst and removes the src name like the Docker
+// runtime does.
+func (r *minikubeRuntime) Tag(ctx context.Context, src LoadedImage, dst name.Reference) error {
+	if src.Ref == nil {
+		return fmt.Errorf("tag image failed: minikube image %s has no name", src)
+	}
+	if src.Ref.Name() == dst.Name() {
+		return nil
+	}
+	if _, err := r.minikube.output(ctx, "image", "tag", src.Ref.Name(), dst.Name()); err != nil {
+		return fmt.Errorf("tag image failed: %w", err)
+	}
+	return r.Remove(ctx, src.Ref)
+}
+
+// Remove removes ref from every node of the profile.
+func (r *minikubeRuntime) Remove(ctx context.Context, ref name.Reference) error {
+	if _, err := r.minikube.output(ctx, "image", "rm", ref.Name()); err != nil {
+		return fmt.Errorf("remove image failed: %w", err)
+	}
+	return nil
+}
+
+// List returns the tagged images of the profile, one entry per tag. minikube
+// does not report when images were created.
+func (r *minikubeRuntime) List(ctx context.Context) ([]LocalImage, error) {
+	out, err := r.minikube.output(ctx, "image", "ls", "--format", "json")
+	if err != nil {
+		return nil, fmt.Errorf("list images failed: %w", err)
+	}
+	var images []struct {
+		ID       string   `json:"id"`
+		RepoTags []string `json:"repoTags"`
+	}
+	if err := json.Unmarshal(out, &images); err != nil {
+		return nil, fmt.Errorf("failed to parse minikube images: %w", err)
+	}
+	var list []LocalImage
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			ref, err := name.ParseReference(tag)
+			if err != nil {
+				continue
+			}
+			list = append(list, LocalImage{Ref: ref, ID: img.ID})
+		}
+	}
+	return list, nil
+}
+
+// Ping checks the profile is running.
+func (r *minikubeRuntime) Ping(ctx context.Context) error {
+	if _, err := r.minikube.output(ctx, "status"); err != nil {
+		return fmt.Errorf("minikube profile %s is not running: %w", r.minikube.profile, err)
+	}
+	return nil
+}
+
+// archiveRepoTags returns the tags of the first image of the docker archive
+// read from r.
+func archiveRepoTags(r io.Reader) ([]string, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+		var manifest []struct {
+			RepoTags []string `json:"RepoTags"`
+		}
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse image archive manifest: %w", err)
+		}
+		if len(manifest) == 0 {
+			return nil, nil
+		}
+		return manifest[0].RepoTags, nil
+	}
+}
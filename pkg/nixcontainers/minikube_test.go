@@ -0,0 +1,134 @@
+package nixcontainers
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMinikubeProfiles = `{"invalid":[],"valid":[` +
+	`{"Name":"minikube","Status":"OK","Config":{"KubernetesConfig":{"ContainerRuntime":"docker"}}},` +
+	`{"Name":"dev","Status":"OK","Config":{"KubernetesConfig":{"ContainerRuntime":"containerd"}}}]}`
+
+// setupMinikubeCommandTest stubs minikube with stdout, capturing the args of
+// its last call, and makes it read its stdin like minikube image load -.
+func setupMinikubeCommandTest(t *testing.T, stdout, stderr string, exitCode int) string {
+	t.Helper()
+
+	commandStubMu.Lock()
+	original := minikubeCommandContext
+	t.Cleanup(func() {
+		minikubeCommandContext = original
+		commandStubMu.Unlock()
+	})
+	argsFile := filepath.Join(t.TempDir(), "args.json")
+	stub := stubCommand(t, stdout, stderr, exitCode, argsFile)
+	minikubeCommandContext = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		cmd := stub(ctx, command, args...)
+		cmd.Env = append(cmd.Env, "FAKE_READ_STDIN=1")
+		return cmd
+	}
+	return argsFile
+}
+
+func TestMinikubeContainerRuntime(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    string
+		wantErr string
+	}{
+		{name: "default profile", want: ContainerRuntimeDocker},
+		{name: "containerd profile", profile: "dev", want: ContainerRuntimeContainerd},
+		{name: "missing profile", profile: "staging", wantErr: "minikube profile staging does not exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsFile := setupMinikubeCommandTest(t, testMinikubeProfiles, "", 0)
+
+			got, err := NewMinikube(tt.profile, 0).ContainerRuntime(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve minikube runtime failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected runtime %s, got %s", tt.want, got)
+			}
+			assertCapturedCommandArgs(
+				t,
+				argsFile,
+				"minikube",
+				"--profile",
+				NewMinikube(tt.profile, 0).Profile(),
+				"profile",
+				"list",
+				"--output",
+				"json",
+			)
+		})
+	}
+}
+
+func TestMinikubeDockerEnv(t *testing.T) {
+	setupMinikubeCommandTest(
+		t,
+		"DOCKER_TLS_VERIFY=1\nDOCKER_HOST=tcp://192.168.49.2:2376\n"+
+			"DOCKER_CERT_PATH=/home/you/.minikube/certs\nMINIKUBE_ACTIVE_DOCKERD=minikube\n",
+		"",
+		0,
+	)
+
+	env, err := NewMinikube("", 0).DockerEnv(context.Background())
+	if err != nil {
+		t.Fatalf("read minikube docker-env failed: %v", err)
+	}
+	want := MinikubeDockerEnv{
+		Host:     "tcp://192.168.49.2:2376",
+		CertPath: "/home/you/.minikube/certs",
+	}
+	if env != want {
+		t.Fatalf("expected docker env %+v, got %+v", want, env)
+	}
+}
+
+func TestMinikubeRuntimeLoad(t *testing.T) {
+	argsFile := setupMinikubeCommandTest(t, "", "", 0)
+	archive, err := os.Open(writeTestImageArchive(t))
+	if err != nil {
+		t.Fatalf("open image archive failed: %v", err)
+	}
+	defer func() { _ = archive.Close() }()
+
+	loaded, err := NewMinikube("dev", 0).ImageRuntime().Load(context.Background(), archive, 0)
+	if err != nil {
+		t.Fatalf("minikube image load failed: %v", err)
+	}
+	if loaded.Ref == nil || loaded.Ref.Name() != mustParseReference(t, "app:latest").Name() {
+		t.Fatalf("expected the image named by the archive, got %s", loaded)
+	}
+	assertCapturedCommandArgs(t, argsFile, "minikube", "--profile", "dev", "image", "load", "-")
+}
+
+func TestMinikubeRuntimeLoadReportsOutput(t *testing.T) {
+	setupMinikubeCommandTest(t, "", "X Exiting due to GUEST_IMAGE_LOAD: no space left\n", 80)
+	archive, err := os.Open(writeTestImageArchive(t))
+	if err != nil {
+		t.Fatalf("open image archive failed: %v", err)
+	}
+	defer func() { _ = archive.Close() }()
+
+	_, err = NewMinikube("dev", 0).ImageRuntime().Load(context.Background(), archive, 0)
+	if err == nil ||
+		!strings.Contains(err.Error(), "into profile dev failed") ||
+		!strings.Contains(err.Error(), "    X Exiting due to GUEST_IMAGE_LOAD: no space left") {
+		t.Fatalf("expected the minikube output in the error, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// WithContainerMirrors also pushes every image or index pushed to its
+// destination to each of refs. The pushed object is reused, so nothing is
+// rebuilt and every destination gets the same digest. Platform images are
+// mirrored as part of their index rather than under their platform tags.
+func WithContainerMirrors(refs ...name.Reference) ContainerOption {
+	return func(o *containerOptions) {
+		o.mirrors = append(o.mirrors, refs...)
+	}
+}
+
+// WithContainerMirrorBestEffort reports failed mirror pushes without failing
+// the push to the destination.
+func WithContainerMirrorBestEffort(bestEffort bool) ContainerOption {
+	return func(o *containerOptions) {
+		o.mirrorBestEffort = bestEffort
+	}
+}
+
+// WithContainerLatestTag also tags every image or index pushed to its
+// destination as tag in the same repository, such as latest. Only the
+// manifest is written, since the registry already has all its blobs.
+func WithContainerLatestTag(tag string) ContainerOption {
+	return func(o *containerOptions) {
+		o.latestTag = tag
+	}
+}
+
+// checkMirrorPushPermission checks every mirror can be pushed to, only
+// warning about the ones that cannot in best-effort mode.
+func (c *ContainerClient) checkMirrorPushPermission(ctx context.Context) error {
+	for _, mirror := range c.mirrors {
+		err := remote.CheckPushPermission(mirror, c.keychain, c.contextTransport(ctx))
+		if retry, cerr := c.createMissingRepository(ctx, mirror.Context(), err); retry {
+			err = remote.CheckPushPermission(mirror, c.keychain, c.contextTransport(ctx))
+		} else {
+			err = cerr
+		}
+		if err == nil {
+			continue
+		}
+		if !c.mirrorBestEffort {
+			return fmt.Errorf("check push permission of mirror %s failed: %w", mirror, err)
+		}
+		slog.WarnContext(
+			ctx,
+			"no push permission for mirror, its push will likely fail",
+			"ref",
+			mirror,
+			"err",
+			err,
+		)
+	}
+	return nil
+}
+
+// mirror writes t, pushed to ref with the digest digest, under the latest tag
+// and to every mirror, and logs the digest with the destinations that
+// received it. Every mirror is
+// attempted before the failures are returned together.
+func (c *ContainerClient) mirror(
+	ctx context.Context,
+	ref name.Reference,
+	digest v1.Hash,
+	t remote.Taggable,
+) error {
+	pushed := []string{c.pushedReference(ref, digest).Name()}
+	if c.latestTag != "" {
+		latest := ref.Context().Tag(c.latestTag)
+		opts := append(c.remoteOptions(ctx), remote.Reuse(c.pusher))
+		if err := remote.Tag(latest, t, opts...); err != nil {
+			return fmt.Errorf("tag %s as %s failed: %w", ref.Name(), latest.Name(), err)
+		}
+		pushed = append(pushed, latest.Name())
+	}
+	var errs []error
+	for _, mirror := range c.mirrors {
+		if err := c.push(ctx, mirror, t, nil, c.mirrorMountFrom(ref, mirror)); err != nil {
+			slog.ErrorContext(
+				ctx,
+				"mirror push failed",
+				"ref",
+				mirror.Name(),
+				"digest",
+				digest,
+				"err",
+				err,
+			)
+			errs = append(errs, fmt.Errorf("mirror push to %s failed: %w", mirror.Name(), err))
+			continue
+		}
+		pushed = append(pushed, c.pushedReference(mirror, digest).Name())
+	}
+	slog.InfoContext(ctx, "image pushed", "refs", pushed, "digest", digest)
+	if len(errs) == 0 {
+		return nil
+	}
+	if c.mirrorBestEffort {
+		slog.WarnContext(
+			ctx,
+			"mirror pushes failed, ignored in best-effort mode",
+			"failed",
+			len(errs),
+			"err",
+			errors.Join(errs...),
+		)
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// mirrorMountFrom returns the repository to mount the layers of a mirror
+// push from: the destination, which just received them, when the mirror is
+// in its registry, or else the --mount-from repository.
+func (c *ContainerClient) mirrorMountFrom(ref, mirror name.Reference) *name.Repository {
+	repo := ref.Context()
+	if canMount(&repo, mirror.Context()) {
+		return &repo
+	}
+	return c.mountFrom
+}
@@ -0,0 +1,207 @@
+package nixcontainers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func newTestRegistryRef(t *testing.T, handler http.Handler, repo string) name.Reference {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return mustParseReference(t, strings.TrimPrefix(srv.URL, "http://")+"/"+repo)
+}
+
+// newReadOnlyRegistryRef rejects every upload, like a registry the keychain has
+// no push credentials for.
+func newReadOnlyRegistryRef(t *testing.T, repo string) name.Reference {
+	t.Helper()
+
+	handler := registry.New()
+	return newTestRegistryRef(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, `{"errors":[{"code":"DENIED","message":"read only"}]}`, http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), repo)
+}
+
+func writeTestImageArchive(t *testing.T) string {
+	t.Helper()
+
+	img, err := random.Image(64, 2)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := tarball.WriteToFile(path, mustParseReference(t, "app:latest"), img); err != nil {
+		t.Fatalf("write image archive failed: %v", err)
+	}
+	return path
+}
+
+func assertSameDigest(t *testing.T, refs ...name.Reference) {
+	t.Helper()
+
+	var want v1.Hash
+	for i, ref := range refs {
+		desc, err := remote.Head(ref)
+		if err != nil {
+			t.Fatalf("head %s failed: %v", ref, err)
+		}
+		if i == 0 {
+			want = desc.Digest
+		} else if desc.Digest != want {
+			t.Fatalf("expected %s to have digest %s, got %s", ref, want, desc.Digest)
+		}
+	}
+}
+
+func TestContainerClientPushImageMirrors(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	mirror := newTestRegistryRef(t, registry.New(), "mirror/app:1.0")
+	readOnly := newReadOnlyRegistryRef(t, "mirror/app:1.0")
+	path := writeTestImageArchive(t)
+
+	for _, bestEffort := range []bool{false, true} {
+		containerClient, err := NewContainerClient(
+			context.Background(),
+			WithContainerDockerClient(&client.Client{}),
+			WithContainerKeychain(fakeKeychain{}),
+			WithContainerMirrors(mirror, readOnly),
+			WithContainerMirrorBestEffort(bestEffort),
+		)
+		if err != nil {
+			t.Fatalf("create container client failed: %v", err)
+		}
+
+		_, err = containerClient.PushImage(context.Background(), ref, HostPlatform(), path, nil)
+		if bestEffort {
+			if err != nil {
+				t.Fatalf("expected best-effort mirror failure to be ignored, got %v", err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "mirror push to "+readOnly.Name()) {
+			t.Fatalf("expected mirror failure for %s, got %v", readOnly, err)
+		}
+		assertSameDigest(t, ref, mirror)
+	}
+}
+
+func TestContainerClientPushManifestMirrorsAcceptedIndex(t *testing.T) {
+	srv := newIndexRejectingRegistry(t)
+	ref := mustParseReference(t, strings.TrimPrefix(srv.URL, "http://")+"/example/app:latest")
+	mirror := newTestRegistryRef(t, registry.New(), "mirror/app:latest")
+	adds := makeRandomIndexAddenda(
+		t,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+		&v1.Platform{OS: "linux", Architecture: "arm64"},
+	)
+
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerIndexMediaType(IndexMediaTypeAuto),
+		WithContainerMirrors(mirror),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	if _, _, err := containerClient.PushManifest(context.Background(), ref, adds); err != nil {
+		t.Fatalf("push manifest failed: %v", err)
+	}
+	assertSameDigest(t, ref, mirror)
+
+	idx, err := remote.Index(mirror)
+	if err != nil {
+		t.Fatalf("read mirrored index failed: %v", err)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatalf("read mirrored index manifest failed: %v", err)
+	}
+	for _, desc := range manifest.Manifests {
+		if _, err := remote.Image(mirror.Context().Digest(desc.Digest.String())); err != nil {
+			t.Fatalf("expected platform image %s in the mirror: %v", desc.Digest, err)
+		}
+	}
+}
+
+func TestContainerClientCheckPushPermissionChecksMirrors(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	readOnly := newReadOnlyRegistryRef(t, "mirror/app:1.0")
+
+	for _, bestEffort := range []bool{false, true} {
+		containerClient, err := NewContainerClient(
+			context.Background(),
+			WithContainerDockerClient(&client.Client{}),
+			WithContainerKeychain(fakeKeychain{}),
+			WithContainerMirrors(readOnly),
+			WithContainerMirrorBestEffort(bestEffort),
+		)
+		if err != nil {
+			t.Fatalf("create container client failed: %v", err)
+		}
+		err = containerClient.CheckPushPermission(context.Background(), ref)
+		if bestEffort && err != nil {
+			t.Fatalf("expected best-effort mirror permission to only warn, got %v", err)
+		}
+		if !bestEffort && (err == nil || !strings.Contains(err.Error(), "mirror")) {
+			t.Fatalf("expected mirror permission error, got %v", err)
+		}
+	}
+}
+
+func TestContainerClientPushLatestTag(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:1.0")
+	path := writeTestImageArchive(t)
+
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerIndexMediaType(IndexMediaTypeOCI),
+		WithContainerLatestTag("latest"),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	_, err = containerClient.PushImage(context.Background(), ref, HostPlatform(), path, nil)
+	if err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	assertSameDigest(t, ref, ref.Context().Tag("latest"))
+
+	indexRef := ref.Context().Tag("2.0")
+	adds := makeRandomIndexAddenda(
+		t,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+		&v1.Platform{OS: "linux", Architecture: "arm64"},
+	)
+	if _, _, err := containerClient.PushManifest(context.Background(), indexRef, adds); err != nil {
+		t.Fatalf("push manifest failed: %v", err)
+	}
+	latest := ref.Context().Tag("latest")
+	assertSameDigest(t, indexRef, latest)
+	desc, err := remote.Head(latest)
+	if err != nil {
+		t.Fatalf("head %s failed: %v", latest, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		t.Fatalf("expected latest to be retagged as the index, got %s", desc.MediaType)
+	}
+}
@@ -0,0 +1,98 @@
+package nixcontainers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// WithContainerMountFrom makes pushes to the registry of repo ask it to mount
+// every layer from repo before uploading it, so layers shared with images
+// already pushed there are not uploaded again.
+func WithContainerMountFrom(repo name.Repository) ContainerOption {
+	return func(o *containerOptions) {
+		o.mountFrom = &repo
+	}
+}
+
+// mountLayers returns a wrapper offering the registry to mount layers from
+// repo. Registries without the layer, or without cross-repository mounts,
+// fall back to a regular upload.
+func mountLayers(repo name.Repository) layerWrapper {
+	return func(l v1.Layer) v1.Layer {
+		digest, err := l.Digest()
+		if err != nil {
+			return l
+		}
+		return &remote.MountableLayer{Layer: l, Reference: repo.Digest(digest.String())}
+	}
+}
+
+// canMount reports whether the blobs of from can be mounted into to, which
+// requires another repository of the same registry.
+func canMount(from *name.Repository, to name.Repository) bool {
+	return from != nil && *from != to && from.RegistryStr() == to.RegistryStr()
+}
+
+// blobStats counts how the registry got the blobs of the pushes.
+type blobStats struct {
+	uploaded atomic.Int64
+	mounted  atomic.Int64
+	existing atomic.Int64
+}
+
+// transport returns base counting the blob requests it completes.
+func (s *blobStats) transport(base http.RoundTripper) http.RoundTripper {
+	return &blobStatsTransport{base: base, stats: s}
+}
+
+type blobStatsTransport struct {
+	base  http.RoundTripper
+	stats *blobStats
+}
+
+func (t *blobStatsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !strings.Contains(req.URL.Path, "/blobs/") {
+		return resp, err
+	}
+	query := req.URL.Query()
+	switch {
+	case req.Method == http.MethodHead && resp.StatusCode == http.StatusOK:
+		t.stats.existing.Add(1)
+	case req.Method == http.MethodPost && query.Has("mount") &&
+		resp.StatusCode == http.StatusCreated:
+		t.stats.mounted.Add(1)
+	case req.Method == http.MethodPut && query.Has("digest") &&
+		resp.StatusCode == http.StatusCreated:
+		t.stats.uploaded.Add(1)
+	}
+	return resp, nil
+}
+
+// LogPushSummary logs how many blobs the pushes uploaded, mounted from
+// another repository, or found already in the registry.
+func (c *ContainerClient) LogPushSummary(ctx context.Context) {
+	uploaded := c.blobs.uploaded.Load()
+	mounted := c.blobs.mounted.Load()
+	existing := c.blobs.existing.Load()
+	if uploaded+mounted+existing == 0 {
+		return
+	}
+	slog.InfoContext(
+		ctx,
+		"push summary",
+		"blobs_uploaded",
+		uploaded,
+		"blobs_mounted",
+		mounted,
+		"blobs_existing",
+		existing,
+	)
+}
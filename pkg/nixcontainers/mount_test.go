@@ -0,0 +1,162 @@
+package nixcontainers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// newMountingRegistryRef serves a registry whose blobs belong to the
+// repositories they were pushed or mounted to, and which mounts blobs across
+// repositories, unlike registry.New that shares every blob.
+func newMountingRegistryRef(t *testing.T, repo string) name.Reference {
+	t.Helper()
+
+	handler := registry.New()
+	var mu sync.Mutex
+	blobs := make(map[string]bool)
+	has := func(repo, digest string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return blobs[repo+"@"+digest]
+	}
+	add := func(repo, digest string) {
+		mu.Lock()
+		defer mu.Unlock()
+		blobs[repo+"@"+digest] = true
+	}
+	return newTestRegistryRef(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, blob, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/")
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead && !has(repo, blob):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost && has(query.Get("from"), query.Get("mount")):
+			add(repo, query.Get("mount"))
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/"+query.Get("mount"))
+			w.Header().Set("Docker-Content-Digest", query.Get("mount"))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			handler.ServeHTTP(rec, r)
+			if r.Method == http.MethodPut && rec.status == http.StatusCreated {
+				add(repo, query.Get("digest"))
+			}
+		}
+	}), repo)
+}
+
+func TestContainerClientPushImageMountsFrom(t *testing.T) {
+	base := newMountingRegistryRef(t, "example/base:latest")
+	ref := base.Context().Registry.Repo("example", "app").Tag("latest")
+	path := writeTestImageArchive(t)
+
+	baseClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	_, err = baseClient.PushImage(context.Background(), base, HostPlatform(), path, nil)
+	if err != nil {
+		t.Fatalf("push base image failed: %v", err)
+	}
+
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerMountFrom(base.Context()),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	_, err = containerClient.PushImage(context.Background(), ref, HostPlatform(), path, nil)
+	if err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	assertSameDigest(t, base, ref)
+	// The two layers are mounted, while the config blob is still uploaded.
+	if got := containerClient.blobs.mounted.Load(); got != 2 {
+		t.Fatalf("expected 2 mounted blobs, got %d", got)
+	}
+	if got := containerClient.blobs.uploaded.Load(); got != 1 {
+		t.Fatalf("expected 1 uploaded blob, got %d", got)
+	}
+	if got := baseClient.UploadedBytes(base); got == 0 {
+		t.Fatal("expected the base image layers to be uploaded")
+	}
+	if got := containerClient.UploadedBytes(ref); got != 0 {
+		t.Fatalf("expected no uploaded layer bytes, got %d", got)
+	}
+}
+
+func TestContainerClientMirrorMountsFromDestination(t *testing.T) {
+	ref := newMountingRegistryRef(t, "example/app:latest")
+	mirror := ref.Context().Registry.Repo("mirror", "app").Tag("1.0")
+	path := writeTestImageArchive(t)
+
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+		WithContainerMirrors(mirror),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	_, err = containerClient.PushImage(context.Background(), ref, HostPlatform(), path, nil)
+	if err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	assertSameDigest(t, ref, mirror)
+	if got := containerClient.blobs.mounted.Load(); got != 2 {
+		t.Fatalf("expected the mirror layers to be mounted, got %d mounted blobs", got)
+	}
+}
+
+func TestCanMount(t *testing.T) {
+	app := mustParseReference(t, "ghcr.io/example/app:latest").Context()
+	base := mustParseReference(t, "ghcr.io/example/base:latest").Context()
+	other := mustParseReference(t, "quay.io/example/base:latest").Context()
+
+	tests := []struct {
+		name string
+		from *name.Repository
+		want bool
+	}{
+		{name: "unset", from: nil, want: false},
+		{name: "same registry", from: &base, want: true},
+		{name: "same repository", from: &app, want: false},
+		{name: "other registry", from: &other, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canMount(tt.from, app); got != tt.want {
+				t.Fatalf("canMount = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
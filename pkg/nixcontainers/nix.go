@@ -0,0 +1,1035 @@
+package nixcontainers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+var nixCommandContext = exec.CommandContext
+
+// NixStderrLevel is the level the stderr lines of nix and image stream
+// scripts are relayed at.
+var NixStderrLevel = slog.LevelDebug
+
+// BuilderType indicates the type of a Nix flake package, as detected from
+// its output.
+type BuilderType int
+
+const (
+	// UnknownBuilderType indicates the package type is unknown.
+	UnknownBuilderType BuilderType = iota
+	// StreamBuilderType indicates a streamable image package.
+	StreamBuilderType
+	// TarGzBuilderType indicates an image archive package, plain or gzip
+	// compressed.
+	TarGzBuilderType
+	// OCILayoutBuilderType indicates an OCI image layout directory package.
+	OCILayoutBuilderType
+)
+
+type ImageOption func(*imageOptions)
+
+type imageOptions struct {
+	acceptFlakeConfig bool
+	noPureEval        bool
+	impure            bool
+	refresh           bool
+	maxJobs           string
+	cores             string
+	builders          string
+	store             string
+	evalStore         string
+	outLink           string
+	packageName       string
+	overrideInputs    []FlakeInputOverride
+	nixArgs           []NixArg
+	output            NixOutput
+	printBuildLogs    bool
+	extraArgs         []string
+}
+
+// FlakeInputOverride replaces a flake input with another flake reference.
+type FlakeInputOverride struct {
+	Name string
+	Ref  string
+}
+
+func (o FlakeInputOverride) String() string {
+	return o.Name + "=" + o.Ref
+}
+
+// NixArg is a value nix passes to the functions it auto-calls, such as a
+// flake output taking parameters.
+type NixArg struct {
+	Name  string
+	Value string
+	// Expr passes Value as a nix expression, with --arg, rather than as a
+	// string with --argstr.
+	Expr bool
+}
+
+// args returns the nix flags passing the argument.
+func (a NixArg) args() []string {
+	if a.Expr {
+		return []string{"--arg", a.Name, a.Value}
+	}
+	return []string{"--argstr", a.Name, a.Value}
+}
+
+// DefaultNixOutput is the derivation output images are read from unless
+// another is selected.
+const DefaultNixOutput = "out"
+
+// NixOutput selects the output of the nix build result an image is read from.
+type NixOutput struct {
+	// Derivation is the path or name of the derivation holding the output,
+	// only needed when the build produced several.
+	Derivation string
+	// Name is the name of the output, DefaultNixOutput when empty.
+	Name string
+}
+
+// String formats the output as the [DRV:]NAME it was given as.
+func (o NixOutput) String() string {
+	if o.Derivation == "" {
+		return o.name()
+	}
+	return o.Derivation + ":" + o.name()
+}
+
+func (o NixOutput) name() string {
+	if o.Name == "" {
+		return DefaultNixOutput
+	}
+	return o.Name
+}
+
+type NixOption func(*nixOptions)
+
+type nixOptions struct {
+	binary            string
+	buildTimeout      time.Duration
+	killGracePeriod   time.Duration
+	heartbeatInterval time.Duration
+	autoFeatures      bool
+}
+
+type NixClient struct {
+	binary            string
+	buildTimeout      time.Duration
+	killGracePeriod   time.Duration
+	heartbeatInterval time.Duration
+	autoFeatures      bool
+
+	featuresOnce  sync.Once
+	extraFeatures []string
+}
+
+// RequiredExperimentalFeatures are the nix experimental features flake
+// builds use.
+var RequiredExperimentalFeatures = []string{"nix-command", "flakes"}
+
+type buildImageBuildResult struct {
+	DrvPath   string            `json:"drvPath"`
+	Outputs   map[string]string `json:"outputs"`
+	StartTime int64             `json:"startTime"`
+	StopTime  int64             `json:"stopTime"`
+}
+
+func formatNixBuildError(err error, stderr string) error {
+	stderr = strings.TrimSpace(stderr)
+	if stderr == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, stderr)
+}
+
+func handleNixBuildError(
+	ctx context.Context,
+	url string,
+	err error,
+	stderrOutput *stderrTail,
+) error {
+	stderr := stderrOutput.String()
+
+	err = stderrOutput.commandError("nix build", err)
+	if ctx.Err() != nil {
+		// A build cut short by its timeout was evaluated already.
+		slog.ErrorContext(ctx, "nix build failed", "url", url, "err", err)
+		return ClassifyError(BuildErrorClass, err)
+	}
+	if evalErr := parseNixEvalError(url, err, stderr); evalErr != nil {
+		// The trace leading to a missing attribute only helps debugging.
+		slog.DebugContext(ctx, "nix evaluation failed", "url", url, "nix_stderr", stderr)
+		return ClassifyError(EvalErrorClass, evalErr)
+	}
+	slog.ErrorContext(ctx, "nix build failed", "url", url, "err", err)
+	return classifyNixBuildError(err, stderr)
+}
+
+// handleNixBuild relays the stderr lines of a nix build at level and keeps
+// their tail in stderrOutput.
+func handleNixBuild(
+	ctx context.Context,
+	sc *bufio.Scanner,
+	level slog.Level,
+	stderrOutput *stderrTail,
+) error {
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		slog.Log(ctx, level, "nix build output", "nix_stderr", line)
+		stderrOutput.add(line)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("stderr scan failed: %w", err)
+	}
+	return nil
+}
+
+func NewNixClient(opts ...NixOption) *NixClient {
+	o := makeNixOptions(opts...)
+	return &NixClient{
+		binary:            o.binary,
+		buildTimeout:      o.buildTimeout,
+		killGracePeriod:   o.killGracePeriod,
+		heartbeatInterval: o.heartbeatInterval,
+		autoFeatures:      o.autoFeatures,
+	}
+}
+
+// WithNixBinary sets the nix executable used for every invocation.
+func WithNixBinary(binary string) NixOption {
+	return func(o *nixOptions) { o.binary = binary }
+}
+
+// WithNixBuildTimeout kills each nix build that runs longer than timeout.
+// Zero disables the timeout.
+func WithNixBuildTimeout(timeout time.Duration) NixOption {
+	return func(o *nixOptions) { o.buildTimeout = timeout }
+}
+
+// WithNixKillGracePeriod sets how long nix may take to exit after SIGINT when
+// its context is cancelled before it is killed.
+func WithNixKillGracePeriod(grace time.Duration) NixOption {
+	return func(o *nixOptions) { o.killGracePeriod = grace }
+}
+
+// WithNixHeartbeatInterval logs at info every interval that a nix build is
+// still running, with the derivation it is building. Zero disables it.
+func WithNixHeartbeatInterval(interval time.Duration) NixOption {
+	return func(o *nixOptions) { o.heartbeatInterval = interval }
+}
+
+// WithNixAutoExperimentalFeatures checks the nix configuration once, before
+// the first nix command, and passes --extra-experimental-features to every
+// command when it lacks one of RequiredExperimentalFeatures, so flakes build
+// on a stock nix install.
+func WithNixAutoExperimentalFeatures() NixOption {
+	return func(o *nixOptions) { o.autoFeatures = true }
+}
+
+func makeNixOptions(opts ...NixOption) *nixOptions {
+	o := &nixOptions{binary: "nix", killGracePeriod: DefaultKillGracePeriod}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func WithAcceptFlakeConfig() ImageOption {
+	return func(o *imageOptions) { o.acceptFlakeConfig = true }
+}
+
+func WithNoPureEval() ImageOption {
+	return func(o *imageOptions) { o.noPureEval = true }
+}
+
+// WithImpure allows the build to read the environment, e.g. builtins.getEnv.
+func WithImpure() ImageOption {
+	return func(o *imageOptions) { o.impure = true }
+}
+
+// WithRefresh makes nix refetch remote flake inputs instead of using its cache.
+func WithRefresh() ImageOption {
+	return func(o *imageOptions) { o.refresh = true }
+}
+
+// WithMaxJobs sets the nix --max-jobs value; "auto" and "0" are passed as is.
+func WithMaxJobs(maxJobs string) ImageOption {
+	return func(o *imageOptions) { o.maxJobs = maxJobs }
+}
+
+// WithCores sets the nix --cores value; "0" uses every available core.
+func WithCores(cores string) ImageOption {
+	return func(o *imageOptions) { o.cores = cores }
+}
+
+// WithBuilders sets the nix --builders value, passed verbatim, and lets the
+// remote builders fetch dependencies from substituters themselves.
+func WithBuilders(builders string) ImageOption {
+	return func(o *imageOptions) { o.builders = builders }
+}
+
+// WithStore builds into the nix store at the given URI, such as a chroot
+// store path, and resolves the built out path under it.
+func WithStore(store string) ImageOption {
+	return func(o *imageOptions) { o.store = store }
+}
+
+// WithEvalStore evaluates derivations in the nix store at the given URI.
+func WithEvalStore(store string) ImageOption {
+	return func(o *imageOptions) { o.evalStore = store }
+}
+
+// WithOutLink links the build result at path, registering it as a garbage
+// collector root for as long as the link exists.
+func WithOutLink(path string) ImageOption {
+	return func(o *imageOptions) { o.outLink = path }
+}
+
+// WithPackageName builds the flake package pkg instead of the one named
+// after the image.
+func WithPackageName(pkg string) ImageOption {
+	return func(o *imageOptions) { o.packageName = pkg }
+}
+
+// WithOverrideInputs passes each override to nix build as --override-input.
+func WithOverrideInputs(overrides ...FlakeInputOverride) ImageOption {
+	return func(o *imageOptions) { o.overrideInputs = append(o.overrideInputs, overrides...) }
+}
+
+// WithNixArgs passes each argument to nix build, and to the evaluation of
+// its out path, as --arg or --argstr.
+func WithNixArgs(args ...NixArg) ImageOption {
+	return func(o *imageOptions) { o.nixArgs = append(o.nixArgs, args...) }
+}
+
+// WithNixOutput reads the image from output rather than from the out output
+// of the built derivation.
+func WithNixOutput(output NixOutput) ImageOption {
+	return func(o *imageOptions) { o.output = output }
+}
+
+// WithPrintBuildLogs passes --print-build-logs to nix build so it prints the full log of
+// every derivation, and relays its stderr at info or above whatever
+// NixStderrLevel is.
+func WithPrintBuildLogs() ImageOption {
+	return func(o *imageOptions) { o.printBuildLogs = true }
+}
+
+// WithExtraArgs appends arguments verbatim to the nix build argv after the
+// flags set by this tool, so they can override its defaults.
+func WithExtraArgs(args ...string) ImageOption {
+	return func(o *imageOptions) { o.extraArgs = append(o.extraArgs, args...) }
+}
+
+func makeImageOptions(opts ...ImageOption) *imageOptions {
+	o := &imageOptions{
+		acceptFlakeConfig: true,
+		noPureEval:        true,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// stderrLevel returns the level the stderr lines of nix build are relayed at.
+func (o *imageOptions) stderrLevel() slog.Level {
+	if o.printBuildLogs {
+		return max(NixStderrLevel, slog.LevelInfo)
+	}
+	return NixStderrLevel
+}
+
+// flakePackageName returns the flake package the image of ref is built from.
+func (o *imageOptions) flakePackageName(ref name.Reference) string {
+	if o.packageName != "" {
+		return o.packageName
+	}
+	return FormatNixFlakePackageName(ref)
+}
+
+func (n *NixClient) command(ctx context.Context, args ...string) *exec.Cmd {
+	if n.autoFeatures {
+		n.featuresOnce.Do(func() { n.extraFeatures = n.missingFeatures(ctx) })
+		if len(n.extraFeatures) > 0 {
+			args = append(
+				[]string{"--extra-experimental-features", strings.Join(n.extraFeatures, " ")},
+				args...,
+			)
+		}
+	}
+	return n.baseCommand(ctx, args...)
+}
+
+// baseCommand runs nix with args as is, whatever its configuration.
+func (n *NixClient) baseCommand(ctx context.Context, args ...string) *exec.Cmd {
+	return interruptOnCancel(nixCommandContext(ctx, n.binary, args...), n.killGracePeriod)
+}
+
+// missingFeatures returns the RequiredExperimentalFeatures the nix
+// configuration lacks, all of them when it cannot be read, as reading it
+// needs nix-command.
+func (n *NixClient) missingFeatures(ctx context.Context) []string {
+	enabled, err := n.ExperimentalFeatures(ctx)
+	if err != nil {
+		slog.DebugContext(ctx, "read nix experimental features failed", "err", err)
+	}
+	var missing []string
+	for _, feature := range RequiredExperimentalFeatures {
+		if !slices.Contains(enabled, feature) {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		slog.InfoContext(
+			ctx,
+			"enabling nix experimental features missing from nix.conf",
+			"features", missing,
+			"hint", `add "experimental-features = nix-command flakes" to nix.conf`,
+		)
+	}
+	return missing
+}
+
+// GetImageBuilderType inspects the output built at path to tell how its image
+// is read, failing with the kind of output found when it is not an image.
+func (n *NixClient) GetImageBuilderType(ctx context.Context, path string) (BuilderType, error) {
+	builderType, err := DetectBuilderType(path)
+	if err != nil {
+		return UnknownBuilderType, err
+	}
+	slog.DebugContext(ctx, "detected builder type", "path", path, "builder_type", builderType)
+	return builderType, nil
+}
+
+// Version returns the raw output of nix --version.
+func (n *NixClient) Version(ctx context.Context) (string, error) {
+	cmd := n.command(ctx, "--version")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", formatNixBuildError(
+			fmt.Errorf("failed to run nix --version: %w", err),
+			stderr.String(),
+		)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// EvalPackageType evaluates the type attribute of an installable without
+// building it or touching the network and lock file.
+func (n *NixClient) EvalPackageType(
+	ctx context.Context,
+	installable string,
+	opts ...ImageOption,
+) (string, error) {
+	o := makeImageOptions(opts...)
+
+	args := []string{"eval", "--offline", "--no-write-lock-file", "--raw", installable + ".type"}
+	if o.noPureEval {
+		args = append(args, "--no-pure-eval")
+	}
+	cmd := n.command(ctx, args...)
+	slog.DebugContext(ctx, "evaluating package type", "cmd", cmd.Path, "args", args)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", formatNixBuildError(
+			fmt.Errorf("failed to run nix eval: %w", err),
+			stderr.String(),
+		)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// EvalPlatformOutPath evaluates the out path of the image package for p
+// without building it.
+func (n *NixClient) EvalPlatformOutPath(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	p *v1.Platform,
+	opts ...ImageOption,
+) (string, error) {
+	o := makeImageOptions(opts...)
+
+	// Evaluate like buildImage so the out path matches the one it builds.
+	args := []string{"eval", "--raw"}
+	if o.acceptFlakeConfig {
+		args = append(args, "--accept-flake-config")
+	}
+	if o.impure {
+		args = append(args, "--impure")
+	}
+	if o.refresh {
+		args = append(args, "--refresh")
+	}
+	if o.evalStore != "" {
+		args = append(args, "--eval-store", o.evalStore)
+	}
+	for _, override := range o.overrideInputs {
+		args = append(args, "--override-input", override.Name, override.Ref)
+	}
+	for _, arg := range o.nixArgs {
+		args = append(args, arg.args()...)
+	}
+	attr := FormatNixFlakeAttribute(buildContext, o.flakePackageName(ref), p)
+	if o.output.Name != "" {
+		attr += "." + o.output.Name
+	}
+	args = append(args, attr+".outPath")
+	cmd := n.command(ctx, args...)
+	slog.DebugContext(ctx, "evaluating package out path", "cmd", cmd.Path, "args", args)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", formatNixBuildError(
+			fmt.Errorf("failed to run nix eval: %w", err),
+			stderr.String(),
+		)
+	}
+	// Resolve like buildImage so the path matches the one it returns.
+	return resolveStorePath(o.store, strings.TrimSpace(string(output)))
+}
+
+// EvalPackageSystems returns the nix systems the flake at buildContext
+// defines the package of ref for, with a single nix eval of its packages.
+func (n *NixClient) EvalPackageSystems(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	opts ...ImageOption,
+) ([]string, error) {
+	o := makeImageOptions(opts...)
+
+	args := []string{"eval", "--json"}
+	if o.acceptFlakeConfig {
+		args = append(args, "--accept-flake-config")
+	}
+	if o.impure {
+		args = append(args, "--impure")
+	}
+	if o.refresh {
+		args = append(args, "--refresh")
+	}
+	if o.evalStore != "" {
+		args = append(args, "--eval-store", o.evalStore)
+	}
+	for _, override := range o.overrideInputs {
+		args = append(args, "--override-input", override.Name, override.Ref)
+	}
+	args = append(
+		args,
+		buildContext+"#packages",
+		"--apply",
+		fmt.Sprintf(
+			"ps: builtins.filter (s: ps.${s} ? %s) (builtins.attrNames ps)",
+			strconv.Quote(o.flakePackageName(ref)),
+		),
+	)
+	cmd := n.command(ctx, args...)
+	slog.DebugContext(ctx, "evaluating package systems", "cmd", cmd.Path, "args", args)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, formatNixBuildError(
+			fmt.Errorf("failed to run nix eval: %w", err),
+			stderr.String(),
+		)
+	}
+	var systems []string
+	if err := json.Unmarshal(output, &systems); err != nil {
+		return nil, fmt.Errorf("failed to parse nix eval output: %w", err)
+	}
+	return systems, nil
+}
+
+func (n *NixClient) BuildPlatformImage(
+	ctx context.Context,
+	buildContext string,
+	ref name.Reference,
+	p *v1.Platform,
+	opts ...ImageOption,
+) (_ string, err error) {
+	ctx, span := startSpan(ctx, "nix build", refAttribute(ref), platformAttribute(p))
+	defer func() { endSpan(span, err) }()
+	pkg := makeImageOptions(opts...).flakePackageName(ref)
+	out, err := n.BuildImage(ctx, FormatNixFlakeAttribute(buildContext, pkg, p), opts...)
+	span.SetAttributes(outPathKey.String(out))
+	var evalErr *NixEvalError
+	if errors.As(err, &evalErr) && len(evalErr.Suggestions) == 0 &&
+		(evalErr.Attribute == pkg || strings.HasSuffix(evalErr.Attribute, "."+pkg)) {
+		evalErr.Suggestions = n.suggestPackages(ctx, buildContext, pkg, p, opts...)
+	}
+	return out, err
+}
+
+// suggestPackages returns the packages the flake at buildContext defines for
+// p with a name close to pkg, listed with a single nix eval. Listing them is
+// best effort, as the build failed already.
+func (n *NixClient) suggestPackages(
+	ctx context.Context,
+	buildContext string,
+	pkg string,
+	p *v1.Platform,
+	opts ...ImageOption,
+) []string {
+	o := makeImageOptions(opts...)
+
+	args := []string{"eval", "--json"}
+	if o.acceptFlakeConfig {
+		args = append(args, "--accept-flake-config")
+	}
+	if o.impure {
+		args = append(args, "--impure")
+	}
+	if o.evalStore != "" {
+		args = append(args, "--eval-store", o.evalStore)
+	}
+	for _, override := range o.overrideInputs {
+		args = append(args, "--override-input", override.Name, override.Ref)
+	}
+	args = append(
+		args,
+		fmt.Sprintf("%s#packages.%s", buildContext, FormatSystemName(p)),
+		"--apply",
+		"builtins.attrNames",
+	)
+	cmd := n.command(ctx, args...)
+	slog.DebugContext(ctx, "listing packages to suggest", "cmd", cmd.Path, "args", args)
+
+	output, err := cmd.Output()
+	if err != nil {
+		slog.DebugContext(ctx, "list packages to suggest failed", "err", err)
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(output, &names); err != nil {
+		slog.DebugContext(ctx, "parse packages to suggest failed", "err", err)
+		return nil
+	}
+	return suggestAttributes(pkg, names)
+}
+
+func (n *NixClient) BuildImage(
+	ctx context.Context,
+	url string,
+	opts ...ImageOption,
+) (string, error) {
+	ctx, cancel := PhaseTimeoutContext(ctx, "nix build", n.buildTimeout)
+	defer cancel()
+	out, err := n.buildImage(ctx, url, opts...)
+	return out, WrapPhaseTimeout(ctx, err)
+}
+
+func (n *NixClient) buildImage(
+	ctx context.Context,
+	url string,
+	opts ...ImageOption,
+) (string, error) {
+	o := makeImageOptions(opts...)
+
+	args := []string{"build"}
+	if o.acceptFlakeConfig {
+		args = append(args, "--accept-flake-config")
+	}
+	if o.outLink != "" {
+		args = append(args, "--out-link", o.outLink)
+	} else if o.acceptFlakeConfig {
+		args = append(args, "--no-link")
+	}
+	if o.impure {
+		args = append(args, "--impure")
+	}
+	if o.refresh {
+		args = append(args, "--refresh")
+	}
+	if o.printBuildLogs {
+		args = append(args, "--print-build-logs")
+	}
+	if o.maxJobs != "" {
+		args = append(args, "--max-jobs", o.maxJobs)
+	}
+	if o.cores != "" {
+		args = append(args, "--cores", o.cores)
+	}
+	if o.builders != "" {
+		args = append(args, "--builders", o.builders, "--builders-use-substitutes")
+	}
+	if o.store != "" {
+		args = append(args, "--store", o.store)
+	}
+	if o.evalStore != "" {
+		args = append(args, "--eval-store", o.evalStore)
+	}
+	for _, override := range o.overrideInputs {
+		args = append(args, "--override-input", override.Name, override.Ref)
+	}
+	for _, arg := range o.nixArgs {
+		args = append(args, arg.args()...)
+	}
+	args = append(args, "--json")
+	args = append(args, o.extraArgs...)
+	args = append(args, url)
+	cmd := n.command(ctx, args...)
+	slog.InfoContext(ctx, "start nix build", "url", url, "args", args)
+	slog.DebugContext(ctx, "nix build argv", "argv", append([]string{n.binary}, args...))
+
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	dec := json.NewDecoder(bufio.NewReader(stdoutPipe))
+
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	sc := bufio.NewScanner(stderrPipe)
+	stderrOutput := newStderrTail()
+
+	if err = cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to run command: %w", err)
+	}
+
+	wg := errgroup.Group{}
+	wg.Go(func() error {
+		return handleNixBuild(ctx, sc, o.stderrLevel(), stderrOutput)
+	})
+	stopHeartbeat := startHeartbeat(ctx, n.heartbeatInterval, "nix build running", func() []any {
+		return []any{"url", url, "building", stderrOutput.currentDerivation()}
+	})
+	defer stopHeartbeat()
+
+	var result []*buildImageBuildResult
+	if err := dec.Decode(&result); err != nil {
+		// Nix exiting early closes stdout first, so its error may not be
+		// read from stderr yet.
+		_ = wg.Wait()
+		return "", handleNixBuildError(
+			ctx,
+			url,
+			fmt.Errorf("failed to parse nix build output: %w", err),
+			stderrOutput,
+		)
+	}
+
+	if err := wg.Wait(); err != nil {
+		return "", handleNixBuildError(
+			ctx,
+			url,
+			fmt.Errorf("failed to wait for command: %w", err),
+			stderrOutput,
+		)
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", handleNixBuildError(
+			ctx,
+			url,
+			fmt.Errorf("failed to wait for command: %w", err),
+			stderrOutput,
+		)
+	}
+
+	drvPath, built, err := selectBuildOutput(result, o.output)
+	if err != nil {
+		return "", ClassifyError(ConfigErrorClass, err)
+	}
+	slog.InfoContext(
+		ctx,
+		"nix build completed",
+		"url",
+		url,
+		"drv_path",
+		drvPath,
+		"output",
+		o.output.name(),
+		"out",
+		built,
+	)
+	if o.store == "" {
+		return built, nil
+	}
+	out, err := resolveStorePath(o.store, built)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(out); err != nil {
+		return "", fmt.Errorf(
+			"nix build reported %s but it is missing from store %s: %w",
+			built,
+			o.store,
+			err,
+		)
+	}
+	return out, nil
+}
+
+// selectBuildOutput returns the derivation and path of the output of a nix
+// build result selected by output, listing the available derivations or
+// outputs when it matches none, or when the result has several derivations
+// and output names none of them.
+func selectBuildOutput(
+	result []*buildImageBuildResult,
+	output NixOutput,
+) (string, string, error) {
+	if len(result) == 0 {
+		return "", "", errors.New("no output path found in nix build result")
+	}
+	candidates := result
+	if output.Derivation != "" {
+		candidates = nil
+		for _, r := range result {
+			if r.DrvPath == output.Derivation || derivationName(r.DrvPath) == output.Derivation {
+				candidates = append(candidates, r)
+			}
+		}
+	}
+	if len(candidates) != 1 {
+		drvs := make([]string, 0, len(result))
+		for _, r := range result {
+			drvs = append(drvs, r.DrvPath)
+		}
+		if len(candidates) == 0 {
+			return "", "", fmt.Errorf(
+				"derivation %s not found in nix build result, available: %s",
+				output.Derivation,
+				strings.Join(drvs, ", "),
+			)
+		}
+		return "", "", fmt.Errorf(
+			"nix build produced %d derivations, select one as DRV:%s: %s",
+			len(candidates),
+			output.name(),
+			strings.Join(drvs, ", "),
+		)
+	}
+	r := candidates[0]
+	out, ok := r.Outputs[output.name()]
+	if !ok {
+		return "", "", fmt.Errorf(
+			"output %s not found in derivation %s, available: %s",
+			output.name(),
+			r.DrvPath,
+			strings.Join(slices.Sorted(maps.Keys(r.Outputs)), ", "),
+		)
+	}
+	return r.DrvPath, out, nil
+}
+
+// derivationName returns the name of the derivation at drvPath, without its
+// store hash and .drv extension.
+func derivationName(drvPath string) string {
+	base := strings.TrimSuffix(filepath.Base(drvPath), ".drv")
+	if _, name, ok := strings.Cut(base, "-"); ok {
+		return name
+	}
+	return base
+}
+
+// NixStoreRoot returns the directory a local nix store URI keeps its /nix
+// tree under: the path itself for chroot store paths, the root parameter of
+// local stores, and empty for the system store.
+func NixStoreRoot(store string) (string, error) {
+	if strings.HasPrefix(store, "/") {
+		return store, nil
+	}
+	uri, query, _ := strings.Cut(store, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("invalid nix store %q: %w", store, err)
+	}
+	switch {
+	case uri == "", uri == "auto", uri == "local", uri == "local://":
+		return params.Get("root"), nil
+	case uri == "daemon", strings.HasPrefix(uri, "unix://"):
+		return "", nil
+	default:
+		return "", fmt.Errorf(
+			"nix store %q is not local: built images cannot be read from it",
+			store,
+		)
+	}
+}
+
+// resolveStorePath returns where the store path lives on disk in store.
+func resolveStorePath(store, path string) (string, error) {
+	root, err := NixStoreRoot(store)
+	if err != nil {
+		return "", err
+	}
+	if root == "" {
+		return path, nil
+	}
+	return filepath.Join(root, path), nil
+}
+
+// binfmtMiscDir is where the kernel lists the binfmt_misc handlers used to
+// run foreign binaries, such as the qemu-user emulators nix can build with.
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// hostSystem returns the nix system of the machine running nix-containers.
+func hostSystem() string {
+	return FormatSystemName(&v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH})
+}
+
+// hasBinfmtEmulation reports whether an enabled binfmt_misc handler can run
+// binaries of the nix system, registered either under the system name as
+// NixOS does or under the qemu-user-static name.
+func hasBinfmtEmulation(system string) bool {
+	arch, _, _ := strings.Cut(system, "-")
+	names := []string{system}
+	switch arch {
+	case "armv6l", "armv7l":
+		names = append(names, "qemu-arm")
+	case "i686":
+		names = append(names, "qemu-i386")
+	default:
+		names = append(names, "qemu-"+arch)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(binfmtMiscDir, name))
+		if err == nil && strings.HasPrefix(string(data), "enabled") {
+			return true
+		}
+	}
+	return false
+}
+
+// WarnEmulatedBuilds warns about every platform that is built for a foreign
+// nix system without remote builders or binfmt emulation, since nix then
+// either fails late or falls back to a very slow emulated build.
+func WarnEmulatedBuilds(ctx context.Context, plats []*v1.Platform, builders string) {
+	if builders != "" {
+		return
+	}
+	host := hostSystem()
+	for _, p := range plats {
+		system := FormatSystemName(p)
+		if system == host || hasBinfmtEmulation(system) {
+			continue
+		}
+		slog.WarnContext(
+			ctx,
+			"cross-architecture build without remote builders or binfmt emulation, "+
+				"expect it to fail or run much slower than native: "+
+				"pass --nix-builders or register a qemu binfmt handler",
+			"platform", p.String(),
+			"system", system,
+			"host_system", host,
+		)
+	}
+}
+
+// flakeShow is the subset of nix flake show --json used to list packages.
+type flakeShow struct {
+	Packages map[string]map[string]json.RawMessage `json:"packages"`
+}
+
+// FlakePackages runs nix flake show --json for flakeRef and returns the
+// package names of each nix system.
+func (n *NixClient) FlakePackages(
+	ctx context.Context,
+	flakeRef string,
+	opts ...ImageOption,
+) (map[string][]string, error) {
+	o := makeImageOptions(opts...)
+
+	args := []string{"flake", "show", "--json"}
+	if o.acceptFlakeConfig {
+		args = append(args, "--accept-flake-config")
+	}
+	if o.noPureEval {
+		args = append(args, "--no-pure-eval")
+	}
+	if o.refresh {
+		args = append(args, "--refresh")
+	}
+	args = append(args, flakeRef)
+	cmd := n.command(ctx, args...)
+	slog.DebugContext(ctx, "listing flake packages", "cmd", cmd.Path, "args", args)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, formatNixBuildError(
+			fmt.Errorf("failed to run nix flake show: %w", err),
+			stderr.String(),
+		)
+	}
+	var show flakeShow
+	if err := json.Unmarshal(output, &show); err != nil {
+		return nil, fmt.Errorf("failed to parse nix flake show output: %w", err)
+	}
+	// Packages of other systems are listed without being evaluated.
+	packages := make(map[string][]string, len(show.Packages))
+	for system, attrs := range show.Packages {
+		packages[system] = slices.Sorted(maps.Keys(attrs))
+	}
+	return packages, nil
+}
+
+// ExperimentalFeatures returns the experimental features enabled in the nix
+// configuration. Nix before 2.19 only has nix show-config.
+func (n *NixClient) ExperimentalFeatures(ctx context.Context) ([]string, error) {
+	var lastErr error
+	for _, args := range [][]string{{"config", "show"}, {"show-config"}} {
+		cmd := n.baseCommand(ctx, args...)
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			lastErr = formatNixBuildError(
+				fmt.Errorf("failed to run nix %s: %w", strings.Join(args, " "), err),
+				stderr.String(),
+			)
+			continue
+		}
+		return strings.Fields(parseNixConfigValue(string(output), "experimental-features")), nil
+	}
+	return nil, lastErr
+}
+
+// parseNixConfigValue returns the value of key in the key = value lines of
+// nix config show.
+func parseNixConfigValue(config, key string) string {
+	for line := range strings.Lines(config) {
+		k, v, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,1138 @@
+package nixcontainers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var commandStubMu sync.Mutex
+
+func stubCommand(
+	t testing.TB,
+	stdout, stderr string,
+	exitCode int,
+	argsFile string,
+) func(context.Context, string, ...string) *exec.Cmd {
+	t.Helper()
+
+	return func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		cmdArgs := make([]string, 0, 3+len(args))
+		cmdArgs = append(cmdArgs, "-test.run=^TestHelperProcess$", "--", command)
+		cmdArgs = append(cmdArgs, args...)
+
+		cmd := exec.CommandContext(ctx, os.Args[0], cmdArgs...)
+		cmd.Env = append(
+			os.Environ(),
+			"GO_WANT_HELPER_PROCESS=1",
+			// Under -race, the helper would otherwise sleep 1s on exit.
+			"GORACE=atexit_sleep_ms=0",
+			fmt.Sprintf("FAKE_STDOUT=%s", stdout),
+			fmt.Sprintf("FAKE_STDERR=%s", stderr),
+			fmt.Sprintf("FAKE_EXIT_CODE=%d", exitCode),
+		)
+		if argsFile != "" {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("FAKE_ARGS_FILE=%s", argsFile))
+		}
+		return cmd
+	}
+}
+
+func setupNixCommandTest(t testing.TB, stdout, stderr string, exitCode int) string {
+	t.Helper()
+
+	commandStubMu.Lock()
+	originalExec := nixCommandContext
+	t.Cleanup(func() {
+		nixCommandContext = originalExec
+		commandStubMu.Unlock()
+	})
+
+	argsFile := filepath.Join(t.TempDir(), "args.json")
+	nixCommandContext = stubCommand(t, stdout, stderr, exitCode, argsFile)
+	return argsFile
+}
+
+func readCapturedCommandArgs(t testing.TB, argsFile string) []string {
+	t.Helper()
+
+	argsRaw, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args file failed: %v", err)
+	}
+
+	var args []string
+	if err := json.Unmarshal(argsRaw, &args); err != nil {
+		t.Fatalf("decode args file failed: %v", err)
+	}
+	return args
+}
+
+func assertCapturedCommandArgs(t testing.TB, argsFile string, want ...string) {
+	t.Helper()
+
+	got := readCapturedCommandArgs(t, argsFile)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected captured args %q, got %q", want, got)
+	}
+}
+
+func TestHelperProcess(_ *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	args := os.Args
+	sep := 0
+	for i, arg := range args {
+		if arg == "--" {
+			sep = i
+			break
+		}
+	}
+	if sep == 0 || sep+1 >= len(args) {
+		if _, err := fmt.Fprint(os.Stderr, "missing helper separator"); err != nil {
+			os.Exit(2)
+		}
+		os.Exit(2)
+	}
+
+	if argsFile := os.Getenv("FAKE_ARGS_FILE"); argsFile != "" {
+		cmdArgs, err := json.Marshal(args[sep+1:])
+		if err != nil {
+			if _, writeErr := fmt.Fprint(os.Stderr, err.Error()); writeErr != nil {
+				os.Exit(2)
+			}
+			os.Exit(2)
+		}
+		if err := os.WriteFile(argsFile, cmdArgs, 0o644); err != nil {
+			if _, writeErr := fmt.Fprint(os.Stderr, err.Error()); writeErr != nil {
+				os.Exit(2)
+			}
+			os.Exit(2)
+		}
+	}
+
+	if sleep, err := time.ParseDuration(os.Getenv("FAKE_SLEEP")); err == nil {
+		time.Sleep(sleep)
+	}
+	if os.Getenv("FAKE_READ_STDIN") == "1" {
+		if _, err := io.Copy(io.Discard, os.Stdin); err != nil {
+			os.Exit(2)
+		}
+	}
+
+	if _, err := fmt.Fprint(os.Stdout, os.Getenv("FAKE_STDOUT")); err != nil {
+		os.Exit(2)
+	}
+	if _, err := fmt.Fprint(os.Stderr, os.Getenv("FAKE_STDERR")); err != nil {
+		os.Exit(2)
+	}
+
+	code, err := strconv.Atoi(os.Getenv("FAKE_EXIT_CODE"))
+	if err != nil {
+		code = 0
+	}
+	os.Exit(code)
+}
+
+func TestNixClientBuildImageReturnsOutPath(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"building\n",
+		0,
+	)
+
+	got, err := NewNixClient().BuildImage(context.Background(), "/workspace#packages.x86_64-linux.app")
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+	if got != "/nix/store/app" {
+		t.Fatalf("expected /nix/store/app, got %s", got)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImageSelectsOutput(t *testing.T) {
+	setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/abc-app.drv","outputs":{"out":"/nix/store/abc-app","image":"/nix/store/abc-app-image"}}]`,
+		"",
+		0,
+	)
+
+	got, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithNixOutput(NixOutput{Name: "image"}),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+	if got != "/nix/store/abc-app-image" {
+		t.Fatalf("expected /nix/store/abc-app-image, got %s", got)
+	}
+
+	_, err = NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithNixOutput(NixOutput{Name: "stream"}),
+	)
+	if ErrorClassOf(err) != ConfigErrorClass || !strings.Contains(err.Error(), "available: image, out") {
+		t.Fatalf("expected a config error listing the outputs, got %v", err)
+	}
+}
+
+func TestSelectBuildOutput(t *testing.T) {
+	result := []*buildImageBuildResult{
+		{
+			DrvPath: "/nix/store/abc-stream-app.drv",
+			Outputs: map[string]string{"out": "/nix/store/abc-stream-app"},
+		},
+		{
+			DrvPath: "/nix/store/def-app-docs.drv",
+			Outputs: map[string]string{"out": "/nix/store/def-app-docs", "man": "/nix/store/def-man"},
+		},
+	}
+	tests := []struct {
+		name    string
+		result  []*buildImageBuildResult
+		output  NixOutput
+		wantDrv string
+		want    string
+		err     string
+	}{
+		{
+			name:    "default output",
+			result:  result[:1],
+			wantDrv: "/nix/store/abc-stream-app.drv",
+			want:    "/nix/store/abc-stream-app",
+		},
+		{
+			name:    "derivation name",
+			result:  result,
+			output:  NixOutput{Derivation: "app-docs", Name: "man"},
+			wantDrv: "/nix/store/def-app-docs.drv",
+			want:    "/nix/store/def-man",
+		},
+		{
+			name:    "derivation path",
+			result:  result,
+			output:  NixOutput{Derivation: "/nix/store/abc-stream-app.drv"},
+			wantDrv: "/nix/store/abc-stream-app.drv",
+			want:    "/nix/store/abc-stream-app",
+		},
+		{
+			name:   "several derivations",
+			result: result,
+			err: "nix build produced 2 derivations, select one as DRV:out: " +
+				"/nix/store/abc-stream-app.drv, /nix/store/def-app-docs.drv",
+		},
+		{
+			name:   "unknown derivation",
+			result: result,
+			output: NixOutput{Derivation: "app"},
+			err:    "derivation app not found in nix build result",
+		},
+		{
+			name:   "unknown output",
+			result: result,
+			output: NixOutput{Derivation: "app-docs", Name: "image"},
+			err:    "output image not found in derivation /nix/store/def-app-docs.drv, available: man, out",
+		},
+		{
+			name: "empty result",
+			err:  "no output path found in nix build result",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drv, got, err := selectBuildOutput(tt.result, tt.output)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("select build output failed: %v", err)
+			}
+			if drv != tt.wantDrv || got != tt.want {
+				t.Fatalf("expected %s of %s, got %s of %s", tt.want, tt.wantDrv, got, drv)
+			}
+		})
+	}
+}
+
+func TestNixClientBuildImageOutLink(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithOutLink("/tmp/gcroot/result"),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--out-link",
+		"/tmp/gcroot/result",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImageReturnsErrorOnEmptyResult(t *testing.T) {
+	argsFile := setupNixCommandTest(t, `[]`, "", 0)
+
+	_, err := NewNixClient().BuildImage(context.Background(), "/workspace#packages.x86_64-linux.app")
+	if err == nil || !strings.Contains(err.Error(), "no output path found") {
+		t.Fatalf("expected empty result error, got %v", err)
+	}
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImageReturnsStderrOnCommandFailure(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"build failed\nhint: inspect logs",
+		1,
+	)
+
+	_, err := NewNixClient().BuildImage(context.Background(), "/workspace#packages.x86_64-linux.app")
+	if err == nil {
+		t.Fatal("expected build failure")
+	}
+	if !strings.Contains(err.Error(), "failed to wait for command") {
+		t.Fatalf("expected wait error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "\n    build failed\n    hint: inspect logs") {
+		t.Fatalf("expected stderr in error, got %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImageBoundsStderrInError(t *testing.T) {
+	var stderr strings.Builder
+	for i := range 220 {
+		fmt.Fprintf(&stderr, "app> line %d\n", i)
+	}
+	stderr.WriteString("error: builder for '/nix/store/app.drv' failed with exit code 1")
+	setupNixCommandTest(t, "[]", stderr.String(), 1)
+
+	_, err := NewNixClient().BuildImage(context.Background(), "/workspace#packages.x86_64-linux.app")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected a command error, got %v", err)
+	}
+	if len(cmdErr.Stderr) != stderrTailLines || cmdErr.OmittedLines != 121 ||
+		cmdErr.Stderr[0] != "app> line 121" {
+		t.Fatalf(
+			"expected the last %d stderr lines in the error, got %d after %d omitted",
+			stderrTailLines,
+			len(cmdErr.Stderr),
+			cmdErr.OmittedLines,
+		)
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "\n  nix build stderr:\n    (121 earlier lines omitted)\n    app> line 121\n") ||
+		!strings.HasSuffix(msg, "    app> line 219\n    error: builder for '/nix/store/app.drv' failed with exit code 1") {
+		t.Fatalf("expected the stderr tail indented in the error, got %v", err)
+	}
+	if ErrorClassOf(err) != BuildErrorClass {
+		t.Fatalf("expected a build error from the tail, got %v", ErrorClassOf(err))
+	}
+}
+
+func TestNixClientBuildImagePrintBuildLogs(t *testing.T) {
+	var buf bytes.Buffer
+	original := slog.Default()
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	slog.SetDefault(slog.New(handler))
+	t.Cleanup(func() { slog.SetDefault(original) })
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"app> compiling\n",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithPrintBuildLogs(),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"nix_stderr":"app> compiling"`) {
+		t.Fatalf("expected nix stderr relayed at info, got %s", buf.String())
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--print-build-logs",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildPlatformImageFormatsFlakeTarget(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	ref, err := name.ParseReference("ghcr.io/example/app:latest")
+	if err != nil {
+		t.Fatalf("parse reference failed: %v", err)
+	}
+	got, err := NewNixClient().BuildPlatformImage(
+		context.Background(),
+		"/workspace",
+		ref,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+	)
+	if err != nil {
+		t.Fatalf("build platform image failed: %v", err)
+	}
+	if got != "/nix/store/app" {
+		t.Fatalf("expected /nix/store/app, got %s", got)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildPlatformImagePackageName(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	ref, err := name.ParseReference("ghcr.io/example/api.v2:latest")
+	if err != nil {
+		t.Fatalf("parse reference failed: %v", err)
+	}
+	if _, err := NewNixClient().BuildPlatformImage(
+		context.Background(),
+		"/workspace",
+		ref,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+		WithPackageName("apiV2"),
+	); err != nil {
+		t.Fatalf("build platform image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--json",
+		"/workspace#packages.x86_64-linux.apiV2",
+	)
+}
+
+func TestNixClientEvalPackageTypeRunsOffline(t *testing.T) {
+	argsFile := setupNixCommandTest(t, "derivation\n", "", 0)
+
+	got, err := NewNixClient().EvalPackageType(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+	)
+	if err != nil {
+		t.Fatalf("eval package type failed: %v", err)
+	}
+	if got != "derivation" {
+		t.Fatalf("expected derivation, got %s", got)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"eval",
+		"--offline",
+		"--no-write-lock-file",
+		"--raw",
+		"/workspace#packages.x86_64-linux.app.type",
+		"--no-pure-eval",
+	)
+}
+
+func TestNixClientEvalPlatformOutPath(t *testing.T) {
+	argsFile := setupNixCommandTest(t, "/nix/store/abc-stream-app\n", "", 0)
+
+	got, err := NewNixClient().EvalPlatformOutPath(
+		context.Background(),
+		"/workspace",
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		&v1.Platform{OS: "linux", Architecture: "arm64"},
+		WithAcceptFlakeConfig(),
+		WithOverrideInputs(FlakeInputOverride{Name: "nixpkgs", Ref: "github:NixOS/nixpkgs"}),
+		WithNixArgs(NixArg{Name: "maxLayers", Value: "100", Expr: true}),
+		WithNixOutput(NixOutput{Name: "image"}),
+	)
+	if err != nil {
+		t.Fatalf("eval out path failed: %v", err)
+	}
+	if got != "/nix/store/abc-stream-app" {
+		t.Fatalf("expected trimmed out path, got %q", got)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"eval",
+		"--raw",
+		"--accept-flake-config",
+		"--override-input",
+		"nixpkgs",
+		"github:NixOS/nixpkgs",
+		"--arg",
+		"maxLayers",
+		"100",
+		"/workspace#packages.aarch64-linux.app.image.outPath",
+	)
+}
+
+func TestNixClientEvalPlatformOutPathResolvesStore(t *testing.T) {
+	setupNixCommandTest(t, "/nix/store/abc-stream-app\n", "", 0)
+	store := t.TempDir()
+
+	got, err := NewNixClient().EvalPlatformOutPath(
+		context.Background(),
+		"/workspace",
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		&v1.Platform{OS: "linux", Architecture: "arm64"},
+		WithStore(store),
+	)
+	if err != nil {
+		t.Fatalf("eval out path failed: %v", err)
+	}
+	if want := filepath.Join(store, "/nix/store/abc-stream-app"); got != want {
+		t.Fatalf("expected out path %q in the store, got %q", want, got)
+	}
+}
+
+func TestNixClientEvalPackageSystems(t *testing.T) {
+	argsFile := setupNixCommandTest(t, `["aarch64-linux","x86_64-linux"]`, "", 0)
+
+	got, err := NewNixClient().EvalPackageSystems(
+		context.Background(),
+		"/workspace",
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		WithAcceptFlakeConfig(),
+	)
+	if err != nil {
+		t.Fatalf("eval package systems failed: %v", err)
+	}
+	if want := []string{"aarch64-linux", "x86_64-linux"}; !slices.Equal(got, want) {
+		t.Fatalf("expected systems %q, got %q", want, got)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"eval",
+		"--json",
+		"--accept-flake-config",
+		"/workspace#packages",
+		"--apply",
+		`ps: builtins.filter (s: ps.${s} ? "app") (builtins.attrNames ps)`,
+	)
+}
+
+func TestNixClientBuildImageAppendsExtraArgsBeforeInstallable(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithExtraArgs("--option", "substituters", "https://a.example https://b.example"),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--json",
+		"--option",
+		"substituters",
+		"https://a.example https://b.example",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImagePassesImpure(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithImpure(),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--impure",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImagePassesOverrideInputs(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithOverrideInputs(
+			FlakeInputOverride{Name: "nixpkgs", Ref: "path:/src/nixpkgs"},
+			FlakeInputOverride{Name: "utils", Ref: "github:numtide/flake-utils"},
+		),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--override-input",
+		"nixpkgs",
+		"path:/src/nixpkgs",
+		"--override-input",
+		"utils",
+		"github:numtide/flake-utils",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImagePassesNixArgs(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithOverrideInputs(FlakeInputOverride{Name: "nixpkgs", Ref: "path:/src/nixpkgs"}),
+		WithNixArgs(
+			NixArg{Name: "channel", Value: "stable"},
+			NixArg{Name: "maxLayers", Value: "100", Expr: true},
+		),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--override-input",
+		"nixpkgs",
+		"path:/src/nixpkgs",
+		"--argstr",
+		"channel",
+		"stable",
+		"--arg",
+		"maxLayers",
+		"100",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImagePassesRefresh(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"github:example/app/main#packages.x86_64-linux.app",
+		WithRefresh(),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--refresh",
+		"--json",
+		"github:example/app/main#packages.x86_64-linux.app",
+	)
+}
+
+func TestHandleNixBuildRelaysStderrAsAttribute(t *testing.T) {
+	var buf bytes.Buffer
+	original := slog.Default()
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	slog.SetDefault(slog.New(handler))
+	t.Cleanup(func() { slog.SetDefault(original) })
+
+	sc := bufio.NewScanner(strings.NewReader("building '/nix/store/app.drv'...\n\nerror: boom\n"))
+	if err := handleNixBuild(context.Background(), sc, slog.LevelDebug, newStderrTail()); err != nil {
+		t.Fatalf("handle nix build failed: %v", err)
+	}
+
+	var relayed []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Msg       string `json:"msg"`
+			NixStderr string `json:"nix_stderr"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if record.Msg != "nix build output" {
+			t.Fatalf("expected nix stderr out of the message, got %q", record.Msg)
+		}
+		relayed = append(relayed, record.NixStderr)
+	}
+	if !slices.Equal(relayed, []string{"building '/nix/store/app.drv'...", "error: boom"}) {
+		t.Fatalf("unexpected relayed stderr %q", relayed)
+	}
+}
+
+func TestNixClientBuildImagePassesResourceLimits(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithMaxJobs("auto"),
+		WithCores("0"),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--max-jobs",
+		"auto",
+		"--cores",
+		"0",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImagePassesBuilders(t *testing.T) {
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+
+	builders := "ssh://builder aarch64-linux /etc/nix/key 4 1 big-parallel; @/etc/nix/machines"
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.aarch64-linux.app",
+		WithBuilders(builders),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--builders",
+		builders,
+		"--builders-use-substitutes",
+		"--json",
+		"/workspace#packages.aarch64-linux.app",
+	)
+}
+
+func TestNixClientBuildImageResolvesStorePath(t *testing.T) {
+	store := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(store, "nix", "store"), 0o755); err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(store, "nix", "store", "app"), nil, 0o644); err != nil {
+		t.Fatalf("write out path: %v", err)
+	}
+
+	argsFile := setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+	out, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithStore(store),
+		WithEvalStore("daemon"),
+	)
+	if err != nil {
+		t.Fatalf("build image failed: %v", err)
+	}
+	if want := filepath.Join(store, "nix", "store", "app"); out != want {
+		t.Fatalf("expected out path %q, got %q", want, out)
+	}
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"build",
+		"--accept-flake-config",
+		"--no-link",
+		"--store",
+		store,
+		"--eval-store",
+		"daemon",
+		"--json",
+		"/workspace#packages.x86_64-linux.app",
+	)
+}
+
+func TestNixClientBuildImageMissingStorePath(t *testing.T) {
+	store := t.TempDir()
+	setupNixCommandTest(
+		t,
+		`[{"drvPath":"/nix/store/app.drv","outputs":{"out":"/nix/store/app"}}]`,
+		"",
+		0,
+	)
+	_, err := NewNixClient().BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+		WithStore("local?root="+store),
+	)
+	if err == nil || !strings.Contains(err.Error(), "/nix/store/app but it is missing from store") {
+		t.Fatalf("expected missing out path error, got %v", err)
+	}
+}
+
+func TestNixStoreRoot(t *testing.T) {
+	tests := []struct {
+		store   string
+		want    string
+		wantErr bool
+	}{
+		{store: "", want: ""},
+		{store: "daemon", want: ""},
+		{store: "unix:///nix/var/nix/daemon-socket/socket", want: ""},
+		{store: "/tmp/nix-store", want: "/tmp/nix-store"},
+		{store: "local?root=/tmp/nix-store", want: "/tmp/nix-store"},
+		{store: "local", want: ""},
+		{store: "ssh-ng://builder", wantErr: true},
+		{store: "s3://cache", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := NixStoreRoot(tt.store)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("NixStoreRoot(%q) = %q, %v", tt.store, got, err)
+		}
+	}
+}
+
+func TestHasBinfmtEmulation(t *testing.T) {
+	original := binfmtMiscDir
+	binfmtMiscDir = t.TempDir()
+	t.Cleanup(func() { binfmtMiscDir = original })
+
+	for name, state := range map[string]string{
+		"qemu-aarch64":  "enabled\ninterpreter /usr/bin/qemu-aarch64-static\n",
+		"riscv64-linux": "enabled\ninterpreter /run/binfmt/riscv64-linux\n",
+		"qemu-arm":      "disabled\ninterpreter /usr/bin/qemu-arm-static\n",
+	} {
+		if err := os.WriteFile(filepath.Join(binfmtMiscDir, name), []byte(state), 0o644); err != nil {
+			t.Fatalf("write binfmt entry: %v", err)
+		}
+	}
+
+	tests := map[string]bool{
+		"aarch64-linux": true,
+		"riscv64-linux": true,
+		"armv7l-linux":  false,
+		"s390x-linux":   false,
+	}
+	for system, want := range tests {
+		if got := hasBinfmtEmulation(system); got != want {
+			t.Fatalf("hasBinfmtEmulation(%q) = %v, want %v", system, got, want)
+		}
+	}
+}
+
+func TestNixClientBuildImageTimesOut(t *testing.T) {
+	setupNixCommandTest(t, `[]`, "", 0)
+	stub := nixCommandContext
+	nixCommandContext = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		cmd := stub(ctx, command, args...)
+		cmd.Env = append(cmd.Env, "FAKE_SLEEP=1m")
+		return cmd
+	}
+
+	start := time.Now()
+	_, err := NewNixClient(WithNixBuildTimeout(50*time.Millisecond)).BuildImage(
+		context.Background(),
+		"/workspace#packages.x86_64-linux.app",
+	)
+	if err == nil {
+		t.Fatalf("expected timeout error")
+	}
+	if !strings.Contains(err.Error(), "nix build timed out after 50ms") {
+		t.Fatalf("expected nix build timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected nix build to be killed, took %s", elapsed)
+	}
+}
+
+func TestNixClientFlakePackages(t *testing.T) {
+	argsFile := setupNixCommandTest(t, flakeShowFixture, "", 0)
+
+	got, err := NewNixClient().FlakePackages(
+		context.Background(),
+		"/workspace",
+		WithAcceptFlakeConfig(),
+	)
+	if err != nil {
+		t.Fatalf("list flake packages failed: %v", err)
+	}
+	if !slices.Equal(got["aarch64-linux"], []string{"app", "worker"}) {
+		t.Fatalf("expected sorted aarch64-linux packages, got %q", got["aarch64-linux"])
+	}
+	if _, ok := got["x86_64-linux"]; !ok || len(got) != 4 {
+		t.Fatalf("expected packages of every system, got %v", got)
+	}
+
+	assertCapturedCommandArgs(
+		t,
+		argsFile,
+		"nix",
+		"flake",
+		"show",
+		"--json",
+		"--accept-flake-config",
+		"--no-pure-eval",
+		"/workspace",
+	)
+}
+
+func TestNixClientExperimentalFeatures(t *testing.T) {
+	config := "cores = 0\nexperimental-features = flakes nix-command\nmax-jobs = 4\n"
+	argsFile := setupNixCommandTest(t, config, "", 0)
+
+	features, err := NewNixClient().ExperimentalFeatures(context.Background())
+	if err != nil {
+		t.Fatalf("read experimental features failed: %v", err)
+	}
+	if !slices.Equal(features, []string{"flakes", "nix-command"}) {
+		t.Fatalf("expected flakes and nix-command, got %q", features)
+	}
+	assertCapturedCommandArgs(t, argsFile, "nix", "config", "show")
+}
+
+func TestNixClientAutoExperimentalFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		exitCode int
+		want     []string
+	}{
+		{
+			name:   "enabled",
+			config: "experimental-features = flakes nix-command\n",
+			want:   []string{"nix", "--version"},
+		},
+		{
+			name:   "flakes missing",
+			config: "experimental-features = nix-command\n",
+			want:   []string{"nix", "--extra-experimental-features", "flakes", "--version"},
+		},
+		{
+			name:     "unreadable config",
+			exitCode: 1,
+			want: []string{
+				"nix",
+				"--extra-experimental-features",
+				"nix-command flakes",
+				"--version",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsFile := setupNixCommandTest(t, tt.config, "", tt.exitCode)
+
+			nix := NewNixClient(WithNixAutoExperimentalFeatures())
+			_, _ = nix.Version(context.Background())
+			assertCapturedCommandArgs(t, argsFile, tt.want...)
+			// Later commands keep the features found missing.
+			_, _ = nix.Version(context.Background())
+			assertCapturedCommandArgs(t, argsFile, tt.want...)
+		})
+	}
+
+	argsFile := setupNixCommandTest(t, "experimental-features =\n", "", 0)
+	_, _ = NewNixClient().Version(context.Background())
+	assertCapturedCommandArgs(t, argsFile, "nix", "--version")
+}
+
+const flakeShowFixture = `{
+  "packages": {
+    "aarch64-darwin": {"app": {}},
+    "aarch64-linux": {"app": {}, "worker": {}},
+    "x86_64-linux": {
+      "app": {"name": "app-image", "type": "derivation"},
+      "tools": {"name": "tools", "type": "derivation"}
+    },
+    "bogus": {"app": {}}
+  },
+  "devShells": {"x86_64-linux": {"default": {"type": "derivation"}}}
+}`
@@ -0,0 +1,196 @@
+package nixcontainers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var nixVersionPattern = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// NixVersion is a major.minor.patch nix version.
+type NixVersion [3]int
+
+func (v NixVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// Compare returns -1, 0 or 1 when v is older than, equal to or newer than
+// other.
+func (v NixVersion) Compare(other NixVersion) int {
+	for i := range v {
+		if v[i] != other[i] {
+			if v[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+type nixVersionComparator struct {
+	op      string
+	version NixVersion
+}
+
+// nixVersionConstraint is a semver range: comparators separated by spaces or
+// commas are ANDed, and groups separated by || are ORed. Supported operators
+// are =, !=, <, <=, >, >=, ~ (same minor) and ^ (same major).
+type nixVersionConstraint struct {
+	raw    string
+	groups [][]nixVersionComparator
+}
+
+// ParseNixVersion extracts the first version number from nix --version
+// output such as "nix (Nix) 2.24.10".
+func ParseNixVersion(s string) (NixVersion, error) {
+	m := nixVersionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return NixVersion{}, fmt.Errorf("no version found in %q", strings.TrimSpace(s))
+	}
+	var v NixVersion
+	for i, seg := range m[1:] {
+		if seg == "" {
+			continue
+		}
+		n, err := strconv.Atoi(seg)
+		if err != nil {
+			return NixVersion{}, fmt.Errorf("invalid version segment %q: %w", seg, err)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func parseNixVersionConstraint(s string) (*nixVersionConstraint, error) {
+	c := &nixVersionConstraint{raw: s}
+	for _, group := range strings.Split(s, "||") {
+		fields := strings.FieldsFunc(group, func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid nix version constraint %q: empty range", s)
+		}
+		comparators := make([]nixVersionComparator, 0, len(fields))
+		for _, field := range fields {
+			op := field[:len(field)-len(strings.TrimLeft(field, "<>=!~^"))]
+			switch op {
+			case "", "=", "==", ">", ">=", "<", "<=", "!=", "~", "^":
+			default:
+				return nil, fmt.Errorf(
+					"invalid nix version constraint %q: unsupported operator %q",
+					s,
+					op,
+				)
+			}
+			v, err := ParseNixVersion(field[len(op):])
+			if err != nil {
+				return nil, fmt.Errorf("invalid nix version constraint %q: %w", s, err)
+			}
+			comparators = append(comparators, nixVersionComparator{op: op, version: v})
+		}
+		c.groups = append(c.groups, comparators)
+	}
+	return c, nil
+}
+
+func (c *nixVersionConstraint) String() string {
+	return c.raw
+}
+
+func (c *nixVersionConstraint) Check(v NixVersion) bool {
+	for _, group := range c.groups {
+		ok := true
+		for _, cmp := range group {
+			if !cmp.check(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmp nixVersionComparator) check(v NixVersion) bool {
+	r := v.Compare(cmp.version)
+	switch cmp.op {
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case "!=":
+		return r != 0
+	case "~":
+		return r >= 0 && v[0] == cmp.version[0] && v[1] == cmp.version[1]
+	case "^":
+		return r >= 0 && v[0] == cmp.version[0]
+	default:
+		return r == 0
+	}
+}
+
+// ResolveNixClient resolves the nix binary to use, building a pinned nix from
+// the nix package of fromFlake when set, and enforces the required semver
+// range when set.
+func ResolveNixClient(
+	ctx context.Context,
+	fromFlake string,
+	constraintRaw string,
+	opts ...NixOption,
+) (*NixClient, error) {
+	var constraint *nixVersionConstraint
+	if constraintRaw != "" {
+		var err error
+		constraint, err = parseNixVersionConstraint(constraintRaw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nix := NewNixClient(opts...)
+	if fromFlake != "" {
+		slog.InfoContext(ctx, "resolving pinned nix", "flake", fromFlake)
+		out, err := nix.BuildImage(ctx, fromFlake+"#nix")
+		if err != nil {
+			return nil, fmt.Errorf("failed to build nix from %s: %w", fromFlake, err)
+		}
+		opts = append(opts, WithNixBinary(filepath.Join(out, "bin", "nix")))
+		nix = NewNixClient(opts...)
+	}
+
+	raw, err := nix.Version(ctx)
+	if err != nil {
+		if constraint != nil {
+			return nil, fmt.Errorf("failed to check nix version: %w", err)
+		}
+		slog.WarnContext(ctx, "nix version check failed", "nix", nix.binary, "err", err)
+		return nix, nil
+	}
+	v, err := ParseNixVersion(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse nix version: %w", err)
+	}
+	slog.InfoContext(ctx, "nix resolved", "nix", nix.binary, "nix_version", v.String())
+	if constraint != nil && !constraint.Check(v) {
+		return nil, fmt.Errorf(
+			"nix %s at %s does not satisfy required version %q: "+
+				"install a matching nix or use --nix-from-flake to pin one",
+			v,
+			nix.binary,
+			constraint,
+		)
+	}
+	return nix, nil
+}
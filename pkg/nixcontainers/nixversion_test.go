@@ -0,0 +1,86 @@
+package nixcontainers
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseNixVersion(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "nix (Nix) 2.24.10", want: "2.24.10"},
+		{input: "nix (Nix) 2.18.1pre20231120_dirty", want: "2.18.1"},
+		{input: "nix (Lix, like Nix) 2.91.1", want: "2.91.1"},
+		{input: "2.25", want: "2.25.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseNixVersion(tt.input)
+			if err != nil {
+				t.Fatalf("parse nix version failed: %v", err)
+			}
+			if got.String() != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNixVersionConstraintCheck(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{constraint: ">=2.18", version: "2.24.10", want: true},
+		{constraint: ">=2.18 <2.24", version: "2.24.0", want: false},
+		{constraint: ">=2.18, <2.24", version: "2.23.3", want: true},
+		{constraint: "2.24.1", version: "2.24.1", want: true},
+		{constraint: "~2.24", version: "2.25.0", want: false},
+		{constraint: "^2.18", version: "2.30.0", want: true},
+		{constraint: "<2.18 || >=2.24", version: "2.20.0", want: false},
+		{constraint: "<2.18 || >=2.24", version: "2.24.2", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.constraint+"/"+tt.version, func(t *testing.T) {
+			c, err := parseNixVersionConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("parse constraint failed: %v", err)
+			}
+			v, err := ParseNixVersion(tt.version)
+			if err != nil {
+				t.Fatalf("parse version failed: %v", err)
+			}
+			if got := c.Check(v); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseNixVersionConstraintRejectsInvalidOperator(t *testing.T) {
+	_, err := parseNixVersionConstraint("=>2.18")
+	if err == nil || !strings.Contains(err.Error(), "unsupported operator") {
+		t.Fatalf("expected unsupported operator error, got %v", err)
+	}
+}
+
+func TestNixClientVersionUsesConfiguredBinary(t *testing.T) {
+	argsFile := setupNixCommandTest(t, "nix (Nix) 2.24.10\n", "", 0)
+
+	got, err := NewNixClient(WithNixBinary("/nix/store/pinned/bin/nix")).Version(
+		context.Background(),
+	)
+	if err != nil {
+		t.Fatalf("nix version failed: %v", err)
+	}
+	if got != "nix (Nix) 2.24.10" {
+		t.Fatalf("expected version output, got %q", got)
+	}
+	assertCapturedCommandArgs(t, argsFile, "/nix/store/pinned/bin/nix", "--version")
+}
@@ -0,0 +1,166 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+// expectedOutputs names the outputs an image can be read from.
+const expectedOutputs = "an executable stream script, an image tarball or an OCI layout directory"
+
+var (
+	// gzipMagic starts a gzip stream.
+	gzipMagic = []byte{0x1f, 0x8b}
+	// tarMagic is at tarMagicOffset in the first header of POSIX and GNU tar
+	// archives.
+	tarMagic = []byte("ustar")
+)
+
+const tarMagicOffset = 257
+
+// DetectBuilderType inspects the nix output at path: a tar or gzip archive is
+// loaded as an image archive, a directory with an oci-layout and index.json
+// is read as an OCI layout, and any other executable file is run as a stream
+// script. Other outputs are rejected with the kind found.
+func DetectBuilderType(path string) (BuilderType, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return UnknownBuilderType, fmt.Errorf("inspect nix output failed: %w", err)
+	}
+	if info.IsDir() {
+		if isOCILayout(path) {
+			return OCILayoutBuilderType, nil
+		}
+		return UnknownBuilderType, unsupportedOutput(
+			path,
+			"a directory without an oci-layout and index.json",
+		)
+	}
+	if !info.Mode().IsRegular() {
+		return UnknownBuilderType, unsupportedOutput(path, irregularFileKind(info.Mode()))
+	}
+	magic, err := readMagic(path)
+	if err != nil {
+		return UnknownBuilderType, fmt.Errorf("inspect nix output failed: %w", err)
+	}
+	switch {
+	case isArchive(magic):
+		return TarGzBuilderType, nil
+	case info.Mode()&0o111 != 0:
+		return StreamBuilderType, nil
+	case len(magic) == 0:
+		return UnknownBuilderType, unsupportedOutput(path, "an empty file")
+	default:
+		return UnknownBuilderType, unsupportedOutput(
+			path,
+			"a non-executable file that is neither a tar nor a gzip archive",
+		)
+	}
+}
+
+func unsupportedOutput(path, kind string) error {
+	return fmt.Errorf("nix output %s is %s, expected %s", path, kind, expectedOutputs)
+}
+
+// irregularFileKind names the kind of a file that is neither a regular file
+// nor a directory.
+func irregularFileKind(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "a named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "a socket"
+	case mode&fs.ModeDevice != 0:
+		return "a device"
+	default:
+		return "an irregular file"
+	}
+}
+
+// isOCILayout reports whether dir holds the files of an OCI image layout.
+func isOCILayout(dir string) bool {
+	for _, name := range []string{"oci-layout", "index.json"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.Mode().IsRegular() {
+			return false
+		}
+	}
+	return true
+}
+
+// readMagic reads the start of the file at path, up to the end of the magic
+// of a tar header.
+func readMagic(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	magic := make([]byte, tarMagicOffset+len(tarMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return magic[:n], nil
+}
+
+// isArchive reports whether magic starts a tar or gzip archive.
+func isArchive(magic []byte) bool {
+	return bytes.HasPrefix(magic, gzipMagic) ||
+		bytes.HasPrefix(magic[min(len(magic), tarMagicOffset):], tarMagic)
+}
+
+// layoutImage reads the single image of the OCI layout at dir, through the
+// indexes of a single manifest it is nested in.
+func layoutImage(dir string) (v1.Image, error) {
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("load image from oci layout failed: %w", err)
+	}
+	for {
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return nil, fmt.Errorf("read oci layout index failed: %w", err)
+		}
+		if len(m.Manifests) != 1 {
+			return nil, fmt.Errorf(
+				"oci layout %s holds %d manifests, expected a single image",
+				dir,
+				len(m.Manifests),
+			)
+		}
+		desc := m.Manifests[0]
+		switch {
+		case desc.MediaType.IsIndex():
+			if idx, err = idx.ImageIndex(desc.Digest); err != nil {
+				return nil, fmt.Errorf("read oci layout index failed: %w", err)
+			}
+		case desc.MediaType.IsImage():
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("load image from oci layout failed: %w", err)
+			}
+			return img, nil
+		default:
+			return nil, fmt.Errorf(
+				"oci layout %s holds a %s manifest, expected an image",
+				dir,
+				desc.MediaType,
+			)
+		}
+	}
+}
+
+// isLayoutDir reports whether path is a directory, read as an OCI layout
+// rather than an image archive.
+func isLayoutDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,211 @@
+package nixcontainers
+
+import (
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func writeTestOutput(t *testing.T, name string, raw []byte, mode os.FileMode) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, raw, mode); err != nil {
+		t.Fatalf("write nix output failed: %v", err)
+	}
+	return path
+}
+
+// writeTestGzipArchive writes a gzip compressed image archive named like a
+// plain one, as it is detected from its content.
+func writeTestGzipArchive(t *testing.T) string {
+	t.Helper()
+
+	raw, err := os.ReadFile(writeTestImageArchive(t))
+	if err != nil {
+		t.Fatalf("read image archive failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create image archive failed: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	gw := gzip.NewWriter(f)
+	if _, err := gw.Write(raw); err != nil {
+		t.Fatalf("compress image archive failed: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("compress image archive failed: %v", err)
+	}
+	return path
+}
+
+// writeTestLayout writes an OCI layout holding img, nested in an index when
+// nested is set, as layouts written by other tools are.
+func writeTestLayout(t *testing.T, img v1.Image, nested bool) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "image")
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("create oci layout failed: %v", err)
+	}
+	if nested {
+		err = lp.AppendIndex(mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: img}))
+	} else {
+		err = lp.AppendImage(img)
+	}
+	if err != nil {
+		t.Fatalf("write oci layout failed: %v", err)
+	}
+	return dir
+}
+
+func TestDetectBuilderType(t *testing.T) {
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	tests := []struct {
+		name string
+		path string
+		want BuilderType
+		err  string
+	}{
+		{
+			name: "stream script",
+			path: writeTestOutput(t, "stream-app", []byte("#!/bin/sh\n"), 0o755),
+			want: StreamBuilderType,
+		},
+		{name: "tar archive", path: writeTestImageArchive(t), want: TarGzBuilderType},
+		{name: "gzip archive", path: writeTestGzipArchive(t), want: TarGzBuilderType},
+		{name: "oci layout", path: writeTestLayout(t, img, false), want: OCILayoutBuilderType},
+		{
+			name: "directory",
+			path: t.TempDir(),
+			err:  "is a directory without an oci-layout and index.json",
+		},
+		{
+			name: "data file",
+			path: writeTestOutput(t, "app", []byte("not an image"), 0o644),
+			err:  "is a non-executable file that is neither a tar nor a gzip archive",
+		},
+		{
+			name: "empty file",
+			path: writeTestOutput(t, "app", nil, 0o644),
+			err:  "is an empty file",
+		},
+		{
+			name: "missing",
+			path: filepath.Join(t.TempDir(), "missing"),
+			err:  "inspect nix output failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetectBuilderType(tt.path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("detect builder type failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected builder type %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNixClientGetImageBuilderTypeNamesExpectedOutputs(t *testing.T) {
+	path := writeTestOutput(t, "app", []byte("not an image"), 0o644)
+
+	_, err := NewNixClient().GetImageBuilderType(context.Background(), path)
+	if err == nil || !strings.Contains(err.Error(), expectedOutputs) {
+		t.Fatalf("expected the expected outputs named, got %v", err)
+	}
+}
+
+func TestContainerClientPushPlatformImageFromOutput(t *testing.T) {
+	img, err := random.Image(64, 2)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatalf("get image digest failed: %v", err)
+	}
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	p := &v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	for name, path := range map[string]string{
+		"gzip archive":      writeTestGzipArchive(t),
+		"oci layout":        writeTestLayout(t, img, false),
+		"nested oci layout": writeTestLayout(t, img, true),
+		"tar archive":       writeTestImageArchive(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+			if _, err := containerClient.PushPlatformImage(context.Background(), ref, p, path, nil); err != nil {
+				t.Fatalf("push platform image failed: %v", err)
+			}
+			pushed, err := remote.Image(ref)
+			if err != nil {
+				t.Fatalf("fetch pushed image failed: %v", err)
+			}
+			layers, err := pushed.Layers()
+			if err != nil || len(layers) != 2 {
+				t.Fatalf("expected 2 pushed layers, got %d: %v", len(layers), err)
+			}
+			// A layout is pushed as is, while archives are converted.
+			if !strings.Contains(name, "layout") {
+				return
+			}
+			got, err := pushed.Digest()
+			if err != nil {
+				t.Fatalf("get pushed digest failed: %v", err)
+			}
+			if got != want {
+				t.Fatalf("expected the layout image %s pushed, got %s", want, got)
+			}
+		})
+	}
+
+	multi := writeTestLayout(t, img, false)
+	lp, err := layout.FromPath(multi)
+	if err != nil {
+		t.Fatalf("open oci layout failed: %v", err)
+	}
+	if err := lp.AppendImage(img); err != nil {
+		t.Fatalf("write oci layout failed: %v", err)
+	}
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	if _, err := containerClient.PushPlatformImage(context.Background(), ref, p, multi, nil); err == nil ||
+		!strings.Contains(err.Error(), "expected a single image") {
+		t.Fatalf("expected a layout of several manifests rejected, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package nixcontainers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DefaultPushJobs is how many layers a push uploads concurrently by default,
+// the go-containerregistry default.
+const DefaultPushJobs = 4
+
+// uploadLimit bounds the blob uploads in flight across every push sharing it,
+// so that concurrent platform pushes split the upload budget instead of each
+// using all of it.
+type uploadLimit chan struct{}
+
+func newUploadLimit(jobs int) uploadLimit {
+	return make(uploadLimit, jobs)
+}
+
+// transport returns base waiting for a free slot of the limit before sending
+// a blob upload request.
+func (l uploadLimit) transport(base http.RoundTripper) http.RoundTripper {
+	return &uploadLimitTransport{base: base, limit: l}
+}
+
+type uploadLimitTransport struct {
+	base  http.RoundTripper
+	limit uploadLimit
+}
+
+func (t *uploadLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isBlobUpload(req) {
+		return t.base.RoundTrip(req)
+	}
+	select {
+	case t.limit <- struct{}{}:
+	case <-req.Context().Done():
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, req.Context().Err()
+	}
+	defer func() { <-t.limit }()
+	return t.base.RoundTrip(req)
+}
+
+// isBlobUpload reports whether req sends blob content: the chunk of a
+// streamed upload, or a monolithic upload committed with its digest.
+func isBlobUpload(req *http.Request) bool {
+	if !strings.Contains(req.URL.Path, "/blobs/uploads/") {
+		return false
+	}
+	switch req.Method {
+	case http.MethodPatch:
+		return true
+	case http.MethodPut:
+		return req.ContentLength != 0
+	}
+	return false
+}
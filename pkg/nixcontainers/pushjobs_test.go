@@ -0,0 +1,86 @@
+package nixcontainers
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyTransport answers every request after a delay, recording the
+// most requests it served at once.
+type concurrencyTransport struct {
+	inFlight atomic.Int32
+	max      atomic.Int32
+}
+
+func (t *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := t.inFlight.Add(1)
+	defer t.inFlight.Add(-1)
+	for {
+		m := t.max.Load()
+		if n <= m || t.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return &http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody, Request: req}, nil
+}
+
+func TestUploadLimitTransportBoundsBlobUploads(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		limited bool
+	}{
+		{name: "chunk uploads", method: http.MethodPatch, path: "/v2/app/blobs/uploads/1", limited: true},
+		{
+			name:    "monolithic uploads",
+			method:  http.MethodPut,
+			path:    "/v2/app/blobs/uploads/1",
+			body:    "layer",
+			limited: true,
+		},
+		{name: "upload commits", method: http.MethodPut, path: "/v2/app/blobs/uploads/1"},
+		{name: "blob checks", method: http.MethodHead, path: "/v2/app/blobs/sha256:abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &concurrencyTransport{}
+			rt := newUploadLimit(2).transport(base)
+
+			var wg sync.WaitGroup
+			for range 8 {
+				wg.Go(func() {
+					req, err := http.NewRequest(
+						tt.method,
+						"https://registry.example"+tt.path,
+						strings.NewReader(tt.body),
+					)
+					if err != nil {
+						t.Errorf("create request failed: %v", err)
+						return
+					}
+					if tt.body == "" {
+						req.Body, req.ContentLength = nil, 0
+					}
+					if _, err := rt.RoundTrip(req); err != nil {
+						t.Errorf("round trip failed: %v", err)
+					}
+				})
+			}
+			wg.Wait()
+			got := base.max.Load()
+			if tt.limited && got > 2 {
+				t.Fatalf("expected at most 2 uploads at once, got %d", got)
+			}
+			if !tt.limited && got <= 2 {
+				t.Fatalf("expected requests not to be limited, got %d at once", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package nixcontainers
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// layerWrapper replaces a layer handed to the pusher, which only sees the
+// layers of an image, or of the images of an index, through these wrappers.
+type layerWrapper func(v1.Layer) v1.Layer
+
+// wrapPushLayers returns t with every layer of its images passed through wrap.
+func wrapPushLayers(t remote.Taggable, wrap layerWrapper) remote.Taggable {
+	switch t := t.(type) {
+	case v1.Image:
+		return &wrappedImage{Image: t, wrap: wrap}
+	case v1.ImageIndex:
+		return &wrappedIndex{index: t, wrap: wrap}
+	}
+	return t
+}
+
+type wrappedImage struct {
+	v1.Image
+	wrap layerWrapper
+}
+
+func (i *wrappedImage) Layers() ([]v1.Layer, error) {
+	ls, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]v1.Layer, 0, len(ls))
+	for _, l := range ls {
+		wrapped = append(wrapped, i.wrap(l))
+	}
+	return wrapped, nil
+}
+
+// wrappedIndex forwards to index, except for its child images and indexes.
+type wrappedIndex struct {
+	index v1.ImageIndex
+	wrap  layerWrapper
+}
+
+func (i *wrappedIndex) MediaType() (types.MediaType, error) { return i.index.MediaType() }
+
+func (i *wrappedIndex) Digest() (v1.Hash, error) { return i.index.Digest() }
+
+func (i *wrappedIndex) Size() (int64, error) { return i.index.Size() }
+
+func (i *wrappedIndex) IndexManifest() (*v1.IndexManifest, error) { return i.index.IndexManifest() }
+
+func (i *wrappedIndex) RawManifest() ([]byte, error) { return i.index.RawManifest() }
+
+func (i *wrappedIndex) Image(h v1.Hash) (v1.Image, error) {
+	img, err := i.index.Image(h)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedImage{Image: img, wrap: i.wrap}, nil
+}
+
+func (i *wrappedIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	idx, err := i.index.ImageIndex(h)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedIndex{index: idx, wrap: i.wrap}, nil
+}
@@ -0,0 +1,227 @@
+package nixcontainers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// pushProgressInterval is how often the progress of a push is logged at most,
+// unless it advanced by pushProgressStep percent since the last line.
+const pushProgressInterval = 5 * time.Second
+
+const pushProgressStep = 5
+
+// pushProgress reports the progress of concurrent registry pushes. Each push
+// is logged on its own, throttled, or when out is set, all pushes are
+// rendered together as a single updating line.
+type pushProgress struct {
+	out io.Writer
+	now func() time.Time
+
+	mu     sync.Mutex
+	pushes []*pushProgressEntry
+}
+
+type pushProgressEntry struct {
+	label       string
+	ref         string
+	platform    string
+	update      v1.Update
+	lastLog     time.Time
+	lastPercent int
+}
+
+func newPushProgress(out io.Writer) *pushProgress {
+	return &pushProgress{out: out, now: time.Now}
+}
+
+// track returns the channel to pass to remote.WithProgress for a push of ref
+// and a function waiting until its updates are reported. remote closes the
+// channel when the write returns.
+func (p *pushProgress) track(
+	ctx context.Context,
+	ref, platform string,
+) (chan v1.Update, func()) {
+	e := &pushProgressEntry{ref: ref, platform: platform, label: ref, lastLog: p.now()}
+	if platform != "" {
+		e.label = platform
+	}
+	p.mu.Lock()
+	p.pushes = append(p.pushes, e)
+	p.mu.Unlock()
+
+	updates := make(chan v1.Update, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for u := range updates {
+			if u.Error != nil {
+				continue
+			}
+			p.observe(ctx, e, u)
+		}
+		p.finish(e)
+	}()
+	return updates, func() { <-done }
+}
+
+func (p *pushProgress) observe(ctx context.Context, e *pushProgressEntry, u v1.Update) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.update = u
+	if p.out != nil {
+		p.render()
+		return
+	}
+	percent := progressPercent(u)
+	now := p.now()
+	if now.Sub(e.lastLog) < pushProgressInterval && percent < e.lastPercent+pushProgressStep {
+		return
+	}
+	e.lastLog = now
+	e.lastPercent = percent
+	slog.InfoContext(
+		ctx,
+		"pushing image",
+		"platform", e.platform,
+		"ref", e.ref,
+		"progress", formatPushProgress(u),
+		"complete_bytes", u.Complete,
+		"total_bytes", u.Total,
+	)
+}
+
+// finish drops the push from the updating line, ending the line once every
+// push is done.
+func (p *pushProgress) finish(e *pushProgressEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, push := range p.pushes {
+		if push == e {
+			p.pushes = append(p.pushes[:i], p.pushes[i+1:]...)
+			break
+		}
+	}
+	if p.out == nil {
+		return
+	}
+	if len(p.pushes) == 0 {
+		_, _ = fmt.Fprint(p.out, "\r\033[K")
+		return
+	}
+	p.render()
+}
+
+func (p *pushProgress) render() {
+	parts := make([]string, 0, len(p.pushes))
+	for _, push := range p.pushes {
+		parts = append(parts, push.label+" "+formatPushProgress(push.update))
+	}
+	_, _ = fmt.Fprintf(p.out, "\r\033[Kpushing %s", strings.Join(parts, " | "))
+}
+
+func progressPercent(u v1.Update) int {
+	if u.Total <= 0 {
+		return 0
+	}
+	return int(min(u.Complete, u.Total) * 100 / u.Total)
+}
+
+func formatPushProgress(u v1.Update) string {
+	return fmt.Sprintf(
+		"%s/%s (%d%%)",
+		units.BytesSize(float64(u.Complete)),
+		units.BytesSize(float64(u.Total)),
+		progressPercent(u),
+	)
+}
+
+// progressLayer counts the compressed bytes read from its layer. A layer is
+// only added to the total once the push opens it, so blobs the registry
+// already has are left out, and reopening it for a retry starts over.
+type progressLayer struct {
+	v1.Layer
+	counter *progressCounter
+
+	mu     sync.Mutex
+	opened bool
+	read   int64
+}
+
+func (l *progressLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.opened {
+		size, err := l.Size()
+		if err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+		l.opened = true
+		l.counter.add(size, 0)
+	} else if l.read > 0 {
+		l.counter.add(0, -l.read)
+	}
+	l.read = 0
+	return &progressReader{ReadCloser: rc, layer: l}, nil
+}
+
+type progressReader struct {
+	io.ReadCloser
+	layer *progressLayer
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		r.layer.mu.Lock()
+		r.layer.read += int64(n)
+		r.layer.mu.Unlock()
+		r.layer.counter.add(0, int64(n))
+	}
+	return n, err
+}
+
+// progressCounter sums the layers of one push into the updates it sends,
+// since remote.WithProgress has no effect on a shared pusher.
+type progressCounter struct {
+	mu      sync.Mutex
+	update  v1.Update
+	updates chan<- v1.Update
+}
+
+func newProgressCounter(updates chan<- v1.Update) *progressCounter {
+	return &progressCounter{updates: updates}
+}
+
+// wrap returns l counting the bytes the push reads from it.
+func (c *progressCounter) wrap(l v1.Layer) v1.Layer {
+	return &progressLayer{Layer: l, counter: c}
+}
+
+// complete returns the bytes read from the layers so far.
+func (c *progressCounter) complete() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.update.Complete
+}
+
+func (c *progressCounter) add(total, complete int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.update.Total += total
+	c.update.Complete += complete
+	c.updates <- c.update
+}
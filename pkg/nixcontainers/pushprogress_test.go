@@ -0,0 +1,135 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestPushProgressThrottlesLogLines(t *testing.T) {
+	var buf bytes.Buffer
+	original := slog.Default()
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	slog.SetDefault(slog.New(handler))
+	t.Cleanup(func() { slog.SetDefault(original) })
+
+	now := time.Unix(0, 0)
+	progress := newPushProgress(nil)
+	progress.now = func() time.Time { return now }
+
+	push := &pushProgressEntry{
+		ref:      "ghcr.io/example/app:latest",
+		platform: "linux/arm64",
+		lastLog:  now,
+	}
+	for complete := int64(1); complete <= 12; complete++ {
+		progress.observe(context.Background(), push, v1.Update{Complete: complete, Total: 100})
+	}
+	now = now.Add(pushProgressInterval)
+	progress.observe(context.Background(), push, v1.Update{Complete: 13, Total: 100})
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Platform string `json:"platform"`
+			Progress string `json:"progress"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		if record.Platform != "linux/arm64" {
+			t.Fatalf("expected platform attribute, got %q", line)
+		}
+		got = append(got, record.Progress)
+	}
+	want := []string{"5B/100B (5%)", "10B/100B (10%)", "13B/100B (13%)"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected progress %q, got %q", want, got)
+	}
+}
+
+func TestPushProgressRendersSingleLine(t *testing.T) {
+	var out bytes.Buffer
+	progress := newPushProgress(&out)
+
+	amd64, waitAMD64 := progress.track(context.Background(), "ghcr.io/example/app:a", "linux/amd64")
+	arm64, waitARM64 := progress.track(context.Background(), "ghcr.io/example/app:b", "linux/arm64")
+	amd64 <- v1.Update{Complete: 512, Total: 1024}
+	close(amd64)
+	waitAMD64()
+	arm64 <- v1.Update{Complete: 1024, Total: 1024}
+	close(arm64)
+	waitARM64()
+
+	got := out.String()
+	if strings.Contains(got, "\n") {
+		t.Fatalf("expected a single updating line, got %q", got)
+	}
+	if !strings.Contains(got, "pushing linux/amd64 512B/1KiB (50%) | linux/arm64 0B/0B (0%)") {
+		t.Fatalf("expected both platforms on the line, got %q", got)
+	}
+	if !strings.HasSuffix(got, "pushing linux/arm64 1KiB/1KiB (100%)\r\033[K") {
+		t.Fatalf("expected the line to be cleared once every push is done, got %q", got)
+	}
+}
+
+func TestProgressImageCountsUploadedLayers(t *testing.T) {
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatalf("create random image failed: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("read layers failed: %v", err)
+	}
+	var size int64
+	for _, l := range layers {
+		n, err := l.Size()
+		if err != nil {
+			t.Fatalf("layer size failed: %v", err)
+		}
+		size += n
+	}
+	pusher, err := remote.NewPusher()
+	if err != nil {
+		t.Fatalf("create pusher failed: %v", err)
+	}
+
+	push := func(ref name.Reference) []v1.Update {
+		updates := make(chan v1.Update, 64)
+		counted := wrapPushLayers(img, newProgressCounter(updates).wrap)
+		if err := pusher.Push(context.Background(), ref, counted); err != nil {
+			t.Fatalf("push failed: %v", err)
+		}
+		close(updates)
+		var got []v1.Update
+		for u := range updates {
+			got = append(got, u)
+		}
+		return got
+	}
+
+	got := push(ref)
+	if len(got) == 0 {
+		t.Fatalf("expected progress updates")
+	}
+	last := got[len(got)-1]
+	if last.Total != size || last.Complete != size {
+		t.Fatalf("expected every layer byte to be counted, got %+v", last)
+	}
+	if again := push(ref.Context().Tag("stable")); len(again) != 0 {
+		t.Fatalf("expected no progress for layers the registry has, got %+v", again)
+	}
+}
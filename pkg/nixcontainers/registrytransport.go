@@ -0,0 +1,139 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// The registry transport defaults, those of the go-containerregistry retry
+// transport: two retries, 100ms then 300ms after the failed attempts.
+const (
+	DefaultRegistryRetryCount   = 2
+	DefaultRegistryRetryBackoff = 100 * time.Millisecond
+)
+
+// registryRetryFactor multiplies the backoff after each retry.
+const registryRetryFactor = 3.0
+
+// registryRetryStatusCodes are the responses retried by the registry
+// transport: rate limiting and transient server errors.
+var registryRetryStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+	499, // nginx, client closed request
+	522, // Cloudflare, connection timed out
+}
+
+// RegistryTransport tunes every request sent to registries.
+type RegistryTransport struct {
+	// Timeout bounds connecting, the TLS handshake and waiting for the
+	// response of each request, zero keeping the defaults. Uploads are not
+	// bounded, only the wait for the registry once they are sent.
+	Timeout time.Duration
+	// RetryCount is how many times a request failing with a transient error
+	// or a 429 or 5xx response is retried.
+	RetryCount int
+	// RetryBackoff is the delay before the first retry, tripled after each.
+	RetryBackoff time.Duration
+}
+
+// DefaultRegistryTransport returns the registry transport settings matching
+// the go-containerregistry defaults.
+func DefaultRegistryTransport() RegistryTransport {
+	return RegistryTransport{
+		RetryCount:   DefaultRegistryRetryCount,
+		RetryBackoff: DefaultRegistryRetryBackoff,
+	}
+}
+
+// WithContainerRegistryTransport sends registry requests through the
+// go-containerregistry retry transport configured with rt. The remote
+// package still retries transient network errors on top of it, but leaves
+// the retried responses to rt.
+func WithContainerRegistryTransport(rt RegistryTransport) ContainerOption {
+	return func(o *containerOptions) {
+		t := rt.roundTripper()
+		o.transport = t
+		o.remote = append(o.remote, rt.remoteOptions(t)...)
+	}
+}
+
+// RemoteOptions returns the remote options sending requests through the retry
+// transport configured with rt, for registry requests made without a
+// ContainerClient.
+func (rt RegistryTransport) RemoteOptions() []remote.Option {
+	return rt.remoteOptions(rt.roundTripper())
+}
+
+func (rt RegistryTransport) remoteOptions(t http.RoundTripper) []remote.Option {
+	return []remote.Option{
+		remote.WithTransport(t),
+		remote.WithRetryStatusCodes(),
+		remote.WithRetryBackoff(rt.backoff()),
+	}
+}
+
+func (rt RegistryTransport) backoff() remote.Backoff {
+	return remote.Backoff{
+		Duration: rt.RetryBackoff,
+		Factor:   registryRetryFactor,
+		Jitter:   0.1,
+		Steps:    rt.RetryCount + 1,
+	}
+}
+
+// roundTripper returns the remote default transport with the timeouts of rt,
+// retrying as configured.
+func (rt RegistryTransport) roundTripper() http.RoundTripper {
+	base := remote.DefaultTransport.(*http.Transport).Clone()
+	if rt.Timeout > 0 {
+		base.DialContext = (&net.Dialer{
+			Timeout:   rt.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		base.TLSHandshakeTimeout = rt.Timeout
+		base.ResponseHeaderTimeout = rt.Timeout
+	}
+	return transport.NewRetry(
+		base,
+		transport.WithRetryBackoff(rt.backoff()),
+		transport.WithRetryPredicate(isTransientRegistryError),
+		transport.WithRetryStatusCodes(registryRetryStatusCodes...),
+	)
+}
+
+// isTransientRegistryError reports whether a registry request failed in a way
+// worth retrying: a temporary error, such as a retried response or a timeout,
+// or a connection that was reset or closed mid-request.
+func isTransientRegistryError(err error) bool {
+	if err == nil ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled) {
+		return false
+	}
+	var temp interface{ Temporary() bool }
+	if errors.As(err, &temp) && temp.Temporary() {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,70 @@
+package nixcontainers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryTransportRetriesTooManyRequests(t *testing.T) {
+	tests := []struct {
+		name         string
+		retryCount   int
+		wantStatus   int
+		wantAttempts int32
+	}{
+		{name: "recovers", retryCount: 2, wantStatus: http.StatusOK, wantAttempts: 3},
+		{name: "gives up", retryCount: 1, wantStatus: http.StatusTooManyRequests, wantAttempts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if attempts.Add(1) <= 2 {
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			t.Cleanup(srv.Close)
+
+			rt := RegistryTransport{RetryCount: tt.retryCount, RetryBackoff: time.Millisecond}
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatalf("create request failed: %v", err)
+			}
+			resp, err := rt.roundTripper().RoundTrip(req)
+			if err != nil {
+				t.Fatalf("round trip failed: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Fatalf("expected %d attempts, got %d", tt.wantAttempts, got)
+			}
+		})
+	}
+}
+
+func TestRegistryTransportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	rt := RegistryTransport{Timeout: 10 * time.Millisecond, RetryBackoff: time.Millisecond}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("create request failed: %v", err)
+	}
+	if _, err := rt.roundTripper().RoundTrip(req); err == nil {
+		t.Fatal("expected the response wait to time out")
+	}
+}
@@ -0,0 +1,269 @@
+package nixcontainers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// DefaultSmokeTestTimeout bounds a smoke test, including pulling the image
+// when it runs on a cluster.
+const DefaultSmokeTestTimeout = 5 * time.Minute
+
+// smokeTestRemoveTimeout bounds the removal of the smoke test container or
+// pod, which also runs after the build context is cancelled.
+const smokeTestRemoveTimeout = 30 * time.Second
+
+var kubectlCommandContext = exec.CommandContext
+
+// errSmokeTestPlatformMismatch is returned by smoke testers that cannot run
+// an image of the requested platform.
+var errSmokeTestPlatformMismatch = errors.New("platform cannot run on the smoke test host")
+
+// smokeTestImage is an image the smoke test runs against. Loaded is the tag
+// in the Docker daemon and Pushed the registry reference, nil when the image
+// was not pushed.
+type smokeTestImage struct {
+	Loaded   name.Reference
+	Pushed   name.Reference
+	Platform *v1.Platform
+}
+
+// ref returns the loaded image, or the pushed one when it was not loaded.
+func (i smokeTestImage) ref() name.Reference {
+	if i.Loaded != nil {
+		return i.Loaded
+	}
+	return i.Pushed
+}
+
+// SmokeTestResult is the outcome of running the smoke test command.
+type SmokeTestResult struct {
+	ExitCode int
+	Output   string
+}
+
+// SmokeTester runs the smoke test command of a built image.
+type SmokeTester interface {
+	SmokeTest(ctx context.Context, image smokeTestImage, args []string) (*SmokeTestResult, error)
+}
+
+// SmokeTest runs args in a container created from the loaded image and
+// removes the container afterwards, including on cancellation.
+func (c *ContainerClient) SmokeTest(
+	ctx context.Context,
+	image smokeTestImage,
+	args []string,
+) (*SmokeTestResult, error) {
+	version, err := c.docker.ServerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get docker server version: %w", err)
+	}
+	if version.Os != image.Platform.OS || version.Arch != image.Platform.Architecture {
+		return nil, fmt.Errorf(
+			"%w: docker daemon is %s/%s",
+			errSmokeTestPlatformMismatch,
+			version.Os,
+			version.Arch,
+		)
+	}
+
+	if image.Loaded == nil {
+		return nil, fmt.Errorf(
+			"%s is not loaded into the docker daemon: set --load or use --smoke-test-k8s",
+			image.Pushed,
+		)
+	}
+
+	created, err := c.docker.ContainerCreate(ctx, &container.Config{
+		Image:      image.Loaded.Name(),
+		Entrypoint: args[:1],
+		Cmd:        args[1:],
+		Tty:        true,
+	}, &container.HostConfig{}, nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create smoke test container: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), smokeTestRemoveTimeout)
+		defer cancel()
+		if err := c.docker.ContainerRemove(
+			ctx,
+			created.ID,
+			container.RemoveOptions{Force: true},
+		); err != nil {
+			slog.WarnContext(
+				ctx,
+				"remove smoke test container failed",
+				"container_id",
+				created.ID,
+				"err",
+				err,
+			)
+		}
+	}()
+
+	waitCh, errCh := c.docker.ContainerWait(ctx, created.ID, container.WaitConditionNextExit)
+	if err := c.docker.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to start smoke test container: %w", err)
+	}
+	var exitCode int
+	select {
+	case resp := <-waitCh:
+		if resp.Error != nil {
+			return nil, fmt.Errorf("smoke test container failed: %s", resp.Error.Message)
+		}
+		exitCode = int(resp.StatusCode)
+	case err := <-errCh:
+		return nil, fmt.Errorf("failed to wait for smoke test container: %w", err)
+	}
+
+	logs, err := c.docker.ContainerLogs(ctx, created.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read smoke test output: %w", err)
+	}
+	defer logs.Close()
+	output, err := io.ReadAll(logs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read smoke test output: %w", err)
+	}
+	return &SmokeTestResult{ExitCode: exitCode, Output: string(output)}, nil
+}
+
+// KubeSmokeTester runs the smoke test as a pod through kubectl, which picks
+// up the cluster from KUBECONFIG and the current context.
+type KubeSmokeTester struct {
+	binary          string
+	killGracePeriod time.Duration
+}
+
+func NewKubeSmokeTester(killGracePeriod time.Duration) *KubeSmokeTester {
+	return &KubeSmokeTester{binary: "kubectl", killGracePeriod: killGracePeriod}
+}
+
+// SmokeTest runs args in a pod created from the pushed image on a node of the
+// image platform and deletes the pod afterwards, including on cancellation.
+func (k *KubeSmokeTester) SmokeTest(
+	ctx context.Context,
+	image smokeTestImage,
+	args []string,
+) (*SmokeTestResult, error) {
+	if image.Pushed == nil {
+		return nil, fmt.Errorf("kubernetes smoke tests require a pushed image")
+	}
+	selector := map[string]string{
+		"kubernetes.io/os":   image.Platform.OS,
+		"kubernetes.io/arch": image.Platform.Architecture,
+	}
+	labelSelector := fmt.Sprintf(
+		"kubernetes.io/os=%s,kubernetes.io/arch=%s",
+		image.Platform.OS,
+		image.Platform.Architecture,
+	)
+	nodes, err := k.command(
+		ctx,
+		"get",
+		"nodes",
+		"--selector",
+		labelSelector,
+		"--output",
+		"name",
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	if len(bytes.TrimSpace(nodes)) == 0 {
+		return nil, fmt.Errorf(
+			"%w: no node matches %s",
+			errSmokeTestPlatformMismatch,
+			labelSelector,
+		)
+	}
+
+	pod, err := newSmokeTestPodName()
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"spec":       map[string]any{"nodeSelector": selector},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pod overrides: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), smokeTestRemoveTimeout)
+		defer cancel()
+		out, err := k.command(
+			ctx,
+			"delete",
+			"pod",
+			pod,
+			"--ignore-not-found",
+			"--wait=false",
+		).CombinedOutput()
+		if err != nil {
+			slog.WarnContext(
+				ctx,
+				"delete smoke test pod failed",
+				"pod",
+				pod,
+				"err",
+				err,
+				"output",
+				strings.TrimSpace(string(out)),
+			)
+		}
+	}()
+
+	runArgs := []string{
+		"run",
+		pod,
+		"--image",
+		image.Pushed.Name(),
+		"--restart=Never",
+		"--attach",
+		"--quiet",
+		"--overrides",
+		string(overrides),
+		"--command",
+		"--",
+	}
+	out, err := k.command(ctx, append(runArgs, args...)...).CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if ctx.Err() == nil && errors.As(err, &exitErr) {
+			return &SmokeTestResult{ExitCode: exitErr.ExitCode(), Output: string(out)}, nil
+		}
+		return nil, fmt.Errorf("failed to run smoke test pod: %w", err)
+	}
+	return &SmokeTestResult{Output: string(out)}, nil
+}
+
+func (k *KubeSmokeTester) command(ctx context.Context, args ...string) *exec.Cmd {
+	return interruptOnCancel(kubectlCommandContext(ctx, k.binary, args...), k.killGracePeriod)
+}
+
+func newSmokeTestPodName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate pod name: %w", err)
+	}
+	return "nix-containers-smoke-test-" + hex.EncodeToString(suffix), nil
+}
@@ -0,0 +1,242 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+type smokeTesterFunc func(context.Context, smokeTestImage, []string) (*SmokeTestResult, error)
+
+func (f smokeTesterFunc) SmokeTest(
+	ctx context.Context,
+	image smokeTestImage,
+	args []string,
+) (*SmokeTestResult, error) {
+	return f(ctx, image, args)
+}
+
+func newSmokeTestBuilderClients(
+	t *testing.T,
+) (*mockNixBuilderClient, *mockContainerBuilderClient) {
+	t.Helper()
+
+	nixClient, containerClient := newPlatformTagTestClients(t, "")
+	nixClient.GetImageBuilderTypeFunc = func(context.Context, string) (BuilderType, error) {
+		return StreamBuilderType, nil
+	}
+	containerClient.LoadStreamImageFunc = func(context.Context, name.Reference, string) (LoadedImage, error) {
+		return LoadedImage{Ref: mustParseReference(t, "ghcr.io/example/app:loaded")}, nil
+	}
+	return nixClient, containerClient
+}
+
+func TestBuilderSmokeTestSinglePlatform(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plat := &v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	tests := []struct {
+		name    string
+		result  *SmokeTestResult
+		err     error
+		wantErr string
+	}{
+		{name: "success", result: &SmokeTestResult{Output: "app 1.0\n"}},
+		{
+			name:    "non-zero exit",
+			result:  &SmokeTestResult{ExitCode: 3},
+			wantErr: "/bin/app exited with code 3",
+		},
+		{
+			name: "platform mismatch",
+			err:  fmt.Errorf("%w: docker daemon is linux/arm64", errSmokeTestPlatformMismatch),
+		},
+		{name: "tester error", err: errors.New("no such image"), wantErr: "no such image"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nixClient, containerClient := newSmokeTestBuilderClients(t)
+			var images []smokeTestImage
+			tester := smokeTesterFunc(
+				func(_ context.Context, image smokeTestImage, args []string) (*SmokeTestResult, error) {
+					images = append(images, image)
+					if !slices.Equal(args, []string{"/bin/app", "--version"}) {
+						t.Fatalf("unexpected args %q", args)
+					}
+					return tt.result, tt.err
+				},
+			)
+
+			builder := NewBuilder(
+				nixClient,
+				containerClient,
+				WithPush(true),
+				WithSmokeTest(tester, []string{"/bin/app", "--version"}, time.Minute),
+			)
+			_, err := builder.BuildAndPush(
+				context.Background(),
+				"/workspace",
+				ref,
+				[]*v1.Platform{plat},
+			)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("build and push failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("expected one smoke test, got %d", len(images))
+			}
+			if images[0].Loaded.Name() != ref.Name() || images[0].Pushed.Name() != ref.Name() {
+				t.Fatalf("unexpected smoke test image %+v", images[0])
+			}
+		})
+	}
+}
+
+func TestBuilderSmokeTestTimeout(t *testing.T) {
+	nixClient, containerClient := newSmokeTestBuilderClients(t)
+	tester := smokeTesterFunc(
+		func(ctx context.Context, _ smokeTestImage, _ []string) (*SmokeTestResult, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	)
+
+	builder := NewBuilder(
+		nixClient,
+		containerClient,
+		WithSmokeTest(tester, []string{"/bin/app"}, 10*time.Millisecond),
+	)
+	_, err := builder.BuildAndPush(
+		context.Background(),
+		"/workspace",
+		mustParseReference(t, "ghcr.io/example/app:latest"),
+		[]*v1.Platform{{OS: "linux", Architecture: "amd64"}},
+	)
+	if err == nil || !strings.Contains(err.Error(), "smoke test timed out after 10ms") {
+		t.Fatalf("expected smoke test timeout, got %v", err)
+	}
+}
+
+func TestBuilderSmokeTestMultiplatformLoadedImages(t *testing.T) {
+	ref := mustParseReference(t, "ghcr.io/example/app:latest")
+	plats := []*v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	nixClient, containerClient := newPlatformTagTestClients(t, "")
+
+	var tested []string
+	tester := smokeTesterFunc(
+		func(ctx context.Context, image smokeTestImage, _ []string) (*SmokeTestResult, error) {
+			if ctx.Err() != nil {
+				t.Fatalf("expected live context, got %v", ctx.Err())
+			}
+			if image.Pushed == nil || image.Pushed.Name() != image.Loaded.Name() {
+				t.Fatalf("expected loaded platform tag to be pushed, got %+v", image)
+			}
+			tested = append(tested, image.Loaded.Name())
+			if image.Platform.Architecture != "amd64" {
+				return nil, errSmokeTestPlatformMismatch
+			}
+			return &SmokeTestResult{}, nil
+		},
+	)
+
+	builder := NewBuilder(
+		nixClient,
+		containerClient,
+		WithPush(true),
+		WithLoad(true),
+		WithSmokeTest(tester, []string{"/bin/app"}, time.Minute),
+	)
+	if _, err := builder.BuildAndPush(context.Background(), "/workspace", ref, plats); err != nil {
+		t.Fatalf("build and push failed: %v", err)
+	}
+	want := []string{ref.Name() + "_linux_amd64", ref.Name() + "_linux_arm64"}
+	if !slices.Equal(tested, want) {
+		t.Fatalf("expected smoke tests on %q, got %q", want, tested)
+	}
+}
+
+func setupKubectlCommandTest(
+	t *testing.T,
+	nodes string,
+	output string,
+	exitCode int,
+) string {
+	t.Helper()
+
+	commandStubMu.Lock()
+	original := kubectlCommandContext
+	t.Cleanup(func() {
+		kubectlCommandContext = original
+		commandStubMu.Unlock()
+	})
+
+	argsFile := filepath.Join(t.TempDir(), "args.json")
+	getNodes := stubCommand(t, nodes, "", 0, "")
+	run := stubCommand(t, output, "", exitCode, "")
+	deletePod := stubCommand(t, "", "", 0, argsFile)
+	kubectlCommandContext = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		switch args[0] {
+		case "get":
+			return getNodes(ctx, command, args...)
+		case "run":
+			return run(ctx, command, args...)
+		default:
+			return deletePod(ctx, command, args...)
+		}
+	}
+	return argsFile
+}
+
+func TestKubeSmokeTester(t *testing.T) {
+	image := smokeTestImage{
+		Loaded:   mustParseReference(t, "ghcr.io/example/app:latest"),
+		Pushed:   mustParseReference(t, "ghcr.io/example/app:latest"),
+		Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+	}
+
+	argsFile := setupKubectlCommandTest(t, "node/worker-1\n", "boom\n", 3)
+	result, err := NewKubeSmokeTester(time.Second).SmokeTest(
+		context.Background(),
+		image,
+		[]string{"/bin/app"},
+	)
+	if err != nil {
+		t.Fatalf("smoke test failed: %v", err)
+	}
+	if result.ExitCode != 3 || result.Output != "boom\n" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	deleteArgs := readCapturedCommandArgs(t, argsFile)
+	if len(deleteArgs) < 4 || deleteArgs[1] != "delete" ||
+		!strings.HasPrefix(deleteArgs[3], "nix-containers-smoke-test-") {
+		t.Fatalf("expected smoke test pod deleted, got %q", deleteArgs)
+	}
+}
+
+func TestKubeSmokeTesterPlatformMismatch(t *testing.T) {
+	setupKubectlCommandTest(t, "", "", 0)
+	_, err := NewKubeSmokeTester(time.Second).SmokeTest(context.Background(), smokeTestImage{
+		Loaded:   mustParseReference(t, "ghcr.io/example/app:latest"),
+		Pushed:   mustParseReference(t, "ghcr.io/example/app:latest"),
+		Platform: &v1.Platform{OS: "linux", Architecture: "riscv64"},
+	}, []string{"/bin/app"})
+	if !errors.Is(err, errSmokeTestPlatformMismatch) {
+		t.Fatalf("expected platform mismatch, got %v", err)
+	}
+}
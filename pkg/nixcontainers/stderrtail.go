@@ -0,0 +1,126 @@
+package nixcontainers
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// stderrTailLines is how many of the last stderr lines of a failed
+	// command its error carries.
+	stderrTailLines = 100
+	// stderrTailBytes bounds the kept lines together, so the tail stays small
+	// whatever the command prints.
+	stderrTailBytes = 64 << 10
+	// stderrLineBytes bounds each kept line, so a single long line does not
+	// push out all the others.
+	stderrLineBytes = 4096
+)
+
+// nixBuildingPattern matches the stderr line of nix starting to build a
+// derivation, locally or on a remote builder.
+var nixBuildingPattern = regexp.MustCompile(`^building '([^']+\.drv)'`)
+
+// CommandError is a command failing, with the last lines it wrote to stderr.
+type CommandError struct {
+	// Command names the failed command, such as nix build.
+	Command string
+	// Stderr are the last lines of the stderr of the command.
+	Stderr []string
+	// OmittedLines is how many earlier stderr lines were dropped.
+	OmittedLines int
+	Err          error
+}
+
+func (e *CommandError) Error() string {
+	if len(e.Stderr) == 0 {
+		return e.Err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v\n  %s stderr:", e.Err, e.Command)
+	if e.OmittedLines > 0 {
+		fmt.Fprintf(&b, "\n    (%d earlier lines omitted)", e.OmittedLines)
+	}
+	for _, line := range e.Stderr {
+		b.WriteString("\n    ")
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// stderrTail keeps the last lines of the stderr of a command, a bounded
+// amount whatever its length, and the nix derivation it last started
+// building.
+type stderrTail struct {
+	mu       sync.Mutex
+	lines    []string
+	size     int
+	dropped  int
+	building string
+}
+
+func newStderrTail() *stderrTail {
+	return &stderrTail{lines: make([]string, 0, stderrTailLines)}
+}
+
+func (t *stderrTail) add(line string) {
+	if len(line) > stderrLineBytes {
+		line = line[:stderrLineBytes] + "..."
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m := nixBuildingPattern.FindStringSubmatch(line); m != nil {
+		t.building = derivationName(m[1])
+	}
+	t.lines = append(t.lines, line)
+	t.size += len(line)
+	for len(t.lines) > stderrTailLines || t.size > stderrTailBytes {
+		t.size -= len(t.lines[0])
+		t.lines = t.lines[1:]
+		t.dropped++
+	}
+}
+
+// currentDerivation returns the name of the derivation the build last
+// started, empty before any.
+func (t *stderrTail) currentDerivation() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.building
+}
+
+// String returns the kept lines in order.
+func (t *stderrTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// commandError returns err of command with the lines kept so far.
+func (t *stderrTail) commandError(command string, err error) *CommandError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &CommandError{
+		Command:      command,
+		Stderr:       slices.Clone(t.lines),
+		OmittedLines: t.dropped,
+		Err:          err,
+	}
+}
+
+// outputCommandError returns err of command with the tail of output, the
+// collected stderr of the command.
+func outputCommandError(command string, output []byte, err error) *CommandError {
+	tail := newStderrTail()
+	for line := range strings.Lines(string(output)) {
+		tail.add(strings.TrimRight(line, "\r\n"))
+	}
+	return tail.commandError(command, err)
+}
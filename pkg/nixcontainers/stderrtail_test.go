@@ -0,0 +1,72 @@
+package nixcontainers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStderrTail(t *testing.T) {
+	tail := newStderrTail()
+	if got := tail.currentDerivation(); got != "" {
+		t.Fatalf("expected no derivation before any build, got %q", got)
+	}
+	tail.add("building '/nix/store/abc-stream-app.drv' on 'ssh://builder'...")
+	if got := tail.currentDerivation(); got != "stream-app" {
+		t.Fatalf("expected stream-app being built, got %q", got)
+	}
+	tail = newStderrTail()
+	tail.add("first")
+	tail.add(strings.Repeat("x", 2*stderrLineBytes))
+	if got := tail.String(); got != "first\n"+strings.Repeat("x", stderrLineBytes)+"..." {
+		t.Fatalf("expected long lines cut, got %d bytes", len(got))
+	}
+	for i := range stderrTailLines {
+		tail.add(fmt.Sprint(i))
+	}
+	lines := strings.Split(tail.String(), "\n")
+	if len(lines) != stderrTailLines ||
+		lines[0] != "0" ||
+		lines[stderrTailLines-1] != fmt.Sprint(stderrTailLines-1) {
+		t.Fatalf("unexpected tail %q", lines)
+	}
+	if err := tail.commandError("nix build", errors.New("boom")); err.OmittedLines != 2 {
+		t.Fatalf("expected 2 lines omitted, got %d", err.OmittedLines)
+	}
+
+	tail = newStderrTail()
+	for range 20 {
+		tail.add(strings.Repeat("y", stderrLineBytes))
+	}
+	if err := tail.commandError("nix build", errors.New("boom")); len(err.Stderr) != 16 ||
+		err.OmittedLines != 4 {
+		t.Fatalf(
+			"expected the tail bounded to %d bytes, got %d lines after %d omitted",
+			stderrTailBytes,
+			len(err.Stderr),
+			err.OmittedLines,
+		)
+	}
+}
+
+func TestCommandErrorIndentsStderr(t *testing.T) {
+	inner := errors.New("exit status 1")
+	err := &CommandError{
+		Command:      "stream image",
+		Stderr:       []string{"tar: short write", "error: broken pipe"},
+		OmittedLines: 3,
+		Err:          inner,
+	}
+	want := "exit status 1\n  stream image stderr:\n    (3 earlier lines omitted)\n" +
+		"    tar: short write\n    error: broken pipe"
+	if got := err.Error(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if !errors.Is(err, inner) {
+		t.Fatal("expected the command error to wrap its error")
+	}
+	if got := (&CommandError{Command: "nix build", Err: inner}).Error(); got != "exit status 1" {
+		t.Fatalf("expected no stderr section without stderr, got %q", got)
+	}
+}
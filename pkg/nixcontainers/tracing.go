@@ -0,0 +1,59 @@
+package nixcontainers
+
+import (
+	"context"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the build pipeline spans. They are no-ops
+// until a tracer provider is registered with otel.SetTracerProvider.
+const tracerName = "github.com/shikanime-studio/nix-containers/pkg/nixcontainers"
+
+// Attribute keys of the pipeline spans.
+const (
+	imageRefKey    = attribute.Key("nix_containers.image.ref")
+	platformKey    = attribute.Key("nix_containers.platform")
+	outPathKey     = attribute.Key("nix_containers.nix.out_path")
+	bytesPushedKey = attribute.Key("nix_containers.push.bytes")
+)
+
+// refAttribute returns the image ref attribute of a span.
+func refAttribute(ref name.Reference) attribute.KeyValue {
+	return imageRefKey.String(ref.Name())
+}
+
+// platformAttribute returns the platform attribute of a span, empty for a
+// nil platform.
+func platformAttribute(p *v1.Platform) attribute.KeyValue {
+	if p == nil {
+		return platformKey.String("")
+	}
+	return platformKey.String(p.String())
+}
+
+// startSpan starts the span name under ctx. The tracer is looked up from the
+// registered provider every time, since one resolved before the provider is
+// registered stays bound to the first provider.
+func startSpan(
+	ctx context.Context,
+	name string,
+	attrs ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err and its class when it failed.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("error.type", string(ErrorClassOf(err))))
+	}
+	span.End()
+}
@@ -0,0 +1,83 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans registers a tracer provider recording the spans of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestContainerClientPushImageTracesPush(t *testing.T) {
+	recorder := recordSpans(t)
+	ref := newTestRegistryRef(t, registry.New(), "example/app:latest")
+	containerClient, err := NewContainerClient(
+		context.Background(),
+		WithContainerDockerClient(&client.Client{}),
+		WithContainerKeychain(fakeKeychain{}),
+	)
+	if err != nil {
+		t.Fatalf("create container client failed: %v", err)
+	}
+	if _, err := containerClient.PushImage(
+		context.Background(),
+		ref,
+		HostPlatform(),
+		writeTestImageArchive(t),
+		nil,
+	); err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "push image" {
+		t.Fatalf("expected a push image span, got %v", spans)
+	}
+	if v, _ := spanAttribute(spans[0], imageRefKey); v.AsString() != ref.Name() {
+		t.Fatalf("expected image ref %s, got %q", ref.Name(), v.AsString())
+	}
+	if v, _ := spanAttribute(spans[0], bytesPushedKey); v.AsInt64() <= 0 {
+		t.Fatalf("expected the pushed bytes to be recorded, got %d", v.AsInt64())
+	}
+}
+
+func TestEndSpanRecordsErrorClass(t *testing.T) {
+	recorder := recordSpans(t)
+	_, span := startSpan(context.Background(), "push image")
+	endSpan(span, ClassifyError(AuthErrorClass, errors.New("denied")))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+		t.Fatalf("expected a failed span, got %v", spans)
+	}
+	if v, _ := spanAttribute(spans[0], "error.type"); v.AsString() != string(AuthErrorClass) {
+		t.Fatalf("expected error type %s, got %q", AuthErrorClass, v.AsString())
+	}
+}
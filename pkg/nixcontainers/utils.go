@@ -0,0 +1,248 @@
+package nixcontainers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// maxTagLength is the longest tag registries accept.
+const maxTagLength = 128
+
+// FormatPlatformReference returns the tag the image of ref for p is loaded
+// and pushed as on its own, in the repository of ref: the tag of ref, or
+// sha256-<12 hex digits> for a digest, followed by the platform, as in
+// app:latest_linux_amd64. A tag too long for registries is truncated, ending
+// with a hash of the whole tag so that distinct tags stay distinct.
+func FormatPlatformReference(ref name.Reference, p *v1.Platform) name.Tag {
+	base := ref.Identifier()
+	if d, ok := ref.(name.Digest); ok {
+		algorithm, digest, _ := strings.Cut(d.DigestStr(), ":")
+		base = algorithm + "-" + digest[:min(len(digest), 12)]
+	}
+	suffix := "_" + p.OS + "_" + p.Architecture
+	if p.Variant != "" {
+		suffix += "_" + p.Variant
+	}
+	suffix = sanitizeTag(suffix)
+	base = sanitizeTag(base)
+	if len(base)+len(suffix) > maxTagLength {
+		sum := sha256.Sum256([]byte(base))
+		hash := hex.EncodeToString(sum[:])[:8]
+		base = base[:maxTagLength-len(suffix)-len(hash)-1] + "-" + hash
+	}
+	return ref.Context().Tag(base + suffix)
+}
+
+// sanitizeTag replaces the characters tags cannot hold with dashes.
+func sanitizeTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			r == '_' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, tag)
+}
+
+// formatSystemArch returns the nix architecture of p. OCI platforms name
+// 32-bit ARM arm with a v5, v6 or v7 variant where nix systems fold the
+// variant into the architecture, as in armv7l-linux.
+func formatSystemArch(p *v1.Platform) string {
+	switch p.Architecture {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "386":
+		return "i686"
+	case "arm":
+		switch p.Variant {
+		case "v5":
+			return "armv5tel"
+		case "v6":
+			return "armv6l"
+		case "", "v7":
+			return "armv7l"
+		}
+	}
+	return p.Architecture
+}
+
+// FormatSystemName returns the nix system of p, such as x86_64-linux.
+func FormatSystemName(p *v1.Platform) string {
+	return fmt.Sprintf("%s-%s", formatSystemArch(p), p.OS)
+}
+
+// ParseSystemName returns the platform of a nix system such as
+// aarch64-linux, the inverse of FormatSystemName.
+func ParseSystemName(system string) (*v1.Platform, error) {
+	arch, osName, ok := strings.Cut(system, "-")
+	if !ok || arch == "" || osName == "" {
+		return nil, fmt.Errorf("invalid nix system: %s", system)
+	}
+	p := &v1.Platform{OS: osName, Architecture: arch}
+	switch arch {
+	case "x86_64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armv5tel":
+		p.Architecture, p.Variant = "arm", "v5"
+	case "armv6l":
+		p.Architecture, p.Variant = "arm", "v6"
+	case "armv7l":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "i686":
+		p.Architecture = "386"
+	}
+	return p, nil
+}
+
+// FormatNixFlakePackageName returns the flake package of ref, the last
+// segment of its repository made a valid attribute name: lowercased, with
+// dots and other characters attribute paths cannot hold replaced by dashes.
+func FormatNixFlakePackageName(ref name.Reference) string {
+	repo := ref.Context().RepositoryStr()
+	segs := strings.Split(repo, "/")
+	return strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if !isNixAttrRune(r) {
+			return '-'
+		}
+		return r
+	}, segs[len(segs)-1])
+}
+
+// ValidNixAttrName reports whether s can name a flake package in an attribute
+// path without quoting.
+func ValidNixAttrName(s string) bool {
+	return s != "" && !strings.ContainsFunc(s, func(r rune) bool { return !isNixAttrRune(r) })
+}
+
+func isNixAttrRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '_' || r == '-' || r == '\''
+}
+
+// FormatNixFlakePackage returns the flake output attribute of the image of ref
+// for p in buildContext.
+func FormatNixFlakePackage(buildContext string, ref name.Reference, p *v1.Platform) string {
+	return FormatNixFlakeAttribute(buildContext, FormatNixFlakePackageName(ref), p)
+}
+
+// FormatFlakeDir returns the reference of the flake in the subdirectory dir
+// of flakeRef, appending the dir parameter to the query flakeRef may carry.
+func FormatFlakeDir(flakeRef, dir string) string {
+	if dir == "" {
+		return flakeRef
+	}
+	sep := "?"
+	if strings.Contains(flakeRef, "?") {
+		sep = "&"
+	}
+	return flakeRef + sep + "dir=" + dir
+}
+
+// FormatNixFlakeAttribute returns the flake output attribute of the package
+// pkg for p in buildContext.
+func FormatNixFlakeAttribute(buildContext, pkg string, p *v1.Platform) string {
+	return fmt.Sprintf("%s#packages.%s.%s", buildContext, FormatSystemName(p), pkg)
+}
+
+// PlatformEquals reports whether a and b have the same os, architecture and
+// variant.
+func PlatformEquals(a, b *v1.Platform) bool {
+	return a.OS == b.OS && a.Architecture == b.Architecture && a.Variant == b.Variant
+}
+
+// phaseTimeoutError is the cancellation cause of a context bounded by
+// PhaseTimeoutContext, naming the phase that ran out of time.
+type phaseTimeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *phaseTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.phase, e.timeout)
+}
+
+func (e *phaseTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// PhaseTimeoutContext bounds ctx by timeout, or only makes it cancelable when
+// timeout is zero.
+func PhaseTimeoutContext(
+	ctx context.Context,
+	phase string,
+	timeout time.Duration,
+) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, &phaseTimeoutError{phase: phase, timeout: timeout})
+}
+
+// WrapPhaseTimeout prefixes err with the phase timeout when ctx, created by
+// PhaseTimeoutContext, hit its deadline.
+func WrapPhaseTimeout(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var timeoutErr *phaseTimeoutError
+	if errors.As(context.Cause(ctx), &timeoutErr) {
+		return fmt.Errorf("%w: %w", timeoutErr, err)
+	}
+	return err
+}
+
+// DefaultKillGracePeriod is how long an interrupted child process may take to
+// exit after SIGINT before it is killed.
+const DefaultKillGracePeriod = 10 * time.Second
+
+// interruptOnCancel makes cmd receive SIGINT when its context is done, so
+// nix and image streams can clean up, and SIGKILL if it is still running
+// after grace.
+func interruptOnCancel(cmd *exec.Cmd, grace time.Duration) *exec.Cmd {
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = grace
+	return cmd
+}
+
+// HostPlatform returns the linux platform of the running architecture.
+func HostPlatform() *v1.Platform {
+	return &v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+// ParsePlatform splits an os/arch[/variant] string into a platform. Missing
+// segments are left empty for the caller to validate.
+func ParsePlatform(s string) *v1.Platform {
+	seg := strings.SplitN(s, "/", 3)
+	operatingSystem := ""
+	arch := ""
+	variant := ""
+	if len(seg) > 0 {
+		operatingSystem = seg[0]
+	}
+	if len(seg) > 1 {
+		arch = seg[1]
+	}
+	if len(seg) > 2 {
+		variant = seg[2]
+	}
+	return &v1.Platform{OS: operatingSystem, Architecture: arch, Variant: variant}
+}
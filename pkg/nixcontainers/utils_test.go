@@ -0,0 +1,316 @@
+package nixcontainers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestFormatSystemName(t *testing.T) {
+	got := FormatSystemName(&v1.Platform{OS: "linux", Architecture: "arm64"})
+	if got != "aarch64-linux" {
+		t.Fatalf("expected aarch64-linux, got %s", got)
+	}
+}
+
+func TestFormatNixFlakePackage(t *testing.T) {
+	ref, err := name.ParseReference("ghcr.io/shikanime/shikanime/catbox:latest")
+	if err != nil {
+		t.Fatalf("parse reference failed: %v", err)
+	}
+
+	got := FormatNixFlakePackage(
+		"/workspace",
+		ref,
+		&v1.Platform{OS: "linux", Architecture: "amd64"},
+	)
+	want := "/workspace#packages.x86_64-linux.catbox"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestFormatNixFlakePackageFlakeURLs(t *testing.T) {
+	ref, err := name.ParseReference("ghcr.io/example/app:latest")
+	if err != nil {
+		t.Fatalf("parse reference failed: %v", err)
+	}
+	tests := []struct {
+		buildContext string
+		want         string
+	}{
+		{
+			buildContext: "github:org/repo",
+			want:         "github:org/repo#packages.x86_64-linux.app",
+		},
+		{
+			buildContext: "github:org/repo?ref=v1.2.0",
+			want:         "github:org/repo?ref=v1.2.0#packages.x86_64-linux.app",
+		},
+		{
+			buildContext: "git+https://example.com/repo.git?ref=main&rev=0123abcd",
+			want:         "git+https://example.com/repo.git?ref=main&rev=0123abcd#packages.x86_64-linux.app",
+		},
+		{
+			buildContext: "git+ssh://git@example.com/repo.git?dir=images",
+			want:         "git+ssh://git@example.com/repo.git?dir=images#packages.x86_64-linux.app",
+		},
+		{
+			buildContext: "path:/src/app",
+			want:         "path:/src/app#packages.x86_64-linux.app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.buildContext, func(t *testing.T) {
+			got := FormatNixFlakePackage(
+				tt.buildContext,
+				ref,
+				&v1.Platform{OS: "linux", Architecture: "amd64"},
+			)
+			if got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFormatFlakeDir(t *testing.T) {
+	tests := []struct {
+		flakeRef string
+		dir      string
+		want     string
+	}{
+		{flakeRef: "github:org/repo", want: "github:org/repo"},
+		{flakeRef: "github:org/repo", dir: "services/api", want: "github:org/repo?dir=services/api"},
+		{
+			flakeRef: "git+https://example.com/repo.git?ref=main",
+			dir:      "services/api",
+			want:     "git+https://example.com/repo.git?ref=main&dir=services/api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			ref, err := name.ParseReference("ghcr.io/example/app:latest")
+			if err != nil {
+				t.Fatalf("parse reference failed: %v", err)
+			}
+			got := FormatNixFlakePackage(
+				FormatFlakeDir(tt.flakeRef, tt.dir),
+				ref,
+				&v1.Platform{OS: "linux", Architecture: "amd64"},
+			)
+			if want := tt.want + "#packages.x86_64-linux.app"; got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestFormatNixFlakePackageNameSanitizes(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "ghcr.io/example/app:latest", want: "app"},
+		{ref: "ghcr.io/example/api.v2:latest", want: "api-v2"},
+		{ref: "ghcr.io/example/web_ui-next:latest", want: "web_ui-next"},
+	}
+	for _, tt := range tests {
+		ref, err := name.ParseReference(tt.ref)
+		if err != nil {
+			t.Fatalf("parse reference failed: %v", err)
+		}
+		if got := FormatNixFlakePackageName(ref); got != tt.want {
+			t.Fatalf("expected %s package %s, got %s", tt.ref, tt.want, got)
+		}
+		if !ValidNixAttrName(FormatNixFlakePackageName(ref)) {
+			t.Fatalf("expected the package of %s to be a valid attribute name", tt.ref)
+		}
+	}
+	for _, attr := range []string{"", "api.v2", "api v2", "api/v2"} {
+		if ValidNixAttrName(attr) {
+			t.Fatalf("expected %q not to be a valid attribute name", attr)
+		}
+	}
+	if !ValidNixAttrName("apiV2") {
+		t.Fatalf("expected apiV2 to be a valid attribute name")
+	}
+}
+
+func TestPlatformFormatting(t *testing.T) {
+	ref, err := name.ParseReference("ghcr.io/example/app:latest")
+	if err != nil {
+		t.Fatalf("parse reference failed: %v", err)
+	}
+
+	tests := []struct {
+		platform    string
+		want        v1.Platform
+		system      string
+		platformRef string
+	}{
+		{
+			platform:    "linux/amd64",
+			want:        v1.Platform{OS: "linux", Architecture: "amd64"},
+			system:      "x86_64-linux",
+			platformRef: "ghcr.io/example/app:latest_linux_amd64",
+		},
+		{
+			platform:    "linux/arm64",
+			want:        v1.Platform{OS: "linux", Architecture: "arm64"},
+			system:      "aarch64-linux",
+			platformRef: "ghcr.io/example/app:latest_linux_arm64",
+		},
+		{
+			platform:    "linux/arm/v6",
+			want:        v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"},
+			system:      "armv6l-linux",
+			platformRef: "ghcr.io/example/app:latest_linux_arm_v6",
+		},
+		{
+			platform:    "linux/arm/v7",
+			want:        v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			system:      "armv7l-linux",
+			platformRef: "ghcr.io/example/app:latest_linux_arm_v7",
+		},
+		{
+			platform:    "linux/arm/v5",
+			want:        v1.Platform{OS: "linux", Architecture: "arm", Variant: "v5"},
+			system:      "armv5tel-linux",
+			platformRef: "ghcr.io/example/app:latest_linux_arm_v5",
+		},
+		{
+			platform:    "linux/386",
+			want:        v1.Platform{OS: "linux", Architecture: "386"},
+			system:      "i686-linux",
+			platformRef: "ghcr.io/example/app:latest_linux_386",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			p := ParsePlatform(tt.platform)
+			if !p.Equals(tt.want) || p.Variant != tt.want.Variant {
+				t.Fatalf("expected platform %+v, got %+v", tt.want, *p)
+			}
+			if got := FormatSystemName(p); got != tt.system {
+				t.Fatalf("expected system %s, got %s", tt.system, got)
+			}
+			parsed, err := ParseSystemName(tt.system)
+			if err != nil {
+				t.Fatalf("parse system failed: %v", err)
+			}
+			if !parsed.Equals(tt.want) || parsed.Variant != tt.want.Variant {
+				t.Fatalf("expected system %s to parse as %+v, got %+v", tt.system, tt.want, *parsed)
+			}
+			wantPackage := "/workspace#packages." + tt.system + ".app"
+			if got := FormatNixFlakePackage("/workspace", ref, p); got != wantPackage {
+				t.Fatalf("expected flake package %s, got %s", wantPackage, got)
+			}
+			platformRef := FormatPlatformReference(ref, p)
+			if got := platformRef.Name(); got != tt.platformRef {
+				t.Fatalf("expected platform ref %s, got %s", tt.platformRef, got)
+			}
+		})
+	}
+}
+
+func TestFormatPlatformReference(t *testing.T) {
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	armv7 := &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	longTag := strings.Repeat("a", 125)
+	tests := []struct {
+		name string
+		ref  string
+		p    *v1.Platform
+		want string
+	}{
+		{
+			name: "tag",
+			ref:  "ghcr.io/example/app:1.0",
+			p:    armv7,
+			want: "ghcr.io/example/app:1.0_linux_arm_v7",
+		},
+		{
+			name: "no explicit tag",
+			ref:  "ghcr.io/example/app",
+			p:    amd64,
+			want: "ghcr.io/example/app:latest_linux_amd64",
+		},
+		{
+			name: "digest",
+			ref:  "ghcr.io/example/app@" + digest,
+			p:    amd64,
+			want: "ghcr.io/example/app:sha256-abababababab_linux_amd64",
+		},
+		{
+			name: "registry with a port",
+			ref:  "localhost:5000/example/app:latest",
+			p:    amd64,
+			want: "localhost:5000/example/app:latest_linux_amd64",
+		},
+		{
+			name: "long tag",
+			ref:  "ghcr.io/example/app:" + longTag,
+			p:    amd64,
+			want: "ghcr.io/example/app:" + longTag[:107] + "-a8e1a0f3_linux_amd64",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := name.ParseReference(tt.ref)
+			if err != nil {
+				t.Fatalf("parse reference failed: %v", err)
+			}
+			got := FormatPlatformReference(ref, tt.p)
+			if got.Name() != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got.Name())
+			}
+			if len(got.TagStr()) > maxTagLength {
+				t.Fatalf(
+					"expected a tag of at most %d characters, got %d",
+					maxTagLength,
+					len(got.TagStr()),
+				)
+			}
+			if _, err := name.NewTag(got.String()); err != nil {
+				t.Fatalf("expected a valid tag, got %v", err)
+			}
+		})
+	}
+
+	// Tags truncated to the same prefix stay distinct.
+	a := FormatPlatformReference(mustParseReference(t, "ghcr.io/example/app:"+longTag+"a"), amd64)
+	b := FormatPlatformReference(mustParseReference(t, "ghcr.io/example/app:"+longTag+"b"), amd64)
+	if a.Name() == b.Name() {
+		t.Fatalf("expected distinct platform tags, got %s for both", a.Name())
+	}
+}
+
+func TestWrapPhaseTimeout(t *testing.T) {
+	ctx, cancel := PhaseTimeoutContext(context.Background(), "push", time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := WrapPhaseTimeout(ctx, errors.New("write failed"))
+	if err == nil || err.Error() != "push timed out after 1ms: write failed" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error to match context.DeadlineExceeded")
+	}
+
+	ctx, cancel = PhaseTimeoutContext(context.Background(), "push", 0)
+	cancel()
+	if err := WrapPhaseTimeout(ctx, errors.New("canceled")); err.Error() != "canceled" {
+		t.Fatalf("expected cancellation without timeout to be unchanged, got %v", err)
+	}
+}